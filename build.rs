@@ -0,0 +1,61 @@
+use std::fs;
+use std::path::Path;
+use std::process::Command;
+
+/// Embed the git commit and the version of the linked nmstate library,
+/// both of which are printed by the `version` command.
+fn main() {
+    let manifest_dir = std::env::var("CARGO_MANIFEST_DIR").expect("set by cargo");
+    let manifest_dir = Path::new(&manifest_dir);
+
+    println!("cargo:rerun-if-changed=Cargo.lock");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs");
+
+    let commit = git_commit(manifest_dir).unwrap_or_else(|| "unknown".to_string());
+    let nmstate_version = fs::read_to_string(manifest_dir.join("Cargo.lock"))
+        .ok()
+        .and_then(|lock| locked_version(&lock, "nmstate"))
+        .unwrap_or_else(|| "unknown".to_string());
+
+    println!("cargo:rustc-env=NMC_GIT_COMMIT={commit}");
+    println!("cargo:rustc-env=NMC_NMSTATE_VERSION={nmstate_version}");
+}
+
+/// Short hash of the checked out commit. Unavailable when building from a source
+/// archive or a container context which does not include the git metadata.
+fn git_commit(dir: &Path) -> Option<String> {
+    let output = Command::new("git")
+        .args(["rev-parse", "--short", "HEAD"])
+        .current_dir(dir)
+        .output()
+        .ok()?;
+
+    if !output.status.success() {
+        return None;
+    }
+
+    let commit = String::from_utf8(output.stdout).ok()?.trim().to_string();
+    (!commit.is_empty()).then_some(commit)
+}
+
+/// Version of the given package as resolved in the lock file.
+fn locked_version(lock: &str, package: &str) -> Option<String> {
+    let name = format!("name = \"{package}\"");
+    let mut lines = lock.lines();
+
+    while let Some(line) = lines.next() {
+        if line.trim() != name {
+            continue;
+        }
+
+        return lines
+            .next()?
+            .trim()
+            .strip_prefix("version = \"")?
+            .strip_suffix('"')
+            .map(str::to_string);
+    }
+
+    None
+}
@@ -0,0 +1,597 @@
+use std::io;
+use std::mem;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+use std::os::fd::{AsRawFd, FromRawFd, OwnedFd};
+use std::time::{Duration, Instant};
+
+use anyhow::anyhow;
+use log::{debug, warn};
+use network_interface::NetworkInterface;
+
+use crate::apply_conf::ConnectionFile;
+use crate::keyfile::Keyfile;
+
+const ETH_P_ARP: u16 = 0x0806;
+const ETH_P_IPV6: u16 = 0x86DD;
+const ETH_HEADER_LEN: usize = 14;
+const IPV6_HEADER_LEN: usize = 40;
+
+const ICMPV6_NEXT_HEADER: u8 = 58;
+const ICMPV6_NEIGHBOR_SOLICITATION: u8 = 135;
+const ICMPV6_NEIGHBOR_ADVERTISEMENT: u8 = 136;
+const ND_OPT_TARGET_LINK_LAYER_ADDR: u8 = 2;
+
+const PROBE_COUNT: u32 = 3;
+const PROBE_INTERVAL: Duration = Duration::from_millis(300);
+
+type MacAddr = [u8; 6];
+
+/// Behaviour on detecting an address which is already in use on the network.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(crate) enum ProbeMode {
+    Warn,
+    Fail,
+}
+
+/// Probe all statically assigned IPv4 (ARP) and IPv6 (Neighbor Solicitation) addresses
+/// in the given connection files for duplicates on the network.
+///
+/// Addresses which can't be probed, e.g. those of virtual interfaces (VLANs, bonds) NetworkManager only creates
+/// once it activates the files, are reported as unchecked and returned, but never fail the check.
+pub(crate) fn check_duplicate_addresses(
+    files: &[ConnectionFile],
+    network_interfaces: &[NetworkInterface],
+    mode: ProbeMode,
+) -> Result<Vec<String>, anyhow::Error> {
+    let mut conflicts = Vec::new();
+    let mut unchecked = Vec::new();
+
+    for file in files {
+        let keyfile = Keyfile::parse(&file.contents);
+        let addresses = static_addresses(&keyfile);
+        if addresses.is_empty() {
+            continue;
+        }
+
+        let interface_name = keyfile
+            .get("connection", "interface-name")
+            .unwrap_or(&file.name);
+
+        let Some(nic) = network_interfaces
+            .iter()
+            .find(|nic| nic.name == interface_name)
+        else {
+            warn!(
+                interface = interface_name;
+                "Skipping duplicate address check for '{interface_name}': interface not present"
+            );
+            unchecked.extend(
+                addresses
+                    .iter()
+                    .map(|address| format!("{address} on '{interface_name}'")),
+            );
+            continue;
+        };
+
+        let Some(mac) = nic.mac_addr.as_deref().and_then(parse_mac) else {
+            warn!(
+                interface = interface_name;
+                "Skipping duplicate address check for '{interface_name}': no MAC address"
+            );
+            unchecked.extend(
+                addresses
+                    .iter()
+                    .map(|address| format!("{address} on '{interface_name}'")),
+            );
+            continue;
+        };
+
+        for address in addresses {
+            debug!(
+                interface = interface_name;
+                "Probing address {address} on '{interface_name}'..."
+            );
+
+            match probe(nic.index, mac, address) {
+                Ok(None) => debug!("Address {address} is not in use"),
+                Ok(Some(owner)) => {
+                    let owner = format_mac(&owner);
+                    warn!(
+                        interface = interface_name;
+                        "Address {address} on '{interface_name}' is already in use by {owner}"
+                    );
+                    conflicts.push(format!("{address} ({owner})"));
+                }
+                Err(err) => {
+                    warn!(
+                        interface = interface_name;
+                        "Probing address {address} on '{interface_name}' failed: {err}"
+                    );
+                    unchecked.push(format!("{address} on '{interface_name}'"));
+                }
+            }
+        }
+    }
+
+    if !unchecked.is_empty() {
+        warn!(
+            "Could not check {} address(es) for duplicates: {}",
+            unchecked.len(),
+            unchecked.join(", ")
+        );
+    }
+
+    if !conflicts.is_empty() && mode == ProbeMode::Fail {
+        return Err(anyhow!(
+            "Detected duplicate addresses: {}",
+            conflicts.join(", ")
+        ));
+    }
+
+    Ok(unchecked)
+}
+
+/// Extract the statically assigned addresses from the `[ipv4]` and `[ipv6]` sections.
+///
+/// Keyfile values are in the `address/prefix[,gateway]` format, e.g. `address1=192.168.1.5/24,192.168.1.1`.
+fn static_addresses(keyfile: &Keyfile) -> Vec<IpAddr> {
+    ["ipv4", "ipv6"]
+        .iter()
+        .flat_map(|section| keyfile.entries(section))
+        .filter(|(key, _)| key.starts_with("address"))
+        .flat_map(|(_, value)| value.split(';'))
+        .filter_map(|value| value.split([',', '/']).next())
+        .filter_map(|ip| ip.trim().parse().ok())
+        .collect()
+}
+
+fn probe(ifindex: u32, mac: MacAddr, address: IpAddr) -> io::Result<Option<MacAddr>> {
+    match address {
+        IpAddr::V4(ip) => {
+            let socket = PacketSocket::open(ifindex, ETH_P_ARP)?;
+            let frame = arp_probe_frame(mac, ip);
+
+            socket.probe([0xff; 6], &frame, |reply| arp_conflict(reply, mac, ip))
+        }
+        IpAddr::V6(ip) => {
+            let socket = PacketSocket::open(ifindex, ETH_P_IPV6)?;
+            let frame = neighbor_solicitation_frame(mac, ip);
+            let destination = solicited_node_mac(ip);
+
+            socket.probe(destination, &frame, |reply| na_conflict(reply, mac, ip))
+        }
+    }
+}
+
+/// Build an ARP probe as defined in RFC 5227 (sender IP address set to 0.0.0.0).
+fn arp_probe_frame(mac: MacAddr, ip: Ipv4Addr) -> Vec<u8> {
+    let mut frame = Vec::with_capacity(ETH_HEADER_LEN + 28);
+
+    frame.extend_from_slice(&[0xff; 6]);
+    frame.extend_from_slice(&mac);
+    frame.extend_from_slice(&ETH_P_ARP.to_be_bytes());
+
+    frame.extend_from_slice(&1u16.to_be_bytes()); // hardware type: Ethernet
+    frame.extend_from_slice(&0x0800u16.to_be_bytes()); // protocol type: IPv4
+    frame.extend_from_slice(&[6, 4]); // hardware and protocol address lengths
+    frame.extend_from_slice(&1u16.to_be_bytes()); // operation: request
+    frame.extend_from_slice(&mac);
+    frame.extend_from_slice(&[0; 4]);
+    frame.extend_from_slice(&[0; 6]);
+    frame.extend_from_slice(&ip.octets());
+
+    frame
+}
+
+/// Returns the sender MAC address if the frame is an ARP packet from another host claiming the given IP.
+fn arp_conflict(frame: &[u8], mac: MacAddr, ip: Ipv4Addr) -> Option<MacAddr> {
+    if frame.len() < ETH_HEADER_LEN + 28 || frame[12..14] != ETH_P_ARP.to_be_bytes() {
+        return None;
+    }
+
+    let arp = &frame[ETH_HEADER_LEN..];
+    let sender_mac: MacAddr = arp[8..14].try_into().ok()?;
+
+    (arp[14..18] == ip.octets() && sender_mac != mac).then_some(sender_mac)
+}
+
+/// Build a Neighbor Solicitation for duplicate address detection as defined in RFC 4862
+/// (unspecified source address, solicited-node multicast destination).
+fn neighbor_solicitation_frame(mac: MacAddr, ip: Ipv6Addr) -> Vec<u8> {
+    let source = Ipv6Addr::UNSPECIFIED;
+    let destination = solicited_node_address(ip);
+
+    let mut icmp = vec![ICMPV6_NEIGHBOR_SOLICITATION, 0, 0, 0, 0, 0, 0, 0];
+    icmp.extend_from_slice(&ip.octets());
+
+    let checksum = icmpv6_checksum(source, destination, &icmp);
+    icmp[2..4].copy_from_slice(&checksum.to_be_bytes());
+
+    let mut frame = Vec::with_capacity(ETH_HEADER_LEN + IPV6_HEADER_LEN + icmp.len());
+
+    frame.extend_from_slice(&solicited_node_mac(ip));
+    frame.extend_from_slice(&mac);
+    frame.extend_from_slice(&ETH_P_IPV6.to_be_bytes());
+
+    frame.extend_from_slice(&[0x60, 0, 0, 0]); // version, traffic class, flow label
+    frame.extend_from_slice(&(icmp.len() as u16).to_be_bytes());
+    frame.extend_from_slice(&[ICMPV6_NEXT_HEADER, 255]); // next header, hop limit
+    frame.extend_from_slice(&source.octets());
+    frame.extend_from_slice(&destination.octets());
+    frame.extend_from_slice(&icmp);
+
+    frame
+}
+
+/// Returns the advertised link-layer address if the frame is a Neighbor Advertisement
+/// from another host for the given IP.
+fn na_conflict(frame: &[u8], mac: MacAddr, ip: Ipv6Addr) -> Option<MacAddr> {
+    let icmp_start = ETH_HEADER_LEN + IPV6_HEADER_LEN;
+
+    if frame.len() < icmp_start + 24
+        || frame[12..14] != ETH_P_IPV6.to_be_bytes()
+        || frame[ETH_HEADER_LEN + 6] != ICMPV6_NEXT_HEADER
+    {
+        return None;
+    }
+
+    let icmp = &frame[icmp_start..];
+    if icmp[0] != ICMPV6_NEIGHBOR_ADVERTISEMENT || icmp[8..24] != ip.octets() {
+        return None;
+    }
+
+    let source_mac: MacAddr = frame[6..12].try_into().ok()?;
+    if source_mac == mac {
+        return None;
+    }
+
+    let advertised_mac = icmp[24..]
+        .chunks_exact(8)
+        .find(|option| option[0] == ND_OPT_TARGET_LINK_LAYER_ADDR && option[1] == 1)
+        .and_then(|option| option[2..8].try_into().ok());
+
+    Some(advertised_mac.unwrap_or(source_mac))
+}
+
+fn solicited_node_address(ip: Ipv6Addr) -> Ipv6Addr {
+    let o = ip.octets();
+    Ipv6Addr::from([
+        0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, o[13], o[14], o[15],
+    ])
+}
+
+fn solicited_node_mac(ip: Ipv6Addr) -> MacAddr {
+    let o = ip.octets();
+    [0x33, 0x33, 0xff, o[13], o[14], o[15]]
+}
+
+fn icmpv6_checksum(source: Ipv6Addr, destination: Ipv6Addr, message: &[u8]) -> u16 {
+    let mut pseudo_header = Vec::with_capacity(40 + message.len());
+    pseudo_header.extend_from_slice(&source.octets());
+    pseudo_header.extend_from_slice(&destination.octets());
+    pseudo_header.extend_from_slice(&(message.len() as u32).to_be_bytes());
+    pseudo_header.extend_from_slice(&[0, 0, 0, ICMPV6_NEXT_HEADER]);
+    pseudo_header.extend_from_slice(message);
+
+    let mut sum: u32 = pseudo_header
+        .chunks(2)
+        .map(|chunk| u32::from(u16::from_be_bytes([chunk[0], *chunk.get(1).unwrap_or(&0)])))
+        .sum();
+
+    while sum >> 16 != 0 {
+        sum = (sum & 0xffff) + (sum >> 16);
+    }
+
+    !(sum as u16)
+}
+
+fn parse_mac(mac: &str) -> Option<MacAddr> {
+    let octets = mac
+        .split(':')
+        .map(|octet| u8::from_str_radix(octet, 16).ok())
+        .collect::<Option<Vec<u8>>>()?;
+
+    octets.try_into().ok()
+}
+
+fn format_mac(mac: &MacAddr) -> String {
+    mac.iter()
+        .map(|octet| format!("{octet:02x}"))
+        .collect::<Vec<_>>()
+        .join(":")
+}
+
+/// Raw `AF_PACKET` socket bound to a single interface.
+struct PacketSocket {
+    fd: OwnedFd,
+    ifindex: u32,
+}
+
+impl PacketSocket {
+    fn open(ifindex: u32, protocol: u16) -> io::Result<Self> {
+        let fd = unsafe {
+            libc::socket(
+                libc::AF_PACKET,
+                libc::SOCK_RAW | libc::SOCK_CLOEXEC,
+                i32::from(protocol.to_be()),
+            )
+        };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        let socket = PacketSocket {
+            fd: unsafe { OwnedFd::from_raw_fd(fd) },
+            ifindex,
+        };
+
+        let address = socket.address(protocol, [0; 6]);
+        let result = unsafe {
+            libc::bind(
+                socket.fd.as_raw_fd(),
+                &address as *const libc::sockaddr_ll as *const libc::sockaddr,
+                mem::size_of::<libc::sockaddr_ll>() as libc::socklen_t,
+            )
+        };
+        if result < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(socket)
+    }
+
+    fn address(&self, protocol: u16, destination: MacAddr) -> libc::sockaddr_ll {
+        let mut address: libc::sockaddr_ll = unsafe { mem::zeroed() };
+        address.sll_family = libc::AF_PACKET as libc::c_ushort;
+        address.sll_protocol = protocol.to_be();
+        address.sll_ifindex = self.ifindex as libc::c_int;
+        address.sll_halen = destination.len() as libc::c_uchar;
+        address.sll_addr[..destination.len()].copy_from_slice(&destination);
+        address
+    }
+
+    /// Send the frame up to `PROBE_COUNT` times and return the first conflict reported by `matcher`.
+    fn probe<F>(
+        &self,
+        destination: MacAddr,
+        frame: &[u8],
+        matcher: F,
+    ) -> io::Result<Option<MacAddr>>
+    where
+        F: Fn(&[u8]) -> Option<MacAddr>,
+    {
+        let mut buffer = [0u8; 1500];
+
+        for _ in 0..PROBE_COUNT {
+            self.send(destination, frame)?;
+
+            let deadline = Instant::now() + PROBE_INTERVAL;
+            while let Some(timeout) = deadline.checked_duration_since(Instant::now()) {
+                let Some(len) = self.receive(&mut buffer, timeout)? else {
+                    break;
+                };
+
+                if let Some(mac) = matcher(&buffer[..len]) {
+                    return Ok(Some(mac));
+                }
+            }
+        }
+
+        Ok(None)
+    }
+
+    fn send(&self, destination: MacAddr, frame: &[u8]) -> io::Result<()> {
+        let protocol = u16::from_be_bytes([frame[12], frame[13]]);
+        let address = self.address(protocol, destination);
+
+        let result = unsafe {
+            libc::sendto(
+                self.fd.as_raw_fd(),
+                frame.as_ptr() as *const libc::c_void,
+                frame.len(),
+                0,
+                &address as *const libc::sockaddr_ll as *const libc::sockaddr,
+                mem::size_of::<libc::sockaddr_ll>() as libc::socklen_t,
+            )
+        };
+        if result < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(())
+    }
+
+    fn receive(&self, buffer: &mut [u8], timeout: Duration) -> io::Result<Option<usize>> {
+        let mut poll_fd = libc::pollfd {
+            fd: self.fd.as_raw_fd(),
+            events: libc::POLLIN,
+            revents: 0,
+        };
+
+        let timeout = timeout.as_millis().clamp(1, i32::MAX as u128) as libc::c_int;
+        let ready = unsafe { libc::poll(&mut poll_fd, 1, timeout) };
+        if ready < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        if ready == 0 {
+            return Ok(None);
+        }
+
+        let len = unsafe {
+            libc::recv(
+                self.fd.as_raw_fd(),
+                buffer.as_mut_ptr() as *mut libc::c_void,
+                buffer.len(),
+                0,
+            )
+        };
+        if len < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(Some(len as usize))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+
+    use network_interface::NetworkInterface;
+
+    use crate::address_probe::{
+        arp_conflict, arp_probe_frame, check_duplicate_addresses, format_mac, icmpv6_checksum,
+        na_conflict, neighbor_solicitation_frame, parse_mac, solicited_node_address,
+        static_addresses, ProbeMode, ETH_HEADER_LEN, IPV6_HEADER_LEN,
+    };
+    use crate::apply_conf::ConnectionFile;
+    use crate::keyfile::Keyfile;
+
+    const LOCAL_MAC: [u8; 6] = [0x00, 0x11, 0x22, 0x33, 0x44, 0x55];
+    const REMOTE_MAC: [u8; 6] = [0x00, 0x11, 0x22, 0x33, 0x44, 0x66];
+
+    #[test]
+    fn extract_static_addresses() {
+        let keyfile = Keyfile::parse(
+            r#"
+[connection]
+id=eth0
+
+[ipv4]
+address1=192.168.123.1/24,192.168.123.254
+address2=192.168.124.1/24
+dns=192.168.123.100;
+method=manual
+
+[ipv6]
+addresses=2001:db8::1/64;2001:db8::2/64;
+method=manual
+"#,
+        );
+
+        assert_eq!(
+            static_addresses(&keyfile),
+            vec![
+                "192.168.123.1".parse::<IpAddr>().unwrap(),
+                "192.168.124.1".parse().unwrap(),
+                "2001:db8::1".parse().unwrap(),
+                "2001:db8::2".parse().unwrap(),
+            ]
+        );
+        assert!(static_addresses(&Keyfile::parse("[ipv4]\nmethod=auto")).is_empty());
+    }
+
+    #[test]
+    fn detect_arp_conflict() {
+        let ip = Ipv4Addr::new(192, 168, 1, 5);
+
+        let mut reply = arp_probe_frame(REMOTE_MAC, ip);
+        reply[ETH_HEADER_LEN + 7] = 2; // reply
+        reply[ETH_HEADER_LEN + 14..ETH_HEADER_LEN + 18].copy_from_slice(&ip.octets());
+
+        assert_eq!(arp_conflict(&reply, LOCAL_MAC, ip), Some(REMOTE_MAC));
+        assert_eq!(arp_conflict(&reply, REMOTE_MAC, ip), None);
+        assert_eq!(
+            arp_conflict(&reply, LOCAL_MAC, Ipv4Addr::new(192, 168, 1, 6)),
+            None
+        );
+        // Own probe which carries an unspecified sender address.
+        assert_eq!(
+            arp_conflict(&arp_probe_frame(LOCAL_MAC, ip), LOCAL_MAC, ip),
+            None
+        );
+        assert_eq!(arp_conflict(&reply[..20], LOCAL_MAC, ip), None);
+    }
+
+    #[test]
+    fn build_neighbor_solicitation() {
+        let ip: Ipv6Addr = "2001:db8::1:2:3".parse().unwrap();
+        let frame = neighbor_solicitation_frame(LOCAL_MAC, ip);
+
+        assert_eq!(frame.len(), ETH_HEADER_LEN + IPV6_HEADER_LEN + 24);
+        assert_eq!(frame[..6], [0x33, 0x33, 0xff, 0x02, 0x00, 0x03]);
+        assert_eq!(
+            solicited_node_address(ip),
+            "ff02::1:ff02:3".parse::<Ipv6Addr>().unwrap()
+        );
+        assert_eq!(frame[ETH_HEADER_LEN + IPV6_HEADER_LEN], 135);
+        assert_eq!(frame[ETH_HEADER_LEN + IPV6_HEADER_LEN + 8..], ip.octets());
+
+        // Checksum over a message including a valid checksum must be zero.
+        assert_eq!(
+            icmpv6_checksum(
+                Ipv6Addr::UNSPECIFIED,
+                solicited_node_address(ip),
+                &frame[ETH_HEADER_LEN + IPV6_HEADER_LEN..]
+            ),
+            0
+        );
+    }
+
+    #[test]
+    fn detect_na_conflict() {
+        let ip: Ipv6Addr = "2001:db8::1".parse().unwrap();
+        let icmp_start = ETH_HEADER_LEN + IPV6_HEADER_LEN;
+
+        let mut advertisement = neighbor_solicitation_frame(REMOTE_MAC, ip);
+        advertisement[icmp_start] = 136;
+
+        assert_eq!(na_conflict(&advertisement, LOCAL_MAC, ip), Some(REMOTE_MAC));
+        assert_eq!(na_conflict(&advertisement, REMOTE_MAC, ip), None);
+        assert_eq!(
+            na_conflict(&advertisement, LOCAL_MAC, "2001:db8::2".parse().unwrap()),
+            None
+        );
+
+        // Prefer the target link-layer address option over the Ethernet source.
+        advertisement.extend_from_slice(&[2, 1, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff]);
+        assert_eq!(
+            na_conflict(&advertisement, LOCAL_MAC, ip),
+            Some([0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff])
+        );
+
+        // Solicitations are not conflicts.
+        let solicitation = neighbor_solicitation_frame(REMOTE_MAC, ip);
+        assert_eq!(na_conflict(&solicitation, LOCAL_MAC, ip), None);
+    }
+
+    #[test]
+    fn parse_and_format_mac() {
+        assert_eq!(parse_mac("00:11:22:33:44:55"), Some(LOCAL_MAC));
+        assert_eq!(parse_mac("00:11:22:33:44"), None);
+        assert_eq!(parse_mac("00:11:22:33:44:zz"), None);
+        assert_eq!(format_mac(&REMOTE_MAC), "00:11:22:33:44:66");
+    }
+
+    #[test]
+    fn report_addresses_of_missing_interfaces_as_unchecked() {
+        let files = [
+            ConnectionFile {
+                name: "bond0".to_string(),
+                contents: "[ipv4]\naddress1=192.168.1.5/24\nmethod=manual\n".to_string(),
+            },
+            ConnectionFile {
+                name: "eth0.100".to_string(),
+                contents:
+                    "[connection]\ninterface-name=vlan100\n\n[ipv6]\naddress1=2001:db8::1/64\n"
+                        .to_string(),
+            },
+            ConnectionFile {
+                name: "eth0".to_string(),
+                contents: "[ipv4]\nmethod=auto\n".to_string(),
+            },
+        ];
+        let network_interfaces = [NetworkInterface {
+            name: "eth0".to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 2,
+        }];
+
+        // Never fails the check, since the interfaces are only created once NetworkManager activates them
+        assert_eq!(
+            check_duplicate_addresses(&files, &network_interfaces, ProbeMode::Fail).unwrap(),
+            vec!["192.168.1.5 on 'bond0'", "2001:db8::1 on 'vlan100'"]
+        );
+    }
+}
@@ -0,0 +1,108 @@
+use log::{info, warn};
+use network_interface::NetworkInterface;
+
+use crate::netlink::{add_link_alt_name, set_link_alias};
+use crate::types::{Host, Interface};
+
+/// Set the descriptions (ifalias) and alternative names of the host's NICs.
+///
+/// Neither is persisted by NetworkManager, so they only last until the next reboot.
+/// Failures are not fatal, since the connectivity of the host does not depend on them.
+pub(crate) fn provision_aliases(host: &Host, network_interfaces: &[NetworkInterface]) {
+    for interface in host
+        .interfaces
+        .iter()
+        .filter(|i| i.description.is_some() || !i.altnames.is_empty())
+    {
+        let Some(nic) = find_nic(interface, network_interfaces) else {
+            info!(
+                "Skipping aliases of '{}': interface not present",
+                interface.logical_name
+            );
+            continue;
+        };
+
+        if let Some(description) = &interface.description {
+            match set_link_alias(nic.index, description) {
+                Ok(()) => {
+                    info!(
+                        interface = nic.name.as_str();
+                        "Set description of '{}': {description}", nic.name
+                    )
+                }
+                Err(err) => {
+                    warn!(
+                        interface = nic.name.as_str();
+                        "Failed to set description of '{}': {err}", nic.name
+                    )
+                }
+            }
+        }
+
+        for altname in &interface.altnames {
+            match add_link_alt_name(nic.index, altname) {
+                Ok(()) => {
+                    info!(
+                        interface = nic.name.as_str();
+                        "Added alternative name '{altname}' to '{}'", nic.name
+                    )
+                }
+                Err(err) => warn!(
+                    interface = nic.name.as_str();
+                    "Failed to add alternative name '{altname}' to '{}': {err}",
+                    nic.name
+                ),
+            }
+        }
+    }
+}
+
+fn find_nic<'a>(
+    interface: &Interface,
+    network_interfaces: &'a [NetworkInterface],
+) -> Option<&'a NetworkInterface> {
+    network_interfaces
+        .iter()
+        .filter(|nic| nic.mac_addr.is_some())
+        .find(|nic| nic.mac_addr == interface.mac_address)
+}
+
+#[cfg(test)]
+mod tests {
+    use network_interface::NetworkInterface;
+
+    use crate::aliases::find_nic;
+    use crate::types::Interface;
+
+    #[test]
+    fn find_nic_by_mac_address() {
+        let interface = |mac_address: Option<&str>| Interface {
+            logical_name: "eth0".to_string(),
+            mac_address: mac_address.map(str::to_string),
+            interface_type: "ethernet".to_string(),
+            description: Option::from("uplink to sw-03 port 12".to_string()),
+            altnames: vec!["uplink0".to_string()],
+            ..Default::default()
+        };
+        let network_interfaces = vec![
+            NetworkInterface {
+                name: "lo".to_string(),
+                mac_addr: None,
+                addr: vec![],
+                index: 1,
+            },
+            NetworkInterface {
+                name: "ens1f0".to_string(),
+                mac_addr: Some("00:11:22:33:44:55".to_string()),
+                addr: vec![],
+                index: 2,
+            },
+        ];
+
+        let nic = find_nic(&interface(Some("00:11:22:33:44:55")), &network_interfaces);
+        assert_eq!(nic.map(|nic| nic.index), Some(2));
+
+        assert!(find_nic(&interface(Some("00:11:22:33:44:56")), &network_interfaces).is_none());
+        assert!(find_nic(&interface(None), &network_interfaces).is_none());
+    }
+}
@@ -1,79 +1,1610 @@
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fmt;
 use std::fs;
-use std::io::Write;
-use std::os::unix::fs::OpenOptionsExt;
+use std::io;
 use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::slice;
 
 use anyhow::{anyhow, Context};
-use log::{debug, info};
+use log::{debug, info, trace, warn};
 use network_interface::{NetworkInterface, NetworkInterfaceConfig};
-use nmstate::InterfaceType;
 
-use crate::types::Host;
-use crate::HOST_MAPPING_FILE;
+use crate::address_probe::{check_duplicate_addresses, ProbeMode};
+use crate::aliases::provision_aliases;
+use crate::bootstrap::{add_dns, detect_ntp_client, ntp_drop_in, CHRONY_CONF};
+use crate::bundle::{Bundle, ConfigServer, Encryption};
+use crate::deadline;
+use crate::dhcp_fallback::fallback_connection_files;
+use crate::env_file::{format_env_file, write_env_file};
+use crate::ethtool::{permanent_address, validate_settings};
+use crate::expand::referenced_placeholders;
+use crate::file_filter::FileFilter;
+use crate::filenames::{check_filenames, validate_hostname};
+use crate::filesystem::FileSystem;
+use crate::history::{self, history_dir, RetentionPolicy};
+use crate::hooks::{Hook, HookContext, Hooks, LOCAL_HOOKS_DIR};
+use crate::identity::MachineIdentity;
+use crate::ifcfg::{to_ifcfg, Format, NETWORK_SCRIPTS_DIR};
+use crate::infiniband::{normalize_address, use_infiniband_addresses};
+use crate::keyfile::{
+    rename_connection_id, rename_interface_references, replace_uuid_references, Keyfile,
+    CONNECTION_FILE_EXT,
+};
+use crate::lock::{RunLock, LOCK_FILE};
+use crate::logging;
+use crate::management::{check_management_interface, verify_connectivity};
+use crate::metrics::{unix_timestamp, write_metrics_file};
+use crate::nm_service::{activate_config, ServiceAction, INITRD_RELEASE};
+use crate::nm_version::{check_compatibility, detect_version, Compatibility};
+use crate::ovs::{check_ovs_plugin, NM_PLUGIN_DIRS};
+use crate::progress::{self, Event};
+use crate::quirks::{apply_quirks, load_quirks};
+use crate::rename::{
+    detect_renames, rename_links, renamed_interfaces, write_link_files, write_udev_rules,
+};
+use crate::report::{format_metrics, ApplyReport, FileAction, FileReport};
+use crate::secrets::Secrets;
+use crate::selector::Selector;
+use crate::sriov::{configure_vfs, map_pci_addresses};
+use crate::state::{digest, State, STATE_FILE};
+use crate::types::{interface_of, rename_connection, Host, Interface, MatchMode, Verification};
+use crate::verify::verify_applied;
+use crate::workspace::{self, workspaces_dir};
+use crate::yaml;
+use crate::{CONF_D_DIR, HOST_MAPPING_FILE};
 
 /// Destination directory to store the *.nmconnection files for NetworkManager.
-const STATIC_SYSTEM_CONNECTIONS_DIR: &str = "/etc/NetworkManager/system-connections";
-const RUNTIME_SYSTEM_CONNECTIONS_DIR: &str = "/var/run/NetworkManager/system-connections";
+pub(crate) const STATIC_SYSTEM_CONNECTIONS_DIR: &str = "/etc/NetworkManager/system-connections";
+/// Directory of the in-memory connections of NetworkManager, lost on reboot.
+const RUNTIME_SYSTEM_CONNECTIONS_DIR: &str = "/run/NetworkManager/system-connections";
+/// Permissions of a connections dir created by NMC, matching the one shipped by NetworkManager.
+const CONNECTIONS_DIR_MODE: u32 = 0o700;
 /// Configuration directory for NetworkManager options.
-const CONFIG_DIR: &str = "/etc/NetworkManager/conf.d";
-const CONNECTION_FILE_EXT: &str = "nmconnection";
+pub(crate) const CONFIG_DIR: &str = "/etc/NetworkManager/conf.d";
+/// Configuration directory for NetworkManager options lasting until the next reboot.
+pub(crate) const RUNTIME_CONFIG_DIR: &str = "/run/NetworkManager/conf.d";
+/// Drop-in disabling the default wired connections, always written by NMC itself.
+pub(crate) const NO_AUTO_DEFAULT_FILE: &str = "no-auto-default.conf";
+/// Directory containing the scripts run by NetworkManager on network events.
+const DISPATCHER_DIR: &str = "/etc/NetworkManager/dispatcher.d";
+/// Directory within a host dir containing dispatcher scripts.
+const DISPATCHER_D_DIR: &str = "dispatcher.d";
+const ROOT_UID: u32 = 0;
+/// Directory containing connection files shared by all hosts.
+pub(crate) const COMMON_CONFIG_DIR: &str = "common";
 const HOSTNAME_FILE: &str = "/etc/hostname";
+/// Rules renaming the local NICs to their preconfigured names.
+pub(crate) const UDEV_RULES_FILE: &str = "/etc/udev/rules.d/70-nm-configurator.rules";
+/// Directory containing systemd.link files applied by systemd-udevd.
+pub(crate) const SYSTEMD_NETWORK_DIR: &str = "/etc/systemd/network";
+pub(crate) const SYSFS_NET_DIR: &str = "/sys/class/net";
+/// Number of hosts `identify` reports as the closest candidates if none of them match.
+const CLOSEST_CANDIDATES: usize = 3;
 
-pub(crate) fn apply(source_dir: &str) -> Result<(), anyhow::Error> {
-    let hosts = parse_config(source_dir).context("Parsing config")?;
+/// How the hostname of the identified host is set.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub(crate) enum HostnameMethod {
+    /// Write `/etc/hostname`, which takes effect on the next boot.
+    #[default]
+    File,
+    /// Set the static hostname via systemd-hostnamed, which also applies it to the running system.
+    Hostnamed,
+    /// Leave the hostname alone, e.g. if it is provisioned by other means.
+    Keep,
+}
+
+/// Options controlling how the host is identified by the local NICs.
+#[derive(Clone, Copy, Debug, Default)]
+pub(crate) struct MatchOptions {
+    /// Identify the host by its interface names as a last resort, e.g. on platforms randomizing the MAC addresses.
+    pub(crate) by_name: bool,
+    /// How many of a host's NICs have to be present locally, unless the host config says otherwise.
+    pub(crate) mode: MatchMode,
+    /// Fail instead of picking the first of several hosts matching the same number of NICs.
+    pub(crate) fail_on_ambiguous: bool,
+    /// Accept MAC addresses assigned to several hosts (e.g. cloned images) and settle them by the best match
+    /// instead of rejecting the host mapping.
+    pub(crate) allow_shared_macs: bool,
+}
+
+/// Options controlling how the connection files are applied.
+#[derive(Default)]
+pub(crate) struct ApplyOptions {
+    /// Expand `${VAR}` references in the connection files from the environment.
+    pub(crate) expand_env: bool,
+    /// Probe statically assigned addresses for duplicates on the network before storing the files.
+    pub(crate) duplicate_address_check: Option<ProbeMode>,
+    /// Rename mismatching NICs via udev rules instead of adjusting the connection files.
+    pub(crate) udev_rules: bool,
+    /// Rename mismatching NICs via systemd.link files instead of adjusting the connection files.
+    pub(crate) systemd_link_files: bool,
+    /// Rename mismatching NICs via netlink instead of adjusting the connection files.
+    pub(crate) rename_links: bool,
+    /// Run the hooks and install the dispatcher scripts shipped in the config dir, using the hooks of the config dir
+    /// instead of the ones of the local hooks dir.
+    pub(crate) allow_bundle_hooks: bool,
+    /// Local hooks dir instead of the default one (/etc/nmc), e.g. on systems with a read-only /etc.
+    pub(crate) hooks_dir: Option<String>,
+    /// Allow removing, renaming or modifying the stored profile of the management interface.
+    pub(crate) allow_management_change: bool,
+    /// File to write a JSON summary of the applied changes to.
+    pub(crate) report_file: Option<String>,
+    /// File in Prometheus text format updated with the results of the run.
+    pub(crate) metrics_file: Option<String>,
+    /// systemd `EnvironmentFile` to write the local names of the host's interfaces to.
+    pub(crate) env_file: Option<String>,
+    /// Decides how files in the host and common dirs which are not connection files are treated.
+    pub(crate) file_filter: FileFilter,
+    /// Wait for a concurrent run to finish instead of failing.
+    pub(crate) wait_for_lock: bool,
+    /// Identity file provisioned by the manufacturer, taking precedence over matching the MAC addresses.
+    pub(crate) identity_file: Option<String>,
+    /// Remove connection files stored by a previous run which are no longer part of the config.
+    pub(crate) prune: bool,
+    /// Subset of the connection files processed by the run.
+    pub(crate) selection: Selection,
+    /// How the host is identified by the local NICs.
+    pub(crate) matching: MatchOptions,
+    /// Fail if the NICs of some of the host's Ethernet interfaces are missing instead of only reporting them.
+    pub(crate) strict_interfaces: bool,
+    /// Fail if the host has OVS connections but NetworkManager lacks the plugin handling them.
+    pub(crate) check_ovs_plugin: bool,
+    /// What is done to the running NetworkManager after storing the files.
+    pub(crate) network_manager: ServiceAction,
+    /// Verify the config once NetworkManager activated it and restore the last-known-good config if it fails.
+    pub(crate) fallback: bool,
+    /// How settings unsupported by the installed NetworkManager version are handled.
+    pub(crate) nm_compatibility: Compatibility,
+    /// How the hostname of the identified host is set.
+    pub(crate) hostname_method: HostnameMethod,
+    /// Add DHCP profiles for the local NICs not covered by the host's profiles, unless the host config says otherwise.
+    pub(crate) dhcp_fallback: bool,
+    /// Bounds of the history keeping the reports of past runs.
+    pub(crate) retention: RetentionPolicy,
+    /// Format the connection files are stored in.
+    pub(crate) format: Format,
+    /// Dir the connection files are stored in instead of the default one of the format.
+    pub(crate) destination_dir: Option<String>,
+    /// Store the connection files and drop-ins under /run, so that they only last until the next reboot
+    /// (e.g. on systems with a read-only root). An explicit destination dir still takes precedence.
+    pub(crate) transient: bool,
+    /// Keep the UUIDs of the connections already stored in the destination dir.
+    pub(crate) preserve_uuids: bool,
+    /// Key file decrypting an encrypted config bundle instead of the one provided via the environment.
+    pub(crate) decryption_key: Option<String>,
+    /// Only apply the config if the labels of the identified host match, leaving the machine untouched otherwise.
+    pub(crate) selector: Option<Selector>,
+    /// Fetch the config of this machine from a config server instead of reading the config dir.
+    pub(crate) config_server: Option<ConfigServer>,
+}
+
+/// Connections selected by their preconfigured or local interface names, e.g. for troubleshooting
+/// a single interface without touching the rest.
+#[derive(Debug, Default)]
+pub(crate) struct Selection {
+    /// Only process these connections if not empty.
+    pub(crate) only: Vec<String>,
+    /// Never process these connections.
+    pub(crate) skip: Vec<String>,
+}
+
+impl Selection {
+    fn is_active(&self) -> bool {
+        !self.only.is_empty() || !self.skip.is_empty()
+    }
+}
+
+/// Error returned when none of the preconfigured hosts match the local NICs.
+#[derive(Debug)]
+pub(crate) struct NoHostMatched;
+
+impl fmt::Display for NoHostMatched {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "None of the preconfigured hosts match local NICs")
+    }
+}
+
+impl std::error::Error for NoHostMatched {}
+
+/// File shipped in a subdir of the host dir and stored as it is, e.g. a NetworkManager.conf drop-in.
+#[derive(Debug)]
+pub(crate) struct HostFile {
+    pub(crate) name: String,
+    pub(crate) contents: Vec<u8>,
+}
+
+/// Connection file prepared for the local host.
+pub(crate) struct ConnectionFile {
+    /// Name of the file without the extension (i.e. the local interface name).
+    pub(crate) name: String,
+    pub(crate) contents: String,
+}
+
+/// Identify the host, store its connection files and disable the default wired connections.
+///
+/// Concurrent runs are serialized via the run lock, so that they never write the destination dir at the same time.
+pub(crate) fn apply(
+    source_dir: &str,
+    options: &ApplyOptions,
+    filesystem: &dyn FileSystem,
+) -> Result<ApplyReport, anyhow::Error> {
+    let _lock = RunLock::acquire(LOCK_FILE, options.wait_for_lock)?;
+
+    // Long-lived nodes would otherwise accumulate the temporary files of interrupted runs.
+    workspace::recover(&workspaces_dir(STATE_FILE)).context("Recovering workspaces")?;
+
+    // The plaintext of an encrypted or fetched config only exists in the workspace of the run,
+    // removed along with the bundle.
+    let bundle = match &options.config_server {
+        Some(server) => Some(fetch_bundle(server)?),
+        None => open_bundle(source_dir, options.decryption_key.as_deref())?,
+    };
+    let source_dir = match &bundle {
+        Some(bundle) => bundle
+            .path()
+            .to_str()
+            .ok_or_else(|| anyhow!("Determining bundle path"))?,
+        None => source_dir,
+    };
+
+    let local_hooks_dir = options.hooks_dir.as_deref().unwrap_or(LOCAL_HOOKS_DIR);
+    let hooks = load_hooks(source_dir, options, local_hooks_dir).context("Loading hooks")?;
+    let result = apply_config(source_dir, options, &hooks, filesystem);
+
+    if let Err(err) = &result {
+        let context = HookContext {
+            config_dir: source_dir,
+            hostname: logging::host(),
+            error: Some(format!("{err:#}")),
+            ..HookContext::default()
+        };
+        // The failure of the run is what gets reported, not the one of its hook.
+        if let Err(hook_err) = hooks.run(Hook::OnFailure, &context) {
+            warn!("{hook_err:#}");
+        }
+    }
+
+    progress::emit(match &result {
+        Ok(..) => Event::new("done", 100),
+        Err(err) => Event {
+            error: Some(format!("{err:#}")),
+            ..Event::new("failed", 100)
+        },
+    });
+
+    if let Some(path) = &options.metrics_file {
+        let metrics = format_metrics(result.as_ref().ok(), unix_timestamp());
+        write_metrics_file(filesystem, path, &metrics).context("Writing metrics file")?;
+    }
+
+    let report = result?;
+
+    if let Some(path) = &options.report_file {
+        report.write(filesystem, path).context("Writing report")?;
+    }
+
+    history::record(
+        filesystem,
+        &history_dir(STATE_FILE),
+        &report,
+        &options.retention,
+    )
+    .context("Recording history")?;
+
+    Ok(report)
+}
+
+/// Load the hooks of the local hooks dir, since hooks run as root. Those of the config dir are only used
+/// if explicitly allowed and, for a config fetched from a server, only if it was fetched via https.
+fn load_hooks(
+    source_dir: &str,
+    options: &ApplyOptions,
+    local_hooks_dir: &str,
+) -> Result<Hooks, anyhow::Error> {
+    if !options.allow_bundle_hooks {
+        if Hooks::exist(source_dir) {
+            warn!("Ignoring the hooks of the config dir, use --allow-bundle-hooks to run them");
+        }
+        return Hooks::load(local_hooks_dir);
+    }
+
+    check_fetched_securely(options, "run hooks")?;
+    Hooks::load(source_dir)
+}
+
+/// Only install the dispatcher scripts of the config dir if explicitly allowed, since they run as root the same way
+/// as hooks do and, for a config fetched from a server, only if it was fetched via https.
+fn allowed_dispatcher_scripts(
+    scripts: Vec<HostFile>,
+    options: &ApplyOptions,
+) -> Result<Vec<HostFile>, anyhow::Error> {
+    if scripts.is_empty() {
+        return Ok(scripts);
+    }
+
+    if !options.allow_bundle_hooks {
+        warn!("Ignoring the dispatcher scripts of the config dir, use --allow-bundle-hooks to install them");
+        return Ok(Vec::new());
+    }
+
+    check_fetched_securely(options, "install dispatcher scripts")?;
+    Ok(scripts)
+}
+
+/// Fail if the config was fetched from a server without https, since its executable content could have been
+/// tampered with on the way.
+fn check_fetched_securely(options: &ApplyOptions, action: &str) -> Result<(), anyhow::Error> {
+    if let Some(server) = &options.config_server {
+        if !server.is_secure() {
+            return Err(anyhow!(
+                "Refusing to {action} of a config fetched from {} without https",
+                server.url
+            ));
+        }
+    }
+
+    Ok(())
+}
+
+fn open_bundle(source: &str, key_file: Option<&str>) -> Result<Option<Bundle>, anyhow::Error> {
+    let Some(encryption) = Encryption::detect(source) else {
+        return Ok(None);
+    };
+
+    let bundle = Bundle::open(source, &encryption, key_file, &workspaces_dir(STATE_FILE))?;
+    if !bundle.path().is_dir() {
+        return Err(anyhow!(
+            "Config bundle {source:?} does not contain a tar archive of the config dir"
+        ));
+    }
+
+    Ok(Some(bundle))
+}
+
+/// Fetch the config of this machine from the server, identified by the MAC addresses of its NICs.
+fn fetch_bundle(server: &ConfigServer) -> Result<Bundle, anyhow::Error> {
+    let mut macs: Vec<String> = local_nics()?
+        .into_iter()
+        .filter_map(|nic| nic.mac_addr.map(|mac| mac.to_lowercase()))
+        .collect();
+    macs.sort();
+    macs.dedup();
+
+    if macs.is_empty() {
+        return Err(anyhow!(
+            "No NICs with MAC addresses found to fetch the config by"
+        ));
+    }
+
+    Bundle::fetch(server, &macs, &workspaces_dir(STATE_FILE))
+}
+
+fn apply_config(
+    source_dir: &str,
+    options: &ApplyOptions,
+    hooks: &Hooks,
+    filesystem: &dyn FileSystem,
+) -> Result<ApplyReport, anyhow::Error> {
+    progress::emit(Event::new("parse", 0));
+    let mut hosts =
+        parse_config(source_dir, options.matching.allow_shared_macs).context("Parsing config")?;
     debug!("Loaded hosts config: {hosts:?}");
 
-    let network_interfaces = NetworkInterface::show()?;
-    debug!("Retrieved network interfaces: {network_interfaces:?}");
+    let mut network_interfaces = NetworkInterface::show()?;
+    debug!("Retrieved network interfaces: {network_interfaces:?}");
+
+    // Virtual interfaces may clone the MAC addresses of physical ones, so only the latter are matched.
+    let mut nics = physical_interfaces(&network_interfaces, SYSFS_NET_DIR);
+    use_permanent_addresses(&mut nics);
+    use_infiniband_addresses(&mut nics, SYSFS_NET_DIR);
+    map_virtual_addresses(&mut hosts, &network_interfaces, &nics, SYSFS_NET_DIR);
+
+    deadline::check()?;
+    progress::emit(Event::new("identify", 10));
+    let identity = load_identity(options.identity_file.as_deref())?;
+    let mut host = find_host(hosts, &nics, identity.as_ref(), &options.matching)?;
+    logging::set_host(&host.hostname);
+    info!("Identified host: {}", host.hostname);
+
+    // The same bundle is rolled out to the whole fleet, so hosts outside of the selection are not an error.
+    if let Some(selector) = &options.selector {
+        if !selector.matches(&host.labels) {
+            info!("Host is not selected by '{selector}', skipping");
+            return Ok(ApplyReport {
+                hostname: host.hostname,
+                interface_names: BTreeMap::new(),
+                files: Vec::new(),
+                secrets: BTreeMap::new(),
+                unchecked_addresses: Vec::new(),
+            });
+        }
+    }
+
+    map_pci_addresses(&mut host, &nics, SYSFS_NET_DIR);
+    check_missing_nics(&host, &nics, options.strict_interfaces)?;
+
+    let mut local_interfaces = detect_local_interfaces(&host, nics.clone());
+    let renaming = options.udev_rules || options.systemd_link_files || options.rename_links;
+    let renames = if renaming {
+        detect_renames(&host, &local_interfaces)
+    } else {
+        Vec::new()
+    };
+    if renaming {
+        // Keep the preconfigured names in the connection files since the NICs will be renamed.
+        local_interfaces.clear();
+    }
+
+    // Everything is checked against the interfaces as they are named once renamed, before anything is changed.
+    let (planned_interfaces, planned_nics) = if options.rename_links {
+        (
+            renamed_interfaces(&renames, &network_interfaces),
+            renamed_interfaces(&renames, &nics),
+        )
+    } else {
+        (network_interfaces.clone(), nics.clone())
+    };
+
+    // Declaring secret providers opts into expanding the connection files the same way as --expand-env does.
+    let secrets = match Secrets::load(source_dir).context("Loading secret providers")? {
+        Some(secrets) => Some(secrets),
+        None if options.expand_env => Some(Secrets::default()),
+        None => None,
+    };
+
+    progress::emit(Event::new("prepare", 30));
+    let mut connection_files = prepare_connection_files(
+        &host,
+        &local_interfaces,
+        source_dir,
+        secrets.as_ref(),
+        &options.file_filter,
+    )
+    .context("Preparing connection files")?;
+
+    let drop_ins = read_drop_ins(
+        &Path::new(source_dir).join(&host.hostname).join(CONF_D_DIR),
+        &options.file_filter,
+    )
+    .context("Reading NetworkManager.conf drop-ins")?;
+    let dispatcher_scripts = read_dispatcher_scripts(
+        &Path::new(source_dir)
+            .join(&host.hostname)
+            .join(DISPATCHER_D_DIR),
+        &options.file_filter,
+    )
+    .context("Reading dispatcher scripts")?;
+    let dispatcher_scripts = allowed_dispatcher_scripts(dispatcher_scripts, options)?;
+
+    let quirks = load_quirks(source_dir).context("Loading quirks")?;
+    apply_quirks(
+        &quirks,
+        &host,
+        &local_interfaces,
+        &nics,
+        &mut connection_files,
+    );
+
+    configure_vfs(&host, &local_interfaces, &mut connection_files);
+    if let Some(dns) = &host.dns {
+        add_dns(dns, &mut connection_files).context("Adding DNS settings")?;
+    }
+    let ntp_drop_in = host.ntp.as_ref().map(|ntp| {
+        let client = ntp.client.unwrap_or_else(|| detect_ntp_client(CHRONY_CONF));
+        ntp_drop_in(ntp, client)
+    });
+
+    for file in &connection_files {
+        validate_settings(&Keyfile::parse(&file.contents))
+            .with_context(|| format!("Validating ethtool settings of '{}'", file.name))?;
+    }
+    if options.check_ovs_plugin {
+        check_ovs_plugin(&connection_files, &NM_PLUGIN_DIRS)?;
+    }
+
+    if host.dhcp_fallback.unwrap_or(options.dhcp_fallback) {
+        let fallback_files = fallback_connection_files(&host, &planned_nics, &connection_files);
+        connection_files.extend(fallback_files);
+    }
+
+    if options.format == Format::Keyfile && options.nm_compatibility != Compatibility::Skip {
+        check_compatibility(
+            &connection_files,
+            detect_version(),
+            options.nm_compatibility,
+        )?;
+    }
+
+    let destination_dir = match options.format {
+        Format::Keyfile if options.transient => RUNTIME_SYSTEM_CONNECTIONS_DIR,
+        Format::Keyfile => STATIC_SYSTEM_CONNECTIONS_DIR,
+        Format::Ifcfg if options.transient => {
+            return Err(anyhow!(
+                "Transient connections are only supported in the keyfile format"
+            ))
+        }
+        Format::Ifcfg => NETWORK_SCRIPTS_DIR,
+        Format::Networkd | Format::Netplan => {
+            return Err(anyhow!(
+                "The networkd and netplan formats are only supported by generate"
+            ))
+        }
+    };
+    let destination_dir = options
+        .destination_dir
+        .as_deref()
+        .unwrap_or(destination_dir);
+    let config_dir = if options.transient {
+        RUNTIME_CONFIG_DIR
+    } else {
+        CONFIG_DIR
+    };
+
+    progress::emit(Event::new("check", 50));
+    let management_change = check_management_interface(
+        &host,
+        &planned_nics,
+        &connection_files,
+        destination_dir,
+        options.allow_management_change,
+    )
+    .context("Checking management interface")?;
+    // The connectivity via the changed profile can only be verified once it is activated.
+    if let Some(interface) = &management_change {
+        if options.network_manager != ServiceAction::Restart {
+            return Err(anyhow!(
+                "Changing the profile of management interface '{interface}' requires --network-manager restart, \
+                 so that its connectivity is verified"
+            ));
+        }
+    }
+
+    if options.selection.is_active() {
+        connection_files =
+            select_connection_files(connection_files, &local_interfaces, &options.selection)
+                .context("Selecting connection files")?;
+    }
+
+    let filenames: Vec<String> = connection_files
+        .iter()
+        .map(|file| options.format.filename(&file.name))
+        .collect();
+    check_filenames(filenames.iter().map(String::as_str))
+        .context("Checking connection file names")?;
+
+    let unchecked_addresses = match options.duplicate_address_check {
+        Some(mode) => check_duplicate_addresses(&connection_files, &planned_interfaces, mode)
+            .context("Checking for duplicate addresses")?,
+        None => Vec::new(),
+    };
+
+    if options.preserve_uuids {
+        if options.format != Format::Keyfile {
+            return Err(anyhow!(
+                "Preserving UUIDs is only supported in the keyfile format"
+            ));
+        }
+        preserve_uuids(&mut connection_files, destination_dir).context("Preserving UUIDs")?;
+    }
+
+    // Past this point the machine is changed, which is not interrupted by the deadline.
+    deadline::check()?;
+    hooks.run(
+        Hook::PreApply,
+        &HookContext {
+            config_dir: source_dir,
+            hostname: Some(&host.hostname),
+            ..HookContext::default()
+        },
+    )?;
+
+    set_hostname(
+        filesystem,
+        &host.hostname,
+        options.hostname_method,
+        HOSTNAME_FILE,
+    )
+    .context("Setting hostname")?;
+
+    let mut rename_files = Vec::new();
+    if options.udev_rules {
+        rename_files.extend(
+            write_udev_rules(filesystem, &renames, UDEV_RULES_FILE)
+                .context("Writing udev rules")?,
+        );
+    }
+    if options.systemd_link_files {
+        rename_files.extend(
+            write_link_files(filesystem, &renames, SYSTEMD_NETWORK_DIR)
+                .context("Writing link files")?,
+        );
+    }
+    if options.rename_links {
+        rename_links(&renames, &nics).context("Renaming links")?;
+
+        network_interfaces = NetworkInterface::show()?;
+        debug!("Retrieved renamed network interfaces: {network_interfaces:?}");
+        nics = physical_interfaces(&network_interfaces, SYSFS_NET_DIR);
+        use_permanent_addresses(&mut nics);
+        use_infiniband_addresses(&mut nics, SYSFS_NET_DIR);
+    }
+
+    provision_aliases(&host, &nics);
+
+    let previous_state = State::load(filesystem, STATE_FILE).context("Loading previous state")?;
+
+    // Files are never left half stored by the watchdog of the deadline.
+    let uninterruptible = deadline::uninterruptible();
+    progress::emit(Event::new("store", 60));
+    create_connections_dir(filesystem, Path::new(destination_dir))
+        .context("Creating destination dir")?;
+    let stored_files = store_connection_files(
+        filesystem,
+        &connection_files,
+        destination_dir,
+        options.format,
+    )
+    .context("Storing connection files")?;
+    let mut stored_host_files = store_drop_ins(filesystem, &drop_ins, config_dir)
+        .context("Storing NetworkManager.conf drop-ins")?;
+    stored_host_files.extend(
+        store_dispatcher_scripts(filesystem, &dispatcher_scripts, DISPATCHER_DIR, ROOT_UID)
+            .context("Storing dispatcher scripts")?,
+    );
+    if let Some((dir, drop_in)) = &ntp_drop_in {
+        stored_host_files.extend(
+            store_host_files(filesystem, slice::from_ref(drop_in), dir, 0o644, None)
+                .context("Storing NTP drop-in")?,
+        );
+    }
+
+    // Drop-ins, dispatcher scripts, udev rules and link files are tracked along with the connection files,
+    // so that they are pruned and verified the same way.
+    stored_host_files.extend(rename_files);
+    let all_stored: Vec<(PathBuf, FileAction)> = stored_files
+        .iter()
+        .chain(&stored_host_files)
+        .cloned()
+        .collect();
+
+    let stale = stale_files(filesystem, previous_state.as_ref(), &all_stored)
+        .context("Determining stale connection files")?;
+    let mut tracked_files: Vec<PathBuf> = all_stored.iter().map(|(path, _)| path.clone()).collect();
+    let mut pruned = Vec::new();
+    if options.selection.is_active() {
+        // Files which were not selected are neither stale nor forgotten.
+        tracked_files.extend(stale);
+    } else if options.prune {
+        prune_files(filesystem, &stale).context("Pruning stale connection files")?;
+        pruned = stale;
+    } else {
+        for path in &stale {
+            warn!("Connection file {path:?} is no longer part of the config, pass --prune to remove it");
+        }
+        // Keep tracking the files, so that a later run can still prune them.
+        tracked_files.extend(stale);
+    }
+
+    let checksums: BTreeMap<PathBuf, String> = tracked_files
+        .iter()
+        .map(|path| {
+            let contents = filesystem
+                .read(path)?
+                .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, format!("{path:?}")))?;
+            Ok((path.clone(), digest(&contents)))
+        })
+        .collect::<Result<_, io::Error>>()
+        .context("Computing checksums of connection files")?;
+
+    let mut report = build_report(
+        &host.hostname,
+        &local_interfaces,
+        &connection_files,
+        &stored_files,
+        &checksums,
+    );
+    report.files.extend(
+        stored_host_files
+            .into_iter()
+            .map(|(path, action)| FileReport {
+                checksum: checksums.get(&path).cloned().unwrap_or_default(),
+                path,
+                action,
+                renamed_from: None,
+            }),
+    );
+    report
+        .files
+        .extend(pruned.into_iter().map(|path| FileReport {
+            path,
+            action: FileAction::Removed,
+            renamed_from: None,
+            checksum: String::new(),
+        }));
+
+    let verification = verification_policies(&host, &local_interfaces);
+
+    if let Some(path) = &options.env_file {
+        write_env_file(filesystem, path, &format_env_file(&host, &local_interfaces))
+            .context("Writing environment file")?;
+    }
+
+    State {
+        hostname: host.hostname.clone(),
+        connection_files: tracked_files,
+        checksums,
+        verification,
+        probes: host.probes.clone(),
+    }
+    .save(filesystem, STATE_FILE)
+    .context("Saving state")?;
+
+    progress::emit(Event::new("finalize", 95));
+    // The runtime connections are only cleared of the default wired connections if they are not the stored ones.
+    let runtime_dir = (Path::new(destination_dir) != Path::new(RUNTIME_SYSTEM_CONNECTIONS_DIR))
+        .then_some(RUNTIME_SYSTEM_CONNECTIONS_DIR);
+    disable_wired_connections(filesystem, config_dir, runtime_dir)
+        .context("Disabling wired connections")?;
+    drop(uninterruptible);
+
+    // The files are only consumed by NetworkManager in the keyfile and ifcfg formats.
+    if matches!(options.format, Format::Keyfile | Format::Ifcfg) {
+        let changed = report
+            .files
+            .iter()
+            .any(|file| file.action != FileAction::Skipped);
+        let activated = activate_config(options.network_manager, changed, INITRD_RELEASE)
+            .context("Activating the config")?;
+
+        if let Some(interface) = &management_change {
+            if activated {
+                verify_connectivity(&host, interface, SYSFS_NET_DIR)
+                    .context("Verifying connectivity of management interface")?;
+            } else {
+                info!(
+                    "Not verifying connectivity of management interface '{interface}', \
+                     NetworkManager activates its profile once it starts"
+                );
+            }
+        }
+
+        if options.fallback {
+            if activated {
+                verify_applied(destination_dir, STATE_FILE).context("Verifying the config")?;
+            } else {
+                info!("Not verifying the config, NetworkManager did not activate it");
+            }
+        }
+    }
+
+    if let Some(secrets) = &secrets {
+        report.secrets = secrets.resolved();
+    }
+    report.unchecked_addresses = unchecked_addresses;
+
+    hooks.run(
+        Hook::PostApply,
+        &HookContext {
+            config_dir: source_dir,
+            hostname: Some(&report.hostname),
+            files: report
+                .files
+                .iter()
+                .filter(|file| file.action != FileAction::Skipped)
+                .map(|file| file.path.clone())
+                .collect(),
+            error: None,
+        },
+    )?;
+
+    Ok(report)
+}
+
+fn build_report(
+    hostname: &str,
+    local_interfaces: &HashMap<String, String>,
+    connection_files: &[ConnectionFile],
+    stored_files: &[(PathBuf, FileAction)],
+    checksums: &BTreeMap<PathBuf, String>,
+) -> ApplyReport {
+    let files = connection_files
+        .iter()
+        .zip(stored_files)
+        .map(|(file, (path, action))| FileReport {
+            path: path.clone(),
+            action: *action,
+            renamed_from: local_interfaces
+                .iter()
+                .find(|(_, local_name)| **local_name == interface_of(&file.name))
+                .map(|(logical_name, _)| rename_connection(&file.name, logical_name)),
+            checksum: checksums.get(path).cloned().unwrap_or_default(),
+        })
+        .collect();
+
+    ApplyReport {
+        hostname: hostname.to_string(),
+        interface_names: local_interfaces
+            .iter()
+            .map(|(logical_name, local_name)| (logical_name.clone(), local_name.clone()))
+            .collect(),
+        files,
+        secrets: BTreeMap::new(),
+        unchecked_addresses: Vec::new(),
+    }
+}
+
+/// Returns the verification policies declared in the host config by the local names of the interfaces.
+fn verification_policies(
+    host: &Host,
+    local_interfaces: &HashMap<String, String>,
+) -> BTreeMap<String, Verification> {
+    host.interfaces
+        .iter()
+        .filter_map(|interface| {
+            let policy = interface.verification?;
+            let name = local_interfaces
+                .get(&interface.logical_name)
+                .unwrap_or(&interface.logical_name);
+
+            Some((name.clone(), policy))
+        })
+        .collect()
+}
+
+/// Identify the host and print how its preconfigured interfaces map to the local NICs
+/// without changing anything on the system.
+pub(crate) fn identify(
+    source_dir: &str,
+    identity_file: Option<&str>,
+    matching: &MatchOptions,
+) -> Result<(), anyhow::Error> {
+    let mut hosts =
+        parse_config(source_dir, matching.allow_shared_macs).context("Parsing config")?;
+
+    let network_interfaces = NetworkInterface::show()?;
+    let mut nics = physical_interfaces(&network_interfaces, SYSFS_NET_DIR);
+    use_permanent_addresses(&mut nics);
+    use_infiniband_addresses(&mut nics, SYSFS_NET_DIR);
+    map_virtual_addresses(&mut hosts, &network_interfaces, &nics, SYSFS_NET_DIR);
+
+    // Computed upfront since identifying the host consumes the mapping.
+    let candidates = closest_hosts(&hosts, &nics);
+
+    let identity = load_identity(identity_file)?;
+    let mut host = match find_host(hosts, &nics, identity.as_ref(), matching) {
+        Ok(host) => host,
+        Err(err) => {
+            print!("{}", format_candidates(&candidates));
+            return Err(err);
+        }
+    };
+    map_pci_addresses(&mut host, &nics, SYSFS_NET_DIR);
+    let local_interfaces = detect_local_interfaces(&host, nics.clone());
+    let matched_by = describe_match(&host, &nics, identity.as_ref());
+
+    print!(
+        "{}",
+        format_identity(&host, &matched_by, &local_interfaces, &nics)
+    );
+
+    Ok(())
+}
+
+/// Describe what the host was identified by, e.g. the local NIC whose MAC address matched.
+fn describe_match(
+    host: &Host,
+    network_interfaces: &[NetworkInterface],
+    identity: Option<&MachineIdentity>,
+) -> String {
+    if identity.is_some_and(|identity| identity.hostname == host.hostname) {
+        return "identity file".to_string();
+    }
+
+    host.interfaces
+        .iter()
+        .find_map(|interface| {
+            let nic = network_interfaces
+                .iter()
+                .find(|nic| nic.mac_addr.is_some() && nic.mac_addr == interface.mac_address)?;
+            Some(format!(
+                "MAC address {} of {} (preconfigured as {})",
+                interface.mac_address.as_deref().unwrap_or_default(),
+                nic.name,
+                interface.logical_name
+            ))
+        })
+        .unwrap_or("interface names".to_string())
+}
+
+/// Preconfigured interface whose MAC address comes closest to the one of a local NIC.
+#[derive(Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+struct Candidate {
+    hostname: String,
+    interface: String,
+    mac_address: String,
+    nic: String,
+    nic_mac_address: String,
+    /// Number of hex digits the MAC addresses differ in.
+    distance: usize,
+}
+
+/// Returns the hosts whose MAC addresses come closest to the ones of the local NICs, e.g. due to a typo or
+/// a replaced NIC of the same vendor, nearest first.
+fn closest_hosts(hosts: &[Host], network_interfaces: &[NetworkInterface]) -> Vec<Candidate> {
+    let mut candidates: Vec<Candidate> = hosts
+        .iter()
+        .filter_map(|host| {
+            host.interfaces
+                .iter()
+                .filter_map(|interface| Some((interface, interface.mac_address.as_deref()?)))
+                .flat_map(|(interface, mac)| {
+                    network_interfaces.iter().filter_map(move |nic| {
+                        let nic_mac = nic.mac_addr.as_deref()?;
+                        Some(Candidate {
+                            hostname: host.hostname.clone(),
+                            interface: interface.logical_name.clone(),
+                            mac_address: mac.to_string(),
+                            nic: nic.name.clone(),
+                            nic_mac_address: nic_mac.to_string(),
+                            distance: mac_distance(mac, nic_mac),
+                        })
+                    })
+                })
+                .min_by_key(|candidate| candidate.distance)
+        })
+        .collect();
+
+    candidates.sort_by(|a, b| {
+        a.distance
+            .cmp(&b.distance)
+            .then_with(|| a.hostname.cmp(&b.hostname))
+    });
+    candidates.truncate(CLOSEST_CANDIDATES);
+
+    candidates
+}
+
+/// Returns the number of hex digits two MAC addresses differ in.
+fn mac_distance(a: &str, b: &str) -> usize {
+    let digits = |mac: &str| -> Vec<char> {
+        mac.chars()
+            .filter(char::is_ascii_hexdigit)
+            .map(|c| c.to_ascii_lowercase())
+            .collect()
+    };
+    let (a, b) = (digits(a), digits(b));
+
+    let differing = a.iter().zip(&b).filter(|(a, b)| a != b).count();
+    differing + a.len().abs_diff(b.len())
+}
+
+fn format_candidates(candidates: &[Candidate]) -> String {
+    if candidates.is_empty() {
+        return "None of the preconfigured hosts have MAC addresses to compare with local NICs\n"
+            .to_string();
+    }
+
+    let rows: Vec<[String; 6]> = candidates
+        .iter()
+        .map(|candidate| {
+            [
+                candidate.hostname.clone(),
+                candidate.interface.clone(),
+                candidate.mac_address.clone(),
+                candidate.nic.clone(),
+                candidate.nic_mac_address.clone(),
+                candidate.distance.to_string(),
+            ]
+        })
+        .collect();
+
+    let mut output = "No host matched, closest candidates:\n".to_string();
+    output.push_str(&format_table(
+        [
+            "HOST",
+            "INTERFACE",
+            "MAC-ADDRESS",
+            "LOCAL-NIC",
+            "LOCAL-MAC-ADDRESS",
+            "DIFFERING-DIGITS",
+        ],
+        &rows,
+    ));
+
+    output
+}
+
+fn format_identity(
+    host: &Host,
+    matched_by: &str,
+    local_interfaces: &HashMap<String, String>,
+    network_interfaces: &[NetworkInterface],
+) -> String {
+    let rows: Vec<[String; 4]> = host
+        .interfaces
+        .iter()
+        .map(|interface| {
+            let local_name = if interface.is_nic() {
+                network_interfaces
+                    .iter()
+                    .find(|nic| nic.mac_addr.is_some() && nic.mac_addr == interface.mac_address)
+                    .map(|nic| nic.name.clone())
+            } else {
+                Some(
+                    local_interfaces
+                        .get(&interface.logical_name)
+                        .unwrap_or(&interface.logical_name)
+                        .clone(),
+                )
+            };
+
+            [
+                interface.logical_name.clone(),
+                interface.interface_type.clone(),
+                interface.mac_address.clone().unwrap_or("--".to_string()),
+                local_name.unwrap_or("--".to_string()),
+            ]
+        })
+        .collect();
+
+    let mut output = format!("Host: {}\nMatched by: {matched_by}\n", host.hostname);
+    output.push_str(&format_table(
+        ["INTERFACE", "TYPE", "MAC-ADDRESS", "LOCAL-NAME"],
+        &rows,
+    ));
+
+    output
+}
+
+fn format_table<const N: usize>(columns: [&str; N], rows: &[[String; N]]) -> String {
+    let mut widths = columns.map(str::len);
+    for row in rows {
+        for (width, value) in widths.iter_mut().zip(row) {
+            *width = (*width).max(value.len());
+        }
+    }
+
+    let format_row = |values: &[&str]| {
+        let line = values
+            .iter()
+            .zip(widths)
+            .map(|(value, width)| format!("{value:width$}"))
+            .collect::<Vec<_>>()
+            .join("  ");
+
+        format!("{}\n", line.trim_end())
+    };
+
+    let mut output = format_row(&columns);
+    for row in rows {
+        let values: Vec<&str> = row.iter().map(String::as_str).collect();
+        output.push_str(&format_row(&values));
+    }
+
+    output
+}
+
+/// Load the host mapping of the config dir. MAC addresses assigned to several hosts make it invalid,
+/// since the machine carrying them could be either of them, unless `allow_shared_macs`.
+pub(crate) fn parse_config(
+    source_dir: &str,
+    allow_shared_macs: bool,
+) -> Result<Vec<Host>, anyhow::Error> {
+    let config_file = Path::new(source_dir).join(HOST_MAPPING_FILE);
+
+    let file = fs::File::open(config_file)?;
+    let mut hosts: Vec<Host> = yaml::from_reader(file)?;
+
+    // The hostnames name the dirs of the hosts and end up in paths and commands.
+    for host in &hosts {
+        validate_hostname(&host.hostname)?;
+    }
+
+    // Ensure lower case formatting and match InfiniBand NICs by their GUIDs.
+    hosts.iter_mut().for_each(|h| {
+        h.interfaces.iter_mut().for_each(|i| match &i.mac_address {
+            None => {}
+            Some(addr) => i.mac_address = Some(normalize_address(addr)),
+        });
+    });
+
+    let duplicates = duplicate_macs(&hosts);
+    if !duplicates.is_empty() {
+        if !allow_shared_macs {
+            return Err(anyhow!(
+                "MAC addresses are assigned to several hosts: {}",
+                duplicates.join(", ")
+            ));
+        }
+
+        // Settled by the best match when identifying the host.
+        warn!(
+            "MAC addresses are assigned to several hosts: {}",
+            duplicates.join(", ")
+        );
+    }
+
+    Ok(hosts)
+}
+
+/// Returns the indexes of the hosts by the MAC addresses of their interfaces, in the order of the mapping,
+/// so that identifying one among thousands of hosts does not scan all of them for every local NIC.
+fn index_by_mac(hosts: &[Host]) -> HashMap<&str, Vec<usize>> {
+    let mut index: HashMap<&str, Vec<usize>> = HashMap::new();
+
+    for (position, host) in hosts.iter().enumerate() {
+        for mac in host
+            .interfaces
+            .iter()
+            .filter_map(|interface| interface.mac_address.as_deref())
+        {
+            let positions = index.entry(mac).or_default();
+            // Interfaces of the same host may share an address, e.g. a bond and its first port.
+            if positions.last() != Some(&position) {
+                positions.push(position);
+            }
+        }
+    }
+
+    index
+}
+
+/// Returns the MAC addresses assigned to several hosts along with their hostnames, e.g. `00:11:22:33:44:55 (node1, node3)`.
+pub(crate) fn duplicate_macs(hosts: &[Host]) -> Vec<String> {
+    let mut duplicates: Vec<String> = index_by_mac(hosts)
+        .into_iter()
+        .filter(|(_, positions)| positions.len() > 1)
+        .map(|(mac, positions)| {
+            let hostnames: Vec<&str> = positions
+                .iter()
+                .map(|&position| hosts[position].hostname.as_str())
+                .collect();
+            format!("{mac} ({})", hostnames.join(", "))
+        })
+        .collect();
+
+    duplicates.sort();
+    duplicates
+}
+
+/// Returns the physical NICs of the local system along with their permanent MAC addresses.
+pub(crate) fn local_nics() -> Result<Vec<NetworkInterface>, anyhow::Error> {
+    let network_interfaces = NetworkInterface::show()?;
+    let mut nics = physical_interfaces(&network_interfaces, SYSFS_NET_DIR);
+    use_permanent_addresses(&mut nics);
+    use_infiniband_addresses(&mut nics, SYSFS_NET_DIR);
+
+    Ok(nics)
+}
+
+/// Returns the interfaces backed by a device (e.g. PCI, USB or virtio NICs),
+/// excluding virtual ones such as bridges, bonds, veths or tuns.
+fn physical_interfaces(
+    network_interfaces: &[NetworkInterface],
+    sysfs_net_dir: &str,
+) -> Vec<NetworkInterface> {
+    network_interfaces
+        .iter()
+        .filter(|nic| {
+            let physical = is_physical(sysfs_net_dir, &nic.name);
+            if !physical {
+                debug!("Excluding virtual interface '{}'", nic.name);
+            }
+            physical
+        })
+        .cloned()
+        .collect()
+}
+
+/// Whether the interface is backed by a device, as opposed to virtual ones such as bridges or bonds.
+pub(crate) fn is_physical(sysfs_net_dir: &str, name: &str) -> bool {
+    Path::new(sysfs_net_dir).join(name).join("device").exists()
+}
+
+/// Point the configured MAC addresses belonging to virtual interfaces (e.g. bonds, VLANs or bridges) to the physical NICs
+/// underneath, since these are often copied from `ip a` on systems where the virtual interfaces cloned them.
+///
+/// Addresses which can not be attributed to a single physical NIC are only reported.
+fn map_virtual_addresses(
+    hosts: &mut [Host],
+    network_interfaces: &[NetworkInterface],
+    nics: &[NetworkInterface],
+    sysfs_net_dir: &str,
+) {
+    let virtual_interfaces: Vec<&NetworkInterface> = network_interfaces
+        .iter()
+        .filter(|nic| nic.mac_addr.is_some() && !nics.iter().any(|n| n.name == nic.name))
+        .collect();
+
+    for interface in hosts.iter_mut().flat_map(|host| host.interfaces.iter_mut()) {
+        let Some(mac_address) = interface.mac_address.clone() else {
+            continue;
+        };
+        if nics
+            .iter()
+            .any(|nic| nic.mac_addr.as_ref() == Some(&mac_address))
+        {
+            continue;
+        }
+
+        let Some(virtual_interface) = virtual_interfaces
+            .iter()
+            .find(|nic| nic.mac_addr.as_ref() == Some(&mac_address))
+        else {
+            continue;
+        };
+
+        let physical = underlying_nic(virtual_interface, network_interfaces, nics, sysfs_net_dir);
+        match physical.and_then(|nic| nic.mac_addr.as_ref().map(|mac| (nic, mac))) {
+            Some((nic, physical_address)) => {
+                warn!(
+                    interface = interface.logical_name.as_str();
+                    "MAC address {mac_address} of '{}' belongs to virtual interface '{}', using {physical_address} of its physical NIC '{}' instead",
+                    interface.logical_name, virtual_interface.name, nic.name
+                );
+                interface.mac_address = Some(physical_address.clone());
+            }
+            None => warn!(
+                interface = interface.logical_name.as_str();
+                "MAC address {mac_address} of '{}' belongs to virtual interface '{}' rather than a physical NIC",
+                interface.logical_name, virtual_interface.name
+            ),
+        }
+    }
+}
+
+/// Returns the physical NIC underneath the virtual interface, following its lower devices (e.g. the ports of a bond
+/// the VLAN is created on). The port whose current MAC address was cloned is preferred if there are several.
+fn underlying_nic<'a>(
+    virtual_interface: &NetworkInterface,
+    network_interfaces: &[NetworkInterface],
+    nics: &'a [NetworkInterface],
+    sysfs_net_dir: &str,
+) -> Option<&'a NetworkInterface> {
+    let lower: Vec<&NetworkInterface> = lower_devices(&virtual_interface.name, sysfs_net_dir)
+        .iter()
+        .filter_map(|name| nics.iter().find(|nic| &nic.name == name))
+        .collect();
+
+    let cloned_from = lower.iter().find(|nic| {
+        network_interfaces
+            .iter()
+            .any(|n| n.name == nic.name && n.mac_addr == virtual_interface.mac_addr)
+    });
+
+    match (cloned_from, lower.as_slice()) {
+        (Some(nic), _) => Some(nic),
+        (None, [nic]) => Some(nic),
+        _ => None,
+    }
+}
+
+/// Returns the names of all devices below the interface as linked via the `lower_<name>` entries in sysfs.
+fn lower_devices(name: &str, sysfs_net_dir: &str) -> Vec<String> {
+    let mut devices = Vec::new();
+    let mut pending = vec![name.to_string()];
+
+    while let Some(name) = pending.pop() {
+        let Ok(entries) = fs::read_dir(Path::new(sysfs_net_dir).join(&name)) else {
+            continue;
+        };
+
+        let mut lower: Vec<String> = entries
+            .filter_map(|entry| entry.ok())
+            .filter_map(|entry| {
+                entry
+                    .file_name()
+                    .to_str()
+                    .and_then(|name| name.strip_prefix("lower_"))
+                    .map(str::to_string)
+            })
+            .filter(|lower| !devices.contains(lower))
+            .collect();
+        lower.sort();
+
+        devices.extend(lower.iter().cloned());
+        pending.extend(lower);
+    }
+
+    devices
+}
+
+/// Replace the current MAC addresses of the NICs with their permanent ones where available,
+/// since the former may be inherited from a bond the NICs are ports of.
+fn use_permanent_addresses(nics: &mut [NetworkInterface]) {
+    for nic in nics {
+        match permanent_address(&nic.name) {
+            Ok(Some(address)) => {
+                if nic.mac_addr.as_ref() != Some(&address) {
+                    debug!(
+                        "Using permanent MAC address {address} of '{}' instead of {:?}",
+                        nic.name, nic.mac_addr
+                    );
+                }
+                nic.mac_addr = Some(address);
+            }
+            Ok(None) => {}
+            Err(err) => debug!("Reading permanent MAC address of '{}': {err}", nic.name),
+        }
+    }
+}
+
+pub(crate) fn load_identity(
+    identity_file: Option<&str>,
+) -> Result<Option<MachineIdentity>, anyhow::Error> {
+    match identity_file {
+        Some(path) => MachineIdentity::load(path).context("Loading machine identity"),
+        None => Ok(None),
+    }
+}
+
+/// Identify the preconfigured static host by the hostname in the machine identity if available,
+/// falling back to matching the MAC addresses if it is not or none of the hosts has that hostname.
+/// Matching the interface names is only attempted last and if explicitly enabled.
+pub(crate) fn find_host(
+    mut hosts: Vec<Host>,
+    network_interfaces: &[NetworkInterface],
+    identity: Option<&MachineIdentity>,
+    options: &MatchOptions,
+) -> Result<Host, anyhow::Error> {
+    if let Some(identity) = identity {
+        if let Some(index) = hosts.iter().position(|h| h.hostname == identity.hostname) {
+            info!("Identified host via the identity file");
+            return Ok(hosts.swap_remove(index));
+        }
+
+        warn!(
+            "Host '{}' from the identity file is not preconfigured, identifying host by MAC addresses",
+            identity.hostname
+        );
+    }
+
+    if options.by_name && matching_host(&hosts, network_interfaces, options)?.is_none() {
+        return identify_host_by_names(hosts, network_interfaces)
+            .ok_or_else(|| NoHostMatched.into());
+    }
+
+    identify_host(hosts, network_interfaces, options)?.ok_or_else(|| NoHostMatched.into())
+}
+
+/// Identify the preconfigured static host by the names of its Ethernet interfaces, all of which have to exist locally.
+///
+/// This is fragile, since interface names depend on the kernel, firmware and udev rules, and several hosts
+/// of a fleet built alike will carry the same names. Hosts are therefore only matched if exactly one of them fits.
+fn identify_host_by_names(
+    mut hosts: Vec<Host>,
+    network_interfaces: &[NetworkInterface],
+) -> Option<Host> {
+    warn!(
+        "None of the hosts match the local MAC addresses, falling back to matching interface names"
+    );
+
+    let matching: Vec<usize> = hosts
+        .iter()
+        .enumerate()
+        .filter(|(_, host)| {
+            let mut nics = host
+                .interfaces
+                .iter()
+                .filter(|interface| interface.is_nic())
+                .peekable();
+
+            nics.peek().is_some()
+                && nics.all(|interface| {
+                    network_interfaces
+                        .iter()
+                        .any(|nic| nic.name == interface.logical_name)
+                })
+        })
+        .map(|(index, _)| index)
+        .collect();
 
-    let host = identify_host(hosts, &network_interfaces)
-        .ok_or_else(|| anyhow!("None of the preconfigured hosts match local NICs"))?;
-    info!("Identified host: {}", host.hostname);
+    match matching[..] {
+        [index] => {
+            let host = hosts.swap_remove(index);
+            warn!(
+                "Identified host '{}' by interface names only, which does not guarantee this is the intended host! \
+                 Prefer MAC addresses or an identity file where possible",
+                host.hostname
+            );
+            Some(host)
+        }
+        [] => None,
+        _ => {
+            let hostnames: Vec<&str> = matching
+                .iter()
+                .map(|&index| hosts[index].hostname.as_str())
+                .collect();
+            warn!(
+                "Refusing to identify host by interface names: they match several hosts ({})",
+                hostnames.join(", ")
+            );
+            None
+        }
+    }
+}
 
-    fs::write(HOSTNAME_FILE, &host.hostname).context("Setting hostname")?;
-    info!("Set hostname: {}", host.hostname);
+/// Identify the preconfigured static host by matching the MAC address of at least one of the local network interfaces,
+/// or all of them for hosts matched in the `all` mode.
+fn identify_host(
+    mut hosts: Vec<Host>,
+    network_interfaces: &[NetworkInterface],
+    options: &MatchOptions,
+) -> Result<Option<Host>, anyhow::Error> {
+    let position = matching_host(&hosts, network_interfaces, options)?;
+    Ok(position.map(|position| hosts.swap_remove(position)))
+}
 
-    let local_interfaces = detect_local_interfaces(&host, network_interfaces);
-    copy_connection_files(
-        host,
-        local_interfaces,
-        source_dir,
-        STATIC_SYSTEM_CONNECTIONS_DIR,
-    )
-    .context("Copying connection files")?;
+/// Returns the position of the host in the mapping having the most interfaces with the MAC addresses of the NICs,
+/// e.g. in case a NIC was moved between machines. Of several hosts scoring the same, the first one is picked unless
+/// the options ask to fail instead.
+///
+/// Hosts matched in the `all` mode are skipped unless the NICs of all their Ethernet interfaces are present.
+/// Fails listing the missing NICs if no other host matches, since the host is likely to have lost a NIC then.
+fn matching_host(
+    hosts: &[Host],
+    network_interfaces: &[NetworkInterface],
+    options: &MatchOptions,
+) -> Result<Option<usize>, anyhow::Error> {
+    let index = index_by_mac(hosts);
+    let local_macs = local_macs(network_interfaces);
+
+    let mut positions: Vec<usize> = local_macs
+        .iter()
+        .filter_map(|mac| index.get(mac))
+        .flatten()
+        .copied()
+        .collect();
+    positions.sort();
+    positions.dedup();
+
+    let mut incomplete = Vec::new();
+    let mut scores = Vec::new();
+    for position in positions {
+        let host = &hosts[position];
+        if host.match_mode.unwrap_or(options.mode) == MatchMode::All {
+            let missing = missing_nics(host, &local_macs);
+            if !missing.is_empty() {
+                warn!(
+                    "Host '{}' requires all of its NICs to be present, missing: {}",
+                    host.hostname,
+                    missing.join(", ")
+                );
+                incomplete.push(format!(
+                    "{} (missing {})",
+                    host.hostname,
+                    missing.join(", ")
+                ));
+                continue;
+            }
+        }
+
+        scores.push((position, matched_interfaces(host, &local_macs)));
+    }
+
+    if scores.is_empty() {
+        if incomplete.is_empty() {
+            return Ok(None);
+        }
+
+        return Err(anyhow::Error::from(NoHostMatched).context(format!(
+            "Hosts requiring all of their NICs lack some of them: {}",
+            incomplete.join("; ")
+        )));
+    }
+
+    if scores.len() > 1 {
+        for (position, matched) in &scores {
+            let host = &hosts[*position];
+            let total = host
+                .interfaces
+                .iter()
+                .filter(|interface| interface.mac_address.is_some())
+                .count();
+            info!(
+                "Host '{}' matches {} of {total} interfaces ({})",
+                host.hostname,
+                matched.len(),
+                matched.join(", ")
+            );
+        }
+    }
+
+    let best = scores
+        .iter()
+        .map(|(_, matched)| matched.len())
+        .max()
+        .unwrap_or_default();
+    let best_hosts: Vec<usize> = scores
+        .iter()
+        .filter(|(_, matched)| matched.len() == best)
+        .map(|(position, _)| *position)
+        .collect();
+
+    if best_hosts.len() > 1 {
+        let hostnames: Vec<&str> = best_hosts
+            .iter()
+            .map(|&position| hosts[position].hostname.as_str())
+            .collect();
+        if options.fail_on_ambiguous {
+            return Err(anyhow!(
+                "Identifying host is ambiguous, {} hosts match {best} interfaces each: {}",
+                hostnames.len(),
+                hostnames.join(", ")
+            ));
+        }
 
-    disable_wired_connections(CONFIG_DIR, RUNTIME_SYSTEM_CONNECTIONS_DIR)
-        .context("Disabling wired connections")
+        warn!(
+            "{} hosts match {best} interfaces each ({}), picking the first one in the host mapping",
+            hostnames.len(),
+            hostnames.join(", ")
+        );
+    }
+
+    Ok(Some(best_hosts[0]))
 }
 
-fn parse_config(source_dir: &str) -> Result<Vec<Host>, anyhow::Error> {
-    let config_file = Path::new(source_dir).join(HOST_MAPPING_FILE);
+/// Report the host's Ethernet interfaces whose NICs are missing (e.g. a failed NIC or one moved to another slot),
+/// since their connection files reference hardware which isn't there. Fails instead if `strict`.
+fn check_missing_nics(
+    host: &Host,
+    network_interfaces: &[NetworkInterface],
+    strict: bool,
+) -> Result<(), anyhow::Error> {
+    let local_macs = local_macs(network_interfaces);
+    let missing = missing_nics(host, &local_macs);
+    if missing.is_empty() {
+        return Ok(());
+    }
 
-    let file = fs::File::open(config_file)?;
-    let mut hosts: Vec<Host> = serde_yaml::from_reader(file)?;
+    if strict {
+        return Err(anyhow!(
+            "NICs of {} interfaces are missing: {}",
+            missing.len(),
+            missing.join(", ")
+        ));
+    }
 
-    // Ensure lower case formatting.
-    hosts.iter_mut().for_each(|h| {
-        h.interfaces.iter_mut().for_each(|i| match &i.mac_address {
-            None => {}
-            Some(addr) => i.mac_address = Some(addr.to_lowercase()),
-        });
-    });
+    for interface in missing {
+        warn!("NIC of interface {interface} is missing, its connections will not activate");
+    }
 
-    Ok(hosts)
+    Ok(())
 }
 
-/// Identify the preconfigured static host by matching the MAC address of at least one of the local network interfaces.
-fn identify_host(hosts: Vec<Host>, network_interfaces: &[NetworkInterface]) -> Option<Host> {
-    hosts.into_iter().find(|h| {
-        h.interfaces.iter().any(|interface| {
-            network_interfaces
-                .iter()
-                .filter(|nic| nic.mac_addr.is_some())
-                .any(|nic| nic.mac_addr == interface.mac_address)
+/// Returns the names of the host's interfaces whose MAC addresses are among the local ones.
+fn matched_interfaces<'a>(host: &'a Host, local_macs: &HashSet<&str>) -> Vec<&'a str> {
+    host.interfaces
+        .iter()
+        .filter(|interface| {
+            interface
+                .mac_address
+                .as_deref()
+                .is_some_and(|mac| local_macs.contains(mac))
         })
-    })
+        .map(|interface| interface.logical_name.as_str())
+        .collect()
+}
+
+fn local_macs(network_interfaces: &[NetworkInterface]) -> HashSet<&str> {
+    network_interfaces
+        .iter()
+        .filter_map(|nic| nic.mac_addr.as_deref())
+        .collect()
+}
+
+/// Returns the NICs of the host whose MAC addresses are not among the local ones, e.g. `eth1 (00:11:22:33:44:56)`.
+fn missing_nics(host: &Host, local_macs: &HashSet<&str>) -> Vec<String> {
+    host.interfaces
+        .iter()
+        .filter(|interface| interface.is_nic())
+        .filter_map(|interface| {
+            let mac = interface.mac_address.as_deref()?;
+            (!local_macs.contains(mac)).then(|| format!("{} ({mac})", interface.logical_name))
+        })
+        .collect()
 }
 
 /// Detect and return the differences between the preconfigured interfaces and their local representations.
@@ -81,7 +1612,7 @@ fn identify_host(hosts: Vec<Host>, network_interfaces: &[NetworkInterface]) -> O
 /// Examples:
 ///     Desired Ethernet "eth0" -> Local "ens1f0"
 ///     Desired VLAN "eth0.1365" -> Local "ens1f0.1365"
-fn detect_local_interfaces(
+pub(crate) fn detect_local_interfaces(
     host: &Host,
     network_interfaces: Vec<NetworkInterface>,
 ) -> HashMap<String, String> {
@@ -89,7 +1620,7 @@ fn detect_local_interfaces(
 
     host.interfaces
         .iter()
-        .filter(|interface| interface.interface_type == InterfaceType::Ethernet.to_string())
+        .filter(|interface| interface.is_nic())
         .for_each(|interface| {
             let detected_interface = network_interfaces.iter().find(|nic| {
                 nic.mac_addr == interface.mac_address
@@ -119,60 +1650,649 @@ fn detect_local_interfaces(
     local_interfaces
 }
 
-/// Copy all *.nmconnection files from the preconfigured host dir to the
-/// appropriate NetworkManager dir (default `/etc/NetworkManager/system-connections`).
-fn copy_connection_files(
-    host: Host,
-    local_interfaces: HashMap<String, String>,
-    source_dir: &str,
-    destination_dir: &str,
-) -> Result<(), anyhow::Error> {
-    fs::create_dir_all(destination_dir).context("Creating destination dir")?;
+/// Resolve the references and placeholders in the contents of the connection file.
+///
+/// Placeholders are never stored verbatim if the expansion is not enabled, since e.g. a Wi-Fi connection
+/// with `psk=@@WIFI_PSK@@` would silently fail to authenticate.
+fn expand_secrets(
+    name: &str,
+    contents: String,
+    secrets: Option<&Secrets>,
+) -> Result<String, anyhow::Error> {
+    if let Some(secrets) = secrets {
+        return secrets.expand(&contents).context("Expanding variables");
+    }
+
+    let placeholders = referenced_placeholders(&contents);
+    if !placeholders.is_empty() {
+        return Err(anyhow!(
+            "Connection file '{name}' contains secret placeholders ({}), declare secret providers or use --expand-env",
+            placeholders.join(", ")
+        ));
+    }
 
+    Ok(contents)
+}
+
+/// Read all *.nmconnection files from the preconfigured host dir and adjust
+/// them to the local interface names where those differ from the static config.
+///
+/// Files in the common dir are layered beneath the host ones, and the ones
+/// not overridden by the host are included as they are.
+///
+/// References to the renamed interfaces (e.g. VLAN parents or bond/bridge controllers)
+/// are adjusted in all files, regardless of which interface they belong to.
+fn prepare_connection_files(
+    host: &Host,
+    local_interfaces: &HashMap<String, String>,
+    source_dir: &str,
+    secrets: Option<&Secrets>,
+    file_filter: &FileFilter,
+) -> Result<Vec<ConnectionFile>, anyhow::Error> {
     let host_config_dir = Path::new(source_dir).join(&host.hostname);
     let host_config_dir = host_config_dir
         .to_str()
         .ok_or_else(|| anyhow!("Determining host config path"))?;
 
+    let common_config_dir = Path::new(source_dir).join(COMMON_CONFIG_DIR);
+    let common_config_dir = common_config_dir
+        .to_str()
+        .ok_or_else(|| anyhow!("Determining common config path"))?;
+
+    check_host_dir(host, host_config_dir, file_filter)?;
+
+    let mut connection_files = Vec::new();
+    // The references to the renamed interfaces and to their OVS ports, which follow them.
+    let mut references = local_interfaces.clone();
+
     for interface in &host.interfaces {
-        info!("Processing interface '{}'...", &interface.logical_name);
+        info!(
+            interface = interface.logical_name.as_str();
+            "Processing interface '{}'...", &interface.logical_name
+        );
+
+        let local_name = local_interfaces.get(&interface.logical_name);
+        if let Some(local_name) = local_name {
+            info!(
+                interface = interface.logical_name.as_str();
+                "Using interface name '{}' instead of the preconfigured '{}'",
+                local_name, interface.logical_name
+            );
+        }
 
-        let mut filename = &interface.logical_name;
+        // The primary profile and the additional ones, as well as the OVS port the interface is attached to,
+        // all of which follow the interface when renamed.
+        let mut names = interface.connection_names();
+        if let Some(port_name) = interface.ovs_port_name() {
+            if [host_config_dir, common_config_dir]
+                .iter()
+                .any(|dir| keyfile_path(dir, &port_name).is_some_and(|path| path.exists()))
+            {
+                if let Some(local_name) = local_name {
+                    references.insert(
+                        port_name.clone(),
+                        local_connection_name(&port_name, interface, local_name),
+                    );
+                }
+                names.push(port_name);
+            }
+        }
 
-        let filepath = keyfile_path(host_config_dir, filename)
-            .ok_or_else(|| anyhow!("Determining source keyfile path"))?;
+        for name in names {
+            let contents = read_layered_keyfile(host_config_dir, common_config_dir, &name)?;
+            let mut contents = expand_secrets(&name, contents, secrets)?;
 
-        let mut contents = fs::read_to_string(filepath).context("Reading file")?;
+            // The file and the connection it holds are named after the local interface, while its references
+            // to interfaces are renamed along with those of all other files below.
+            let name = match local_name {
+                None => name,
+                Some(local_name) => {
+                    let renamed = local_connection_name(&name, interface, local_name);
+                    contents = rename_connection_id(&contents, &name, &renamed);
+                    renamed
+                }
+            };
 
-        // Update the name and all references of the host NIC in the settings file if there is a difference from the static config.
-        match local_interfaces.get(&interface.logical_name) {
-            None => {}
-            Some(local_name) => {
-                info!(
-                    "Using interface name '{}' instead of the preconfigured '{}'",
-                    local_name, interface.logical_name
-                );
+            connection_files.push(ConnectionFile { name, contents });
+        }
+    }
+
+    for name in common_keyfile_names(common_config_dir, file_filter)? {
+        if host.interfaces.iter().any(|i| {
+            i.connection_names().contains(&name) || i.ovs_port_name().as_ref() == Some(&name)
+        }) {
+            continue;
+        }
+
+        info!(file = name.as_str(); "Processing common connection '{name}'...");
+
+        let filepath = keyfile_path(common_config_dir, &name)
+            .ok_or_else(|| anyhow!("Determining common keyfile path"))?;
+
+        let contents = fs::read_to_string(filepath).context("Reading common file")?;
+        let contents = expand_secrets(&name, contents, secrets)?;
+
+        connection_files.push(ConnectionFile { name, contents });
+    }
+
+    for file in &mut connection_files {
+        let contents = rename_interface_references(&file.contents, &references);
+        if contents != file.contents {
+            debug!(file = file.name.as_str(); "Adjusted interface references in '{}'", file.name);
+            file.contents = contents;
+        }
+    }
+
+    Ok(connection_files)
+}
+
+/// Returns the name of the connection after the local interface. The connection names start with the
+/// interface name, e.g. `eth0@dhcp` or `eth0-port`.
+fn local_connection_name(name: &str, interface: &Interface, local_name: &str) -> String {
+    format!("{local_name}{}", &name[interface.logical_name.len()..])
+}
+
+/// Read the keyfile with the given name from the host dir and merge it on top of
+/// the one in the common dir on a key level (if such exists).
+fn read_layered_keyfile(
+    host_config_dir: &str,
+    common_config_dir: &str,
+    name: &str,
+) -> Result<String, anyhow::Error> {
+    let host_path = keyfile_path(host_config_dir, name)
+        .ok_or_else(|| anyhow!("Determining source keyfile path"))?;
+    let common_path = keyfile_path(common_config_dir, name)
+        .ok_or_else(|| anyhow!("Determining common keyfile path"))?;
+
+    if !common_path.exists() {
+        return fs::read_to_string(host_path).context("Reading file");
+    }
+
+    let common = fs::read_to_string(common_path).context("Reading common file")?;
+    if !host_path.exists() {
+        debug!("Using common config for '{name}'");
+        return Ok(common);
+    }
+
+    let host = fs::read_to_string(host_path).context("Reading file")?;
+    debug!("Merging host config for '{name}' on top of the common one");
+
+    let mut keyfile = Keyfile::parse(&common);
+    keyfile.merge(&Keyfile::parse(&host));
+
+    Ok(keyfile.to_string())
+}
+
+/// Check the host dir for files which do not belong to any of the host's interfaces, e.g. misnamed connection files.
+fn check_host_dir(
+    host: &Host,
+    host_config_dir: &str,
+    file_filter: &FileFilter,
+) -> Result<(), anyhow::Error> {
+    let dir = Path::new(host_config_dir);
+    if !dir.exists() {
+        return Ok(());
+    }
+
+    for entry in fs::read_dir(dir).context("Reading host config dir")? {
+        let path = entry?.path();
+
+        let expected = if path.is_dir() {
+            path.file_name()
+                .is_some_and(|name| name == CONF_D_DIR || name == DISPATCHER_D_DIR)
+        } else {
+            host.interfaces
+                .iter()
+                .flat_map(|interface| {
+                    let mut names = interface.connection_names();
+                    names.extend(interface.ovs_port_name());
+                    names
+                })
+                .any(|name| keyfile_path(host_config_dir, &name).as_ref() == Some(&path))
+        };
+
+        if !expected {
+            file_filter.check_unexpected(&path, "host config dir")?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Returns the names (without extension) of all keyfiles in the common dir, sorted alphabetically.
+fn common_keyfile_names(
+    common_config_dir: &str,
+    file_filter: &FileFilter,
+) -> Result<Vec<String>, anyhow::Error> {
+    let dir = Path::new(common_config_dir);
+    if !dir.exists() {
+        return Ok(Vec::new());
+    }
+
+    let mut names = Vec::new();
+
+    for entry in fs::read_dir(dir).context("Reading common config dir")? {
+        let path = entry?.path();
+
+        let Some(filename) = path.file_name().and_then(|name| name.to_str()) else {
+            continue;
+        };
+
+        match filename.strip_suffix(&format!(".{CONNECTION_FILE_EXT}")) {
+            Some(name) if path.is_file() => names.push(name.to_string()),
+            _ => file_filter.check_unexpected(&path, "common config dir")?,
+        }
+    }
+
+    names.sort();
+
+    Ok(names)
+}
+
+/// Carry over the UUIDs of the connections already stored in the destination dir, so that NetworkManager treats
+/// the files as updates of the existing profiles rather than new ones (which would otherwise end up duplicated
+/// and lose their per-connection state). References to the replaced UUIDs (e.g. the controller of a bond port)
+/// are adjusted in all connection files of the host.
+///
+/// A stored file only counts as the same connection if its ID or interface name matches.
+fn preserve_uuids(
+    connection_files: &mut [ConnectionFile],
+    destination_dir: &str,
+) -> Result<(), anyhow::Error> {
+    let mut replacements = HashMap::new();
+
+    for file in connection_files.iter() {
+        let path = keyfile_path(destination_dir, &file.name)
+            .ok_or_else(|| anyhow!("Determining destination keyfile path"))?;
+        let existing = match fs::read_to_string(&path) {
+            Ok(contents) => Keyfile::parse(&contents),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => continue,
+            Err(err) => return Err(err).with_context(|| format!("Reading {path:?}")),
+        };
+        let keyfile = Keyfile::parse(&file.contents);
+
+        let matches = |key| {
+            keyfile
+                .get("connection", key)
+                .is_some_and(|value| existing.get("connection", key) == Some(value))
+        };
+        if !matches("id") && !matches("interface-name") {
+            continue;
+        }
+
+        if let (Some(uuid), Some(existing_uuid)) = (
+            keyfile.get("connection", "uuid"),
+            existing.get("connection", "uuid"),
+        ) {
+            if uuid != existing_uuid {
+                info!(file = file.name.as_str(); "Preserving UUID {existing_uuid} of {path:?}");
+                replacements.insert(uuid.to_string(), existing_uuid.to_string());
+            }
+        }
+    }
+
+    if replacements.is_empty() {
+        return Ok(());
+    }
+
+    for file in connection_files {
+        file.contents = replace_uuid_references(&file.contents, &replacements);
+    }
+
+    Ok(())
+}
+
+/// Create the connections dir if it is missing (e.g. the one under /run before NetworkManager started), restricted
+/// to root since the connection files may contain secrets. The permissions of an existing dir are left untouched.
+fn create_connections_dir(filesystem: &dyn FileSystem, path: &Path) -> Result<(), anyhow::Error> {
+    filesystem
+        .create_dir_with_mode(path, CONNECTIONS_DIR_MODE)
+        .with_context(|| format!("Creating {path:?}"))
+}
+
+/// Store the connection files in the appropriate NetworkManager dir
+/// (default `/etc/NetworkManager/system-connections`) and return their paths.
+/// Files which already have the desired contents are left untouched.
+///
+/// Keyfiles are converted to `ifcfg-*` files if `format` asks for them.
+fn store_connection_files(
+    filesystem: &dyn FileSystem,
+    connection_files: &[ConnectionFile],
+    destination_dir: &str,
+    format: Format,
+) -> Result<Vec<(PathBuf, FileAction)>, anyhow::Error> {
+    filesystem
+        .create_dir_all(Path::new(destination_dir))
+        .context("Creating destination dir")?;
+
+    let mut stored_files = Vec::new();
+
+    for file in connection_files {
+        let (destination, contents) = match format {
+            Format::Keyfile => (
+                keyfile_path(destination_dir, &file.name)
+                    .ok_or_else(|| anyhow!("Determining destination keyfile path"))?,
+                file.contents.clone(),
+            ),
+            Format::Ifcfg => (
+                Path::new(destination_dir).join(format.filename(&file.name)),
+                to_ifcfg(&file.name, &Keyfile::parse(&file.contents))?,
+            ),
+            Format::Networkd | Format::Netplan => {
+                return Err(anyhow!(
+                    "The networkd and netplan formats are only supported by generate"
+                ))
+            }
+        };
+
+        let action = write_if_changed(filesystem, &destination, contents.as_bytes(), 0o600)?;
+        progress::emit(Event {
+            file: Some(&destination),
+            ..Event::new(
+                "store",
+                store_percent(stored_files.len() + 1, connection_files.len()),
+            )
+        });
+
+        if action == FileAction::Skipped {
+            info!(file = file.name.as_str(); "{destination:?} unchanged");
+        } else {
+            trace!(file = file.name.as_str(); "Stored {destination:?}:\n{contents}");
+        }
+
+        stored_files.push((destination, action));
+    }
+
+    Ok(stored_files)
+}
+
+/// Read the NetworkManager.conf drop-ins from the given dir sorted by name. A missing dir yields none.
+///
+/// Only `*.conf` files are read by NetworkManager, so other files are treated as unexpected.
+fn read_drop_ins(dir: &Path, file_filter: &FileFilter) -> Result<Vec<HostFile>, anyhow::Error> {
+    let drop_ins = read_host_files(dir, "conf.d dir", file_filter, |name| {
+        name.ends_with(".conf")
+    })?;
+
+    if drop_ins
+        .iter()
+        .any(|file| file.name == NO_AUTO_DEFAULT_FILE)
+    {
+        return Err(anyhow!(
+            "Drop-in name '{NO_AUTO_DEFAULT_FILE}' is reserved by NMC"
+        ));
+    }
+
+    Ok(drop_ins)
+}
+
+/// Read the dispatcher scripts from the given dir sorted by name. A missing dir yields none.
+///
+/// Hidden files are never run by NetworkManager, so they are treated as unexpected.
+fn read_dispatcher_scripts(
+    dir: &Path,
+    file_filter: &FileFilter,
+) -> Result<Vec<HostFile>, anyhow::Error> {
+    read_host_files(dir, "dispatcher.d dir", file_filter, |name| {
+        !name.starts_with('.')
+    })
+}
+
+fn read_host_files(
+    dir: &Path,
+    location: &str,
+    file_filter: &FileFilter,
+    expected: impl Fn(&str) -> bool,
+) -> Result<Vec<HostFile>, anyhow::Error> {
+    if !dir.exists() {
+        return Ok(Vec::new());
+    }
+
+    let mut files = Vec::new();
+
+    for entry in fs::read_dir(dir).with_context(|| format!("Reading {location}"))? {
+        let path = entry?.path();
+
+        let name = match path.file_name().and_then(|name| name.to_str()) {
+            Some(name) if path.is_file() && expected(name) => name.to_owned(),
+            _ => {
+                file_filter.check_unexpected(&path, location)?;
+                continue;
+            }
+        };
+
+        let contents = fs::read(&path).with_context(|| format!("Reading {path:?}"))?;
+        files.push(HostFile { name, contents });
+    }
+
+    files.sort_by(|a, b| a.name.cmp(&b.name));
+
+    Ok(files)
+}
+
+/// Store the drop-ins readable by everyone, as NetworkManager.conf itself is.
+/// The permissions of already existing files are corrected as well.
+fn store_drop_ins(
+    filesystem: &dyn FileSystem,
+    drop_ins: &[HostFile],
+    destination_dir: &str,
+) -> Result<Vec<(PathBuf, FileAction)>, anyhow::Error> {
+    store_host_files(filesystem, drop_ins, destination_dir, 0o644, None)
+}
+
+/// Store the dispatcher scripts executable and owned by the given user (root outside of tests),
+/// since NetworkManager ignores scripts which are not owned by root or are writable by others.
+/// The permissions and ownership of already existing files are corrected as well.
+fn store_dispatcher_scripts(
+    filesystem: &dyn FileSystem,
+    scripts: &[HostFile],
+    destination_dir: &str,
+    owner: u32,
+) -> Result<Vec<(PathBuf, FileAction)>, anyhow::Error> {
+    store_host_files(filesystem, scripts, destination_dir, 0o755, Some(owner))
+}
+
+fn store_host_files(
+    filesystem: &dyn FileSystem,
+    files: &[HostFile],
+    destination_dir: &str,
+    mode: u32,
+    owner: Option<u32>,
+) -> Result<Vec<(PathBuf, FileAction)>, anyhow::Error> {
+    if files.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    filesystem
+        .create_dir_all(Path::new(destination_dir))
+        .context("Creating destination dir")?;
+
+    let mut stored = Vec::new();
+
+    for file in files {
+        let destination = Path::new(destination_dir).join(&file.name);
+
+        let action = write_if_changed(filesystem, &destination, &file.contents, mode)?;
+        if let Some(owner) = owner {
+            filesystem
+                .set_owner(&destination, owner)
+                .with_context(|| format!("Changing owner of {destination:?}"))?;
+        }
+        filesystem
+            .set_permissions(&destination, mode)
+            .with_context(|| format!("Setting permissions of {destination:?}"))?;
+
+        if action == FileAction::Skipped {
+            info!(file = file.name.as_str(); "{destination:?} unchanged");
+        } else {
+            info!(file = file.name.as_str(); "Stored {destination:?}");
+        }
+
+        stored.push((destination, action));
+    }
+
+    Ok(stored)
+}
+
+/// Returns the selected connection files. Fails if the selection names a connection which is not part of the config.
+fn select_connection_files(
+    connection_files: Vec<ConnectionFile>,
+    local_interfaces: &HashMap<String, String>,
+    selection: &Selection,
+) -> Result<Vec<ConnectionFile>, anyhow::Error> {
+    // A file is named after the local interface, but may also be referred to by the preconfigured name.
+    // Naming the interface selects all of its profiles, naming a profile (e.g. `eth0@dhcp`) only that one.
+    let names = |file: &ConnectionFile| {
+        let interface = interface_of(&file.name);
+        let mut names = vec![file.name.clone(), interface.to_string()];
+        for (logical_name, _) in local_interfaces
+            .iter()
+            .filter(|(_, local_name)| **local_name == interface)
+        {
+            names.push(rename_connection(&file.name, logical_name));
+            names.push(logical_name.clone());
+        }
+        names.dedup();
+        names
+    };
+
+    for name in selection.only.iter().chain(&selection.skip) {
+        if !connection_files
+            .iter()
+            .any(|file| names(file).contains(name))
+        {
+            return Err(anyhow!(
+                "Connection '{name}' is not part of the host's config"
+            ));
+        }
+    }
+
+    Ok(connection_files
+        .into_iter()
+        .filter(|file| {
+            let names = names(file);
+            let selected =
+                selection.only.is_empty() || selection.only.iter().any(|name| names.contains(name));
+            let skipped = selection.skip.iter().any(|name| names.contains(name));
+
+            if !selected || skipped {
+                info!("Skipping connection '{}'", file.name);
+            }
+            selected && !skipped
+        })
+        .collect())
+}
+
+/// Returns the connection files stored by a previous run which are no longer part of the config.
+fn stale_files(
+    filesystem: &dyn FileSystem,
+    previous_state: Option<&State>,
+    stored_files: &[(PathBuf, FileAction)],
+) -> io::Result<Vec<PathBuf>> {
+    let Some(state) = previous_state else {
+        return Ok(Vec::new());
+    };
+
+    let mut stale = Vec::new();
+    for path in &state.connection_files {
+        if !stored_files.iter().any(|(stored, _)| stored == path)
+            && filesystem.read(path)?.is_some()
+        {
+            stale.push(path.clone());
+        }
+    }
+
+    Ok(stale)
+}
+
+fn prune_files(filesystem: &dyn FileSystem, paths: &[PathBuf]) -> Result<(), anyhow::Error> {
+    for path in paths {
+        filesystem
+            .remove_file(path)
+            .with_context(|| format!("Removing {path:?}"))?;
+        info!("Removed stale connection file {path:?}");
+    }
+
+    Ok(())
+}
+
+/// Storing the files accounts for the progress between 60% and 90%.
+fn store_percent(stored: usize, total: usize) -> u8 {
+    (60 + 30 * stored / total.max(1)) as u8
+}
+
+/// Set the hostname of the machine to the one of the identified host, unless the hostname file already holds it.
+fn set_hostname(
+    filesystem: &dyn FileSystem,
+    hostname: &str,
+    method: HostnameMethod,
+    hostname_file: &str,
+) -> Result<(), anyhow::Error> {
+    match method {
+        HostnameMethod::Keep => {
+            info!("Keeping the hostname, identified host: {hostname}");
+        }
+        HostnameMethod::File => {
+            match write_if_changed(
+                filesystem,
+                Path::new(hostname_file),
+                hostname.as_bytes(),
+                0o644,
+            )? {
+                FileAction::Skipped => info!("Hostname unchanged: {hostname}"),
+                _ => info!("Set hostname: {hostname}"),
+            }
+        }
+        HostnameMethod::Hostnamed => {
+            // hostnamed stores the static hostname in the same file.
+            let current = filesystem
+                .read(Path::new(hostname_file))
+                .ok()
+                .flatten()
+                .unwrap_or_default();
+            if String::from_utf8_lossy(&current).trim() == hostname {
+                info!("Hostname unchanged: {hostname}");
+                return Ok(());
+            }
 
-                contents = contents.replace(&interface.logical_name, local_name);
-                filename = local_name;
+            let status = deadline::status(Command::new("hostnamectl").args([
+                "set-hostname",
+                "--static",
+                hostname,
+            ]))
+            .context("Running hostnamectl")?;
+            if !status.success() {
+                return Err(anyhow!("hostnamectl exited with {status}"));
             }
+            info!("Set hostname via hostnamed: {hostname}");
         }
+    }
 
-        let destination = keyfile_path(destination_dir, filename)
-            .ok_or_else(|| anyhow!("Determining destination keyfile path"))?;
+    Ok(())
+}
+
+/// Write the contents to the file unless it already holds exactly them, so that unchanged files
+/// keep their modification time and NetworkManager sees no reason to reload them.
+/// The mode only applies to newly created files.
+pub(crate) fn write_if_changed(
+    filesystem: &dyn FileSystem,
+    path: &Path,
+    contents: &[u8],
+    mode: u32,
+) -> Result<FileAction, anyhow::Error> {
+    let action = match filesystem.read(path).context("Reading existing file")? {
+        Some(existing) if existing == contents => FileAction::Skipped,
+        Some(..) => FileAction::Updated,
+        None => FileAction::Created,
+    };
 
-        fs::OpenOptions::new()
-            .create(true)
-            .truncate(true)
-            .write(true)
-            .mode(0o600)
-            .open(&destination)
-            .context("Creating file")?
-            .write_all(contents.as_bytes())
+    if action != FileAction::Skipped {
+        filesystem
+            .write(path, contents, mode)
             .context("Writing file")?;
     }
 
-    Ok(())
+    Ok(action)
 }
 
 fn keyfile_path(dir: &str, filename: &str) -> Option<PathBuf> {
@@ -190,42 +2310,66 @@ fn keyfile_path(dir: &str, filename: &str) -> Option<PathBuf> {
     Some(destination.into())
 }
 
-fn disable_wired_connections(config_dir: &str, conn_dir: &str) -> Result<(), anyhow::Error> {
-    let _ = fs::remove_dir_all(conn_dir);
-    fs::create_dir_all(conn_dir).context(format!("Recreating {} directory", conn_dir))?;
+fn disable_wired_connections(
+    filesystem: &dyn FileSystem,
+    config_dir: &str,
+    conn_dir: Option<&str>,
+) -> Result<(), anyhow::Error> {
+    if let Some(conn_dir) = conn_dir {
+        let conn_dir = Path::new(conn_dir);
+        let _ = filesystem.remove_dir_all(conn_dir);
+        filesystem
+            .create_dir_all(conn_dir)
+            .context(format!("Recreating {conn_dir:?} directory"))?;
+    }
 
-    fs::create_dir_all(config_dir).context(format!("Creating {} directory", config_dir))?;
+    filesystem
+        .create_dir_all(Path::new(config_dir))
+        .context(format!("Creating {} directory", config_dir))?;
 
-    let config_path = Path::new(config_dir).join("no-auto-default.conf");
+    let config_path = Path::new(config_dir).join(NO_AUTO_DEFAULT_FILE);
     let config_contents = "[main]\nno-auto-default=*\n";
 
-    fs::OpenOptions::new()
-        .create(true)
-        .truncate(true)
-        .write(true)
-        .open(config_path)
-        .context("Creating config file")?
-        .write_all(config_contents.as_bytes())
-        .context("Writing config file")
+    write_if_changed(filesystem, &config_path, config_contents.as_bytes(), 0o644)
+        .context("Writing config file")?;
+
+    Ok(())
 }
 
 #[cfg(test)]
 mod tests {
-    use std::collections::HashMap;
+    use std::collections::{BTreeMap, HashMap};
+    use std::os::unix::fs::{MetadataExt, PermissionsExt};
     use std::path::{Path, PathBuf};
     use std::{fs, io};
 
     use network_interface::NetworkInterface;
 
     use crate::apply_conf::{
-        copy_connection_files, detect_local_interfaces, disable_wired_connections, identify_host,
-        keyfile_path, parse_config,
+        allowed_dispatcher_scripts, build_report, check_host_dir, check_missing_nics,
+        closest_hosts, common_keyfile_names, create_connections_dir, describe_match,
+        detect_local_interfaces, disable_wired_connections, duplicate_macs, expand_secrets,
+        find_host, format_candidates, format_identity, identify_host, keyfile_path, load_hooks,
+        lower_devices, mac_distance, map_virtual_addresses, parse_config, physical_interfaces,
+        prepare_connection_files, preserve_uuids, prune_files, read_dispatcher_scripts,
+        read_drop_ins, select_connection_files, set_hostname, stale_files, store_connection_files,
+        store_dispatcher_scripts, store_drop_ins, ApplyOptions, Candidate, ConnectionFile,
+        HostFile, HostnameMethod, MatchOptions, NoHostMatched, Selection,
     };
-    use crate::types::{Host, Interface};
+    use crate::bundle::ConfigServer;
+    use crate::file_filter::FileFilter;
+    use crate::filesystem::{Disk, FileSystem, Memory};
+    use crate::identity::MachineIdentity;
+    use crate::ifcfg::Format;
+    use crate::keyfile::Keyfile;
+    use crate::report::{FileAction, FileReport};
+    use crate::secrets::Secrets;
+    use crate::state::State;
+    use crate::types::{Host, Interface, MatchMode};
 
     #[test]
     fn disable_wired_conn() {
-        assert!(disable_wired_connections("config", "connections").is_ok());
+        assert!(disable_wired_connections(&Disk, "config", Some("connections")).is_ok());
 
         assert!(Path::new("config").exists());
         assert!(Path::new("connections").exists());
@@ -238,6 +2382,91 @@ mod tests {
         assert!(fs::remove_dir_all("connections").is_ok());
     }
 
+    #[test]
+    fn disable_wired_conn_in_memory() {
+        let memory = Memory::default();
+        memory
+            .write(
+                Path::new("connections/Wired connection 1.nmconnection"),
+                b"",
+                0o600,
+            )
+            .unwrap();
+
+        disable_wired_connections(&memory, "config", Some("connections")).unwrap();
+
+        assert_eq!(
+            memory.files(),
+            BTreeMap::from([(
+                PathBuf::from("config/no-auto-default.conf"),
+                b"[main]\nno-auto-default=*\n".to_vec()
+            )])
+        );
+    }
+
+    #[test]
+    fn create_missing_connections_dir() {
+        let dir = Path::new("_connections_dir/run/NetworkManager/system-connections");
+        let mode = |path: &Path| fs::metadata(path).unwrap().permissions().mode() & 0o777;
+
+        create_connections_dir(&Disk, dir).unwrap();
+        assert_eq!(mode(dir), 0o700);
+
+        // Existing dirs are left untouched
+        fs::set_permissions(dir, fs::Permissions::from_mode(0o755)).unwrap();
+        create_connections_dir(&Disk, dir).unwrap();
+        assert_eq!(mode(dir), 0o755);
+
+        // cleanup
+        fs::remove_dir_all("_connections_dir").unwrap();
+    }
+
+    #[test]
+    fn preserve_uuids_of_stored_connections() {
+        let dir = "_preserve_uuids";
+        fs::create_dir_all(dir).unwrap();
+        fs::write(
+            Path::new(dir).join("bond0.nmconnection"),
+            "[connection]\nid=bond0\nuuid=0d5bc3a1-6d1f-4b3c-9e4a-2f1c8b7a6e50\ninterface-name=bond0\n",
+        )
+        .unwrap();
+        // Another connection stored under the name of the interface
+        fs::write(
+            Path::new(dir).join("eth0.nmconnection"),
+            "[connection]\nid=legacy\nuuid=99999999-8888-7777-6666-555555555555\ninterface-name=eth1\n",
+        )
+        .unwrap();
+
+        let mut connection_files = vec![
+            ConnectionFile {
+                name: "bond0".to_string(),
+                contents: "[connection]\nid=bond0\nuuid=11111111-2222-3333-4444-555555555555\ninterface-name=bond0\n"
+                    .to_string(),
+            },
+            ConnectionFile {
+                name: "eth0".to_string(),
+                contents: "[connection]\nid=eth0\nuuid=22222222-3333-4444-5555-666666666666\ninterface-name=eth0\n\
+                           controller=11111111-2222-3333-4444-555555555555\n"
+                    .to_string(),
+            },
+        ];
+
+        preserve_uuids(&mut connection_files, dir).unwrap();
+
+        assert_eq!(
+            connection_files[0].contents,
+            "[connection]\nid=bond0\nuuid=0d5bc3a1-6d1f-4b3c-9e4a-2f1c8b7a6e50\ninterface-name=bond0\n"
+        );
+        assert_eq!(
+            connection_files[1].contents,
+            "[connection]\nid=eth0\nuuid=22222222-3333-4444-5555-666666666666\ninterface-name=eth0\n\
+             controller=0d5bc3a1-6d1f-4b3c-9e4a-2f1c8b7a6e50\n"
+        );
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
     #[test]
     fn identify_host_successfully() {
         let hosts = vec![
@@ -247,7 +2476,9 @@ mod tests {
                     logical_name: "eth0".to_string(),
                     mac_address: Option::from("00:11:22:33:44:55".to_string()),
                     interface_type: "ethernet".to_string(),
+                    ..Default::default()
                 }],
+                ..Default::default()
             },
             Host {
                 hostname: "h2".to_string(),
@@ -255,75 +2486,616 @@ mod tests {
                     logical_name: "".to_string(),
                     mac_address: Option::from("10:10:10:10:10:10".to_string()),
                     interface_type: "".to_string(),
+                    ..Default::default()
                 }],
+                ..Default::default()
+            },
+        ];
+        let interfaces = [
+            NetworkInterface {
+                name: "eth0".to_string(),
+                mac_addr: Some("00:11:22:33:44:55".to_string()),
+                addr: vec![],
+                index: 0,
+            },
+            NetworkInterface {
+                name: "eth0".to_string(),
+                mac_addr: Some("00:10:20:30:40:50".to_string()),
+                addr: vec![],
+                index: 0,
             },
         ];
+
+        let host = identify_host(hosts, &interfaces, &MatchOptions::default())
+            .unwrap()
+            .unwrap();
+        assert_eq!(host.hostname, "h1");
+        assert_eq!(
+            host.interfaces,
+            vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: Option::from("00:11:22:33:44:55".to_string()),
+                interface_type: "ethernet".to_string(),
+                ..Default::default()
+            }]
+        );
+    }
+
+    #[test]
+    fn find_host_via_identity() {
+        let host = |hostname: &str, mac: &str| Host {
+            hostname: hostname.to_string(),
+            interfaces: vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: Some(mac.to_string()),
+                interface_type: "ethernet".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let hosts = || {
+            vec![
+                host("h1", "00:11:22:33:44:55"),
+                host("h2", "10:10:10:10:10:10"),
+            ]
+        };
+        let interfaces = [NetworkInterface {
+            name: "eth0".to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 0,
+        }];
+        let identity = |hostname: &str| MachineIdentity {
+            serial: Some("SN123456".to_string()),
+            site: None,
+            hostname: hostname.to_string(),
+        };
+
+        // The identity takes precedence over the MAC addresses
+        let found = find_host(
+            hosts(),
+            &interfaces,
+            Some(&identity("h2")),
+            &MatchOptions::default(),
+        )
+        .unwrap();
+        assert_eq!(found.hostname, "h2");
+
+        let found = find_host(
+            hosts(),
+            &interfaces,
+            Some(&identity("h3")),
+            &MatchOptions::default(),
+        )
+        .unwrap();
+        assert_eq!(found.hostname, "h1");
+
+        let found = find_host(hosts(), &interfaces, None, &MatchOptions::default()).unwrap();
+        assert_eq!(found.hostname, "h1");
+
+        assert!(find_host(
+            hosts(),
+            &[],
+            Some(&identity("h3")),
+            &MatchOptions::default()
+        )
+        .is_err());
+    }
+
+    #[test]
+    fn find_host_requiring_all_nics() {
+        let interface = |logical_name: &str, mac: &str| Interface {
+            logical_name: logical_name.to_string(),
+            mac_address: Some(mac.to_string()),
+            interface_type: "ethernet".to_string(),
+            ..Default::default()
+        };
+        // The first MAC address of h2 was copied into h1 by mistake
+        let hosts = |match_mode: Option<MatchMode>| {
+            vec![
+                Host {
+                    hostname: "h1".to_string(),
+                    match_mode,
+                    interfaces: vec![
+                        interface("eth0", "00:11:22:33:44:55"),
+                        interface("eth1", "00:11:22:33:44:56"),
+                    ],
+                    ..Default::default()
+                },
+                Host {
+                    hostname: "h2".to_string(),
+                    interfaces: vec![interface("eth0", "00:11:22:33:44:77")],
+                    ..Default::default()
+                },
+            ]
+        };
+        let nic = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        let interfaces = [
+            nic("eth0", "00:11:22:33:44:77"),
+            nic("eth1", "00:11:22:33:44:56"),
+        ];
+
+        let all = MatchOptions {
+            mode: MatchMode::All,
+            ..MatchOptions::default()
+        };
+
+        let found = find_host(hosts(None), &interfaces, None, &MatchOptions::default()).unwrap();
+        assert_eq!(found.hostname, "h1");
+
+        let found = find_host(hosts(None), &interfaces, None, &all).unwrap();
+        assert_eq!(found.hostname, "h2");
+
+        // The host config takes precedence over the flag
+        let found = find_host(
+            hosts(Some(MatchMode::All)),
+            &interfaces,
+            None,
+            &MatchOptions::default(),
+        )
+        .unwrap();
+        assert_eq!(found.hostname, "h2");
+        let found = find_host(hosts(Some(MatchMode::Any)), &interfaces, None, &all).unwrap();
+        assert_eq!(found.hostname, "h1");
+
+        let err = find_host(hosts(None), &interfaces[1..], None, &all).unwrap_err();
+        assert!(err.root_cause().is::<NoHostMatched>());
+        assert_eq!(
+            err.to_string(),
+            "Hosts requiring all of their NICs lack some of them: h1 (missing eth0 (00:11:22:33:44:55))"
+        );
+    }
+
+    #[test]
+    fn find_best_matching_host() {
+        let interface = |logical_name: &str, mac: &str| Interface {
+            logical_name: logical_name.to_string(),
+            mac_address: Some(mac.to_string()),
+            interface_type: "ethernet".to_string(),
+            ..Default::default()
+        };
+        let host = |hostname: &str, interfaces: Vec<Interface>| Host {
+            hostname: hostname.to_string(),
+            interfaces,
+            ..Default::default()
+        };
+        // A NIC of h2 was moved into the machine of h1
+        let hosts = || {
+            vec![
+                host("h1", vec![interface("eth0", "00:11:22:33:44:55")]),
+                host(
+                    "h2",
+                    vec![
+                        interface("eth0", "00:11:22:33:44:66"),
+                        interface("eth1", "00:11:22:33:44:67"),
+                    ],
+                ),
+                host("h3", vec![interface("eth0", "00:11:22:33:44:77")]),
+            ]
+        };
+        let nic = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        let fail_on_ambiguous = MatchOptions {
+            fail_on_ambiguous: true,
+            ..MatchOptions::default()
+        };
+
+        let interfaces = [
+            nic("eth0", "00:11:22:33:44:55"),
+            nic("eth1", "00:11:22:33:44:66"),
+            nic("eth2", "00:11:22:33:44:67"),
+        ];
+        let found = find_host(hosts(), &interfaces, None, &fail_on_ambiguous).unwrap();
+        assert_eq!(found.hostname, "h2");
+
+        // Ties are resolved by the order of the mapping unless asked to fail
+        let interfaces = [
+            nic("eth0", "00:11:22:33:44:55"),
+            nic("eth1", "00:11:22:33:44:77"),
+        ];
+        let found = find_host(hosts(), &interfaces, None, &MatchOptions::default()).unwrap();
+        assert_eq!(found.hostname, "h1");
+        assert_eq!(
+            find_host(hosts(), &interfaces, None, &fail_on_ambiguous)
+                .unwrap_err()
+                .to_string(),
+            "Identifying host is ambiguous, 2 hosts match 1 interfaces each: h1, h3"
+        );
+    }
+
+    #[test]
+    fn set_hostname_of_host() {
+        let dir = "_set_hostname";
+        fs::create_dir_all(dir).unwrap();
+        let hostname_file = Path::new(dir).join("hostname");
+        let path = hostname_file.to_str().unwrap();
+
+        set_hostname(&Disk, "node1", HostnameMethod::Keep, path).unwrap();
+        assert!(!hostname_file.exists());
+
+        set_hostname(&Disk, "node1", HostnameMethod::File, path).unwrap();
+        assert_eq!(fs::read_to_string(&hostname_file).unwrap(), "node1");
+
+        // Unchanged hostnames are not passed to hostnamed
+        set_hostname(&Disk, "node1", HostnameMethod::Hostnamed, path).unwrap();
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn set_hostname_in_memory() {
+        let memory = Memory::default();
+
+        set_hostname(&memory, "node1", HostnameMethod::File, "etc/hostname").unwrap();
+        assert_eq!(
+            memory.files(),
+            BTreeMap::from([(PathBuf::from("etc/hostname"), b"node1".to_vec())])
+        );
+
+        // The hostname stored by hostnamed is read via the filesystem as well
+        set_hostname(&memory, "node1", HostnameMethod::Hostnamed, "etc/hostname").unwrap();
+    }
+
+    #[test]
+    fn check_missing_nics_of_host() {
+        let interface = |logical_name: &str, interface_type: &str, mac: Option<&str>| Interface {
+            logical_name: logical_name.to_string(),
+            mac_address: mac.map(str::to_string),
+            interface_type: interface_type.to_string(),
+            ..Default::default()
+        };
+        let host = Host {
+            hostname: "h1".to_string(),
+            interfaces: vec![
+                interface("eth0", "ethernet", Some("00:11:22:33:44:55")),
+                interface("eth1", "ethernet", Some("00:11:22:33:44:56")),
+                interface("bond0", "bond", Some("00:11:22:33:44:57")),
+            ],
+            ..Default::default()
+        };
+        let interfaces = [NetworkInterface {
+            name: "ens1f0".to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 0,
+        }];
+
+        check_missing_nics(&host, &interfaces, false).unwrap();
+        assert_eq!(
+            check_missing_nics(&host, &interfaces, true)
+                .unwrap_err()
+                .to_string(),
+            "NICs of 1 interfaces are missing: eth1 (00:11:22:33:44:56)"
+        );
+    }
+
+    #[test]
+    fn find_host_via_interface_names() {
+        let ethernet = |name: &str, mac: &str| Interface {
+            logical_name: name.to_string(),
+            mac_address: Some(mac.to_string()),
+            interface_type: "ethernet".to_string(),
+            ..Default::default()
+        };
+        let hosts = || {
+            vec![
+                Host {
+                    hostname: "h1".to_string(),
+                    interfaces: vec![
+                        ethernet("ens1f0", "00:11:22:33:44:55"),
+                        ethernet("ens1f1", "00:11:22:33:44:56"),
+                    ],
+                    ..Default::default()
+                },
+                Host {
+                    hostname: "h2".to_string(),
+                    interfaces: vec![ethernet("ens2f0", "10:10:10:10:10:10")],
+                    ..Default::default()
+                },
+            ]
+        };
+        let nic = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        let randomized = [
+            nic("ens1f0", "5a:00:00:00:00:01"),
+            nic("ens1f1", "5a:00:00:00:00:02"),
+        ];
+
+        // Matching the names is strictly opt-in
+        assert!(find_host(hosts(), &randomized, None, &MatchOptions::default()).is_err());
+
+        let by_name = MatchOptions {
+            by_name: true,
+            ..MatchOptions::default()
+        };
+
+        let found = find_host(hosts(), &randomized, None, &by_name).unwrap();
+        assert_eq!(found.hostname, "h1");
+
+        // MAC addresses still take precedence
         let interfaces = [
+            nic("ens1f0", "5a:00:00:00:00:01"),
+            nic("ens1f1", "5a:00:00:00:00:02"),
+            nic("ens9", "10:10:10:10:10:10"),
+        ];
+        let found = find_host(hosts(), &interfaces, None, &by_name).unwrap();
+        assert_eq!(found.hostname, "h2");
+
+        // Not all of the Ethernet interfaces exist locally
+        assert!(find_host(hosts(), &randomized[..1], None, &by_name).is_err());
+
+        // Ambiguous names never match
+        let mut ambiguous = hosts();
+        ambiguous[1].interfaces = vec![ethernet("ens1f0", "10:10:10:10:10:10")];
+        assert!(find_host(ambiguous, &randomized, None, &by_name).is_err());
+    }
+
+    #[test]
+    fn identify_host_fails() {
+        let hosts = vec![
+            Host {
+                hostname: "h1".to_string(),
+                interfaces: vec![Interface {
+                    logical_name: "eth0".to_string(),
+                    mac_address: Option::from("10:20:30:40:50:60".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                }],
+                ..Default::default()
+            },
+            Host {
+                hostname: "h2".to_string(),
+                interfaces: vec![Interface {
+                    logical_name: "".to_string(),
+                    mac_address: Option::from("00:10:20:30:40:50".to_string()),
+                    interface_type: "".to_string(),
+                    ..Default::default()
+                }],
+                ..Default::default()
+            },
+        ];
+        let interfaces = [NetworkInterface {
+            name: "eth0".to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 0,
+        }];
+
+        assert!(identify_host(hosts, &interfaces, &MatchOptions::default())
+            .unwrap()
+            .is_none())
+    }
+
+    #[test]
+    fn format_identity_successfully() {
+        let interface =
+            |logical_name: &str, interface_type: &str, mac_address: Option<&str>| Interface {
+                logical_name: logical_name.to_string(),
+                mac_address: mac_address.map(str::to_string),
+                interface_type: interface_type.to_string(),
+                ..Default::default()
+            };
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                interface("eth0", "ethernet", Some("00:11:22:33:44:55")),
+                interface("eth0.1365", "vlan", None),
+                interface("eth1", "ethernet", Some("00:11:22:33:44:56")),
+            ],
+            ..Default::default()
+        };
+        let local_interfaces = HashMap::from([
+            ("eth0".to_string(), "ens1f0".to_string()),
+            ("eth0.1365".to_string(), "ens1f0.1365".to_string()),
+        ]);
+        let network_interfaces = [NetworkInterface {
+            name: "ens1f0".to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 2,
+        }];
+
+        let matched_by = describe_match(&host, &network_interfaces, None);
+        assert_eq!(
+            matched_by,
+            "MAC address 00:11:22:33:44:55 of ens1f0 (preconfigured as eth0)"
+        );
+        let identity = MachineIdentity {
+            serial: None,
+            site: None,
+            hostname: "node1".to_string(),
+        };
+        assert_eq!(
+            describe_match(&host, &network_interfaces, Some(&identity)),
+            "identity file"
+        );
+
+        assert_eq!(
+            format_identity(&host, &matched_by, &local_interfaces, &network_interfaces),
+            "Host: node1\n\
+             Matched by: MAC address 00:11:22:33:44:55 of ens1f0 (preconfigured as eth0)\n\
+             INTERFACE  TYPE      MAC-ADDRESS        LOCAL-NAME\n\
+             eth0       ethernet  00:11:22:33:44:55  ens1f0\n\
+             eth0.1365  vlan      --                 ens1f0.1365\n\
+             eth1       ethernet  00:11:22:33:44:56  --\n"
+        );
+    }
+
+    #[test]
+    fn report_closest_hosts() {
+        assert_eq!(mac_distance("00:11:22:33:44:55", "00:11:22:33:44:55"), 0);
+        assert_eq!(mac_distance("00:11:22:33:44:55", "00:11:22:33:44:5A"), 1);
+        assert_eq!(mac_distance("00:11:22:33:44:55", "00:11:22:33:44"), 2);
+
+        let host = |hostname: &str, mac_address: Option<&str>| Host {
+            hostname: hostname.to_string(),
+            interfaces: vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: mac_address.map(str::to_string),
+                interface_type: "ethernet".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let hosts = [
+            host("node1", Some("00:11:22:33:44:aa")),
+            host("node2", Some("00:11:22:33:44:56")),
+            host("node3", None),
+            host("node4", Some("00:11:22:33:44:57")),
+            host("node5", Some("00:11:22:33:45:55")),
+            host("node6", Some("aa:bb:cc:dd:ee:ff")),
+        ];
+        let network_interfaces = [
             NetworkInterface {
-                name: "eth0".to_string(),
+                name: "ens1f0".to_string(),
                 mac_addr: Some("00:11:22:33:44:55".to_string()),
                 addr: vec![],
-                index: 0,
+                index: 2,
             },
             NetworkInterface {
-                name: "eth0".to_string(),
-                mac_addr: Some("00:10:20:30:40:50".to_string()),
+                name: "ens1f1".to_string(),
+                mac_addr: Some("00:11:22:33:44:a0".to_string()),
                 addr: vec![],
-                index: 0,
+                index: 3,
             },
         ];
 
-        let host = identify_host(hosts, &interfaces).unwrap();
-        assert_eq!(host.hostname, "h1");
+        let candidates = closest_hosts(&hosts, &network_interfaces);
+        let candidate = |hostname: &str, mac: &str, nic: &str, nic_mac: &str| Candidate {
+            hostname: hostname.to_string(),
+            interface: "eth0".to_string(),
+            mac_address: mac.to_string(),
+            nic: nic.to_string(),
+            nic_mac_address: nic_mac.to_string(),
+            distance: 1,
+        };
         assert_eq!(
-            host.interfaces,
-            vec![Interface {
-                logical_name: "eth0".to_string(),
-                mac_address: Option::from("00:11:22:33:44:55".to_string()),
-                interface_type: "ethernet".to_string(),
-            }]
+            candidates,
+            vec![
+                candidate("node1", "00:11:22:33:44:aa", "ens1f1", "00:11:22:33:44:a0"),
+                candidate("node2", "00:11:22:33:44:56", "ens1f0", "00:11:22:33:44:55"),
+                candidate("node4", "00:11:22:33:44:57", "ens1f0", "00:11:22:33:44:55"),
+            ]
+        );
+
+        assert_eq!(
+            format_candidates(&candidates[1..2]),
+            "No host matched, closest candidates:\n\
+             HOST   INTERFACE  MAC-ADDRESS        LOCAL-NIC  LOCAL-MAC-ADDRESS  DIFFERING-DIGITS\n\
+             node2  eth0       00:11:22:33:44:56  ens1f0     00:11:22:33:44:55  1\n"
+        );
+        assert_eq!(
+            format_candidates(&[]),
+            "None of the preconfigured hosts have MAC addresses to compare with local NICs\n"
         );
     }
 
     #[test]
-    fn identify_host_fails() {
-        let hosts = vec![
-            Host {
-                hostname: "h1".to_string(),
-                interfaces: vec![Interface {
-                    logical_name: "eth0".to_string(),
-                    mac_address: Option::from("10:20:30:40:50:60".to_string()),
-                    interface_type: "ethernet".to_string(),
-                }],
-            },
-            Host {
-                hostname: "h2".to_string(),
-                interfaces: vec![Interface {
-                    logical_name: "".to_string(),
-                    mac_address: Option::from("00:10:20:30:40:50".to_string()),
-                    interface_type: "".to_string(),
-                }],
-            },
-        ];
-        let interfaces = [NetworkInterface {
-            name: "eth0".to_string(),
-            mac_addr: Some("00:11:22:33:44:55".to_string()),
+    fn parse_config_with_duplicate_macs() {
+        let config_dir = "_duplicate_macs";
+        fs::create_dir_all(config_dir).unwrap();
+        // JSON is valid YAML
+        fs::write(
+            Path::new(config_dir).join("host_config.yaml"),
+            r#"[
+                {"hostname": "node1", "interfaces": [
+                    {"logical_name": "eth0", "mac_address": "00:11:22:33:44:55", "interface_type": "ethernet"},
+                    {"logical_name": "bond0", "mac_address": "00:11:22:33:44:55", "interface_type": "bond"}]},
+                {"hostname": "node2", "interfaces": [
+                    {"logical_name": "eth0", "mac_address": "00:11:22:33:44:66", "interface_type": "ethernet"}]},
+                {"hostname": "node3", "interfaces": [
+                    {"logical_name": "eth0", "mac_address": "00:11:22:33:44:66", "interface_type": "ethernet"},
+                    {"logical_name": "eth1", "mac_address": "00:11:22:33:44:55", "interface_type": "ethernet"}]}
+            ]"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            parse_config(config_dir, false).unwrap_err().to_string(),
+            "MAC addresses are assigned to several hosts: \
+             00:11:22:33:44:55 (node1, node3), 00:11:22:33:44:66 (node2, node3)"
+        );
+
+        let hosts = parse_config(config_dir, true).unwrap();
+        assert_eq!(
+            duplicate_macs(&hosts),
+            vec![
+                "00:11:22:33:44:55 (node1, node3)",
+                "00:11:22:33:44:66 (node2, node3)"
+            ]
+        );
+
+        // Shared addresses are settled by the best match, node1 scores 2 by its bond inheriting the MAC of eth0
+        let nic = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
             addr: vec![],
             index: 0,
-        }];
+        };
+        let interfaces = [
+            nic("eth0", "00:11:22:33:44:66"),
+            nic("eth1", "00:11:22:33:44:55"),
+        ];
+        let fail_on_ambiguous = MatchOptions {
+            fail_on_ambiguous: true,
+            ..MatchOptions::default()
+        };
+        assert_eq!(
+            find_host(hosts, &interfaces, None, &fail_on_ambiguous)
+                .unwrap_err()
+                .to_string(),
+            "Identifying host is ambiguous, 2 hosts match 2 interfaces each: node1, node3"
+        );
+        let hosts = parse_config(config_dir, true).unwrap();
+        let found = find_host(hosts, &interfaces, None, &MatchOptions::default()).unwrap();
+        assert_eq!(found.hostname, "node1");
+
+        // cleanup
+        fs::remove_dir_all(config_dir).unwrap();
+    }
+
+    #[test]
+    fn parse_config_with_invalid_hostname() {
+        let config_dir = "_invalid_hostname";
+        fs::create_dir_all(config_dir).unwrap();
+        fs::write(
+            Path::new(config_dir).join("host_config.yaml"),
+            "- hostname: ../etc\n  interfaces: []\n",
+        )
+        .unwrap();
+
+        assert_eq!(
+            parse_config(config_dir, false).unwrap_err().to_string(),
+            "Invalid hostname '../etc'"
+        );
 
-        assert!(identify_host(hosts, &interfaces).is_none())
+        // cleanup
+        fs::remove_dir_all(config_dir).unwrap();
     }
 
     #[test]
     fn parse_config_fails_due_to_missing_file() {
-        let error = parse_config("<missing>").unwrap_err();
+        let error = parse_config("<missing>", false).unwrap_err();
         assert!(error.to_string().contains("No such file or directory"))
     }
 
     #[test]
     fn parse_config_successfully() {
-        let hosts = parse_config("testdata/apply/config").unwrap();
+        let hosts = parse_config("testdata/apply/config", false).unwrap();
         assert_eq!(
             hosts,
             vec![
@@ -334,23 +3106,28 @@ mod tests {
                             logical_name: "eth0".to_string(),
                             mac_address: Option::from("00:11:22:33:44:55".to_string()),
                             interface_type: "ethernet".to_string(),
+                            ..Default::default()
                         },
                         Interface {
                             logical_name: "eth1".to_string(),
                             mac_address: Option::from("00:11:22:33:44:58".to_string()),
                             interface_type: "ethernet".to_string(),
+                            ..Default::default()
                         },
                         Interface {
                             logical_name: "eth2".to_string(),
                             mac_address: Option::from("36:5e:6b:a2:ed:80".to_string()),
                             interface_type: "ethernet".to_string(),
+                            ..Default::default()
                         },
                         Interface {
                             logical_name: "bond0".to_string(),
                             mac_address: Option::from("00:11:22:aa:44:58".to_string()),
                             interface_type: "bond".to_string(),
+                            ..Default::default()
                         },
                     ],
+                    ..Default::default()
                 },
                 Host {
                     hostname: "node2".to_string(),
@@ -359,20 +3136,392 @@ mod tests {
                             logical_name: "eth0".to_string(),
                             mac_address: Option::from("36:5e:6b:a2:ed:81".to_string()),
                             interface_type: "ethernet".to_string(),
+                            ..Default::default()
                         },
                         Interface {
                             logical_name: "eth0.1365".to_string(),
-                            mac_address: None,
                             interface_type: "vlan".to_string(),
+                            ..Default::default()
                         },
                     ],
+                    ..Default::default()
+                },
+            ]
+        )
+    }
+
+    #[test]
+    fn detect_interface_differences() {
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                Interface {
+                    logical_name: "eth0".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:55".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth0.1365".to_string(),
+                    interface_type: "vlan".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth2".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:56".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth2.bridge".to_string(),
+                    interface_type: "linux-bridge".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "bond0".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:58".to_string()),
+                    interface_type: "bond".to_string(),
+                    ..Default::default()
+                },
+            ],
+            ..Default::default()
+        };
+        let interfaces = vec![
+            NetworkInterface {
+                name: "eth0".to_string(),
+                mac_addr: Some("00:11:22:33:44:55".to_string()),
+                addr: vec![],
+                index: 0,
+            },
+            NetworkInterface {
+                name: "eth0.1365".to_string(), // VLAN
+                addr: vec![],
+                mac_addr: Some("00:11:22:33:44:55".to_string()),
+                index: 0,
+            },
+            NetworkInterface {
+                name: "ens1f0".to_string(),
+                mac_addr: Some("00:11:22:33:44:56".to_string()),
+                addr: vec![],
+                index: 0,
+            },
+        ];
+
+        let local_interfaces = detect_local_interfaces(&host, interfaces);
+        assert_eq!(
+            local_interfaces,
+            HashMap::from([
+                ("eth2".to_string(), "ens1f0".to_string()),
+                ("eth2.bridge".to_string(), "ens1f0.bridge".to_string())
+            ])
+        )
+    }
+
+    #[test]
+    fn prepare_and_store_connection_files_successfully() -> io::Result<()> {
+        let source_dir = "testdata/apply";
+        let destination_dir = "_out";
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                Interface {
+                    logical_name: "eth0".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:55".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth0.1365".to_string(),
+                    interface_type: "vlan".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth2".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:56".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth1".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:57".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "bond0".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:58".to_string()),
+                    interface_type: "bond".to_string(),
+                    ..Default::default()
+                },
+            ],
+            ..Default::default()
+        };
+        let detected_interfaces = HashMap::from([("eth2".to_string(), "eth4".to_string())]);
+
+        let connection_files = prepare_connection_files(
+            &host,
+            &detected_interfaces,
+            source_dir,
+            None,
+            &FileFilter::default(),
+        )
+        .unwrap();
+        assert!(
+            store_connection_files(&Disk, &connection_files, destination_dir, Format::Keyfile)
+                .is_ok()
+        );
+
+        let source_path = Path::new(source_dir).join("node1");
+        let destination_path = Path::new(destination_dir);
+        for entry in fs::read_dir(source_path)? {
+            let entry = entry?;
+
+            let mut filename = entry.file_name().into_string().unwrap();
+            let mut input = fs::read_to_string(entry.path())?;
+
+            // Adjust the name and content for the "eth2"->"eth4" edge case.
+            if entry.path().file_stem().is_some_and(|stem| stem == "eth2") {
+                filename = filename.replace("eth2", "eth4");
+                input = input.replace("eth2", "eth4");
+            }
+
+            let output = fs::read_to_string(destination_path.join(&filename))?;
+
+            assert_eq!(input, output);
+        }
+
+        // cleanup
+        fs::remove_dir_all(destination_dir)
+    }
+
+    #[test]
+    fn store_connection_files_actions() {
+        let filesystem = Memory::default();
+        let destination_dir = "_store";
+        let file = |name: &str, contents: &str| ConnectionFile {
+            name: name.to_string(),
+            contents: contents.to_string(),
+        };
+        let read =
+            |path: &str| String::from_utf8(filesystem.files()[Path::new(path)].clone()).unwrap();
+
+        let stored = store_connection_files(
+            &filesystem,
+            &[file("eth0", "[connection]\nid=eth0\n"), file("eth1", "")],
+            destination_dir,
+            Format::Keyfile,
+        )
+        .unwrap();
+        assert_eq!(
+            stored,
+            vec![
+                (
+                    PathBuf::from("_store/eth0.nmconnection"),
+                    FileAction::Created
+                ),
+                (
+                    PathBuf::from("_store/eth1.nmconnection"),
+                    FileAction::Created
+                ),
+            ]
+        );
+
+        let stored = store_connection_files(
+            &filesystem,
+            &[
+                file("eth0", "[connection]\nid=eth0\n"),
+                file("eth1", "[connection]\n"),
+            ],
+            destination_dir,
+            Format::Keyfile,
+        )
+        .unwrap();
+        assert_eq!(stored[0].1, FileAction::Skipped);
+        assert_eq!(stored[1].1, FileAction::Updated);
+        assert_eq!(read("_store/eth0.nmconnection"), "[connection]\nid=eth0\n");
+        assert_eq!(read("_store/eth1.nmconnection"), "[connection]\n");
+
+        let stored = store_connection_files(
+            &filesystem,
+            &[file(
+                "eth0",
+                "[connection]\nid=eth0\ninterface-name=eth0\ntype=ethernet\n",
+            )],
+            destination_dir,
+            Format::Ifcfg,
+        )
+        .unwrap();
+        assert_eq!(
+            stored,
+            vec![(PathBuf::from("_store/ifcfg-eth0"), FileAction::Created)]
+        );
+        assert_eq!(
+            read("_store/ifcfg-eth0"),
+            "TYPE=Ethernet\nNAME=eth0\nDEVICE=eth0\n"
+        );
+        assert!(!Path::new(destination_dir).exists());
+    }
+
+    #[test]
+    fn select_connection_files_by_name() {
+        let files = || {
+            ["ens1f0", "ens1f0@dhcp", "bond0", "ens1f0.1365"]
+                .map(|name| ConnectionFile {
+                    name: name.to_string(),
+                    contents: String::new(),
+                })
+                .into()
+        };
+        let local_interfaces = HashMap::from([
+            ("eth0".to_string(), "ens1f0".to_string()),
+            ("eth0.1365".to_string(), "ens1f0.1365".to_string()),
+        ]);
+        let select = |only: &[&str], skip: &[&str]| {
+            let selection = Selection {
+                only: only.iter().map(|name| name.to_string()).collect(),
+                skip: skip.iter().map(|name| name.to_string()).collect(),
+            };
+            select_connection_files(files(), &local_interfaces, &selection).map(|files| {
+                files
+                    .into_iter()
+                    .map(|file| file.name)
+                    .collect::<Vec<String>>()
+            })
+        };
+
+        assert_eq!(
+            select(&["eth0", "bond0"], &[]).unwrap(),
+            ["ens1f0", "ens1f0@dhcp", "bond0"]
+        );
+        assert_eq!(select(&["ens1f0"], &[]).unwrap(), ["ens1f0", "ens1f0@dhcp"]);
+        assert_eq!(
+            select(&[], &["eth0.1365"]).unwrap(),
+            ["ens1f0", "ens1f0@dhcp", "bond0"]
+        );
+        assert_eq!(
+            select(&["eth0", "bond0"], &["bond0"]).unwrap(),
+            ["ens1f0", "ens1f0@dhcp"]
+        );
+        assert_eq!(select(&["eth0@dhcp"], &[]).unwrap(), ["ens1f0@dhcp"]);
+        assert_eq!(
+            select(&[], &["ens1f0@dhcp"]).unwrap(),
+            ["ens1f0", "bond0", "ens1f0.1365"]
+        );
+
+        assert_eq!(
+            select(&["eth1"], &[]).unwrap_err().to_string(),
+            "Connection 'eth1' is not part of the host's config"
+        );
+    }
+
+    #[test]
+    fn prune_stale_files() {
+        let dir = Path::new("_prune");
+        fs::create_dir_all(dir).unwrap();
+        let eth0 = dir.join("eth0.nmconnection");
+        let eth1 = dir.join("eth1.nmconnection");
+        let eth2 = dir.join("eth2.nmconnection");
+        fs::write(&eth0, "").unwrap();
+        fs::write(&eth1, "").unwrap();
+
+        let state = State {
+            hostname: "node1".to_string(),
+            connection_files: vec![eth0.clone(), eth1.clone(), eth2.clone()],
+            checksums: BTreeMap::new(),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        };
+        let stored_files = [(eth0.clone(), FileAction::Skipped)];
+
+        assert!(stale_files(&Disk, None, &stored_files).unwrap().is_empty());
+
+        // eth2 is already gone
+        let stale = stale_files(&Disk, Some(&state), &stored_files).unwrap();
+        assert_eq!(stale, vec![eth1.clone()]);
+
+        prune_files(&Disk, &stale).unwrap();
+        assert!(eth0.exists());
+        assert!(!eth1.exists());
+        assert!(stale_files(&Disk, Some(&state), &stored_files)
+            .unwrap()
+            .is_empty());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn build_report_successfully() {
+        let local_interfaces = HashMap::from([
+            ("eth0".to_string(), "ens1f0".to_string()),
+            ("eth0.1365".to_string(), "ens1f0.1365".to_string()),
+        ]);
+        let connection_files: Vec<ConnectionFile> = ["ens1f0", "bond0"]
+            .iter()
+            .map(|name| ConnectionFile {
+                name: name.to_string(),
+                contents: String::new(),
+            })
+            .collect();
+        let stored_files = vec![
+            (
+                PathBuf::from("/etc/ens1f0.nmconnection"),
+                FileAction::Created,
+            ),
+            (
+                PathBuf::from("/etc/bond0.nmconnection"),
+                FileAction::Updated,
+            ),
+        ];
+        let checksums = BTreeMap::from([
+            (
+                PathBuf::from("/etc/ens1f0.nmconnection"),
+                "abc123".to_string(),
+            ),
+            (
+                PathBuf::from("/etc/bond0.nmconnection"),
+                "def456".to_string(),
+            ),
+        ]);
+
+        let report = build_report(
+            "node1",
+            &local_interfaces,
+            &connection_files,
+            &stored_files,
+            &checksums,
+        );
+
+        assert_eq!(report.hostname, "node1");
+        assert_eq!(
+            report.interface_names,
+            BTreeMap::from([
+                ("eth0".to_string(), "ens1f0".to_string()),
+                ("eth0.1365".to_string(), "ens1f0.1365".to_string()),
+            ])
+        );
+        assert_eq!(
+            report.files,
+            vec![
+                FileReport {
+                    path: PathBuf::from("/etc/ens1f0.nmconnection"),
+                    action: FileAction::Created,
+                    renamed_from: Some("eth0".to_string()),
+                    checksum: "abc123".to_string(),
+                },
+                FileReport {
+                    path: PathBuf::from("/etc/bond0.nmconnection"),
+                    action: FileAction::Updated,
+                    renamed_from: None,
+                    checksum: "def456".to_string(),
                 },
             ]
-        )
+        );
     }
 
     #[test]
-    fn detect_interface_differences() {
+    fn prepare_layered_connection_files() {
+        let source_dir = "testdata/apply-layered";
         let host = Host {
             hostname: "node1".to_string(),
             interfaces: vec![
@@ -380,64 +3529,41 @@ mod tests {
                     logical_name: "eth0".to_string(),
                     mac_address: Option::from("00:11:22:33:44:55".to_string()),
                     interface_type: "ethernet".to_string(),
+                    ..Default::default()
                 },
                 Interface {
-                    logical_name: "eth0.1365".to_string(),
-                    mac_address: None,
-                    interface_type: "vlan".to_string(),
-                },
-                Interface {
-                    logical_name: "eth2".to_string(),
+                    logical_name: "eth1".to_string(),
                     mac_address: Option::from("00:11:22:33:44:56".to_string()),
                     interface_type: "ethernet".to_string(),
-                },
-                Interface {
-                    logical_name: "eth2.bridge".to_string(),
-                    mac_address: None,
-                    interface_type: "linux-bridge".to_string(),
-                },
-                Interface {
-                    logical_name: "bond0".to_string(),
-                    mac_address: Option::from("00:11:22:33:44:58".to_string()),
-                    interface_type: "bond".to_string(),
+                    ..Default::default()
                 },
             ],
+            ..Default::default()
         };
-        let interfaces = vec![
-            NetworkInterface {
-                name: "eth0".to_string(),
-                mac_addr: Some("00:11:22:33:44:55".to_string()),
-                addr: vec![],
-                index: 0,
-            },
-            NetworkInterface {
-                name: "eth0.1365".to_string(), // VLAN
-                addr: vec![],
-                mac_addr: Some("00:11:22:33:44:55".to_string()),
-                index: 0,
-            },
-            NetworkInterface {
-                name: "ens1f0".to_string(),
-                mac_addr: Some("00:11:22:33:44:56".to_string()),
-                addr: vec![],
-                index: 0,
-            },
-        ];
+        let detected_interfaces = HashMap::from([("eth1".to_string(), "ens1f1".to_string())]);
 
-        let local_interfaces = detect_local_interfaces(&host, interfaces);
-        assert_eq!(
-            local_interfaces,
-            HashMap::from([
-                ("eth2".to_string(), "ens1f0".to_string()),
-                ("eth2.bridge".to_string(), "ens1f0.bridge".to_string())
-            ])
+        let connection_files = prepare_connection_files(
+            &host,
+            &detected_interfaces,
+            source_dir,
+            None,
+            &FileFilter::default(),
         )
+        .unwrap();
+
+        let expected_dir = Path::new(source_dir).join("expected");
+        let names: Vec<&str> = connection_files.iter().map(|f| f.name.as_str()).collect();
+        assert_eq!(names, vec!["eth0", "ens1f1", "dummy0"]);
+
+        for file in connection_files {
+            let expected = expected_dir.join(format!("{}.nmconnection", file.name));
+            assert_eq!(fs::read_to_string(expected).unwrap(), file.contents);
+        }
     }
 
     #[test]
-    fn copy_connection_files_successfully() -> io::Result<()> {
-        let source_dir = "testdata/apply";
-        let destination_dir = "_out";
+    fn prepare_connection_files_with_references() {
+        let source_dir = "testdata/apply-references";
         let host = Host {
             hostname: "node1".to_string(),
             interfaces: vec![
@@ -445,56 +3571,416 @@ mod tests {
                     logical_name: "eth0".to_string(),
                     mac_address: Option::from("00:11:22:33:44:55".to_string()),
                     interface_type: "ethernet".to_string(),
+                    ..Default::default()
                 },
                 Interface {
-                    logical_name: "eth0.1365".to_string(),
-                    mac_address: None,
+                    logical_name: "mgmt".to_string(),
                     interface_type: "vlan".to_string(),
-                },
-                Interface {
-                    logical_name: "eth2".to_string(),
-                    mac_address: Option::from("00:11:22:33:44:56".to_string()),
-                    interface_type: "ethernet".to_string(),
-                },
-                Interface {
-                    logical_name: "eth1".to_string(),
-                    mac_address: Option::from("00:11:22:33:44:57".to_string()),
-                    interface_type: "ethernet".to_string(),
-                },
-                Interface {
-                    logical_name: "bond0".to_string(),
-                    mac_address: Option::from("00:11:22:33:44:58".to_string()),
-                    interface_type: "bond".to_string(),
+                    ..Default::default()
                 },
             ],
+            ..Default::default()
         };
-        let detected_interfaces = HashMap::from([("eth2".to_string(), "eth4".to_string())]);
+        let detected_interfaces = HashMap::from([("eth0".to_string(), "ens1f0".to_string())]);
 
-        assert!(
-            copy_connection_files(host, detected_interfaces, source_dir, destination_dir).is_ok()
+        let connection_files = prepare_connection_files(
+            &host,
+            &detected_interfaces,
+            source_dir,
+            None,
+            &FileFilter::default(),
+        )
+        .unwrap();
+
+        let names: Vec<&str> = connection_files.iter().map(|f| f.name.as_str()).collect();
+        assert_eq!(names, vec!["ens1f0", "mgmt"]);
+
+        // Only the name and the references are renamed, not other values mentioning the interface
+        let ethernet = Keyfile::parse(&connection_files[0].contents);
+        assert_eq!(ethernet.get("connection", "id"), Some("ens1f0"));
+        assert_eq!(ethernet.get("connection", "interface-name"), Some("ens1f0"));
+        assert_eq!(
+            ethernet.get("user", "org.example.switch-port"),
+            Some("eth0")
         );
 
-        let source_path = Path::new(source_dir).join("node1");
-        let destination_path = Path::new(destination_dir);
-        for entry in fs::read_dir(source_path)? {
-            let entry = entry?;
+        let vlan = Keyfile::parse(&connection_files[1].contents);
+        assert_eq!(vlan.get("vlan", "parent"), Some("ens1f0"));
+        assert_eq!(vlan.get("connection", "interface-name"), Some("mgmt"));
+    }
 
-            let mut filename = entry.file_name().into_string().unwrap();
-            let mut input = fs::read_to_string(entry.path())?;
+    #[test]
+    fn prepare_ovs_connection_files() {
+        let source_dir = "testdata/apply-ovs";
+        let interface = |logical_name: &str, interface_type: &str, mac: Option<&str>| Interface {
+            logical_name: logical_name.to_string(),
+            mac_address: mac.map(str::to_string),
+            interface_type: interface_type.to_string(),
+            ..Default::default()
+        };
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                interface("eth1", "ethernet", Some("00:11:22:33:44:55")),
+                interface("br0", "ovs-bridge", None),
+                interface("br0", "ovs-interface", None),
+            ],
+            ..Default::default()
+        };
+        let detected_interfaces = HashMap::from([("eth1".to_string(), "ens1f1".to_string())]);
 
-            // Adjust the name and content for the "eth2"->"eth4" edge case.
-            if entry.path().file_stem().is_some_and(|stem| stem == "eth2") {
-                filename = filename.replace("eth2", "eth4");
-                input = input.replace("eth2", "eth4");
-            }
+        // All files belong to the host's interfaces
+        check_host_dir(
+            &host,
+            "testdata/apply-ovs/node1",
+            &FileFilter {
+                deny: vec!["*.nmconnection".to_string()],
+                ..FileFilter::default()
+            },
+        )
+        .unwrap();
 
-            let output = fs::read_to_string(destination_path.join(&filename))?;
+        let connection_files = prepare_connection_files(
+            &host,
+            &detected_interfaces,
+            source_dir,
+            None,
+            &FileFilter::default(),
+        )
+        .unwrap();
 
-            assert_eq!(input, output);
+        let names: Vec<&str> = connection_files.iter().map(|f| f.name.as_str()).collect();
+        assert_eq!(
+            names,
+            vec!["ens1f1", "ens1f1-port", "br0-br", "br0-if", "br0-port"]
+        );
+
+        let port = Keyfile::parse(&connection_files[1].contents);
+        assert_eq!(port.get("connection", "id"), Some("ens1f1-port"));
+        assert_eq!(port.get("connection", "interface-name"), Some("ens1f1"));
+        assert_eq!(
+            port.get("connection", "controller"),
+            Some("3d2d7f60-9e4b-4a0c-9c63-5b8f4ea07d03")
+        );
+    }
+
+    #[test]
+    fn prepare_connection_files_with_profiles() {
+        let source_dir = "testdata/apply-profiles";
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: Option::from("00:11:22:33:44:55".to_string()),
+                interface_type: "ethernet".to_string(),
+                profiles: vec!["dhcp".to_string()],
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let detected_interfaces = HashMap::from([("eth0".to_string(), "ens1f0".to_string())]);
+
+        let connection_files = prepare_connection_files(
+            &host,
+            &detected_interfaces,
+            source_dir,
+            None,
+            &FileFilter::default(),
+        )
+        .unwrap();
+
+        let names: Vec<&str> = connection_files.iter().map(|f| f.name.as_str()).collect();
+        assert_eq!(names, vec!["ens1f0", "ens1f0@dhcp"]);
+
+        let fallback = Keyfile::parse(&connection_files[1].contents);
+        assert_eq!(fallback.get("connection", "id"), Some("ens1f0@dhcp"));
+        assert_eq!(fallback.get("connection", "interface-name"), Some("ens1f0"));
+        assert_eq!(fallback.get("ipv4", "method"), Some("auto"));
+
+        let stored_files = [
+            (PathBuf::from("ens1f0.nmconnection"), FileAction::Created),
+            (
+                PathBuf::from("ens1f0@dhcp.nmconnection"),
+                FileAction::Created,
+            ),
+        ];
+        let report = build_report(
+            "node1",
+            &detected_interfaces,
+            &connection_files,
+            &stored_files,
+            &BTreeMap::new(),
+        );
+        let renamed_from: Vec<Option<&str>> = report
+            .files
+            .iter()
+            .map(|file| file.renamed_from.as_deref())
+            .collect();
+        assert_eq!(renamed_from, [Some("eth0"), Some("eth0@dhcp")]);
+
+        // Profiles which are not declared by the host are not applied
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![Interface {
+                ..host.interfaces.into_iter().next().unwrap()
+            }],
+            ..Default::default()
+        };
+        let connection_files = prepare_connection_files(
+            &host,
+            &detected_interfaces,
+            source_dir,
+            None,
+            &FileFilter::default(),
+        )
+        .unwrap();
+        assert_eq!(connection_files.len(), 1);
+    }
+
+    #[test]
+    fn exclude_virtual_interfaces() {
+        let sysfs_dir = "_sysfs_net";
+        fs::create_dir_all(Path::new(sysfs_dir).join("eth0/device")).unwrap();
+        fs::create_dir_all(Path::new(sysfs_dir).join("bond0")).unwrap();
+
+        let nic = |name: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        let network_interfaces = vec![nic("eth0"), nic("bond0"), nic("veth0")];
+
+        let nics = physical_interfaces(&network_interfaces, sysfs_dir);
+        assert_eq!(nics, vec![nic("eth0")]);
+
+        // cleanup
+        fs::remove_dir_all(sysfs_dir).unwrap();
+    }
+
+    #[test]
+    fn map_addresses_of_virtual_interfaces() {
+        let sysfs_dir = "_sysfs_virtual";
+        for path in [
+            "bond0/lower_eth0",
+            "bond0/lower_eth1",
+            "bond0.100/lower_bond0",
+            "br0/lower_eth2",
+            "br1/lower_eth0",
+            "br1/lower_eth2",
+        ] {
+            fs::create_dir_all(Path::new(sysfs_dir).join(path)).unwrap();
         }
 
+        let nic = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        // The current addresses, the ports and the VLAN took over the (random) address assigned to the bond
+        let network_interfaces = vec![
+            nic("eth0", "02:00:00:00:00:01"),
+            nic("eth1", "02:00:00:00:00:01"),
+            nic("eth2", "00:00:00:00:00:03"),
+            nic("bond0", "02:00:00:00:00:01"),
+            nic("bond0.100", "02:00:00:00:00:01"),
+            nic("br0", "02:00:00:00:00:04"),
+            nic("br1", "02:00:00:00:00:05"),
+        ];
+        // The permanent addresses of the physical NICs
+        let nics = vec![
+            nic("eth0", "00:00:00:00:00:01"),
+            nic("eth1", "00:00:00:00:00:02"),
+            nic("eth2", "00:00:00:00:00:03"),
+        ];
+
+        assert_eq!(
+            lower_devices("bond0.100", sysfs_dir),
+            vec!["bond0", "eth0", "eth1"]
+        );
+
+        let interface = |name: &str, mac: &str| Interface {
+            logical_name: name.to_string(),
+            mac_address: Some(mac.to_string()),
+            interface_type: "ethernet".to_string(),
+            ..Default::default()
+        };
+        let mut hosts = vec![Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                interface("eth0", "02:00:00:00:00:01"),
+                interface("eth2", "02:00:00:00:00:04"),
+                interface("eth3", "02:00:00:00:00:05"),
+                interface("eth4", "00:00:00:00:00:09"),
+            ],
+            ..Default::default()
+        }];
+
+        map_virtual_addresses(&mut hosts, &network_interfaces, &nics, sysfs_dir);
+
+        let addresses: Vec<&str> = hosts[0]
+            .interfaces
+            .iter()
+            .map(|i| i.mac_address.as_deref().unwrap())
+            .collect();
+        assert_eq!(
+            addresses,
+            vec![
+                // First port of the bond beneath the VLAN which shares its address
+                "00:00:00:00:00:01",
+                // Single port of the bridge
+                "00:00:00:00:00:03",
+                // Ambiguous bridge ports
+                "02:00:00:00:00:05",
+                // Unknown address
+                "00:00:00:00:00:09",
+            ]
+        );
+
         // cleanup
-        fs::remove_dir_all(destination_dir)
+        fs::remove_dir_all(sysfs_dir).unwrap();
+    }
+
+    #[test]
+    fn list_common_keyfile_names() {
+        assert_eq!(
+            common_keyfile_names("testdata/apply-layered/common", &FileFilter::default()).unwrap(),
+            vec!["dummy0", "eth0"]
+        );
+        assert!(common_keyfile_names("<missing>", &FileFilter::default())
+            .unwrap()
+            .is_empty());
+    }
+
+    #[test]
+    fn check_host_dir_for_unexpected_files() {
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: Option::from("00:11:22:33:44:55".to_string()),
+                interface_type: "ethernet".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+
+        assert!(check_host_dir(&host, "testdata/apply/node1", &FileFilter::default()).is_ok());
+        assert!(check_host_dir(&host, "<missing>", &FileFilter::default()).is_ok());
+
+        let filter = FileFilter {
+            ignore: vec![],
+            deny: vec!["eth?.nmconnection".to_string()],
+        };
+        let error = check_host_dir(&host, "testdata/apply/node1", &filter).unwrap_err();
+        assert!(error
+            .to_string()
+            .contains("matches denied pattern 'eth?.nmconnection'"));
+
+        // eth0 belongs to the host, so it is never matched against the patterns
+        let filter = FileFilter {
+            ignore: vec![],
+            deny: vec!["eth0.nmconnection".to_string()],
+        };
+        assert!(check_host_dir(&host, "testdata/apply/node1", &filter).is_ok());
+    }
+
+    #[test]
+    fn read_and_store_drop_ins() {
+        let source_dir = "_drop_ins/node1/conf.d";
+        let destination_dir = "_drop_ins/etc/conf.d";
+        fs::create_dir_all(source_dir).unwrap();
+        fs::write("_drop_ins/node1/conf.d/dns.conf", "[main]\ndns=none\n").unwrap();
+        fs::write(
+            "_drop_ins/node1/conf.d/00-log.conf",
+            "[logging]\nlevel=INFO\n",
+        )
+        .unwrap();
+        fs::write("_drop_ins/node1/conf.d/README.md", "notes").unwrap();
+
+        assert!(
+            read_drop_ins(Path::new("_drop_ins/missing"), &FileFilter::default())
+                .unwrap()
+                .is_empty()
+        );
+
+        let drop_ins = read_drop_ins(Path::new(source_dir), &FileFilter::default()).unwrap();
+        let names: Vec<&str> = drop_ins.iter().map(|d| d.name.as_str()).collect();
+        assert_eq!(names, ["00-log.conf", "dns.conf"]);
+
+        // an existing file with the wrong permissions is corrected even if its contents are unchanged
+        fs::create_dir_all(destination_dir).unwrap();
+        fs::write("_drop_ins/etc/conf.d/dns.conf", "[main]\ndns=none\n").unwrap();
+        fs::set_permissions(
+            "_drop_ins/etc/conf.d/dns.conf",
+            fs::Permissions::from_mode(0o600),
+        )
+        .unwrap();
+
+        assert_eq!(
+            store_drop_ins(&Disk, &drop_ins, destination_dir).unwrap(),
+            vec![
+                (
+                    PathBuf::from("_drop_ins/etc/conf.d/00-log.conf"),
+                    FileAction::Created
+                ),
+                (
+                    PathBuf::from("_drop_ins/etc/conf.d/dns.conf"),
+                    FileAction::Skipped
+                ),
+            ]
+        );
+        for name in ["00-log.conf", "dns.conf"] {
+            let metadata = fs::metadata(Path::new(destination_dir).join(name)).unwrap();
+            assert_eq!(metadata.permissions().mode() & 0o777, 0o644);
+        }
+
+        fs::write("_drop_ins/node1/conf.d/no-auto-default.conf", "[main]\n").unwrap();
+        let error = read_drop_ins(Path::new(source_dir), &FileFilter::default()).unwrap_err();
+        assert!(error.to_string().contains("reserved"));
+
+        // cleanup
+        fs::remove_dir_all("_drop_ins").unwrap();
+    }
+
+    #[test]
+    fn read_and_store_dispatcher_scripts() {
+        let source_dir = "_dispatcher/node1/dispatcher.d";
+        let destination_dir = "_dispatcher/etc/dispatcher.d";
+        fs::create_dir_all(source_dir).unwrap();
+        fs::write(
+            "_dispatcher/node1/dispatcher.d/50-routes",
+            "#!/bin/sh\nip route add 10.0.0.0/8 dev \"$1\"\n",
+        )
+        .unwrap();
+        fs::write("_dispatcher/node1/dispatcher.d/.swp", "").unwrap();
+
+        let scripts =
+            read_dispatcher_scripts(Path::new(source_dir), &FileFilter::default()).unwrap();
+        let names: Vec<&str> = scripts.iter().map(|s| s.name.as_str()).collect();
+        assert_eq!(names, ["50-routes"]);
+
+        // Only root may hand the scripts over to root, so the tests stick to the current user.
+        let uid = unsafe { libc::geteuid() };
+        assert_eq!(
+            store_dispatcher_scripts(&Disk, &scripts, destination_dir, uid).unwrap(),
+            vec![(
+                PathBuf::from("_dispatcher/etc/dispatcher.d/50-routes"),
+                FileAction::Created
+            )]
+        );
+
+        let metadata = fs::metadata("_dispatcher/etc/dispatcher.d/50-routes").unwrap();
+        assert_eq!(metadata.permissions().mode() & 0o777, 0o755);
+        assert_eq!(metadata.uid(), uid);
+        assert_eq!(
+            fs::read("_dispatcher/etc/dispatcher.d/50-routes").unwrap(),
+            scripts[0].contents
+        );
+
+        // cleanup
+        fs::remove_dir_all("_dispatcher").unwrap();
     }
 
     #[test]
@@ -510,4 +3996,114 @@ mod tests {
         assert!(keyfile_path("some-dir", "").is_none());
         assert!(keyfile_path("", "eth0").is_none());
     }
+
+    #[test]
+    fn expand_secrets_requires_providers_for_placeholders() {
+        let contents = "[wifi-security]\npsk=@@NMC_TEST_WIFI_PSK@@\n".to_string();
+
+        let error = expand_secrets("wlan0", contents.clone(), None).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Connection file 'wlan0' contains secret placeholders (NMC_TEST_WIFI_PSK), declare secret providers or use --expand-env"
+        );
+
+        std::env::set_var("NMC_TEST_WIFI_PSK", "secret");
+        assert_eq!(
+            expand_secrets("wlan0", contents, Some(&Secrets::default())).unwrap(),
+            "[wifi-security]\npsk=secret\n"
+        );
+
+        // References are kept as they are without providers
+        let contents = "[vlan]\nid=${VLAN_ID}\n".to_string();
+        assert_eq!(
+            expand_secrets("vlan", contents.clone(), None).unwrap(),
+            contents
+        );
+    }
+
+    #[test]
+    fn load_hooks_of_config_dir_only_if_allowed() {
+        let config_dir = "_apply_hooks_config";
+        fs::create_dir_all(config_dir).unwrap();
+        // Failing to parse tells whether the hooks of the config dir were loaded
+        fs::write(
+            Path::new(config_dir).join("hooks.yaml"),
+            r#"{"after-apply": []}"#,
+        )
+        .unwrap();
+
+        let mut options = ApplyOptions::default();
+        load_hooks(config_dir, &options, "_apply_hooks_local").unwrap();
+
+        options.allow_bundle_hooks = true;
+        assert!(load_hooks(config_dir, &options, "_apply_hooks_local").is_err());
+
+        fs::write(
+            Path::new(config_dir).join("hooks.yaml"),
+            r#"{"post-apply": []}"#,
+        )
+        .unwrap();
+        load_hooks(config_dir, &options, "_apply_hooks_local").unwrap();
+
+        options.config_server = Some(ConfigServer {
+            url: "http://nmc.example.com:8080".to_string(),
+            token_file: None,
+            ca_file: None,
+        });
+        assert_eq!(
+            load_hooks(config_dir, &options, "_apply_hooks_local")
+                .unwrap_err()
+                .to_string(),
+            "Refusing to run hooks of a config fetched from http://nmc.example.com:8080 without https"
+        );
+
+        // cleanup
+        fs::remove_dir_all(config_dir).unwrap();
+    }
+
+    #[test]
+    fn install_dispatcher_scripts_only_if_allowed() {
+        let scripts = || {
+            vec![HostFile {
+                name: "50-routes".to_string(),
+                contents: b"#!/bin/sh\n".to_vec(),
+            }]
+        };
+
+        let mut options = ApplyOptions::default();
+        assert!(allowed_dispatcher_scripts(scripts(), &options)
+            .unwrap()
+            .is_empty());
+
+        options.allow_bundle_hooks = true;
+        assert_eq!(
+            allowed_dispatcher_scripts(scripts(), &options)
+                .unwrap()
+                .len(),
+            1
+        );
+
+        options.config_server = Some(ConfigServer {
+            url: "http://nmc.example.com:8080".to_string(),
+            token_file: None,
+            ca_file: None,
+        });
+        assert_eq!(
+            allowed_dispatcher_scripts(scripts(), &options)
+                .unwrap_err()
+                .to_string(),
+            "Refusing to install dispatcher scripts of a config fetched from http://nmc.example.com:8080 without https"
+        );
+        assert!(allowed_dispatcher_scripts(Vec::new(), &options)
+            .unwrap()
+            .is_empty());
+
+        options.config_server.as_mut().unwrap().url = "https://nmc.example.com:8443".to_string();
+        assert_eq!(
+            allowed_dispatcher_scripts(scripts(), &options)
+                .unwrap()
+                .len(),
+            1
+        );
+    }
 }
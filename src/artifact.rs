@@ -0,0 +1,424 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+
+use anyhow::Context;
+
+use crate::apply_conf::parse_config;
+use crate::keyfile::{is_keyfile, Keyfile};
+use crate::types::Interface;
+
+#[derive(Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+enum Change {
+    Added,
+    Removed,
+    /// Names of the modified keys or fields.
+    Modified(Vec<String>),
+}
+
+/// Preconfigured host as found in a generated artifact.
+#[derive(Debug, Default)]
+struct HostArtifact {
+    interfaces: Vec<Interface>,
+    files: BTreeMap<String, Keyfile>,
+}
+
+#[derive(Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+struct HostDiff {
+    hostname: String,
+    change: Change,
+    /// Changes of the connection files and interfaces of the host.
+    details: Vec<(String, Change)>,
+}
+
+/// Print a summary of the changes between two artifacts generated by NMC, host by host and file by file.
+///
+/// Only the names of the modified keys are reported, since values may contain secrets.
+pub(crate) fn print_artifact_diff(old_dir: &str, new_dir: &str) -> Result<(), anyhow::Error> {
+    let old = load_artifact(old_dir).context("Loading old artifact")?;
+    let new = load_artifact(new_dir).context("Loading new artifact")?;
+
+    let hostnames: BTreeSet<&String> = old.keys().chain(new.keys()).collect();
+    let diffs = diff_hosts(&old, &new);
+
+    print!("{}", format_report(&diffs, hostnames.len()));
+
+    Ok(())
+}
+
+fn load_artifact(dir: &str) -> Result<BTreeMap<String, HostArtifact>, anyhow::Error> {
+    let mut hosts: BTreeMap<String, HostArtifact> = BTreeMap::new();
+
+    for host in parse_config(dir, false).context("Parsing host mapping")? {
+        hosts.entry(host.hostname).or_default().interfaces = host.interfaces;
+    }
+
+    for entry in fs::read_dir(dir).context("Reading artifact dir")? {
+        let entry = entry?;
+        if !entry.file_type()?.is_dir() {
+            continue;
+        }
+
+        let hostname = entry.file_name().to_string_lossy().to_string();
+        let files = &mut hosts.entry(hostname).or_default().files;
+
+        for file in fs::read_dir(entry.path()).context("Reading host dir")? {
+            let path = file?.path();
+            if !is_keyfile(&path) {
+                continue;
+            }
+
+            let contents = fs::read_to_string(&path).context("Reading connection file")?;
+            let filename = path
+                .file_name()
+                .map(|name| name.to_string_lossy().to_string())
+                .unwrap_or_default();
+
+            files.insert(filename, Keyfile::parse(&contents));
+        }
+    }
+
+    Ok(hosts)
+}
+
+/// Returns the hosts which differ between the artifacts, sorted by hostname.
+fn diff_hosts(
+    old: &BTreeMap<String, HostArtifact>,
+    new: &BTreeMap<String, HostArtifact>,
+) -> Vec<HostDiff> {
+    let empty = HostArtifact::default();
+    let hostnames: BTreeSet<&String> = old.keys().chain(new.keys()).collect();
+
+    hostnames
+        .into_iter()
+        .filter_map(|hostname| {
+            let change = match (old.get(hostname), new.get(hostname)) {
+                (None, _) => Change::Added,
+                (_, None) => Change::Removed,
+                _ => Change::Modified(Vec::new()),
+            };
+
+            let (old_host, new_host) = (
+                old.get(hostname).unwrap_or(&empty),
+                new.get(hostname).unwrap_or(&empty),
+            );
+
+            let mut details = diff_files(&old_host.files, &new_host.files);
+            details.extend(diff_interfaces(&old_host.interfaces, &new_host.interfaces));
+
+            if matches!(change, Change::Modified(..)) && details.is_empty() {
+                return None;
+            }
+
+            Some(HostDiff {
+                hostname: hostname.clone(),
+                change,
+                details,
+            })
+        })
+        .collect()
+}
+
+fn diff_files(
+    old: &BTreeMap<String, Keyfile>,
+    new: &BTreeMap<String, Keyfile>,
+) -> Vec<(String, Change)> {
+    let filenames: BTreeSet<&String> = old.keys().chain(new.keys()).collect();
+
+    filenames
+        .into_iter()
+        .filter_map(|filename| {
+            let change = match (old.get(filename), new.get(filename)) {
+                (None, _) => Change::Added,
+                (_, None) => Change::Removed,
+                (Some(old), Some(new)) => {
+                    let keys = old.changed_keys(new);
+                    if keys.is_empty() {
+                        return None;
+                    }
+                    Change::Modified(keys)
+                }
+            };
+
+            Some((filename.clone(), change))
+        })
+        .collect()
+}
+
+fn diff_interfaces(old: &[Interface], new: &[Interface]) -> Vec<(String, Change)> {
+    let names: BTreeSet<&String> = old.iter().chain(new).map(|i| &i.logical_name).collect();
+
+    names
+        .into_iter()
+        .filter_map(|name| {
+            let change = match (find(old, name), find(new, name)) {
+                (None, _) => Change::Added,
+                (_, None) => Change::Removed,
+                (Some(old), Some(new)) => {
+                    let mut fields = Vec::new();
+                    if old.mac_address != new.mac_address {
+                        fields.push("mac_address".to_string());
+                    }
+                    if old.interface_type != new.interface_type {
+                        fields.push("interface_type".to_string());
+                    }
+                    if old.management != new.management {
+                        fields.push("management".to_string());
+                    }
+                    if old.description != new.description {
+                        fields.push("description".to_string());
+                    }
+                    if old.altnames != new.altnames {
+                        fields.push("altnames".to_string());
+                    }
+                    if old.verification != new.verification {
+                        fields.push("verification".to_string());
+                    }
+
+                    if fields.is_empty() {
+                        return None;
+                    }
+                    Change::Modified(fields)
+                }
+            };
+
+            Some((format!("interface {name}"), change))
+        })
+        .collect()
+}
+
+fn find<'a>(interfaces: &'a [Interface], name: &str) -> Option<&'a Interface> {
+    interfaces.iter().find(|i| i.logical_name == name)
+}
+
+fn format_report(diffs: &[HostDiff], host_count: usize) -> String {
+    let mut report = String::new();
+    let mut counts = [0; 3];
+
+    for diff in diffs {
+        let (symbol, count) = match diff.change {
+            Change::Added => ('+', &mut counts[0]),
+            Change::Removed => ('-', &mut counts[1]),
+            Change::Modified(..) => ('~', &mut counts[2]),
+        };
+        *count += 1;
+
+        report.push_str(&format!("{symbol} {}\n", diff.hostname));
+
+        for (name, change) in &diff.details {
+            let line = match change {
+                Change::Added => format!("+ {name}"),
+                Change::Removed => format!("- {name}"),
+                Change::Modified(keys) => format!("~ {name}: {}", keys.join(", ")),
+            };
+            report.push_str(&format!("    {line}\n"));
+        }
+    }
+
+    if !diffs.is_empty() {
+        report.push('\n');
+    }
+
+    let [added, removed, changed] = counts;
+    report.push_str(&format!(
+        "Hosts: {added} added, {removed} removed, {changed} changed, {} unchanged\n",
+        host_count - diffs.len()
+    ));
+
+    report
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+
+    use crate::artifact::{
+        diff_files, diff_hosts, diff_interfaces, format_report, load_artifact, Change,
+        HostArtifact, HostDiff,
+    };
+    use crate::keyfile::Keyfile;
+    use crate::types::Interface;
+
+    fn interface(name: &str, mac_address: &str) -> Interface {
+        Interface {
+            logical_name: name.to_string(),
+            mac_address: Option::from(mac_address.to_string()),
+            interface_type: "ethernet".to_string(),
+            ..Default::default()
+        }
+    }
+
+    fn keyfile(method: &str) -> Keyfile {
+        Keyfile::parse(&format!(
+            "[connection]\nid=eth0\ntype=ethernet\n\n[ipv4]\nmethod={method}\n"
+        ))
+    }
+
+    #[test]
+    fn diff_connection_files() {
+        let old = BTreeMap::from([
+            ("eth0.nmconnection".to_string(), keyfile("auto")),
+            ("eth1.nmconnection".to_string(), keyfile("auto")),
+            ("eth2.nmconnection".to_string(), keyfile("auto")),
+        ]);
+        let new = BTreeMap::from([
+            ("eth0.nmconnection".to_string(), keyfile("auto")),
+            ("eth1.nmconnection".to_string(), keyfile("manual")),
+            ("eth3.nmconnection".to_string(), keyfile("auto")),
+        ]);
+
+        assert_eq!(
+            diff_files(&old, &new),
+            vec![
+                (
+                    "eth1.nmconnection".to_string(),
+                    Change::Modified(vec!["ipv4.method".to_string()])
+                ),
+                ("eth2.nmconnection".to_string(), Change::Removed),
+                ("eth3.nmconnection".to_string(), Change::Added),
+            ]
+        );
+    }
+
+    #[test]
+    fn diff_host_interfaces() {
+        let old = vec![
+            interface("eth0", "00:11:22:33:44:55"),
+            interface("eth1", "00:11:22:33:44:56"),
+        ];
+        let mut management = interface("eth0", "00:11:22:33:44:55");
+        management.management = true;
+        let new = vec![management, interface("eth2", "00:11:22:33:44:57")];
+
+        assert_eq!(
+            diff_interfaces(&old, &new),
+            vec![
+                (
+                    "interface eth0".to_string(),
+                    Change::Modified(vec!["management".to_string()])
+                ),
+                ("interface eth1".to_string(), Change::Removed),
+                ("interface eth2".to_string(), Change::Added),
+            ]
+        );
+        assert!(diff_interfaces(&old, &old).is_empty());
+    }
+
+    #[test]
+    fn diff_artifact_hosts() {
+        let host = |method: &str| HostArtifact {
+            interfaces: vec![interface("eth0", "00:11:22:33:44:55")],
+            files: BTreeMap::from([("eth0.nmconnection".to_string(), keyfile(method))]),
+        };
+
+        let old = BTreeMap::from([
+            ("node1".to_string(), host("auto")),
+            ("node2".to_string(), host("auto")),
+            ("node3".to_string(), host("auto")),
+        ]);
+        let new = BTreeMap::from([
+            ("node1".to_string(), host("auto")),
+            ("node2".to_string(), host("manual")),
+            ("node4".to_string(), host("auto")),
+        ]);
+
+        assert_eq!(
+            diff_hosts(&old, &new),
+            vec![
+                HostDiff {
+                    hostname: "node2".to_string(),
+                    change: Change::Modified(vec![]),
+                    details: vec![(
+                        "eth0.nmconnection".to_string(),
+                        Change::Modified(vec!["ipv4.method".to_string()])
+                    )],
+                },
+                HostDiff {
+                    hostname: "node3".to_string(),
+                    change: Change::Removed,
+                    details: vec![
+                        ("eth0.nmconnection".to_string(), Change::Removed),
+                        ("interface eth0".to_string(), Change::Removed),
+                    ],
+                },
+                HostDiff {
+                    hostname: "node4".to_string(),
+                    change: Change::Added,
+                    details: vec![
+                        ("eth0.nmconnection".to_string(), Change::Added),
+                        ("interface eth0".to_string(), Change::Added),
+                    ],
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn format_diff_report() {
+        let diffs = vec![
+            HostDiff {
+                hostname: "node2".to_string(),
+                change: Change::Modified(vec![]),
+                details: vec![
+                    (
+                        "eth0.nmconnection".to_string(),
+                        Change::Modified(vec![
+                            "ipv4.address1".to_string(),
+                            "ipv4.gateway".to_string(),
+                        ]),
+                    ),
+                    ("interface eth1".to_string(), Change::Removed),
+                ],
+            },
+            HostDiff {
+                hostname: "node4".to_string(),
+                change: Change::Added,
+                details: vec![("eth0.nmconnection".to_string(), Change::Added)],
+            },
+        ];
+
+        assert_eq!(
+            format_report(&diffs, 3),
+            r#"~ node2
+    ~ eth0.nmconnection: ipv4.address1, ipv4.gateway
+    - interface eth1
++ node4
+    + eth0.nmconnection
+
+Hosts: 1 added, 0 removed, 1 changed, 1 unchanged
+"#
+        );
+        assert_eq!(
+            format_report(&[], 2),
+            "Hosts: 0 added, 0 removed, 0 changed, 2 unchanged\n"
+        );
+    }
+
+    #[test]
+    fn diff_loaded_artifacts() {
+        let old = load_artifact("testdata/artifact/old").unwrap();
+        let new = load_artifact("testdata/artifact/new").unwrap();
+
+        assert_eq!(old["node1"].files.len(), 2);
+        assert_eq!(old["node1"].interfaces.len(), 2);
+
+        assert_eq!(
+            format_report(&diff_hosts(&old, &new), 3),
+            r#"~ node1
+    ~ eth0.nmconnection: ipv4.address1
+    ~ interface eth0: management
+- node2
+    - eth0.nmconnection
+    - interface eth0
++ node3
+    + eth0.nmconnection
+    + interface eth0
+
+Hosts: 1 added, 1 removed, 1 changed, 0 unchanged
+"#
+        );
+
+        assert!(load_artifact("<missing>").is_err());
+    }
+}
@@ -0,0 +1,192 @@
+use std::net::IpAddr;
+use std::path::Path;
+
+use anyhow::anyhow;
+use log::info;
+
+use crate::apply_conf::{ConnectionFile, HostFile};
+use crate::keyfile::Keyfile;
+use crate::types::{Dns, Ntp, NtpClient};
+
+/// Config of chrony, whose presence selects it over systemd-timesyncd.
+pub(crate) const CHRONY_CONF: &str = "/etc/chrony.conf";
+const CHRONY_DIR: &str = "/etc/chrony.d";
+const TIMESYNCD_DIR: &str = "/etc/systemd/timesyncd.conf.d";
+/// Name of the NTP drop-in, the same for either client.
+const NTP_DROP_IN: &str = "nm-configurator.conf";
+
+/// Add the name servers and search domains of the host to the IP settings of its connections, for the address
+/// families using the `auto` or `manual` method. Connections declaring their own DNS settings are left as they are.
+pub(crate) fn add_dns(
+    dns: &Dns,
+    connection_files: &mut [ConnectionFile],
+) -> Result<(), anyhow::Error> {
+    let mut ipv4 = Vec::new();
+    let mut ipv6 = Vec::new();
+    for server in &dns.servers {
+        match server.parse::<IpAddr>() {
+            Ok(IpAddr::V4(_)) => ipv4.push(server.as_str()),
+            Ok(IpAddr::V6(_)) => ipv6.push(server.as_str()),
+            Err(_) => return Err(anyhow!("Invalid name server '{server}'")),
+        }
+    }
+
+    for file in connection_files {
+        let mut keyfile = Keyfile::parse(&file.contents);
+        let mut changed = false;
+
+        for (family, servers) in [("ipv4", &ipv4), ("ipv6", &ipv6)] {
+            if !matches!(keyfile.get(family, "method"), Some("auto" | "manual")) {
+                continue;
+            }
+
+            if !servers.is_empty() && keyfile.get(family, "dns").is_none() {
+                keyfile.set(family, "dns", &keyfile_list(servers));
+                changed = true;
+            }
+            if !dns.search.is_empty() && keyfile.get(family, "dns-search").is_none() {
+                let search: Vec<&str> = dns.search.iter().map(String::as_str).collect();
+                keyfile.set(family, "dns-search", &keyfile_list(&search));
+                changed = true;
+            }
+        }
+
+        if changed {
+            info!("Adding DNS settings of the host to '{}'", file.name);
+            file.contents = keyfile.to_string();
+        }
+    }
+
+    Ok(())
+}
+
+/// Returns the list in the keyfile format, e.g. `192.168.1.1;192.168.1.2;`.
+fn keyfile_list(values: &[&str]) -> String {
+    values.iter().map(|value| format!("{value};")).collect()
+}
+
+/// Returns chrony if its config exists and systemd-timesyncd otherwise.
+pub(crate) fn detect_ntp_client(chrony_conf: &str) -> NtpClient {
+    if Path::new(chrony_conf).exists() {
+        NtpClient::Chrony
+    } else {
+        NtpClient::Timesyncd
+    }
+}
+
+/// Returns the drop-in of the NTP client declaring the time servers along with the dir it is stored in.
+pub(crate) fn ntp_drop_in(ntp: &Ntp, client: NtpClient) -> (&'static str, HostFile) {
+    let (dir, contents) = match client {
+        NtpClient::Chrony => {
+            let servers: String = ntp
+                .servers
+                .iter()
+                .map(|server| format!("server {server} iburst\n"))
+                .collect();
+            (CHRONY_DIR, servers)
+        }
+        NtpClient::Timesyncd => (
+            TIMESYNCD_DIR,
+            format!("[Time]\nNTP={}\n", ntp.servers.join(" ")),
+        ),
+    };
+
+    (
+        dir,
+        HostFile {
+            name: NTP_DROP_IN.to_string(),
+            contents: contents.into_bytes(),
+        },
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use crate::apply_conf::ConnectionFile;
+    use crate::bootstrap::{add_dns, detect_ntp_client, ntp_drop_in};
+    use crate::types::{Dns, Ntp, NtpClient};
+
+    #[test]
+    fn add_dns_to_connections() {
+        let file = |name: &str, contents: &str| ConnectionFile {
+            name: name.to_string(),
+            contents: contents.to_string(),
+        };
+        let mut files = vec![
+            file(
+                "eth0",
+                "[connection]\nid=eth0\n\n[ipv4]\nmethod=manual\naddress1=192.168.1.10/24\n\n[ipv6]\nmethod=auto\n",
+            ),
+            file(
+                "eth1",
+                "[connection]\nid=eth1\n\n[ipv4]\nmethod=auto\ndns=10.0.0.1;\n\n[ipv6]\nmethod=disabled\n",
+            ),
+            file("eth2", "[connection]\nid=eth2\nmaster=bond0\n"),
+        ];
+        let dns = Dns {
+            servers: vec!["192.168.1.1".to_string(), "2001:db8::1".to_string()],
+            search: vec!["example.com".to_string()],
+        };
+
+        add_dns(&dns, &mut files).unwrap();
+        assert_eq!(
+            files[0].contents,
+            "[connection]\nid=eth0\n\n[ipv4]\nmethod=manual\naddress1=192.168.1.10/24\ndns=192.168.1.1;\n\
+             dns-search=example.com;\n\n[ipv6]\nmethod=auto\ndns=2001:db8::1;\ndns-search=example.com;\n"
+        );
+        // The connection's own servers are kept
+        assert_eq!(
+            files[1].contents,
+            "[connection]\nid=eth1\n\n[ipv4]\nmethod=auto\ndns=10.0.0.1;\ndns-search=example.com;\n\n\
+             [ipv6]\nmethod=disabled\n"
+        );
+        assert_eq!(files[2].contents, "[connection]\nid=eth2\nmaster=bond0\n");
+
+        let dns = Dns {
+            servers: vec!["ns1.example.com".to_string()],
+            search: vec![],
+        };
+        assert_eq!(
+            add_dns(&dns, &mut files).unwrap_err().to_string(),
+            "Invalid name server 'ns1.example.com'"
+        );
+    }
+
+    #[test]
+    fn ntp_drop_ins() {
+        let ntp = Ntp {
+            servers: vec!["0.pool.ntp.org".to_string(), "1.pool.ntp.org".to_string()],
+            client: None,
+        };
+
+        let (dir, file) = ntp_drop_in(&ntp, NtpClient::Chrony);
+        assert_eq!(dir, "/etc/chrony.d");
+        assert_eq!(file.name, "nm-configurator.conf");
+        assert_eq!(
+            file.contents,
+            b"server 0.pool.ntp.org iburst\nserver 1.pool.ntp.org iburst\n"
+        );
+
+        let (dir, file) = ntp_drop_in(&ntp, NtpClient::Timesyncd);
+        assert_eq!(dir, "/etc/systemd/timesyncd.conf.d");
+        assert_eq!(
+            file.contents,
+            b"[Time]\nNTP=0.pool.ntp.org 1.pool.ntp.org\n"
+        );
+    }
+
+    #[test]
+    fn detect_ntp_clients() {
+        let chrony_conf = "_bootstrap_chrony.conf";
+        assert_eq!(detect_ntp_client(chrony_conf), NtpClient::Timesyncd);
+
+        fs::write(chrony_conf, "").unwrap();
+        assert_eq!(detect_ntp_client(chrony_conf), NtpClient::Chrony);
+
+        // cleanup
+        fs::remove_file(Path::new(chrony_conf)).unwrap();
+    }
+}
@@ -0,0 +1,710 @@
+use std::env;
+use std::ffi::OsStr;
+use std::fs::{self, OpenOptions};
+use std::io::{Read, Write};
+use std::net::IpAddr;
+use std::os::unix::fs::{OpenOptionsExt, PermissionsExt};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use anyhow::{anyhow, Context};
+use log::{debug, info};
+
+use crate::deadline;
+use crate::serve::{CONFIG_PATH, MAC_PARAM};
+use crate::workspace::Workspace;
+
+/// Name of the systemd credential holding the decryption key, e.g. sealed with the TPM via `LoadCredentialEncrypted=`.
+const KEY_CREDENTIAL: &str = "nmc-decryption-key";
+/// Variable holding the decryption key itself.
+const KEY_VARIABLE: &str = "NMC_DECRYPTION_KEY";
+
+/// Directory within the workspace holding the plaintext of the bundle.
+const BUNDLE_DIR: &str = "bundle";
+/// Directory within the workspace used as the GnuPG home, keeping the imported key off the keyring of the machine.
+const GNUPG_HOME_DIR: &str = "gnupg";
+
+/// Offset and value of the magic identifying POSIX tar archives.
+const TAR_MAGIC: (usize, &[u8]) = (257, b"ustar");
+const GZIP_MAGIC: &[u8] = &[0x1f, 0x8b];
+const ZSTD_MAGIC: &[u8] = &[0x28, 0xb5, 0x2f, 0xfd];
+
+/// Compression of the tar archives of config dirs, detected by its magic when reading them.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub(crate) enum Compression {
+    #[default]
+    Gzip,
+    /// Smaller and faster to extract than gzip, e.g. on low-end edge CPUs.
+    Zstd,
+}
+
+impl Compression {
+    fn detect(header: &[u8]) -> Option<Self> {
+        if header.starts_with(GZIP_MAGIC) {
+            Some(Compression::Gzip)
+        } else if header.starts_with(ZSTD_MAGIC) {
+            Some(Compression::Zstd)
+        } else {
+            None
+        }
+    }
+
+    /// Returns the flag of `tar` (de)compressing the archive.
+    pub(crate) fn tar_flag(&self) -> &'static str {
+        match self {
+            Compression::Gzip => "--gzip",
+            Compression::Zstd => "--zstd",
+        }
+    }
+
+    pub(crate) fn extension(&self) -> &'static str {
+        match self {
+            Compression::Gzip => "tar.gz",
+            Compression::Zstd => "tar.zst",
+        }
+    }
+
+    pub(crate) fn media_type(&self) -> &'static str {
+        match self {
+            Compression::Gzip => "application/gzip",
+            Compression::Zstd => "application/zstd",
+        }
+    }
+}
+
+#[derive(Debug, PartialEq)]
+pub(crate) enum Encryption {
+    Age,
+    Gpg,
+}
+
+impl Encryption {
+    /// Detect the encryption of the config source by its extension. Returns `None` for plain sources.
+    pub(crate) fn detect(source: &str) -> Option<Self> {
+        let path = Path::new(source);
+        if path.is_dir() {
+            return None;
+        }
+
+        match path.extension().and_then(OsStr::to_str) {
+            Some("age") => Some(Encryption::Age),
+            Some("gpg" | "pgp" | "asc") => Some(Encryption::Gpg),
+            _ => None,
+        }
+    }
+}
+
+/// Location of the key decrypting the bundle.
+#[derive(Debug, PartialEq)]
+enum KeySource {
+    File(PathBuf),
+    /// Key passed via the environment, stored in the workspace since neither age nor gpg read keys from variables.
+    Inline(String),
+}
+
+/// `nmc serve` instance providing the config of this machine.
+pub(crate) struct ConfigServer {
+    /// Base URL of the server, e.g. `https://nmc.example.com:8443`.
+    pub(crate) url: String,
+    /// File containing the bearer token presented to the server.
+    pub(crate) token_file: Option<String>,
+    /// CA certificate verifying the server instead of the system trust store.
+    pub(crate) ca_file: Option<String>,
+}
+
+impl ConfigServer {
+    /// Whether the server is contacted via https or on the loopback interface, i.e. the token and the fetched
+    /// config can't be read or tampered with on the way.
+    pub(crate) fn is_secure(&self) -> bool {
+        self.url.starts_with("https://") || is_loopback(&self.url)
+    }
+}
+
+/// Whether the http URL points at a loopback address, e.g. `http://127.0.0.1:8080`. Host names are not
+/// resolved, so `localhost` does not count.
+fn is_loopback(url: &str) -> bool {
+    let Some(rest) = url.strip_prefix("http://") else {
+        return false;
+    };
+
+    let authority = rest.split(['/', '?', '#']).next().unwrap_or_default();
+    let host = authority.rsplit('@').next().unwrap_or_default();
+    let host = match host.strip_prefix('[') {
+        Some(host) => host.split(']').next().unwrap_or_default(),
+        None => host.split(':').next().unwrap_or_default(),
+    };
+
+    host.parse::<IpAddr>().is_ok_and(|ip| ip.is_loopback())
+}
+
+/// Decrypted or downloaded config bundle, removed along with the workspace of the run when dropped.
+pub(crate) struct Bundle {
+    _workspace: Workspace,
+    path: PathBuf,
+}
+
+impl Bundle {
+    /// Decrypt the encrypted `source` into a new workspace in `workspaces_dir`.
+    ///
+    /// Tar archives (optionally compressed with gzip or zstd) are extracted, so that the bundle path is the config dir.
+    /// Anything else (e.g. a single desired state) is stored as a file named after the source without the extension.
+    pub(crate) fn open(
+        source: &str,
+        encryption: &Encryption,
+        key_file: Option<&str>,
+        workspaces_dir: &Path,
+    ) -> Result<Self, anyhow::Error> {
+        let key = key_source(
+            key_file,
+            env::var(KEY_VARIABLE).ok(),
+            env::var("CREDENTIALS_DIRECTORY").ok(),
+        )?;
+
+        let workspace = Workspace::create(workspaces_dir)?;
+        let dir = workspace.dir(BUNDLE_DIR)?;
+        fs::set_permissions(&dir, fs::Permissions::from_mode(0o700))
+            .context("Restricting bundle dir")?;
+
+        let key_path = match key {
+            KeySource::File(path) => path,
+            KeySource::Inline(key) => {
+                let path = dir.join("key");
+                write_private(&path, key.as_bytes()).context("Storing decryption key")?;
+                path
+            }
+        };
+
+        info!("Decrypting config bundle {source:?}...");
+        let plaintext = dir.join("plaintext");
+        match encryption {
+            Encryption::Age => decrypt_age(source, &key_path, &plaintext),
+            Encryption::Gpg => decrypt_gpg(source, &key_path, &plaintext, &workspace),
+        }
+        .context("Decrypting config bundle")?;
+
+        let path = unpack(&plaintext, source, &workspace).context("Unpacking config bundle")?;
+        debug!("Unpacked config bundle to {path:?}");
+
+        Ok(Bundle {
+            _workspace: workspace,
+            path,
+        })
+    }
+
+    /// Download the config of the machine with the given MAC addresses from the server into a new workspace
+    /// in `workspaces_dir`, extracting the returned archive so that the bundle path is the config dir.
+    ///
+    /// The bundle is neither signed nor encrypted, so the server has to be contacted via https (or on the loopback
+    /// interface), which also keeps the token from being sent in cleartext.
+    pub(crate) fn fetch(
+        server: &ConfigServer,
+        macs: &[String],
+        workspaces_dir: &Path,
+    ) -> Result<Self, anyhow::Error> {
+        if !server.is_secure() {
+            return Err(anyhow!(
+                "Refusing to fetch the config from {} without https",
+                server.url
+            ));
+        }
+
+        let workspace = Workspace::create(workspaces_dir)?;
+        let dir = workspace.dir(BUNDLE_DIR)?;
+        fs::set_permissions(&dir, fs::Permissions::from_mode(0o700))
+            .context("Restricting bundle dir")?;
+
+        let url = config_url(&server.url, macs);
+        let archive = dir.join("config.tar");
+
+        let mut command = Command::new("curl");
+        command
+            .args(["--silent", "--show-error", "--fail", "--retry", "3"])
+            .arg("--output")
+            .arg(&archive);
+        if let Some(ca_file) = &server.ca_file {
+            command.arg("--cacert").arg(ca_file);
+        }
+        if let Some(secs) = deadline::remaining_secs() {
+            command.arg("--max-time").arg(secs.to_string());
+        }
+        if let Some(token_file) = &server.token_file {
+            // Passed via a file, so that the token does not show up in the process list.
+            let token = fs::read_to_string(token_file).context("Reading token file")?;
+            let headers = dir.join("headers");
+            write_private(
+                &headers,
+                format!("Authorization: Bearer {}\n", token.trim()).as_bytes(),
+            )
+            .context("Storing token")?;
+            command
+                .arg("--header")
+                .arg(format!("@{}", headers.display()));
+        }
+
+        info!("Fetching config from {url}...");
+        let output = command.arg(&url).output().context("Running curl")?;
+        if !output.status.success() {
+            deadline::check()?;
+            return Err(anyhow!(
+                "Fetching config from {url} failed: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            ));
+        }
+
+        if !is_archive(&archive)? {
+            return Err(anyhow!("Config server did not return a tar archive"));
+        }
+
+        let path = unpack(&archive, "config.tar", &workspace).context("Unpacking config")?;
+        debug!("Unpacked config to {path:?}");
+
+        Ok(Bundle {
+            _workspace: workspace,
+            path,
+        })
+    }
+
+    /// Returns the config dir or the single file contained in the bundle.
+    pub(crate) fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+/// Returns the URL of the config of the machine with the given MAC addresses.
+fn config_url(base: &str, macs: &[String]) -> String {
+    let query: Vec<String> = macs
+        .iter()
+        .map(|mac| format!("{MAC_PARAM}={mac}"))
+        .collect();
+
+    format!(
+        "{}{CONFIG_PATH}?{}",
+        base.trim_end_matches('/'),
+        query.join("&")
+    )
+}
+
+/// Find the decryption key, preferring the explicitly passed file over the environment and the systemd credential.
+fn key_source(
+    key_file: Option<&str>,
+    key_variable: Option<String>,
+    credentials_dir: Option<String>,
+) -> Result<KeySource, anyhow::Error> {
+    if let Some(path) = key_file {
+        return Ok(KeySource::File(PathBuf::from(path)));
+    }
+
+    if let Some(key) = key_variable.filter(|key| !key.is_empty()) {
+        return Ok(KeySource::Inline(key));
+    }
+
+    if let Some(path) = credentials_dir
+        .map(|dir| Path::new(&dir).join(KEY_CREDENTIAL))
+        .filter(|path| path.exists())
+    {
+        return Ok(KeySource::File(path));
+    }
+
+    Err(anyhow!(
+        "No decryption key provided, pass --decryption-key, set {KEY_VARIABLE} or load the {KEY_CREDENTIAL} credential"
+    ))
+}
+
+fn decrypt_age(source: &str, key: &Path, output: &Path) -> Result<(), anyhow::Error> {
+    run(Command::new("age")
+        .arg("--decrypt")
+        .arg("--identity")
+        .arg(key)
+        .arg("--output")
+        .arg(output)
+        .arg(source))
+}
+
+fn decrypt_gpg(
+    source: &str,
+    key: &Path,
+    output: &Path,
+    workspace: &Workspace,
+) -> Result<(), anyhow::Error> {
+    let home = workspace.dir(GNUPG_HOME_DIR)?;
+    fs::set_permissions(&home, fs::Permissions::from_mode(0o700))
+        .context("Restricting GnuPG home")?;
+
+    run(gpg(&home).arg("--import").arg(key)).context("Importing decryption key")?;
+    run(gpg(&home)
+        .arg("--output")
+        .arg(output)
+        .arg("--decrypt")
+        .arg(source))
+}
+
+fn gpg(home: &Path) -> Command {
+    let mut command = Command::new("gpg");
+    command
+        .args([
+            "--batch",
+            "--quiet",
+            "--pinentry-mode",
+            "loopback",
+            "--homedir",
+        ])
+        .arg(home);
+    command
+}
+
+fn run(command: &mut Command) -> Result<(), anyhow::Error> {
+    let program = command.get_program().to_string_lossy().to_string();
+    let status = command
+        .status()
+        .with_context(|| format!("Running {program}"))?;
+    if !status.success() {
+        return Err(anyhow!("{program} exited with {status}"));
+    }
+
+    Ok(())
+}
+
+/// Extract the plaintext if it is a tar archive, otherwise move it in place as a single file.
+fn unpack(plaintext: &Path, source: &str, workspace: &Workspace) -> Result<PathBuf, anyhow::Error> {
+    if is_archive(plaintext)? {
+        let compression = Compression::detect(&read_header(plaintext)?);
+        let dir = workspace.dir("config")?;
+        run(Command::new("tar")
+            .args(["--extract", "--no-same-owner", "--no-same-permissions"])
+            .args(compression.as_ref().map(Compression::tar_flag))
+            .arg("--file")
+            .arg(plaintext)
+            .arg("--directory")
+            .arg(&dir))?;
+        fs::remove_file(plaintext).context("Removing archive")?;
+
+        return Ok(dir);
+    }
+
+    let name = Path::new(source)
+        .file_stem()
+        .ok_or_else(|| anyhow!("Determining bundle file name"))?;
+    let path = plaintext.with_file_name(name);
+    fs::rename(plaintext, &path).context("Moving bundle file")?;
+
+    Ok(path)
+}
+
+fn is_archive(path: &Path) -> Result<bool, anyhow::Error> {
+    let header = read_header(path)?;
+
+    Ok(Compression::detect(&header).is_some() || header.get(TAR_MAGIC.0..) == Some(TAR_MAGIC.1))
+}
+
+/// Returns the leading bytes of the file covering the magics of tar archives and of their compressions.
+fn read_header(path: &Path) -> Result<Vec<u8>, anyhow::Error> {
+    let mut header = Vec::new();
+    fs::File::open(path)
+        .context("Opening plaintext")?
+        .take((TAR_MAGIC.0 + TAR_MAGIC.1.len()) as u64)
+        .read_to_end(&mut header)
+        .context("Reading plaintext")?;
+
+    Ok(header)
+}
+
+fn write_private(path: &Path, contents: &[u8]) -> Result<(), anyhow::Error> {
+    let mut file = OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .mode(0o600)
+        .open(path)?;
+    file.write_all(contents)?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::io::{BufRead, BufReader, Write};
+    use std::net::TcpListener;
+    use std::path::{Path, PathBuf};
+    use std::process::Command;
+    use std::thread;
+
+    use crate::bundle::{
+        config_url, is_loopback, key_source, unpack, Bundle, Compression, ConfigServer, Encryption,
+        KeySource,
+    };
+    use crate::workspace::Workspace;
+
+    #[test]
+    fn detect_encryption() {
+        assert_eq!(Encryption::detect("config.tar.age"), Some(Encryption::Age));
+        assert_eq!(Encryption::detect("state.yaml.gpg"), Some(Encryption::Gpg));
+        assert_eq!(Encryption::detect("state.yaml.asc"), Some(Encryption::Gpg));
+        assert_eq!(Encryption::detect("state.yaml"), None);
+        assert_eq!(Encryption::detect("testdata/apply"), None);
+    }
+
+    #[test]
+    fn detect_compression() {
+        assert_eq!(
+            Compression::detect(&[0x1f, 0x8b, 0x08]),
+            Some(Compression::Gzip)
+        );
+        assert_eq!(
+            Compression::detect(&[0x28, 0xb5, 0x2f, 0xfd, 0x04]),
+            Some(Compression::Zstd)
+        );
+        assert_eq!(Compression::detect(b"interfaces: []"), None);
+        assert_eq!(Compression::detect(&[]), None);
+    }
+
+    #[test]
+    fn detect_loopback_urls() {
+        for url in [
+            "http://127.0.0.1:8080",
+            "http://127.0.0.1",
+            "http://[::1]:8080/",
+            "http://user@127.0.0.1:8080",
+        ] {
+            assert!(is_loopback(url), "{url}");
+        }
+
+        for url in [
+            "http://nmc.example.com:8080",
+            "http://localhost:8080",
+            "http://192.168.1.1:8080",
+            "http://127.0.0.1@nmc.example.com",
+            "http://127.0.0.1.nmc.example.com",
+            "https://127.0.0.1:8443",
+            "127.0.0.1:8080",
+        ] {
+            assert!(!is_loopback(url), "{url}");
+        }
+    }
+
+    #[test]
+    fn build_config_url() {
+        let macs = vec![
+            "00:11:22:33:44:55".to_string(),
+            "00:11:22:33:44:66".to_string(),
+        ];
+
+        assert_eq!(
+            config_url("https://nmc.example.com:8443/", &macs),
+            "https://nmc.example.com:8443/config?mac=00:11:22:33:44:55&mac=00:11:22:33:44:66"
+        );
+    }
+
+    #[test]
+    fn fetch_config_from_server() {
+        let dir = Path::new("_bundle_fetch");
+        let source = dir.join("source");
+        fs::create_dir_all(source.join("node1")).unwrap();
+        fs::write(source.join("host_config.yaml"), "- hostname: node1\n").unwrap();
+
+        let status = Command::new("tar")
+            .arg("--create")
+            .arg("--gzip")
+            .arg("--file")
+            .arg(dir.join("config.tar.gz"))
+            .arg("--directory")
+            .arg(&source)
+            .args(["host_config.yaml", "node1"])
+            .status()
+            .unwrap();
+        assert!(status.success());
+        let archive = fs::read(dir.join("config.tar.gz")).unwrap();
+
+        // Serves a single request, checking the MAC address and that no token is sent in cleartext
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}", listener.local_addr().unwrap());
+        let server = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut head = String::new();
+            let mut reader = BufReader::new(stream.try_clone().unwrap());
+            loop {
+                let mut line = String::new();
+                reader.read_line(&mut line).unwrap();
+                if line.trim().is_empty() {
+                    break;
+                }
+                head.push_str(&line);
+            }
+
+            assert!(head.starts_with("GET /config?mac=00:11:22:33:44:55 HTTP/1.1"));
+            assert!(!head.contains("Authorization"));
+
+            write!(
+                stream,
+                "HTTP/1.1 200 OK\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+                archive.len()
+            )
+            .unwrap();
+            stream.write_all(&archive).unwrap();
+        });
+
+        let bundle = Bundle::fetch(
+            &ConfigServer {
+                url,
+                token_file: None,
+                ca_file: None,
+            },
+            &["00:11:22:33:44:55".to_string()],
+            &dir.join("work"),
+        )
+        .unwrap();
+        server.join().unwrap();
+
+        assert!(bundle.path().join("host_config.yaml").exists());
+        assert!(bundle.path().join("node1").is_dir());
+
+        // cleanup
+        drop(bundle);
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn fetch_refuses_http() {
+        let dir = Path::new("_bundle_fetch_http");
+        fs::create_dir_all(dir).unwrap();
+        fs::write(dir.join("token"), "s3cret\n").unwrap();
+
+        let server = ConfigServer {
+            url: "http://nmc.example.com:8080".to_string(),
+            token_file: Some(dir.join("token").to_str().unwrap().to_string()),
+            ca_file: None,
+        };
+        assert!(!server.is_secure());
+        assert_eq!(
+            Bundle::fetch(
+                &server,
+                &["00:11:22:33:44:55".to_string()],
+                &dir.join("work")
+            )
+            .err()
+            .unwrap()
+            .to_string(),
+            "Refusing to fetch the config from http://nmc.example.com:8080 without https"
+        );
+
+        let server = ConfigServer {
+            token_file: None,
+            ..server
+        };
+        assert!(Bundle::fetch(
+            &server,
+            &["00:11:22:33:44:55".to_string()],
+            &dir.join("work")
+        )
+        .is_err());
+        assert!(!dir.join("work").exists());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn find_key_source() {
+        assert_eq!(
+            key_source(Some("key.txt"), Some("inline".to_string()), None).unwrap(),
+            KeySource::File(PathBuf::from("key.txt"))
+        );
+        assert_eq!(
+            key_source(
+                None,
+                Some("inline".to_string()),
+                Some("testdata".to_string())
+            )
+            .unwrap(),
+            KeySource::Inline("inline".to_string())
+        );
+
+        let dir = "_bundle_credentials";
+        fs::create_dir_all(dir).unwrap();
+        fs::write(Path::new(dir).join("nmc-decryption-key"), "key").unwrap();
+
+        assert_eq!(
+            key_source(None, Some(String::new()), Some(dir.to_string())).unwrap(),
+            KeySource::File(Path::new(dir).join("nmc-decryption-key"))
+        );
+        assert!(key_source(None, None, Some("testdata".to_string())).is_err());
+        assert!(key_source(None, None, None).is_err());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn unpack_archive_and_single_file() {
+        let dir = Path::new("_bundle_unpack");
+        let source = dir.join("source");
+        fs::create_dir_all(source.join("node1")).unwrap();
+        fs::write(source.join("host_config.yaml"), "- hostname: node1\n").unwrap();
+        fs::write(
+            source.join("node1").join("eth0.nmconnection"),
+            "[connection]\n",
+        )
+        .unwrap();
+
+        let workspace = Workspace::create(&dir.join("work")).unwrap();
+        let plaintext = workspace.dir("bundle").unwrap().join("plaintext");
+        let status = Command::new("tar")
+            .arg("--create")
+            .arg("--file")
+            .arg(&plaintext)
+            .arg("--directory")
+            .arg(&source)
+            .arg(".")
+            .status()
+            .unwrap();
+        assert!(status.success());
+
+        let config_dir = unpack(&plaintext, "config.tar.age", &workspace).unwrap();
+        assert_eq!(
+            fs::read_to_string(config_dir.join("node1").join("eth0.nmconnection")).unwrap(),
+            "[connection]\n"
+        );
+        assert!(!plaintext.exists());
+
+        fs::write(&plaintext, "interfaces: []\n").unwrap();
+        let file = unpack(&plaintext, "/tmp/state.yaml.gpg", &workspace).unwrap();
+        assert_eq!(file.file_name().unwrap(), "state.yaml");
+        assert_eq!(fs::read_to_string(file).unwrap(), "interfaces: []\n");
+
+        // cleanup
+        drop(workspace);
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn unpack_zstd_archive() {
+        let dir = Path::new("_bundle_unpack_zstd");
+        let source = dir.join("source");
+        fs::create_dir_all(source.join("node1")).unwrap();
+        fs::write(source.join("host_config.yaml"), "- hostname: node1\n").unwrap();
+
+        let workspace = Workspace::create(&dir.join("work")).unwrap();
+        let plaintext = workspace.dir("bundle").unwrap().join("plaintext");
+        let status = Command::new("tar")
+            .arg("--create")
+            .arg("--zstd")
+            .arg("--file")
+            .arg(&plaintext)
+            .arg("--directory")
+            .arg(&source)
+            .arg(".")
+            .status()
+            .unwrap();
+        assert!(status.success());
+
+        let config_dir = unpack(&plaintext, "config.tar.zst.age", &workspace).unwrap();
+        assert_eq!(
+            fs::read_to_string(config_dir.join("host_config.yaml")).unwrap(),
+            "- hostname: node1\n"
+        );
+        assert!(config_dir.join("node1").is_dir());
+
+        // cleanup
+        drop(workspace);
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
@@ -0,0 +1,147 @@
+use std::collections::BTreeMap;
+use std::path::Path;
+
+use anyhow::Context;
+use log::warn;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::filesystem::FileSystem;
+
+/// File in the output dir recording the inputs the config of each host was generated from.
+pub(crate) const CACHE_FILE: &str = ".nmc-cache.json";
+
+/// Outcome of generating the config of a single host, reused as long as its inputs do not change.
+#[derive(Serialize, Deserialize, Clone, Debug, PartialEq)]
+pub(crate) struct GeneratedHost {
+    /// Types of the generated connections.
+    pub(crate) connection_types: Vec<String>,
+    /// Number of files stored in the host dir.
+    pub(crate) files: usize,
+    /// Entry of the host in the host mapping.
+    pub(crate) mapping: String,
+}
+
+#[derive(Serialize, Deserialize, Debug, PartialEq)]
+struct Entry {
+    checksum: String,
+    host: GeneratedHost,
+}
+
+/// Hosts generated into an output dir by their input checksums, allowing repeated builds to skip the unchanged ones.
+#[derive(Serialize, Deserialize, Debug, Default, PartialEq)]
+pub(crate) struct GenerationCache {
+    hosts: BTreeMap<String, Entry>,
+}
+
+impl GenerationCache {
+    /// Load the cache of the output dir. Returns an empty cache if there is none or it can't be read,
+    /// so that the hosts are simply generated again.
+    pub(crate) fn load(filesystem: &dyn FileSystem, output_dir: &str) -> Self {
+        let path = Path::new(output_dir).join(CACHE_FILE);
+        let contents = match filesystem.read(&path) {
+            Ok(Some(contents)) => contents,
+            Ok(None) => return GenerationCache::default(),
+            Err(err) => {
+                warn!("Reading generation cache {path:?} failed, generating all hosts: {err}");
+                return GenerationCache::default();
+            }
+        };
+
+        serde_json::from_slice(&contents).unwrap_or_else(|err| {
+            warn!("Parsing generation cache {path:?} failed, generating all hosts: {err}");
+            GenerationCache::default()
+        })
+    }
+
+    /// Returns the host generated from the inputs with the given checksum, if any.
+    pub(crate) fn get(&self, hostname: &str, checksum: &str) -> Option<&GeneratedHost> {
+        self.hosts
+            .get(hostname)
+            .filter(|entry| entry.checksum == checksum)
+            .map(|entry| &entry.host)
+    }
+
+    pub(crate) fn insert(&mut self, hostname: &str, checksum: String, host: GeneratedHost) {
+        self.hosts
+            .insert(hostname.to_string(), Entry { checksum, host });
+    }
+
+    pub(crate) fn save(
+        &self,
+        filesystem: &dyn FileSystem,
+        output_dir: &str,
+    ) -> Result<(), anyhow::Error> {
+        let contents = serde_json::to_vec_pretty(self).context("Serializing generation cache")?;
+        filesystem
+            .write(&Path::new(output_dir).join(CACHE_FILE), &contents, 0o666)
+            .context("Writing generation cache")
+    }
+}
+
+/// Returns a hex encoded SHA-256 digest over the inputs of a host's config. The version of NMC and the linked
+/// nmstate are always included, so that upgrading either of them regenerates all hosts.
+pub(crate) fn input_checksum<'a>(inputs: impl IntoIterator<Item = &'a str>) -> String {
+    let mut hasher = Sha256::new();
+    for input in [env!("CARGO_PKG_VERSION"), env!("NMC_NMSTATE_VERSION")]
+        .into_iter()
+        .chain(inputs)
+    {
+        // Length prefixed, so that moving content between adjacent inputs changes the digest.
+        hasher.update((input.len() as u64).to_le_bytes());
+        hasher.update(input.as_bytes());
+    }
+
+    hasher
+        .finalize()
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::Path;
+
+    use crate::cache::{input_checksum, GeneratedHost, GenerationCache};
+    use crate::filesystem::{FileSystem, Memory};
+
+    #[test]
+    fn checksum_inputs() {
+        assert_eq!(input_checksum(["a", "b"]), input_checksum(["a", "b"]));
+        assert_ne!(input_checksum(["a", "b"]), input_checksum(["a", "c"]));
+        assert_ne!(input_checksum(["ab", ""]), input_checksum(["a", "b"]));
+    }
+
+    #[test]
+    fn load_and_save_cache() {
+        let filesystem = Memory::default();
+        assert_eq!(
+            GenerationCache::load(&filesystem, "out"),
+            GenerationCache::default()
+        );
+
+        let host = GeneratedHost {
+            connection_types: vec!["ethernet".to_string()],
+            files: 1,
+            mapping: "- hostname: node1\n".to_string(),
+        };
+        let mut cache = GenerationCache::default();
+        cache.insert("node1", "abc".to_string(), host.clone());
+        cache.save(&filesystem, "out").unwrap();
+
+        let cache = GenerationCache::load(&filesystem, "out");
+        assert_eq!(cache.get("node1", "abc"), Some(&host));
+        assert_eq!(cache.get("node1", "def"), None);
+        assert_eq!(cache.get("node2", "abc"), None);
+
+        // Unreadable caches are discarded
+        filesystem
+            .write(Path::new("out/.nmc-cache.json"), b"{", 0o666)
+            .unwrap();
+        assert_eq!(
+            GenerationCache::load(&filesystem, "out"),
+            GenerationCache::default()
+        );
+    }
+}
@@ -0,0 +1,94 @@
+use std::fs;
+use std::path::Path;
+
+use anyhow::Context;
+use log::{info, warn};
+use nmstate::{InterfaceType, Interfaces, NetworkState};
+
+/// Capture the current network state of this machine as a desired state and print it to stdout (`output` is `-`)
+/// or store it in the `output` file, giving a starting point for authoring the configs of similar hosts.
+///
+/// Secrets (e.g. Wi-Fi or 802.1X passwords) are only included if `include_secrets` is set.
+pub(crate) fn capture(output: &str, include_secrets: bool) -> Result<(), anyhow::Error> {
+    let mut state = NetworkState::new();
+    state.set_include_secrets(include_secrets);
+    state.retrieve().context("Retrieving network state")?;
+
+    let data = serde_yaml::to_string(&desired_state(state)).context("Serializing network state")?;
+
+    if output == "-" {
+        print!("{data}");
+        return Ok(());
+    }
+
+    if let Some(dir) = Path::new(output).parent() {
+        fs::create_dir_all(dir).context("Creating output dir")?;
+    }
+
+    fs::write(output, data).context("Writing desired state")
+}
+
+/// Strip the parts of the current state which do not belong to a desired state.
+///
+/// The loopback interface is skipped since it is brought up on its own.
+/// Ethernet interfaces without a MAC address are kept but reported, since `generate` requires one to identify the host.
+fn desired_state(mut state: NetworkState) -> NetworkState {
+    let mut interfaces = Interfaces::new();
+
+    for interface in state.interfaces.to_vec() {
+        match interface.iface_type() {
+            InterfaceType::Loopback => {
+                info!("Skipping loopback interface '{}'", interface.name());
+                continue;
+            }
+            InterfaceType::Ethernet if interface.base_iface().mac_address.is_none() => {
+                warn!(
+                    interface = interface.name();
+                    "Ethernet interface '{}' has no MAC address, add one before generating its config",
+                    interface.name()
+                );
+            }
+            _ => {}
+        }
+
+        interfaces.push(interface.clone());
+    }
+
+    state.interfaces = interfaces;
+    state
+}
+
+#[cfg(test)]
+mod tests {
+    use nmstate::NetworkState;
+
+    use crate::capture::desired_state;
+
+    #[test]
+    fn desired_state_skips_loopback() {
+        let state = NetworkState::new_from_yaml(
+            r#"---
+interfaces:
+  - name: lo
+    type: loopback
+    state: up
+  - name: eth0
+    type: ethernet
+    state: up
+    mac-address: 00:11:22:33:44:55
+  - name: eth1
+    type: ethernet
+    state: up
+"#,
+        )
+        .unwrap();
+
+        let names: Vec<String> = desired_state(state)
+            .interfaces
+            .to_vec()
+            .iter()
+            .map(|interface| interface.name().to_string())
+            .collect();
+        assert_eq!(names, vec!["eth0", "eth1"]);
+    }
+}
@@ -0,0 +1,85 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::Context;
+
+use crate::filesystem::FileSystem;
+
+/// Directory on the config drive containing the combustion script.
+const COMBUSTION_DIR: &str = "combustion";
+/// Directory next to the script containing the generated network config.
+const NETWORK_DIR: &str = "network";
+const SCRIPT_FILE: &str = "script";
+
+/// Script applying the network config from the config drive. Combustion runs it from the `combustion` dir,
+/// which is where the `nmc` binary is expected unless the image already ships it.
+const SCRIPT: &str = r#"#!/bin/bash
+# Applies the network config generated by nm-configurator.
+set -euo pipefail
+
+cd "$(dirname "$0")"
+
+nmc=nmc
+if [ -x ./nmc ]; then
+    nmc=./nmc
+fi
+
+"$nmc" apply --config-dir NETWORK_DIR/
+"#;
+
+/// Returns the dir storing the generated network config within the combustion layout under `output_dir`.
+pub(crate) fn network_dir(output_dir: &str) -> PathBuf {
+    Path::new(output_dir).join(COMBUSTION_DIR).join(NETWORK_DIR)
+}
+
+/// Write the combustion script applying the config stored in the [`network_dir`] of `output_dir`.
+pub(crate) fn write_script(
+    filesystem: &dyn FileSystem,
+    output_dir: &str,
+) -> Result<(), anyhow::Error> {
+    let path = Path::new(output_dir).join(COMBUSTION_DIR).join(SCRIPT_FILE);
+
+    filesystem
+        .write(
+            &path,
+            SCRIPT.replace("NETWORK_DIR", NETWORK_DIR).as_bytes(),
+            0o755,
+        )
+        .context("Writing combustion script")?;
+    filesystem
+        .set_permissions(&path, 0o755)
+        .context("Making combustion script executable")
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::Path;
+
+    use crate::combustion::{network_dir, write_script};
+    use crate::filesystem::Disk;
+
+    #[test]
+    fn write_combustion_script() {
+        let output_dir = "_combustion";
+        assert_eq!(
+            network_dir(output_dir),
+            Path::new("_combustion/combustion/network")
+        );
+        fs::create_dir_all(network_dir(output_dir)).unwrap();
+
+        write_script(&Disk, output_dir).unwrap();
+
+        let path = Path::new(output_dir).join("combustion").join("script");
+        let script = fs::read_to_string(&path).unwrap();
+        assert!(script.starts_with("#!/bin/bash\n"));
+        assert!(script.ends_with("\"$nmc\" apply --config-dir network/\n"));
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o755
+        );
+
+        // cleanup
+        fs::remove_dir_all(output_dir).unwrap();
+    }
+}
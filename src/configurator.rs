@@ -0,0 +1,589 @@
+//! Stable API for embedding NM configurator, e.g. in image builders which would otherwise shell out to `nmc`.
+//!
+//! ```no_run
+//! use nmc::configurator::{Configurator, ConfiguratorOptions, LocalNics};
+//!
+//! let configurator = Configurator::new(ConfiguratorOptions::default().expand_env(true));
+//! configurator.generate("desired-states", "network-config")?;
+//!
+//! let identification = configurator.identify("network-config", &LocalNics)?;
+//! println!("Identified host: {}", identification.hostname);
+//! # Ok::<(), anyhow::Error>(())
+//! ```
+//!
+//! The generated files can be kept in memory instead, e.g. to package them without touching the disk:
+//!
+//! ```no_run
+//! use nmc::configurator::{Configurator, ConfiguratorOptions, Memory};
+//!
+//! let files = Memory::default();
+//! Configurator::new(ConfiguratorOptions::default())
+//!     .with_filesystem(files.clone())
+//!     .generate("desired-states", "network-config")?;
+//!
+//! for (path, contents) in files.files() {
+//!     println!("{path:?}: {} bytes", contents.len());
+//! }
+//! # Ok::<(), anyhow::Error>(())
+//! ```
+//!
+//! The host mapping of a config dir can be built from code, e.g. from an inventory, instead of templating
+//! `host_config.yaml`:
+//!
+//! ```no_run
+//! use nmc::configurator::{marshal_hosts, HostBuilder, InterfaceBuilder};
+//!
+//! let host = HostBuilder::new("node1")
+//!     .label("site", "berlin")
+//!     .interface(
+//!         InterfaceBuilder::new("eth0", "ethernet")
+//!             .mac_address("00:11:22:33:44:55")
+//!             .management(true)
+//!             .build()?,
+//!     )
+//!     .build()?;
+//!
+//! std::fs::write("network-config/host_config.yaml", marshal_hosts(&[host])?)?;
+//! # Ok::<(), anyhow::Error>(())
+//! ```
+//!
+//! Unlike the internals of the crate, the items of this module only change in backwards compatible ways
+//! within a major version.
+
+use std::collections::{BTreeMap, HashSet};
+
+use anyhow::{anyhow, Context};
+use network_interface::NetworkInterface;
+
+use crate::apply_conf::{
+    apply, detect_local_interfaces, duplicate_macs, find_host, load_identity, local_nics,
+    parse_config, ApplyOptions, MatchOptions,
+};
+use crate::filenames::{validate_hostname, validate_interface_name};
+use crate::generate_conf::{generate, GenerateOptions};
+use crate::infiniband::{is_hardware_address, normalize_address};
+use crate::selector::is_valid_label;
+
+pub use crate::filesystem::{Disk, FileSystem, Memory};
+pub use crate::types::{Host, Interface};
+
+/// Physical NIC of the machine a config is applied to.
+#[derive(Clone, Debug, PartialEq)]
+#[non_exhaustive]
+pub struct Nic {
+    /// Name of the interface, e.g. `ens1f0`.
+    pub name: String,
+    /// MAC address of the NIC, preferably the permanent one.
+    pub mac_address: Option<String>,
+}
+
+impl Nic {
+    pub fn new(name: impl Into<String>, mac_address: Option<String>) -> Self {
+        Nic {
+            name: name.into(),
+            mac_address,
+        }
+    }
+}
+
+/// Source of the NICs a host is identified by.
+pub trait NicCollector {
+    /// Returns the physical NICs of the machine, excluding virtual interfaces such as bridges or bonds.
+    fn collect(&self) -> Result<Vec<Nic>, anyhow::Error>;
+}
+
+/// Collects the NICs of the machine running the process, using their permanent MAC addresses where available.
+pub struct LocalNics;
+
+impl NicCollector for LocalNics {
+    fn collect(&self) -> Result<Vec<Nic>, anyhow::Error> {
+        Ok(local_nics()?
+            .into_iter()
+            .map(|nic| Nic::new(nic.name, nic.mac_addr))
+            .collect())
+    }
+}
+
+/// Options shared by the operations of a [`Configurator`], set via the builder methods of the same names.
+#[derive(Clone, Debug, Default)]
+#[non_exhaustive]
+pub struct ConfiguratorOptions {
+    /// Expand `${VAR}` references in the desired states and connection files from the environment.
+    pub expand_env: bool,
+    /// Identity file provisioned by the manufacturer, taking precedence over matching the MAC addresses.
+    pub identity_file: Option<String>,
+    /// Identify the host by its interface names as a last resort, e.g. on platforms randomizing the MAC addresses.
+    pub match_by_name: bool,
+}
+
+impl ConfiguratorOptions {
+    pub fn expand_env(mut self, expand_env: bool) -> Self {
+        self.expand_env = expand_env;
+        self
+    }
+
+    pub fn identity_file(mut self, identity_file: impl Into<String>) -> Self {
+        self.identity_file = Some(identity_file.into());
+        self
+    }
+
+    pub fn match_by_name(mut self, match_by_name: bool) -> Self {
+        self.match_by_name = match_by_name;
+        self
+    }
+}
+
+/// Host a machine was identified as.
+#[derive(Clone, Debug, PartialEq)]
+#[non_exhaustive]
+pub struct Identification {
+    pub hostname: String,
+    /// Local names of the host's interfaces by their preconfigured names, for those which differ.
+    pub interface_names: BTreeMap<String, String>,
+}
+
+impl Identification {
+    pub fn new(hostname: impl Into<String>, interface_names: BTreeMap<String, String>) -> Self {
+        Identification {
+            hostname: hostname.into(),
+            interface_names,
+        }
+    }
+}
+
+/// Builds a host of `host_config.yaml`. `build` checks the hostname the same way `apply` does when parsing the
+/// host mapping, and additionally rejects invalid labels and interfaces declared more than once.
+pub struct HostBuilder {
+    host: Host,
+}
+
+impl HostBuilder {
+    pub fn new(hostname: impl Into<String>) -> Self {
+        HostBuilder {
+            host: Host {
+                hostname: hostname.into(),
+                ..Host::default()
+            },
+        }
+    }
+
+    /// Add a label selecting the host along with others, e.g. `site: berlin`.
+    pub fn label(mut self, key: impl Into<String>, value: impl Into<String>) -> Self {
+        self.host.labels.insert(key.into(), value.into());
+        self
+    }
+
+    pub fn interface(mut self, interface: Interface) -> Self {
+        self.host.interfaces.push(interface);
+        self
+    }
+
+    pub fn build(self) -> Result<Host, anyhow::Error> {
+        let hostname = &self.host.hostname;
+        validate_hostname(hostname)?;
+
+        if let Some((key, value)) = self
+            .host
+            .labels
+            .iter()
+            .find(|(key, value)| !is_valid_label(key) || !is_valid_label(value))
+        {
+            return Err(anyhow!(
+                "Invalid label '{key}: {value}' of host '{hostname}'"
+            ));
+        }
+
+        let mut names = HashSet::new();
+        if let Some(interface) = self
+            .host
+            .interfaces
+            .iter()
+            .find(|interface| !names.insert(interface.logical_name.as_str()))
+        {
+            return Err(anyhow!(
+                "Interface '{}' is declared more than once by host '{hostname}'",
+                interface.logical_name
+            ));
+        }
+
+        Ok(self.host)
+    }
+}
+
+/// Builds an interface of a host, validating its name and MAC address.
+pub struct InterfaceBuilder {
+    interface: Interface,
+}
+
+impl InterfaceBuilder {
+    /// Starts an interface of the given nmstate type, e.g. `ethernet`, `infiniband` or `bond`.
+    pub fn new(logical_name: impl Into<String>, interface_type: impl Into<String>) -> Self {
+        InterfaceBuilder {
+            interface: Interface {
+                logical_name: logical_name.into(),
+                interface_type: interface_type.into(),
+                ..Interface::default()
+            },
+        }
+    }
+
+    /// Set the MAC address identifying the host, required for Ethernet and InfiniBand interfaces.
+    pub fn mac_address(mut self, mac_address: impl Into<String>) -> Self {
+        self.interface.mac_address = Some(mac_address.into());
+        self
+    }
+
+    /// Mark the interface as the one providing remote access to the host.
+    pub fn management(mut self, management: bool) -> Self {
+        self.interface.management = management;
+        self
+    }
+
+    /// Set the free-form description of the interface (ifalias), e.g. "uplink to sw-03 port 12".
+    pub fn description(mut self, description: impl Into<String>) -> Self {
+        self.interface.description = Some(description.into());
+        self
+    }
+
+    pub fn build(mut self) -> Result<Interface, anyhow::Error> {
+        let name = &self.interface.logical_name;
+        validate_interface_name(name)?;
+
+        if self.interface.interface_type.is_empty() {
+            return Err(anyhow!("Interface '{name}' has no type"));
+        }
+
+        match &self.interface.mac_address {
+            Some(mac) if !is_hardware_address(mac) => {
+                return Err(anyhow!("Invalid MAC address '{mac}' of interface '{name}'"));
+            }
+            Some(mac) => self.interface.mac_address = Some(normalize_address(mac)),
+            None if self.interface.is_nic() => {
+                return Err(anyhow!(
+                    "Ethernet or InfiniBand interface '{name}' has no MAC address"
+                ));
+            }
+            None => {}
+        }
+
+        Ok(self.interface)
+    }
+}
+
+/// Returns the contents of `host_config.yaml` for the hosts, failing if they share hostnames or MAC addresses.
+pub fn marshal_hosts(hosts: &[Host]) -> Result<String, anyhow::Error> {
+    let mut hostnames = HashSet::new();
+    if let Some(host) = hosts
+        .iter()
+        .find(|host| !hostnames.insert(host.hostname.as_str()))
+    {
+        return Err(anyhow!(
+            "Host '{}' is declared more than once",
+            host.hostname
+        ));
+    }
+
+    let duplicates = duplicate_macs(hosts);
+    if !duplicates.is_empty() {
+        return Err(anyhow!(
+            "MAC addresses are assigned to several hosts: {}",
+            duplicates.join(", ")
+        ));
+    }
+
+    serde_yaml::to_string(hosts).context("Serializing hosts")
+}
+
+/// Entry point of the API, performing the same operations as the corresponding `nmc` commands.
+pub struct Configurator {
+    options: ConfiguratorOptions,
+    filesystem: Box<dyn FileSystem>,
+    /// Whether the files are written to the disk, which applying a config requires.
+    on_disk: bool,
+}
+
+impl Configurator {
+    pub fn new(options: ConfiguratorOptions) -> Self {
+        Configurator {
+            options,
+            filesystem: Box::new(Disk),
+            on_disk: true,
+        }
+    }
+
+    /// Write the generated files via the given filesystem instead of the disk.
+    pub fn with_filesystem(mut self, filesystem: impl FileSystem + 'static) -> Self {
+        self.filesystem = Box::new(filesystem);
+        self.on_disk = false;
+        self
+    }
+
+    /// Generate the config dir of the desired states in `config_dir` into `output_dir`, like `nmc generate`.
+    pub fn generate(&self, config_dir: &str, output_dir: &str) -> Result<(), anyhow::Error> {
+        let options = GenerateOptions {
+            expand_env: self.options.expand_env,
+            ..GenerateOptions::default()
+        };
+
+        generate(config_dir, output_dir, &options, self.filesystem.as_ref())
+    }
+
+    /// Identify which host of the generated `config_dir` the collected NICs belong to, without touching the machine.
+    pub fn identify(
+        &self,
+        config_dir: &str,
+        collector: &dyn NicCollector,
+    ) -> Result<Identification, anyhow::Error> {
+        let matching = MatchOptions {
+            by_name: self.options.match_by_name,
+            ..MatchOptions::default()
+        };
+        let hosts =
+            parse_config(config_dir, matching.allow_shared_macs).context("Parsing config")?;
+        let nics: Vec<NetworkInterface> = collector
+            .collect()
+            .context("Collecting NICs")?
+            .into_iter()
+            .map(|nic| NetworkInterface {
+                name: nic.name,
+                mac_addr: nic.mac_address.map(|mac| normalize_address(&mac)),
+                addr: vec![],
+                index: 0,
+            })
+            .collect();
+
+        let identity = load_identity(self.options.identity_file.as_deref())?;
+        let host = find_host(hosts, &nics, identity.as_ref(), &matching)?;
+        let interface_names = detect_local_interfaces(&host, nics).into_iter().collect();
+
+        Ok(Identification {
+            hostname: host.hostname,
+            interface_names,
+        })
+    }
+
+    /// Apply the generated `config_dir` to the machine running the process, like `nmc apply`.
+    ///
+    /// The host is always identified by the local NICs, since the files configure this machine. For the same
+    /// reason, it fails if the files are written via `with_filesystem`: besides storing them, it serializes
+    /// concurrent runs via a lock file and activates the config via NetworkManager on this machine.
+    pub fn apply(&self, config_dir: &str) -> Result<(), anyhow::Error> {
+        if !self.on_disk {
+            return Err(anyhow!(
+                "Applying a config is only supported on disk, it configures the machine running the process"
+            ));
+        }
+
+        let options = ApplyOptions {
+            expand_env: self.options.expand_env,
+            identity_file: self.options.identity_file.clone(),
+            matching: MatchOptions {
+                by_name: self.options.match_by_name,
+                ..MatchOptions::default()
+            },
+            ..ApplyOptions::default()
+        };
+
+        apply(config_dir, &options, self.filesystem.as_ref())?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::{BTreeMap, HashSet};
+    use std::fs;
+    use std::path::Path;
+
+    use crate::configurator::{
+        marshal_hosts, Configurator, ConfiguratorOptions, Host, HostBuilder, Identification,
+        InterfaceBuilder, Memory, Nic, NicCollector,
+    };
+
+    struct FakeNics(Vec<Nic>);
+
+    impl NicCollector for FakeNics {
+        fn collect(&self) -> Result<Vec<Nic>, anyhow::Error> {
+            Ok(self.0.clone())
+        }
+    }
+
+    #[test]
+    fn identify_collected_nics() {
+        let config_dir = "_configurator_identify";
+        fs::create_dir_all(config_dir).unwrap();
+        // JSON is valid YAML
+        fs::write(
+            Path::new(config_dir).join("host_config.yaml"),
+            r#"[
+                {"hostname": "node1", "interfaces": [
+                    {"logical_name": "eth0", "mac_address": "00:11:22:33:44:55", "interface_type": "ethernet"}]},
+                {"hostname": "node2", "interfaces": [
+                    {"logical_name": "eth0", "mac_address": "00:11:22:33:44:66", "interface_type": "ethernet"}]}
+            ]"#,
+        )
+        .unwrap();
+
+        let configurator = Configurator::new(ConfiguratorOptions::default());
+        let nics = FakeNics(vec![Nic::new(
+            "ens1f0",
+            Some("00:11:22:33:44:66".to_string()),
+        )]);
+        assert_eq!(
+            configurator.identify(config_dir, &nics).unwrap(),
+            Identification::new(
+                "node2",
+                BTreeMap::from([("eth0".to_string(), "ens1f0".to_string())])
+            )
+        );
+
+        let nics = FakeNics(vec![Nic::new(
+            "eth0",
+            Some("00:11:22:33:44:77".to_string()),
+        )]);
+        assert_eq!(
+            configurator
+                .identify(config_dir, &nics)
+                .unwrap_err()
+                .to_string(),
+            "None of the preconfigured hosts match local NICs"
+        );
+
+        // cleanup
+        fs::remove_dir_all(config_dir).unwrap();
+    }
+
+    #[test]
+    fn build_options() {
+        let options = ConfiguratorOptions::default()
+            .expand_env(true)
+            .identity_file("/etc/nmc/identity")
+            .match_by_name(true);
+
+        assert!(options.expand_env);
+        assert_eq!(options.identity_file.as_deref(), Some("/etc/nmc/identity"));
+        assert!(options.match_by_name);
+    }
+
+    #[test]
+    fn apply_only_on_disk() {
+        let configurator =
+            Configurator::new(ConfiguratorOptions::default()).with_filesystem(Memory::default());
+
+        assert_eq!(
+            configurator.apply("<missing>").unwrap_err().to_string(),
+            "Applying a config is only supported on disk, it configures the machine running the process"
+        );
+    }
+
+    #[test]
+    fn build_hosts() {
+        let node1 = HostBuilder::new("node1")
+            .label("site", "berlin")
+            .interface(
+                InterfaceBuilder::new("eth0", "ethernet")
+                    .mac_address("00:11:22:33:44:AA")
+                    .management(true)
+                    .description("uplink to sw-03 port 12")
+                    .build()
+                    .unwrap(),
+            )
+            .interface(InterfaceBuilder::new("bond0", "bond").build().unwrap())
+            .build()
+            .unwrap();
+        let node2 = HostBuilder::new("node2")
+            .interface(
+                InterfaceBuilder::new("eth0", "ethernet")
+                    .mac_address("00:11:22:33:44:bb")
+                    .build()
+                    .unwrap(),
+            )
+            .build()
+            .unwrap();
+
+        let mapping = marshal_hosts(&[node1, node2]).unwrap();
+        let hosts: Vec<Host> = serde_yaml::from_str(&mapping).unwrap();
+        assert_eq!(hosts.len(), 2);
+        assert_eq!(hosts[0].labels["site"], "berlin");
+        assert_eq!(
+            hosts[0].interfaces[0].mac_address.as_deref(),
+            Some("00:11:22:33:44:aa")
+        );
+        assert!(hosts[0].interfaces[0].management);
+        assert_eq!(hosts[0].interfaces[1].mac_address, None);
+        assert_eq!(hosts[1].hostname, "node2");
+    }
+
+    #[test]
+    fn build_invalid_hosts() {
+        let eth0 = |mac: &str| {
+            InterfaceBuilder::new("eth0", "ethernet")
+                .mac_address(mac)
+                .build()
+                .unwrap()
+        };
+
+        assert_eq!(
+            InterfaceBuilder::new("eth0", "ethernet")
+                .build()
+                .unwrap_err()
+                .to_string(),
+            "Ethernet or InfiniBand interface 'eth0' has no MAC address"
+        );
+        assert_eq!(
+            InterfaceBuilder::new("eth0", "ethernet")
+                .mac_address("00:11:22:33:44")
+                .build()
+                .unwrap_err()
+                .to_string(),
+            "Invalid MAC address '00:11:22:33:44' of interface 'eth0'"
+        );
+        assert!(InterfaceBuilder::new("eth/0", "bond").build().is_err());
+        assert_eq!(
+            HostBuilder::new("-node1").build().unwrap_err().to_string(),
+            "Invalid hostname '-node1'"
+        );
+        assert_eq!(
+            HostBuilder::new("node1")
+                .label("site", "berlin mitte")
+                .build()
+                .unwrap_err()
+                .to_string(),
+            "Invalid label 'site: berlin mitte' of host 'node1'"
+        );
+        assert_eq!(
+            HostBuilder::new("node1")
+                .interface(eth0("00:11:22:33:44:55"))
+                .interface(eth0("00:11:22:33:44:66"))
+                .build()
+                .unwrap_err()
+                .to_string(),
+            "Interface 'eth0' is declared more than once by host 'node1'"
+        );
+
+        let host = |hostname: &str, mac: &str| {
+            HostBuilder::new(hostname)
+                .interface(eth0(mac))
+                .build()
+                .unwrap()
+        };
+        assert_eq!(
+            marshal_hosts(&[
+                host("node1", "00:11:22:33:44:55"),
+                host("node1", "00:11:22:33:44:66")
+            ])
+            .unwrap_err()
+            .to_string(),
+            "Host 'node1' is declared more than once"
+        );
+        assert_eq!(
+            marshal_hosts(&[
+                host("node1", "00:11:22:33:44:55"),
+                host("node2", "00:11:22:33:44:55")
+            ])
+            .unwrap_err()
+            .to_string(),
+            "MAC addresses are assigned to several hosts: 00:11:22:33:44:55 (node1, node2)"
+        );
+    }
+}
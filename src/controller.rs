@@ -0,0 +1,449 @@
+use std::collections::BTreeMap;
+use std::ffi::CString;
+use std::fs;
+use std::io::{self, Read};
+use std::os::unix::ffi::OsStrExt;
+use std::path::{Path, PathBuf};
+use std::process::{Child, Command, Stdio};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError, Sender};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Context};
+use log::{error, info, warn};
+use serde::de::IgnoredAny;
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+
+use crate::filenames::validate_hostname;
+use crate::filesystem::Disk;
+use crate::generate_conf::{generate, GenerateOptions};
+
+/// Custom resource describing the network of a node.
+const RESOURCE: &str = "nodenetworkconfigs.nm-configurator.suse.com";
+/// Delay of restarting a watch which ended, e.g. since the API server closed it or kubectl failed.
+const WATCH_RETRY_DELAY: Duration = Duration::from_secs(5);
+
+/// Options of the controller generating the configs from the `NodeNetworkConfig` resources of a cluster.
+pub(crate) struct ControllerOptions {
+    /// Namespace of the resources, all namespaces if not set.
+    pub(crate) namespace: Option<String>,
+    /// Interval of listing all resources regardless of the changes reported by the watch.
+    pub(crate) interval: Duration,
+}
+
+#[derive(Deserialize)]
+struct ResourceList {
+    items: Vec<Resource>,
+}
+
+#[derive(Deserialize)]
+struct Resource {
+    metadata: Metadata,
+    spec: Spec,
+}
+
+#[derive(Deserialize)]
+struct Metadata {
+    name: String,
+    #[serde(default)]
+    namespace: Option<String>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Spec {
+    /// Hostname of the node, the name of the resource if not set.
+    #[serde(default)]
+    hostname: Option<String>,
+    /// nmstate desired state of the node. Its interfaces with a `mac-address` identify the node.
+    desired_state: serde_json::Value,
+}
+
+/// Keep the configs in `output_dir` in sync with the `NodeNetworkConfig` resources of the cluster.
+///
+/// The resources are watched via `kubectl`, using its usual means of locating the cluster (e.g. `KUBECONFIG`
+/// or the service account of the pod), and listed whenever the watch reports a change as well as in the given
+/// interval, in case the watch missed one. Whenever they change, the configs are generated into a staging dir
+/// which is then atomically swapped with the output dir, so that nodes fetching their config (e.g. via `nmc serve`)
+/// never see a partially generated one. A failed generation is logged and leaves the
+/// previous configs in place.
+pub(crate) fn run_controller(
+    output_dir: &str,
+    options: &ControllerOptions,
+) -> Result<(), anyhow::Error> {
+    info!(
+        "Watching {RESOURCE} resources, resyncing every {}s",
+        options.interval.as_secs()
+    );
+
+    let mut generated: Option<String> = None;
+    loop {
+        sync(output_dir, options, &mut generated);
+
+        let watch = match Watch::start(options.namespace.as_deref()) {
+            Ok(watch) => watch,
+            Err(err) => {
+                error!("Watching {RESOURCE} resources failed: {err:#}");
+                thread::sleep(options.interval);
+                continue;
+            }
+        };
+
+        let resync_at = Instant::now() + options.interval;
+        loop {
+            match watch
+                .events
+                .recv_timeout(resync_at.saturating_duration_since(Instant::now()))
+            {
+                Ok(()) => {
+                    // A burst of changes is listed once.
+                    while watch.events.try_recv().is_ok() {}
+                    sync(output_dir, options, &mut generated);
+                }
+                Err(RecvTimeoutError::Timeout) => break,
+                Err(RecvTimeoutError::Disconnected) => {
+                    warn!("Watch of {RESOURCE} resources ended, restarting it");
+                    thread::sleep(WATCH_RETRY_DELAY);
+                    break;
+                }
+            }
+        }
+    }
+}
+
+/// Reconcile the resources, logging a failure since the controller keeps running.
+fn sync(output_dir: &str, options: &ControllerOptions, generated: &mut Option<String>) {
+    match reconcile(output_dir, options, generated.as_deref()) {
+        Ok(digest) => *generated = Some(digest),
+        Err(err) => error!("Reconciling {RESOURCE} resources failed: {err:#}"),
+    }
+}
+
+/// `kubectl get --watch` reporting each change of the resources, killed when dropped.
+struct Watch {
+    child: Child,
+    events: Receiver<()>,
+}
+
+impl Watch {
+    fn start(namespace: Option<&str>) -> Result<Self, anyhow::Error> {
+        let mut child = kubectl(namespace)
+            .args(["--watch-only", "--output", "json"])
+            .stdout(Stdio::piped())
+            .spawn()
+            .context("Running kubectl")?;
+        let stdout = child
+            .stdout
+            .take()
+            .ok_or_else(|| anyhow!("Reading kubectl output"))?;
+
+        let (sender, events) = mpsc::channel();
+        thread::spawn(move || watch_events(stdout, &sender));
+
+        Ok(Watch { child, events })
+    }
+}
+
+impl Drop for Watch {
+    fn drop(&mut self) {
+        let _ = self.child.kill();
+        let _ = self.child.wait();
+    }
+}
+
+/// Send an event for each of the JSON objects printed by the watch, until it ends or the receiver is gone.
+/// Only the occurrence of a change matters, since the resources are listed as a whole anyway.
+fn watch_events(output: impl Read, events: &Sender<()>) {
+    for object in serde_json::Deserializer::from_reader(output).into_iter::<IgnoredAny>() {
+        if object.is_err() || events.send(()).is_err() {
+            return;
+        }
+    }
+}
+
+/// Generate the configs if the resources differ from the ones last generated, returning their digest.
+fn reconcile(
+    output_dir: &str,
+    options: &ControllerOptions,
+    generated: Option<&str>,
+) -> Result<String, anyhow::Error> {
+    let resources = list_resources(options.namespace.as_deref())?;
+    let states = desired_states(&resources)?;
+    let digest = digest(&states);
+
+    if generated == Some(digest.as_str()) {
+        return Ok(digest);
+    }
+
+    info!("Generating configs of {} node(s)", states.len());
+    publish(output_dir, &states)?;
+    info!("Successfully generated configs in {output_dir:?}");
+
+    Ok(digest)
+}
+
+/// Returns `kubectl get` of the resources in the namespace, or in all namespaces if not set.
+fn kubectl(namespace: Option<&str>) -> Command {
+    let mut command = Command::new("kubectl");
+    command.args(["get", RESOURCE]);
+    match namespace {
+        Some(namespace) => command.args(["--namespace", namespace]),
+        None => command.arg("--all-namespaces"),
+    };
+    command
+}
+
+fn list_resources(namespace: Option<&str>) -> Result<ResourceList, anyhow::Error> {
+    let output = kubectl(namespace)
+        .args(["--output", "json"])
+        .output()
+        .context("Running kubectl")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "kubectl exited with {}: {}",
+            output.status,
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+
+    serde_json::from_slice(&output.stdout).context("Parsing resources")
+}
+
+/// Returns the desired states of the nodes by their file names in the config dir of `generate`.
+fn desired_states(resources: &ResourceList) -> Result<BTreeMap<String, String>, anyhow::Error> {
+    let mut states = BTreeMap::new();
+    let mut owners: BTreeMap<String, String> = BTreeMap::new();
+
+    for resource in &resources.items {
+        let owner = match &resource.metadata.namespace {
+            Some(namespace) => format!("{namespace}/{}", resource.metadata.name),
+            None => resource.metadata.name.clone(),
+        };
+        let hostname = resource
+            .spec
+            .hostname
+            .as_deref()
+            .unwrap_or(&resource.metadata.name);
+
+        validate_hostname(hostname).map_err(|err| anyhow!("{err} of {owner}"))?;
+
+        if let Some(other) = owners.insert(hostname.to_string(), owner.clone()) {
+            return Err(anyhow!(
+                "Hostname '{hostname}' is used by both {other} and {owner}"
+            ));
+        }
+
+        // JSON is valid YAML, so the embedded state is passed on as it is.
+        let state = serde_json::to_string_pretty(&resource.spec.desired_state)
+            .with_context(|| format!("Serializing desired state of {owner}"))?;
+        states.insert(format!("{hostname}.yaml"), state);
+    }
+
+    Ok(states)
+}
+
+fn digest(states: &BTreeMap<String, String>) -> String {
+    let mut hasher = Sha256::new();
+    for (name, state) in states {
+        for data in [name.as_bytes(), state.as_bytes()] {
+            hasher.update((data.len() as u64).to_le_bytes());
+            hasher.update(data);
+        }
+    }
+
+    hasher
+        .finalize()
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect()
+}
+
+/// Generate the configs of the desired states into a staging dir next to `output_dir` and swap them into place.
+fn publish(output_dir: &str, states: &BTreeMap<String, String>) -> Result<(), anyhow::Error> {
+    let output_dir = Path::new(output_dir);
+    let staging_dir = sibling(output_dir, "staging")?;
+
+    remove_dir(&staging_dir)?;
+
+    let config_dir = staging_dir.join("config");
+    let generated_dir = staging_dir.join("generated");
+    fs::create_dir_all(&config_dir).context("Creating staging dir")?;
+
+    for (name, state) in states {
+        fs::write(config_dir.join(name), state).context("Writing desired state")?;
+    }
+
+    // Without any resources there is nothing left to serve.
+    if states.is_empty() {
+        fs::create_dir_all(&generated_dir).context("Creating staging dir")?;
+    } else {
+        generate(
+            &config_dir.to_string_lossy(),
+            &generated_dir.to_string_lossy(),
+            &GenerateOptions::default(),
+            &Disk,
+        )?;
+    }
+
+    // The previous configs end up in the staging dir, removed along with it.
+    exchange(&generated_dir, output_dir).context("Moving generated configs")?;
+    remove_dir(&staging_dir)
+}
+
+/// Atomically swap the dirs, so that there is no moment in which `dir` does not exist, e.g. for concurrent
+/// requests of `nmc serve`. A missing `dir` is created by moving `new_dir` into place.
+fn exchange(new_dir: &Path, dir: &Path) -> io::Result<()> {
+    if !dir.exists() {
+        return fs::rename(new_dir, dir);
+    }
+
+    let new_dir = CString::new(new_dir.as_os_str().as_bytes())?;
+    let dir = CString::new(dir.as_os_str().as_bytes())?;
+    let result = unsafe {
+        libc::renameat2(
+            libc::AT_FDCWD,
+            new_dir.as_ptr(),
+            libc::AT_FDCWD,
+            dir.as_ptr(),
+            libc::RENAME_EXCHANGE,
+        )
+    };
+    if result != 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    Ok(())
+}
+
+/// Returns a hidden dir next to `dir`, on the same filesystem so that it can be renamed into place.
+fn sibling(dir: &Path, suffix: &str) -> Result<PathBuf, anyhow::Error> {
+    let name = dir
+        .file_name()
+        .and_then(|name| name.to_str())
+        .ok_or_else(|| anyhow!("Invalid output dir {dir:?}"))?;
+
+    Ok(dir.with_file_name(format!(".{name}.{suffix}")))
+}
+
+fn remove_dir(dir: &Path) -> Result<(), anyhow::Error> {
+    match fs::remove_dir_all(dir) {
+        Ok(..) => Ok(()),
+        Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(()),
+        Err(err) => Err(err).with_context(|| format!("Removing {dir:?}")),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::io::Cursor;
+    use std::path::Path;
+    use std::sync::mpsc;
+
+    use crate::controller::{
+        desired_states, digest, exchange, publish, sibling, watch_events, ResourceList,
+    };
+
+    fn resources(json: &str) -> ResourceList {
+        serde_json::from_str(json).unwrap()
+    }
+
+    #[test]
+    fn desired_states_of_resources() {
+        let list = resources(
+            r#"{"items": [
+                {"metadata": {"name": "node1", "namespace": "infra"},
+                 "spec": {"desiredState": {"interfaces": [{"name": "eth0", "mac-address": "00:11:22:33:44:55"}]}}},
+                {"metadata": {"name": "gateway", "namespace": "infra"},
+                 "spec": {"hostname": "node2", "desiredState": {"interfaces": []}}}
+            ]}"#,
+        );
+
+        let states = desired_states(&list).unwrap();
+        assert_eq!(
+            states.keys().collect::<Vec<_>>(),
+            vec!["node1.yaml", "node2.yaml"]
+        );
+        assert!(states["node1.yaml"].contains("\"mac-address\": \"00:11:22:33:44:55\""));
+        assert_eq!(digest(&states), digest(&states.clone()));
+
+        let list = resources(
+            r#"{"items": [
+                {"metadata": {"name": "node1", "namespace": "a"}, "spec": {"desiredState": {}}},
+                {"metadata": {"name": "other", "namespace": "b"}, "spec": {"hostname": "node1", "desiredState": {}}}
+            ]}"#,
+        );
+        assert_eq!(
+            desired_states(&list).unwrap_err().to_string(),
+            "Hostname 'node1' is used by both a/node1 and b/other"
+        );
+
+        let list = resources(
+            r#"{"items": [{"metadata": {"name": "node1"}, "spec": {"hostname": "../etc", "desiredState": {}}}]}"#,
+        );
+        assert_eq!(
+            desired_states(&list).unwrap_err().to_string(),
+            "Invalid hostname '../etc' of node1"
+        );
+
+        let list = resources(
+            r#"{"items": [{"metadata": {"name": "node1"}, "spec": {"hostname": "-node1", "desiredState": {}}}]}"#,
+        );
+        assert_eq!(
+            desired_states(&list).unwrap_err().to_string(),
+            "Invalid hostname '-node1' of node1"
+        );
+    }
+
+    #[test]
+    fn report_watch_events() {
+        let (sender, events) = mpsc::channel();
+        // kubectl prints the changed resources as indented JSON objects one after the other
+        let output = "{\n  \"metadata\": {\"name\": \"node1\"}\n}\n{\"metadata\": {\"name\": \"node2\"}}\n{\"trunc";
+
+        watch_events(Cursor::new(output), &sender);
+        assert_eq!(events.try_iter().count(), 2);
+    }
+
+    #[test]
+    fn publish_replaces_output_dir() {
+        let output_dir = Path::new("_controller_out");
+        fs::create_dir_all(output_dir).unwrap();
+        fs::write(output_dir.join("stale"), "").unwrap();
+
+        publish("_controller_out", &BTreeMap::new()).unwrap();
+
+        assert!(output_dir.is_dir());
+        assert!(!output_dir.join("stale").exists());
+        assert!(!sibling(output_dir, "staging").unwrap().exists());
+
+        // cleanup
+        fs::remove_dir_all(output_dir).unwrap();
+    }
+
+    #[test]
+    fn exchange_dirs() {
+        let dir = Path::new("_controller_exchange");
+        let new_dir = dir.join("new");
+        let output_dir = dir.join("out");
+        fs::create_dir_all(&new_dir).unwrap();
+        fs::write(new_dir.join("node1"), "").unwrap();
+
+        exchange(&new_dir, &output_dir).unwrap();
+        assert!(output_dir.join("node1").exists());
+        assert!(!new_dir.exists());
+
+        fs::create_dir_all(&new_dir).unwrap();
+        fs::write(new_dir.join("node2"), "").unwrap();
+
+        exchange(&new_dir, &output_dir).unwrap();
+        assert!(output_dir.join("node2").exists());
+        assert!(!output_dir.join("node1").exists());
+        assert!(new_dir.join("node1").exists());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
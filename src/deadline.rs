@@ -0,0 +1,284 @@
+use std::fmt;
+use std::io::Read;
+use std::process::{Child, Command, ExitStatus, Output, Stdio};
+use std::sync::{Mutex, MutexGuard, OnceLock, PoisonError, TryLockError};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::Context;
+use log::error;
+
+use crate::exit_code::TIMED_OUT;
+
+/// Time granted to an operation past the deadline to fail on its own (e.g. running its on-failure hooks and
+/// writing its metrics) before the watchdog exits the process.
+const GRACE_PERIOD: Duration = Duration::from_secs(5);
+/// Time granted to an uninterruptible operation still running once the grace period passed. Should it block
+/// beyond that (e.g. on a hung filesystem), the watchdog exits the process anyway.
+const UNINTERRUPTIBLE_GRACE_PERIOD: Duration = Duration::from_secs(30);
+/// Interval of checking whether a command bounded by the deadline exited.
+const POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// Deadline of the run, set via the global `--timeout`.
+static DEADLINE: OnceLock<Deadline> = OnceLock::new();
+/// Held while the run must not be exited by the watchdog, e.g. while storing the files of the host.
+static UNINTERRUPTIBLE: Mutex<()> = Mutex::new(());
+
+/// Error returned when the run exceeds its deadline.
+#[derive(Debug)]
+pub(crate) struct TimedOut(pub(crate) Duration);
+
+impl fmt::Display for TimedOut {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Timed out after {}s", self.0.as_secs())
+    }
+}
+
+impl std::error::Error for TimedOut {}
+
+#[derive(Clone, Copy, Debug)]
+struct Deadline {
+    at: Instant,
+    timeout: Duration,
+}
+
+impl Deadline {
+    fn new(timeout: Duration, now: Instant) -> Self {
+        Deadline {
+            at: now + timeout,
+            timeout,
+        }
+    }
+
+    fn remaining(&self, now: Instant) -> Duration {
+        self.at.saturating_duration_since(now)
+    }
+
+    fn check(&self, now: Instant) -> Result<(), TimedOut> {
+        if now >= self.at {
+            return Err(TimedOut(self.timeout));
+        }
+
+        Ok(())
+    }
+}
+
+/// Bound the run to `timeout`, so that an unresponsive config server or NetworkManager can't hang the boot.
+///
+/// Operations check the deadline between their steps and bound the external commands they run by the
+/// remaining time. Should one of them block regardless (e.g. on a hung filesystem), a watchdog exits the
+/// process once the grace period after the deadline passed, unless the run is [`uninterruptible`].
+pub(crate) fn start(timeout: Duration) {
+    let deadline = Deadline::new(timeout, Instant::now());
+    if DEADLINE.set(deadline).is_err() {
+        return;
+    }
+
+    thread::spawn(move || {
+        thread::sleep(timeout + GRACE_PERIOD);
+        let uninterruptible = try_lock_within(&UNINTERRUPTIBLE, UNINTERRUPTIBLE_GRACE_PERIOD);
+        if uninterruptible.is_none() {
+            error!(
+                "Uninterruptible operation still running after {}s",
+                UNINTERRUPTIBLE_GRACE_PERIOD.as_secs()
+            );
+        }
+        error!("{}, exiting", TimedOut(timeout));
+        std::process::exit(TIMED_OUT);
+    });
+}
+
+/// Lock the mutex unless it stays locked for longer than `timeout`.
+fn try_lock_within(mutex: &Mutex<()>, timeout: Duration) -> Option<MutexGuard<'_, ()>> {
+    let started = Instant::now();
+
+    loop {
+        match mutex.try_lock() {
+            Ok(guard) => return Some(guard),
+            Err(TryLockError::Poisoned(err)) => return Some(err.into_inner()),
+            Err(TryLockError::WouldBlock) if started.elapsed() >= timeout => return None,
+            Err(TryLockError::WouldBlock) => thread::sleep(POLL_INTERVAL),
+        }
+    }
+}
+
+/// Keep the watchdog from exiting the process until the returned guard is dropped, so that e.g. files are
+/// never left half stored.
+pub(crate) fn uninterruptible() -> MutexGuard<'static, ()> {
+    UNINTERRUPTIBLE
+        .lock()
+        .unwrap_or_else(PoisonError::into_inner)
+}
+
+/// Fail if the deadline passed. Without a deadline, the run never times out.
+pub(crate) fn check() -> Result<(), TimedOut> {
+    match DEADLINE.get() {
+        Some(deadline) => deadline.check(Instant::now()),
+        None => Ok(()),
+    }
+}
+
+/// Returns the whole seconds left until the deadline for bounding external commands (e.g. `curl --max-time`),
+/// at least one since most of them treat zero as no limit. `None` without a deadline.
+pub(crate) fn remaining_secs() -> Option<u64> {
+    DEADLINE
+        .get()
+        .map(|deadline| deadline.remaining(Instant::now()).as_secs().max(1))
+}
+
+/// Run the command to completion, killing it once the deadline passes.
+pub(crate) fn status(command: &mut Command) -> Result<ExitStatus, anyhow::Error> {
+    let Some(deadline) = DEADLINE.get() else {
+        return Ok(command.status()?);
+    };
+
+    wait(command, deadline)
+}
+
+/// Run the command to completion collecting its output, killing it once the deadline passes.
+pub(crate) fn output(command: &mut Command) -> Result<Output, anyhow::Error> {
+    let Some(deadline) = DEADLINE.get() else {
+        return Ok(command.output()?);
+    };
+
+    collect(command, deadline)
+}
+
+fn wait(command: &mut Command, deadline: &Deadline) -> Result<ExitStatus, anyhow::Error> {
+    deadline.check(Instant::now())?;
+
+    wait_child(command.spawn()?, deadline)
+}
+
+fn collect(command: &mut Command, deadline: &Deadline) -> Result<Output, anyhow::Error> {
+    deadline.check(Instant::now())?;
+
+    let mut child = command
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+    // Read while waiting, since a command filling the pipes would never exit otherwise.
+    let stdout = read_to_end(child.stdout.take());
+    let stderr = read_to_end(child.stderr.take());
+
+    let status = wait_child(child, deadline)?;
+
+    Ok(Output {
+        status,
+        stdout: stdout.join().unwrap_or_default(),
+        stderr: stderr.join().unwrap_or_default(),
+    })
+}
+
+fn read_to_end(pipe: Option<impl Read + Send + 'static>) -> thread::JoinHandle<Vec<u8>> {
+    thread::spawn(move || {
+        let mut buf = Vec::new();
+        if let Some(mut pipe) = pipe {
+            // A partial read is returned as it is, like the output of a killed command.
+            let _ = pipe.read_to_end(&mut buf);
+        }
+        buf
+    })
+}
+
+fn wait_child(mut child: Child, deadline: &Deadline) -> Result<ExitStatus, anyhow::Error> {
+    loop {
+        if let Some(status) = child.try_wait()? {
+            return Ok(status);
+        }
+
+        if let Err(err) = deadline.check(Instant::now()) {
+            child.kill().context("Killing command")?;
+            child.wait()?;
+            return Err(err.into());
+        }
+
+        thread::sleep(POLL_INTERVAL.min(deadline.remaining(Instant::now())));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::process::Command;
+    use std::sync::{mpsc, Mutex};
+    use std::thread;
+    use std::time::{Duration, Instant};
+
+    use crate::deadline::{collect, try_lock_within, wait, Deadline, TimedOut};
+
+    #[test]
+    fn check_deadline() {
+        let now = Instant::now();
+        let deadline = Deadline::new(Duration::from_secs(30), now);
+
+        assert!(deadline.check(now).is_ok());
+        assert_eq!(deadline.remaining(now), Duration::from_secs(30));
+
+        let later = now + Duration::from_secs(30);
+        assert_eq!(
+            deadline.check(later).unwrap_err().to_string(),
+            "Timed out after 30s"
+        );
+        assert_eq!(deadline.remaining(later), Duration::ZERO);
+    }
+
+    #[test]
+    fn lock_uninterruptible_within_timeout() {
+        let mutex = Mutex::new(());
+        assert!(try_lock_within(&mutex, Duration::ZERO).is_some());
+
+        let (locked_tx, locked_rx) = mpsc::channel();
+        let (unlock_tx, unlock_rx) = mpsc::channel::<()>();
+        thread::scope(|scope| {
+            let mutex = &mutex;
+            scope.spawn(move || {
+                let _guard = mutex.lock().unwrap();
+                locked_tx.send(()).unwrap();
+                unlock_rx.recv().unwrap();
+            });
+            locked_rx.recv().unwrap();
+
+            let started = Instant::now();
+            assert!(try_lock_within(mutex, Duration::from_millis(100)).is_none());
+            assert!(started.elapsed() >= Duration::from_millis(100));
+
+            // Locked once the operation finishes within the timeout
+            unlock_tx.send(()).unwrap();
+            assert!(try_lock_within(mutex, Duration::from_secs(10)).is_some());
+        });
+    }
+
+    #[test]
+    fn wait_for_command() {
+        let deadline = Deadline::new(Duration::from_secs(10), Instant::now());
+        assert!(wait(&mut Command::new("true"), &deadline)
+            .unwrap()
+            .success());
+
+        let deadline = Deadline::new(Duration::from_millis(100), Instant::now());
+        let started = Instant::now();
+        let err = wait(Command::new("sleep").arg("10"), &deadline).unwrap_err();
+        assert!(err.is::<TimedOut>());
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+
+    #[test]
+    fn collect_output_of_command() {
+        let deadline = Deadline::new(Duration::from_secs(10), Instant::now());
+        let output = collect(
+            Command::new("sh").args(["-c", "echo 1.44.2; echo warning >&2"]),
+            &deadline,
+        )
+        .unwrap();
+        assert!(output.status.success());
+        assert_eq!(output.stdout, b"1.44.2\n");
+        assert_eq!(output.stderr, b"warning\n");
+
+        let deadline = Deadline::new(Duration::from_millis(100), Instant::now());
+        let started = Instant::now();
+        let err = collect(Command::new("sleep").arg("10"), &deadline).unwrap_err();
+        assert!(err.is::<TimedOut>());
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+}
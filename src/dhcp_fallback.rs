@@ -0,0 +1,137 @@
+use log::info;
+use network_interface::NetworkInterface;
+
+use crate::apply_conf::ConnectionFile;
+use crate::keyfile::{derive_uuid, Keyfile};
+use crate::types::{interface_of, Host};
+
+/// Prefix of the IDs and file names of the fallback profiles, telling them apart from the configured ones.
+const FALLBACK_PREFIX: &str = "nmc-dhcp-";
+
+/// Lowest autoconnect priority accepted by NetworkManager, so that any other profile of the NIC is preferred.
+const FALLBACK_PRIORITY: &str = "-999";
+
+/// User data key marking the profiles generated by NMC rather than shipped in the config.
+const OWNER_KEY: &str = "nm-configurator.generated";
+
+/// Returns DHCP profiles for the local NICs which are not covered by the host's profiles, e.g. freshly attached ones,
+/// so that they still get connectivity for remote troubleshooting.
+///
+/// A NIC is covered if any of the connection files refers to it or the host config declares its MAC address.
+/// The profiles have the lowest priority and are marked as generated by NMC.
+pub(crate) fn fallback_connection_files(
+    host: &Host,
+    nics: &[NetworkInterface],
+    connection_files: &[ConnectionFile],
+) -> Vec<ConnectionFile> {
+    let covered = |nic: &NetworkInterface| {
+        let declared = host
+            .interfaces
+            .iter()
+            .any(|interface| nic.mac_addr.is_some() && interface.mac_address == nic.mac_addr);
+
+        declared
+            || connection_files.iter().any(|file| {
+                Keyfile::parse(&file.contents)
+                    .get("connection", "interface-name")
+                    .unwrap_or(interface_of(&file.name))
+                    == nic.name
+            })
+    };
+
+    nics.iter()
+        .filter(|nic| !covered(nic))
+        .map(|nic| {
+            info!(interface = nic.name.as_str(); "Adding DHCP fallback profile for uncovered NIC '{}'", nic.name);
+            fallback_connection_file(&nic.name)
+        })
+        .collect()
+}
+
+fn fallback_connection_file(interface: &str) -> ConnectionFile {
+    let name = format!("{FALLBACK_PREFIX}{interface}");
+
+    let mut keyfile = Keyfile::default();
+    keyfile.set("connection", "id", &name);
+    keyfile.set("connection", "uuid", &derive_uuid(&name));
+    keyfile.set("connection", "type", "ethernet");
+    keyfile.set("connection", "interface-name", interface);
+    keyfile.set("connection", "autoconnect-priority", FALLBACK_PRIORITY);
+    keyfile.set("ipv4", "method", "auto");
+    keyfile.set("ipv6", "method", "auto");
+    keyfile.set("user", OWNER_KEY, "dhcp-fallback");
+
+    ConnectionFile {
+        name,
+        contents: keyfile.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use network_interface::NetworkInterface;
+
+    use crate::apply_conf::ConnectionFile;
+    use crate::dhcp_fallback::fallback_connection_files;
+    use crate::keyfile::Keyfile;
+    use crate::types::{Host, Interface};
+
+    fn nic(name: &str, mac: &str) -> NetworkInterface {
+        NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        }
+    }
+
+    #[test]
+    fn add_fallback_profiles_for_uncovered_nics() {
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: Some("00:11:22:33:44:55".to_string()),
+                interface_type: "ethernet".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let nics = [
+            // Declared by the host, but renamed on the next boot
+            nic("ens1f0", "00:11:22:33:44:55"),
+            // Referred to by a common profile
+            nic("ens1f1", "00:11:22:33:44:56"),
+            nic("ens2f0", "00:11:22:33:44:57"),
+        ];
+        let connection_files = [ConnectionFile {
+            name: "uplink".to_string(),
+            contents: "[connection]\nid=uplink\ninterface-name=ens1f1\n".to_string(),
+        }];
+
+        let files = fallback_connection_files(&host, &nics, &connection_files);
+        assert_eq!(files.len(), 1);
+        assert_eq!(files[0].name, "nmc-dhcp-ens2f0");
+
+        let keyfile = Keyfile::parse(&files[0].contents);
+        assert_eq!(keyfile.get("connection", "id"), Some("nmc-dhcp-ens2f0"));
+        assert_eq!(keyfile.get("connection", "interface-name"), Some("ens2f0"));
+        assert_eq!(
+            keyfile.get("connection", "autoconnect-priority"),
+            Some("-999")
+        );
+        assert_eq!(keyfile.get("ipv4", "method"), Some("auto"));
+        assert_eq!(
+            keyfile.get("user", "nm-configurator.generated"),
+            Some("dhcp-fallback")
+        );
+
+        // The UUID is stable across runs
+        assert_eq!(
+            files[0].contents,
+            fallback_connection_files(&host, &nics, &connection_files)[0].contents
+        );
+
+        assert!(fallback_connection_files(&host, &nics[..2], &connection_files).is_empty());
+    }
+}
@@ -0,0 +1,156 @@
+use std::collections::{BTreeMap, HashMap};
+use std::path::Path;
+
+use anyhow::Context;
+use log::warn;
+
+use crate::filesystem::FileSystem;
+use crate::types::Host;
+
+/// Prefix of the variables holding the local names of the interfaces, e.g. `NMC_IFACE_ETH0=enp3s0`.
+const VARIABLE_PREFIX: &str = "NMC_IFACE_";
+
+/// Variable holding the local name of the management interface.
+const MANAGEMENT_VARIABLE: &str = "NMC_IFACE_MANAGEMENT";
+
+/// Format the mapping of the preconfigured interface names to the local ones as a systemd `EnvironmentFile`,
+/// allowing other units (e.g. firewalls or the kubelet) to consume it without parsing the apply report.
+///
+/// Interfaces which are not renamed map to their preconfigured names.
+pub(crate) fn format_env_file(host: &Host, local_interfaces: &HashMap<String, String>) -> String {
+    let mut variables = BTreeMap::new();
+
+    for interface in &host.interfaces {
+        let local_name = local_interfaces
+            .get(&interface.logical_name)
+            .unwrap_or(&interface.logical_name);
+
+        let variable = format!(
+            "{VARIABLE_PREFIX}{}",
+            variable_name(&interface.logical_name)
+        );
+        if variable == MANAGEMENT_VARIABLE || variables.contains_key(&variable) {
+            warn!(
+                interface = interface.logical_name.as_str();
+                "Skipping interface '{}' in environment file, its variable {variable} is already taken",
+                interface.logical_name
+            );
+            continue;
+        }
+
+        variables.insert(variable, local_name.as_str());
+
+        if interface.management {
+            variables.insert(MANAGEMENT_VARIABLE.to_string(), local_name.as_str());
+        }
+    }
+
+    let mut contents = format!("# Interface names of host {}\n", host.hostname);
+    for (variable, value) in variables {
+        contents.push_str(&format!("{variable}={value}\n"));
+    }
+
+    contents
+}
+
+/// Write the environment file, replacing it atomically so that units never read a partial mapping.
+pub(crate) fn write_env_file(
+    filesystem: &dyn FileSystem,
+    path: &str,
+    contents: &str,
+) -> Result<(), anyhow::Error> {
+    if let Some(dir) = Path::new(path).parent() {
+        filesystem
+            .create_dir_all(dir)
+            .context("Creating environment file dir")?;
+    }
+
+    filesystem
+        .write(Path::new(path), contents.as_bytes(), 0o666)
+        .context("Replacing environment file")
+}
+
+/// Returns the interface name as a valid shell variable name, e.g. `ETH0_1365` for `eth0.1365`.
+fn variable_name(interface: &str) -> String {
+    interface
+        .chars()
+        .map(|c| match c {
+            'a'..='z' | 'A'..='Z' | '0'..='9' => c.to_ascii_uppercase(),
+            _ => '_',
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+    use std::fs;
+    use std::path::Path;
+
+    use crate::env_file::{format_env_file, variable_name, write_env_file};
+    use crate::filesystem::Disk;
+    use crate::types::{Host, Interface};
+
+    fn interface(logical_name: &str, interface_type: &str, management: bool) -> Interface {
+        Interface {
+            logical_name: logical_name.to_string(),
+            interface_type: interface_type.to_string(),
+            management,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn format_variable_names() {
+        assert_eq!(variable_name("eth0"), "ETH0");
+        assert_eq!(variable_name("eth0.1365"), "ETH0_1365");
+        assert_eq!(variable_name("br-ex"), "BR_EX");
+    }
+
+    #[test]
+    fn format_interface_mapping() {
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                interface("eth0", "ethernet", true),
+                interface("eth1", "ethernet", false),
+                interface("eth0.1365", "vlan", false),
+                // Collides with the VLAN
+                interface("eth0-1365", "vlan", false),
+                // Collides with the management alias
+                interface("management", "ethernet", false),
+            ],
+            ..Default::default()
+        };
+        let local_interfaces = HashMap::from([
+            ("eth0".to_string(), "enp3s0".to_string()),
+            ("eth0.1365".to_string(), "enp3s0.1365".to_string()),
+        ]);
+
+        assert_eq!(
+            format_env_file(&host, &local_interfaces),
+            "# Interface names of host node1\n\
+             NMC_IFACE_ETH0=enp3s0\n\
+             NMC_IFACE_ETH0_1365=enp3s0.1365\n\
+             NMC_IFACE_ETH1=eth1\n\
+             NMC_IFACE_MANAGEMENT=enp3s0\n"
+        );
+    }
+
+    #[test]
+    fn write_env_file_atomically() {
+        let dir = Path::new("_env_file");
+        let path = dir.join("nested").join("interfaces.env");
+
+        write_env_file(&Disk, path.to_str().unwrap(), "NMC_IFACE_ETH0=enp3s0\n").unwrap();
+
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "NMC_IFACE_ETH0=enp3s0\n"
+        );
+        assert_eq!(fs::read_dir(dir.join("nested")).unwrap().count(), 1);
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
@@ -0,0 +1,598 @@
+use std::collections::HashMap;
+use std::io;
+use std::os::fd::{AsRawFd, FromRawFd, OwnedFd};
+
+use anyhow::anyhow;
+
+use crate::keyfile::Keyfile;
+
+const SIOCETHTOOL: u32 = 0x8946;
+
+const ETHTOOL_GCOALESCE: u32 = 0x0e;
+const ETHTOOL_GRINGPARAM: u32 = 0x10;
+const ETHTOOL_GPAUSEPARAM: u32 = 0x12;
+const ETHTOOL_GSTRINGS: u32 = 0x1b;
+const ETHTOOL_GPERMADDR: u32 = 0x20;
+const ETHTOOL_GSSET_INFO: u32 = 0x37;
+const ETHTOOL_GFEATURES: u32 = 0x3a;
+
+const ETH_SS_FEATURES: u32 = 4;
+const ETH_GSTRING_LEN: usize = 32;
+const MAX_ADDR_LEN: usize = 32;
+
+/// Keyfile section containing the ethtool settings.
+pub(crate) const ETHTOOL_SECTION: &str = "ethtool";
+
+const FEATURE_PREFIX: &str = "feature-";
+
+/// Ring settings and their position in `struct ethtool_ringparam`.
+const RING_SETTINGS: [(&str, usize); 4] = [
+    ("ring-rx", 5),
+    ("ring-rx-mini", 6),
+    ("ring-rx-jumbo", 7),
+    ("ring-tx", 8),
+];
+const RING_PARAM_LEN: usize = 9;
+
+/// Pause settings and their position in `struct ethtool_pauseparam`.
+const PAUSE_SETTINGS: [(&str, usize); 3] = [("pause-autoneg", 1), ("pause-rx", 2), ("pause-tx", 3)];
+const PAUSE_PARAM_LEN: usize = 4;
+
+/// Coalesce settings and their position in `struct ethtool_coalesce`.
+const COALESCE_SETTINGS: [(&str, usize); 22] = [
+    ("coalesce-rx-usecs", 1),
+    ("coalesce-rx-frames", 2),
+    ("coalesce-rx-usecs-irq", 3),
+    ("coalesce-rx-frames-irq", 4),
+    ("coalesce-tx-usecs", 5),
+    ("coalesce-tx-frames", 6),
+    ("coalesce-tx-usecs-irq", 7),
+    ("coalesce-tx-frames-irq", 8),
+    ("coalesce-stats-block-usecs", 9),
+    ("coalesce-adaptive-rx", 10),
+    ("coalesce-adaptive-tx", 11),
+    ("coalesce-pkt-rate-low", 12),
+    ("coalesce-rx-usecs-low", 13),
+    ("coalesce-rx-frames-low", 14),
+    ("coalesce-tx-usecs-low", 15),
+    ("coalesce-tx-frames-low", 16),
+    ("coalesce-pkt-rate-high", 17),
+    ("coalesce-rx-usecs-high", 18),
+    ("coalesce-rx-frames-high", 19),
+    ("coalesce-tx-usecs-high", 20),
+    ("coalesce-tx-frames-high", 21),
+    ("coalesce-sample-interval", 22),
+];
+const COALESCE_PARAM_LEN: usize = 23;
+
+/// Features referred to by their legacy ethtool names, mapped to the kernel ones.
+/// All other features are named as in the kernel.
+const FEATURE_ALIASES: [(&str, &[&str]); 11] = [
+    ("gro", &["rx-gro"]),
+    ("gso", &["tx-generic-segmentation"]),
+    ("lro", &["rx-lro"]),
+    ("ntuple", &["rx-ntuple-filter"]),
+    ("rx", &["rx-checksum"]),
+    ("rxhash", &["rx-hashing"]),
+    ("rxvlan", &["rx-vlan-hw-parse"]),
+    ("sg", &["tx-scatter-gather", "tx-scatter-gather-fraglist"]),
+    (
+        "tso",
+        &[
+            "tx-tcp-segmentation",
+            "tx-tcp-ecn-segmentation",
+            "tx-tcp-mangleid-segmentation",
+            "tx-tcp6-segmentation",
+        ],
+    ),
+    (
+        "tx",
+        &[
+            "tx-checksum-ipv4",
+            "tx-checksum-ip-generic",
+            "tx-checksum-ipv6",
+            "tx-checksum-fcoe-crc",
+            "tx-checksum-sctp",
+        ],
+    ),
+    ("txvlan", &["tx-vlan-hw-insert"]),
+];
+
+/// State of an offload feature as reported by the kernel.
+#[derive(Debug, Clone, Copy)]
+#[cfg_attr(test, derive(PartialEq))]
+struct Feature {
+    changeable: bool,
+    active: bool,
+}
+
+/// Settings currently in effect for a link. Only the groups required for the verification are queried.
+#[derive(Default)]
+struct LinkSettings {
+    ring: Option<Result<Vec<u32>, String>>,
+    pause: Option<Result<Vec<u32>, String>>,
+    coalesce: Option<Result<Vec<u32>, String>>,
+    features: Option<Result<HashMap<String, Feature>, String>>,
+}
+
+/// Validate the names and values of the ethtool settings in the keyfile.
+pub(crate) fn validate_settings(keyfile: &Keyfile) -> Result<(), anyhow::Error> {
+    keyfile
+        .entries(ETHTOOL_SECTION)
+        .try_for_each(|(key, value)| parse_setting(key, value).map(|_| ()))
+}
+
+/// Compare the ethtool settings in the keyfile with the ones in effect for the given interface.
+/// Returns a description of every setting which differs.
+pub(crate) fn verify_settings(
+    interface: &str,
+    keyfile: &Keyfile,
+) -> Result<Vec<String>, anyhow::Error> {
+    let desired = keyfile
+        .entries(ETHTOOL_SECTION)
+        .map(|(key, value)| parse_setting(key, value).map(|value| (key, value)))
+        .collect::<Result<Vec<_>, _>>()?;
+
+    if desired.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let socket = EthtoolSocket::open()?;
+    let requires = |prefix: &str| desired.iter().any(|(key, _)| key.starts_with(prefix));
+    let query = |cmd, len| {
+        socket
+            .query_params(interface, cmd, len)
+            .map_err(|err| err.to_string())
+    };
+
+    let current = LinkSettings {
+        ring: requires("ring-").then(|| query(ETHTOOL_GRINGPARAM, RING_PARAM_LEN)),
+        pause: requires("pause-").then(|| query(ETHTOOL_GPAUSEPARAM, PAUSE_PARAM_LEN)),
+        coalesce: requires("coalesce-").then(|| query(ETHTOOL_GCOALESCE, COALESCE_PARAM_LEN)),
+        features: requires(FEATURE_PREFIX)
+            .then(|| socket.features(interface).map_err(|err| err.to_string())),
+    };
+
+    Ok(desired
+        .into_iter()
+        .filter_map(|(key, expected)| {
+            compare_setting(key, expected, &current).map(|mismatch| format!("{key}: {mismatch}"))
+        })
+        .collect())
+}
+
+/// Returns the permanent hardware address of the interface, which differs from the current
+/// one e.g. when the NIC is a port of a bond. Returns `None` if the driver does not report one.
+pub(crate) fn permanent_address(interface: &str) -> io::Result<Option<String>> {
+    // struct ethtool_perm_addr { cmd, size, data[size] }
+    let mut data = vec![0u8; 8 + MAX_ADDR_LEN];
+    data[..4].copy_from_slice(&ETHTOOL_GPERMADDR.to_ne_bytes());
+    data[4..8].copy_from_slice(&(MAX_ADDR_LEN as u32).to_ne_bytes());
+
+    match EthtoolSocket::open()?.ioctl(interface, &mut data) {
+        Ok(()) => Ok(parse_permanent_address(&data)),
+        Err(err) if err.raw_os_error() == Some(libc::EOPNOTSUPP) => Ok(None),
+        Err(err) => Err(err),
+    }
+}
+
+fn parse_permanent_address(data: &[u8]) -> Option<String> {
+    let size = read_u32(data, 4)? as usize;
+    let address = data.get(8..8 + size)?;
+
+    if size != 6 || address.iter().all(|b| *b == 0) {
+        return None;
+    }
+
+    Some(
+        address
+            .iter()
+            .map(|b| format!("{b:02x}"))
+            .collect::<Vec<_>>()
+            .join(":"),
+    )
+}
+
+/// Returns the value of the setting as a number, with booleans represented as 0 or 1.
+fn parse_setting(key: &str, value: &str) -> Result<u32, anyhow::Error> {
+    let is_feature = key
+        .strip_prefix(FEATURE_PREFIX)
+        .is_some_and(|name| !name.is_empty());
+    let is_known = |settings: &[(&str, usize)]| settings.iter().any(|(name, _)| *name == key);
+
+    if !is_feature
+        && !is_known(&RING_SETTINGS)
+        && !is_known(&PAUSE_SETTINGS)
+        && !is_known(&COALESCE_SETTINGS)
+    {
+        return Err(anyhow!("Unknown ethtool setting '{key}'"));
+    }
+
+    if is_boolean(key) {
+        return match value {
+            "true" | "yes" | "1" => Ok(1),
+            "false" | "no" | "0" => Ok(0),
+            _ => Err(anyhow!(
+                "Invalid value '{value}' for ethtool setting '{key}', expected a boolean"
+            )),
+        };
+    }
+
+    value.parse().map_err(|_| {
+        anyhow!("Invalid value '{value}' for ethtool setting '{key}', expected an unsigned integer")
+    })
+}
+
+fn is_boolean(key: &str) -> bool {
+    key.starts_with(FEATURE_PREFIX)
+        || key.starts_with("pause-")
+        || key.starts_with("coalesce-adaptive-")
+}
+
+fn format_value(key: &str, value: u32) -> String {
+    match (is_boolean(key), value) {
+        (true, 0) => "false".to_string(),
+        (true, _) => "true".to_string(),
+        (false, value) => value.to_string(),
+    }
+}
+
+/// Returns a description of the difference between the expected and current value of the setting, if any.
+fn compare_setting(key: &str, expected: u32, current: &LinkSettings) -> Option<String> {
+    let params = |settings: &[(&str, usize)], params: &Option<Result<Vec<u32>, String>>| {
+        let index = settings.iter().find(|(name, _)| *name == key)?.1;
+        match params.as_ref()? {
+            Ok(params) => params.get(index).map(|value| Ok(*value)),
+            Err(err) => Some(Err(err.clone())),
+        }
+    };
+
+    let actual = if let Some(name) = key.strip_prefix(FEATURE_PREFIX) {
+        match current.features.as_ref()? {
+            Ok(features) => feature_value(name, features),
+            Err(err) => Err(err.clone()),
+        }
+    } else {
+        params(&RING_SETTINGS, &current.ring)
+            .or_else(|| params(&PAUSE_SETTINGS, &current.pause))
+            .or_else(|| params(&COALESCE_SETTINGS, &current.coalesce))?
+            .map(|value| format_value(key, value))
+    };
+
+    let expected = format_value(key, expected);
+
+    match actual {
+        Ok(actual) if actual == expected => None,
+        Ok(actual) => Some(format!("expected {expected}, got {actual}")),
+        Err(err) => Some(err),
+    }
+}
+
+/// Returns the state of the feature or group of features (e.g. `tso`) as `true`, `false` or `mixed`.
+///
+/// Members of a group which can not be changed by the driver are ignored, unless none of them can be.
+fn feature_value(name: &str, features: &HashMap<String, Feature>) -> Result<String, String> {
+    let names = FEATURE_ALIASES
+        .iter()
+        .find(|(alias, _)| *alias == name)
+        .map(|(_, names)| names.to_vec())
+        .unwrap_or_else(|| vec![name]);
+
+    let present: Vec<Feature> = names
+        .iter()
+        .filter_map(|name| features.get(*name).copied())
+        .collect();
+    let changeable: Vec<Feature> = present.iter().filter(|f| f.changeable).copied().collect();
+
+    let members = if changeable.is_empty() {
+        present
+    } else {
+        changeable
+    };
+
+    if members.is_empty() {
+        return Err("not supported by the driver".to_string());
+    }
+
+    let value = if members.iter().all(|f| f.active) {
+        "true"
+    } else if members.iter().all(|f| !f.active) {
+        "false"
+    } else {
+        "mixed"
+    };
+
+    Ok(value.to_string())
+}
+
+/// Map the feature names to the blocks returned by `ETHTOOL_GFEATURES`.
+fn parse_features(names: &[String], blocks: &[u8]) -> HashMap<String, Feature> {
+    names
+        .iter()
+        .enumerate()
+        .filter_map(|(i, name)| {
+            // struct ethtool_get_features_block { available, requested, active, never_changed }
+            let offset = i / 32 * 16;
+            let bit = 1 << (i % 32);
+
+            let available = read_u32(blocks, offset)?;
+            let active = read_u32(blocks, offset + 8)?;
+
+            Some((
+                name.clone(),
+                Feature {
+                    changeable: available & bit != 0,
+                    active: active & bit != 0,
+                },
+            ))
+        })
+        .collect()
+}
+
+fn parse_strings(data: &[u8]) -> Vec<String> {
+    data.chunks_exact(ETH_GSTRING_LEN)
+        .map(|chunk| {
+            let len = chunk.iter().position(|b| *b == 0).unwrap_or(chunk.len());
+            String::from_utf8_lossy(&chunk[..len]).to_string()
+        })
+        .collect()
+}
+
+fn read_u32(data: &[u8], offset: usize) -> Option<u32> {
+    data.get(offset..offset + 4)
+        .and_then(|bytes| bytes.try_into().ok())
+        .map(u32::from_ne_bytes)
+}
+
+/// `struct ifreq` with the `ifr_data` member of the union.
+#[repr(C)]
+struct IfReq {
+    name: [libc::c_char; libc::IFNAMSIZ],
+    data: *mut libc::c_void,
+    padding: [u8; 16],
+}
+
+/// Socket used for issuing ethtool ioctls.
+struct EthtoolSocket {
+    fd: OwnedFd,
+}
+
+impl EthtoolSocket {
+    fn open() -> io::Result<Self> {
+        let fd = unsafe { libc::socket(libc::AF_INET, libc::SOCK_DGRAM | libc::SOCK_CLOEXEC, 0) };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(EthtoolSocket {
+            fd: unsafe { OwnedFd::from_raw_fd(fd) },
+        })
+    }
+
+    /// Issue the ethtool command contained in `data` (starting with the command number) for the interface.
+    fn ioctl(&self, interface: &str, data: &mut [u8]) -> io::Result<()> {
+        if interface.is_empty() || interface.len() >= libc::IFNAMSIZ {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidInput,
+                format!("invalid interface name: '{interface}'"),
+            ));
+        }
+
+        let mut request = IfReq {
+            name: [0; libc::IFNAMSIZ],
+            data: data.as_mut_ptr() as *mut libc::c_void,
+            padding: [0; 16],
+        };
+        for (dst, src) in request.name.iter_mut().zip(interface.bytes()) {
+            *dst = src as libc::c_char;
+        }
+
+        let result = unsafe {
+            libc::ioctl(
+                self.fd.as_raw_fd(),
+                SIOCETHTOOL as _,
+                &mut request as *mut IfReq,
+            )
+        };
+        if result < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(())
+    }
+
+    /// Query a parameter struct consisting of `len` u32 fields (including the command).
+    fn query_params(&self, interface: &str, cmd: u32, len: usize) -> io::Result<Vec<u32>> {
+        let mut data = vec![0u8; len * 4];
+        data[..4].copy_from_slice(&cmd.to_ne_bytes());
+
+        self.ioctl(interface, &mut data)?;
+
+        Ok(data
+            .chunks_exact(4)
+            .map(|chunk| u32::from_ne_bytes([chunk[0], chunk[1], chunk[2], chunk[3]]))
+            .collect())
+    }
+
+    fn features(&self, interface: &str) -> io::Result<HashMap<String, Feature>> {
+        // struct ethtool_sset_info { cmd, reserved, sset_mask (u64), data[1] }
+        let mut info = vec![0u8; 20];
+        info[..4].copy_from_slice(&ETHTOOL_GSSET_INFO.to_ne_bytes());
+        info[8..16].copy_from_slice(&(1u64 << ETH_SS_FEATURES).to_ne_bytes());
+        self.ioctl(interface, &mut info)?;
+
+        let count = read_u32(&info, 16).unwrap_or_default() as usize;
+
+        // struct ethtool_gstrings { cmd, string_set, len, data[len * ETH_GSTRING_LEN] }
+        let mut strings = vec![0u8; 12 + count * ETH_GSTRING_LEN];
+        strings[..4].copy_from_slice(&ETHTOOL_GSTRINGS.to_ne_bytes());
+        strings[4..8].copy_from_slice(&ETH_SS_FEATURES.to_ne_bytes());
+        strings[8..12].copy_from_slice(&(count as u32).to_ne_bytes());
+        self.ioctl(interface, &mut strings)?;
+
+        // struct ethtool_gfeatures { cmd, size, features[size] }
+        let size = count.div_ceil(32);
+        let mut features = vec![0u8; 8 + size * 16];
+        features[..4].copy_from_slice(&ETHTOOL_GFEATURES.to_ne_bytes());
+        features[4..8].copy_from_slice(&(size as u32).to_ne_bytes());
+        self.ioctl(interface, &mut features)?;
+
+        Ok(parse_features(
+            &parse_strings(&strings[12..]),
+            &features[8..],
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+
+    use crate::ethtool::{
+        compare_setting, feature_value, parse_features, parse_permanent_address, parse_setting,
+        parse_strings, validate_settings, Feature, LinkSettings,
+    };
+    use crate::keyfile::Keyfile;
+
+    fn feature(changeable: bool, active: bool) -> Feature {
+        Feature { changeable, active }
+    }
+
+    #[test]
+    fn parse_ethtool_settings() {
+        assert_eq!(parse_setting("feature-tso", "false").unwrap(), 0);
+        assert_eq!(parse_setting("feature-rx-gro-hw", "true").unwrap(), 1);
+        assert_eq!(parse_setting("pause-rx", "1").unwrap(), 1);
+        assert_eq!(parse_setting("ring-rx", "4096").unwrap(), 4096);
+        assert_eq!(parse_setting("coalesce-adaptive-tx", "no").unwrap(), 0);
+        assert_eq!(parse_setting("coalesce-rx-usecs", "50").unwrap(), 50);
+
+        assert_eq!(
+            parse_setting("ring-rxx", "4096").unwrap_err().to_string(),
+            "Unknown ethtool setting 'ring-rxx'"
+        );
+        assert_eq!(
+            parse_setting("feature-", "true").unwrap_err().to_string(),
+            "Unknown ethtool setting 'feature-'"
+        );
+        assert_eq!(
+            parse_setting("ring-rx", "-1").unwrap_err().to_string(),
+            "Invalid value '-1' for ethtool setting 'ring-rx', expected an unsigned integer"
+        );
+        assert_eq!(
+            parse_setting("pause-tx", "on").unwrap_err().to_string(),
+            "Invalid value 'on' for ethtool setting 'pause-tx', expected a boolean"
+        );
+    }
+
+    #[test]
+    fn validate_keyfile_settings() {
+        assert!(validate_settings(&Keyfile::parse(
+            "[connection]\nid=eth0\n\n[ethtool]\nfeature-tso=false\nring-rx=4096\n"
+        ))
+        .is_ok());
+        assert!(validate_settings(&Keyfile::parse("[connection]\nid=eth0\n")).is_ok());
+        assert!(validate_settings(&Keyfile::parse("[ethtool]\nring-rx=large\n")).is_err());
+    }
+
+    #[test]
+    fn compare_link_settings() {
+        let mut ring = vec![0; 9];
+        ring[5] = 1024;
+        ring[8] = 4096;
+
+        let current = LinkSettings {
+            ring: Some(Ok(ring)),
+            pause: Some(Err("Operation not supported (os error 95)".to_string())),
+            features: Some(Ok(HashMap::from([(
+                "rx-gro".to_string(),
+                feature(true, true),
+            )]))),
+            ..Default::default()
+        };
+
+        assert_eq!(compare_setting("ring-tx", 4096, &current), None);
+        assert_eq!(
+            compare_setting("ring-rx", 4096, &current),
+            Some("expected 4096, got 1024".to_string())
+        );
+        assert_eq!(
+            compare_setting("pause-rx", 1, &current),
+            Some("Operation not supported (os error 95)".to_string())
+        );
+        assert_eq!(compare_setting("feature-gro", 1, &current), None);
+        assert_eq!(
+            compare_setting("feature-rx-gro", 0, &current),
+            Some("expected false, got true".to_string())
+        );
+        assert_eq!(
+            compare_setting("feature-lro", 0, &current),
+            Some("not supported by the driver".to_string())
+        );
+    }
+
+    #[test]
+    fn determine_feature_values() {
+        let features = HashMap::from([
+            ("tx-tcp-segmentation".to_string(), feature(true, false)),
+            ("tx-tcp6-segmentation".to_string(), feature(true, false)),
+            (
+                "tx-tcp-mangleid-segmentation".to_string(),
+                feature(false, true),
+            ),
+            ("tx-scatter-gather".to_string(), feature(true, true)),
+            (
+                "tx-scatter-gather-fraglist".to_string(),
+                feature(true, false),
+            ),
+            ("highdma".to_string(), feature(false, true)),
+        ]);
+
+        assert_eq!(feature_value("tso", &features), Ok("false".to_string()));
+        assert_eq!(feature_value("sg", &features), Ok("mixed".to_string()));
+        assert_eq!(feature_value("highdma", &features), Ok("true".to_string()));
+        assert!(feature_value("rx-gro", &features).is_err());
+    }
+
+    #[test]
+    fn parse_permanent_hardware_address() {
+        let data = |size: u32, address: &[u8]| {
+            let mut data = vec![0u8; 40];
+            data[4..8].copy_from_slice(&size.to_ne_bytes());
+            data[8..8 + address.len()].copy_from_slice(address);
+            data
+        };
+
+        assert_eq!(
+            parse_permanent_address(&data(6, &[0x00, 0x11, 0x22, 0xAA, 0x44, 0x5F])),
+            Some("00:11:22:aa:44:5f".to_string())
+        );
+        assert_eq!(parse_permanent_address(&data(6, &[0; 6])), None);
+        assert_eq!(parse_permanent_address(&data(0, &[])), None);
+        assert_eq!(parse_permanent_address(&data(64, &[])), None);
+    }
+
+    #[test]
+    fn parse_kernel_features() {
+        let mut strings = vec![0u8; 64];
+        strings[..6].copy_from_slice(b"rx-gro");
+        strings[32..38].copy_from_slice(b"rx-lro");
+
+        let names = parse_strings(&strings);
+        assert_eq!(names, vec!["rx-gro", "rx-lro"]);
+
+        // available, requested, active, never_changed
+        let mut blocks = Vec::new();
+        for value in [0b11u32, 0b01, 0b01, 0] {
+            blocks.extend_from_slice(&value.to_ne_bytes());
+        }
+
+        assert_eq!(
+            parse_features(&names, &blocks),
+            HashMap::from([
+                ("rx-gro".to_string(), feature(true, true)),
+                ("rx-lro".to_string(), feature(true, false)),
+            ])
+        );
+    }
+}
@@ -0,0 +1,110 @@
+use std::io;
+
+use crate::apply_conf::NoHostMatched;
+use crate::deadline::TimedOut;
+use crate::filesystem::WriteFailed;
+use crate::lock::AlreadyRunning;
+use crate::verify::VerificationFailed;
+
+/// Any failure not covered by a more specific exit code.
+pub(crate) const FAILURE: i32 = 1;
+/// None of the preconfigured hosts match the local NICs.
+/// Exit code 2 is skipped since it is already used for invalid command line arguments.
+pub(crate) const NO_HOST_MATCHED: i32 = 3;
+/// The desired states could not be turned into connection files.
+pub(crate) const GENERATION_FAILED: i32 = 4;
+/// Files could not be written or moved into place, e.g. due to missing permissions or a read-only file system.
+pub(crate) const WRITE_FAILED: i32 = 5;
+/// The stored config is not intact or its settings are not in effect.
+pub(crate) const VERIFICATION_FAILED: i32 = 6;
+/// Another run holds the run lock.
+pub(crate) const ALREADY_RUNNING: i32 = 7;
+/// The run exceeded the `--timeout`.
+pub(crate) const TIMED_OUT: i32 = 8;
+
+/// Determine the exit code from the causes of the error, falling back to the default
+/// exit code of the command if none of them is specific.
+pub(crate) fn exit_code(err: &anyhow::Error, default: i32) -> i32 {
+    for cause in err.chain() {
+        if cause.is::<NoHostMatched>() {
+            return NO_HOST_MATCHED;
+        }
+
+        if cause.is::<VerificationFailed>() {
+            return VERIFICATION_FAILED;
+        }
+
+        if cause.is::<AlreadyRunning>() {
+            return ALREADY_RUNNING;
+        }
+
+        if cause.is::<TimedOut>() {
+            return TIMED_OUT;
+        }
+
+        if cause
+            .downcast_ref::<io::Error>()
+            .and_then(WriteFailed::unwrap)
+            .is_some()
+        {
+            return WRITE_FAILED;
+        }
+    }
+
+    default
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io;
+    use std::path::Path;
+    use std::time::Duration;
+
+    use anyhow::{anyhow, Context};
+
+    use crate::apply_conf::NoHostMatched;
+    use crate::deadline::TimedOut;
+    use crate::exit_code::{
+        exit_code, ALREADY_RUNNING, FAILURE, GENERATION_FAILED, NO_HOST_MATCHED, TIMED_OUT,
+        VERIFICATION_FAILED, WRITE_FAILED,
+    };
+    use crate::filesystem::{Disk, FileSystem};
+    use crate::lock::AlreadyRunning;
+    use crate::verify::VerificationFailed;
+
+    #[test]
+    fn determine_exit_codes() {
+        let err = anyhow::Error::from(NoHostMatched);
+        assert_eq!(exit_code(&err, FAILURE), NO_HOST_MATCHED);
+
+        let err = anyhow::Error::from(VerificationFailed(
+            "1 stored profiles are missing".to_string(),
+        ));
+        assert_eq!(exit_code(&err, FAILURE), VERIFICATION_FAILED);
+
+        let err = anyhow::Error::from(AlreadyRunning);
+        assert_eq!(exit_code(&err, FAILURE), ALREADY_RUNNING);
+
+        let err = anyhow::Error::from(TimedOut(Duration::from_secs(30))).context("Fetching config");
+        assert_eq!(exit_code(&err, FAILURE), TIMED_OUT);
+
+        let err = Disk
+            .write(Path::new("_exit_code_missing/file"), b"contents", 0o600)
+            .context("Storing connection files")
+            .unwrap_err();
+        assert_eq!(exit_code(&err, GENERATION_FAILED), WRITE_FAILED);
+
+        let err = anyhow::Error::from(io::Error::from(io::ErrorKind::PermissionDenied))
+            .context("Reading config file");
+        assert_eq!(exit_code(&err, FAILURE), FAILURE);
+
+        let err =
+            anyhow::Error::from(io::Error::from(io::ErrorKind::NotFound)).context("Parsing config");
+        assert_eq!(exit_code(&err, FAILURE), FAILURE);
+
+        let err = Err::<(), _>(anyhow!("Invalid desired state"))
+            .context("Generating config")
+            .unwrap_err();
+        assert_eq!(exit_code(&err, GENERATION_FAILED), GENERATION_FAILED);
+    }
+}
@@ -0,0 +1,281 @@
+use std::cell::RefCell;
+
+use anyhow::anyhow;
+
+/// Marker enclosing the name of a secret placeholder, e.g. `psk=@@WIFI_PSK@@`.
+const PLACEHOLDER_MARKER: &str = "@@";
+
+/// Returns the names of all variables referenced in the given input in order of first appearance.
+pub(crate) fn referenced_vars(input: &str) -> Result<Vec<String>, anyhow::Error> {
+    let names: RefCell<Vec<String>> = RefCell::new(Vec::new());
+
+    expand_vars(input, |name| {
+        let mut names = names.borrow_mut();
+        if !names.iter().any(|n| n == name) {
+            names.push(name.to_string());
+        }
+        Some(String::new())
+    })?;
+
+    Ok(names.into_inner())
+}
+
+/// Expand all `${VAR}` references in the given input using the lookup function.
+///
+/// A literal `${` sequence can be preserved by escaping it as `$${`.
+/// Referencing variables which are not defined results in an error listing all of them.
+pub(crate) fn expand_vars<F>(input: &str, lookup: F) -> Result<String, anyhow::Error>
+where
+    F: Fn(&str) -> Option<String>,
+{
+    let mut output = String::with_capacity(input.len());
+    let mut missing: Vec<String> = Vec::new();
+    let mut rest = input;
+
+    while let Some(start) = rest.find('$') {
+        output.push_str(&rest[..start]);
+        rest = &rest[start..];
+
+        if rest.starts_with("$${") {
+            output.push_str("${");
+            rest = &rest[3..];
+            continue;
+        }
+
+        if !rest.starts_with("${") {
+            output.push('$');
+            rest = &rest[1..];
+            continue;
+        }
+
+        let end = rest
+            .find('}')
+            .ok_or_else(|| anyhow!("Unterminated variable reference: {}", first_line(rest)))?;
+
+        let name = &rest[2..end];
+        if !is_valid_name(name) {
+            return Err(anyhow!("Invalid variable name: '{name}'"));
+        }
+
+        match lookup(name) {
+            Some(value) => output.push_str(&value),
+            None => {
+                if !missing.iter().any(|m| m == name) {
+                    missing.push(name.to_string());
+                }
+            }
+        }
+
+        rest = &rest[end + 1..];
+    }
+
+    output.push_str(rest);
+
+    if !missing.is_empty() {
+        return Err(anyhow!(
+            "Undefined environment variables: {}",
+            missing.join(", ")
+        ));
+    }
+
+    Ok(output)
+}
+
+/// Returns the names of all `@@NAME@@` placeholders in the given input in order of first appearance.
+pub(crate) fn referenced_placeholders(input: &str) -> Vec<String> {
+    let names: RefCell<Vec<String>> = RefCell::new(Vec::new());
+
+    // Cannot fail since every placeholder is resolved.
+    let _ = expand_placeholders(input, |name| {
+        let mut names = names.borrow_mut();
+        if !names.iter().any(|n| n == name) {
+            names.push(name.to_string());
+        }
+        Some(String::new())
+    });
+
+    names.into_inner()
+}
+
+/// Expand all `@@NAME@@` placeholders in the given input using the lookup function.
+///
+/// Markers which do not enclose a valid variable name (e.g. in `password=a@@b c@@`) are preserved.
+/// Placeholders which cannot be resolved result in an error listing all of them.
+pub(crate) fn expand_placeholders<F>(input: &str, lookup: F) -> Result<String, anyhow::Error>
+where
+    F: Fn(&str) -> Option<String>,
+{
+    let mut output = String::with_capacity(input.len());
+    let mut missing: Vec<String> = Vec::new();
+    let mut rest = input;
+
+    while let Some(start) = rest.find(PLACEHOLDER_MARKER) {
+        output.push_str(&rest[..start]);
+        rest = &rest[start + PLACEHOLDER_MARKER.len()..];
+
+        let name = rest
+            .find(PLACEHOLDER_MARKER)
+            .map(|end| &rest[..end])
+            .filter(|name| is_valid_name(name));
+
+        let Some(name) = name else {
+            output.push_str(PLACEHOLDER_MARKER);
+            continue;
+        };
+
+        match lookup(name) {
+            Some(value) => output.push_str(&value),
+            None => {
+                if !missing.iter().any(|m| m == name) {
+                    missing.push(name.to_string());
+                }
+            }
+        }
+
+        rest = &rest[name.len() + PLACEHOLDER_MARKER.len()..];
+    }
+
+    output.push_str(rest);
+
+    if !missing.is_empty() {
+        return Err(anyhow!("Unresolved placeholders: {}", missing.join(", ")));
+    }
+
+    Ok(output)
+}
+
+fn is_valid_name(name: &str) -> bool {
+    let mut chars = name.chars();
+
+    chars
+        .next()
+        .is_some_and(|c| c.is_ascii_alphabetic() || c == '_')
+        && chars.all(|c| c.is_ascii_alphanumeric() || c == '_')
+}
+
+fn first_line(s: &str) -> &str {
+    s.lines().next().unwrap_or_default()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+
+    use crate::expand::{
+        expand_placeholders, expand_vars, is_valid_name, referenced_placeholders, referenced_vars,
+    };
+
+    fn lookup(name: &str) -> Option<String> {
+        HashMap::from([
+            ("VLAN_ID", "1365"),
+            ("PROXY", "10.0.0.1:3128"),
+            ("EMPTY", ""),
+        ])
+        .get(name)
+        .map(|v| v.to_string())
+    }
+
+    #[test]
+    fn expand_vars_successfully() {
+        let input = "[vlan]\nid=${VLAN_ID}\nproxy=${PROXY}\nempty=${EMPTY}\n";
+
+        assert_eq!(
+            expand_vars(input, lookup).unwrap(),
+            "[vlan]\nid=1365\nproxy=10.0.0.1:3128\nempty=\n"
+        );
+    }
+
+    #[test]
+    fn expand_vars_preserves_plain_and_escaped_references() {
+        let input = "price=$5\nliteral=$${VLAN_ID}\ntrailing=$";
+
+        assert_eq!(
+            expand_vars(input, lookup).unwrap(),
+            "price=$5\nliteral=${VLAN_ID}\ntrailing=$"
+        );
+    }
+
+    #[test]
+    fn expand_vars_fails_due_to_undefined_variables() {
+        let input = "a=${MISSING_A}\nb=${VLAN_ID}\nc=${MISSING_B}\nd=${MISSING_A}";
+
+        let error = expand_vars(input, lookup).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Undefined environment variables: MISSING_A, MISSING_B"
+        );
+    }
+
+    #[test]
+    fn expand_vars_fails_due_to_unterminated_reference() {
+        let error = expand_vars("id=${VLAN_ID\nmtu=1500", lookup).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Unterminated variable reference: ${VLAN_ID"
+        );
+    }
+
+    #[test]
+    fn expand_vars_fails_due_to_invalid_name() {
+        let error = expand_vars("id=${VLAN-ID}", lookup).unwrap_err();
+        assert_eq!(error.to_string(), "Invalid variable name: 'VLAN-ID'");
+    }
+
+    #[test]
+    fn list_referenced_vars() {
+        let input = "a=${VLAN_ID}\nb=$${ESCAPED}\nc=${PROXY}\nd=${VLAN_ID}";
+
+        assert_eq!(referenced_vars(input).unwrap(), vec!["VLAN_ID", "PROXY"]);
+        assert!(referenced_vars("plain").unwrap().is_empty());
+        assert!(referenced_vars("id=${VLAN-ID}").is_err());
+    }
+
+    #[test]
+    fn expand_placeholders_successfully() {
+        let input = "[vlan]\nid=@@VLAN_ID@@\nproxy=@@PROXY@@@@EMPTY@@\n";
+
+        assert_eq!(
+            expand_placeholders(input, lookup).unwrap(),
+            "[vlan]\nid=1365\nproxy=10.0.0.1:3128\n"
+        );
+    }
+
+    #[test]
+    fn expand_placeholders_preserves_other_markers() {
+        let input = "a=p@@s s@@\nb=@@VLAN-ID@@\nc=@@\nd=x@@@@VLAN_ID@@";
+
+        assert_eq!(
+            expand_placeholders(input, lookup).unwrap(),
+            "a=p@@s s@@\nb=@@VLAN-ID@@\nc=@@\nd=x@@1365"
+        );
+    }
+
+    #[test]
+    fn expand_placeholders_fails_due_to_unresolved_placeholders() {
+        let input = "a=@@MISSING_A@@\nb=@@VLAN_ID@@\nc=@@MISSING_B@@\nd=@@MISSING_A@@";
+
+        let error = expand_placeholders(input, lookup).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Unresolved placeholders: MISSING_A, MISSING_B"
+        );
+    }
+
+    #[test]
+    fn list_referenced_placeholders() {
+        let input = "a=@@WIFI_PSK@@\nb=${VLAN_ID}\nc=@@WIFI_PSK@@\nd=@@KEY@@";
+
+        assert_eq!(referenced_placeholders(input), vec!["WIFI_PSK", "KEY"]);
+        assert!(referenced_placeholders("a=b@@c").is_empty());
+    }
+
+    #[test]
+    fn validate_variable_names() {
+        assert!(is_valid_name("VLAN_ID"));
+        assert!(is_valid_name("_private"));
+        assert!(is_valid_name("A1"));
+        assert!(!is_valid_name(""));
+        assert!(!is_valid_name("1A"));
+        assert!(!is_valid_name("A B"));
+    }
+}
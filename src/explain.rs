@@ -0,0 +1,484 @@
+use std::fmt::Write;
+
+use anyhow::anyhow;
+
+/// Documented field of the host mapping.
+#[cfg_attr(test, derive(Debug))]
+pub(crate) struct Field {
+    name: &'static str,
+    kind: &'static str,
+    description: &'static str,
+    /// Accepted values of fields not taking arbitrary ones.
+    values: &'static [&'static str],
+    fields: &'static [Field],
+}
+
+/// Schema of `host_config.yaml`, a list of hosts. It mirrors the types the file is deserialized into,
+/// which must be kept in sync whenever a field is added.
+pub(crate) const HOSTS: Field = Field {
+    name: "hosts",
+    kind: "[]object",
+    description: "Hosts of the config dir along with the interfaces identifying them, stored as host_config.yaml. \
+    The host whose interfaces match the local NICs is configured by apply.",
+    values: &[],
+    fields: &[
+        Field {
+            name: "hostname",
+            kind: "string",
+            description: "Name of the host, also naming the dir of its connection files. Set as the hostname of \
+            the machine by apply.",
+            values: &[],
+            fields: &[],
+        },
+        Field {
+            name: "dhcp_fallback",
+            kind: "boolean",
+            description: "Whether local NICs not covered by the host's profiles get a DHCP fallback profile, \
+            overriding the --dhcp-fallback flag of apply.",
+            values: &[],
+            fields: &[],
+        },
+        Field {
+            name: "match",
+            kind: "string",
+            description: "How many of the host's Ethernet NICs have to be present locally for it to match, \
+            overriding the --match flag of apply and identify. With `all`, a host matching only some of them \
+            fails the run listing the missing ones.",
+            values: &["any", "all"],
+            fields: &[],
+        },
+        Field {
+            name: "labels",
+            kind: "map[string]string",
+            description: "Labels selecting the host along with others via --selector, e.g. `site: berlin`. \
+            Taken from the --labels-file of generate.",
+            values: &[],
+            fields: &[],
+        },
+        Field {
+            name: "dns",
+            kind: "object",
+            description: "Name servers added to the host's connections which don't declare their own.",
+            values: &[],
+            fields: &[
+                Field {
+                    name: "servers",
+                    kind: "[]string",
+                    description: "IPv4 and IPv6 addresses of the name servers, set as the dns of the ipv4 and \
+                    ipv6 settings of the connections with the auto or manual method respectively.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "search",
+                    kind: "[]string",
+                    description: "Search domains, set as the dns-search of the same connections.",
+                    values: &[],
+                    fields: &[],
+                },
+            ],
+        },
+        Field {
+            name: "ntp",
+            kind: "object",
+            description: "Time servers stored by apply as a drop-in of the NTP client of the machine.",
+            values: &[],
+            fields: &[
+                Field {
+                    name: "servers",
+                    kind: "[]string",
+                    description: "Host names or addresses of the time servers.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "client",
+                    kind: "string",
+                    description: "Client the drop-in is written for, chrony if /etc/chrony.conf exists and \
+                    systemd-timesyncd otherwise if not set.",
+                    values: &["chrony", "timesyncd"],
+                    fields: &[],
+                },
+            ],
+        },
+        Field {
+            name: "probes",
+            kind: "[]object",
+            description: "Services the host has to reach once its config is active, probed by verify after the \
+            links came up. Failed probes fail the verification and trigger its fallback like any other check.",
+            values: &[],
+            fields: &[
+                Field {
+                    name: "type",
+                    kind: "string",
+                    description: "How the target is probed, `http` expects a successful status of a GET request, \
+                    `dns` a name resolving to an address and `ntp` an answer of the time server.",
+                    values: &["http", "dns", "ntp"],
+                    fields: &[],
+                },
+                Field {
+                    name: "target",
+                    kind: "string",
+                    description: "URL, name or time server (`host` or `host:port`) probed, depending on the type.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "timeout",
+                    kind: "integer",
+                    description: "Seconds to wait for the answer, 5 if not set.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "severity",
+                    kind: "string",
+                    description: "Whether a failed probe fails the verification.",
+                    values: &["critical", "warn", "ignore"],
+                    fields: &[],
+                },
+            ],
+        },
+        Field {
+            name: "interfaces",
+            kind: "[]object",
+            description: "Interfaces of the host. Those with a MAC address identify the host and are renamed to \
+            the local names of the matching NICs.",
+            values: &[],
+            fields: &[
+                Field {
+                    name: "logical_name",
+                    kind: "string",
+                    description: "Name of the interface in the desired state, also naming its connection file.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "mac_address",
+                    kind: "string",
+                    description: "MAC address of the NIC, e.g. `00:11:22:33:44:55`. Virtual interfaces without \
+                    one (e.g. bonds) are not matched.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "interface_type",
+                    kind: "string",
+                    description: "nmstate type of the interface, e.g. `ethernet`, `bond` or `vlan`.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "management",
+                    kind: "boolean",
+                    description: "Marks the interface providing remote access to the host, which apply refuses \
+                    to remove, rename or modify unless --allow-management-change is passed.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "description",
+                    kind: "string",
+                    description: "Free-form description of the interface (ifalias), e.g. `uplink to sw-03 port 12`.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "altnames",
+                    kind: "[]string",
+                    description: "Alternative names of the interface.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "verification",
+                    kind: "object",
+                    description: "How the interface is checked by verify.",
+                    values: &[],
+                    fields: &[
+                        Field {
+                            name: "timeout",
+                            kind: "integer",
+                            description: "Seconds to wait for the link to come up, e.g. for LTE modems or bridges \
+                            waiting for STP to converge.",
+                            values: &[],
+                            fields: &[],
+                        },
+                        Field {
+                            name: "severity",
+                            kind: "string",
+                            description: "Whether failed checks of the interface fail the verification.",
+                            values: &["critical", "warn", "ignore"],
+                            fields: &[],
+                        },
+                    ],
+                },
+                Field {
+                    name: "profiles",
+                    kind: "[]string",
+                    description: "Additional connection profiles of the interface (e.g. a DHCP fallback), \
+                    stored next to the primary one as `<logical_name>@<profile>`.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "pci_address",
+                    kind: "string",
+                    description: "PCI address of the NIC, e.g. `0000:3b:00.0`. Locates interfaces without a MAC \
+                    address once the host is identified, it never identifies the host itself.",
+                    values: &[],
+                    fields: &[],
+                },
+                Field {
+                    name: "sriov",
+                    kind: "object",
+                    description: "SR-IOV physical function whose virtual functions are configured by apply.",
+                    values: &[],
+                    fields: &[Field {
+                        name: "total_vfs",
+                        kind: "integer",
+                        description: "Number of virtual functions, set as the total-vfs of the sriov settings \
+                        of the interface's connection.",
+                        values: &[],
+                        fields: &[],
+                    }],
+                },
+            ],
+        },
+    ],
+};
+
+/// Print the documentation of the field at `path` of the host mapping, e.g. `hosts.interfaces.mac_address`.
+pub(crate) fn explain(path: &str, recursive: bool) -> Result<(), anyhow::Error> {
+    let field = find_field(path)?;
+    print!("{}", format_field(field, recursive));
+
+    Ok(())
+}
+
+/// Looks up the field at the dotted path. Segments may also be written in camel case (e.g. `macAddress`).
+fn find_field(path: &str) -> Result<&'static Field, anyhow::Error> {
+    let mut segments = path.split('.').map(snake_case);
+
+    if segments.next().as_deref() != Some(HOSTS.name) {
+        return Err(anyhow!(
+            "Unknown field '{path}', paths start with '{}'",
+            HOSTS.name
+        ));
+    }
+
+    let mut field = &HOSTS;
+    for segment in segments {
+        field = field
+            .fields
+            .iter()
+            .find(|child| child.name == segment)
+            .ok_or_else(|| anyhow!("Unknown field '{segment}' of '{path}'"))?;
+    }
+
+    Ok(field)
+}
+
+fn snake_case(segment: &str) -> String {
+    let mut name = String::new();
+    for c in segment.chars() {
+        if c.is_ascii_uppercase() {
+            name.push('_');
+            name.push(c.to_ascii_lowercase());
+        } else {
+            name.push(c);
+        }
+    }
+    name
+}
+
+fn format_field(field: &Field, recursive: bool) -> String {
+    let mut output = format!("FIELD: {} <{}>\n\nDESCRIPTION:\n", field.name, field.kind);
+    output.push_str(&indent(field.description, 4));
+
+    if !field.values.is_empty() {
+        output.push_str("\nVALUES:\n");
+        for value in field.values {
+            let _ = writeln!(output, "    {value}");
+        }
+    }
+
+    if !field.fields.is_empty() {
+        output.push_str("\nFIELDS:\n");
+        format_fields(&mut output, field.fields, recursive, 4);
+    }
+
+    output
+}
+
+fn format_fields(output: &mut String, fields: &[Field], recursive: bool, depth: usize) {
+    for field in fields {
+        let _ = writeln!(output, "{:depth$}{} <{}>", "", field.name, field.kind);
+        if recursive {
+            format_fields(output, field.fields, recursive, depth + 2);
+        } else {
+            output.push_str(&indent(field.description, depth + 2));
+        }
+    }
+}
+
+fn indent(text: &str, depth: usize) -> String {
+    let mut output = String::new();
+    for line in text.lines() {
+        let _ = writeln!(output, "{:depth$}{}", "", line.trim());
+    }
+    output
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+
+    use serde_json::Value;
+
+    use crate::explain::{find_field, format_field, Field, HOSTS};
+    use crate::types::{
+        Dns, Host, Interface, MatchMode, Ntp, NtpClient, Probe, ProbeType, Severity, Sriov,
+        Verification,
+    };
+
+    fn assert_documented(value: &Value, field: &Field) {
+        let value = match value {
+            Value::Array(items) => &items[0],
+            value => value,
+        };
+
+        if let Value::Object(object) = value {
+            if field.kind == "map[string]string" {
+                return;
+            }
+
+            let mut documented: Vec<&str> = field.fields.iter().map(|field| field.name).collect();
+            documented.sort();
+            let mut keys: Vec<&str> = object.keys().map(String::as_str).collect();
+            keys.sort();
+            assert_eq!(documented, keys, "fields of '{}'", field.name);
+
+            for child in field.fields {
+                assert_documented(&object[child.name], child);
+            }
+        }
+    }
+
+    #[test]
+    fn schema_covers_host_config() {
+        let hosts = vec![Host {
+            hostname: "node1".to_string(),
+            dhcp_fallback: Some(true),
+            match_mode: Some(MatchMode::All),
+            labels: BTreeMap::from([("site".to_string(), "berlin".to_string())]),
+            dns: Some(Dns {
+                servers: vec!["192.168.1.1".to_string()],
+                search: vec!["example.com".to_string()],
+            }),
+            ntp: Some(Ntp {
+                servers: vec!["ntp.example.com".to_string()],
+                client: Some(NtpClient::Chrony),
+            }),
+            probes: vec![Probe {
+                probe_type: ProbeType::Http,
+                target: "https://mgmt.example.com/healthz".to_string(),
+                timeout: 10,
+                severity: Severity::Warn,
+            }],
+            interfaces: vec![Interface {
+                logical_name: "eth0".to_string(),
+                mac_address: Some("00:11:22:33:44:55".to_string()),
+                interface_type: "ethernet".to_string(),
+                management: true,
+                description: Some("uplink".to_string()),
+                altnames: vec!["enp1s0".to_string()],
+                verification: Some(Verification {
+                    timeout: 30,
+                    severity: Severity::Warn,
+                }),
+                profiles: vec!["dhcp".to_string()],
+                pci_address: Some("0000:3b:00.0".to_string()),
+                sriov: Some(Sriov { total_vfs: 8 }),
+            }],
+        }];
+
+        let value = serde_json::to_value(hosts).unwrap();
+        assert_documented(&value, &HOSTS);
+    }
+
+    #[test]
+    fn find_fields() {
+        assert_eq!(find_field("hosts").unwrap().name, "hosts");
+        assert_eq!(
+            find_field("hosts.interfaces.mac_address").unwrap().name,
+            "mac_address"
+        );
+        assert_eq!(
+            find_field("hosts.interfaces.macAddress").unwrap().name,
+            "mac_address"
+        );
+        assert_eq!(
+            find_field("hosts.interfaces.verification.severity")
+                .unwrap()
+                .name,
+            "severity"
+        );
+
+        assert_eq!(
+            find_field("hosts.interfaces.mtu").unwrap_err().to_string(),
+            "Unknown field 'mtu' of 'hosts.interfaces.mtu'"
+        );
+        assert_eq!(
+            find_field("interfaces").unwrap_err().to_string(),
+            "Unknown field 'interfaces', paths start with 'hosts'"
+        );
+    }
+
+    #[test]
+    fn format_fields() {
+        let field = find_field("hosts.interfaces.verification").unwrap();
+
+        assert_eq!(
+            format_field(field, false),
+            "FIELD: verification <object>
+
+DESCRIPTION:
+    How the interface is checked by verify.
+
+FIELDS:
+    timeout <integer>
+      Seconds to wait for the link to come up, e.g. for LTE modems or bridges waiting for STP to converge.
+    severity <string>
+      Whether failed checks of the interface fail the verification.
+"
+        );
+
+        let field = find_field("hosts.interfaces.verification.severity").unwrap();
+        assert_eq!(
+            format_field(field, false),
+            "FIELD: severity <string>
+
+DESCRIPTION:
+    Whether failed checks of the interface fail the verification.
+
+VALUES:
+    critical
+    warn
+    ignore
+"
+        );
+
+        let field = find_field("hosts.interfaces").unwrap();
+        assert!(format_field(field, true).ends_with(
+            "    verification <object>
+      timeout <integer>
+      severity <string>
+    profiles <[]string>
+    pci_address <string>
+    sriov <object>
+      total_vfs <integer>
+"
+        ));
+    }
+}
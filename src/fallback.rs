@@ -0,0 +1,339 @@
+use std::collections::BTreeMap;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use anyhow::Context;
+use log::{debug, info, warn};
+
+use crate::filesystem::FileSystem;
+use crate::state::{checksum, State};
+
+/// Directory next to the state file keeping a copy of the last successfully verified config.
+const LAST_KNOWN_GOOD_DIR: &str = "last-known-good";
+const STATE_FILE_NAME: &str = "state.yaml";
+/// Extension of the dir the copy is staged in before replacing the kept one.
+const STAGING_EXTENSION: &str = "tmp";
+
+fn last_known_good_dir(state_file: &str) -> PathBuf {
+    Path::new(state_file)
+        .parent()
+        .unwrap_or(Path::new(""))
+        .join(LAST_KNOWN_GOOD_DIR)
+}
+
+/// Returns the path of the copy of a stored file, mirroring its full path, since drop-ins, dispatcher scripts
+/// and connection files stored in different dirs may share a name.
+fn kept_path(dir: &Path, path: &Path) -> PathBuf {
+    dir.join(path.strip_prefix("/").unwrap_or(path))
+}
+
+/// Keep a copy of the connection files stored during the last apply after they were successfully verified.
+///
+/// The copy is only replaced if the stored files changed since it was taken.
+pub(crate) fn save_last_known_good(
+    filesystem: &dyn FileSystem,
+    state_file: &str,
+) -> Result<(), anyhow::Error> {
+    let Some(state) = State::load(filesystem, state_file)? else {
+        return Ok(());
+    };
+
+    let checksums = state
+        .connection_files
+        .iter()
+        .map(|path| Ok((path.clone(), checksum(filesystem, path)?)))
+        .collect::<Result<BTreeMap<_, _>, io::Error>>()
+        .context("Computing checksums of connection files")?;
+
+    let dir = last_known_good_dir(state_file);
+    if let Some(kept) = load_kept_state(filesystem, &dir)? {
+        if kept.hostname == state.hostname
+            && kept.connection_files == state.connection_files
+            && kept.checksums == checksums
+            && kept.verification == state.verification
+            && kept.probes == state.probes
+        {
+            debug!("Last-known-good config is up to date");
+            return Ok(());
+        }
+    }
+
+    // Populate a staging directory first, so that a failure never leaves a partial copy behind.
+    // A leftover of an interrupted run is replaced.
+    let tmp_dir = dir.with_extension(STAGING_EXTENSION);
+    filesystem
+        .remove_dir_all(&tmp_dir)
+        .context("Removing staged last-known-good config")?;
+
+    for path in &state.connection_files {
+        let copy = kept_path(&tmp_dir, path);
+        if let Some(parent) = copy.parent() {
+            filesystem
+                .create_dir_all(parent)
+                .with_context(|| format!("Creating {parent:?}"))?;
+        }
+
+        copy_atomically(filesystem, path, &copy).with_context(|| format!("Copying {path:?}"))?;
+    }
+
+    State {
+        hostname: state.hostname,
+        connection_files: state.connection_files,
+        checksums,
+        verification: state.verification,
+        probes: state.probes,
+    }
+    .save(filesystem, &tmp_dir.join(STATE_FILE_NAME).to_string_lossy())?;
+
+    filesystem
+        .remove_dir_all(&dir)
+        .context("Removing previous last-known-good config")?;
+    filesystem
+        .rename(&tmp_dir, &dir)
+        .context("Replacing last-known-good config")?;
+
+    info!("Kept last-known-good config in {dir:?}");
+
+    Ok(())
+}
+
+/// Restore the connection files of the last-known-good config and remove the ones stored since.
+///
+/// Returns whether any changes were made, i.e. `false` if there is no last-known-good config
+/// or it is already in place.
+pub(crate) fn restore_last_known_good(
+    filesystem: &dyn FileSystem,
+    state_file: &str,
+) -> Result<bool, anyhow::Error> {
+    let dir = last_known_good_dir(state_file);
+    let Some(kept) = load_kept_state(filesystem, &dir)? else {
+        warn!("No last-known-good config to fall back to");
+        return Ok(false);
+    };
+
+    let current = State::load(filesystem, state_file)?.unwrap_or_default();
+
+    let in_place = current.connection_files == kept.connection_files
+        && kept.checksums.iter().all(|(path, expected)| {
+            checksum(filesystem, path).is_ok_and(|actual| &actual == expected)
+        });
+    if in_place {
+        info!("Last-known-good config is already in place");
+        return Ok(false);
+    }
+
+    for path in &current.connection_files {
+        if kept.manages(path) || filesystem.read(path)?.is_none() {
+            continue;
+        }
+
+        filesystem
+            .remove_file(path)
+            .with_context(|| format!("Removing {path:?}"))?;
+        info!(file = &*path.to_string_lossy(); "Removed {path:?}");
+    }
+
+    for path in &kept.connection_files {
+        copy_atomically(filesystem, &kept_path(&dir, path), path)
+            .with_context(|| format!("Restoring {path:?}"))?;
+        info!(file = &*path.to_string_lossy(); "Restored {path:?}");
+    }
+
+    kept.save(filesystem, state_file).context("Saving state")?;
+
+    Ok(true)
+}
+
+/// Copy the file along with its permissions (e.g. the restrictive ones of connection files). The destination
+/// is replaced atomically, so that a crash while falling back never leaves a truncated file behind.
+fn copy_atomically(
+    filesystem: &dyn FileSystem,
+    source: &Path,
+    destination: &Path,
+) -> io::Result<()> {
+    let contents = filesystem
+        .read(source)?
+        .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, format!("{source:?}")))?;
+    // Filesystems not tracking permissions get the ones of connection files.
+    let mode = filesystem.permissions(source)?.unwrap_or(0o600);
+
+    filesystem.write(destination, &contents, mode)?;
+    // An existing file keeps its permissions and a created one is subject to the umask otherwise.
+    filesystem.set_permissions(destination, mode)
+}
+
+fn load_kept_state(
+    filesystem: &dyn FileSystem,
+    dir: &Path,
+) -> Result<Option<State>, anyhow::Error> {
+    State::load(filesystem, &dir.join(STATE_FILE_NAME).to_string_lossy())
+        .context("Loading last-known-good state")
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::Path;
+
+    use crate::fallback::{
+        kept_path, last_known_good_dir, restore_last_known_good, save_last_known_good,
+        STATE_FILE_NAME,
+    };
+    use crate::filesystem::{Disk, FileSystem, Memory};
+    use crate::state::State;
+
+    #[test]
+    fn last_known_good_dir_next_to_state_file() {
+        assert_eq!(
+            last_known_good_dir("/var/lib/nm-configurator/state.yaml"),
+            Path::new("/var/lib/nm-configurator/last-known-good")
+        );
+    }
+
+    #[test]
+    fn kept_paths_mirror_stored_paths() {
+        let dir = Path::new("/var/lib/nm-configurator/last-known-good");
+        assert_eq!(
+            kept_path(dir, Path::new("/etc/NetworkManager/conf.d/10-nmc.conf")),
+            dir.join("etc/NetworkManager/conf.d/10-nmc.conf")
+        );
+        assert_eq!(
+            kept_path(dir, Path::new("connections/eth0.nmconnection")),
+            dir.join("connections/eth0.nmconnection")
+        );
+    }
+
+    #[test]
+    fn save_and_restore_last_known_good() {
+        let dir = Path::new("_fallback");
+        let connections_dir = dir.join("connections");
+        fs::create_dir_all(&connections_dir).unwrap();
+        let state_file = dir.join("state.yaml");
+        let state_file = state_file.to_str().unwrap();
+
+        let eth0 = connections_dir.join("eth0.nmconnection");
+        let eth1 = connections_dir.join("eth1.nmconnection");
+        fs::write(&eth0, "[connection]\nid=eth0\n").unwrap();
+        fs::set_permissions(&eth0, fs::Permissions::from_mode(0o600)).unwrap();
+        // Files of the same name in different dirs, e.g. a NetworkManager.conf and an NTP drop-in
+        let nm_drop_in = dir.join("conf.d/10-nmc.conf");
+        let ntp_drop_in = dir.join("chrony.d/10-nmc.conf");
+        for (path, contents) in [(&nm_drop_in, "[main]\n"), (&ntp_drop_in, "server ntp1\n")] {
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, contents).unwrap();
+        }
+
+        // Nothing to keep or restore without a state
+        save_last_known_good(&Disk, state_file).unwrap();
+        assert!(!dir.join("last-known-good").exists());
+        assert!(!restore_last_known_good(&Disk, state_file).unwrap());
+
+        State {
+            hostname: "node1".to_string(),
+            connection_files: vec![eth0.clone(), nm_drop_in.clone(), ntp_drop_in.clone()],
+            checksums: BTreeMap::new(),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        }
+        .save(&Disk, state_file)
+        .unwrap();
+
+        save_last_known_good(&Disk, state_file).unwrap();
+        assert_eq!(
+            fs::read_to_string(dir.join("last-known-good/_fallback/connections/eth0.nmconnection"))
+                .unwrap(),
+            "[connection]\nid=eth0\n"
+        );
+        assert!(dir.join("last-known-good").join(STATE_FILE_NAME).exists());
+        assert!(!dir.join("last-known-good.tmp").exists());
+
+        // The kept config is already in place
+        assert!(!restore_last_known_good(&Disk, state_file).unwrap());
+
+        // Simulate a bad apply modifying eth0 and the drop-ins and adding eth1
+        fs::write(&eth0, "[connection]\nid=eth0\nautoconnect=false\n").unwrap();
+        fs::set_permissions(&eth0, fs::Permissions::from_mode(0o644)).unwrap();
+        fs::write(&eth1, "[connection]\nid=eth1\n").unwrap();
+        fs::write(&nm_drop_in, "[main]\ndns=none\n").unwrap();
+        fs::write(&ntp_drop_in, "server ntp2\n").unwrap();
+        State {
+            hostname: "node1".to_string(),
+            connection_files: vec![
+                eth0.clone(),
+                eth1.clone(),
+                nm_drop_in.clone(),
+                ntp_drop_in.clone(),
+            ],
+            checksums: BTreeMap::new(),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        }
+        .save(&Disk, state_file)
+        .unwrap();
+
+        assert!(restore_last_known_good(&Disk, state_file).unwrap());
+        assert_eq!(
+            fs::read_to_string(&eth0).unwrap(),
+            "[connection]\nid=eth0\n"
+        );
+        assert_eq!(
+            fs::metadata(&eth0).unwrap().permissions().mode() & 0o777,
+            0o600
+        );
+        // Replaced atomically, leaving no temporary files behind
+        assert_eq!(fs::read_dir(&connections_dir).unwrap().count(), 1);
+        assert!(!eth1.exists());
+        assert_eq!(fs::read_to_string(&nm_drop_in).unwrap(), "[main]\n");
+        assert_eq!(fs::read_to_string(&ntp_drop_in).unwrap(), "server ntp1\n");
+
+        let state = State::load(&Disk, state_file).unwrap().unwrap();
+        assert_eq!(state.connection_files, vec![eth0, nm_drop_in, ntp_drop_in]);
+        assert_eq!(state.checksums.len(), 3);
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn save_and_restore_last_known_good_in_memory() {
+        let filesystem = Memory::default();
+        let state_file = "/var/lib/nm-configurator/state.yaml";
+        let eth0 = Path::new("/etc/NetworkManager/system-connections/eth0.nmconnection");
+
+        filesystem.write(eth0, b"[connection]\n", 0o600).unwrap();
+        State {
+            hostname: "node1".to_string(),
+            connection_files: vec![eth0.to_path_buf()],
+            checksums: BTreeMap::new(),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        }
+        .save(&filesystem, state_file)
+        .unwrap();
+
+        save_last_known_good(&filesystem, state_file).unwrap();
+        assert_eq!(
+            filesystem
+                .read(Path::new(
+                    "/var/lib/nm-configurator/last-known-good/etc/NetworkManager/system-connections/eth0.nmconnection"
+                ))
+                .unwrap(),
+            Some(b"[connection]\n".to_vec())
+        );
+
+        filesystem
+            .write(eth0, b"[connection]\nautoconnect=false\n", 0o600)
+            .unwrap();
+        assert!(restore_last_known_good(&filesystem, state_file).unwrap());
+        assert_eq!(
+            filesystem.read(eth0).unwrap(),
+            Some(b"[connection]\n".to_vec())
+        );
+        assert!(!filesystem
+            .files()
+            .keys()
+            .any(|path| path.starts_with("/var/lib/nm-configurator/last-known-good.tmp")));
+    }
+}
@@ -0,0 +1,246 @@
+use std::collections::BTreeMap;
+
+use anyhow::anyhow;
+
+/// Maturity of a feature guarded by a gate.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(crate) enum Stage {
+    /// Disabled by default, may change or be removed without notice.
+    Alpha,
+    /// Enabled by default, can still be disabled in case of problems.
+    // No feature has reached beta yet.
+    #[allow(dead_code)]
+    Beta,
+}
+
+impl Stage {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Stage::Alpha => "Alpha",
+            Stage::Beta => "Beta",
+        }
+    }
+
+    fn default_enabled(&self) -> bool {
+        matches!(self, Stage::Beta)
+    }
+}
+
+/// Gate guarding a subsystem which ships before it is considered stable.
+#[derive(Debug)]
+pub(crate) struct FeatureGate {
+    pub(crate) name: &'static str,
+    pub(crate) stage: Stage,
+    pub(crate) description: &'static str,
+}
+
+/// Gates known to this build. Gates are added along with the subsystems they guard and removed once those
+/// graduate, after which passing them fails like any other unknown gate.
+pub(crate) const FEATURE_GATES: &[FeatureGate] = &[CONTROLLER, CONFIG_SERVER];
+
+/// Generating the configs from the `NodeNetworkConfig` resources of a Kubernetes cluster.
+pub(crate) const CONTROLLER: FeatureGate = FeatureGate {
+    name: "Controller",
+    stage: Stage::Alpha,
+    description: "The Kubernetes controller mode",
+};
+
+/// Serving the configs of the hosts over HTTP.
+pub(crate) const CONFIG_SERVER: FeatureGate = FeatureGate {
+    name: "ConfigServer",
+    stage: Stage::Alpha,
+    description: "The config server",
+};
+
+/// Features enabled for the run, e.g. via `--feature-gates Controller=true,ConfigServer=true`.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub(crate) struct FeatureGates {
+    /// Gates set explicitly, taking precedence over the defaults of their stages.
+    overrides: BTreeMap<&'static str, bool>,
+}
+
+impl FeatureGates {
+    /// Parse a comma separated list of `<Name>=<true|false>` pairs, rejecting gates unknown to this build.
+    pub(crate) fn parse(spec: &str, known: &'static [FeatureGate]) -> Result<Self, anyhow::Error> {
+        let mut overrides = BTreeMap::new();
+
+        for pair in spec
+            .split(',')
+            .map(str::trim)
+            .filter(|pair| !pair.is_empty())
+        {
+            let (name, value) = pair.split_once('=').ok_or_else(|| {
+                anyhow!("Invalid feature gate '{pair}', expected '<Name>=<true|false>'")
+            })?;
+
+            let gate = known
+                .iter()
+                .find(|gate| gate.name == name.trim())
+                .ok_or_else(|| {
+                    anyhow!("Unknown feature gate '{}', see 'nmc features'", name.trim())
+                })?;
+
+            let enabled = value.trim().parse().map_err(|_| {
+                anyhow!(
+                    "Invalid value '{}' of feature gate '{}'",
+                    value.trim(),
+                    gate.name
+                )
+            })?;
+
+            overrides.insert(gate.name, enabled);
+        }
+
+        Ok(FeatureGates { overrides })
+    }
+
+    pub(crate) fn enabled(&self, gate: &FeatureGate) -> bool {
+        self.overrides
+            .get(gate.name)
+            .copied()
+            .unwrap_or_else(|| gate.stage.default_enabled())
+    }
+
+    /// Fail unless the gate is enabled, naming the flag enabling it.
+    pub(crate) fn require(&self, gate: &FeatureGate) -> Result<(), anyhow::Error> {
+        if self.enabled(gate) {
+            return Ok(());
+        }
+
+        Err(anyhow!(
+            "{} is an experimental feature, enable it via --feature-gates {}=true",
+            gate.description,
+            gate.name
+        ))
+    }
+}
+
+const COLUMNS: [&str; 4] = ["NAME", "STAGE", "ENABLED", "DESCRIPTION"];
+
+/// Print the known gates along with whether they are enabled for the given flags.
+pub(crate) fn print_features(gates: &FeatureGates) {
+    print!("{}", format_features(FEATURE_GATES, gates));
+}
+
+fn format_features(known: &[FeatureGate], gates: &FeatureGates) -> String {
+    let rows: Vec<[String; 4]> = known
+        .iter()
+        .map(|gate| {
+            [
+                gate.name.to_string(),
+                gate.stage.as_str().to_string(),
+                gates.enabled(gate).to_string(),
+                gate.description.to_string(),
+            ]
+        })
+        .collect();
+
+    let mut widths = COLUMNS.map(str::len);
+    for row in &rows {
+        for (width, value) in widths.iter_mut().zip(row) {
+            *width = (*width).max(value.len());
+        }
+    }
+
+    let format_row = |values: &[&str]| {
+        let line = values
+            .iter()
+            .zip(widths)
+            .map(|(value, width)| format!("{value:width$}"))
+            .collect::<Vec<_>>()
+            .join("  ");
+
+        format!("{}\n", line.trim_end())
+    };
+
+    let mut table = format_row(&COLUMNS);
+    for row in &rows {
+        let values: Vec<&str> = row.iter().map(String::as_str).collect();
+        table.push_str(&format_row(&values));
+    }
+
+    table
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::features::{
+        format_features, FeatureGate, FeatureGates, Stage, CONFIG_SERVER, CONTROLLER, FEATURE_GATES,
+    };
+
+    const GATES: &[FeatureGate] = &[
+        FeatureGate {
+            name: "DbusApply",
+            stage: Stage::Alpha,
+            description: "Applying the config via D-Bus",
+        },
+        FeatureGate {
+            name: "Checkpoints",
+            stage: Stage::Beta,
+            description: "Rolling back via checkpoints",
+        },
+    ];
+
+    #[test]
+    fn parse_feature_gates() {
+        let gates = FeatureGates::parse("", GATES).unwrap();
+        assert!(!gates.enabled(&GATES[0]));
+        assert!(gates.enabled(&GATES[1]));
+
+        let gates = FeatureGates::parse("DbusApply=true, Checkpoints=false", GATES).unwrap();
+        assert!(gates.enabled(&GATES[0]));
+        assert!(!gates.enabled(&GATES[1]));
+
+        assert_eq!(
+            FeatureGates::parse("Dbus=true", GATES)
+                .unwrap_err()
+                .to_string(),
+            "Unknown feature gate 'Dbus', see 'nmc features'"
+        );
+        assert_eq!(
+            FeatureGates::parse("DbusApply", GATES)
+                .unwrap_err()
+                .to_string(),
+            "Invalid feature gate 'DbusApply', expected '<Name>=<true|false>'"
+        );
+        assert_eq!(
+            FeatureGates::parse("DbusApply=yes", GATES)
+                .unwrap_err()
+                .to_string(),
+            "Invalid value 'yes' of feature gate 'DbusApply'"
+        );
+    }
+
+    #[test]
+    fn parse_known_feature_gates() {
+        let gates =
+            FeatureGates::parse("Controller=true,ConfigServer=true", FEATURE_GATES).unwrap();
+        assert!(gates.enabled(&CONTROLLER));
+        assert!(gates.enabled(&CONFIG_SERVER));
+    }
+
+    #[test]
+    fn require_feature_gate() {
+        let gates = FeatureGates::default();
+
+        assert!(gates.require(&GATES[1]).is_ok());
+        assert_eq!(
+            gates.require(&GATES[0]).unwrap_err().to_string(),
+            "Applying the config via D-Bus is an experimental feature, enable it via --feature-gates DbusApply=true"
+        );
+    }
+
+    #[test]
+    fn format_feature_gates() {
+        let gates = FeatureGates::parse("Checkpoints=false", GATES).unwrap();
+
+        assert_eq!(
+            format_features(GATES, &gates),
+            "\
+NAME         STAGE  ENABLED  DESCRIPTION
+DbusApply    Alpha  false    Applying the config via D-Bus
+Checkpoints  Beta   false    Rolling back via checkpoints
+"
+        );
+    }
+}
@@ -0,0 +1,159 @@
+use std::path::Path;
+
+use anyhow::anyhow;
+use log::{debug, warn};
+
+/// Patterns of file names (e.g. `*.md`) deciding how files which are not part of the config are treated.
+#[derive(Debug, Default)]
+pub(crate) struct FileFilter {
+    /// Files skipped silently, e.g. documentation.
+    pub(crate) ignore: Vec<String>,
+    /// Files failing the run, e.g. backups which are likely meant to be used instead.
+    pub(crate) deny: Vec<String>,
+}
+
+/// Classification of a file according to the filter patterns.
+#[derive(Debug, PartialEq)]
+pub(crate) enum FileClass {
+    /// Matches an ignore pattern.
+    Ignored,
+    /// Matches the given deny pattern. Takes precedence over the ignore patterns.
+    Denied(String),
+    /// Matches none of the patterns.
+    Unlisted,
+}
+
+impl FileFilter {
+    pub(crate) fn classify(&self, path: &Path) -> FileClass {
+        let name = path
+            .file_name()
+            .map(|name| name.to_string_lossy())
+            .unwrap_or_default();
+
+        if let Some(pattern) = self.deny.iter().find(|pattern| matches(pattern, &name)) {
+            return FileClass::Denied(pattern.clone());
+        }
+
+        if self.ignore.iter().any(|pattern| matches(pattern, &name)) {
+            return FileClass::Ignored;
+        }
+
+        FileClass::Unlisted
+    }
+
+    /// Handle a file which is not part of the config found in the given location.
+    ///
+    /// Unlisted files are skipped with a warning since they may be misnamed config files.
+    pub(crate) fn check_unexpected(
+        &self,
+        path: &Path,
+        location: &str,
+    ) -> Result<(), anyhow::Error> {
+        match self.classify(path) {
+            FileClass::Ignored => {
+                debug!("Ignoring file in {location}: {path:?}");
+                Ok(())
+            }
+            FileClass::Denied(pattern) => Err(denied(path, location, &pattern)),
+            FileClass::Unlisted => {
+                warn!("Ignoring unexpected file in {location}: {path:?}");
+                Ok(())
+            }
+        }
+    }
+}
+
+pub(crate) fn denied(path: &Path, location: &str, pattern: &str) -> anyhow::Error {
+    anyhow!("File {path:?} in {location} matches denied pattern '{pattern}'")
+}
+
+/// Match the name against a pattern where `*` matches any sequence of characters and `?` any single one.
+fn matches(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+
+    let (mut p, mut n) = (0, 0);
+    // Position of the last `*` in the pattern and the position in the name it was tried at.
+    let mut backtrack: Option<(usize, usize)> = None;
+
+    while n < name.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                backtrack = Some((p, n));
+                p += 1;
+            }
+            Some(&c) if c == '?' || c == name[n] => {
+                p += 1;
+                n += 1;
+            }
+            _ => match backtrack {
+                Some((star, tried)) => {
+                    p = star + 1;
+                    n = tried + 1;
+                    backtrack = Some((star, tried + 1));
+                }
+                None => return false,
+            },
+        }
+    }
+
+    pattern[p..].iter().all(|&c| c == '*')
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::Path;
+
+    use crate::file_filter::{matches, FileClass, FileFilter};
+
+    #[test]
+    fn match_patterns() {
+        assert!(matches("*.md", "README.md"));
+        assert!(matches("*.md", ".md"));
+        assert!(!matches("*.md", "README.mdx"));
+        assert!(matches("*.nmconnection.bak", "eth0.nmconnection.bak"));
+        assert!(!matches("*.nmconnection.bak", "eth0.nmconnection"));
+        assert!(matches("eth?.nmconnection", "eth1.nmconnection"));
+        assert!(!matches("eth?.nmconnection", "eth10.nmconnection"));
+        assert!(matches("*", ""));
+        assert!(matches("a*b*c", "aXbYbZc"));
+        assert!(!matches("a*b*c", "aXbYbZ"));
+        assert!(matches("README", "README"));
+        assert!(!matches("", "README"));
+    }
+
+    #[test]
+    fn classify_files() {
+        let filter = FileFilter {
+            ignore: vec!["*.md".to_string(), "*.bak".to_string()],
+            deny: vec!["*.nmconnection.bak".to_string()],
+        };
+
+        assert_eq!(
+            filter.classify(Path::new("common/README.md")),
+            FileClass::Ignored
+        );
+        assert_eq!(
+            filter.classify(Path::new("node1/eth0.nmconnection.bak")),
+            FileClass::Denied("*.nmconnection.bak".to_string())
+        );
+        assert_eq!(
+            filter.classify(Path::new("node1/eth0.nmconection")),
+            FileClass::Unlisted
+        );
+
+        assert!(filter
+            .check_unexpected(Path::new("common/README.md"), "common config dir")
+            .is_ok());
+        assert!(filter
+            .check_unexpected(Path::new("common/notes.txt"), "common config dir")
+            .is_ok());
+        assert_eq!(
+            filter
+                .check_unexpected(Path::new("node1/eth0.nmconnection.bak"), "host config dir")
+                .unwrap_err()
+                .to_string(),
+            "File \"node1/eth0.nmconnection.bak\" in host config dir matches denied pattern '*.nmconnection.bak'"
+        );
+    }
+}
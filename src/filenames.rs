@@ -0,0 +1,167 @@
+use std::collections::HashMap;
+
+use anyhow::anyhow;
+
+use crate::types::PROFILE_SEPARATOR;
+
+/// Longest interface name accepted by the kernel (`IFNAMSIZ` without the terminating NUL).
+const MAX_INTERFACE_NAME_LEN: usize = 15;
+
+/// Ensure that the interface name is accepted by the kernel, and thereby NetworkManager and udev.
+pub(crate) fn validate_interface_name(name: &str) -> Result<(), anyhow::Error> {
+    if name.is_empty() || name == "." || name == ".." {
+        return Err(anyhow!("Invalid interface name '{name}'"));
+    }
+
+    if name.len() > MAX_INTERFACE_NAME_LEN {
+        return Err(anyhow!(
+            "Interface name '{name}' exceeds {MAX_INTERFACE_NAME_LEN} characters"
+        ));
+    }
+
+    if let Some(c) = name
+        .chars()
+        .find(|c| *c == '/' || *c == ':' || c.is_whitespace() || c.is_control())
+    {
+        return Err(anyhow!(
+            "Interface name '{name}' contains invalid character {c:?}"
+        ));
+    }
+
+    Ok(())
+}
+
+/// Ensure that the hostname can name the host's dir of a config dir and be passed to commands such as `tar`,
+/// i.e. that it is a single path component which is neither hidden nor mistaken for an option. The profile
+/// separator is reserved for the names of additional profiles.
+pub(crate) fn validate_hostname(hostname: &str) -> Result<(), anyhow::Error> {
+    if hostname.is_empty()
+        || hostname.starts_with(['.', '-'])
+        || hostname.contains(['/', PROFILE_SEPARATOR])
+        || hostname
+            .chars()
+            .any(|c| c.is_whitespace() || c.is_control())
+    {
+        return Err(anyhow!("Invalid hostname '{hostname}'"));
+    }
+
+    Ok(())
+}
+
+/// Ensure that the files can be stored under the given names and are picked up on the device.
+///
+/// Hidden and backup files are ignored by NetworkManager, and names only differing in case collide
+/// when building the artifacts on case-insensitive filesystems (e.g. on macOS CI runners).
+pub(crate) fn check_filenames<'a>(
+    filenames: impl IntoIterator<Item = &'a str>,
+) -> Result<(), anyhow::Error> {
+    let mut seen: HashMap<String, &str> = HashMap::new();
+
+    for filename in filenames {
+        if filename.is_empty()
+            || filename.starts_with('.')
+            || filename.ends_with('~')
+            || filename.contains(['/', '\0'])
+            || filename.chars().any(char::is_control)
+        {
+            return Err(anyhow!("Invalid file name '{filename}'"));
+        }
+
+        if let Some(other) = seen.insert(filename.to_lowercase(), filename) {
+            if other != filename {
+                return Err(anyhow!(
+                    "File names '{other}' and '{filename}' only differ in case"
+                ));
+            }
+        }
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::filenames::{check_filenames, validate_hostname, validate_interface_name};
+
+    #[test]
+    fn validate_interface_names() {
+        for name in [
+            "eth0",
+            "bond0.1365",
+            "br-ex",
+            "enp0s31f6",
+            "ens1f0np0v12345",
+        ] {
+            assert!(validate_interface_name(name).is_ok(), "{name}");
+        }
+
+        for (name, error) in [
+            ("", "Invalid interface name ''"),
+            ("..", "Invalid interface name '..'"),
+            (
+                "enp0s31f6np0.100",
+                "Interface name 'enp0s31f6np0.100' exceeds 15 characters",
+            ),
+            (
+                "eth0:1",
+                "Interface name 'eth0:1' contains invalid character ':'",
+            ),
+            (
+                "eth 0",
+                "Interface name 'eth 0' contains invalid character ' '",
+            ),
+            (
+                "eth/0",
+                "Interface name 'eth/0' contains invalid character '/'",
+            ),
+        ] {
+            assert_eq!(
+                validate_interface_name(name).unwrap_err().to_string(),
+                error
+            );
+        }
+    }
+
+    #[test]
+    fn validate_hostnames() {
+        for hostname in ["node1", "node1.example.com", "edge_01"] {
+            assert!(validate_hostname(hostname).is_ok(), "{hostname}");
+        }
+
+        for hostname in [
+            "",
+            ".",
+            "..",
+            "../etc",
+            ".node1",
+            "-node1",
+            "a/b",
+            "node1@dhcp",
+            "node 1",
+        ] {
+            assert_eq!(
+                validate_hostname(hostname).unwrap_err().to_string(),
+                format!("Invalid hostname '{hostname}'")
+            );
+        }
+    }
+
+    #[test]
+    fn check_file_names() {
+        assert!(check_filenames(["eth0.nmconnection", "eth0@dhcp.nmconnection"]).is_ok());
+
+        assert_eq!(
+            check_filenames(["eth0.nmconnection", "ETH0.nmconnection"])
+                .unwrap_err()
+                .to_string(),
+            "File names 'eth0.nmconnection' and 'ETH0.nmconnection' only differ in case"
+        );
+
+        for filename in [".eth0.nmconnection", "eth0.nmconnection~", "a/b", ""] {
+            assert_eq!(
+                check_filenames([filename]).unwrap_err().to_string(),
+                format!("Invalid file name '{filename}'")
+            );
+        }
+    }
+}
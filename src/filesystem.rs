@@ -0,0 +1,514 @@
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::io::{self, Write};
+use std::os::unix::fs::{chown, MetadataExt, OpenOptionsExt, PermissionsExt};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+/// Destination of the files written by `generate` and `apply`, so that they can be kept in memory
+/// (e.g. for tests or dry runs) or packaged (e.g. into an archive) instead of being written to disk.
+pub trait FileSystem {
+    /// Returns the contents of the file, `None` if it does not exist.
+    fn read(&self, path: &Path) -> io::Result<Option<Vec<u8>>>;
+
+    fn create_dir_all(&self, path: &Path) -> io::Result<()>;
+
+    /// Create the dir along with its missing parents and set its permissions, unless it already exists,
+    /// in which case they are left untouched. Filesystems not tracking permissions only create it.
+    fn create_dir_with_mode(&self, path: &Path, _mode: u32) -> io::Result<()> {
+        self.create_dir_all(path)
+    }
+
+    /// Replace the contents of the file. The mode only applies if the file is created by the call and is subject
+    /// to the umask on disk, i.e. `0o666` matches the permissions of `std::fs::write`.
+    ///
+    /// On disk, the file is replaced atomically, so that readers (e.g. NetworkManager) never see a truncated one,
+    /// not even after a power loss.
+    fn write(&self, path: &Path, contents: &[u8], mode: u32) -> io::Result<()>;
+
+    /// Append to the file, creating it if it does not exist.
+    fn append(&self, path: &Path, contents: &[u8]) -> io::Result<()>;
+
+    fn set_permissions(&self, path: &Path, mode: u32) -> io::Result<()>;
+
+    /// Returns the permissions of the file, `None` if it does not exist or they are not tracked.
+    fn permissions(&self, _path: &Path) -> io::Result<Option<u32>> {
+        Ok(None)
+    }
+
+    /// Change the owner and group of the file to the user, e.g. root for dispatcher scripts.
+    ///
+    /// Only needed for applying configs, hence not supported unless implemented.
+    fn set_owner(&self, path: &Path, _uid: u32) -> io::Result<()> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            format!("Changing the owner of {path:?} is not supported"),
+        ))
+    }
+
+    /// Remove the file, succeeding if it does not exist.
+    ///
+    /// Only needed for applying configs (e.g. pruning stale files), hence not supported unless implemented.
+    fn remove_file(&self, path: &Path) -> io::Result<()> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            format!("Removing {path:?} is not supported"),
+        ))
+    }
+
+    /// Remove the dir along with its contents, succeeding if it does not exist.
+    ///
+    /// Only needed for regenerating cached configs and applying configs, hence not supported unless implemented.
+    fn remove_dir_all(&self, path: &Path) -> io::Result<()> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            format!("Removing {path:?} is not supported"),
+        ))
+    }
+
+    /// Returns the paths of the files in the dir, leaving out subdirs. Empty if the dir does not exist.
+    ///
+    /// Only needed for applying configs (e.g. pruning the history), hence not supported unless implemented.
+    fn list_files(&self, path: &Path) -> io::Result<Vec<PathBuf>> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            format!("Listing {path:?} is not supported"),
+        ))
+    }
+
+    /// Move the file or dir, replacing an existing file or empty dir at the destination.
+    ///
+    /// Only needed for applying configs (e.g. keeping the last-known-good config), hence not supported
+    /// unless implemented.
+    fn rename(&self, from: &Path, _to: &Path) -> io::Result<()> {
+        Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            format!("Moving {from:?} is not supported"),
+        ))
+    }
+}
+
+/// The local filesystem.
+pub struct Disk;
+
+/// Marks the errors of writing or moving files into place on disk, as opposed to e.g. reading the config,
+/// so that they get their own exit code. Displays as the wrapped error.
+#[derive(Debug)]
+pub(crate) struct WriteFailed(io::Error);
+
+impl WriteFailed {
+    fn wrap(err: io::Error) -> io::Error {
+        io::Error::new(err.kind(), WriteFailed(err))
+    }
+
+    /// Returns the wrapped error if the error is a write failure.
+    pub(crate) fn unwrap(err: &io::Error) -> Option<&io::Error> {
+        err.get_ref()?
+            .downcast_ref::<WriteFailed>()
+            .map(|failure| &failure.0)
+    }
+}
+
+impl fmt::Display for WriteFailed {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        self.0.fmt(f)
+    }
+}
+
+impl std::error::Error for WriteFailed {}
+
+impl FileSystem for Disk {
+    fn read(&self, path: &Path) -> io::Result<Option<Vec<u8>>> {
+        match fs::read(path) {
+            Ok(contents) => Ok(Some(contents)),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(None),
+            Err(err) => Err(err),
+        }
+    }
+
+    fn create_dir_all(&self, path: &Path) -> io::Result<()> {
+        fs::create_dir_all(path)
+    }
+
+    fn create_dir_with_mode(&self, path: &Path, mode: u32) -> io::Result<()> {
+        if path.is_dir() {
+            return Ok(());
+        }
+
+        fs::create_dir_all(path)?;
+        fs::set_permissions(path, fs::Permissions::from_mode(mode))
+    }
+
+    fn write(&self, path: &Path, contents: &[u8], mode: u32) -> io::Result<()> {
+        let tmp_path = tmp_path(path)?;
+        // A leftover of an interrupted run would keep its permissions otherwise.
+        let _ = fs::remove_file(&tmp_path);
+
+        let result = write_replacement(path, &tmp_path, contents, mode);
+        if result.is_err() {
+            let _ = fs::remove_file(&tmp_path);
+        }
+
+        result.map_err(WriteFailed::wrap)
+    }
+
+    fn append(&self, path: &Path, contents: &[u8]) -> io::Result<()> {
+        fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .and_then(|mut file| file.write_all(contents))
+            .map_err(WriteFailed::wrap)
+    }
+
+    fn set_permissions(&self, path: &Path, mode: u32) -> io::Result<()> {
+        fs::set_permissions(path, fs::Permissions::from_mode(mode))
+    }
+
+    fn permissions(&self, path: &Path) -> io::Result<Option<u32>> {
+        match fs::metadata(path) {
+            Ok(metadata) => Ok(Some(metadata.permissions().mode() & 0o7777)),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(None),
+            Err(err) => Err(err),
+        }
+    }
+
+    fn set_owner(&self, path: &Path, uid: u32) -> io::Result<()> {
+        chown(path, Some(uid), Some(uid))
+    }
+
+    fn remove_file(&self, path: &Path) -> io::Result<()> {
+        match fs::remove_file(path) {
+            Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(()),
+            result => result,
+        }
+    }
+
+    fn remove_dir_all(&self, path: &Path) -> io::Result<()> {
+        match fs::remove_dir_all(path) {
+            Err(err) if err.kind() == io::ErrorKind::NotFound => Ok(()),
+            result => result,
+        }
+    }
+
+    fn list_files(&self, path: &Path) -> io::Result<Vec<PathBuf>> {
+        let read_dir = match fs::read_dir(path) {
+            Ok(read_dir) => read_dir,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(err) => return Err(err),
+        };
+
+        let mut files = Vec::new();
+        for entry in read_dir {
+            let entry = entry?;
+            if entry.file_type()?.is_file() {
+                files.push(entry.path());
+            }
+        }
+
+        files.sort();
+        Ok(files)
+    }
+
+    fn rename(&self, from: &Path, to: &Path) -> io::Result<()> {
+        fs::rename(from, to).map_err(WriteFailed::wrap)
+    }
+}
+
+/// Returns the path of the temporary file replacing the given one. It is hidden, so that NetworkManager
+/// does not pick it up as a connection file, and in the same dir, so that renaming it is atomic.
+fn tmp_path(path: &Path) -> io::Result<PathBuf> {
+    let name = path.file_name().ok_or_else(|| {
+        io::Error::new(
+            io::ErrorKind::InvalidInput,
+            format!("{path:?} is not a file path"),
+        )
+    })?;
+
+    let mut tmp_name = std::ffi::OsString::from(".");
+    tmp_name.push(name);
+    tmp_name.push(".nmc-tmp");
+    Ok(path.with_file_name(tmp_name))
+}
+
+/// Write the contents to the temporary file, carrying over the permissions and owner of an existing file,
+/// and move it into place once it is on disk.
+fn write_replacement(path: &Path, tmp_path: &Path, contents: &[u8], mode: u32) -> io::Result<()> {
+    let mut file = fs::OpenOptions::new()
+        .create_new(true)
+        .write(true)
+        .mode(mode)
+        .open(tmp_path)?;
+
+    match fs::metadata(path) {
+        Ok(existing) => {
+            file.set_permissions(existing.permissions())?;
+            chown(tmp_path, Some(existing.uid()), Some(existing.gid()))?;
+        }
+        Err(err) if err.kind() == io::ErrorKind::NotFound => {}
+        Err(err) => return Err(err),
+    }
+
+    file.write_all(contents)?;
+    file.sync_all()?;
+    fs::rename(tmp_path, path)?;
+
+    // The rename itself only survives a power loss once the dir is synced.
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+    fs::File::open(dir)?.sync_all()
+}
+
+/// Files kept in memory by their paths. Dirs are implied by the files and permissions are not tracked.
+///
+/// Clones share the files, so that they can be inspected after handing a clone to the code writing them.
+#[derive(Clone, Debug, Default)]
+pub struct Memory {
+    files: Arc<Mutex<BTreeMap<PathBuf, Vec<u8>>>>,
+}
+
+impl Memory {
+    /// Returns the files written so far.
+    pub fn files(&self) -> BTreeMap<PathBuf, Vec<u8>> {
+        self.lock().clone()
+    }
+
+    fn check_exists(&self, path: &Path) -> io::Result<()> {
+        if !self.lock().contains_key(path) {
+            return Err(io::Error::new(
+                io::ErrorKind::NotFound,
+                format!("{path:?} does not exist"),
+            ));
+        }
+
+        Ok(())
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, BTreeMap<PathBuf, Vec<u8>>> {
+        // The map is never left in an inconsistent state, so a panic of another holder is irrelevant.
+        self.files.lock().unwrap_or_else(|err| err.into_inner())
+    }
+}
+
+impl FileSystem for Memory {
+    fn read(&self, path: &Path) -> io::Result<Option<Vec<u8>>> {
+        Ok(self.lock().get(path).cloned())
+    }
+
+    fn create_dir_all(&self, _path: &Path) -> io::Result<()> {
+        Ok(())
+    }
+
+    fn write(&self, path: &Path, contents: &[u8], _mode: u32) -> io::Result<()> {
+        self.lock().insert(path.to_path_buf(), contents.to_vec());
+        Ok(())
+    }
+
+    fn append(&self, path: &Path, contents: &[u8]) -> io::Result<()> {
+        self.lock()
+            .entry(path.to_path_buf())
+            .or_default()
+            .extend_from_slice(contents);
+        Ok(())
+    }
+
+    fn set_permissions(&self, path: &Path, _mode: u32) -> io::Result<()> {
+        self.check_exists(path)
+    }
+
+    fn set_owner(&self, path: &Path, _uid: u32) -> io::Result<()> {
+        self.check_exists(path)
+    }
+
+    fn remove_file(&self, path: &Path) -> io::Result<()> {
+        self.lock().remove(path);
+        Ok(())
+    }
+
+    fn remove_dir_all(&self, path: &Path) -> io::Result<()> {
+        self.lock().retain(|file, _| !file.starts_with(path));
+        Ok(())
+    }
+
+    fn list_files(&self, path: &Path) -> io::Result<Vec<PathBuf>> {
+        Ok(self
+            .lock()
+            .keys()
+            .filter(|file| file.parent() == Some(path))
+            .cloned()
+            .collect())
+    }
+
+    fn rename(&self, from: &Path, to: &Path) -> io::Result<()> {
+        let mut files = self.lock();
+        let moved: Vec<PathBuf> = files
+            .keys()
+            .filter(|file| file.starts_with(from))
+            .cloned()
+            .collect();
+        if moved.is_empty() {
+            return Err(io::Error::new(
+                io::ErrorKind::NotFound,
+                format!("{from:?} does not exist"),
+            ));
+        }
+
+        files.retain(|file, _| !file.starts_with(to));
+        for file in moved {
+            let contents = files.remove(&file).unwrap_or_default();
+            let destination = match file.strip_prefix(from) {
+                Ok(relative) if !relative.as_os_str().is_empty() => to.join(relative),
+                _ => to.to_path_buf(),
+            };
+            files.insert(destination, contents);
+        }
+
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::Path;
+
+    use crate::filesystem::{Disk, FileSystem, Memory};
+
+    #[test]
+    fn write_to_disk() {
+        let dir = Path::new("_filesystem_disk");
+        let path = dir.join("file");
+
+        Disk.create_dir_all(dir).unwrap();
+        assert_eq!(Disk.read(&path).unwrap(), None);
+
+        Disk.write(&path, b"first", 0o600).unwrap();
+        Disk.append(&path, b" second").unwrap();
+        assert_eq!(Disk.read(&path).unwrap(), Some(b"first second".to_vec()));
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o600
+        );
+
+        Disk.set_permissions(&path, 0o644).unwrap();
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o644
+        );
+
+        // Replacing the file keeps its permissions and leaves no temporary file behind
+        Disk.write(&path, b"third", 0o600).unwrap();
+        assert_eq!(Disk.read(&path).unwrap(), Some(b"third".to_vec()));
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o644
+        );
+        assert_eq!(fs::read_dir(dir).unwrap().count(), 1);
+
+        // Leftovers of an interrupted write are replaced
+        fs::write(dir.join(".file.nmc-tmp"), "partial").unwrap();
+        Disk.write(&path, b"fourth", 0o600).unwrap();
+        assert_eq!(Disk.read(&path).unwrap(), Some(b"fourth".to_vec()));
+        assert_eq!(fs::read_dir(dir).unwrap().count(), 1);
+
+        Disk.remove_file(&path).unwrap();
+        assert_eq!(Disk.read(&path).unwrap(), None);
+        Disk.remove_file(&path).unwrap();
+
+        // Only a created dir gets the mode
+        let restricted = dir.join("restricted");
+        Disk.create_dir_with_mode(&restricted, 0o700).unwrap();
+        assert_eq!(
+            fs::metadata(&restricted).unwrap().permissions().mode() & 0o777,
+            0o700
+        );
+        Disk.create_dir_with_mode(dir, 0o700).unwrap();
+        assert_ne!(
+            fs::metadata(dir).unwrap().permissions().mode() & 0o777,
+            0o700
+        );
+
+        // Subdirs are left out of the listing
+        Disk.write(&dir.join("a"), b"", 0o640).unwrap();
+        assert_eq!(Disk.permissions(&dir.join("a")).unwrap(), Some(0o640));
+        assert_eq!(Disk.permissions(&path).unwrap(), None);
+        assert_eq!(Disk.list_files(dir).unwrap(), [dir.join("a")]);
+        assert!(Disk.list_files(&dir.join("missing")).unwrap().is_empty());
+
+        Disk.rename(&restricted, &dir.join("moved")).unwrap();
+        assert!(dir.join("moved").is_dir());
+        assert!(!restricted.exists());
+
+        Disk.remove_dir_all(dir).unwrap();
+        assert!(!dir.exists());
+        Disk.remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn write_to_memory() {
+        let memory = Memory::default();
+        let path = Path::new("out/node1/eth0.nmconnection");
+
+        let writer = memory.clone();
+        writer.create_dir_all(Path::new("out/node1")).unwrap();
+        assert_eq!(writer.read(path).unwrap(), None);
+        assert!(writer.set_permissions(path, 0o600).is_err());
+
+        writer.append(path, b"[connection]\n").unwrap();
+        writer.append(path, b"id=eth0\n").unwrap();
+        writer.set_permissions(path, 0o600).unwrap();
+        assert_eq!(
+            memory.files().get(path),
+            Some(&b"[connection]\nid=eth0\n".to_vec())
+        );
+
+        writer.write(path, b"", 0o600).unwrap();
+        assert_eq!(memory.read(path).unwrap(), Some(Vec::new()));
+        assert!(!Path::new("out").exists());
+
+        writer
+            .write(Path::new("out/node10/eth0.nmconnection"), b"", 0o600)
+            .unwrap();
+        writer.remove_dir_all(Path::new("out/node1")).unwrap();
+        assert_eq!(
+            memory.files().into_keys().collect::<Vec<_>>(),
+            [Path::new("out/node10/eth0.nmconnection")]
+        );
+
+        assert!(writer.set_owner(path, 0).is_err());
+        writer
+            .set_owner(Path::new("out/node10/eth0.nmconnection"), 0)
+            .unwrap();
+        writer
+            .remove_file(Path::new("out/node10/eth0.nmconnection"))
+            .unwrap();
+        assert!(memory.files().is_empty());
+
+        for file in ["work/a", "work/b", "work/dir/c", "kept/stale"] {
+            writer.write(Path::new(file), b"", 0o600).unwrap();
+        }
+        assert_eq!(
+            writer.list_files(Path::new("work")).unwrap(),
+            [Path::new("work/a"), Path::new("work/b")]
+        );
+        assert_eq!(writer.permissions(Path::new("work/a")).unwrap(), None);
+
+        writer.rename(Path::new("work"), Path::new("kept")).unwrap();
+        writer
+            .rename(Path::new("kept/a"), Path::new("kept/renamed"))
+            .unwrap();
+        assert_eq!(
+            memory.files().into_keys().collect::<Vec<_>>(),
+            [
+                Path::new("kept/b"),
+                Path::new("kept/dir/c"),
+                Path::new("kept/renamed")
+            ]
+        );
+        assert!(writer.rename(Path::new("work"), Path::new("kept")).is_err());
+    }
+}
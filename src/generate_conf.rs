@@ -1,49 +1,629 @@
+use std::collections::{BTreeMap, HashMap};
 use std::ffi::OsStr;
 use std::fs;
-use std::path::Path;
+use std::path::{Path, PathBuf};
+use std::time::Instant;
 
 use anyhow::{anyhow, Context};
-use log::{info, warn};
+use log::{debug, info, warn};
 use nmstate::{InterfaceType, NetworkState};
 
-use crate::types::{Host, Interface};
-use crate::HOST_MAPPING_FILE;
+use crate::cache::{input_checksum, GeneratedHost, GenerationCache};
+use crate::combustion::{network_dir, write_script};
+use crate::deadline;
+use crate::ethtool::validate_settings;
+use crate::file_filter::{denied, FileClass, FileFilter};
+use crate::filenames::{check_filenames, validate_interface_name};
+use crate::filesystem::FileSystem;
+use crate::ifcfg::{to_ifcfg, Format};
+use crate::ignition::{to_ignition, write_ignition};
+use crate::keyfile::{derive_uuid, replace_uuid_references, Keyfile, CONNECTION_FILE_EXT};
+use crate::netplan::{to_netplan, NETPLAN_FILE};
+use crate::networkd::to_networkd;
+use crate::report::{GenerationReport, HostFailure, HostStats};
+use crate::secrets::{separate_secrets, write_secret_files, SecretHandling};
+use crate::selector::{load_labels, Labels, Selector};
+use crate::types::{profile_name, Host, Interface, PROFILE_SEPARATOR};
+use crate::variables::{check_variables, Catalog};
+use crate::yaml::merge_keys;
+use crate::{CONF_D_DIR, HOST_MAPPING_FILE};
 
 /// `NetworkConfig` contains the generated configurations in the
 /// following format: `Vec<(config_file_name, config_content>)`
 type NetworkConfig = Vec<(String, String)>;
 
+/// Layout the generated configurations are stored in.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub(crate) enum Output {
+    /// A dir per host next to the host mapping.
+    #[default]
+    Dir,
+    /// A combustion config drive layout, along with the script applying the config on first boot.
+    Combustion,
+    /// A dir per host along with an Ignition config per host placing its files on the machine.
+    Ignition,
+}
+
+/// Options of generating the network configurations.
+#[derive(Default)]
+pub(crate) struct GenerateOptions {
+    /// Expand `${VAR}` references in the desired states from the environment.
+    pub(crate) expand_env: bool,
+    /// YAML file defining the variables referenced by the desired states.
+    pub(crate) vars_file: Option<String>,
+    /// Decides how files in the config dir which are not desired states are treated.
+    pub(crate) file_filter: FileFilter,
+    /// Format the connection files are stored in.
+    pub(crate) format: Format,
+    /// File to write a JSON summary of the run across all hosts to.
+    pub(crate) report_file: Option<String>,
+    /// How the secrets in the generated keyfiles are handled.
+    pub(crate) secrets: SecretHandling,
+    /// Layout the configurations are stored in.
+    pub(crate) output: Output,
+    /// YAML file defining the labels of the hosts, stored in the host mapping.
+    pub(crate) labels_file: Option<String>,
+    /// Only generate the configurations of the hosts whose labels match.
+    pub(crate) selector: Option<Selector>,
+    /// Reuse the configurations of the hosts whose inputs did not change since the previous run
+    /// into the same output dir.
+    pub(crate) cache: bool,
+}
+
+/// Desired state of a single host read from the config dir.
+#[cfg_attr(test, derive(Debug))]
+pub(crate) struct DesiredState {
+    pub(crate) hostname: String,
+    /// Name of the additional profiles described by the state, e.g. `dhcp` for `node1@dhcp.yaml`.
+    pub(crate) profile: Option<String>,
+    pub(crate) path: PathBuf,
+    pub(crate) data: String,
+}
+
+impl DesiredState {
+    /// Returns the name of the state, i.e. the hostname followed by the profile (if any).
+    pub(crate) fn name(&self) -> String {
+        match &self.profile {
+            Some(profile) => profile_name(&self.hostname, profile),
+            None => self.hostname.clone(),
+        }
+    }
+}
+
 /// Generate network configurations from all YAML files in the `config_dir`
 /// and store the result *.nmconnection files and host mapping under `output_dir`.
-pub(crate) fn generate(config_dir: &str, output_dir: &str) -> Result<(), anyhow::Error> {
+///
+/// `${VAR}` references in the YAML files are expanded from the environment if `expand_env` is set,
+/// or from the variables file (falling back to the environment) if `vars_file` is given.
+/// In both cases, the references of all hosts are validated before generating any config.
+///
+/// The connections are stored as `ifcfg-*` files or systemd-networkd files instead of keyfiles
+/// if `format` asks for them. The netplan format is converted from the desired state rather than the keyfiles
+/// and does not support additional profiles.
+///
+/// A summary of the run across all hosts is logged and written as JSON to `report_file` if given,
+/// including the host whose generation failed.
+///
+/// Secrets in the keyfiles (e.g. Wi-Fi passwords) are kept, flagged as owned by a secret agent
+/// or extracted to a file per secret as `secrets` asks for, so that the artifacts need not carry them.
+///
+/// Files named `<hostname>@<profile>.yaml` describe additional profiles of the host's interfaces
+/// (e.g. a DHCP fallback), stored next to the primary ones as `<interface>@<profile>.nmconnection`.
+///
+/// The labels of the hosts are loaded from the `labels_file` if given. With a `selector`, only the hosts
+/// whose labels match are generated, so that slices of the fleet can be targeted without separate config dirs.
+///
+/// The combustion `output` stores the configurations in `combustion/network` along with a `combustion/script`
+/// applying them, so that the `output_dir` can be used as a config drive as it is. The ignition `output`
+/// additionally packages the files of each host as `ignition/<hostname>.ign`.
+///
+/// With `cache`, the checksums of the inputs of each host are recorded in the `output_dir`, and the hosts whose
+/// inputs did not change since the previous run are not generated again. The host mapping is rebuilt by every run.
+///
+/// All files, including the extracted secrets, are written via the `filesystem`, while the config dir
+/// is read from disk.
+pub(crate) fn generate(
+    config_dir: &str,
+    output_dir: &str,
+    options: &GenerateOptions,
+    filesystem: &dyn FileSystem,
+) -> Result<(), anyhow::Error> {
     if fs::read_dir(config_dir)?.count() == 0 {
         return Err(anyhow!("Empty config directory"));
     };
 
+    if options.output != Output::Dir && options.format != Format::Keyfile {
+        return Err(anyhow!(
+            "The combustion and ignition outputs require the keyfile format"
+        ));
+    }
+
+    let target_dir = match options.output {
+        Output::Dir | Output::Ignition => output_dir.to_string(),
+        Output::Combustion => network_dir(output_dir).to_string_lossy().to_string(),
+    };
+
+    let states = read_desired_states(config_dir, &options.file_filter)?;
+
+    let labels = match &options.labels_file {
+        Some(path) => load_labels(path)?,
+        None => Labels::new(),
+    };
+    for hostname in labels.keys() {
+        if !states.iter().any(|state| &state.hostname == hostname) {
+            warn!("Labels are defined for unknown host '{hostname}'");
+        }
+    }
+
+    let states = match &options.selector {
+        Some(selector) => select_states(states, &labels, selector)?,
+        None => states,
+    };
+
+    let catalog = match &options.vars_file {
+        Some(path) => Some(Catalog::load(path)?),
+        None if options.expand_env => Some(Catalog::default()),
+        None => None,
+    };
+
+    if let Some(catalog) = &catalog {
+        check_variables(catalog, &states).context("Validating variables")?;
+    }
+
+    let expand = |state: &DesiredState| match &catalog {
+        Some(catalog) => catalog
+            .expand(&state.hostname, &state.data)
+            .context("Expanding variables"),
+        None => Ok(state.data.clone()),
+    };
+
+    let (states, profile_states): (Vec<_>, Vec<_>) = states
+        .into_iter()
+        .partition(|state| state.profile.is_none());
+
+    if let Some(orphan) = profile_states
+        .iter()
+        .find(|profile| !states.iter().any(|s| s.hostname == profile.hostname))
+    {
+        return Err(anyhow!(
+            "Profiles {:?} do not belong to any host",
+            orphan.path
+        ));
+    }
+
+    let previous_cache = options
+        .cache
+        .then(|| GenerationCache::load(filesystem, output_dir));
+    let mut cache = GenerationCache::default();
+    let mapping_path = Path::new(&target_dir).join(HOST_MAPPING_FILE);
+    if options.cache {
+        // The entries of the unchanged hosts are appended from the cache.
+        filesystem
+            .create_dir_all(Path::new(&target_dir))
+            .context("Creating output dir")?;
+        filesystem
+            .write(&mapping_path, b"", 0o666)
+            .context("Resetting mapping file")?;
+    }
+
+    let started = Instant::now();
+    let mut hosts = Vec::new();
+
+    for state in &states {
+        let host_started = Instant::now();
+        let host_labels = labels.get(&state.hostname).cloned().unwrap_or_default();
+
+        let checksum = match &previous_cache {
+            Some(..) => Some(host_checksum(
+                state,
+                &profile_states,
+                &expand,
+                &host_labels,
+                options,
+            )?),
+            None => None,
+        };
+        if let (Some(previous_cache), Some(checksum)) = (&previous_cache, &checksum) {
+            if let Some(host) = previous_cache.get(&state.hostname, checksum) {
+                info!(file = &*state.path.to_string_lossy(); "Config of '{}' is unchanged, skipping", state.hostname);
+                filesystem
+                    .append(&mapping_path, host.mapping.as_bytes())
+                    .context("Writing mapping file")?;
+                hosts.push(HostStats {
+                    hostname: state.hostname.clone(),
+                    files: host.files,
+                    connection_types: host.connection_types.clone(),
+                    duration: host_started.elapsed(),
+                });
+                cache.insert(&state.hostname, checksum.clone(), host.clone());
+                continue;
+            }
+
+            // Files of the previous config would linger next to the regenerated ones otherwise.
+            filesystem
+                .remove_dir_all(&Path::new(&target_dir).join(&state.hostname))
+                .context("Removing previous config")?;
+        }
+
+        info!(file = &*state.path.to_string_lossy(); "Generating config from {:?}...", state.path);
+
+        match generate_host(
+            state,
+            &profile_states,
+            &expand,
+            &target_dir,
+            host_labels,
+            options,
+            filesystem,
+        ) {
+            Ok(host) => {
+                hosts.push(HostStats {
+                    hostname: state.hostname.clone(),
+                    files: host.files,
+                    connection_types: host.connection_types.clone(),
+                    duration: host_started.elapsed(),
+                });
+                if let Some(checksum) = checksum {
+                    cache.insert(&state.hostname, checksum, host);
+                }
+            }
+            Err(err) => {
+                let failure = HostFailure {
+                    host: state.hostname.clone(),
+                    error: format!("{err:#}"),
+                };
+                finish_report(
+                    &hosts,
+                    vec![failure],
+                    started,
+                    options.report_file.as_deref(),
+                    filesystem,
+                )?;
+                return Err(err);
+            }
+        }
+    }
+
+    finish_report(
+        &hosts,
+        Vec::new(),
+        started,
+        options.report_file.as_deref(),
+        filesystem,
+    )?;
+
+    if options.cache {
+        cache.save(filesystem, output_dir)?;
+    }
+
+    if options.output == Output::Combustion {
+        write_script(filesystem, output_dir)?;
+    }
+
+    Ok(())
+}
+
+/// Log the summary of the run and write the report if asked for.
+fn finish_report(
+    hosts: &[HostStats],
+    failures: Vec<HostFailure>,
+    started: Instant,
+    report_file: Option<&str>,
+    filesystem: &dyn FileSystem,
+) -> Result<(), anyhow::Error> {
+    let report = GenerationReport::new(hosts, failures, started.elapsed());
+    for line in report.summary().lines() {
+        info!("{line}");
+    }
+
+    match report_file {
+        Some(path) => report.write(filesystem, path).context("Writing report"),
+        None => Ok(()),
+    }
+}
+
+/// Returns the checksum of everything the config of the host is generated from, i.e. its desired state
+/// and additional profiles with the variables expanded, its labels and the options shaping the output.
+fn host_checksum(
+    state: &DesiredState,
+    profile_states: &[DesiredState],
+    expand: &dyn Fn(&DesiredState) -> Result<String, anyhow::Error>,
+    labels: &BTreeMap<String, String>,
+    options: &GenerateOptions,
+) -> Result<String, anyhow::Error> {
+    let mut inputs = vec![
+        format!(
+            "{:?} {:?} {:?}",
+            options.format, options.output, options.secrets
+        ),
+        serde_json::to_string(labels).context("Serializing labels")?,
+        expand(state)?,
+    ];
+    for profile_state in profile_states
+        .iter()
+        .filter(|profile| profile.hostname == state.hostname)
+    {
+        inputs.push(profile_state.name());
+        inputs.push(expand(profile_state)?);
+    }
+
+    Ok(input_checksum(inputs.iter().map(String::as_str)))
+}
+
+/// Generate and store the config of a single host.
+fn generate_host(
+    state: &DesiredState,
+    profile_states: &[DesiredState],
+    expand: &dyn Fn(&DesiredState) -> Result<String, anyhow::Error>,
+    output_dir: &str,
+    labels: BTreeMap<String, String>,
+    options: &GenerateOptions,
+    filesystem: &dyn FileSystem,
+) -> Result<GeneratedHost, anyhow::Error> {
+    deadline::check()?;
+
+    let format = options.format;
+    let data = expand(state)?;
+    let (mut interfaces, mut config) = generate_config(data.clone())?;
+    validate_ethtool_settings(&config)?;
+
+    if format == Format::Netplan {
+        validate_names(&interfaces, &config)?;
+        if profile_states.iter().any(|p| p.hostname == state.hostname) {
+            warn!(
+                "Skipping the additional profiles of '{}' which are not supported by netplan",
+                state.hostname
+            );
+        }
+
+        let connection_types = connection_types(&config);
+        let netplan = to_netplan(&state.hostname, &data).context("Converting to netplan")?;
+        let (files, mapping) = store_network_config(
+            filesystem,
+            output_dir,
+            state.hostname.clone(),
+            interfaces,
+            labels,
+            vec![(NETPLAN_FILE.to_string(), netplan)],
+            format,
+        )
+        .context("Storing config")?;
+        return Ok(GeneratedHost {
+            connection_types,
+            files,
+            mapping,
+        });
+    }
+
+    for profile_state in profile_states
+        .iter()
+        .filter(|profile| profile.hostname == state.hostname)
+    {
+        info!(file = &*profile_state.path.to_string_lossy(); "Generating profiles from {:?}...", profile_state.path);
+
+        let profile = profile_state.profile.as_deref().unwrap_or_default();
+        let network_state = parse_network_state(&expand(profile_state)?)?;
+        let profile_config = network_config(&network_state)?;
+        validate_ethtool_settings(&profile_config)?;
+
+        add_profiles(
+            profile,
+            &mut interfaces,
+            &mut config,
+            extract_interfaces(&network_state),
+            profile_config,
+        )
+        .with_context(|| format!("Adding profiles '{profile}'"))?;
+    }
+
+    validate_names(&interfaces, &config)?;
+    derive_connection_uuids(&state.hostname, &mut config);
+    let connection_types = connection_types(&config);
+
+    let secrets = separate_keyfile_secrets(&mut config, &options.secrets);
+    if let SecretHandling::Extract { dir } = &options.secrets {
+        if !secrets.is_empty() {
+            write_secret_files(filesystem, &Path::new(dir).join(&state.hostname), &secrets)
+                .context("Storing secrets")?;
+        }
+    }
+
+    if options.output == Output::Ignition {
+        let ignition = to_ignition(&config).context("Packaging Ignition config")?;
+        write_ignition(filesystem, output_dir, &state.hostname, &ignition)?;
+    }
+
+    let (files, mapping) = store_network_config(
+        filesystem,
+        output_dir,
+        state.hostname.clone(),
+        interfaces,
+        labels,
+        config,
+        format,
+    )
+    .context("Storing config")?;
+
+    Ok(GeneratedHost {
+        connection_types,
+        files,
+        mapping,
+    })
+}
+
+/// Returns the states of the hosts whose labels match the selector, including their additional profiles.
+fn select_states(
+    states: Vec<DesiredState>,
+    labels: &Labels,
+    selector: &Selector,
+) -> Result<Vec<DesiredState>, anyhow::Error> {
+    let no_labels = BTreeMap::new();
+    let selected: Vec<DesiredState> = states
+        .into_iter()
+        .filter(|state| selector.matches(labels.get(&state.hostname).unwrap_or(&no_labels)))
+        .collect();
+
+    if selected.is_empty() {
+        return Err(anyhow!("No hosts match selector '{selector}'"));
+    }
+
+    let mut hostnames: Vec<&str> = selected.iter().map(|s| s.hostname.as_str()).collect();
+    hostnames.dedup();
+    info!(
+        "Selected {} host(s) by '{selector}': {}",
+        hostnames.len(),
+        hostnames.join(", ")
+    );
+
+    Ok(selected)
+}
+
+/// Ensure that the interfaces can be named as configured on the device and that the files can be stored
+/// under their names, rather than producing artifacts which only fail once applied.
+fn validate_names(interfaces: &[Interface], config: &NetworkConfig) -> Result<(), anyhow::Error> {
+    for interface in interfaces {
+        validate_interface_name(&interface.logical_name)?;
+    }
+
+    check_filenames(config.iter().map(|(filename, _)| filename.as_str()))
+}
+
+/// Separate the secrets from the keyfiles, returning the extracted ones by their variable names.
+fn separate_keyfile_secrets(
+    config: &mut NetworkConfig,
+    handling: &SecretHandling,
+) -> BTreeMap<String, String> {
+    let mut secrets = BTreeMap::new();
+
+    for (filename, content) in config.iter_mut() {
+        let Some(name) = filename.strip_suffix(&format!(".{CONNECTION_FILE_EXT}")) else {
+            continue;
+        };
+
+        let mut keyfile = Keyfile::parse(content);
+        let extracted = separate_secrets(name, &mut keyfile, handling);
+        if *handling != SecretHandling::Inline {
+            *content = keyfile.to_string();
+        }
+        secrets.extend(extracted);
+    }
+
+    secrets
+}
+
+/// Returns the types of the connections in the generated keyfiles, e.g. `ethernet` or `bond`.
+fn connection_types(config: &NetworkConfig) -> Vec<String> {
+    config
+        .iter()
+        .filter(|(filename, _)| filename.ends_with(&format!(".{CONNECTION_FILE_EXT}")))
+        .filter_map(|(_, content)| {
+            let connection_type = Keyfile::parse(content)
+                .get("connection", "type")?
+                .to_string();
+            Some(match connection_type.as_str() {
+                "802-3-ethernet" => "ethernet".to_string(),
+                _ => connection_type,
+            })
+        })
+        .collect()
+}
+
+/// Read the desired states of all hosts in the `config_dir` sorted by hostname.
+///
+/// Files matching the ignore patterns of the filter are skipped and the ones matching its deny patterns fail the run.
+pub(crate) fn read_desired_states(
+    config_dir: &str,
+    file_filter: &FileFilter,
+) -> Result<Vec<DesiredState>, anyhow::Error> {
+    let mut states = Vec::new();
+
     for entry in fs::read_dir(config_dir)? {
         let entry = entry?;
         let path = entry.path();
 
         if entry.metadata()?.is_dir() {
-            warn!("Ignoring unexpected dir: {path:?}");
+            file_filter.check_unexpected(&path, "config dir")?;
             continue;
         }
 
-        info!("Generating config from {path:?}...");
+        match file_filter.classify(&path) {
+            FileClass::Ignored => {
+                debug!("Ignoring file in config dir: {path:?}");
+                continue;
+            }
+            FileClass::Denied(pattern) => return Err(denied(&path, "config dir", &pattern)),
+            FileClass::Unlisted => {}
+        }
 
-        let hostname = extract_hostname(&path)
+        let name = extract_hostname(&path)
             .and_then(OsStr::to_str)
-            .ok_or_else(|| anyhow!("Invalid file path"))?
-            .to_owned();
+            .ok_or_else(|| anyhow!("Invalid file path"))?;
+        let (hostname, profile) = match name.split_once(PROFILE_SEPARATOR) {
+            Some((hostname, profile)) => (hostname.to_owned(), Some(profile.to_owned())),
+            None => (name.to_owned(), None),
+        };
 
         let data = fs::read_to_string(&path).context("Reading network config")?;
 
-        let (interfaces, config) = generate_config(data)?;
+        states.push(DesiredState {
+            hostname,
+            profile,
+            path,
+            data,
+        });
+    }
+
+    states.sort_by(|a, b| {
+        a.hostname
+            .cmp(&b.hostname)
+            .then_with(|| a.profile.cmp(&b.profile))
+    });
+
+    Ok(states)
+}
+
+/// Generate the keyfiles of a standalone nmstate snippet and print them to stdout (`output` is `-`)
+/// or store them in the `output` dir.
+///
+/// Unlike `generate`, no host mapping is written and the snippet does not need to describe
+/// a complete host (e.g. Ethernet interfaces are not required to have a MAC address).
+///
+/// The keyfiles are written via the `filesystem` and, since they may contain secrets and NetworkManager
+/// ignores them otherwise, only readable by their owner.
+pub(crate) fn render(
+    state_file: &str,
+    output: &str,
+    filesystem: &dyn FileSystem,
+) -> Result<(), anyhow::Error> {
+    let data = fs::read_to_string(state_file).context("Reading network state")?;
 
-        store_network_config(output_dir, hostname, interfaces, config).context("Storing config")?;
+    let network_state = parse_network_state(&data)?;
+    let config = network_config(&network_state)?;
+    validate_ethtool_settings(&config)?;
+
+    if output == "-" {
+        print!("{}", format_keyfiles(&config));
+        return Ok(());
     }
 
-    Ok(())
+    filesystem
+        .create_dir_all(Path::new(output))
+        .context("Creating output dir")?;
+
+    config.iter().try_for_each(|(filename, content)| {
+        filesystem
+            .write(&Path::new(output).join(filename), content.as_bytes(), 0o600)
+            .context("Writing config file")
+    })
+}
+
+/// Concatenate the keyfiles, each preceded by a comment line holding its file name.
+fn format_keyfiles(config: &NetworkConfig) -> String {
+    config
+        .iter()
+        .map(|(filename, content)| format!("# {filename}\n{content}"))
+        .collect::<Vec<_>>()
+        .join("\n")
 }
 
 fn extract_hostname(path: &Path) -> Option<&OsStr> {
@@ -58,18 +638,37 @@ fn extract_hostname(path: &Path) -> Option<&OsStr> {
 }
 
 fn generate_config(data: String) -> Result<(Vec<Interface>, NetworkConfig), anyhow::Error> {
-    let network_state = NetworkState::new_from_yaml(&data)?;
+    let network_state = parse_network_state(&data)?;
 
     let interfaces = extract_interfaces(&network_state);
     validate_interfaces(&interfaces)?;
 
+    let config = network_config(&network_state)?;
+
+    Ok((interfaces, config))
+}
+
+pub(crate) fn parse_network_state(data: &str) -> Result<NetworkState, anyhow::Error> {
+    let data = merge_keys(data).context("Resolving YAML merge keys")?;
+
+    Ok(NetworkState::new_from_yaml(&data)?)
+}
+
+fn network_config(network_state: &NetworkState) -> Result<NetworkConfig, anyhow::Error> {
     let config = network_state
         .gen_conf()?
         .get("NetworkManager")
         .ok_or_else(|| anyhow!("Invalid NM configuration"))?
         .to_owned();
 
-    Ok((interfaces, config))
+    Ok(config)
+}
+
+fn validate_ethtool_settings(config: &NetworkConfig) -> Result<(), anyhow::Error> {
+    config.iter().try_for_each(|(filename, content)| {
+        validate_settings(&Keyfile::parse(content))
+            .with_context(|| format!("Validating ethtool settings of '{filename}'"))
+    })
 }
 
 fn extract_interfaces(network_state: &NetworkState) -> Vec<Interface> {
@@ -81,73 +680,266 @@ fn extract_interfaces(network_state: &NetworkState) -> Vec<Interface> {
             logical_name: i.name().to_owned(),
             mac_address: i.base_iface().mac_address.clone(),
             interface_type: i.iface_type().to_string(),
+            ..Default::default()
         })
         .collect()
 }
 
 fn validate_interfaces(interfaces: &[Interface]) -> anyhow::Result<()> {
-    let ethernet_interfaces: Vec<&Interface> = interfaces
-        .iter()
-        .filter(|i| i.interface_type == InterfaceType::Ethernet.to_string())
-        .collect();
+    let nics: Vec<&Interface> = interfaces.iter().filter(|i| i.is_nic()).collect();
 
-    if ethernet_interfaces.is_empty() {
-        return Err(anyhow!("No Ethernet interfaces were provided"));
+    if nics.is_empty() {
+        return Err(anyhow!(
+            "No Ethernet or InfiniBand interfaces were provided"
+        ));
     }
 
-    let ethernet_interfaces: Vec<String> = ethernet_interfaces
+    let nics: Vec<String> = nics
         .iter()
         .filter(|i| i.mac_address.is_none())
         .map(|i| i.logical_name.to_owned())
         .collect();
 
-    if !ethernet_interfaces.is_empty() {
+    if !nics.is_empty() {
         return Err(anyhow!(
-            "Detected Ethernet interfaces without a MAC address: {}",
-            ethernet_interfaces.join(", ")
+            "Detected Ethernet or InfiniBand interfaces without a MAC address: {}",
+            nics.join(", ")
         ));
     };
 
     Ok(())
 }
 
+/// Add the connections generated from the desired state of additional profiles to the host's config.
+///
+/// The connections are renamed after the profile and get an ID and UUID of their own,
+/// so that NetworkManager keeps them apart from the primary ones of the same interfaces.
+/// References between the connections of the profile (e.g. the controller of a bond port) follow their new UUIDs.
+fn add_profiles(
+    profile: &str,
+    interfaces: &mut [Interface],
+    config: &mut NetworkConfig,
+    profile_interfaces: Vec<Interface>,
+    profile_config: NetworkConfig,
+) -> Result<(), anyhow::Error> {
+    if profile.is_empty() || profile.contains(PROFILE_SEPARATOR) {
+        return Err(anyhow!("Invalid profile name '{profile}'"));
+    }
+
+    for profile_interface in &profile_interfaces {
+        let interface = interfaces
+            .iter_mut()
+            .find(|i| i.logical_name == profile_interface.logical_name)
+            .ok_or_else(|| {
+                anyhow!(
+                    "Interface '{}' is not part of the host's config",
+                    profile_interface.logical_name
+                )
+            })?;
+
+        interface.profiles.push(profile.to_string());
+    }
+
+    let mut connections = Vec::new();
+    let mut replacements = HashMap::new();
+
+    for (filename, content) in profile_config {
+        let name = filename.strip_suffix(&format!(".{CONNECTION_FILE_EXT}"));
+        let Some(name) =
+            name.filter(|name| profile_interfaces.iter().any(|i| i.logical_name == *name))
+        else {
+            debug!("Skipping '{filename}' of profiles '{profile}'");
+            continue;
+        };
+
+        let uuid = Keyfile::parse(&content)
+            .get("connection", "uuid")
+            .unwrap_or_default()
+            .to_string();
+        let profile_uuid = derive_uuid(&format!("{uuid}{PROFILE_SEPARATOR}{profile}"));
+        if !uuid.is_empty() {
+            replacements.insert(uuid, profile_uuid.clone());
+        }
+
+        connections.push((profile_name(name, profile), profile_uuid, content));
+    }
+
+    for (name, uuid, content) in connections {
+        let mut keyfile = Keyfile::parse(&replace_uuid_references(&content, &replacements));
+
+        keyfile.set("connection", "id", &name);
+        keyfile.set("connection", "uuid", &uuid);
+
+        config.push((format!("{name}.{CONNECTION_FILE_EXT}"), keyfile.to_string()));
+    }
+
+    Ok(())
+}
+
+/// Replace the UUIDs of the connections with ones derived from the hostname, interface name and connection ID,
+/// so that re-generating the config produces identical files (e.g. for reproducible image builds), while the
+/// connections of different hosts never share a UUID. References to the replaced UUIDs (e.g. the controller
+/// of a bond port) are adjusted accordingly.
+fn derive_connection_uuids(hostname: &str, config: &mut NetworkConfig) {
+    let keyfile_ext = format!(".{CONNECTION_FILE_EXT}");
+    let mut replacements = HashMap::new();
+
+    for (_, content) in config
+        .iter()
+        .filter(|(filename, _)| filename.ends_with(&keyfile_ext))
+    {
+        let keyfile = Keyfile::parse(content);
+        let Some(uuid) = keyfile.get("connection", "uuid") else {
+            continue;
+        };
+        let interface = keyfile
+            .get("connection", "interface-name")
+            .unwrap_or_default();
+        let id = keyfile.get("connection", "id").unwrap_or_default();
+
+        replacements.insert(
+            uuid.to_string(),
+            derive_uuid(&format!("{hostname}/{interface}/{id}")),
+        );
+    }
+
+    for (_, content) in config
+        .iter_mut()
+        .filter(|(filename, _)| filename.ends_with(&keyfile_ext))
+    {
+        *content = replace_uuid_references(content, &replacements);
+    }
+}
+
+/// Store the config in the host dir and append the host to the mapping, returning the number of stored files
+/// along with the entry of the host in the mapping.
 fn store_network_config(
+    filesystem: &dyn FileSystem,
     output_dir: &str,
     hostname: String,
     interfaces: Vec<Interface>,
+    labels: BTreeMap<String, String>,
     config: NetworkConfig,
-) -> Result<(), anyhow::Error> {
+    format: Format,
+) -> Result<(usize, String), anyhow::Error> {
     let path = Path::new(output_dir);
 
-    fs::create_dir_all(path.join(&hostname)).context("Creating output dir")?;
-
-    config.iter().try_for_each(|(filename, content)| {
-        let path = path.join(&hostname).join(filename);
-
-        fs::write(path, content).context("Writing config file")
-    })?;
+    filesystem
+        .create_dir_all(&path.join(&hostname))
+        .context("Creating output dir")?;
 
-    let mapping_file = fs::OpenOptions::new()
-        .create(true)
-        .append(true)
-        .open(path.join(HOST_MAPPING_FILE))?;
+    let files = if format == Format::Networkd {
+        store_networkd_config(filesystem, &path.join(&hostname), &config)?
+    } else {
+        store_connection_files(filesystem, &path.join(&hostname), &config, format)?
+    };
 
     let hosts = [Host {
         hostname,
+        labels,
         interfaces,
+        ..Default::default()
     }];
 
-    serde_yaml::to_writer(mapping_file, &hosts).context("Writing mapping file")
+    let mapping = serde_yaml::to_string(&hosts).context("Serializing mapping file")?;
+    filesystem
+        .append(&path.join(HOST_MAPPING_FILE), mapping.as_bytes())
+        .context("Writing mapping file")?;
+
+    Ok((files, mapping))
+}
+
+fn store_connection_files(
+    filesystem: &dyn FileSystem,
+    host_dir: &Path,
+    config: &NetworkConfig,
+    format: Format,
+) -> Result<usize, anyhow::Error> {
+    let mut files = 0;
+
+    for (filename, content) in config {
+        let mut path = host_dir.to_path_buf();
+        let mut filename = filename.clone();
+        let mut content = content.clone();
+
+        // NetworkManager.conf drop-ins are kept apart from the connection files.
+        if Path::new(&filename)
+            .extension()
+            .is_some_and(|ext| ext == "conf")
+        {
+            path.push(CONF_D_DIR);
+            filesystem
+                .create_dir_all(&path)
+                .context("Creating conf.d dir")?;
+        } else if format == Format::Ifcfg {
+            let name = filename
+                .strip_suffix(&format!(".{CONNECTION_FILE_EXT}"))
+                .unwrap_or(&filename)
+                .to_string();
+            let keyfile = Keyfile::parse(&content);
+
+            // The ifcfg-rh plugin brings up the loopback interface on its own.
+            if keyfile.get("connection", "type") == Some("loopback") {
+                info!("Skipping loopback connection '{name}' in ifcfg format");
+                continue;
+            }
+
+            content = to_ifcfg(&name, &keyfile)?;
+            filename = format.filename(&name);
+        }
+
+        filesystem
+            .write(&path.join(filename), content.as_bytes(), 0o666)
+            .context("Writing config file")?;
+        files += 1;
+    }
+
+    Ok(files)
+}
+
+/// Convert the keyfiles of the host to systemd-networkd files and store them in the host dir.
+fn store_networkd_config(
+    filesystem: &dyn FileSystem,
+    host_dir: &Path,
+    config: &NetworkConfig,
+) -> Result<usize, anyhow::Error> {
+    let mut keyfiles = Vec::new();
+
+    for (filename, content) in config {
+        match filename.strip_suffix(&format!(".{CONNECTION_FILE_EXT}")) {
+            Some(name) => keyfiles.push((name.to_string(), Keyfile::parse(content))),
+            None => info!("Skipping '{filename}' which does not apply to systemd-networkd"),
+        }
+    }
+
+    let networkd = to_networkd(&keyfiles)?;
+    for (filename, content) in &networkd {
+        filesystem
+            .write(&host_dir.join(filename), content.as_bytes(), 0o666)
+            .context("Writing config file")?;
+    }
+
+    Ok(networkd.len())
 }
 
 #[cfg(test)]
 mod tests {
+    use std::collections::BTreeMap;
     use std::fs;
+    use std::os::unix::fs::PermissionsExt;
     use std::path::Path;
 
+    use crate::filesystem::{Disk, Memory};
     use crate::generate_conf::{
-        extract_hostname, extract_interfaces, generate, generate_config, validate_interfaces,
+        add_profiles, derive_connection_uuids, extract_hostname, extract_interfaces,
+        format_keyfiles, generate, generate_config, render, select_states,
+        separate_keyfile_secrets, store_network_config, validate_interfaces, DesiredState,
+        GenerateOptions, Output,
     };
+    use crate::ifcfg::Format;
+    use crate::keyfile::{derive_uuid, Keyfile};
+    use crate::secrets::SecretHandling;
+    use crate::selector::{Labels, Selector};
     use crate::types::{Host, Interface};
     use crate::HOST_MAPPING_FILE;
 
@@ -158,7 +950,7 @@ mod tests {
         let out_dir = "_out";
         let output_path = Path::new("_out").join("node1");
 
-        assert!(generate(config_dir, out_dir).is_ok());
+        assert!(generate(config_dir, out_dir, &GenerateOptions::default(), &Disk).is_ok());
 
         // verify contents of *.nmconnection files
         let exp_eth0_conn = fs::read_to_string(exp_output_path.join("eth0.nmconnection"))?;
@@ -200,11 +992,474 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn select_states_by_labels() {
+        let state = |hostname: &str, profile: Option<&str>| DesiredState {
+            hostname: hostname.to_string(),
+            profile: profile.map(str::to_string),
+            path: Path::new(hostname).with_extension("yaml"),
+            data: String::new(),
+        };
+        let states = vec![
+            state("node1", None),
+            state("node1", Some("dhcp")),
+            state("node2", None),
+            state("node3", None),
+        ];
+        let labels = Labels::from([
+            (
+                "node1".to_string(),
+                BTreeMap::from([("site".to_string(), "berlin".to_string())]),
+            ),
+            (
+                "node2".to_string(),
+                BTreeMap::from([("site".to_string(), "paris".to_string())]),
+            ),
+        ]);
+
+        let selector = Selector::parse("site=berlin").unwrap();
+        let selected = select_states(states, &labels, &selector).unwrap();
+        assert_eq!(
+            selected
+                .iter()
+                .map(|state| (state.hostname.as_str(), state.profile.as_deref()))
+                .collect::<Vec<_>>(),
+            vec![("node1", None), ("node1", Some("dhcp"))]
+        );
+
+        let selector = Selector::parse("site=rome").unwrap();
+        assert_eq!(
+            select_states(vec![state("node1", None)], &labels, &selector)
+                .unwrap_err()
+                .to_string(),
+            "No hosts match selector 'site=rome'"
+        );
+    }
+
+    #[test]
+    fn generate_combustion_output() -> Result<(), anyhow::Error> {
+        let out_dir = "_out_combustion";
+        let options = GenerateOptions {
+            output: Output::Combustion,
+            ..Default::default()
+        };
+
+        generate("testdata/generate", out_dir, &options, &Disk)?;
+
+        let combustion_dir = Path::new(out_dir).join("combustion");
+        assert!(combustion_dir.join("script").exists());
+        assert!(combustion_dir
+            .join("network")
+            .join(HOST_MAPPING_FILE)
+            .exists());
+        assert!(combustion_dir
+            .join("network")
+            .join("node1")
+            .join("eth0.nmconnection")
+            .exists());
+
+        // cleanup
+        fs::remove_dir_all(out_dir)?;
+
+        let options = GenerateOptions {
+            output: Output::Combustion,
+            format: Format::Ifcfg,
+            ..Default::default()
+        };
+        let error = generate("testdata/generate", out_dir, &options, &Disk).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "The combustion and ignition outputs require the keyfile format"
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn render_successfully() -> Result<(), anyhow::Error> {
+        let exp_output_path = Path::new("testdata/generate/expected");
+        let out_dir = "_render";
+
+        render("testdata/generate/node1.yaml", out_dir, &Disk)?;
+
+        for filename in [
+            "eth0.nmconnection",
+            "bridge0.nmconnection",
+            "lo.nmconnection",
+        ] {
+            assert_eq!(
+                fs::read_to_string(exp_output_path.join(filename))?,
+                fs::read_to_string(Path::new(out_dir).join(filename))?
+            );
+            assert_eq!(
+                fs::metadata(Path::new(out_dir).join(filename))?
+                    .permissions()
+                    .mode()
+                    & 0o777,
+                0o600
+            );
+        }
+        assert!(!Path::new(out_dir).join(HOST_MAPPING_FILE).exists());
+
+        // cleanup
+        fs::remove_dir_all(out_dir)?;
+
+        assert!(render("<missing>", "-", &Disk).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn store_network_config_with_drop_ins() -> Result<(), anyhow::Error> {
+        let filesystem = Memory::default();
+        let config = vec![
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\n".to_string(),
+            ),
+            ("dns.conf".to_string(), "[main]\ndns=none\n".to_string()),
+        ];
+
+        let (files, _) = store_network_config(
+            &filesystem,
+            "_out",
+            "node1".to_string(),
+            vec![],
+            BTreeMap::new(),
+            config,
+            Format::Keyfile,
+        )?;
+        assert_eq!(files, 2);
+
+        let files = filesystem.files();
+        assert_eq!(
+            files.keys().collect::<Vec<_>>(),
+            vec![
+                Path::new("_out/host_config.yaml"),
+                Path::new("_out/node1/conf.d/dns.conf"),
+                Path::new("_out/node1/eth0.nmconnection"),
+            ]
+        );
+        assert_eq!(
+            files[Path::new("_out/node1/eth0.nmconnection")],
+            b"[connection]\nid=eth0\n"
+        );
+        assert_eq!(
+            files[Path::new("_out/node1/conf.d/dns.conf")],
+            b"[main]\ndns=none\n"
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn store_network_config_as_ifcfg() -> Result<(), anyhow::Error> {
+        let out_dir = "_out_ifcfg";
+        let config = vec![
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\ninterface-name=eth0\ntype=ethernet\n\n[ipv4]\nmethod=auto\n"
+                    .to_string(),
+            ),
+            (
+                "lo.nmconnection".to_string(),
+                "[connection]\nid=lo\ntype=loopback\n".to_string(),
+            ),
+        ];
+
+        store_network_config(
+            &Disk,
+            out_dir,
+            "node1".to_string(),
+            vec![],
+            BTreeMap::new(),
+            config,
+            Format::Ifcfg,
+        )?;
+
+        let host_dir = Path::new(out_dir).join("node1");
+        assert_eq!(
+            fs::read_to_string(host_dir.join("ifcfg-eth0"))?,
+            "TYPE=Ethernet\nNAME=eth0\nDEVICE=eth0\nBOOTPROTO=dhcp\n"
+        );
+        assert!(!host_dir.join("eth0.nmconnection").exists());
+        assert!(!host_dir.join("ifcfg-lo").exists());
+
+        // cleanup
+        fs::remove_dir_all(out_dir)?;
+
+        Ok(())
+    }
+
+    #[test]
+    fn separate_secrets_of_keyfiles() {
+        let mut config = vec![
+            (
+                "wlan0.nmconnection".to_string(),
+                "[connection]\nid=wlan0\n\n[wifi-security]\npsk=secret\n".to_string(),
+            ),
+            (
+                "dns.conf".to_string(),
+                "[main]\ndns=none\npsk=not-a-keyfile\n".to_string(),
+            ),
+        ];
+        let handling = SecretHandling::Extract {
+            dir: "_secrets".to_string(),
+        };
+
+        let secrets = separate_keyfile_secrets(&mut config, &handling);
+
+        assert_eq!(secrets.len(), 1);
+        assert_eq!(secrets["NMC_SECRET_WLAN0_WIFI_SECURITY_PSK"], "secret");
+        assert_eq!(
+            config[0].1,
+            "[connection]\nid=wlan0\n\n[wifi-security]\npsk=${NMC_SECRET_WLAN0_WIFI_SECURITY_PSK}\n"
+        );
+        assert_eq!(config[1].1, "[main]\ndns=none\npsk=not-a-keyfile\n");
+    }
+
+    #[test]
+    fn store_network_config_as_networkd() -> Result<(), anyhow::Error> {
+        let out_dir = "_out_networkd";
+        let config = vec![
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\ninterface-name=eth0\ntype=ethernet\n\n[ipv4]\nmethod=auto\n"
+                    .to_string(),
+            ),
+            (
+                "lo.nmconnection".to_string(),
+                "[connection]\nid=lo\ninterface-name=lo\ntype=loopback\n".to_string(),
+            ),
+            (
+                "nmstate.conf".to_string(),
+                "[main]\nno-auto-default=*\n".to_string(),
+            ),
+        ];
+
+        store_network_config(
+            &Disk,
+            out_dir,
+            "node1".to_string(),
+            vec![],
+            BTreeMap::new(),
+            config,
+            Format::Networkd,
+        )?;
+
+        let host_dir = Path::new(out_dir).join("node1");
+        let mut filenames: Vec<String> = fs::read_dir(&host_dir)?
+            .map(|entry| entry.map(|e| e.file_name().to_string_lossy().to_string()))
+            .collect::<Result<_, _>>()?;
+        filenames.sort();
+        assert_eq!(filenames, ["10-eth0.network"]);
+        assert_eq!(
+            fs::read_to_string(host_dir.join("10-eth0.network"))?,
+            "[Match]\nName=eth0\n\n[Network]\nDHCP=ipv4\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n"
+        );
+        assert!(Path::new(out_dir).join(HOST_MAPPING_FILE).exists());
+
+        // cleanup
+        fs::remove_dir_all(out_dir)?;
+
+        Ok(())
+    }
+
+    #[test]
+    fn add_profiles_to_interfaces() -> Result<(), anyhow::Error> {
+        let interface = |name: &str| Interface {
+            logical_name: name.to_string(),
+            interface_type: "ethernet".to_string(),
+            ..Default::default()
+        };
+        let mut interfaces = vec![interface("eth0"), interface("eth1")];
+        let mut config = vec![(
+            "eth0.nmconnection".to_string(),
+            "[connection]\nid=eth0\nuuid=dfd202f5-562f-5f07-8f2a-a7717756fb70\n".to_string(),
+        )];
+        let profile_config = vec![
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\nuuid=dfd202f5-562f-5f07-8f2a-a7717756fb70\nautoconnect-priority=-10\n"
+                    .to_string(),
+            ),
+            (
+                "lo.nmconnection".to_string(),
+                "[connection]\nid=lo\ntype=loopback\n".to_string(),
+            ),
+        ];
+
+        add_profiles(
+            "dhcp",
+            &mut interfaces,
+            &mut config,
+            vec![interface("eth0")],
+            profile_config.clone(),
+        )?;
+
+        assert_eq!(interfaces[0].profiles, ["dhcp"]);
+        assert!(interfaces[1].profiles.is_empty());
+        assert_eq!(config.len(), 2);
+        assert_eq!(config[1].0, "eth0@dhcp.nmconnection");
+        assert_eq!(
+            config[1].1,
+            format!(
+                "[connection]\nid=eth0@dhcp\nuuid={}\nautoconnect-priority=-10\n",
+                derive_uuid("dfd202f5-562f-5f07-8f2a-a7717756fb70@dhcp")
+            )
+        );
+
+        assert_eq!(
+            add_profiles(
+                "dhcp",
+                &mut interfaces,
+                &mut config,
+                vec![interface("eth2")],
+                vec![]
+            )
+            .unwrap_err()
+            .to_string(),
+            "Interface 'eth2' is not part of the host's config"
+        );
+        assert!(add_profiles("", &mut interfaces, &mut config, vec![], vec![]).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn add_profiles_of_bond() -> Result<(), anyhow::Error> {
+        let interface = |name: &str, interface_type: &str| Interface {
+            logical_name: name.to_string(),
+            interface_type: interface_type.to_string(),
+            ..Default::default()
+        };
+        let bond_uuid = "2a3f2f3e-1a1a-4b5b-8c8c-0d0d0d0d0d01";
+        let port = |uuid: &str| {
+            format!(
+                "[connection]\nid=eth0\nuuid=2a3f2f3e-1a1a-4b5b-8c8c-0d0d0d0d0d02\ntype=ethernet\n\
+                 interface-name=eth0\ncontroller={uuid}\nport-type=bond\n"
+            )
+        };
+        let bond =
+            format!("[connection]\nid=bond0\nuuid={bond_uuid}\ntype=bond\ninterface-name=bond0\n");
+
+        let mut interfaces = vec![interface("bond0", "bond"), interface("eth0", "ethernet")];
+        let mut config = vec![
+            ("bond0.nmconnection".to_string(), bond.clone()),
+            ("eth0.nmconnection".to_string(), port(bond_uuid)),
+        ];
+        // Generated from its own desired state, here with the same UUIDs as the primary connections
+        add_profiles(
+            "backup",
+            &mut interfaces,
+            &mut config,
+            vec![interface("bond0", "bond"), interface("eth0", "ethernet")],
+            vec![
+                ("bond0.nmconnection".to_string(), bond),
+                ("eth0.nmconnection".to_string(), port(bond_uuid)),
+            ],
+        )?;
+
+        let profile_bond_uuid = derive_uuid(&format!("{bond_uuid}@backup"));
+        let controller = |content: &str| {
+            Keyfile::parse(content)
+                .get("connection", "controller")
+                .map(str::to_string)
+        };
+        assert_eq!(config[2].0, "bond0@backup.nmconnection");
+        assert_eq!(
+            Keyfile::parse(&config[2].1).get("connection", "uuid"),
+            Some(profile_bond_uuid.as_str())
+        );
+        assert_eq!(config[3].0, "eth0@backup.nmconnection");
+        assert_eq!(controller(&config[3].1), Some(profile_bond_uuid.clone()));
+        // The primary port keeps referring to the primary bond
+        assert_eq!(controller(&config[1].1).as_deref(), Some(bond_uuid));
+
+        // Still the case once the UUIDs are derived from the hostname
+        derive_connection_uuids("node1", &mut config);
+        let uuid = |index: usize| {
+            Keyfile::parse(&config[index].1)
+                .get("connection", "uuid")
+                .map(str::to_string)
+        };
+        assert_eq!(controller(&config[1].1), uuid(0));
+        assert_eq!(controller(&config[3].1), uuid(2));
+        assert_ne!(uuid(0), uuid(2));
+
+        Ok(())
+    }
+
+    #[test]
+    fn derive_uuids_of_connections() {
+        let config = vec![
+            (
+                "bond0.nmconnection".to_string(),
+                "[connection]\nid=bond0\nuuid=11111111-2222-3333-4444-555555555555\ninterface-name=bond0\n"
+                    .to_string(),
+            ),
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\nuuid=22222222-3333-4444-5555-666666666666\ninterface-name=eth0\n\
+                 controller=11111111-2222-3333-4444-555555555555\n"
+                    .to_string(),
+            ),
+        ];
+
+        let mut node1 = config.clone();
+        derive_connection_uuids("node1", &mut node1);
+        let bond0 = derive_uuid("node1/bond0/bond0");
+        assert_eq!(
+            node1,
+            vec![
+                (
+                    "bond0.nmconnection".to_string(),
+                    format!("[connection]\nid=bond0\nuuid={bond0}\ninterface-name=bond0\n"),
+                ),
+                (
+                    "eth0.nmconnection".to_string(),
+                    format!(
+                        "[connection]\nid=eth0\nuuid={}\ninterface-name=eth0\ncontroller={bond0}\n",
+                        derive_uuid("node1/eth0/eth0")
+                    ),
+                ),
+            ]
+        );
+
+        let mut node2 = config.clone();
+        derive_connection_uuids("node2", &mut node2);
+        assert_ne!(node1, node2);
+
+        let mut again = config;
+        derive_connection_uuids("node1", &mut again);
+        assert_eq!(node1, again);
+    }
+
+    #[test]
+    fn format_keyfiles_with_names() {
+        let config = vec![
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\n".to_string(),
+            ),
+            (
+                "bond0.nmconnection".to_string(),
+                "[connection]\nid=bond0\n".to_string(),
+            ),
+        ];
+
+        assert_eq!(
+            format_keyfiles(&config),
+            "# eth0.nmconnection\n[connection]\nid=eth0\n\n# bond0.nmconnection\n[connection]\nid=bond0\n"
+        );
+        assert_eq!(format_keyfiles(&vec![]), "");
+    }
+
     #[test]
     fn generate_fails_due_to_empty_dir() {
         fs::create_dir_all("empty").unwrap();
 
-        let error = generate("empty", "_out").unwrap_err();
+        let error = generate("empty", "_out", &GenerateOptions::default(), &Disk).unwrap_err();
         assert_eq!(error.to_string(), "Empty config directory");
 
         fs::remove_dir_all("empty").unwrap();
@@ -212,7 +1467,7 @@ mod tests {
 
     #[test]
     fn generate_fails_due_to_missing_path() {
-        let error = generate("<missing>", "_out").unwrap_err();
+        let error = generate("<missing>", "_out", &GenerateOptions::default(), &Disk).unwrap_err();
         assert!(error.to_string().contains("No such file or directory"))
     }
 
@@ -249,11 +1504,13 @@ mod tests {
                     logical_name: "bridge0".to_string(),
                     mac_address: Option::from("FE:C4:05:42:8B:AB".to_string()),
                     interface_type: "linux-bridge".to_string(),
+                    ..Default::default()
                 },
                 Interface {
                     logical_name: "eth1".to_string(),
                     mac_address: Option::from("FE:C4:05:42:8B:AA".to_string()),
                     interface_type: "ethernet".to_string(),
+                    ..Default::default()
                 },
             ]
         );
@@ -266,18 +1523,21 @@ mod tests {
         let interfaces = vec![
             Interface {
                 logical_name: "eth3.1365".to_string(),
-                mac_address: None,
                 interface_type: "vlan".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "bond0".to_string(),
-                mac_address: None,
                 interface_type: "bond".to_string(),
+                ..Default::default()
             },
         ];
 
         let error = validate_interfaces(&interfaces).unwrap_err();
-        assert_eq!(error.to_string(), "No Ethernet interfaces were provided")
+        assert_eq!(
+            error.to_string(),
+            "No Ethernet or InfiniBand interfaces were provided"
+        )
     }
 
     #[test]
@@ -287,38 +1547,41 @@ mod tests {
                 logical_name: "eth0".to_string(),
                 mac_address: Option::from("00:11:22:33:44:55".to_string()),
                 interface_type: "ethernet".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "eth1".to_string(),
-                mac_address: None,
                 interface_type: "ethernet".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "eth2".to_string(),
                 mac_address: Option::from("00:11:22:33:44:56".to_string()),
                 interface_type: "ethernet".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "eth3".to_string(),
-                mac_address: None,
                 interface_type: "ethernet".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "eth3.1365".to_string(),
-                mac_address: None,
                 interface_type: "vlan".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "bond0".to_string(),
                 mac_address: Option::from("00:11:22:33:44:58".to_string()),
                 interface_type: "bond".to_string(),
+                ..Default::default()
             },
         ];
 
         let error = validate_interfaces(&interfaces).unwrap_err();
         assert_eq!(
             error.to_string(),
-            "Detected Ethernet interfaces without a MAC address: eth1, eth3"
+            "Detected Ethernet or InfiniBand interfaces without a MAC address: eth1, eth3"
         )
     }
 
@@ -329,16 +1592,17 @@ mod tests {
                 logical_name: "eth0".to_string(),
                 mac_address: Option::from("00:11:22:33:44:55".to_string()),
                 interface_type: "ethernet".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "eth0.1365".to_string(),
-                mac_address: None,
                 interface_type: "vlan".to_string(),
+                ..Default::default()
             },
             Interface {
                 logical_name: "bond0".to_string(),
-                mac_address: None,
                 interface_type: "bond".to_string(),
+                ..Default::default()
             },
         ];
 
@@ -0,0 +1,295 @@
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{anyhow, Context};
+use log::{debug, info};
+
+use crate::filesystem::FileSystem;
+use crate::report::ApplyReport;
+
+/// Directory next to the state file keeping the reports of past apply runs.
+const HISTORY_DIR: &str = "history";
+const SECONDS_PER_DAY: u64 = 24 * 60 * 60;
+/// Entries are named after the time they were recorded at, e.g. `report-1716248311000.json`.
+const ENTRY_PREFIX: &str = "report-";
+const ENTRY_SUFFIX: &str = ".json";
+
+/// Returns the directory holding the history, next to the state file.
+pub(crate) fn history_dir(state_file: &str) -> PathBuf {
+    Path::new(state_file)
+        .parent()
+        .unwrap_or(Path::new(""))
+        .join(HISTORY_DIR)
+}
+
+/// Bounds of the history, so that it can't fill up storage-constrained devices.
+/// Entries exceeding any of the bounds are removed oldest first, but the newest one is always kept.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub(crate) struct RetentionPolicy {
+    pub(crate) max_count: Option<usize>,
+    pub(crate) max_age: Option<Duration>,
+    /// Total size of the entries in bytes.
+    pub(crate) max_size: Option<u64>,
+}
+
+impl Default for RetentionPolicy {
+    fn default() -> Self {
+        RetentionPolicy {
+            max_count: Some(50),
+            max_age: Some(Duration::from_secs(90 * SECONDS_PER_DAY)),
+            max_size: Some(10 * 1024 * 1024),
+        }
+    }
+}
+
+struct Entry {
+    path: PathBuf,
+    recorded: SystemTime,
+    size: u64,
+}
+
+/// Archive the report of a successful apply run and enforce the retention policy on the history.
+pub(crate) fn record(
+    filesystem: &dyn FileSystem,
+    dir: &Path,
+    report: &ApplyReport,
+    policy: &RetentionPolicy,
+) -> Result<(), anyhow::Error> {
+    filesystem
+        .create_dir_all(dir)
+        .context("Creating history dir")?;
+
+    let millis = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_millis();
+    let path = dir.join(format!("{ENTRY_PREFIX}{millis}{ENTRY_SUFFIX}"));
+
+    let contents = serde_json::to_vec_pretty(report).context("Serializing history entry")?;
+    filesystem
+        .write(&path, &contents, 0o666)
+        .context("Writing history entry")?;
+    debug!("Recorded {path:?}");
+
+    prune(filesystem, dir, policy, SystemTime::now())?;
+
+    Ok(())
+}
+
+/// Remove the history entries exceeding the retention policy. Returns the removed paths.
+pub(crate) fn prune(
+    filesystem: &dyn FileSystem,
+    dir: &Path,
+    policy: &RetentionPolicy,
+    now: SystemTime,
+) -> Result<Vec<PathBuf>, anyhow::Error> {
+    let mut entries = load_entries(filesystem, dir).context("Reading history")?;
+    // Newest first, so that the entries to remove are the ones at the end.
+    entries.sort_by(|a, b| b.recorded.cmp(&a.recorded).then(b.path.cmp(&a.path)));
+
+    let mut keep = entries.len();
+
+    if let Some(max_age) = policy.max_age {
+        let fresh = entries
+            .iter()
+            .take_while(|entry| {
+                now.duration_since(entry.recorded)
+                    .map_or(true, |age| age <= max_age)
+            })
+            .count();
+        keep = keep.min(fresh);
+    }
+
+    if let Some(max_count) = policy.max_count {
+        keep = keep.min(max_count);
+    }
+
+    if let Some(max_size) = policy.max_size {
+        let mut total = 0;
+        let within = entries
+            .iter()
+            .take_while(|entry| {
+                total += entry.size;
+                total <= max_size
+            })
+            .count();
+        keep = keep.min(within);
+    }
+
+    let mut removed = Vec::new();
+
+    for entry in entries.into_iter().skip(keep.max(1)) {
+        filesystem
+            .remove_file(&entry.path)
+            .with_context(|| format!("Removing {:?}", entry.path))?;
+        debug!("Removed history entry {:?}", entry.path);
+        removed.push(entry.path);
+    }
+
+    if !removed.is_empty() {
+        info!(
+            "Removed {} history entries exceeding the retention policy",
+            removed.len()
+        );
+    }
+
+    Ok(removed)
+}
+
+/// Load the entries of the history, ordered by the time of recording in their names, since the filesystem
+/// may not track modification times. Other files are left alone.
+fn load_entries(filesystem: &dyn FileSystem, dir: &Path) -> Result<Vec<Entry>, anyhow::Error> {
+    let mut entries = Vec::new();
+
+    for path in filesystem.list_files(dir)? {
+        let Some(millis) = path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .and_then(|name| name.strip_prefix(ENTRY_PREFIX))
+            .and_then(|name| name.strip_suffix(ENTRY_SUFFIX))
+            .and_then(|millis| millis.parse().ok())
+        else {
+            debug!("Skipping {path:?}, which is not a history entry");
+            continue;
+        };
+
+        let size = filesystem.read(&path)?.map_or(0, |contents| contents.len());
+        entries.push(Entry {
+            path,
+            recorded: UNIX_EPOCH + Duration::from_millis(millis),
+            size: size as u64,
+        });
+    }
+
+    Ok(entries)
+}
+
+/// Parse a size given in bytes, optionally with a binary `K`, `M` or `G` suffix (e.g. `10M`).
+pub(crate) fn parse_size(value: &str) -> Result<u64, anyhow::Error> {
+    let (number, multiplier) = match value.char_indices().last() {
+        Some((index, 'K' | 'k')) => (&value[..index], 1024),
+        Some((index, 'M' | 'm')) => (&value[..index], 1024 * 1024),
+        Some((index, 'G' | 'g')) => (&value[..index], 1024 * 1024 * 1024),
+        _ => (value, 1),
+    };
+
+    number
+        .parse::<u64>()
+        .ok()
+        .and_then(|number| number.checked_mul(multiplier))
+        .ok_or_else(|| anyhow!("Invalid size '{value}'"))
+}
+
+pub(crate) fn days(days: u64) -> Duration {
+    Duration::from_secs(days * SECONDS_PER_DAY)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::{Path, PathBuf};
+    use std::time::{Duration, UNIX_EPOCH};
+
+    use crate::filesystem::{FileSystem, Memory};
+    use crate::history::{days, history_dir, parse_size, prune, RetentionPolicy};
+
+    #[test]
+    fn history_dir_next_to_state_file() {
+        assert_eq!(
+            history_dir("/var/lib/nm-configurator/state.yaml"),
+            Path::new("/var/lib/nm-configurator/history")
+        );
+    }
+
+    #[test]
+    fn prune_by_policy() {
+        let filesystem = Memory::default();
+        let dir = Path::new("_history");
+
+        // Entries recorded one second apart, the first one being the oldest
+        let start = UNIX_EPOCH + Duration::from_secs(1716248311);
+        let paths: Vec<PathBuf> = (0..5)
+            .map(|index| {
+                let millis = (start + Duration::from_secs(index))
+                    .duration_since(UNIX_EPOCH)
+                    .unwrap()
+                    .as_millis();
+                let path = dir.join(format!("report-{millis}.json"));
+                filesystem.write(&path, &[b'x'; 100], 0o666).unwrap();
+                path
+            })
+            .collect();
+        // Files not named like entries are left alone
+        let other = dir.join("notes.txt");
+        filesystem.write(&other, &[b'x'; 1000], 0o666).unwrap();
+        let now = start + Duration::from_secs(10);
+
+        let unbounded = RetentionPolicy {
+            max_count: None,
+            max_age: None,
+            max_size: None,
+        };
+        assert!(prune(&filesystem, dir, &unbounded, now).unwrap().is_empty());
+
+        let by_count = RetentionPolicy {
+            max_count: Some(4),
+            ..unbounded
+        };
+        assert_eq!(
+            prune(&filesystem, dir, &by_count, now).unwrap(),
+            vec![paths[0].clone()]
+        );
+
+        let by_size = RetentionPolicy {
+            max_size: Some(350),
+            ..unbounded
+        };
+        assert_eq!(
+            prune(&filesystem, dir, &by_size, now).unwrap(),
+            vec![paths[1].clone()]
+        );
+
+        let by_age = RetentionPolicy {
+            max_age: Some(Duration::from_secs(7)),
+            ..unbounded
+        };
+        assert_eq!(
+            prune(&filesystem, dir, &by_age, now).unwrap(),
+            vec![paths[2].clone()]
+        );
+
+        // The newest entry is kept even if it exceeds the policy
+        let by_everything = RetentionPolicy {
+            max_count: Some(0),
+            max_age: Some(Duration::ZERO),
+            max_size: Some(0),
+        };
+        assert_eq!(
+            prune(&filesystem, dir, &by_everything, now).unwrap(),
+            vec![paths[3].clone()]
+        );
+        assert_eq!(
+            filesystem.files().into_keys().collect::<Vec<_>>(),
+            [other, paths[4].clone()]
+        );
+
+        assert!(
+            prune(&filesystem, Path::new("_history/missing"), &by_count, now)
+                .unwrap()
+                .is_empty()
+        );
+    }
+
+    #[test]
+    fn parse_sizes() {
+        assert_eq!(parse_size("512").unwrap(), 512);
+        assert_eq!(parse_size("4K").unwrap(), 4096);
+        assert_eq!(parse_size("10M").unwrap(), 10 * 1024 * 1024);
+        assert_eq!(parse_size("1g").unwrap(), 1024 * 1024 * 1024);
+        assert!(parse_size("").is_err());
+        assert!(parse_size("M").is_err());
+        assert!(parse_size("10MB").is_err());
+        assert!(parse_size("-1").is_err());
+
+        assert_eq!(days(2), Duration::from_secs(172800));
+    }
+}
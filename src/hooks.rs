@@ -0,0 +1,313 @@
+use std::fmt;
+use std::fs;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use anyhow::{anyhow, Context};
+use log::info;
+use serde::Deserialize;
+
+use crate::deadline;
+use crate::yaml;
+
+/// Local dir owned by the operator which hooks are loaded from, unless the ones of the config dir are allowed.
+pub(crate) const LOCAL_HOOKS_DIR: &str = "/etc/nmc";
+/// Directory containing executables named after the hook they implement.
+const HOOKS_DIR: &str = "hooks";
+/// File declaring shell commands per hook.
+const HOOKS_FILE: &str = "hooks.yaml";
+
+/// Point of an apply run at which hooks are executed.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(crate) enum Hook {
+    /// The host was identified, nothing was written yet.
+    PreApply,
+    /// The files of the host were stored.
+    PostApply,
+    /// The run failed.
+    OnFailure,
+}
+
+impl fmt::Display for Hook {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Hook::PreApply => write!(f, "pre-apply"),
+            Hook::PostApply => write!(f, "post-apply"),
+            Hook::OnFailure => write!(f, "on-failure"),
+        }
+    }
+}
+
+/// Shell commands per hook, e.g.
+///
+/// ```yaml
+/// post-apply:
+///   - systemctl restart keepalived
+/// ```
+#[derive(Deserialize, Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+#[serde(deny_unknown_fields, rename_all = "kebab-case")]
+struct HookCommands {
+    #[serde(default)]
+    pre_apply: Vec<String>,
+    #[serde(default)]
+    post_apply: Vec<String>,
+    #[serde(default)]
+    on_failure: Vec<String>,
+}
+
+/// Hooks shipped in a dir.
+#[derive(Debug, Default)]
+pub(crate) struct Hooks {
+    dir: PathBuf,
+    commands: HookCommands,
+}
+
+/// Details of the run passed to the hooks via environment variables.
+#[derive(Debug, Default)]
+pub(crate) struct HookContext<'a> {
+    pub(crate) config_dir: &'a str,
+    /// Identified host, unknown if the run failed before identifying it.
+    pub(crate) hostname: Option<&'a str>,
+    /// Files created, updated or removed by the run.
+    pub(crate) files: Vec<PathBuf>,
+    pub(crate) error: Option<String>,
+}
+
+impl HookContext<'_> {
+    fn env(&self, hook: Hook) -> Vec<(&'static str, String)> {
+        let mut env = vec![
+            ("NMC_HOOK", hook.to_string()),
+            ("NMC_CONFIG_DIR", self.config_dir.to_string()),
+        ];
+        if let Some(hostname) = self.hostname {
+            env.push(("NMC_HOSTNAME", hostname.to_string()));
+        }
+        if hook == Hook::PostApply {
+            let files: Vec<_> = self
+                .files
+                .iter()
+                .map(|path| path.to_string_lossy())
+                .collect();
+            env.push(("NMC_FILES", files.join("\n")));
+        }
+        if let Some(error) = &self.error {
+            env.push(("NMC_ERROR", error.clone()));
+        }
+
+        env
+    }
+}
+
+impl Hooks {
+    /// Returns whether the dir ships a hooks dir or hooks file.
+    pub(crate) fn exist(dir: &str) -> bool {
+        let dir = Path::new(dir);
+        dir.join(HOOKS_FILE).exists() || dir.join(HOOKS_DIR).exists()
+    }
+
+    /// Load the hooks of the dir. Returns no hooks if neither the hooks dir nor the hooks file exist.
+    pub(crate) fn load(config_dir: &str) -> Result<Self, anyhow::Error> {
+        let path = Path::new(config_dir).join(HOOKS_FILE);
+        let commands = if path.exists() {
+            let file = fs::File::open(path).context("Opening hooks file")?;
+            yaml::from_reader(file).context("Parsing hooks file")?
+        } else {
+            HookCommands::default()
+        };
+
+        Ok(Hooks {
+            dir: Path::new(config_dir).join(HOOKS_DIR),
+            commands,
+        })
+    }
+
+    /// Run the executable of the hook followed by its commands, failing on the first one exiting unsuccessfully.
+    pub(crate) fn run(&self, hook: Hook, context: &HookContext) -> Result<(), anyhow::Error> {
+        let commands = match hook {
+            Hook::PreApply => &self.commands.pre_apply,
+            Hook::PostApply => &self.commands.post_apply,
+            Hook::OnFailure => &self.commands.on_failure,
+        };
+        let env = context.env(hook);
+
+        let executable = self.dir.join(hook.to_string());
+        if executable.exists() {
+            let mode = fs::metadata(&executable)
+                .with_context(|| format!("Reading {executable:?}"))?
+                .permissions()
+                .mode();
+            if mode & 0o111 == 0 {
+                return Err(anyhow!("Hook {executable:?} is not executable"));
+            }
+
+            info!("Running {hook} hook {executable:?}");
+            run_command(Command::new(&executable), &env)
+                .with_context(|| format!("Running {hook} hook {executable:?}"))?;
+        }
+
+        for command in commands {
+            info!("Running {hook} hook '{command}'");
+            let mut sh = Command::new("sh");
+            sh.arg("-c").arg(command);
+            run_command(sh, &env).with_context(|| format!("Running {hook} hook '{command}'"))?;
+        }
+
+        Ok(())
+    }
+}
+
+fn run_command(mut command: Command, env: &[(&str, String)]) -> Result<(), anyhow::Error> {
+    let status = deadline::status(command.envs(env.iter().map(|(key, value)| (key, value))))?;
+    if !status.success() {
+        return Err(anyhow!("Exited with {status}"));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::{Path, PathBuf};
+
+    use crate::hooks::{Hook, HookCommands, HookContext, Hooks};
+
+    #[test]
+    fn load_hooks() {
+        let config_dir = "_hooks_load";
+        fs::create_dir_all(config_dir).unwrap();
+
+        assert!(!Hooks::exist(config_dir));
+        assert_eq!(
+            Hooks::load(config_dir).unwrap().commands,
+            HookCommands::default()
+        );
+
+        // JSON is valid YAML
+        fs::write(
+            Path::new(config_dir).join("hooks.yaml"),
+            r#"{"pre-apply": ["true"], "on-failure": ["logger failed", "false"]}"#,
+        )
+        .unwrap();
+        assert!(Hooks::exist(config_dir));
+        assert_eq!(
+            Hooks::load(config_dir).unwrap().commands,
+            HookCommands {
+                pre_apply: vec!["true".to_string()],
+                post_apply: Vec::new(),
+                on_failure: vec!["logger failed".to_string(), "false".to_string()],
+            }
+        );
+
+        fs::write(
+            Path::new(config_dir).join("hooks.yaml"),
+            r#"{"after-apply": ["true"]}"#,
+        )
+        .unwrap();
+        assert!(Hooks::load(config_dir).is_err());
+
+        // cleanup
+        fs::remove_dir_all(config_dir).unwrap();
+    }
+
+    #[test]
+    fn hook_context_env() {
+        let context = HookContext {
+            config_dir: "config",
+            hostname: Some("node1"),
+            files: vec![
+                PathBuf::from("/etc/NetworkManager/system-connections/eth0.nmconnection"),
+                PathBuf::from("/etc/NetworkManager/system-connections/eth1.nmconnection"),
+            ],
+            error: None,
+        };
+
+        assert_eq!(
+            context.env(Hook::PostApply),
+            vec![
+                ("NMC_HOOK", "post-apply".to_string()),
+                ("NMC_CONFIG_DIR", "config".to_string()),
+                ("NMC_HOSTNAME", "node1".to_string()),
+                (
+                    "NMC_FILES",
+                    "/etc/NetworkManager/system-connections/eth0.nmconnection\n\
+                     /etc/NetworkManager/system-connections/eth1.nmconnection"
+                        .to_string()
+                ),
+            ]
+        );
+
+        let context = HookContext {
+            config_dir: "config",
+            error: Some("Parsing config".to_string()),
+            ..HookContext::default()
+        };
+        assert_eq!(
+            context.env(Hook::OnFailure),
+            vec![
+                ("NMC_HOOK", "on-failure".to_string()),
+                ("NMC_CONFIG_DIR", "config".to_string()),
+                ("NMC_ERROR", "Parsing config".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn run_hooks() {
+        let config_dir = "_hooks_run";
+        let hooks_dir = Path::new(config_dir).join("hooks");
+        fs::create_dir_all(&hooks_dir).unwrap();
+
+        let output = Path::new(config_dir).join("output");
+        let executable = hooks_dir.join("post-apply");
+        fs::write(
+            &executable,
+            format!(
+                "#!/bin/sh\necho \"$NMC_HOOK $NMC_HOSTNAME\" >> {}\n",
+                output.display()
+            ),
+        )
+        .unwrap();
+        fs::write(
+            Path::new(config_dir).join("hooks.yaml"),
+            format!(
+                r#"{{"post-apply": ["echo \"$NMC_FILES\" >> {}"], "on-failure": ["false"]}}"#,
+                output.display()
+            ),
+        )
+        .unwrap();
+
+        let hooks = Hooks::load(config_dir).unwrap();
+        let context = HookContext {
+            config_dir,
+            hostname: Some("node1"),
+            files: vec![PathBuf::from("/etc/eth0.nmconnection")],
+            error: None,
+        };
+
+        // Not executable yet
+        assert!(hooks.run(Hook::PostApply, &context).is_err());
+
+        fs::set_permissions(&executable, fs::Permissions::from_mode(0o755)).unwrap();
+        hooks.run(Hook::PostApply, &context).unwrap();
+        assert_eq!(
+            fs::read_to_string(&output).unwrap(),
+            "post-apply node1\n/etc/eth0.nmconnection\n"
+        );
+
+        hooks.run(Hook::PreApply, &context).unwrap();
+        assert_eq!(
+            hooks
+                .run(Hook::OnFailure, &context)
+                .unwrap_err()
+                .to_string(),
+            "Running on-failure hook 'false'"
+        );
+
+        // cleanup
+        fs::remove_dir_all(config_dir).unwrap();
+    }
+}
@@ -0,0 +1,85 @@
+use std::fs;
+use std::io;
+
+use anyhow::Context;
+use log::{info, warn};
+use serde::Deserialize;
+
+/// Identity of the machine written by the manufacturer, e.g. to a small vendor partition:
+///
+/// ```json
+/// {"serial": "SN123456", "site": "fra1", "hostname": "node1"}
+/// ```
+#[derive(Deserialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct MachineIdentity {
+    #[serde(default)]
+    pub(crate) serial: Option<String>,
+    #[serde(default)]
+    pub(crate) site: Option<String>,
+    #[serde(alias = "host_name")]
+    pub(crate) hostname: String,
+}
+
+impl MachineIdentity {
+    /// Load the identity from the given path. Returns `None` if the file does not exist,
+    /// since not every machine of a fleet is necessarily provisioned with one.
+    pub(crate) fn load(path: &str) -> Result<Option<Self>, anyhow::Error> {
+        let file = match fs::File::open(path) {
+            Ok(file) => file,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => {
+                warn!("Identity file {path:?} not found, identifying host by MAC addresses");
+                return Ok(None);
+            }
+            Err(err) => return Err(err).context("Opening identity file"),
+        };
+
+        let identity: MachineIdentity =
+            serde_json::from_reader(file).context("Parsing identity file")?;
+        info!(
+            "Loaded machine identity: hostname '{}', serial '{}', site '{}'",
+            identity.hostname,
+            identity.serial.as_deref().unwrap_or("--"),
+            identity.site.as_deref().unwrap_or("--")
+        );
+
+        Ok(Some(identity))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+
+    use crate::identity::MachineIdentity;
+
+    #[test]
+    fn load_identity() {
+        let dir = "_identity";
+        fs::create_dir_all(dir).unwrap();
+
+        fs::write(
+            "_identity/machine-identity.json",
+            r#"{"serial": "SN123456", "site": "fra1", "host_name": "node1"}"#,
+        )
+        .unwrap();
+        assert_eq!(
+            MachineIdentity::load("_identity/machine-identity.json").unwrap(),
+            Some(MachineIdentity {
+                serial: Some("SN123456".to_string()),
+                site: Some("fra1".to_string()),
+                hostname: "node1".to_string(),
+            })
+        );
+
+        fs::write("_identity/invalid.json", r#"{"serial": "SN123456"}"#).unwrap();
+        assert!(MachineIdentity::load("_identity/invalid.json").is_err());
+
+        assert!(MachineIdentity::load("_identity/missing.json")
+            .unwrap()
+            .is_none());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
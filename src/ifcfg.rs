@@ -0,0 +1,488 @@
+use anyhow::anyhow;
+use log::warn;
+
+use crate::keyfile::{Keyfile, CONNECTION_FILE_EXT};
+use crate::netplan::NETPLAN_FILE;
+use crate::networkd::FILE_PREFIX;
+
+/// Directory read by the ifcfg-rh plugin of NetworkManager.
+pub(crate) const NETWORK_SCRIPTS_DIR: &str = "/etc/sysconfig/network-scripts";
+
+/// Settings emitted by nmstate which match the defaults of the ifcfg-rh plugin and are dropped silently.
+const DEFAULT_KEYS: [&str; 4] = [
+    "connection.autoconnect-slaves",
+    "ipv4.dhcp-timeout",
+    "ipv6.dhcp-timeout",
+    "vlan.flags",
+];
+
+/// Format of the stored connection files.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub(crate) enum Format {
+    /// NetworkManager keyfiles (*.nmconnection).
+    #[default]
+    Keyfile,
+    /// `ifcfg-*` files of the ifcfg-rh plugin used by legacy distributions.
+    Ifcfg,
+    /// `.network` and `.netdev` files of systemd-networkd, only produced by `generate`.
+    Networkd,
+    /// A single netplan YAML file per host for Ubuntu-based nodes, only produced by `generate`.
+    Netplan,
+}
+
+impl Format {
+    /// Returns the file name of the connection with the given name, e.g. `eth0.nmconnection` or `ifcfg-eth0`.
+    /// Virtual interfaces are additionally described by a `.netdev` file in the networkd format,
+    /// while all connections of a host share the same file in the netplan format.
+    pub(crate) fn filename(&self, name: &str) -> String {
+        match self {
+            Format::Keyfile => format!("{name}.{CONNECTION_FILE_EXT}"),
+            Format::Ifcfg => format!("ifcfg-{name}"),
+            Format::Networkd => format!("{FILE_PREFIX}{name}.network"),
+            Format::Netplan => NETPLAN_FILE.to_string(),
+        }
+    }
+}
+
+/// Convert the keyfile into an `ifcfg-*` file for the ifcfg-rh plugin.
+///
+/// Only the commonly used settings of Ethernet, bond, VLAN and bridge connections can be expressed.
+/// Any other settings are reported in a warning, so that silently lost configuration is never deployed unnoticed.
+pub(crate) fn to_ifcfg(name: &str, keyfile: &Keyfile) -> Result<String, anyhow::Error> {
+    let mut ifcfg = Ifcfg::default();
+    let mut unsupported = Vec::new();
+
+    let connection_type = keyfile.get("connection", "type").unwrap_or_default();
+    match connection_type {
+        "802-3-ethernet" | "ethernet" => ifcfg.push("TYPE", "Ethernet"),
+        "bond" => {
+            ifcfg.push("TYPE", "Bond");
+            ifcfg.push("BONDING_MASTER", "yes");
+        }
+        "vlan" => {
+            ifcfg.push("TYPE", "Vlan");
+            ifcfg.push("VLAN", "yes");
+        }
+        "bridge" => ifcfg.push("TYPE", "Bridge"),
+        _ => {
+            return Err(anyhow!(
+                "Connection type '{connection_type}' of '{name}' is not supported by ifcfg files"
+            ))
+        }
+    }
+
+    let mut port_type = None;
+    let mut controller = None;
+    for (key, value) in keyfile.entries("connection") {
+        match key {
+            "type" => {}
+            "id" => ifcfg.push("NAME", value),
+            "uuid" => ifcfg.push("UUID", value),
+            "interface-name" => ifcfg.push("DEVICE", value),
+            "autoconnect" => ifcfg.push("ONBOOT", yes_no(value)),
+            "autoconnect-priority" => ifcfg.push("AUTOCONNECT_PRIORITY", value),
+            "zone" => ifcfg.push("ZONE", value),
+            "master" | "controller" => controller = Some(value),
+            "slave-type" | "port-type" => port_type = Some(value),
+            _ => unsupported.push(format!("connection.{key}")),
+        }
+    }
+
+    match (port_type, controller) {
+        (Some("bond"), Some(controller)) => {
+            ifcfg.push("MASTER", controller);
+            ifcfg.push("SLAVE", "yes");
+        }
+        (Some("bridge"), Some(controller)) => ifcfg.push("BRIDGE", controller),
+        (None, None) => {}
+        _ => unsupported.push("connection.controller".to_string()),
+    }
+
+    for section in ["ethernet", "802-3-ethernet"] {
+        for (key, value) in keyfile.entries(section) {
+            match key {
+                "mac-address" => ifcfg.push("HWADDR", value),
+                "cloned-mac-address" => ifcfg.push("MACADDR", value),
+                "mtu" => ifcfg.push("MTU", value),
+                _ => unsupported.push(format!("{section}.{key}")),
+            }
+        }
+    }
+
+    let mut dns = Vec::new();
+    convert_ipv4(keyfile, &mut ifcfg, &mut dns, &mut unsupported);
+    convert_ipv6(keyfile, &mut ifcfg, &mut dns, &mut unsupported);
+    for (index, server) in dns.iter().enumerate() {
+        ifcfg.push(&format!("DNS{}", index + 1), server);
+    }
+
+    for (key, value) in keyfile.entries("vlan") {
+        match key {
+            "id" => ifcfg.push("VLAN_ID", value),
+            "parent" => ifcfg.push("PHYSDEV", value),
+            _ => unsupported.push(format!("vlan.{key}")),
+        }
+    }
+
+    let bonding_opts: Vec<String> = keyfile
+        .entries("bond")
+        .map(|(key, value)| format!("{key}={value}"))
+        .collect();
+    if !bonding_opts.is_empty() {
+        ifcfg.push("BONDING_OPTS", &bonding_opts.join(" "));
+    }
+
+    let mut bridging_opts = Vec::new();
+    for (key, value) in keyfile.entries("bridge") {
+        match key {
+            "stp" => ifcfg.push("STP", yes_no(value)),
+            _ => bridging_opts.push(format!("{}={value}", key.replace('-', "_"))),
+        }
+    }
+    if !bridging_opts.is_empty() {
+        ifcfg.push("BRIDGING_OPTS", &bridging_opts.join(" "));
+    }
+
+    for section in keyfile.sections() {
+        if ![
+            "connection",
+            "ethernet",
+            "802-3-ethernet",
+            "ipv4",
+            "ipv6",
+            "vlan",
+            "bond",
+            "bridge",
+        ]
+        .contains(&section)
+        {
+            unsupported.extend(
+                keyfile
+                    .entries(section)
+                    .map(|(key, _)| format!("{section}.{key}")),
+            );
+        }
+    }
+
+    unsupported.retain(|key| !DEFAULT_KEYS.contains(&key.as_str()));
+    if !unsupported.is_empty() {
+        warn!(
+            file = name;
+            "Settings of '{name}' not supported by ifcfg files are dropped: {}",
+            unsupported.join(", ")
+        );
+    }
+
+    Ok(ifcfg.to_string())
+}
+
+fn convert_ipv4(
+    keyfile: &Keyfile,
+    ifcfg: &mut Ifcfg,
+    dns: &mut Vec<String>,
+    unsupported: &mut Vec<String>,
+) {
+    let mut address_index = 0;
+
+    for (key, value) in keyfile.entries("ipv4") {
+        match key {
+            "method" => match value {
+                "auto" => ifcfg.push("BOOTPROTO", "dhcp"),
+                "manual" | "disabled" => ifcfg.push("BOOTPROTO", "none"),
+                _ => unsupported.push(format!("ipv4.{key}")),
+            },
+            _ if is_address_key(key) => {
+                // Addresses may carry a gateway, e.g. `192.168.1.10/24,192.168.1.1`.
+                let (address, gateway) = value.split_once(',').unwrap_or((value, ""));
+                let (ip, prefix) = address.split_once('/').unwrap_or((address, "32"));
+
+                ifcfg.push(&format!("IPADDR{address_index}"), ip);
+                ifcfg.push(&format!("PREFIX{address_index}"), prefix);
+                if !gateway.is_empty() {
+                    ifcfg.push("GATEWAY", gateway);
+                }
+                address_index += 1;
+            }
+            "gateway" => ifcfg.push("GATEWAY", value),
+            "dns" => dns.extend(list_items(value)),
+            "dns-search" => ifcfg.push("DOMAIN", &list_items(value).join(" ")),
+            "never-default" => ifcfg.push("DEFROUTE", yes_no(&negate(value))),
+            "ignore-auto-dns" => ifcfg.push("PEERDNS", yes_no(&negate(value))),
+            "ignore-auto-routes" => ifcfg.push("PEERROUTES", yes_no(&negate(value))),
+            "route-metric" => ifcfg.push("IPV4_ROUTE_METRIC", value),
+            "dhcp-client-id" => ifcfg.push("DHCP_CLIENT_ID", value),
+            "dhcp-hostname" => ifcfg.push("DHCP_HOSTNAME", value),
+            "dhcp-send-hostname" => ifcfg.push("DHCP_SEND_HOSTNAME", yes_no(value)),
+            _ => unsupported.push(format!("ipv4.{key}")),
+        }
+    }
+}
+
+fn convert_ipv6(
+    keyfile: &Keyfile,
+    ifcfg: &mut Ifcfg,
+    dns: &mut Vec<String>,
+    unsupported: &mut Vec<String>,
+) {
+    let mut addresses = Vec::new();
+
+    for (key, value) in keyfile.entries("ipv6") {
+        match key {
+            "method" => match value {
+                "auto" => {
+                    ifcfg.push("IPV6INIT", "yes");
+                    ifcfg.push("IPV6_AUTOCONF", "yes");
+                }
+                "dhcp" => {
+                    ifcfg.push("IPV6INIT", "yes");
+                    ifcfg.push("IPV6_AUTOCONF", "no");
+                    ifcfg.push("DHCPV6C", "yes");
+                }
+                "manual" | "link-local" => {
+                    ifcfg.push("IPV6INIT", "yes");
+                    ifcfg.push("IPV6_AUTOCONF", "no");
+                }
+                "disabled" | "ignore" => ifcfg.push("IPV6INIT", "no"),
+                _ => unsupported.push(format!("ipv6.{key}")),
+            },
+            _ if is_address_key(key) => {
+                let (address, gateway) = value.split_once(',').unwrap_or((value, ""));
+                addresses.push(address.to_string());
+                if !gateway.is_empty() {
+                    ifcfg.push("IPV6_DEFAULTGW", gateway);
+                }
+            }
+            "gateway" => ifcfg.push("IPV6_DEFAULTGW", value),
+            "dns" => dns.extend(list_items(value)),
+            "never-default" => ifcfg.push("IPV6_DEFROUTE", yes_no(&negate(value))),
+            "ignore-auto-dns" => ifcfg.push("IPV6_PEERDNS", yes_no(&negate(value))),
+            "ignore-auto-routes" => ifcfg.push("IPV6_PEERROUTES", yes_no(&negate(value))),
+            "route-metric" => ifcfg.push("IPV6_ROUTE_METRIC", value),
+            "addr-gen-mode" => match value {
+                "0" | "eui64" => ifcfg.push("IPV6_ADDR_GEN_MODE", "eui64"),
+                "1" | "stable-privacy" => ifcfg.push("IPV6_ADDR_GEN_MODE", "stable-privacy"),
+                _ => unsupported.push(format!("ipv6.{key}")),
+            },
+            _ => unsupported.push(format!("ipv6.{key}")),
+        }
+    }
+
+    if let Some((first, secondaries)) = addresses.split_first() {
+        ifcfg.push("IPV6ADDR", first);
+        if !secondaries.is_empty() {
+            ifcfg.push("IPV6ADDR_SECONDARIES", &secondaries.join(" "));
+        }
+    }
+}
+
+/// Returns whether the key holds an address, i.e. `address` or `addressN`/`addressesN` in older keyfiles.
+pub(crate) fn is_address_key(key: &str) -> bool {
+    ["addresses", "address"].iter().any(|prefix| {
+        key.strip_prefix(prefix)
+            .is_some_and(|index| index.chars().all(|c| c.is_ascii_digit()))
+    })
+}
+
+pub(crate) fn list_items(value: &str) -> Vec<String> {
+    value
+        .split([';', ','])
+        .map(str::trim)
+        .filter(|item| !item.is_empty())
+        .map(str::to_string)
+        .collect()
+}
+
+pub(crate) fn yes_no(value: &str) -> &'static str {
+    match value {
+        "true" | "yes" | "1" => "yes",
+        _ => "no",
+    }
+}
+
+fn negate(value: &str) -> String {
+    (yes_no(value) == "no").to_string()
+}
+
+/// Contents of an `ifcfg-*` file, i.e. shell variable assignments in order.
+#[derive(Default)]
+struct Ifcfg {
+    entries: Vec<(String, String)>,
+}
+
+impl Ifcfg {
+    fn push(&mut self, key: &str, value: &str) {
+        self.entries.push((key.to_string(), value.to_string()));
+    }
+}
+
+impl std::fmt::Display for Ifcfg {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        for (key, value) in &self.entries {
+            writeln!(f, "{key}={}", quote(value))?;
+        }
+
+        Ok(())
+    }
+}
+
+/// Quote the value for the shell-like syntax of ifcfg files if it contains anything but safe characters.
+fn quote(value: &str) -> String {
+    let safe = !value.is_empty()
+        && value
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || "-_.:/@+,%=".contains(c));
+    if safe {
+        return value.to_string();
+    }
+
+    let mut quoted = String::from("\"");
+    for c in value.chars() {
+        if matches!(c, '"' | '\\' | '$' | '`') {
+            quoted.push('\\');
+        }
+        quoted.push(c);
+    }
+    quoted.push('"');
+
+    quoted
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::ifcfg::{quote, to_ifcfg, Format};
+    use crate::keyfile::Keyfile;
+
+    #[test]
+    fn convert_ethernet_keyfile() {
+        let keyfile = Keyfile::parse(
+            "[connection]\n\
+             autoconnect=true\n\
+             autoconnect-slaves=-1\n\
+             id=eth0\n\
+             interface-name=eth0\n\
+             type=802-3-ethernet\n\
+             uuid=dfd202f5-562f-5f07-8f2a-a7717756fb70\n\
+             \n\
+             [ipv4]\n\
+             address0=192.168.75.4/24,192.168.75.1\n\
+             dns=1.1.1.1;8.8.8.8;\n\
+             dhcp-timeout=2147483647\n\
+             method=manual\n\
+             \n\
+             [ipv6]\n\
+             address0=2001:db8::4/64\n\
+             address1=2001:db8::5/64\n\
+             addr-gen-mode=0\n\
+             method=manual\n\
+             \n\
+             [ethernet]\n\
+             cloned-mac-address=0E:4D:C6:B8:C4:72\n\
+             mtu=9000\n\
+             \n\
+             [ethtool]\n\
+             ring-rx=4096\n",
+        );
+
+        assert_eq!(
+            to_ifcfg("eth0", &keyfile).unwrap(),
+            "TYPE=Ethernet\n\
+             ONBOOT=yes\n\
+             NAME=eth0\n\
+             DEVICE=eth0\n\
+             UUID=dfd202f5-562f-5f07-8f2a-a7717756fb70\n\
+             MACADDR=0E:4D:C6:B8:C4:72\n\
+             MTU=9000\n\
+             IPADDR0=192.168.75.4\n\
+             PREFIX0=24\n\
+             GATEWAY=192.168.75.1\n\
+             BOOTPROTO=none\n\
+             IPV6_ADDR_GEN_MODE=eui64\n\
+             IPV6INIT=yes\n\
+             IPV6_AUTOCONF=no\n\
+             IPV6ADDR=2001:db8::4/64\n\
+             IPV6ADDR_SECONDARIES=2001:db8::5/64\n\
+             DNS1=1.1.1.1\n\
+             DNS2=8.8.8.8\n"
+        );
+    }
+
+    #[test]
+    fn convert_bond_and_ports() {
+        let bond = Keyfile::parse(
+            "[connection]\nid=bond0\ninterface-name=bond0\ntype=bond\n\n\
+             [bond]\nmiimon=140\nmode=balance-rr\n\n\
+             [ipv4]\nmethod=auto\nnever-default=true\n\n\
+             [ipv6]\nmethod=disabled\n",
+        );
+        assert_eq!(
+            to_ifcfg("bond0", &bond).unwrap(),
+            "TYPE=Bond\n\
+             BONDING_MASTER=yes\n\
+             NAME=bond0\n\
+             DEVICE=bond0\n\
+             BOOTPROTO=dhcp\n\
+             DEFROUTE=no\n\
+             IPV6INIT=no\n\
+             BONDING_OPTS=\"miimon=140 mode=balance-rr\"\n"
+        );
+
+        let port = Keyfile::parse(
+            "[connection]\nid=eth1\ninterface-name=eth1\ntype=ethernet\n\
+             master=bond0\nslave-type=bond\n",
+        );
+        assert_eq!(
+            to_ifcfg("eth1", &port).unwrap(),
+            "TYPE=Ethernet\nNAME=eth1\nDEVICE=eth1\nMASTER=bond0\nSLAVE=yes\n"
+        );
+    }
+
+    #[test]
+    fn convert_vlan_and_bridge() {
+        let vlan = Keyfile::parse(
+            "[connection]\nid=eth0.1365\ninterface-name=eth0.1365\ntype=vlan\n\n\
+             [vlan]\nflags=0\nid=1365\nparent=eth0\n",
+        );
+        assert_eq!(
+            to_ifcfg("eth0.1365", &vlan).unwrap(),
+            "TYPE=Vlan\nVLAN=yes\nNAME=eth0.1365\nDEVICE=eth0.1365\nVLAN_ID=1365\nPHYSDEV=eth0\n"
+        );
+
+        let bridge = Keyfile::parse(
+            "[connection]\nid=My Bridge\ninterface-name=br0\ntype=bridge\n\n\
+             [bridge]\nstp=false\nforward-delay=4\n",
+        );
+        assert_eq!(
+            to_ifcfg("br0", &bridge).unwrap(),
+            "TYPE=Bridge\nNAME=\"My Bridge\"\nDEVICE=br0\nSTP=no\nBRIDGING_OPTS=forward_delay=4\n"
+        );
+    }
+
+    #[test]
+    fn convert_unsupported_type() {
+        let keyfile = Keyfile::parse("[connection]\nid=lo\ntype=loopback\n");
+        let error = to_ifcfg("lo", &keyfile).unwrap_err();
+        assert!(error.to_string().contains("'loopback'"));
+    }
+
+    #[test]
+    fn quote_values() {
+        assert_eq!(quote("eth0"), "eth0");
+        assert_eq!(quote("192.168.1.1/24"), "192.168.1.1/24");
+        assert_eq!(quote(""), "\"\"");
+        assert_eq!(quote("a b"), "\"a b\"");
+        assert_eq!(quote("x\"$`\\"), "\"x\\\"\\$\\`\\\\\"");
+    }
+
+    #[test]
+    fn format_filenames() {
+        assert_eq!(
+            Format::Keyfile.filename("eth0.1365"),
+            "eth0.1365.nmconnection"
+        );
+        assert_eq!(Format::Ifcfg.filename("eth0.1365"), "ifcfg-eth0.1365");
+        assert_eq!(
+            Format::Networkd.filename("eth0.1365"),
+            "10-eth0.1365.network"
+        );
+    }
+}
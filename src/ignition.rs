@@ -0,0 +1,169 @@
+use std::path::Path;
+
+use anyhow::Context;
+use serde::Serialize;
+
+use crate::apply_conf::{CONFIG_DIR, STATIC_SYSTEM_CONNECTIONS_DIR};
+use crate::filesystem::FileSystem;
+
+/// Directory within the output dir containing the Ignition fragment of each host.
+const IGNITION_DIR: &str = "ignition";
+const IGNITION_VERSION: &str = "3.4.0";
+const IGNITION_FILE_EXT: &str = "ign";
+
+/// Connection files may contain secrets, so they are only readable by root (as NetworkManager requires anyway).
+const CONNECTION_FILE_MODE: u32 = 0o600;
+const DROP_IN_MODE: u32 = 0o644;
+
+#[derive(Serialize)]
+struct Config {
+    ignition: Ignition,
+    storage: Storage,
+}
+
+#[derive(Serialize)]
+struct Ignition {
+    version: &'static str,
+}
+
+#[derive(Serialize)]
+struct Storage {
+    files: Vec<File>,
+}
+
+#[derive(Serialize)]
+struct File {
+    path: String,
+    mode: u32,
+    overwrite: bool,
+    contents: Contents,
+}
+
+#[derive(Serialize)]
+struct Contents {
+    source: String,
+}
+
+/// Package the generated files of a host as an Ignition config only consisting of `storage.files`,
+/// ready to be merged into the config of the machine (e.g. via `ignition.config.merge` or Butane).
+///
+/// Connection files are placed in the NetworkManager system connections dir and drop-ins in its conf.d dir.
+pub(crate) fn to_ignition(files: &[(String, String)]) -> Result<String, anyhow::Error> {
+    let config = Config {
+        ignition: Ignition {
+            version: IGNITION_VERSION,
+        },
+        storage: Storage {
+            files: files
+                .iter()
+                .map(|(filename, contents)| {
+                    let (dir, mode) = if filename.ends_with(".conf") {
+                        (CONFIG_DIR, DROP_IN_MODE)
+                    } else {
+                        (STATIC_SYSTEM_CONNECTIONS_DIR, CONNECTION_FILE_MODE)
+                    };
+
+                    File {
+                        path: format!("{dir}/{filename}"),
+                        mode,
+                        overwrite: true,
+                        contents: Contents {
+                            source: data_url(contents),
+                        },
+                    }
+                })
+                .collect(),
+        },
+    };
+
+    serde_json::to_string_pretty(&config).context("Serializing Ignition config")
+}
+
+/// Store the Ignition config of the host as `ignition/<hostname>.ign` in the output dir.
+pub(crate) fn write_ignition(
+    filesystem: &dyn FileSystem,
+    output_dir: &str,
+    hostname: &str,
+    config: &str,
+) -> Result<(), anyhow::Error> {
+    let dir = Path::new(output_dir).join(IGNITION_DIR);
+    filesystem
+        .create_dir_all(&dir)
+        .context("Creating Ignition dir")?;
+
+    filesystem
+        .write(
+            &dir.join(format!("{hostname}.{IGNITION_FILE_EXT}")),
+            format!("{config}\n").as_bytes(),
+            0o666,
+        )
+        .context("Writing Ignition config")
+}
+
+/// Returns the contents as an RFC 2397 data URL, percent-encoding everything but the unreserved characters.
+fn data_url(contents: &str) -> String {
+    let mut url = String::from("data:,");
+
+    for byte in contents.bytes() {
+        match byte {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'.' | b'_' | b'~' => {
+                url.push(byte as char)
+            }
+            _ => url.push_str(&format!("%{byte:02X}")),
+        }
+    }
+
+    url
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::{json, Value};
+
+    use crate::ignition::{data_url, to_ignition};
+
+    #[test]
+    fn encode_data_url() {
+        assert_eq!(
+            data_url("[connection]\nid=eth0 #1\n"),
+            "data:,%5Bconnection%5D%0Aid%3Deth0%20%231%0A"
+        );
+        assert_eq!(data_url(""), "data:,");
+    }
+
+    #[test]
+    fn package_files_as_ignition_config() {
+        let files = vec![
+            (
+                "eth0.nmconnection".to_string(),
+                "[connection]\nid=eth0\n".to_string(),
+            ),
+            ("dns.conf".to_string(), "[main]\ndns=none\n".to_string()),
+        ];
+
+        let config: Value = serde_json::from_str(&to_ignition(&files).unwrap()).unwrap();
+
+        assert_eq!(
+            config,
+            json!({
+                "ignition": {"version": "3.4.0"},
+                "storage": {
+                    "files": [
+                        {
+                            "path": "/etc/NetworkManager/system-connections/eth0.nmconnection",
+                            "mode": 384,
+                            "overwrite": true,
+                            "contents": {"source": "data:,%5Bconnection%5D%0Aid%3Deth0%0A"}
+                        },
+                        {
+                            "path": "/etc/NetworkManager/conf.d/dns.conf",
+                            "mode": 420,
+                            "overwrite": true,
+                            "contents": {"source": "data:,%5Bmain%5D%0Adns%3Dnone%0A"}
+                        }
+                    ]
+                }
+            })
+        );
+    }
+}
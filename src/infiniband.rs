@@ -0,0 +1,143 @@
+use std::fs;
+use std::path::Path;
+
+use log::debug;
+use network_interface::NetworkInterface;
+
+/// Number of bytes of the hardware address of IPoIB interfaces.
+const ADDRESS_LEN: usize = 20;
+/// Number of bytes of Ethernet MAC addresses.
+const ETHERNET_ADDRESS_LEN: usize = 6;
+/// Number of trailing bytes of the hardware address holding the port GUID.
+const GUID_LEN: usize = 8;
+/// Link type of InfiniBand interfaces in sysfs (`ARPHRD_INFINIBAND`).
+const LINK_TYPE: &str = "32";
+
+/// Returns the hardware address in the form hosts are identified by, i.e. lower case and, for InfiniBand
+/// addresses, reduced to the port GUID, since the leading queue pair number changes whenever the interface
+/// is created. NetworkManager likewise only compares the GUID when matching InfiniBand connections.
+pub(crate) fn normalize_address(address: &str) -> String {
+    let address = address.to_lowercase();
+    let bytes: Vec<&str> = address.split(':').collect();
+
+    if is_infiniband_address(&address) {
+        bytes[ADDRESS_LEN - GUID_LEN..].join(":")
+    } else {
+        address
+    }
+}
+
+/// Returns whether the address is an Ethernet MAC address, an InfiniBand port GUID or the full hardware address
+/// of an IPoIB interface, written as colon-separated hex bytes.
+pub(crate) fn is_hardware_address(address: &str) -> bool {
+    let bytes: Vec<&str> = address.split(':').collect();
+
+    [ETHERNET_ADDRESS_LEN, GUID_LEN, ADDRESS_LEN].contains(&bytes.len())
+        && bytes
+            .iter()
+            .all(|byte| byte.len() == 2 && byte.chars().all(|c| c.is_ascii_hexdigit()))
+}
+
+/// Returns whether the hardware address is the full one of an IPoIB interface.
+pub(crate) fn is_infiniband_address(address: &str) -> bool {
+    address.split(':').count() == ADDRESS_LEN
+}
+
+/// Returns the full hardware address of the interface if it is an InfiniBand one.
+pub(crate) fn infiniband_address(sysfs_net_dir: &str, name: &str) -> Option<String> {
+    let sysfs = Path::new(sysfs_net_dir).join(name);
+    let link_type = fs::read_to_string(sysfs.join("type")).ok()?;
+    if link_type.trim() != LINK_TYPE {
+        return None;
+    }
+
+    let address = fs::read_to_string(sysfs.join("address")).ok()?;
+    Some(address.trim().to_lowercase())
+}
+
+/// Use the hardware addresses of the local InfiniBand NICs from sysfs, since they do not fit into the
+/// link layer addresses the interfaces are listed with.
+pub(crate) fn use_infiniband_addresses(nics: &mut [NetworkInterface], sysfs_net_dir: &str) {
+    for nic in nics {
+        let Some(address) = infiniband_address(sysfs_net_dir, &nic.name) else {
+            continue;
+        };
+
+        debug!("Using InfiniBand address {address} of '{}'", nic.name);
+        nic.mac_addr = Some(normalize_address(&address));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use network_interface::NetworkInterface;
+
+    use crate::infiniband::{
+        infiniband_address, is_hardware_address, is_infiniband_address, normalize_address,
+        use_infiniband_addresses,
+    };
+
+    const ADDRESS: &str = "80:00:02:08:FE:80:00:00:00:00:00:00:00:02:C9:03:00:0A:1B:2C";
+
+    #[test]
+    fn normalize_addresses() {
+        assert_eq!(normalize_address(ADDRESS), "00:02:c9:03:00:0a:1b:2c");
+        // The queue pair number differs, the GUID does not
+        assert_eq!(
+            normalize_address("80:00:0a:48:fe:80:00:00:00:00:00:00:00:02:c9:03:00:0a:1b:2c"),
+            normalize_address(ADDRESS)
+        );
+        assert_eq!(normalize_address("00:11:22:33:44:AA"), "00:11:22:33:44:aa");
+        assert!(is_infiniband_address(ADDRESS));
+        assert!(!is_infiniband_address("00:11:22:33:44:aa"));
+        assert!(is_hardware_address(ADDRESS));
+        assert!(is_hardware_address("00:02:c9:03:00:0a:1b:2c"));
+        assert!(is_hardware_address("00:11:22:33:44:AA"));
+        assert!(!is_hardware_address("00:11:22:33:44"));
+        assert!(!is_hardware_address("00:11:22:33:44:gg"));
+        assert!(!is_hardware_address("0:11:22:33:44:55"));
+    }
+
+    #[test]
+    fn use_addresses_of_infiniband_nics() {
+        let sysfs = Path::new("_infiniband_sysfs");
+        fs::create_dir_all(sysfs.join("ibp59s0")).unwrap();
+        fs::create_dir_all(sysfs.join("eth0")).unwrap();
+        fs::write(sysfs.join("ibp59s0").join("type"), "32\n").unwrap();
+        fs::write(
+            sysfs.join("ibp59s0").join("address"),
+            format!("{ADDRESS}\n"),
+        )
+        .unwrap();
+        fs::write(sysfs.join("eth0").join("type"), "1\n").unwrap();
+        fs::write(sysfs.join("eth0").join("address"), "00:11:22:33:44:55\n").unwrap();
+        let sysfs_dir = sysfs.to_str().unwrap();
+
+        assert_eq!(
+            infiniband_address(sysfs_dir, "ibp59s0").as_deref(),
+            Some(ADDRESS.to_lowercase().as_str())
+        );
+        assert_eq!(infiniband_address(sysfs_dir, "eth0"), None);
+
+        let nic = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        let mut nics = vec![
+            nic("ibp59s0", "80:00:02:08:fe:80"),
+            nic("eth0", "00:11:22:33:44:55"),
+        ];
+
+        use_infiniband_addresses(&mut nics, sysfs_dir);
+        assert_eq!(nics[0].mac_addr.as_deref(), Some("00:02:c9:03:00:0a:1b:2c"));
+        assert_eq!(nics[1].mac_addr.as_deref(), Some("00:11:22:33:44:55"));
+
+        // cleanup
+        fs::remove_dir_all(sysfs).unwrap();
+    }
+}
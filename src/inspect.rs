@@ -0,0 +1,201 @@
+use std::fs;
+use std::path::Path;
+
+use anyhow::Context;
+use network_interface::{NetworkInterface, NetworkInterfaceConfig};
+use serde::Serialize;
+
+use crate::apply_conf::{is_physical, SYSFS_NET_DIR};
+use crate::ethtool::permanent_address;
+use crate::infiniband::infiniband_address;
+
+const COLUMNS: [&str; 6] = [
+    "NAME",
+    "MAC-ADDRESS",
+    "PERMANENT-ADDRESS",
+    "DRIVER",
+    "STATE",
+    "CONSIDERED",
+];
+const MISSING_VALUE: &str = "--";
+
+/// Local interface as seen by the host identification.
+#[derive(Serialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+struct Nic {
+    name: String,
+    /// Current MAC address, which may be inherited from a bond or randomized.
+    mac_address: Option<String>,
+    /// MAC address burnt into the NIC as reported by ethtool, preferred for identifying the host.
+    permanent_address: Option<String>,
+    driver: Option<String>,
+    /// Operational state of the link, e.g. `up` or `down`.
+    state: Option<String>,
+    /// Whether the interface is backed by a device and hence considered for identifying the host.
+    considered: bool,
+}
+
+/// Print the local interfaces along with the details relevant to identifying the host, as a table or JSON.
+///
+/// Meant for debugging why the identification fails without resorting to `ip` and `ethtool`.
+pub(crate) fn inspect(json: bool) -> Result<(), anyhow::Error> {
+    let network_interfaces = NetworkInterface::show().context("Listing interfaces")?;
+    let nics = collect_nics(&network_interfaces, SYSFS_NET_DIR);
+
+    if json {
+        println!(
+            "{}",
+            serde_json::to_string_pretty(&nics).context("Serializing interfaces")?
+        );
+    } else {
+        print!("{}", format_table(&nics));
+    }
+
+    Ok(())
+}
+
+fn collect_nics(network_interfaces: &[NetworkInterface], sysfs_net_dir: &str) -> Vec<Nic> {
+    let mut nics: Vec<Nic> = network_interfaces
+        .iter()
+        .map(|nic| {
+            let sysfs = Path::new(sysfs_net_dir).join(&nic.name);
+            Nic {
+                name: nic.name.clone(),
+                mac_address: infiniband_address(sysfs_net_dir, &nic.name)
+                    .or_else(|| nic.mac_addr.as_ref().map(|mac| mac.to_lowercase())),
+                permanent_address: permanent_address(&nic.name).ok().flatten(),
+                driver: fs::read_link(sysfs.join("device").join("driver"))
+                    .ok()
+                    .and_then(|path| Some(path.file_name()?.to_string_lossy().to_string())),
+                state: fs::read_to_string(sysfs.join("operstate"))
+                    .ok()
+                    .map(|state| state.trim().to_string()),
+                considered: is_physical(sysfs_net_dir, &nic.name),
+            }
+        })
+        .collect();
+
+    // Interfaces are listed once per address family on some platforms.
+    nics.sort_by(|a, b| a.name.cmp(&b.name));
+    nics.dedup_by(|a, b| a.name == b.name);
+
+    nics
+}
+
+fn format_table(nics: &[Nic]) -> String {
+    let value = |value: &Option<String>| value.as_deref().unwrap_or(MISSING_VALUE).to_string();
+    let rows: Vec<[String; 6]> = nics
+        .iter()
+        .map(|nic| {
+            [
+                nic.name.clone(),
+                value(&nic.mac_address),
+                value(&nic.permanent_address),
+                value(&nic.driver),
+                value(&nic.state),
+                if nic.considered { "yes" } else { "no" }.to_string(),
+            ]
+        })
+        .collect();
+
+    let mut widths = COLUMNS.map(str::len);
+    for row in &rows {
+        for (width, value) in widths.iter_mut().zip(row) {
+            *width = (*width).max(value.len());
+        }
+    }
+
+    let format_row = |values: &[&str]| {
+        let line = values
+            .iter()
+            .zip(widths)
+            .map(|(value, width)| format!("{value:width$}"))
+            .collect::<Vec<_>>()
+            .join("  ");
+
+        format!("{}\n", line.trim_end())
+    };
+
+    let mut table = format_row(&COLUMNS);
+    for row in &rows {
+        let values: Vec<&str> = row.iter().map(String::as_str).collect();
+        table.push_str(&format_row(&values));
+    }
+
+    table
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::os::unix::fs::symlink;
+    use std::path::Path;
+
+    use network_interface::NetworkInterface;
+
+    use crate::inspect::{collect_nics, format_table, Nic};
+
+    #[test]
+    fn collect_local_nics() {
+        let sysfs = Path::new("_inspect_sysfs");
+        let drivers = Path::new("_inspect_drivers");
+        fs::create_dir_all(sysfs.join("nmc-test0").join("device")).unwrap();
+        fs::create_dir_all(sysfs.join("nmc-bond0")).unwrap();
+        fs::create_dir_all(drivers.join("ixgbe")).unwrap();
+        symlink(
+            fs::canonicalize(drivers.join("ixgbe")).unwrap(),
+            sysfs.join("nmc-test0").join("device").join("driver"),
+        )
+        .unwrap();
+        fs::write(sysfs.join("nmc-test0").join("operstate"), "up\n").unwrap();
+        fs::write(sysfs.join("nmc-bond0").join("operstate"), "down\n").unwrap();
+
+        let interface = |name: &str, mac: &str| NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac.to_string()),
+            addr: vec![],
+            index: 0,
+        };
+        let nics = collect_nics(
+            &[
+                interface("nmc-test0", "00:11:22:33:44:AA"),
+                interface("nmc-bond0", "00:11:22:33:44:aa"),
+                interface("nmc-test0", "00:11:22:33:44:AA"),
+            ],
+            sysfs.to_str().unwrap(),
+        );
+
+        assert_eq!(
+            nics,
+            vec![
+                Nic {
+                    name: "nmc-bond0".to_string(),
+                    mac_address: Some("00:11:22:33:44:aa".to_string()),
+                    permanent_address: None,
+                    driver: None,
+                    state: Some("down".to_string()),
+                    considered: false,
+                },
+                Nic {
+                    name: "nmc-test0".to_string(),
+                    mac_address: Some("00:11:22:33:44:aa".to_string()),
+                    permanent_address: None,
+                    driver: Some("ixgbe".to_string()),
+                    state: Some("up".to_string()),
+                    considered: true,
+                },
+            ]
+        );
+
+        assert_eq!(
+            format_table(&nics),
+            "NAME       MAC-ADDRESS        PERMANENT-ADDRESS  DRIVER  STATE  CONSIDERED\n\
+             nmc-bond0  00:11:22:33:44:aa  --                 --      down   no\n\
+             nmc-test0  00:11:22:33:44:aa  --                 ixgbe   up     yes\n"
+        );
+
+        // cleanup
+        fs::remove_dir_all(sysfs).unwrap();
+        fs::remove_dir_all(drivers).unwrap();
+    }
+}
@@ -0,0 +1,616 @@
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::fmt;
+use std::path::Path;
+
+use sha1::{Digest, Sha1};
+
+pub(crate) const CONNECTION_FILE_EXT: &str = "nmconnection";
+
+/// Settings whose values reference other interfaces by name.
+/// Values may also be semicolon separated lists (e.g. `match.interface-name`).
+const INTERFACE_REFERENCE_KEYS: [(&str, &str); 7] = [
+    ("connection", "interface-name"),
+    ("connection", "master"),
+    ("connection", "controller"),
+    ("vlan", "parent"),
+    ("infiniband", "parent"),
+    ("ovs-patch", "peer"),
+    ("match", "interface-name"),
+];
+
+/// Settings whose values are the UUID of the connection or reference other connections by UUID.
+const UUID_REFERENCE_KEYS: [(&str, &str); 4] = [
+    ("connection", "uuid"),
+    ("connection", "master"),
+    ("connection", "controller"),
+    ("vlan", "parent"),
+];
+
+/// Returns whether the path points to a NetworkManager keyfile (*.nmconnection).
+pub(crate) fn is_keyfile(path: &Path) -> bool {
+    path.is_file()
+        && path
+            .extension()
+            .is_some_and(|ext| ext == CONNECTION_FILE_EXT)
+}
+
+/// Rename the interfaces referenced by the keyfile contents (e.g. the parent of a VLAN or
+/// the controller of a bond port) according to the given `renames`.
+///
+/// Operates on the raw lines so that formatting and comments are preserved.
+pub(crate) fn rename_interface_references(
+    contents: &str,
+    renames: &HashMap<String, String>,
+) -> String {
+    replace_references(contents, &INTERFACE_REFERENCE_KEYS, renames)
+}
+
+/// Rename the connection (`connection.id`) from `from` to `to`, unless the keyfile names it differently.
+pub(crate) fn rename_connection_id(contents: &str, from: &str, to: &str) -> String {
+    let renames = HashMap::from([(from.to_string(), to.to_string())]);
+    replace_references(contents, &[("connection", "id")], &renames)
+}
+
+/// Replace the UUID of the connection and the references to other connections by UUID (e.g. the controller
+/// of a bond port) according to the given `replacements`.
+pub(crate) fn replace_uuid_references(
+    contents: &str,
+    replacements: &HashMap<String, String>,
+) -> String {
+    replace_references(contents, &UUID_REFERENCE_KEYS, replacements)
+}
+
+fn replace_references(
+    contents: &str,
+    keys: &[(&str, &str)],
+    renames: &HashMap<String, String>,
+) -> String {
+    let mut section = "";
+
+    contents
+        .split_inclusive('\n')
+        .map(|line| {
+            let trimmed = line.trim();
+
+            if let Some(name) = trimmed.strip_prefix('[').and_then(|l| l.strip_suffix(']')) {
+                section = name.trim();
+                return line.to_string();
+            }
+
+            let Some((key, value)) = line.split_once('=') else {
+                return line.to_string();
+            };
+
+            if !keys.contains(&(section, key.trim())) {
+                return line.to_string();
+            }
+
+            let renamed = rename_list_items(value.trim(), renames);
+            if renamed == value.trim() {
+                return line.to_string();
+            }
+
+            format!("{key}={}", value.replacen(value.trim(), &renamed, 1))
+        })
+        .collect()
+}
+
+/// Rename the items of a semicolon separated list, retaining their
+/// `!` (negation) and `~` (optional) prefixes and any trailing separator.
+fn rename_list_items(value: &str, renames: &HashMap<String, String>) -> String {
+    value
+        .split(';')
+        .map(|item| {
+            let name = item.trim_start_matches(['!', '~']);
+            let prefix = &item[..item.len() - name.len()];
+
+            match renames.get(name) {
+                Some(renamed) => format!("{prefix}{renamed}"),
+                None => item.to_string(),
+            }
+        })
+        .collect::<Vec<_>>()
+        .join(";")
+}
+
+/// Minimal representation of a NetworkManager keyfile (*.nmconnection).
+///
+/// Only the data relevant to NMC is retained, i.e. the sections and their key-value pairs in order.
+#[derive(Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct Keyfile {
+    sections: Vec<Section>,
+}
+
+#[derive(Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+struct Section {
+    name: String,
+    entries: Vec<(String, String)>,
+}
+
+impl Keyfile {
+    pub(crate) fn parse(contents: &str) -> Self {
+        let mut sections: Vec<Section> = Vec::new();
+
+        for line in contents.lines().map(str::trim) {
+            if line.is_empty() || line.starts_with('#') || line.starts_with(';') {
+                continue;
+            }
+
+            if let Some(name) = line.strip_prefix('[').and_then(|l| l.strip_suffix(']')) {
+                sections.push(Section {
+                    name: name.trim().to_string(),
+                    entries: Vec::new(),
+                });
+                continue;
+            }
+
+            let (Some(section), Some((key, value))) = (sections.last_mut(), line.split_once('='))
+            else {
+                continue;
+            };
+
+            section
+                .entries
+                .push((key.trim().to_string(), value.trim().to_string()));
+        }
+
+        Keyfile { sections }
+    }
+
+    /// Returns the value of the given key in the given section.
+    pub(crate) fn get(&self, section: &str, key: &str) -> Option<&str> {
+        self.sections
+            .iter()
+            .filter(|s| s.name == section)
+            .flat_map(|s| s.entries.iter())
+            .find(|(k, _)| k == key)
+            .map(|(_, v)| v.as_str())
+    }
+
+    /// Sets the value of the given key, creating the section and key if those are not present.
+    pub(crate) fn set(&mut self, section: &str, key: &str, value: &str) {
+        let index = match self.sections.iter().position(|s| s.name == section) {
+            Some(index) => index,
+            None => {
+                self.sections.push(Section {
+                    name: section.to_string(),
+                    entries: Vec::new(),
+                });
+                self.sections.len() - 1
+            }
+        };
+
+        let entries = &mut self.sections[index].entries;
+        match entries.iter_mut().find(|(k, _)| k == key) {
+            Some((_, v)) => *v = value.to_string(),
+            None => entries.push((key.to_string(), value.to_string())),
+        }
+    }
+
+    /// Removes the given key from the given section, returning its value if it was present.
+    pub(crate) fn remove(&mut self, section: &str, key: &str) -> Option<String> {
+        self.sections
+            .iter_mut()
+            .filter(|s| s.name == section)
+            .find_map(|s| {
+                let index = s.entries.iter().position(|(k, _)| k == key)?;
+                Some(s.entries.remove(index).1)
+            })
+    }
+
+    /// Merges the other keyfile on top of this one on a key level,
+    /// i.e. values in `other` take precedence over the existing ones.
+    pub(crate) fn merge(&mut self, other: &Keyfile) {
+        for section in &other.sections {
+            if section.entries.is_empty() && !self.sections.iter().any(|s| s.name == section.name) {
+                self.sections.push(Section {
+                    name: section.name.clone(),
+                    entries: Vec::new(),
+                });
+            }
+
+            for (key, value) in &section.entries {
+                self.set(&section.name, key, value);
+            }
+        }
+    }
+
+    /// Returns whether both keyfiles contain the same settings, regardless of their order and formatting.
+    pub(crate) fn equivalent(&self, other: &Keyfile) -> bool {
+        self.settings() == other.settings()
+    }
+
+    /// Returns the `section.key` names whose values were added, removed or changed in `other`.
+    pub(crate) fn changed_keys(&self, other: &Keyfile) -> Vec<String> {
+        let (old, new) = (self.values(), other.values());
+
+        old.keys()
+            .chain(new.keys())
+            .collect::<BTreeSet<_>>()
+            .into_iter()
+            .filter(|key| old.get(*key) != new.get(*key))
+            .map(|(section, key)| format!("{section}.{key}"))
+            .collect()
+    }
+
+    fn values(&self) -> BTreeMap<(&str, &str), &str> {
+        self.settings()
+            .into_iter()
+            .map(|(section, key, value)| ((section, key), value))
+            .collect()
+    }
+
+    fn settings(&self) -> BTreeSet<(&str, &str, &str)> {
+        self.sections
+            .iter()
+            .flat_map(|s| {
+                s.entries
+                    .iter()
+                    .map(|(k, v)| (s.name.as_str(), k.as_str(), v.as_str()))
+            })
+            .collect()
+    }
+
+    /// Returns the names of the sections in order.
+    pub(crate) fn sections(&self) -> impl Iterator<Item = &str> {
+        self.sections.iter().map(|s| s.name.as_str())
+    }
+
+    /// Returns all key-value pairs in the given section.
+    pub(crate) fn entries<'a>(
+        &'a self,
+        section: &'a str,
+    ) -> impl Iterator<Item = (&'a str, &'a str)> + 'a {
+        self.sections
+            .iter()
+            .filter(move |s| s.name == section)
+            .flat_map(|s| s.entries.iter())
+            .map(|(k, v)| (k.as_str(), v.as_str()))
+    }
+}
+
+impl fmt::Display for Keyfile {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for (i, section) in self.sections.iter().enumerate() {
+            if i > 0 {
+                writeln!(f)?;
+            }
+
+            writeln!(f, "[{}]", section.name)?;
+            for (key, value) in &section.entries {
+                writeln!(f, "{key}={value}")?;
+            }
+        }
+
+        Ok(())
+    }
+}
+
+/// Namespace of the UUIDs derived by NMC (`a6c91421-389b-4843-a135-13401ddc5747`), so that they never collide
+/// with the ones other tools derive from the same names.
+const UUID_NAMESPACE: [u8; 16] = [
+    0xa6, 0xc9, 0x14, 0x21, 0x38, 0x9b, 0x48, 0x43, 0xa1, 0x35, 0x13, 0x40, 0x1d, 0xdc, 0x57, 0x47,
+];
+
+/// Derive a stable name-based UUID (version 5, RFC 4122) from the seed within the namespace of NMC.
+pub(crate) fn derive_uuid(seed: &str) -> String {
+    let digest = Sha1::new()
+        .chain_update(UUID_NAMESPACE)
+        .chain_update(seed.as_bytes())
+        .finalize();
+
+    let mut bytes: [u8; 16] = digest[..16]
+        .try_into()
+        .expect("SHA-1 digest is longer than 16 bytes");
+    bytes[6] = (bytes[6] & 0x0f) | 0x50;
+    bytes[8] = (bytes[8] & 0x3f) | 0x80;
+
+    let hex: String = bytes.iter().map(|byte| format!("{byte:02x}")).collect();
+
+    format!(
+        "{}-{}-{}-{}-{}",
+        &hex[..8],
+        &hex[8..12],
+        &hex[12..16],
+        &hex[16..20],
+        &hex[20..]
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::Path;
+
+    use std::collections::HashMap;
+
+    use crate::keyfile::{
+        derive_uuid, is_keyfile, rename_connection_id, rename_interface_references,
+        rename_list_items, replace_uuid_references, Keyfile,
+    };
+
+    #[test]
+    fn parse_keyfile() {
+        let keyfile = Keyfile::parse(
+            r#"
+# comment
+[connection]
+id             = eth0
+interface-name = eth0
+
+[ipv4]
+address1=192.168.123.1/24
+route1_options = table=254
+; another comment
+invalid line
+"#,
+        );
+
+        assert_eq!(keyfile.get("connection", "id"), Some("eth0"));
+        assert_eq!(keyfile.get("connection", "interface-name"), Some("eth0"));
+        assert_eq!(keyfile.get("ipv4", "route1_options"), Some("table=254"));
+        assert_eq!(keyfile.get("ipv4", "id"), None);
+        assert_eq!(keyfile.get("ipv6", "method"), None);
+        assert_eq!(
+            keyfile.entries("ipv4").collect::<Vec<_>>(),
+            vec![
+                ("address1", "192.168.123.1/24"),
+                ("route1_options", "table=254")
+            ]
+        );
+    }
+
+    #[test]
+    fn parse_empty_keyfile() {
+        assert_eq!(Keyfile::parse(""), Keyfile::default());
+        assert_eq!(
+            Keyfile::parse("key=value-outside-of-section"),
+            Keyfile::default()
+        );
+    }
+
+    #[test]
+    fn set_keyfile_values() {
+        let mut keyfile = Keyfile::parse("[connection]\nid=eth0\n");
+
+        keyfile.set("connection", "id", "eth1");
+        keyfile.set("connection", "interface-name", "eth1");
+        keyfile.set("ethernet", "mtu", "9000");
+
+        assert_eq!(
+            keyfile.to_string(),
+            "[connection]\nid=eth1\ninterface-name=eth1\n\n[ethernet]\nmtu=9000\n"
+        );
+    }
+
+    #[test]
+    fn remove_keyfile_values() {
+        let mut keyfile = Keyfile::parse("[wifi-security]\nkey-mgmt=wpa-psk\npsk=secret\n");
+
+        assert_eq!(
+            keyfile.remove("wifi-security", "psk"),
+            Some("secret".to_string())
+        );
+        assert_eq!(keyfile.remove("wifi-security", "psk"), None);
+        assert_eq!(keyfile.remove("wifi", "psk"), None);
+        assert_eq!(keyfile.to_string(), "[wifi-security]\nkey-mgmt=wpa-psk\n");
+    }
+
+    #[test]
+    fn merge_keyfiles() {
+        let mut base = Keyfile::parse(
+            r#"
+[connection]
+id=eth0
+type=ethernet
+
+[ethernet]
+mtu=9000
+
+[ipv4]
+dns=10.0.0.53;
+method=auto
+"#,
+        );
+        let overlay = Keyfile::parse(
+            r#"
+[connection]
+id = eth0
+interface-name = eth0
+
+[ipv4]
+address1 = 192.168.1.5/24
+method = manual
+
+[ipv6]
+"#,
+        );
+
+        base.merge(&overlay);
+
+        assert_eq!(
+            base.to_string(),
+            r#"[connection]
+id=eth0
+type=ethernet
+interface-name=eth0
+
+[ethernet]
+mtu=9000
+
+[ipv4]
+dns=10.0.0.53;
+method=manual
+address1=192.168.1.5/24
+
+[ipv6]
+"#
+        );
+    }
+
+    #[test]
+    fn compare_equivalent_keyfiles() {
+        let keyfile =
+            Keyfile::parse("[connection]\nid=eth0\ntype=ethernet\n\n[ipv4]\nmethod=auto\n");
+
+        assert!(keyfile.equivalent(&Keyfile::parse(
+            "# comment\n[ipv4]\nmethod = auto\n\n[connection]\ntype = ethernet\nid = eth0\n[ethernet]\n"
+        )));
+        assert!(!keyfile.equivalent(&Keyfile::parse(
+            "[connection]\nid=eth0\ntype=ethernet\n\n[ipv4]\nmethod=manual\n"
+        )));
+        assert!(!keyfile.equivalent(&Keyfile::parse("[connection]\nid=eth0\ntype=ethernet\n")));
+    }
+
+    #[test]
+    fn detect_changed_keys() {
+        let keyfile = Keyfile::parse(
+            "[connection]\nid=eth0\ntype=ethernet\n\n[ipv4]\nmethod=manual\naddress1=192.168.1.10/24\n",
+        );
+
+        assert!(keyfile.changed_keys(&keyfile).is_empty());
+        assert_eq!(
+            keyfile.changed_keys(&Keyfile::parse(
+                "[connection]\nid=eth0\ntype=ethernet\n\n[ipv4]\nmethod=auto\n\n[ipv6]\nmethod=auto\n"
+            )),
+            vec!["ipv4.address1", "ipv4.method", "ipv6.method"]
+        );
+    }
+
+    #[test]
+    fn rename_references_to_interfaces() {
+        let renames = HashMap::from([
+            ("eth0".to_string(), "ens1f0".to_string()),
+            ("eth1".to_string(), "ens1f1".to_string()),
+        ]);
+
+        assert_eq!(
+            rename_interface_references(
+                "[connection]\nid=eth0-port\ninterface-name = eth0\nmaster=eth1\n\n[vlan]\nid=10\nparent=eth1\n\n# parent=eth0\n[ethernet]\nparent=eth0",
+                &renames
+            ),
+            "[connection]\nid=eth0-port\ninterface-name = ens1f0\nmaster=ens1f1\n\n[vlan]\nid=10\nparent=ens1f1\n\n# parent=eth0\n[ethernet]\nparent=eth0"
+        );
+        assert_eq!(
+            rename_interface_references(
+                "[connection]\ninterface-name=eth01\ncontroller=eth0\n",
+                &renames
+            ),
+            "[connection]\ninterface-name=eth01\ncontroller=ens1f0\n"
+        );
+
+        let renames = HashMap::from([("ib0".to_string(), "ibp59s0".to_string())]);
+        assert_eq!(
+            rename_interface_references(
+                "[connection]\nid=ib0.8001\ntype=infiniband\ninterface-name=ib0.8001\n\n\
+                 [infiniband]\nmtu=2044\np-key=0x8001\nparent=ib0\ntransport-mode=datagram\n",
+                &renames
+            ),
+            "[connection]\nid=ib0.8001\ntype=infiniband\ninterface-name=ib0.8001\n\n\
+             [infiniband]\nmtu=2044\np-key=0x8001\nparent=ibp59s0\ntransport-mode=datagram\n"
+        );
+    }
+
+    #[test]
+    fn rename_connection_by_id() {
+        assert_eq!(
+            rename_connection_id(
+                "[connection]\nid=eth0@dhcp\ninterface-name=eth0\n\n[user]\nid=eth0@dhcp\n",
+                "eth0@dhcp",
+                "ens1f0@dhcp"
+            ),
+            "[connection]\nid=ens1f0@dhcp\ninterface-name=eth0\n\n[user]\nid=eth0@dhcp\n"
+        );
+        // Connections named differently are left alone
+        assert_eq!(
+            rename_connection_id("[connection]\nid=Uplink\n", "eth0", "ens1f0"),
+            "[connection]\nid=Uplink\n"
+        );
+    }
+
+    #[test]
+    fn rename_list_item_references() {
+        let renames = HashMap::from([
+            ("eth0".to_string(), "ens1f0".to_string()),
+            ("eth1".to_string(), "ens1f1".to_string()),
+        ]);
+
+        assert_eq!(rename_list_items("eth0", &renames), "ens1f0");
+        assert_eq!(rename_list_items("eth0;eth1;", &renames), "ens1f0;ens1f1;");
+        assert_eq!(
+            rename_list_items("!eth0;~eth1;eth*;eth01", &renames),
+            "!ens1f0;~ens1f1;eth*;eth01"
+        );
+        assert_eq!(rename_list_items("", &renames), "");
+
+        assert_eq!(
+            rename_interface_references(
+                "[connection]\nid=eth0\n\n[match]\ninterface-name = eth0;eth1;\n",
+                &renames
+            ),
+            "[connection]\nid=eth0\n\n[match]\ninterface-name = ens1f0;ens1f1;\n"
+        );
+    }
+
+    #[test]
+    fn replace_references_to_uuids() {
+        let replacements = HashMap::from([(
+            "dfd202f5-562f-5f07-8f2a-a7717756fb70".to_string(),
+            "0d5bc3a1-6d1f-4b3c-9e4a-2f1c8b7a6e50".to_string(),
+        )]);
+
+        assert_eq!(
+            replace_uuid_references(
+                "[connection]\nid=bond0\nuuid=dfd202f5-562f-5f07-8f2a-a7717756fb70\n",
+                &replacements
+            ),
+            "[connection]\nid=bond0\nuuid=0d5bc3a1-6d1f-4b3c-9e4a-2f1c8b7a6e50\n"
+        );
+        assert_eq!(
+            replace_uuid_references(
+                "[connection]\nid=eth0\nuuid=11111111-2222-3333-4444-555555555555\n\
+                 controller=dfd202f5-562f-5f07-8f2a-a7717756fb70\ninterface-name=dfd202f5-562f-5f07-8f2a-a7717756fb70\n",
+                &replacements
+            ),
+            "[connection]\nid=eth0\nuuid=11111111-2222-3333-4444-555555555555\n\
+             controller=0d5bc3a1-6d1f-4b3c-9e4a-2f1c8b7a6e50\ninterface-name=dfd202f5-562f-5f07-8f2a-a7717756fb70\n"
+        );
+    }
+
+    #[test]
+    fn detect_keyfiles() {
+        assert!(is_keyfile(Path::new(
+            "testdata/apply/node1/eth0.nmconnection"
+        )));
+        assert!(!is_keyfile(Path::new(
+            "testdata/apply/config/host_config.yaml"
+        )));
+        assert!(!is_keyfile(Path::new("testdata/apply/node1")));
+        assert!(!is_keyfile(Path::new("<missing>.nmconnection")));
+    }
+
+    #[test]
+    fn derive_stable_uuids() {
+        let uuid = derive_uuid("dfd202f5-562f-5f07-8f2a-a7717756fb70@dhcp");
+
+        assert_eq!(
+            uuid,
+            derive_uuid("dfd202f5-562f-5f07-8f2a-a7717756fb70@dhcp")
+        );
+        assert_ne!(
+            uuid,
+            derive_uuid("dfd202f5-562f-5f07-8f2a-a7717756fb70@backup")
+        );
+        assert_eq!(uuid.len(), 36);
+        assert_eq!(&uuid[14..15], "5");
+        assert!(matches!(&uuid[19..20], "8" | "9" | "a" | "b"));
+
+        // Same as any other RFC 4122 implementation, e.g. Python's uuid.uuid5()
+        assert_eq!(uuid, "fc304e31-0145-5897-a693-e767d8eb9ff6");
+        assert_eq!(
+            derive_uuid("node1/eth0/eth0"),
+            "7f3155d3-db15-5716-8627-cf8417fc91f3"
+        );
+    }
+}
@@ -0,0 +1,1693 @@
+//! NM configurator generates NetworkManager connection files from nmstate desired states and applies them to the
+//! matching hosts.
+//!
+//! The [`configurator`] module is the stable API for running it in-process. Everything else backs the `nmc`
+//! command line (see [`run`]) and may change between releases.
+
+use std::io::IsTerminal;
+use std::time::{Duration, SystemTime};
+
+use anyhow::Context;
+use log::{error, info, warn};
+
+use address_probe::ProbeMode;
+use apply_conf::{
+    apply, identify, ApplyOptions, HostnameMethod, MatchOptions, Selection,
+    STATIC_SYSTEM_CONNECTIONS_DIR,
+};
+use artifact::print_artifact_diff;
+use bundle::{Compression, ConfigServer};
+use capture::capture;
+use controller::{run_controller, ControllerOptions};
+use exit_code::{exit_code, FAILURE, GENERATION_FAILED};
+use explain::explain;
+use features::{print_features, FeatureGates, CONFIG_SERVER, CONTROLLER, FEATURE_GATES};
+use file_filter::FileFilter;
+use filesystem::Disk;
+use generate_conf::{generate, render, GenerateOptions, Output};
+use history::{history_dir, parse_size, prune, RetentionPolicy};
+use ifcfg::Format;
+use inspect::inspect;
+use live::{apply_state, LiveOptions};
+use logging::{SocketFormat, SocketLogger};
+use nm_service::ServiceAction;
+use nm_version::Compatibility;
+use onboard::{onboard, OnboardOptions};
+use profiles::print_profiles;
+use push::{push, PushOptions};
+use secrets::SecretHandling;
+use selector::Selector;
+use serve::{serve, ServeOptions};
+use state::STATE_FILE;
+use systemd::{notify_failed, print_units, UnitOptions};
+use types::MatchMode;
+use uninstall::{uninstall, UninstallOptions};
+use variables::print_variables;
+use verify::{verify, VerifyOptions};
+use watch::watch;
+
+mod address_probe;
+mod aliases;
+mod apply_conf;
+mod artifact;
+mod bootstrap;
+mod bundle;
+mod cache;
+mod capture;
+mod combustion;
+pub mod configurator;
+mod controller;
+mod deadline;
+mod dhcp_fallback;
+mod env_file;
+mod ethtool;
+mod exit_code;
+mod expand;
+mod explain;
+mod fallback;
+mod features;
+mod file_filter;
+mod filenames;
+mod filesystem;
+mod generate_conf;
+mod history;
+mod hooks;
+mod identity;
+mod ifcfg;
+mod ignition;
+mod infiniband;
+mod inspect;
+mod keyfile;
+mod live;
+mod lock;
+mod logging;
+mod management;
+mod metrics;
+mod netlink;
+mod netplan;
+mod networkd;
+mod nm_service;
+mod nm_version;
+mod onboard;
+mod ovs;
+mod profiles;
+mod progress;
+mod push;
+mod quirks;
+mod rename;
+mod report;
+mod secrets;
+mod selector;
+mod serve;
+mod service_probe;
+mod sriov;
+mod state;
+mod systemd;
+mod types;
+mod uninstall;
+mod variables;
+mod verify;
+mod watch;
+mod workspace;
+mod yaml;
+
+const APP_NAME: &str = "nmc";
+
+const SUB_CMD_GENERATE: &str = "generate";
+const SUB_CMD_APPLY: &str = "apply";
+const SUB_CMD_IDENTIFY: &str = "identify";
+const SUB_CMD_INSPECT: &str = "inspect";
+const SUB_CMD_VERSION: &str = "version";
+const SUB_CMD_RENDER: &str = "render";
+const SUB_CMD_CAPTURE: &str = "capture";
+const SUB_CMD_VARIABLES: &str = "variables";
+const SUB_CMD_PROFILES: &str = "profiles";
+const SUB_CMD_ARTIFACT: &str = "artifact";
+const SUB_CMD_VERIFY: &str = "verify";
+const SUB_CMD_DIFF: &str = "diff";
+const SUB_CMD_SYSTEMD_UNITS: &str = "systemd-units";
+const SUB_CMD_ONBOARD: &str = "onboard";
+const SUB_CMD_STATE: &str = "state";
+const SUB_CMD_PRUNE: &str = "prune";
+const SUB_CMD_UNINSTALL: &str = "uninstall";
+const SUB_CMD_EXPLAIN: &str = "explain";
+const SUB_CMD_FEATURES: &str = "features";
+const SUB_CMD_CONTROLLER: &str = "controller";
+const SUB_CMD_SERVE: &str = "serve";
+const SUB_CMD_PUSH: &str = "push";
+
+/// File storing a mapping between host identifier (usually hostname) and its preconfigured network interfaces.
+const HOST_MAPPING_FILE: &str = "host_config.yaml";
+/// Directory within a host dir containing NetworkManager.conf drop-ins (e.g. DNS handling).
+const CONF_D_DIR: &str = "conf.d";
+
+/// Run the `nmc` command line with the arguments of the process, exiting it on failure.
+pub fn run() {
+    let app = clap::Command::new(APP_NAME)
+        .version(clap::crate_version!())
+        .about("Command line of NM configurator")
+        .subcommand_required(true)
+        .arg(
+            clap::Arg::new("LOG-FORMAT")
+                .long("log-format")
+                .global(true)
+                .value_parser(["text", "json"])
+                .default_value("text")
+                .help("Format of the log output, 'json' emits one object per line for log collectors")
+        )
+        .arg(
+            clap::Arg::new("LOG-LEVEL")
+                .long("log-level")
+                .env("NMC_LOG_LEVEL")
+                .global(true)
+                .value_parser(["error", "warn", "info", "debug", "trace"])
+                .default_value("info")
+                .help("Verbosity of the log output, 'trace' also dumps the contents of the stored connection files")
+        )
+        .arg(
+            clap::Arg::new("LOG-TARGET")
+                .long("log-target")
+                .global(true)
+                .value_parser(["stderr", "journal", "syslog"])
+                .default_value("stderr")
+                .help("Destination of the log output, falls back to stderr if the journal or syslog is not available")
+        )
+        .arg(
+            clap::Arg::new("FEATURE-GATES")
+                .long("feature-gates")
+                .env("NMC_FEATURE_GATES")
+                .global(true)
+                .value_parser(|value: &str| FeatureGates::parse(value, FEATURE_GATES).map_err(|err| err.to_string()))
+                .help("Comma separated list of experimental features to enable or disable, \
+                 e.g. 'Controller=true,ConfigServer=true'. 'nmc features' lists the known ones")
+        )
+        .arg(
+            clap::Arg::new("TIMEOUT")
+                .long("timeout")
+                .env("NMC_TIMEOUT")
+                .global(true)
+                .value_name("SECONDS")
+                .value_parser(clap::value_parser!(u64).range(1..))
+                .help("Fails apply and generate runs taking longer, e.g. since the config server or NetworkManager \
+                 does not respond. Ignored by all other subcommands and apply --watch")
+        )
+        .arg(
+            clap::Arg::new("QUIET")
+                .long("quiet")
+                .short('q')
+                .global(true)
+                .action(clap::ArgAction::SetTrue)
+                .help("Only logs errors and omits the summary printed at the end of an interactive run")
+        )
+        .arg(
+            clap::Arg::new("NO-COLOR")
+                .long("no-color")
+                .global(true)
+                .action(clap::ArgAction::SetTrue)
+                .help("Disables the colors of the summary, also disabled by a non-empty NO_COLOR variable")
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_GENERATE)
+                .about("Generate network configuration using nmstate")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .required(true)
+                        .long("config-dir")
+                        .help("Config dir containing network configurations for different hosts in YAML format"),
+                )
+                .arg(
+                    clap::Arg::new("OUTPUT-DIR")
+                        .default_value("_out")
+                        .long("output-dir")
+                        .help("Destination dir storing the output configurations"),
+                )
+                .arg(
+                    clap::Arg::new("EXPAND-ENV")
+                        .long("expand-env")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Expands ${VAR} references in the YAML files using environment variables")
+                )
+                .arg(
+                    clap::Arg::new("VARS-FILE")
+                        .long("vars-file")
+                        .help("YAML file defining common and per-host variables for expanding ${VAR} references \
+                         in the YAML files (falls back to environment variables)")
+                )
+                .arg(
+                    clap::Arg::new("IGNORE-FILES")
+                        .long("ignore-files")
+                        .value_name("PATTERNS")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated file name patterns (e.g. '*.md') of files in the config dir \
+                         which are skipped without a warning")
+                )
+                .arg(
+                    clap::Arg::new("DENY-FILES")
+                        .long("deny-files")
+                        .value_name("PATTERNS")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated file name patterns (e.g. '*.nmconnection.bak') of files in the config dir \
+                         which fail the run")
+                )
+                .arg(format_arg(&["keyfile", "ifcfg", "networkd", "netplan"]))
+                .arg(
+                    clap::Arg::new("OUTPUT")
+                        .long("output")
+                        .value_parser(["dir", "combustion", "ignition"])
+                        .default_value("dir")
+                        .help("Layout of the output dir, 'combustion' stores the configurations along with a script \
+                         applying them, ready to be used as a combustion config drive, and 'ignition' adds an Ignition \
+                         config per host placing its files on the machine")
+                )
+                .arg(
+                    clap::Arg::new("LABELS-FILE")
+                        .long("labels-file")
+                        .help("YAML file defining the labels of the hosts (e.g. 'node1: {site: berlin}'), \
+                         stored in the host mapping")
+                )
+                .arg(
+                    clap::Arg::new("SELECTOR")
+                        .long("selector")
+                        .requires("LABELS-FILE")
+                        .value_parser(|value: &str| Selector::parse(value).map_err(|err| err.to_string()))
+                        .help("Only generates the hosts whose labels match the expression, \
+                         e.g. 'site=berlin,role!=edge,gpu,!legacy'")
+                )
+                .arg(
+                    clap::Arg::new("REPORT")
+                        .long("report")
+                        .help("Writes a JSON summary of the run across all hosts (files, connection types, \
+                         largest hosts and durations) to the given path")
+                )
+                .arg(
+                    clap::Arg::new("SECRETS")
+                        .long("secrets")
+                        .value_parser(["inline", "agent", "extract"])
+                        .default_value("inline")
+                        .help("Handling of secrets such as Wi-Fi or 802.1X passwords in the keyfiles, 'agent' leaves \
+                         them to a secret agent and 'extract' stores them apart in --secrets-dir")
+                )
+                .arg(
+                    clap::Arg::new("SECRETS-DIR")
+                        .long("secrets-dir")
+                        .required_if_eq("SECRETS", "extract")
+                        .help("Destination dir storing a file per extracted secret in a subdirectory per host")
+                )
+                .arg(
+                    clap::Arg::new("CACHE")
+                        .long("cache")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Skips the hosts whose desired states, variables and labels did not change since the \
+                         previous run into the same --output-dir, tracked in its .nmc-cache.json")
+                ))
+        .subcommand(
+            clap::Command::new(SUB_CMD_VARIABLES)
+                .about("Show which variables are referenced by and defined for which hosts")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .required(true)
+                        .long("config-dir")
+                        .help("Config dir containing network configurations for different hosts in YAML format"),
+                )
+                .arg(
+                    clap::Arg::new("VARS-FILE")
+                        .long("vars-file")
+                        .help("YAML file defining common and per-host variables")
+                )
+                .arg(
+                    clap::Arg::new("IGNORE-FILES")
+                        .long("ignore-files")
+                        .value_name("PATTERNS")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated file name patterns (e.g. '*.md') of files in the config dir \
+                         which are skipped without a warning")
+                )
+                .arg(
+                    clap::Arg::new("DENY-FILES")
+                        .long("deny-files")
+                        .value_name("PATTERNS")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated file name patterns (e.g. '*.nmconnection.bak') of files in the config dir \
+                         which fail the run")
+                ))
+        .subcommand(
+            clap::Command::new(SUB_CMD_RENDER)
+                .about("Render the NetworkManager keyfiles of a standalone nmstate snippet")
+                .arg(
+                    clap::Arg::new("STATE")
+                        .required(true)
+                        .long("state")
+                        .help("YAML file containing the desired state")
+                )
+                .arg(
+                    clap::Arg::new("OUT")
+                        .long("out")
+                        .default_value("-")
+                        .help("Destination dir storing the keyfiles, '-' prints them to stdout")
+                ))
+        .subcommand(
+            clap::Command::new(SUB_CMD_CAPTURE)
+                .about("Capture the current network state of this machine as a desired state")
+                .arg(
+                    clap::Arg::new("OUT")
+                        .long("out")
+                        .default_value("-")
+                        .help("Destination file storing the desired state, '-' prints it to stdout")
+                )
+                .arg(
+                    clap::Arg::new("INCLUDE-SECRETS")
+                        .long("include-secrets")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Includes secrets such as Wi-Fi or 802.1X passwords in the desired state")
+                ))
+        .subcommand(
+            clap::Command::new(SUB_CMD_APPLY)
+                .about("Apply network configurations to host")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .long("config-dir")
+                        .default_value("config")
+                        .help("Config dir containing host mapping ('host_config.yaml') \
+                         and subdirectories containing *.nmconnection files per host, \
+                         or a tar archive of it encrypted with age (*.age) or GPG (*.gpg, *.asc)")
+                )
+                .arg(
+                    clap::Arg::new("DECRYPTION-KEY")
+                        .long("decryption-key")
+                        .help("age identity or GPG secret key file decrypting an encrypted config dir or desired state, \
+                         taking precedence over the NMC_DECRYPTION_KEY variable and the nmc-decryption-key credential")
+                )
+                .arg(
+                    clap::Arg::new("SELECTOR")
+                        .long("selector")
+                        .conflicts_with("STATE")
+                        .value_parser(|value: &str| Selector::parse(value).map_err(|err| err.to_string()))
+                        .help("Only applies the config if the labels of the identified host match the expression \
+                         (e.g. 'site=berlin'), leaving the host untouched otherwise")
+                )
+                .arg(
+                    clap::Arg::new("FROM-SERVER")
+                        .long("from-server")
+                        .value_name("URL")
+                        .conflicts_with_all(["STATE", "WATCH"])
+                        .help("Fetches the config of this machine by the MAC addresses of its NICs from a config server \
+                         (nmc serve, experimental, requires the ConfigServer feature gate) instead of reading --config-dir")
+                )
+                .arg(
+                    clap::Arg::new("SERVER-TOKEN-FILE")
+                        .long("server-token-file")
+                        .requires("FROM-SERVER")
+                        .help("File containing the token presented to the config server, only sent via https")
+                )
+                .arg(
+                    clap::Arg::new("SERVER-CA")
+                        .long("server-ca")
+                        .requires("FROM-SERVER")
+                        .help("PEM encoded CA certificate verifying the config server instead of the system trust store")
+                )
+                .arg(
+                    clap::Arg::new("ALLOW-BUNDLE-HOOKS")
+                        .long("allow-bundle-hooks")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Runs the hooks and installs the dispatcher scripts shipped in the config dir, bundle or \
+                         config served via https, using the hooks instead of the ones in the --hooks-dir")
+                )
+                .arg(
+                    clap::Arg::new("HOOKS-DIR")
+                        .long("hooks-dir")
+                        .env("NMC_HOOKS_DIR")
+                        .default_value("/etc/nmc")
+                        .help("Local dir owned by the operator which the hooks are loaded from")
+                )
+                .arg(
+                    clap::Arg::new("EXPAND-ENV")
+                        .long("expand-env")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Expands ${VAR} references in the *.nmconnection files using environment variables")
+                )
+                .arg(
+                    clap::Arg::new("DESTINATION-DIR")
+                        .long("destination-dir")
+                        .env("NMC_DESTINATION_DIR")
+                        .conflicts_with("STATE")
+                        .help("Dir storing the connection files instead of the default one of the --format \
+                         (e.g. /etc/NetworkManager/system-connections for keyfiles)")
+                )
+                .arg(
+                    clap::Arg::new("TRANSIENT")
+                        .long("transient")
+                        .action(clap::ArgAction::SetTrue)
+                        .conflicts_with("STATE")
+                        .help("Stores the connection files and NetworkManager.conf drop-ins under /run/NetworkManager, \
+                         so that they only last until the next reboot, e.g. on systems with a read-only root")
+                )
+                .arg(
+                    clap::Arg::new("SET-HOSTNAME")
+                        .long("set-hostname")
+                        .value_parser(["file", "hostnamed", "keep"])
+                        .default_value("file")
+                        .help("How the hostname of the identified host is set, 'file' writes /etc/hostname taking \
+                         effect on the next boot, 'hostnamed' also applies it to the running system via \
+                         systemd-hostnamed and 'keep' leaves the hostname alone")
+                )
+                .arg(
+                    clap::Arg::new("STRICT-INTERFACES")
+                        .long("strict-interfaces")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Fails if the NICs of some of the host's Ethernet interfaces are missing instead of \
+                         only warning about them")
+                )
+                .arg(
+                    clap::Arg::new("NETWORK-MANAGER")
+                        .long("network-manager")
+                        .value_parser(["check", "reload", "restart"])
+                        .default_value("check")
+                        .help("What is done to the running NetworkManager once files changed, 'check' only reports \
+                         whether it is active, 'reload' reloads its config and connection files and 'restart' also \
+                         activates the connections right away. Nothing is done in the initrd or if it is not active")
+                )
+                .arg(
+                    clap::Arg::new("FALLBACK")
+                        .long("fallback")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Verifies the config like 'nmc verify' once NetworkManager was reloaded or restarted \
+                         and restores the last successfully verified connection files if the verification fails")
+                )
+                .arg(
+                    clap::Arg::new("NM-COMPATIBILITY")
+                        .long("nm-compatibility")
+                        .value_parser(["warn", "fail", "skip"])
+                        .default_value("warn")
+                        .help("How keyfile settings unsupported by the installed NetworkManager version are \
+                         handled, 'warn' reports them, 'fail' fails the run before storing the connection files and \
+                         'skip' does not detect the version at all")
+                )
+                .arg(
+                    clap::Arg::new("CHECK-OVS-PLUGIN")
+                        .long("check-ovs-plugin")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Fails if the host has OVS connections but the openvswitch plugin of NetworkManager \
+                         is not installed")
+                )
+                .arg(
+                    clap::Arg::new("PRESERVE-UUIDS")
+                        .long("preserve-uuids")
+                        .action(clap::ArgAction::SetTrue)
+                        .conflicts_with("STATE")
+                        .help("Keeps the UUIDs of the connections already stored under the same ID or interface name, \
+                         so that NetworkManager updates the existing profiles instead of adding new ones")
+                )
+                .arg(
+                    clap::Arg::new("STATE")
+                        .long("state")
+                        .conflicts_with("WATCH")
+                        .help("Applies the nmstate desired state in the given YAML file (optionally encrypted) directly \
+                         to the running NetworkManager instead of storing the connection files of the config dir")
+                )
+                .arg(
+                    clap::Arg::new("ROLLBACK-TIMEOUT")
+                        .long("rollback-timeout")
+                        .value_name("SECONDS")
+                        .value_parser(clap::value_parser!(u32).range(1..))
+                        .default_value("60")
+                        .requires("STATE")
+                        .help("Seconds after which a change applied via --state is rolled back if it did not complete")
+                )
+                .arg(
+                    clap::Arg::new("DUPLICATE-ADDRESS-CHECK")
+                        .long("duplicate-address-check")
+                        .value_parser(["warn", "fail"])
+                        .help("Probes statically assigned addresses via ARP/ND before storing the configurations \
+                         and either warns or fails if any of them are already in use")
+                )
+                .arg(
+                    clap::Arg::new("UDEV-RULES")
+                        .long("udev-rules")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Generates udev rules renaming the local NICs to their preconfigured names \
+                         instead of adjusting the *.nmconnection files")
+                )
+                .arg(
+                    clap::Arg::new("SYSTEMD-LINK-FILES")
+                        .long("systemd-link-files")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Generates systemd.link files renaming the local NICs to their preconfigured names \
+                         instead of adjusting the *.nmconnection files")
+                )
+                .arg(
+                    clap::Arg::new("RENAME-LINKS")
+                        .long("rename-links")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Renames the local NICs to their preconfigured names via netlink \
+                         instead of adjusting the *.nmconnection files (requires the links to be down)")
+                )
+                .arg(
+                    clap::Arg::new("ALLOW-MGMT-CHANGE")
+                        .long("allow-mgmt-change")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Allows removing, renaming or modifying the already stored profile \
+                         of the interface marked as 'management' in the host mapping")
+                )
+                .arg(
+                    clap::Arg::new("REPORT")
+                        .long("report")
+                        .help("Writes a JSON summary of the matched host and the stored connection files \
+                         to the given path")
+                )
+                .arg(
+                    clap::Arg::new("METRICS-FILE")
+                        .long("metrics-file")
+                        .help("File updated with the results of the run in Prometheus text format \
+                         (e.g. for the textfile collector of the node exporter)")
+                )
+                .arg(
+                    clap::Arg::new("ENV-FILE")
+                        .long("env-file")
+                        .help("Writes the local names of the host's interfaces as a systemd EnvironmentFile \
+                         (e.g. NMC_IFACE_ETH0=enp3s0) to the given path")
+                )
+                .arg(
+                    clap::Arg::new("WATCH")
+                        .long("watch")
+                        .value_name("SECONDS")
+                        .value_parser(clap::value_parser!(u64).range(1..))
+                        .help("Keeps running and re-applies the config whenever the config dir changes, \
+                         checking it every given number of seconds")
+                )
+                .arg(
+                    clap::Arg::new("IGNORE-FILES")
+                        .long("ignore-files")
+                        .value_name("PATTERNS")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated file name patterns (e.g. '*.md') of files in the config dir's host and common dirs \
+                         which are skipped without a warning")
+                )
+                .arg(
+                    clap::Arg::new("DENY-FILES")
+                        .long("deny-files")
+                        .value_name("PATTERNS")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated file name patterns (e.g. '*.nmconnection.bak') of files in the config dir's host and common dirs \
+                         which fail the run")
+                )
+                .arg(
+                    clap::Arg::new("WAIT")
+                        .long("wait")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Waits for a concurrent run to finish instead of failing")
+                )
+                .arg(
+                    clap::Arg::new("IDENTITY-FILE")
+                        .long("identity-file")
+                        .env("NMC_IDENTITY_FILE")
+                        .help("JSON file provisioned by the manufacturer (e.g. 'machine-identity.json') whose \
+                         hostname identifies the host ahead of matching the MAC addresses")
+                )
+                .args(match_args())
+                .arg(
+                    clap::Arg::new("DHCP-FALLBACK")
+                        .long("dhcp-fallback")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Adds a low priority DHCP profile for each local NIC not covered by the host's profiles \
+                         (e.g. a freshly attached one), unless the host config says otherwise")
+                )
+                .arg(
+                    clap::Arg::new("ONLY")
+                        .long("only")
+                        .value_name("INTERFACES")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated preconfigured or local interface names whose connection files \
+                         are the only ones processed")
+                )
+                .arg(
+                    clap::Arg::new("SKIP")
+                        .long("skip")
+                        .value_name("INTERFACES")
+                        .value_delimiter(',')
+                        .action(clap::ArgAction::Append)
+                        .help("Comma separated preconfigured or local interface names whose connection files \
+                         are not processed")
+                )
+                .arg(
+                    clap::Arg::new("PROGRESS-FD")
+                        .long("progress-fd")
+                        .value_name("FD")
+                        .value_parser(clap::value_parser!(i32).range(3..))
+                        .help("Emits progress events as newline delimited JSON to the given open file descriptor \
+                         (e.g. for installers rendering their own UI)")
+                )
+                .arg(
+                    clap::Arg::new("PROGRESS-SOCKET")
+                        .long("progress-socket")
+                        .conflicts_with("PROGRESS-FD")
+                        .help("Emits progress events as newline delimited JSON to the Unix stream socket \
+                         listening at the given path")
+                )
+                .arg(
+                    clap::Arg::new("PRUNE")
+                        .long("prune")
+                        .conflicts_with_all(["ONLY", "SKIP"])
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Removes the connection files stored by previous runs \
+                         which are no longer part of the host's config")
+                )
+                .args(retention_args())
+                .arg(format_arg(&["keyfile", "ifcfg"]))
+                .arg(
+                    clap::Arg::new("VERBOSE")
+                        .long("verbose")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Enables DEBUG log level (same as --log-level debug)")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_IDENTIFY)
+                .about("Identify the host and show how its preconfigured interfaces map to the local NICs \
+                 without applying anything")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .long("config-dir")
+                        .default_value("config")
+                        .help("Config dir containing host mapping ('host_config.yaml')")
+                )
+                .arg(
+                    clap::Arg::new("IDENTITY-FILE")
+                        .long("identity-file")
+                        .env("NMC_IDENTITY_FILE")
+                        .help("JSON file provisioned by the manufacturer (e.g. 'machine-identity.json') whose \
+                         hostname identifies the host ahead of matching the MAC addresses")
+                )
+                .args(match_args())
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_INSPECT)
+                .about("List the local interfaces along with their MAC addresses, driver and link state, and \
+                 whether they are considered for identifying the host")
+                .arg(
+                    clap::Arg::new("OUTPUT")
+                        .long("output")
+                        .value_parser(["table", "json"])
+                        .default_value("table")
+                        .help("Format of the listing")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_VERSION)
+                .about("Print the version, git commit and the version of the linked nmstate library")
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_EXPLAIN)
+                .about("Describe a field of the host mapping (host_config.yaml) along with its nested fields")
+                .arg(
+                    clap::Arg::new("FIELD")
+                        .required(true)
+                        .help("Dotted path of the field, e.g. 'hosts.interfaces.mac_address'")
+                )
+                .arg(
+                    clap::Arg::new("RECURSIVE")
+                        .long("recursive")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Lists the nested fields of all levels")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_FEATURES)
+                .about("List the feature gates of experimental features and whether they are enabled")
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_PROFILES)
+                .about("List the stored connection profiles in an nmcli-like table")
+                .arg(
+                    clap::Arg::new("CONNECTIONS-DIR")
+                        .long("connections-dir")
+                        .default_value(STATIC_SYSTEM_CONNECTIONS_DIR)
+                        .help("Dir containing the *.nmconnection files")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_VERIFY)
+                .about("Verify that the stored connection profiles are intact and their settings are in effect")
+                .arg(
+                    clap::Arg::new("CONNECTIONS-DIR")
+                        .long("connections-dir")
+                        .default_value(STATIC_SYSTEM_CONNECTIONS_DIR)
+                        .help("Dir containing the *.nmconnection files")
+                )
+                .arg(
+                    clap::Arg::new("INTERVAL")
+                        .long("interval")
+                        .value_parser(clap::value_parser!(u64).range(1..))
+                        .help("Keeps running and re-verifies the config every given number of seconds")
+                )
+                .arg(
+                    clap::Arg::new("METRICS-FILE")
+                        .long("metrics-file")
+                        .help("File updated with the results of each verification in Prometheus text format \
+                         (e.g. for the textfile collector of the node exporter)")
+                )
+                .arg(
+                    clap::Arg::new("FALLBACK")
+                        .long("fallback")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Restores the last successfully verified connection files if the verification fails")
+                )
+                .arg(
+                    clap::Arg::new("WAIT")
+                        .long("wait")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Waits for a concurrent run to finish instead of failing (only with --fallback)")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_ONBOARD)
+                .about("Render the desired state of this machine from a template based on its local NICs")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .required(true)
+                        .long("config-dir")
+                        .help("Config dir containing network configurations for different hosts in YAML format")
+                )
+                .arg(
+                    clap::Arg::new("TEMPLATE")
+                        .required(true)
+                        .long("template")
+                        .help("Desired state template referencing ${NMC_HOSTNAME}, ${NMC_ROLE}, ${NMC_SITE} \
+                         and the name and MAC address of each local NIC (e.g. ${NMC_NIC0_MAC})")
+                )
+                .arg(
+                    clap::Arg::new("HOSTNAME")
+                        .long("hostname")
+                        .help("Hostname of the machine, asked for if not given")
+                )
+                .arg(
+                    clap::Arg::new("ROLE")
+                        .long("role")
+                        .help("Role of the machine, asked for if not given and referenced by the template")
+                )
+                .arg(
+                    clap::Arg::new("SITE")
+                        .long("site")
+                        .help("Site of the machine, asked for if not given and referenced by the template")
+                )
+                .arg(
+                    clap::Arg::new("SUBMIT")
+                        .long("submit")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Commits the desired state to the git repository of the config dir and pushes it")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_SYSTEMD_UNITS)
+                .about("Print or install the recommended systemd units applying the config at boot \
+                 and whenever it changes")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .long("config-dir")
+                        .default_value("/var/lib/nm-configurator/config")
+                        .help("Config dir applied by the service")
+                )
+                .arg(
+                    clap::Arg::new("EXEC-PATH")
+                        .long("exec-path")
+                        .default_value("/usr/bin/nmc")
+                        .help("Path of the nmc binary executed by the service")
+                )
+                .arg(
+                    clap::Arg::new("WATCH")
+                        .long("watch")
+                        .value_name("SECONDS")
+                        .default_value("30")
+                        .value_parser(clap::value_parser!(u64).range(1..))
+                        .help("Number of seconds between checking the config dir for changes")
+                )
+                .arg(
+                    clap::Arg::new("OUT")
+                        .long("out")
+                        .default_value("-")
+                        .help("Destination dir storing the units (e.g. '/etc/systemd/system'), \
+                         '-' prints them to stdout")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_ARTIFACT)
+                .about("Inspect the artifacts produced by the generate command")
+                .subcommand_required(true)
+                .subcommand(
+                    clap::Command::new(SUB_CMD_DIFF)
+                        .about("Summarize the changes between two generated artifacts host by host")
+                        .arg(
+                            clap::Arg::new("OLD-DIR")
+                                .required(true)
+                                .help("Dir containing the previously generated configurations")
+                        )
+                        .arg(
+                            clap::Arg::new("NEW-DIR")
+                                .required(true)
+                                .help("Dir containing the newly generated configurations")
+                        )
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_STATE)
+                .about("Manage the state kept by NMC on this machine")
+                .subcommand_required(true)
+                .subcommand(
+                    clap::Command::new(SUB_CMD_PRUNE)
+                        .about("Remove the history entries of past apply runs exceeding the retention policy")
+                        .args(retention_args())
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_UNINSTALL)
+                .about("Remove the files stored by NMC on this machine along with its state")
+                .arg(
+                    clap::Arg::new("FORCE")
+                        .long("force")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Removes the stored files even if they were modified since NMC stored them")
+                )
+                .arg(
+                    clap::Arg::new("NO-RELOAD")
+                        .long("no-reload")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Skips reloading NetworkManager after removing the files")
+                )
+                .arg(
+                    clap::Arg::new("WAIT")
+                        .long("wait")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Waits for a concurrent run to finish instead of failing")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_CONTROLLER)
+                .about("Keep generating the configs of the NodeNetworkConfig resources of a Kubernetes cluster \
+                 (experimental, requires the Controller feature gate)")
+                .arg(
+                    clap::Arg::new("OUTPUT-DIR")
+                        .long("output-dir")
+                        .default_value("_out")
+                        .help("Destination dir of the generated configs, replaced whenever the resources change")
+                )
+                .arg(
+                    clap::Arg::new("NAMESPACE")
+                        .long("namespace")
+                        .help("Namespace of the resources, defaults to all namespaces")
+                )
+                .arg(
+                    clap::Arg::new("INTERVAL")
+                        .long("interval")
+                        .value_name("SECONDS")
+                        .default_value("30")
+                        .value_parser(clap::value_parser!(u64).range(1..))
+                        .help("Number of seconds between listing all resources in case the watch missed a change")
+                )
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_SERVE)
+                .about("Serve the config of each host over HTTP to the machines presenting its MAC addresses \
+                 (experimental, requires the ConfigServer feature gate)")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .long("config-dir")
+                        .default_value("config")
+                        .help("Config dir containing host mapping ('host_config.yaml') \
+                         and subdirectories containing *.nmconnection files per host")
+                )
+                .arg(
+                    clap::Arg::new("LISTEN")
+                        .long("listen")
+                        .value_name("ADDRESS")
+                        .default_value("0.0.0.0:8080")
+                        .help("Address and port to listen on")
+                )
+                .arg(
+                    clap::Arg::new("TLS-CERT")
+                        .long("tls-cert")
+                        .requires("TLS-KEY")
+                        .help("PEM encoded certificate chain serving HTTPS instead of plain HTTP")
+                )
+                .arg(
+                    clap::Arg::new("TLS-KEY")
+                        .long("tls-key")
+                        .requires("TLS-CERT")
+                        .help("PEM encoded private key of the certificate")
+                )
+                .arg(
+                    clap::Arg::new("TOKEN-FILE")
+                        .long("token-file")
+                        .help("File containing the token clients have to present as 'Authorization: Bearer <token>'")
+                )
+                .arg(
+                    clap::Arg::new("INSECURE")
+                        .long("insecure")
+                        .action(clap::ArgAction::SetTrue)
+                        .conflicts_with("TOKEN-FILE")
+                        .help("Serves the configs without a token to anyone able to connect")
+                )
+                .arg(compression_arg())
+                .args(match_args())
+        )
+        .subcommand(
+            clap::Command::new(SUB_CMD_PUSH)
+                .about("Identify the machines of an inventory over SSH and apply the config of their hosts")
+                .arg(
+                    clap::Arg::new("CONFIG-DIR")
+                        .long("config-dir")
+                        .default_value("config")
+                        .help("Config dir containing host mapping ('host_config.yaml') \
+                         and subdirectories containing *.nmconnection files per host")
+                )
+                .arg(
+                    clap::Arg::new("INVENTORY")
+                        .long("inventory")
+                        .required(true)
+                        .help("YAML file listing the machines by their SSH 'address', optionally along with \
+                         'port' and 'identity_file'")
+                )
+                .arg(
+                    clap::Arg::new("REMOTE-NMC")
+                        .long("remote-nmc")
+                        .value_name("PATH")
+                        .default_value("nmc")
+                        .help("Path of the nmc binary on the machines")
+                )
+                .arg(
+                    clap::Arg::new("NO-RELOAD")
+                        .long("no-reload")
+                        .action(clap::ArgAction::SetTrue)
+                        .help("Skips reloading NetworkManager on the machines after applying the config")
+                )
+                .arg(compression_arg())
+                .args(match_args())
+        );
+
+    let matches = app.get_matches();
+
+    match matches.subcommand() {
+        Some((SUB_CMD_GENERATE, cmd)) => {
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let output_dir = cmd
+                .get_one::<String>("OUTPUT-DIR")
+                .expect("--output-dir is required");
+            let options = GenerateOptions {
+                expand_env: cmd.get_flag("EXPAND-ENV"),
+                vars_file: cmd.get_one::<String>("VARS-FILE").cloned(),
+                file_filter: file_filter(cmd),
+                format: format(cmd),
+                report_file: cmd.get_one::<String>("REPORT").cloned(),
+                secrets: match cmd.get_one::<String>("SECRETS").map(String::as_str) {
+                    Some("agent") => SecretHandling::Agent,
+                    Some("extract") => SecretHandling::Extract {
+                        dir: cmd
+                            .get_one::<String>("SECRETS-DIR")
+                            .expect("--secrets-dir is required")
+                            .clone(),
+                    },
+                    _ => SecretHandling::Inline,
+                },
+                output: match cmd.get_one::<String>("OUTPUT").map(String::as_str) {
+                    Some("combustion") => Output::Combustion,
+                    Some("ignition") => Output::Ignition,
+                    _ => Output::Dir,
+                },
+                labels_file: cmd.get_one::<String>("LABELS-FILE").cloned(),
+                selector: cmd.get_one::<Selector>("SELECTOR").cloned(),
+                cache: cmd.get_flag("CACHE"),
+            };
+
+            setup_logger(cmd);
+            start_deadline(cmd);
+
+            match generate(config_dir, output_dir, &options, &Disk) {
+                Ok(..) => {
+                    info!("Successfully generated and stored network config");
+                }
+                Err(err) => {
+                    error!("Generating config failed: {err:#}");
+                    std::process::exit(exit_code(&err, GENERATION_FAILED))
+                }
+            }
+        }
+        Some((SUB_CMD_VARIABLES, cmd)) => {
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let vars_file = cmd.get_one::<String>("VARS-FILE").map(String::as_str);
+
+            setup_logger(cmd);
+
+            if let Err(err) = print_variables(config_dir, vars_file, &file_filter(cmd)) {
+                error!("Listing variables failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_RENDER, cmd)) => {
+            let state_file = cmd.get_one::<String>("STATE").expect("--state is required");
+            let output = cmd.get_one::<String>("OUT").expect("--out is required");
+
+            setup_logger(cmd);
+
+            if let Err(err) = render(state_file, output, &Disk) {
+                error!("Rendering config failed: {err:#}");
+                std::process::exit(exit_code(&err, GENERATION_FAILED))
+            }
+        }
+        Some((SUB_CMD_CAPTURE, cmd)) => {
+            let output = cmd.get_one::<String>("OUT").expect("--out is required");
+
+            setup_logger(cmd);
+
+            if let Err(err) = capture(output, cmd.get_flag("INCLUDE-SECRETS")) {
+                error!("Capturing network state failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_APPLY, cmd)) => {
+            if let Some(state_file) = cmd.get_one::<String>("STATE") {
+                let options = LiveOptions {
+                    expand_env: cmd.get_flag("EXPAND-ENV"),
+                    rollback_timeout: *cmd
+                        .get_one::<u32>("ROLLBACK-TIMEOUT")
+                        .expect("--rollback-timeout is required"),
+                    wait_for_lock: cmd.get_flag("WAIT"),
+                    decryption_key: cmd.get_one::<String>("DECRYPTION-KEY").cloned(),
+                };
+
+                setup_logger(cmd);
+                start_deadline(cmd);
+
+                match apply_state(state_file, &options) {
+                    Ok(..) => info!("Successfully applied desired state"),
+                    Err(err) => {
+                        error!("Applying desired state failed: {err:#}");
+                        std::process::exit(exit_code(&err, FAILURE))
+                    }
+                }
+                return;
+            }
+
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let options = ApplyOptions {
+                expand_env: cmd.get_flag("EXPAND-ENV"),
+                duplicate_address_check: cmd.get_one::<String>("DUPLICATE-ADDRESS-CHECK").map(
+                    |mode| match mode.as_str() {
+                        "fail" => ProbeMode::Fail,
+                        _ => ProbeMode::Warn,
+                    },
+                ),
+                udev_rules: cmd.get_flag("UDEV-RULES"),
+                systemd_link_files: cmd.get_flag("SYSTEMD-LINK-FILES"),
+                rename_links: cmd.get_flag("RENAME-LINKS"),
+                allow_bundle_hooks: cmd.get_flag("ALLOW-BUNDLE-HOOKS"),
+                hooks_dir: cmd.get_one::<String>("HOOKS-DIR").cloned(),
+                allow_management_change: cmd.get_flag("ALLOW-MGMT-CHANGE"),
+                report_file: cmd.get_one::<String>("REPORT").cloned(),
+                metrics_file: cmd.get_one::<String>("METRICS-FILE").cloned(),
+                env_file: cmd.get_one::<String>("ENV-FILE").cloned(),
+                file_filter: file_filter(cmd),
+                wait_for_lock: cmd.get_flag("WAIT"),
+                identity_file: cmd.get_one::<String>("IDENTITY-FILE").cloned(),
+                prune: cmd.get_flag("PRUNE"),
+                selection: Selection {
+                    only: values(cmd, "ONLY"),
+                    skip: values(cmd, "SKIP"),
+                },
+                matching: match_options(cmd),
+                strict_interfaces: cmd.get_flag("STRICT-INTERFACES"),
+                check_ovs_plugin: cmd.get_flag("CHECK-OVS-PLUGIN"),
+                network_manager: match cmd.get_one::<String>("NETWORK-MANAGER").map(String::as_str)
+                {
+                    Some("reload") => ServiceAction::Reload,
+                    Some("restart") => ServiceAction::Restart,
+                    _ => ServiceAction::Check,
+                },
+                fallback: cmd.get_flag("FALLBACK"),
+                nm_compatibility: match cmd
+                    .get_one::<String>("NM-COMPATIBILITY")
+                    .map(String::as_str)
+                {
+                    Some("fail") => Compatibility::Fail,
+                    Some("skip") => Compatibility::Skip,
+                    _ => Compatibility::Warn,
+                },
+                hostname_method: match cmd.get_one::<String>("SET-HOSTNAME").map(String::as_str) {
+                    Some("hostnamed") => HostnameMethod::Hostnamed,
+                    Some("keep") => HostnameMethod::Keep,
+                    _ => HostnameMethod::File,
+                },
+                dhcp_fallback: cmd.get_flag("DHCP-FALLBACK"),
+                retention: retention_policy(cmd),
+                format: format(cmd),
+                destination_dir: cmd.get_one::<String>("DESTINATION-DIR").cloned(),
+                transient: cmd.get_flag("TRANSIENT"),
+                preserve_uuids: cmd.get_flag("PRESERVE-UUIDS"),
+                decryption_key: cmd.get_one::<String>("DECRYPTION-KEY").cloned(),
+                selector: cmd.get_one::<Selector>("SELECTOR").cloned(),
+                config_server: cmd
+                    .get_one::<String>("FROM-SERVER")
+                    .map(|url| ConfigServer {
+                        url: url.clone(),
+                        token_file: cmd.get_one::<String>("SERVER-TOKEN-FILE").cloned(),
+                        ca_file: cmd.get_one::<String>("SERVER-CA").cloned(),
+                    }),
+            };
+
+            setup_logger(cmd);
+
+            if options.config_server.is_some() {
+                if let Err(err) = feature_gates(cmd).require(&CONFIG_SERVER) {
+                    error!("Applying config failed: {err:#}");
+                    std::process::exit(FAILURE)
+                }
+            }
+
+            if let Err(err) = setup_progress(cmd) {
+                error!("Setting up progress events failed: {err:#}");
+                std::process::exit(FAILURE)
+            }
+
+            if let Some(&seconds) = cmd.get_one::<u64>("WATCH") {
+                if let Err(err) = watch(config_dir, &options, Duration::from_secs(seconds)) {
+                    error!("Watching config failed: {err:#}");
+                    notify_failed(&err);
+                    std::process::exit(exit_code(&err, FAILURE))
+                }
+                return;
+            }
+
+            start_deadline(cmd);
+            match apply(config_dir, &options, &Disk) {
+                Ok(report) => {
+                    info!("Successfully applied config");
+                    if let Some(color) = summary_color(cmd) {
+                        print!("{}", report.summary(color));
+                    }
+                }
+                Err(err) => {
+                    error!("Applying config failed: {err:#}");
+                    std::process::exit(exit_code(&err, FAILURE))
+                }
+            }
+        }
+        Some((SUB_CMD_IDENTIFY, cmd)) => {
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let identity_file = cmd.get_one::<String>("IDENTITY-FILE").map(String::as_str);
+
+            setup_logger(cmd);
+
+            if let Err(err) = identify(config_dir, identity_file, &match_options(cmd)) {
+                error!("Identifying host failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_INSPECT, cmd)) => {
+            let json = cmd
+                .get_one::<String>("OUTPUT")
+                .is_some_and(|output| output == "json");
+
+            setup_logger(cmd);
+
+            if let Err(err) = inspect(json) {
+                error!("Inspecting interfaces failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_VERSION, _)) => {
+            println!("{APP_NAME} {}", clap::crate_version!());
+            println!("commit: {}", env!("NMC_GIT_COMMIT"));
+            println!("nmstate: {}", env!("NMC_NMSTATE_VERSION"));
+        }
+        Some((SUB_CMD_EXPLAIN, cmd)) => {
+            let field = cmd.get_one::<String>("FIELD").expect("field is required");
+
+            if let Err(err) = explain(field, cmd.get_flag("RECURSIVE")) {
+                eprintln!("{err:#}");
+                std::process::exit(FAILURE)
+            }
+        }
+        Some((SUB_CMD_FEATURES, cmd)) => print_features(&feature_gates(cmd)),
+        Some((SUB_CMD_PROFILES, cmd)) => {
+            let connections_dir = cmd
+                .get_one::<String>("CONNECTIONS-DIR")
+                .expect("--connections-dir is required");
+
+            setup_logger(cmd);
+
+            if let Err(err) = print_profiles(connections_dir, STATE_FILE) {
+                error!("Listing profiles failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_VERIFY, cmd)) => {
+            let connections_dir = cmd
+                .get_one::<String>("CONNECTIONS-DIR")
+                .expect("--connections-dir is required");
+            let options = VerifyOptions {
+                interval: cmd
+                    .get_one::<u64>("INTERVAL")
+                    .map(|&seconds| Duration::from_secs(seconds)),
+                metrics_file: cmd.get_one::<String>("METRICS-FILE").cloned(),
+                fallback: cmd.get_flag("FALLBACK"),
+                wait_for_lock: cmd.get_flag("WAIT"),
+            };
+
+            setup_logger(cmd);
+
+            match verify(connections_dir, STATE_FILE, &options) {
+                Ok(..) => {
+                    info!("Successfully verified config");
+                }
+                Err(err) => {
+                    error!("Verifying config failed: {err:#}");
+                    notify_failed(&err);
+                    std::process::exit(exit_code(&err, FAILURE))
+                }
+            }
+        }
+        Some((SUB_CMD_ONBOARD, cmd)) => {
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let options = OnboardOptions {
+                template: cmd
+                    .get_one::<String>("TEMPLATE")
+                    .expect("--template is required")
+                    .clone(),
+                hostname: cmd.get_one::<String>("HOSTNAME").cloned(),
+                role: cmd.get_one::<String>("ROLE").cloned(),
+                site: cmd.get_one::<String>("SITE").cloned(),
+                submit: cmd.get_flag("SUBMIT"),
+            };
+
+            setup_logger(cmd);
+
+            if let Err(err) = onboard(config_dir, &options) {
+                error!("Onboarding host failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_SYSTEMD_UNITS, cmd)) => {
+            let options = UnitOptions {
+                exec_path: cmd
+                    .get_one::<String>("EXEC-PATH")
+                    .expect("--exec-path is required")
+                    .clone(),
+                config_dir: cmd
+                    .get_one::<String>("CONFIG-DIR")
+                    .expect("--config-dir is required")
+                    .clone(),
+                interval: *cmd.get_one::<u64>("WATCH").expect("--watch is required"),
+            };
+            let output = cmd.get_one::<String>("OUT").expect("--out is required");
+
+            setup_logger(cmd);
+
+            if let Err(err) = print_units(&options, output) {
+                error!("Installing systemd units failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_ARTIFACT, cmd)) => match cmd.subcommand() {
+            Some((SUB_CMD_DIFF, cmd)) => {
+                let old_dir = cmd
+                    .get_one::<String>("OLD-DIR")
+                    .expect("old dir is required");
+                let new_dir = cmd
+                    .get_one::<String>("NEW-DIR")
+                    .expect("new dir is required");
+
+                setup_logger(cmd);
+
+                if let Err(err) = print_artifact_diff(old_dir, new_dir) {
+                    error!("Comparing artifacts failed: {err:#}");
+                    std::process::exit(exit_code(&err, FAILURE))
+                }
+            }
+            _ => unreachable!("Unrecognized subcommand"),
+        },
+        Some((SUB_CMD_STATE, cmd)) => match cmd.subcommand() {
+            Some((SUB_CMD_PRUNE, cmd)) => {
+                let policy = retention_policy(cmd);
+
+                setup_logger(cmd);
+
+                match prune(&Disk, &history_dir(STATE_FILE), &policy, SystemTime::now()) {
+                    Ok(removed) => info!("Removed {} history entries", removed.len()),
+                    Err(err) => {
+                        error!("Pruning state failed: {err:#}");
+                        std::process::exit(exit_code(&err, FAILURE))
+                    }
+                }
+            }
+            _ => unreachable!("Unrecognized subcommand"),
+        },
+        Some((SUB_CMD_UNINSTALL, cmd)) => {
+            let options = UninstallOptions {
+                force: cmd.get_flag("FORCE"),
+                reload: !cmd.get_flag("NO-RELOAD"),
+                wait_for_lock: cmd.get_flag("WAIT"),
+            };
+
+            setup_logger(cmd);
+
+            match uninstall(&options) {
+                Ok(..) => info!("Successfully uninstalled"),
+                Err(err) => {
+                    error!("Uninstalling failed: {err:#}");
+                    std::process::exit(exit_code(&err, FAILURE))
+                }
+            }
+        }
+        Some((SUB_CMD_CONTROLLER, cmd)) => {
+            let output_dir = cmd
+                .get_one::<String>("OUTPUT-DIR")
+                .expect("--output-dir is required");
+            let options = ControllerOptions {
+                namespace: cmd.get_one::<String>("NAMESPACE").cloned(),
+                interval: Duration::from_secs(
+                    *cmd.get_one::<u64>("INTERVAL")
+                        .expect("--interval is required"),
+                ),
+            };
+
+            setup_logger(cmd);
+
+            let result = feature_gates(cmd)
+                .require(&CONTROLLER)
+                .and_then(|_| run_controller(output_dir, &options));
+            if let Err(err) = result {
+                error!("Running controller failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_SERVE, cmd)) => {
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let options = ServeOptions {
+                listen: cmd
+                    .get_one::<String>("LISTEN")
+                    .expect("--listen is required")
+                    .clone(),
+                tls: cmd
+                    .get_one::<String>("TLS-CERT")
+                    .cloned()
+                    .zip(cmd.get_one::<String>("TLS-KEY").cloned()),
+                token_file: cmd.get_one::<String>("TOKEN-FILE").cloned(),
+                insecure: cmd.get_flag("INSECURE"),
+                compression: compression(cmd),
+                matching: match_options(cmd),
+            };
+
+            setup_logger(cmd);
+
+            let result = feature_gates(cmd)
+                .require(&CONFIG_SERVER)
+                .and_then(|_| serve(config_dir, &options));
+            if let Err(err) = result {
+                error!("Serving configs failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        Some((SUB_CMD_PUSH, cmd)) => {
+            let config_dir = cmd
+                .get_one::<String>("CONFIG-DIR")
+                .expect("--config-dir is required");
+            let options = PushOptions {
+                inventory: cmd
+                    .get_one::<String>("INVENTORY")
+                    .expect("--inventory is required")
+                    .clone(),
+                remote_nmc: cmd
+                    .get_one::<String>("REMOTE-NMC")
+                    .expect("--remote-nmc is required")
+                    .clone(),
+                reload: !cmd.get_flag("NO-RELOAD"),
+                compression: compression(cmd),
+                matching: match_options(cmd),
+            };
+
+            setup_logger(cmd);
+
+            if let Err(err) = push(config_dir, &options) {
+                error!("Pushing configs failed: {err:#}");
+                std::process::exit(exit_code(&err, FAILURE))
+            }
+        }
+        _ => unreachable!("Unrecognized subcommand"),
+    }
+}
+
+fn file_filter(matches: &clap::ArgMatches) -> FileFilter {
+    FileFilter {
+        ignore: values(matches, "IGNORE-FILES"),
+        deny: values(matches, "DENY-FILES"),
+    }
+}
+
+fn setup_progress(matches: &clap::ArgMatches) -> Result<(), anyhow::Error> {
+    if let Some(&fd) = matches.get_one::<i32>("PROGRESS-FD") {
+        progress::to_fd(fd).with_context(|| format!("Using file descriptor {fd}"))?;
+    }
+
+    if let Some(path) = matches.get_one::<String>("PROGRESS-SOCKET") {
+        progress::to_socket(path).with_context(|| format!("Connecting to {path:?}"))?;
+    }
+
+    Ok(())
+}
+
+fn format_arg(formats: &'static [&'static str]) -> clap::Arg {
+    let mut help = "Format of the connection files, 'ifcfg' targets the ifcfg-rh plugin of legacy distributions"
+        .to_string();
+    if formats.contains(&"networkd") {
+        help.push_str(", 'networkd' images shipping systemd-networkd instead of NetworkManager");
+    }
+    if formats.contains(&"netplan") {
+        help.push_str(" and 'netplan' Ubuntu-based nodes");
+    }
+
+    clap::Arg::new("FORMAT")
+        .long("format")
+        .value_parser(formats.to_vec())
+        .default_value("keyfile")
+        .help(help)
+}
+
+fn format(matches: &clap::ArgMatches) -> Format {
+    match matches.get_one::<String>("FORMAT").map(String::as_str) {
+        Some("ifcfg") => Format::Ifcfg,
+        Some("networkd") => Format::Networkd,
+        Some("netplan") => Format::Netplan,
+        _ => Format::Keyfile,
+    }
+}
+
+fn compression_arg() -> clap::Arg {
+    clap::Arg::new("COMPRESSION")
+        .long("compression")
+        .value_parser(["gzip", "zstd"])
+        .default_value("gzip")
+        .help("Compression of the config archives, 'zstd' is smaller and faster to extract but requires \
+         a tar with zstd support on the machines")
+}
+
+fn compression(matches: &clap::ArgMatches) -> Compression {
+    match matches.get_one::<String>("COMPRESSION").map(String::as_str) {
+        Some("zstd") => Compression::Zstd,
+        _ => Compression::Gzip,
+    }
+}
+
+/// Arguments controlling how the host is identified by the local NICs.
+fn match_args() -> [clap::Arg; 4] {
+    [
+        clap::Arg::new("MATCH-BY-NAME")
+            .long("match-by-name")
+            .action(clap::ArgAction::SetTrue)
+            .help("Identifies the host by its Ethernet interface names if none of the hosts match \
+             the MAC addresses (e.g. on platforms randomizing them). Fragile, use as a last resort"),
+        clap::Arg::new("MATCH")
+            .long("match")
+            .value_parser(["any", "all"])
+            .default_value("any")
+            .help("How many of a host's Ethernet NICs have to be present locally for it to match, 'all' guards \
+             against MAC addresses copied into the wrong host. Overridden by the 'match' of the host in the host \
+             mapping"),
+        clap::Arg::new("FAIL-ON-AMBIGUOUS-MATCH")
+            .long("fail-on-ambiguous-match")
+            .action(clap::ArgAction::SetTrue)
+            .help("Fails if several hosts match the same number of interfaces instead of picking the first one \
+             in the host mapping"),
+        clap::Arg::new("ALLOW-SHARED-MACS")
+            .long("allow-shared-macs")
+            .action(clap::ArgAction::SetTrue)
+            .help("Accepts MAC addresses assigned to several hosts (e.g. by cloned images) and picks the host \
+             matching the most interfaces instead of rejecting the host mapping"),
+    ]
+}
+
+fn match_options(matches: &clap::ArgMatches) -> MatchOptions {
+    MatchOptions {
+        by_name: matches.get_flag("MATCH-BY-NAME"),
+        mode: match matches.get_one::<String>("MATCH").map(String::as_str) {
+            Some("all") => MatchMode::All,
+            _ => MatchMode::Any,
+        },
+        fail_on_ambiguous: matches.get_flag("FAIL-ON-AMBIGUOUS-MATCH"),
+        allow_shared_macs: matches.get_flag("ALLOW-SHARED-MACS"),
+    }
+}
+
+/// Arguments bounding the history of past apply runs.
+fn retention_args() -> [clap::Arg; 3] {
+    [
+        clap::Arg::new("RETAIN-COUNT")
+            .long("retain-count")
+            .value_name("COUNT")
+            .value_parser(clap::value_parser!(usize))
+            .default_value("50")
+            .help("Maximum number of history entries kept for past apply runs"),
+        clap::Arg::new("RETAIN-DAYS")
+            .long("retain-days")
+            .value_name("DAYS")
+            .value_parser(clap::value_parser!(u64))
+            .default_value("90")
+            .help("Maximum age in days of the history entries kept for past apply runs"),
+        clap::Arg::new("RETAIN-SIZE")
+            .long("retain-size")
+            .value_name("SIZE")
+            .value_parser(|value: &str| parse_size(value).map_err(|err| err.to_string()))
+            .default_value("10M")
+            .help(
+                "Maximum total size of the history entries kept for past apply runs, \
+             in bytes or with a K, M or G suffix",
+            ),
+    ]
+}
+
+fn retention_policy(matches: &clap::ArgMatches) -> RetentionPolicy {
+    RetentionPolicy {
+        max_count: matches.get_one::<usize>("RETAIN-COUNT").copied(),
+        max_age: matches
+            .get_one::<u64>("RETAIN-DAYS")
+            .map(|&days| history::days(days)),
+        max_size: matches.get_one::<u64>("RETAIN-SIZE").copied(),
+    }
+}
+
+fn values(matches: &clap::ArgMatches, id: &str) -> Vec<String> {
+    matches
+        .get_many::<String>(id)
+        .map(|values| values.cloned().collect())
+        .unwrap_or_default()
+}
+
+fn feature_gates(matches: &clap::ArgMatches) -> FeatureGates {
+    matches
+        .try_get_one::<FeatureGates>("FEATURE-GATES")
+        .ok()
+        .flatten()
+        .cloned()
+        .unwrap_or_default()
+}
+
+/// Returns whether the summary of a run is printed in color, `None` if it is not printed at all.
+///
+/// The summary is meant for interactive use, scripts capturing the output only get the log records.
+fn summary_color(matches: &clap::ArgMatches) -> Option<bool> {
+    if matches.get_flag("QUIET") || !std::io::stdout().is_terminal() {
+        return None;
+    }
+
+    let no_color = std::env::var_os("NO_COLOR").is_some_and(|value| !value.is_empty());
+    Some(!matches.get_flag("NO-COLOR") && !no_color)
+}
+
+/// Bound the run by the global `--timeout`. Only one-shot runs are bounded, the long-running ones would be exited
+/// by the watchdog otherwise.
+fn start_deadline(matches: &clap::ArgMatches) {
+    if let Some(&timeout) = matches.get_one::<u64>("TIMEOUT") {
+        deadline::start(Duration::from_secs(timeout));
+    }
+}
+
+fn setup_logger(matches: &clap::ArgMatches) {
+    let verbose_arg = "VERBOSE";
+
+    let mut level = matches
+        .try_get_one::<String>("LOG-LEVEL")
+        .ok()
+        .flatten()
+        .and_then(|level| level.parse().ok())
+        .unwrap_or(log::LevelFilter::Info);
+
+    // --verbose is a shorthand for the DEBUG level and does not lower an explicitly requested TRACE level.
+    if matches
+        .try_get_one::<bool>(verbose_arg)
+        .is_ok_and(|arg| arg.is_some_and(|&value| value))
+    {
+        level = level.max(log::LevelFilter::Debug);
+    }
+
+    if matches
+        .try_get_one::<bool>("QUIET")
+        .is_ok_and(|arg| arg.is_some_and(|&value| value))
+    {
+        level = log::LevelFilter::Error;
+    }
+
+    let target = matches
+        .try_get_one::<String>("LOG-TARGET")
+        .ok()
+        .flatten()
+        .map_or("stderr", String::as_str);
+    let socket_format = match target {
+        "journal" => Some(SocketFormat::Journal),
+        "syslog" => Some(SocketFormat::Syslog),
+        _ => None,
+    };
+
+    let mut fallback_reason = None;
+    if let Some(format) = socket_format {
+        match SocketLogger::connect(format, level) {
+            Ok(logger) => {
+                log::set_boxed_logger(Box::new(logger)).expect("Logger is already set up");
+                log::set_max_level(level);
+                return;
+            }
+            Err(err) => fallback_reason = Some(err),
+        }
+    }
+
+    let mut log_builder = env_logger::Builder::new();
+    log_builder.filter(None, level);
+    if matches
+        .try_get_one::<String>("LOG-FORMAT")
+        .is_ok_and(|arg| arg.is_some_and(|format| format == "json"))
+    {
+        log_builder.format(|buf, record| {
+            let timestamp = buf.timestamp().to_string();
+            logging::format_json(buf, &timestamp, logging::host(), record)
+        });
+    }
+    log_builder.init();
+
+    if let Some(err) = fallback_reason {
+        warn!("Logging to {target} is not available, falling back to stderr: {err}");
+    }
+}
@@ -0,0 +1,94 @@
+use std::path::Path;
+use std::{env, fs};
+
+use anyhow::Context;
+use log::info;
+use nmstate::NetworkState;
+
+use crate::bundle::{Bundle, Encryption};
+use crate::expand::expand_vars;
+use crate::generate_conf::parse_network_state;
+use crate::lock::{RunLock, LOCK_FILE};
+use crate::state::STATE_FILE;
+use crate::workspace::workspaces_dir;
+
+/// Options of applying a desired state to the running NetworkManager.
+pub(crate) struct LiveOptions {
+    /// Expand `${VAR}` references in the desired state from the environment.
+    pub(crate) expand_env: bool,
+    /// Seconds after which nmstate rolls back a change which did not complete.
+    pub(crate) rollback_timeout: u32,
+    /// Wait for a concurrent run to finish instead of failing.
+    pub(crate) wait_for_lock: bool,
+    /// Key file decrypting an encrypted desired state instead of the one provided via the environment.
+    pub(crate) decryption_key: Option<String>,
+}
+
+/// Apply the nmstate desired state in `state_file` directly to the running NetworkManager,
+/// e.g. for day-2 changes on live nodes, instead of storing connection files for the next boot.
+///
+/// nmstate verifies that the resulting state matches the desired one and rolls the change back
+/// if the verification fails or the change does not complete within the rollback timeout.
+pub(crate) fn apply_state(state_file: &str, options: &LiveOptions) -> Result<(), anyhow::Error> {
+    let _lock = RunLock::acquire(LOCK_FILE, options.wait_for_lock)?;
+
+    let bundle = match Encryption::detect(state_file) {
+        Some(encryption) => Some(Bundle::open(
+            state_file,
+            &encryption,
+            options.decryption_key.as_deref(),
+            &workspaces_dir(STATE_FILE),
+        )?),
+        None => None,
+    };
+    let path = match &bundle {
+        Some(bundle) => bundle.path(),
+        None => Path::new(state_file),
+    };
+
+    let mut state = load_state(path, options.expand_env)?;
+    state
+        .set_verify_change(true)
+        .set_commit(true)
+        .set_timeout(options.rollback_timeout);
+
+    info!("Applying desired state from {state_file:?}...");
+    state.apply().context("Applying desired state")?;
+
+    Ok(())
+}
+
+fn load_state(state_file: &Path, expand_env: bool) -> Result<NetworkState, anyhow::Error> {
+    let mut data = fs::read_to_string(state_file).context("Reading desired state")?;
+    if expand_env {
+        data = expand_vars(&data, |name| env::var(name).ok()).context("Expanding variables")?;
+    }
+
+    parse_network_state(&data).context("Parsing desired state")
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use crate::live::load_state;
+
+    #[test]
+    fn load_state_fails_due_to_undefined_variables() {
+        let path = "_live_state.yaml";
+        fs::write(
+            path,
+            "interfaces:\n- name: eth0\n  mtu: ${NMC_LIVE_TEST_MTU}\n",
+        )
+        .unwrap();
+
+        let error = load_state(Path::new(path), true).unwrap_err();
+        assert!(format!("{error:#}").contains("NMC_LIVE_TEST_MTU"));
+
+        assert!(load_state(Path::new("<missing>"), false).is_err());
+
+        // cleanup
+        fs::remove_file(path).unwrap();
+    }
+}
@@ -0,0 +1,104 @@
+use std::fmt;
+use std::fs;
+use std::io;
+use std::os::fd::AsRawFd;
+use std::os::unix::fs::OpenOptionsExt;
+
+use anyhow::Context;
+use log::{debug, info};
+
+/// Lock serializing the runs writing the connection files, e.g. a combustion retry and the watch mode.
+pub(crate) const LOCK_FILE: &str = "/run/nm-configurator.lock";
+
+/// Error returned when another run holds the lock and waiting for it was not requested.
+#[derive(Debug)]
+pub(crate) struct AlreadyRunning;
+
+impl fmt::Display for AlreadyRunning {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "Another run is in progress (pass --wait to wait for it to finish)"
+        )
+    }
+}
+
+impl std::error::Error for AlreadyRunning {}
+
+/// Exclusive advisory lock on the lock file, released when dropped.
+/// The kernel releases it as well if the process dies, so a crashed run never leaves a stale lock behind.
+pub(crate) struct RunLock {
+    _file: fs::File,
+}
+
+impl RunLock {
+    /// Acquire the lock, failing immediately if it is held by another run unless `wait` is set.
+    pub(crate) fn acquire(path: &str, wait: bool) -> Result<Self, anyhow::Error> {
+        let file = fs::OpenOptions::new()
+            .create(true)
+            .truncate(false)
+            .write(true)
+            .mode(0o600)
+            .open(path)
+            .with_context(|| format!("Opening lock file {path:?}"))?;
+
+        match try_lock(&file, libc::LOCK_EX | libc::LOCK_NB) {
+            Ok(..) => {}
+            Err(err) if err.raw_os_error() == Some(libc::EWOULDBLOCK) => {
+                if !wait {
+                    return Err(AlreadyRunning.into());
+                }
+
+                info!("Waiting for another run to finish");
+                try_lock(&file, libc::LOCK_EX).context("Waiting for lock")?;
+            }
+            Err(err) => return Err(err).context("Acquiring lock"),
+        }
+
+        debug!("Acquired lock {path:?}");
+
+        Ok(RunLock { _file: file })
+    }
+}
+
+fn try_lock(file: &fs::File, operation: libc::c_int) -> io::Result<()> {
+    let result = unsafe { libc::flock(file.as_raw_fd(), operation) };
+    if result != 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::thread;
+    use std::time::Duration;
+
+    use crate::lock::{AlreadyRunning, RunLock};
+
+    #[test]
+    fn exclusive_run_lock() {
+        let dir = "_run_lock";
+        fs::create_dir_all(dir).unwrap();
+        let path = "_run_lock/nmc.lock";
+
+        let lock = RunLock::acquire(path, false).unwrap();
+
+        let err = RunLock::acquire(path, false).err().unwrap();
+        assert!(err.is::<AlreadyRunning>());
+
+        let waiting = thread::spawn(move || RunLock::acquire(path, true).is_ok());
+        thread::sleep(Duration::from_millis(50));
+        assert!(!waiting.is_finished());
+
+        drop(lock);
+        assert!(waiting.join().unwrap());
+
+        assert!(RunLock::acquire(path, false).is_ok());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
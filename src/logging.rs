@@ -0,0 +1,337 @@
+use std::io::{self, Write};
+use std::os::unix::net::UnixDatagram;
+use std::process;
+use std::sync::OnceLock;
+
+use log::kv::{self, Key, Value, VisitSource};
+use log::{Level, LevelFilter, Log, Metadata, Record};
+
+use crate::APP_NAME;
+
+const JOURNAL_SOCKET: &str = "/run/systemd/journal/socket";
+const SYSLOG_SOCKET: &str = "/dev/log";
+
+/// Facility of the syslog messages (daemon).
+const SYSLOG_FACILITY: u8 = 3;
+
+/// Hostname attached to all subsequent JSON and journal records once the host is identified.
+static HOST: OnceLock<String> = OnceLock::new();
+
+pub(crate) fn set_host(hostname: &str) {
+    let _ = HOST.set(hostname.to_string());
+}
+
+pub(crate) fn host() -> Option<&'static str> {
+    HOST.get().map(String::as_str)
+}
+
+/// Write the record as a single line JSON object. Structured fields passed to the log macros
+/// (e.g. `info!(interface = name; "...")`) are emitted as additional string members.
+pub(crate) fn format_json(
+    buf: &mut impl Write,
+    timestamp: &str,
+    host: Option<&str>,
+    record: &Record,
+) -> io::Result<()> {
+    let mut line = String::from("{");
+
+    push_field(&mut line, "timestamp", timestamp);
+    push_field(&mut line, "level", record.level().as_str());
+    push_field(&mut line, "target", record.target());
+    push_field(&mut line, "message", &record.args().to_string());
+    if let Some(host) = host {
+        push_field(&mut line, "host", host);
+    }
+
+    // Visiting a slice of pairs never fails.
+    let _ = record.key_values().visit(&mut JsonFields(&mut line));
+
+    line.push('}');
+
+    writeln!(buf, "{line}")
+}
+
+/// Protocols of the local log daemons the records can be sent to instead of stderr.
+#[derive(Clone, Copy, Debug)]
+pub(crate) enum SocketFormat {
+    /// Native protocol of systemd-journald, preserving the structured fields.
+    Journal,
+    /// RFC 3164 messages as accepted by syslog daemons on `/dev/log`.
+    Syslog,
+}
+
+/// Logger sending each record as a single datagram to journald or syslog.
+pub(crate) struct SocketLogger {
+    socket: UnixDatagram,
+    format: SocketFormat,
+    level: LevelFilter,
+}
+
+impl SocketLogger {
+    pub(crate) fn connect(format: SocketFormat, level: LevelFilter) -> io::Result<Self> {
+        let socket = UnixDatagram::unbound()?;
+        socket.connect(match format {
+            SocketFormat::Journal => JOURNAL_SOCKET,
+            SocketFormat::Syslog => SYSLOG_SOCKET,
+        })?;
+
+        Ok(SocketLogger {
+            socket,
+            format,
+            level,
+        })
+    }
+}
+
+impl Log for SocketLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= self.level
+    }
+
+    fn log(&self, record: &Record) {
+        if !self.enabled(record.metadata()) {
+            return;
+        }
+
+        let message = match self.format {
+            SocketFormat::Journal => journal_message(host(), record),
+            SocketFormat::Syslog => syslog_message(process::id(), record),
+        };
+
+        // There is no other destination left to report failures to.
+        let _ = self.socket.send(&message);
+    }
+
+    fn flush(&self) {}
+}
+
+/// Map the log level to the syslog severity also used as journal priority.
+fn priority(level: Level) -> u8 {
+    match level {
+        Level::Error => 3,
+        Level::Warn => 4,
+        Level::Info => 6,
+        Level::Debug | Level::Trace => 7,
+    }
+}
+
+/// Serialize the record using the native journal protocol. Structured fields are
+/// upper-cased to match the journal conventions, e.g. `interface` becomes `INTERFACE`.
+fn journal_message(host: Option<&str>, record: &Record) -> Vec<u8> {
+    let mut message = Vec::new();
+
+    push_journal_field(
+        &mut message,
+        "PRIORITY",
+        &priority(record.level()).to_string(),
+    );
+    push_journal_field(&mut message, "SYSLOG_IDENTIFIER", APP_NAME);
+    push_journal_field(&mut message, "MESSAGE", &record.args().to_string());
+    push_journal_field(&mut message, "TARGET", record.target());
+    if let Some(file) = record.file() {
+        push_journal_field(&mut message, "CODE_FILE", file);
+    }
+    if let Some(line) = record.line() {
+        push_journal_field(&mut message, "CODE_LINE", &line.to_string());
+    }
+    if let Some(host) = host {
+        push_journal_field(&mut message, "HOST", host);
+    }
+
+    let mut fields = JournalFields(&mut message);
+    // Visiting a slice of pairs never fails.
+    let _ = record.key_values().visit(&mut fields);
+
+    message
+}
+
+struct JournalFields<'a>(&'a mut Vec<u8>);
+
+impl<'kvs> VisitSource<'kvs> for JournalFields<'_> {
+    fn visit_pair(&mut self, key: Key<'kvs>, value: Value<'kvs>) -> Result<(), kv::Error> {
+        let name: String = key
+            .as_str()
+            .chars()
+            .map(|c| match c {
+                c if c.is_ascii_alphanumeric() => c.to_ascii_uppercase(),
+                _ => '_',
+            })
+            .collect();
+
+        push_journal_field(self.0, &name, &value.to_string());
+        Ok(())
+    }
+}
+
+/// Values spanning multiple lines are length-prefixed, all others are written as `NAME=value`.
+fn push_journal_field(message: &mut Vec<u8>, name: &str, value: &str) {
+    message.extend_from_slice(name.as_bytes());
+
+    if value.contains('\n') {
+        message.push(b'\n');
+        message.extend_from_slice(&(value.len() as u64).to_le_bytes());
+    } else {
+        message.push(b'=');
+    }
+
+    message.extend_from_slice(value.as_bytes());
+    message.push(b'\n');
+}
+
+/// Format the record as an RFC 3164 message without timestamp and hostname,
+/// which are added by the syslog daemon.
+fn syslog_message(pid: u32, record: &Record) -> Vec<u8> {
+    let pri = SYSLOG_FACILITY * 8 + priority(record.level());
+
+    format!("<{pri}>{APP_NAME}[{pid}]: {}", record.args()).into_bytes()
+}
+
+struct JsonFields<'a>(&'a mut String);
+
+impl<'kvs> VisitSource<'kvs> for JsonFields<'_> {
+    fn visit_pair(&mut self, key: Key<'kvs>, value: Value<'kvs>) -> Result<(), kv::Error> {
+        push_field(self.0, key.as_str(), &value.to_string());
+        Ok(())
+    }
+}
+
+fn push_field(line: &mut String, key: &str, value: &str) {
+    if !line.ends_with('{') {
+        line.push(',');
+    }
+
+    line.push_str(&format!("\"{}\":\"{}\"", escape(key), escape(value)));
+}
+
+fn escape(value: &str) -> String {
+    let mut escaped = String::with_capacity(value.len());
+
+    for c in value.chars() {
+        match c {
+            '"' => escaped.push_str("\\\""),
+            '\\' => escaped.push_str("\\\\"),
+            '\n' => escaped.push_str("\\n"),
+            '\r' => escaped.push_str("\\r"),
+            '\t' => escaped.push_str("\\t"),
+            c if c.is_control() => escaped.push_str(&format!("\\u{:04x}", c as u32)),
+            c => escaped.push(c),
+        }
+    }
+
+    escaped
+}
+
+#[cfg(test)]
+mod tests {
+    use log::{Level, Record};
+
+    use crate::logging::{escape, format_json, journal_message, priority, syslog_message};
+
+    #[test]
+    fn escape_special_characters() {
+        assert_eq!(escape("eth0"), "eth0");
+        assert_eq!(escape("\"a\\b\"\n"), "\\\"a\\\\b\\\"\\n");
+        assert_eq!(escape("\u{1b}[0m\t"), "\\u001b[0m\\t");
+    }
+
+    #[test]
+    fn format_record_as_json() {
+        let mut buf = Vec::new();
+        format_json(
+            &mut buf,
+            "2024-05-20T23:38:31Z",
+            None,
+            &Record::builder()
+                .args(format_args!("Processing interface 'eth0'..."))
+                .level(Level::Info)
+                .target("nmc::apply_conf")
+                .build(),
+        )
+        .unwrap();
+
+        assert_eq!(
+            String::from_utf8(buf).unwrap(),
+            "{\"timestamp\":\"2024-05-20T23:38:31Z\",\"level\":\"INFO\",\"target\":\"nmc::apply_conf\",\
+             \"message\":\"Processing interface 'eth0'...\"}\n"
+        );
+    }
+
+    #[test]
+    fn format_record_with_fields_as_json() {
+        let mut buf = Vec::new();
+        format_json(
+            &mut buf,
+            "2024-05-20T23:38:31Z",
+            Some("node1"),
+            &Record::builder()
+                .args(format_args!("Address 192.168.1.10 is \"in use\""))
+                .level(Level::Warn)
+                .target("nmc::address_probe")
+                .key_values(&("interface", "eth0"))
+                .build(),
+        )
+        .unwrap();
+
+        assert_eq!(
+            String::from_utf8(buf).unwrap(),
+            "{\"timestamp\":\"2024-05-20T23:38:31Z\",\"level\":\"WARN\",\"target\":\"nmc::address_probe\",\
+             \"message\":\"Address 192.168.1.10 is \\\"in use\\\"\",\"host\":\"node1\",\"interface\":\"eth0\"}\n"
+        );
+    }
+
+    #[test]
+    fn map_levels_to_priorities() {
+        assert_eq!(priority(Level::Error), 3);
+        assert_eq!(priority(Level::Warn), 4);
+        assert_eq!(priority(Level::Info), 6);
+        assert_eq!(priority(Level::Debug), 7);
+        assert_eq!(priority(Level::Trace), 7);
+    }
+
+    #[test]
+    fn format_record_for_journal() {
+        let message = journal_message(
+            Some("node1"),
+            &Record::builder()
+                .args(format_args!("Stored \"/etc/eth0.nmconnection\""))
+                .level(Level::Warn)
+                .target("nmc::apply_conf")
+                .key_values(&("interface", "eth0"))
+                .build(),
+        );
+
+        assert_eq!(
+            message,
+            b"PRIORITY=4\nSYSLOG_IDENTIFIER=nmc\nMESSAGE=Stored \"/etc/eth0.nmconnection\"\n\
+              TARGET=nmc::apply_conf\nHOST=node1\nINTERFACE=eth0\n"
+        );
+
+        let message = journal_message(
+            None,
+            &Record::builder()
+                .args(format_args!("a\nb"))
+                .level(Level::Trace)
+                .target("nmc")
+                .line(Some(7))
+                .build(),
+        );
+
+        let mut expected = b"PRIORITY=7\nSYSLOG_IDENTIFIER=nmc\nMESSAGE\n".to_vec();
+        expected.extend_from_slice(&3u64.to_le_bytes());
+        expected.extend_from_slice(b"a\nb\nTARGET=nmc\nCODE_LINE=7\n");
+        assert_eq!(message, expected);
+    }
+
+    #[test]
+    fn format_record_for_syslog() {
+        let message = syslog_message(
+            42,
+            &Record::builder()
+                .args(format_args!("Identified host: node1"))
+                .level(Level::Info)
+                .build(),
+        );
+
+        assert_eq!(message, b"<30>nmc[42]: Identified host: node1");
+    }
+}
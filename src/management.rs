@@ -0,0 +1,460 @@
+use std::fs;
+use std::net::IpAddr;
+use std::path::Path;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Context};
+use log::{debug, info, warn};
+use network_interface::{NetworkInterface, NetworkInterfaceConfig};
+
+use crate::apply_conf::ConnectionFile;
+use crate::keyfile::{is_keyfile, Keyfile};
+use crate::types::{Host, Interface};
+
+/// How long the management interface is given to regain connectivity via its changed profile,
+/// unless its verification policy allows longer.
+const CONNECTIVITY_TIMEOUT: Duration = Duration::from_secs(60);
+/// Interval of checking whether the management interface regained connectivity.
+const CONNECTIVITY_POLL_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Ensure that the profile of the management interface is not removed, renamed or
+/// materially modified on a live system unless explicitly allowed.
+///
+/// The system is considered live if a profile for the management NIC is already stored in `destination_dir`.
+/// Returns the name of the management NIC if its profile is changed, whose connectivity has to be verified then.
+pub(crate) fn check_management_interface(
+    host: &Host,
+    network_interfaces: &[NetworkInterface],
+    connection_files: &[ConnectionFile],
+    destination_dir: &str,
+    allow_change: bool,
+) -> Result<Option<String>, anyhow::Error> {
+    let management: Vec<&Interface> = host.interfaces.iter().filter(|i| i.management).collect();
+
+    let interface = match management.as_slice() {
+        [] => return Ok(None),
+        [interface] => interface,
+        _ => {
+            let names: Vec<&str> = management.iter().map(|i| i.logical_name.as_str()).collect();
+            return Err(anyhow!(
+                "Only a single management interface per host is supported, found: {}",
+                names.join(", ")
+            ));
+        }
+    };
+
+    let Some(nic) = network_interfaces
+        .iter()
+        .find(|nic| nic.mac_addr.is_some() && nic.mac_addr == interface.mac_address)
+    else {
+        debug!(
+            "Management interface '{}' is not present",
+            interface.logical_name
+        );
+        return Ok(None);
+    };
+
+    let Some((existing_name, existing)) = find_profile(destination_dir, &nic.name)? else {
+        debug!(
+            "No profile is stored for management interface '{}'",
+            nic.name
+        );
+        return Ok(None);
+    };
+
+    let new_file = connection_files
+        .iter()
+        .find(|file| profile_interface(&Keyfile::parse(&file.contents), &file.name) == nic.name);
+
+    let change = match new_file {
+        None => "removed or renamed",
+        Some(file) if file.name != existing_name => "renamed",
+        Some(file) if !Keyfile::parse(&file.contents).equivalent(&existing) => "modified",
+        Some(_) => {
+            debug!(
+                "Profile of management interface '{}' is unchanged",
+                nic.name
+            );
+            return Ok(None);
+        }
+    };
+
+    if !allow_change {
+        return Err(anyhow!(
+            "Profile of management interface '{}' would be {change}, pass --allow-mgmt-change to proceed",
+            nic.name
+        ));
+    }
+
+    warn!(
+        interface = nic.name.as_str();
+        "Profile of management interface '{}' will be {change}",
+        nic.name
+    );
+
+    Ok(Some(nic.name.clone()))
+}
+
+/// Wait for the management interface to regain connectivity once NetworkManager activated its changed profile,
+/// i.e. for its link to be up and a routable address to be assigned to it. Fails if it does not in time,
+/// since the node may no longer be reachable remotely.
+pub(crate) fn verify_connectivity(
+    host: &Host,
+    interface: &str,
+    sysfs_net_dir: &str,
+) -> Result<(), anyhow::Error> {
+    let timeout = host
+        .interfaces
+        .iter()
+        .find(|i| i.management)
+        .and_then(|i| i.verification)
+        .map_or(CONNECTIVITY_TIMEOUT, |policy| {
+            CONNECTIVITY_TIMEOUT.max(Duration::from_secs(policy.timeout))
+        });
+
+    if !wait_for_connectivity(interface, sysfs_net_dir, timeout, || {
+        NetworkInterface::show().unwrap_or_default()
+    }) {
+        return Err(anyhow!(
+            "Management interface '{interface}' has no connectivity {}s after activating its changed profile",
+            timeout.as_secs()
+        ));
+    }
+
+    info!(interface = interface; "Management interface '{interface}' is up and has an address");
+    Ok(())
+}
+
+fn wait_for_connectivity(
+    interface: &str,
+    sysfs_net_dir: &str,
+    timeout: Duration,
+    network_interfaces: impl Fn() -> Vec<NetworkInterface>,
+) -> bool {
+    let operstate = Path::new(sysfs_net_dir).join(interface).join("operstate");
+    let deadline = Instant::now() + timeout;
+
+    loop {
+        if fs::read_to_string(&operstate).is_ok_and(|state| state.trim() == "up")
+            && has_routable_address(&network_interfaces(), interface)
+        {
+            return true;
+        }
+
+        let now = Instant::now();
+        if now >= deadline {
+            return false;
+        }
+
+        thread::sleep(CONNECTIVITY_POLL_INTERVAL.min(deadline - now));
+    }
+}
+
+/// Returns whether the interface has an address other than an IPv6 link-local one,
+/// which the kernel assigns regardless of the profile.
+fn has_routable_address(network_interfaces: &[NetworkInterface], interface: &str) -> bool {
+    network_interfaces
+        .iter()
+        .filter(|nic| nic.name == interface)
+        .flat_map(|nic| &nic.addr)
+        .any(|addr| match addr.ip() {
+            IpAddr::V4(ip) => !ip.is_link_local(),
+            IpAddr::V6(ip) => ip.segments()[0] & 0xffc0 != 0xfe80,
+        })
+}
+
+/// Find the stored profile for the given interface and return its file name (without extension) and contents.
+fn find_profile(
+    destination_dir: &str,
+    interface_name: &str,
+) -> Result<Option<(String, Keyfile)>, anyhow::Error> {
+    let dir = Path::new(destination_dir);
+    if !dir.exists() {
+        return Ok(None);
+    }
+
+    let mut paths = fs::read_dir(dir)
+        .context("Reading destination dir")?
+        .map(|entry| entry.map(|e| e.path()))
+        .collect::<Result<Vec<_>, _>>()?;
+    paths.sort();
+
+    for path in paths {
+        if !is_keyfile(&path) {
+            continue;
+        }
+
+        let Some(name) = path.file_stem().and_then(|stem| stem.to_str()) else {
+            continue;
+        };
+
+        let keyfile = Keyfile::parse(&fs::read_to_string(&path).context("Reading profile")?);
+        if profile_interface(&keyfile, name) == interface_name {
+            return Ok(Some((name.to_string(), keyfile)));
+        }
+    }
+
+    Ok(None)
+}
+
+fn profile_interface<'a>(keyfile: &'a Keyfile, filename: &'a str) -> &'a str {
+    keyfile
+        .get("connection", "interface-name")
+        .unwrap_or(filename)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::time::Duration;
+
+    use network_interface::{Addr, NetworkInterface, V4IfAddr, V6IfAddr};
+
+    use crate::apply_conf::ConnectionFile;
+    use crate::management::{
+        check_management_interface, find_profile, has_routable_address, wait_for_connectivity,
+    };
+    use crate::types::{Host, Interface};
+
+    const EXISTING_PROFILE: &str =
+        "[connection]\nid=eth0\ninterface-name=ens1f0\n\n[ipv4]\nmethod=auto\n";
+
+    fn host(management: &[bool]) -> Host {
+        Host {
+            hostname: "node1".to_string(),
+            interfaces: management
+                .iter()
+                .enumerate()
+                .map(|(i, &management)| Interface {
+                    logical_name: format!("eth{i}"),
+                    mac_address: Option::from(format!("00:11:22:33:44:5{i}")),
+                    interface_type: "ethernet".to_string(),
+                    management,
+                    ..Default::default()
+                })
+                .collect(),
+            ..Default::default()
+        }
+    }
+
+    fn network_interfaces() -> Vec<NetworkInterface> {
+        vec![NetworkInterface {
+            name: "ens1f0".to_string(),
+            mac_addr: Some("00:11:22:33:44:50".to_string()),
+            addr: vec![],
+            index: 0,
+        }]
+    }
+
+    fn connection_file(name: &str, contents: &str) -> Vec<ConnectionFile> {
+        vec![ConnectionFile {
+            name: name.to_string(),
+            contents: contents.to_string(),
+        }]
+    }
+
+    fn setup(dir: &str) {
+        fs::create_dir_all(dir).unwrap();
+        fs::write(format!("{dir}/ens1f0.nmconnection"), EXISTING_PROFILE).unwrap();
+    }
+
+    #[test]
+    fn management_interface_unchanged() {
+        let dir = "_mgmt_unchanged";
+        setup(dir);
+
+        let files = connection_file(
+            "ens1f0",
+            "[connection]\nid = eth0\ninterface-name = ens1f0\n[ipv4]\nmethod = auto\n",
+        );
+        assert!(check_management_interface(
+            &host(&[true]),
+            &network_interfaces(),
+            &files,
+            dir,
+            false
+        )
+        .unwrap()
+        .is_none());
+
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn management_interface_changes_require_permission() {
+        let dir = "_mgmt_changed";
+        setup(dir);
+
+        let modified = connection_file(
+            "ens1f0",
+            "[connection]\nid=eth0\ninterface-name=ens1f0\n\n[ipv4]\nmethod=manual\n",
+        );
+        let renamed = connection_file("eth0", "[connection]\nid=eth0\ninterface-name=eth0\n");
+
+        for (files, change) in [
+            (modified, "modified"),
+            (renamed, "removed or renamed"),
+            (vec![], "removed or renamed"),
+        ] {
+            let error = check_management_interface(
+                &host(&[true]),
+                &network_interfaces(),
+                &files,
+                dir,
+                false,
+            )
+            .unwrap_err();
+            assert_eq!(
+                error.to_string(),
+                format!("Profile of management interface 'ens1f0' would be {change}, pass --allow-mgmt-change to proceed")
+            );
+
+            assert_eq!(
+                check_management_interface(
+                    &host(&[true]),
+                    &network_interfaces(),
+                    &files,
+                    dir,
+                    true
+                )
+                .unwrap(),
+                Some("ens1f0".to_string())
+            );
+        }
+
+        // Changes to non-management interfaces are not guarded.
+        assert!(check_management_interface(
+            &host(&[false]),
+            &network_interfaces(),
+            &[],
+            dir,
+            false
+        )
+        .is_ok());
+
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn management_interface_on_new_system() {
+        let files = connection_file("ens1f0", "[connection]\ninterface-name=ens1f0\n");
+
+        assert!(check_management_interface(
+            &host(&[true]),
+            &network_interfaces(),
+            &files,
+            "<missing>",
+            false
+        )
+        .is_ok());
+    }
+
+    #[test]
+    fn multiple_management_interfaces() {
+        let error = check_management_interface(
+            &host(&[true, false, true]),
+            &network_interfaces(),
+            &[],
+            "<missing>",
+            false,
+        )
+        .unwrap_err();
+
+        assert_eq!(
+            error.to_string(),
+            "Only a single management interface per host is supported, found: eth0, eth2"
+        );
+    }
+
+    #[test]
+    fn find_stored_profile() {
+        let dir = "_mgmt_find";
+        setup(dir);
+        fs::write(
+            format!("{dir}/eth1.nmconnection"),
+            "[connection]\nid=eth1\n",
+        )
+        .unwrap();
+
+        let (name, _) = find_profile(dir, "ens1f0").unwrap().unwrap();
+        assert_eq!(name, "ens1f0");
+        let (name, _) = find_profile(dir, "eth1").unwrap().unwrap();
+        assert_eq!(name, "eth1");
+        assert!(find_profile(dir, "eth2").unwrap().is_none());
+
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    fn with_addresses(addresses: &[&str]) -> Vec<NetworkInterface> {
+        let mut interfaces = network_interfaces();
+        interfaces[0].addr = addresses
+            .iter()
+            .map(|address| match address.parse().unwrap() {
+                std::net::IpAddr::V4(ip) => Addr::V4(V4IfAddr {
+                    ip,
+                    broadcast: None,
+                    netmask: None,
+                }),
+                std::net::IpAddr::V6(ip) => Addr::V6(V6IfAddr {
+                    ip,
+                    broadcast: None,
+                    netmask: None,
+                }),
+            })
+            .collect();
+        interfaces
+    }
+
+    #[test]
+    fn routable_addresses() {
+        assert!(!has_routable_address(&with_addresses(&[]), "ens1f0"));
+        assert!(!has_routable_address(
+            &with_addresses(&["fe80::1", "169.254.1.1"]),
+            "ens1f0"
+        ));
+        assert!(has_routable_address(
+            &with_addresses(&["fe80::1", "192.168.1.10"]),
+            "ens1f0"
+        ));
+        assert!(has_routable_address(
+            &with_addresses(&["2001:db8::1"]),
+            "ens1f0"
+        ));
+        assert!(!has_routable_address(
+            &with_addresses(&["192.168.1.10"]),
+            "eth0"
+        ));
+    }
+
+    #[test]
+    fn wait_for_management_connectivity() {
+        let sysfs_net_dir = "_mgmt_sysfs";
+        fs::create_dir_all(format!("{sysfs_net_dir}/ens1f0")).unwrap();
+        let connected = || with_addresses(&["192.168.1.10"]);
+
+        fs::write(format!("{sysfs_net_dir}/ens1f0/operstate"), "down\n").unwrap();
+        assert!(!wait_for_connectivity(
+            "ens1f0",
+            sysfs_net_dir,
+            Duration::ZERO,
+            connected
+        ));
+
+        fs::write(format!("{sysfs_net_dir}/ens1f0/operstate"), "up\n").unwrap();
+        assert!(wait_for_connectivity(
+            "ens1f0",
+            sysfs_net_dir,
+            Duration::ZERO,
+            connected
+        ));
+        assert!(!wait_for_connectivity(
+            "ens1f0",
+            sysfs_net_dir,
+            Duration::ZERO,
+            || with_addresses(&["fe80::1"])
+        ));
+
+        fs::remove_dir_all(sysfs_net_dir).unwrap();
+    }
+}
@@ -0,0 +1,52 @@
+use std::path::Path;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use anyhow::Context;
+
+use crate::filesystem::FileSystem;
+
+/// Atomically replace the metrics file, so that collectors (e.g. the textfile collector
+/// of the Prometheus node exporter) never read a partially written one.
+pub(crate) fn write_metrics_file(
+    filesystem: &dyn FileSystem,
+    path: &str,
+    metrics: &str,
+) -> Result<(), anyhow::Error> {
+    filesystem
+        .write(Path::new(path), metrics.as_bytes(), 0o666)
+        .context("Replacing metrics file")
+}
+
+pub(crate) fn unix_timestamp() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use crate::filesystem::Disk;
+    use crate::metrics::write_metrics_file;
+
+    #[test]
+    fn write_metrics_file_atomically() {
+        let dir = Path::new("_metrics_file");
+        fs::create_dir_all(dir).unwrap();
+        let path = dir.join("nmc.prom");
+        let path = path.to_str().unwrap();
+
+        write_metrics_file(&Disk, path, "nmc_verify_success 1\n").unwrap();
+        write_metrics_file(&Disk, path, "nmc_verify_success 0\n").unwrap();
+
+        assert_eq!(fs::read_to_string(path).unwrap(), "nmc_verify_success 0\n");
+        // No temporary file is left behind
+        assert_eq!(fs::read_dir(dir).unwrap().count(), 1);
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
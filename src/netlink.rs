@@ -0,0 +1,353 @@
+use std::fs;
+use std::io;
+use std::mem;
+use std::os::fd::{AsRawFd, FromRawFd, OwnedFd};
+
+const NLMSG_HEADER_LEN: usize = 16;
+const IFINFOMSG_LEN: usize = 16;
+const RTATTR_HEADER_LEN: usize = 4;
+const NLMSG_ALIGNTO: usize = 4;
+
+const RTM_NEWLINKPROP: u16 = 108;
+const IFLA_PROP_LIST: u16 = 52;
+const IFLA_ALT_IFNAME: u16 = 53;
+const NLA_F_NESTED: u16 = 0x8000;
+
+const IFALIASZ: usize = 256;
+const ALTIFNAMSIZ: usize = 128;
+
+/// Rename the link with the given index.
+///
+/// The kernel only allows renaming links which are administratively down.
+pub(crate) fn set_link_name(index: u32, name: &str) -> io::Result<()> {
+    if name.is_empty() || name.len() >= libc::IFNAMSIZ {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidInput,
+            format!("invalid interface name: '{name}'"),
+        ));
+    }
+
+    RouteSocket::open()?.request(&set_link_name_message(index, name))
+}
+
+/// Set the description (ifalias) of the link with the given index.
+pub(crate) fn set_link_alias(index: u32, alias: &str) -> io::Result<()> {
+    if alias.len() >= IFALIASZ {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidInput,
+            format!("interface alias exceeds {} characters", IFALIASZ - 1),
+        ));
+    }
+
+    let message = link_message(
+        libc::RTM_SETLINK,
+        0,
+        index,
+        &attribute(libc::IFLA_IFALIAS, &string_payload(alias)),
+    );
+
+    RouteSocket::open()?.request(&message)
+}
+
+/// Add an alternative name to the link with the given index. Adding an existing name is a no-op.
+pub(crate) fn add_link_alt_name(index: u32, name: &str) -> io::Result<()> {
+    if name.is_empty() || name.len() >= ALTIFNAMSIZ {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidInput,
+            format!("invalid alternative interface name: '{name}'"),
+        ));
+    }
+
+    match RouteSocket::open()?.request(&add_alt_name_message(index, name)) {
+        Err(err) if err.raw_os_error() == Some(libc::EEXIST) => Ok(()),
+        result => result,
+    }
+}
+
+/// Returns whether the link with the given name is administratively up.
+pub(crate) fn is_link_up(name: &str) -> io::Result<bool> {
+    let flags = fs::read_to_string(format!("/sys/class/net/{name}/flags"))?;
+
+    parse_flags(&flags)
+        .map(|flags| flags & libc::IFF_UP as u32 != 0)
+        .ok_or_else(|| io::Error::new(io::ErrorKind::InvalidData, "invalid link flags"))
+}
+
+fn parse_flags(flags: &str) -> Option<u32> {
+    u32::from_str_radix(flags.trim().trim_start_matches("0x"), 16).ok()
+}
+
+fn set_link_name_message(index: u32, name: &str) -> Vec<u8> {
+    link_message(
+        libc::RTM_SETLINK,
+        0,
+        index,
+        &attribute(libc::IFLA_IFNAME, &string_payload(name)),
+    )
+}
+
+fn add_alt_name_message(index: u32, name: &str) -> Vec<u8> {
+    let alt_name = attribute(IFLA_ALT_IFNAME, &string_payload(name));
+
+    link_message(
+        RTM_NEWLINKPROP,
+        (libc::NLM_F_CREATE | libc::NLM_F_EXCL) as u16,
+        index,
+        &attribute(IFLA_PROP_LIST | NLA_F_NESTED, &alt_name),
+    )
+}
+
+/// Build a request with the given type and flags for the link with the given index.
+fn link_message(message_type: u16, flags: u16, index: u32, attributes: &[u8]) -> Vec<u8> {
+    let len = NLMSG_HEADER_LEN + IFINFOMSG_LEN + attributes.len();
+    let flags = flags | (libc::NLM_F_REQUEST | libc::NLM_F_ACK) as u16;
+
+    let mut message = Vec::with_capacity(len);
+    message.extend_from_slice(&(len as u32).to_ne_bytes());
+    message.extend_from_slice(&message_type.to_ne_bytes());
+    message.extend_from_slice(&flags.to_ne_bytes());
+    message.extend_from_slice(&1u32.to_ne_bytes()); // sequence number
+    message.extend_from_slice(&0u32.to_ne_bytes()); // port ID (kernel)
+
+    message.push(libc::AF_UNSPEC as u8); // family
+    message.push(0); // padding
+    message.extend_from_slice(&0u16.to_ne_bytes()); // device type
+    message.extend_from_slice(&(index as i32).to_ne_bytes());
+    message.extend_from_slice(&0u32.to_ne_bytes()); // flags
+    message.extend_from_slice(&0u32.to_ne_bytes()); // change mask
+
+    message.extend_from_slice(attributes);
+
+    message
+}
+
+/// Build a route attribute padded to the netlink alignment.
+fn attribute(attribute_type: u16, payload: &[u8]) -> Vec<u8> {
+    let mut attribute = Vec::with_capacity(align(RTATTR_HEADER_LEN + payload.len()));
+    attribute.extend_from_slice(&((RTATTR_HEADER_LEN + payload.len()) as u16).to_ne_bytes());
+    attribute.extend_from_slice(&attribute_type.to_ne_bytes());
+    attribute.extend_from_slice(payload);
+    attribute.resize(align(attribute.len()), 0);
+
+    attribute
+}
+
+fn string_payload(value: &str) -> Vec<u8> {
+    let mut payload = value.as_bytes().to_vec();
+    payload.push(0);
+    payload
+}
+
+/// Parse the kernel acknowledgement from the received messages.
+/// Returns `None` if the buffer does not contain an acknowledgement.
+fn parse_ack(buffer: &[u8]) -> Option<io::Result<()>> {
+    let mut offset = 0;
+
+    while offset + NLMSG_HEADER_LEN <= buffer.len() {
+        let len = u32::from_ne_bytes(buffer[offset..offset + 4].try_into().ok()?) as usize;
+        let message_type = u16::from_ne_bytes(buffer[offset + 4..offset + 6].try_into().ok()?);
+
+        if len < NLMSG_HEADER_LEN || offset + len > buffer.len() {
+            return Some(Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                "truncated netlink message",
+            )));
+        }
+
+        if i32::from(message_type) == libc::NLMSG_ERROR {
+            let start = offset + NLMSG_HEADER_LEN;
+            let error = i32::from_ne_bytes(buffer.get(start..start + 4)?.try_into().ok()?);
+
+            return Some(match error {
+                0 => Ok(()),
+                _ => Err(io::Error::from_raw_os_error(-error)),
+            });
+        }
+
+        offset += align(len);
+    }
+
+    None
+}
+
+fn align(len: usize) -> usize {
+    (len + NLMSG_ALIGNTO - 1) & !(NLMSG_ALIGNTO - 1)
+}
+
+/// Socket communicating with the kernel over the `NETLINK_ROUTE` protocol.
+struct RouteSocket {
+    fd: OwnedFd,
+}
+
+impl RouteSocket {
+    fn open() -> io::Result<Self> {
+        let fd = unsafe {
+            libc::socket(
+                libc::AF_NETLINK,
+                libc::SOCK_RAW | libc::SOCK_CLOEXEC,
+                libc::NETLINK_ROUTE,
+            )
+        };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        let socket = RouteSocket {
+            fd: unsafe { OwnedFd::from_raw_fd(fd) },
+        };
+
+        let mut address: libc::sockaddr_nl = unsafe { mem::zeroed() };
+        address.nl_family = libc::AF_NETLINK as libc::sa_family_t;
+
+        let result = unsafe {
+            libc::bind(
+                socket.fd.as_raw_fd(),
+                &address as *const libc::sockaddr_nl as *const libc::sockaddr,
+                mem::size_of::<libc::sockaddr_nl>() as libc::socklen_t,
+            )
+        };
+        if result < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(socket)
+    }
+
+    /// Send the request and wait for its acknowledgement.
+    fn request(&self, message: &[u8]) -> io::Result<()> {
+        let sent = unsafe {
+            libc::send(
+                self.fd.as_raw_fd(),
+                message.as_ptr() as *const libc::c_void,
+                message.len(),
+                0,
+            )
+        };
+        if sent < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        let mut buffer = [0u8; 8192];
+
+        loop {
+            let len = unsafe {
+                libc::recv(
+                    self.fd.as_raw_fd(),
+                    buffer.as_mut_ptr() as *mut libc::c_void,
+                    buffer.len(),
+                    0,
+                )
+            };
+            if len < 0 {
+                return Err(io::Error::last_os_error());
+            }
+
+            if let Some(result) = parse_ack(&buffer[..len as usize]) {
+                return result;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::netlink::{
+        add_alt_name_message, add_link_alt_name, align, attribute, parse_ack, parse_flags,
+        set_link_alias, set_link_name, set_link_name_message,
+    };
+
+    #[test]
+    fn build_set_link_name_message() {
+        let message = set_link_name_message(3, "eth0");
+
+        // header (16) + ifinfomsg (16) + attribute header (4) + "eth0\0" (5) padded to 8
+        assert_eq!(message.len(), 44);
+        assert_eq!(u32::from_ne_bytes(message[0..4].try_into().unwrap()), 44);
+        assert_eq!(u16::from_ne_bytes(message[4..6].try_into().unwrap()), 19);
+        assert_eq!(u16::from_ne_bytes(message[6..8].try_into().unwrap()), 5);
+        assert_eq!(i32::from_ne_bytes(message[20..24].try_into().unwrap()), 3);
+        assert_eq!(u16::from_ne_bytes(message[32..34].try_into().unwrap()), 9);
+        assert_eq!(u16::from_ne_bytes(message[34..36].try_into().unwrap()), 3);
+        assert_eq!(&message[36..44], b"eth0\0\0\0\0");
+    }
+
+    #[test]
+    fn build_add_alt_name_message() {
+        let message = add_alt_name_message(3, "uplink");
+
+        // header (16) + ifinfomsg (16) + list attribute header (4) + name attribute (4 + "uplink\0" padded to 8)
+        assert_eq!(message.len(), 48);
+        assert_eq!(u16::from_ne_bytes(message[4..6].try_into().unwrap()), 108);
+        assert_eq!(
+            u16::from_ne_bytes(message[6..8].try_into().unwrap()),
+            0x1 | 0x4 | 0x200 | 0x400
+        );
+        assert_eq!(u16::from_ne_bytes(message[32..34].try_into().unwrap()), 16);
+        assert_eq!(
+            u16::from_ne_bytes(message[34..36].try_into().unwrap()),
+            52 | 0x8000
+        );
+        assert_eq!(u16::from_ne_bytes(message[36..38].try_into().unwrap()), 11);
+        assert_eq!(u16::from_ne_bytes(message[38..40].try_into().unwrap()), 53);
+        assert_eq!(&message[40..48], b"uplink\0\0");
+    }
+
+    #[test]
+    fn build_route_attribute() {
+        let header = |len: u16| [len.to_ne_bytes(), 20u16.to_ne_bytes()].concat();
+
+        assert_eq!(attribute(20, b""), header(4));
+        assert_eq!(
+            attribute(20, b"ab"),
+            [header(6), b"ab\0\0".to_vec()].concat()
+        );
+    }
+
+    #[test]
+    fn parse_netlink_ack() {
+        let ack = |error: i32| {
+            let mut message = Vec::new();
+            message.extend_from_slice(&36u32.to_ne_bytes());
+            message.extend_from_slice(&2u16.to_ne_bytes());
+            message.extend_from_slice(&[0; 10]);
+            message.extend_from_slice(&error.to_ne_bytes());
+            message.extend_from_slice(&[0; 16]);
+            message
+        };
+
+        assert!(parse_ack(&ack(0)).unwrap().is_ok());
+        assert_eq!(
+            parse_ack(&ack(-libc::EBUSY))
+                .unwrap()
+                .unwrap_err()
+                .raw_os_error(),
+            Some(libc::EBUSY)
+        );
+        assert!(parse_ack(&[]).is_none());
+        assert!(parse_ack(&ack(0)[..20]).unwrap().is_err());
+    }
+
+    #[test]
+    fn parse_link_flags() {
+        assert_eq!(parse_flags("0x1003\n"), Some(0x1003));
+        assert_eq!(parse_flags("0x1002"), Some(0x1002));
+        assert_eq!(parse_flags("invalid"), None);
+    }
+
+    #[test]
+    fn set_link_name_fails_due_to_invalid_name() {
+        assert!(set_link_name(1, "").is_err());
+        assert!(set_link_name(1, "a-very-long-interface-name").is_err());
+        assert!(set_link_alias(1, &"a".repeat(256)).is_err());
+        assert!(add_link_alt_name(1, "").is_err());
+        assert!(add_link_alt_name(1, &"a".repeat(128)).is_err());
+    }
+
+    #[test]
+    fn align_lengths() {
+        assert_eq!(align(0), 0);
+        assert_eq!(align(1), 4);
+        assert_eq!(align(4), 4);
+        assert_eq!(align(9), 12);
+    }
+}
@@ -0,0 +1,669 @@
+use std::collections::BTreeMap;
+
+use anyhow::{anyhow, Context};
+use log::{info, warn};
+use serde::{Deserialize, Serialize};
+use serde_yaml::Value;
+
+use crate::yaml;
+
+/// File holding the netplan config of a host, merged by netplan with the others in `/etc/netplan/` in name order.
+pub(crate) const NETPLAN_FILE: &str = "50-nm-configurator.yaml";
+
+/// Route table nmstate and netplan use unless told otherwise.
+const MAIN_TABLE: u32 = 254;
+
+/// Subset of the nmstate desired state which can be expressed by netplan.
+/// Any other settings are collected in the `other` maps and reported as unsupported.
+#[derive(Deserialize, Default)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredState {
+    #[serde(default)]
+    interfaces: Vec<DesiredInterface>,
+    #[serde(default)]
+    routes: DesiredRoutes,
+    #[serde(default)]
+    dns_resolver: DesiredDns,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredInterface {
+    name: String,
+    #[serde(rename = "type")]
+    interface_type: String,
+    state: Option<String>,
+    mac_address: Option<String>,
+    mtu: Option<u32>,
+    ipv4: Option<DesiredIp>,
+    ipv6: Option<DesiredIp>,
+    link_aggregation: Option<DesiredBond>,
+    bridge: Option<DesiredBridge>,
+    vlan: Option<DesiredVlan>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredIp {
+    #[serde(default)]
+    enabled: bool,
+    #[serde(default)]
+    dhcp: bool,
+    #[serde(default)]
+    autoconf: bool,
+    #[serde(default)]
+    address: Vec<DesiredAddress>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredAddress {
+    ip: String,
+    prefix_length: u8,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredBond {
+    mode: Option<String>,
+    #[serde(default)]
+    options: BTreeMap<String, Value>,
+    /// Called `slaves` by older nmstate versions.
+    #[serde(default, alias = "slaves")]
+    port: Vec<String>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredBridge {
+    options: Option<DesiredBridgeOptions>,
+    #[serde(default)]
+    port: Vec<DesiredBridgePort>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredBridgeOptions {
+    stp: Option<DesiredStp>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredStp {
+    enabled: Option<bool>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredBridgePort {
+    name: String,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredVlan {
+    base_iface: String,
+    id: u16,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize, Default)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredRoutes {
+    #[serde(default)]
+    config: Vec<DesiredRoute>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredRoute {
+    destination: String,
+    state: Option<String>,
+    next_hop_address: Option<String>,
+    next_hop_interface: Option<String>,
+    metric: Option<u32>,
+    table_id: Option<u32>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize, Default)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredDns {
+    #[serde(default)]
+    config: DesiredDnsConfig,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Deserialize, Default)]
+#[serde(rename_all = "kebab-case")]
+struct DesiredDnsConfig {
+    #[serde(default)]
+    server: Vec<String>,
+    #[serde(default)]
+    search: Vec<String>,
+    #[serde(flatten)]
+    other: BTreeMap<String, Value>,
+}
+
+#[derive(Serialize, Debug, PartialEq)]
+struct Netplan {
+    network: Network,
+}
+
+#[derive(Serialize, Debug, Default, PartialEq)]
+struct Network {
+    version: u8,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    ethernets: BTreeMap<String, Device>,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    bonds: BTreeMap<String, Device>,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    bridges: BTreeMap<String, Device>,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    vlans: BTreeMap<String, Device>,
+}
+
+#[derive(Serialize, Debug, Default, PartialEq)]
+#[serde(rename_all = "kebab-case")]
+struct Device {
+    #[serde(rename = "match", skip_serializing_if = "Option::is_none")]
+    matching: Option<Match>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    set_name: Option<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    interfaces: Vec<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    id: Option<u16>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    link: Option<String>,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    parameters: BTreeMap<String, Value>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    mtu: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    dhcp4: Option<bool>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    dhcp6: Option<bool>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    accept_ra: Option<bool>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    link_local: Option<Vec<String>>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    addresses: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    routes: Vec<Route>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    nameservers: Option<Nameservers>,
+}
+
+#[derive(Serialize, Debug, PartialEq)]
+struct Match {
+    macaddress: String,
+}
+
+#[derive(Serialize, Debug, PartialEq)]
+struct Route {
+    to: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    via: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    metric: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    table: Option<u32>,
+}
+
+#[derive(Serialize, Debug, Clone, PartialEq)]
+struct Nameservers {
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    addresses: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    search: Vec<String>,
+}
+
+/// Convert the nmstate desired state of a host into netplan YAML.
+///
+/// Only the commonly used settings of Ethernet, bond, VLAN and bridge interfaces, routes and DNS can be expressed.
+/// Any other settings are reported in a warning, so that silently lost configuration is never deployed unnoticed.
+pub(crate) fn to_netplan(name: &str, data: &str) -> Result<String, anyhow::Error> {
+    let state: DesiredState =
+        yaml::from_reader(data.as_bytes()).context("Parsing desired state")?;
+
+    let mut unsupported = Vec::new();
+    let netplan = convert(state, &mut unsupported)?;
+
+    if !unsupported.is_empty() {
+        warn!(
+            file = name;
+            "Settings of '{name}' not supported by netplan are dropped: {}",
+            unsupported.join(", ")
+        );
+    }
+
+    serde_yaml::to_string(&netplan).context("Serializing netplan config")
+}
+
+fn convert(state: DesiredState, unsupported: &mut Vec<String>) -> Result<Netplan, anyhow::Error> {
+    let mut network = Network {
+        version: 2,
+        ..Network::default()
+    };
+    unsupported.extend(state.other.keys().cloned());
+    unsupported.extend(state.routes.other.keys().map(|key| format!("routes.{key}")));
+    unsupported.extend(
+        state
+            .dns_resolver
+            .other
+            .keys()
+            .map(|key| format!("dns-resolver.{key}")),
+    );
+    unsupported.extend(
+        state
+            .dns_resolver
+            .config
+            .other
+            .keys()
+            .map(|key| format!("dns-resolver.config.{key}")),
+    );
+
+    let mut routes: BTreeMap<String, Vec<Route>> = BTreeMap::new();
+    for route in state.routes.config {
+        if route.state.as_deref() == Some("absent") {
+            continue;
+        }
+        unsupported.extend(route.other.keys().map(|key| format!("routes.config.{key}")));
+
+        let Some(interface) = route.next_hop_interface else {
+            unsupported.push(format!("routes.config.{}", route.destination));
+            continue;
+        };
+
+        let to = match route.destination.as_str() {
+            "0.0.0.0/0" | "::/0" => "default".to_string(),
+            destination => destination.to_string(),
+        };
+        routes.entry(interface).or_default().push(Route {
+            to,
+            via: route.next_hop_address,
+            metric: route.metric,
+            table: route
+                .table_id
+                .filter(|table| ![0, MAIN_TABLE].contains(table)),
+        });
+    }
+
+    // netplan configures the name servers per interface, so they are assigned to the ones with a default route
+    // or, lacking those, to all of the interfaces with IP enabled.
+    let dns = &state.dns_resolver.config;
+    let nameservers = (!dns.server.is_empty() || !dns.search.is_empty()).then(|| Nameservers {
+        addresses: dns.server.clone(),
+        search: dns.search.clone(),
+    });
+    let default_route_interfaces: Vec<String> = routes
+        .iter()
+        .filter(|(_, routes)| routes.iter().any(|route| route.to == "default"))
+        .map(|(interface, _)| interface.clone())
+        .collect();
+
+    for interface in state.interfaces {
+        let name = interface.name.clone();
+
+        if matches!(interface.state.as_deref(), Some("absent" | "down")) {
+            info!("Skipping interface '{name}' which is not up");
+            continue;
+        }
+
+        let ip_enabled = [&interface.ipv4, &interface.ipv6]
+            .iter()
+            .any(|ip| ip.as_ref().is_some_and(|ip| ip.enabled));
+        let assign_dns = if default_route_interfaces.is_empty() {
+            ip_enabled
+        } else {
+            default_route_interfaces.contains(&name)
+        };
+
+        let devices = match interface.interface_type.as_str() {
+            "ethernet" => &mut network.ethernets,
+            "bond" => &mut network.bonds,
+            "linux-bridge" => &mut network.bridges,
+            "vlan" => &mut network.vlans,
+            "loopback" => {
+                info!("Skipping loopback interface '{name}'");
+                continue;
+            }
+            interface_type => {
+                return Err(anyhow!(
+                    "Interface type '{interface_type}' of '{name}' is not supported by netplan"
+                ))
+            }
+        };
+
+        let mut device = convert_interface(interface, unsupported);
+        device.routes = routes.remove(&name).unwrap_or_default();
+        if assign_dns {
+            device.nameservers = nameservers.clone();
+        }
+
+        devices.insert(name, device);
+    }
+
+    for interface in routes.keys() {
+        unsupported.push(format!("routes.config.{interface}"));
+    }
+
+    Ok(Netplan { network })
+}
+
+fn convert_interface(interface: DesiredInterface, unsupported: &mut Vec<String>) -> Device {
+    let name = interface.name;
+    let mut device = Device {
+        mtu: interface.mtu,
+        ..Device::default()
+    };
+
+    unsupported.extend(interface.other.keys().map(|key| format!("{name}.{key}")));
+
+    // NICs are matched by their MAC address and named as in the desired state.
+    if let Some(mac_address) = interface.mac_address {
+        if interface.interface_type == "ethernet" {
+            device.matching = Some(Match {
+                macaddress: mac_address.to_lowercase(),
+            });
+            device.set_name = Some(name.clone());
+        } else {
+            unsupported.push(format!("{name}.mac-address"));
+        }
+    }
+
+    let ipv4 = interface.ipv4.filter(|ip| ip.enabled);
+    let ipv6 = interface.ipv6.filter(|ip| ip.enabled);
+
+    if let Some(ipv4) = &ipv4 {
+        unsupported.extend(ipv4.other.keys().map(|key| format!("{name}.ipv4.{key}")));
+        if ipv4.dhcp {
+            device.dhcp4 = Some(true);
+        }
+        device.addresses.extend(
+            ipv4.address
+                .iter()
+                .map(|address| format!("{}/{}", address.ip, address.prefix_length)),
+        );
+    }
+
+    match &ipv6 {
+        Some(ipv6) => {
+            unsupported.extend(ipv6.other.keys().map(|key| format!("{name}.ipv6.{key}")));
+            if ipv6.dhcp {
+                device.dhcp6 = Some(true);
+            }
+            device.accept_ra = Some(ipv6.autoconf);
+            device.addresses.extend(
+                ipv6.address
+                    .iter()
+                    .map(|address| format!("{}/{}", address.ip, address.prefix_length)),
+            );
+        }
+        None => {
+            device.accept_ra = Some(false);
+            device.link_local = Some(Vec::new());
+        }
+    }
+
+    if let Some(bond) = interface.link_aggregation {
+        unsupported.extend(
+            bond.other
+                .keys()
+                .map(|key| format!("{name}.link-aggregation.{key}")),
+        );
+        device.interfaces = bond.port;
+        if let Some(mode) = bond.mode {
+            device
+                .parameters
+                .insert("mode".to_string(), Value::String(mode));
+        }
+        for (option, value) in bond.options {
+            let parameter = match option.as_str() {
+                "miimon" => "mii-monitor-interval",
+                "lacp_rate" => "lacp-rate",
+                "xmit_hash_policy" => "transmit-hash-policy",
+                "primary" => "primary",
+                "updelay" => "up-delay",
+                "downdelay" => "down-delay",
+                _ => {
+                    unsupported.push(format!("{name}.link-aggregation.options.{option}"));
+                    continue;
+                }
+            };
+            device.parameters.insert(parameter.to_string(), value);
+        }
+    }
+
+    if let Some(bridge) = interface.bridge {
+        unsupported.extend(
+            bridge
+                .other
+                .keys()
+                .map(|key| format!("{name}.bridge.{key}")),
+        );
+        for port in bridge.port {
+            unsupported.extend(
+                port.other
+                    .keys()
+                    .map(|key| format!("{name}.bridge.port.{key}")),
+            );
+            device.interfaces.push(port.name);
+        }
+
+        if let Some(options) = bridge.options {
+            unsupported.extend(
+                options
+                    .other
+                    .keys()
+                    .map(|key| format!("{name}.bridge.options.{key}")),
+            );
+            if let Some(stp) = options.stp {
+                unsupported.extend(
+                    stp.other
+                        .keys()
+                        .map(|key| format!("{name}.bridge.options.stp.{key}")),
+                );
+                if let Some(enabled) = stp.enabled {
+                    device
+                        .parameters
+                        .insert("stp".to_string(), Value::Bool(enabled));
+                }
+            }
+        }
+    }
+
+    if let Some(vlan) = interface.vlan {
+        unsupported.extend(vlan.other.keys().map(|key| format!("{name}.vlan.{key}")));
+        device.id = Some(vlan.id);
+        device.link = Some(vlan.base_iface);
+    }
+
+    device
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_yaml::Value;
+
+    use crate::netplan::{convert, DesiredState, Device, Match, Nameservers, Route};
+    use crate::yaml;
+
+    fn convert_state(data: &str) -> (super::Network, Vec<String>) {
+        let state: DesiredState = yaml::from_reader(data.as_bytes()).unwrap();
+        let mut unsupported = Vec::new();
+        let netplan = convert(state, &mut unsupported).unwrap();
+        (netplan.network, unsupported)
+    }
+
+    #[test]
+    fn convert_ethernet_interface() {
+        let (network, unsupported) = convert_state(
+            r#"
+interfaces:
+  - name: eth0
+    type: ethernet
+    state: up
+    mac-address: "00:11:22:AA:BB:CC"
+    mtu: 9000
+    ipv4:
+      enabled: true
+      address:
+        - ip: 192.168.122.10
+          prefix-length: 24
+    ipv6:
+      enabled: true
+      dhcp: true
+      autoconf: true
+    ethtool:
+      feature:
+        tx-checksum-ip-generic: false
+  - name: eth1
+    type: ethernet
+    state: down
+  - name: lo
+    type: loopback
+routes:
+  config:
+    - destination: 0.0.0.0/0
+      next-hop-address: 192.168.122.1
+      next-hop-interface: eth0
+      metric: 100
+      table-id: 254
+dns-resolver:
+  config:
+    server:
+      - 192.168.122.1
+    search:
+      - example.com
+"#,
+        );
+
+        assert_eq!(network.version, 2);
+        assert_eq!(network.ethernets.len(), 1);
+        assert_eq!(
+            network.ethernets["eth0"],
+            Device {
+                matching: Some(Match {
+                    macaddress: "00:11:22:aa:bb:cc".to_string()
+                }),
+                set_name: Some("eth0".to_string()),
+                mtu: Some(9000),
+                dhcp6: Some(true),
+                accept_ra: Some(true),
+                addresses: vec!["192.168.122.10/24".to_string()],
+                routes: vec![Route {
+                    to: "default".to_string(),
+                    via: Some("192.168.122.1".to_string()),
+                    metric: Some(100),
+                    table: None,
+                }],
+                nameservers: Some(Nameservers {
+                    addresses: vec!["192.168.122.1".to_string()],
+                    search: vec!["example.com".to_string()],
+                }),
+                ..Device::default()
+            }
+        );
+        assert_eq!(unsupported, vec!["eth0.ethtool"]);
+    }
+
+    #[test]
+    fn convert_bond_vlan_and_bridge() {
+        let (network, unsupported) = convert_state(
+            r#"
+interfaces:
+  - name: eth1
+    type: ethernet
+  - name: eth2
+    type: ethernet
+  - name: bond0
+    type: bond
+    link-aggregation:
+      mode: 802.3ad
+      options:
+        miimon: 100
+        lacp_rate: fast
+        arp_interval: 10
+      port:
+        - eth1
+        - eth2
+  - name: bond0.1365
+    type: vlan
+    vlan:
+      base-iface: bond0
+      id: 1365
+  - name: br0
+    type: linux-bridge
+    ipv4:
+      enabled: true
+      dhcp: true
+    bridge:
+      options:
+        stp:
+          enabled: false
+      port:
+        - name: bond0.1365
+"#,
+        );
+
+        let bond = &network.bonds["bond0"];
+        assert_eq!(bond.interfaces, vec!["eth1", "eth2"]);
+        assert_eq!(bond.parameters["mode"], "802.3ad");
+        assert_eq!(bond.parameters["lacp-rate"], "fast");
+        assert!(bond.parameters.contains_key("mii-monitor-interval"));
+        assert_eq!(bond.accept_ra, Some(false));
+        assert_eq!(bond.link_local, Some(vec![]));
+
+        let vlan = &network.vlans["bond0.1365"];
+        assert_eq!(vlan.id, Some(1365));
+        assert_eq!(vlan.link.as_deref(), Some("bond0"));
+
+        let bridge = &network.bridges["br0"];
+        assert_eq!(bridge.interfaces, vec!["bond0.1365"]);
+        assert_eq!(bridge.parameters["stp"], Value::Bool(false));
+        assert_eq!(bridge.dhcp4, Some(true));
+
+        assert_eq!(network.ethernets.len(), 2);
+        assert_eq!(
+            unsupported,
+            vec!["bond0.link-aggregation.options.arp_interval"]
+        );
+    }
+
+    #[test]
+    fn convert_unsupported_interface_type() {
+        let state: DesiredState =
+            yaml::from_reader("interfaces:\n  - name: wg0\n    type: wireguard\n".as_bytes())
+                .unwrap();
+
+        let error = convert(state, &mut Vec::new()).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Interface type 'wireguard' of 'wg0' is not supported by netplan"
+        );
+    }
+}
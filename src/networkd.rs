@@ -0,0 +1,520 @@
+use std::collections::BTreeMap;
+use std::fmt;
+
+use anyhow::anyhow;
+use log::{info, warn};
+
+use crate::ifcfg::{is_address_key, list_items, yes_no};
+use crate::keyfile::Keyfile;
+use crate::types::interface_of;
+
+/// Prefix of the generated file names, ordering them before the catch-all defaults of distributions (e.g. `99-*.network`).
+pub(crate) const FILE_PREFIX: &str = "10-";
+
+/// Settings emitted by nmstate which have no systemd-networkd counterpart but match its behavior and are dropped silently.
+const DEFAULT_KEYS: [&str; 7] = [
+    "connection.id",
+    "connection.uuid",
+    "connection.autoconnect-slaves",
+    "ipv4.dhcp-timeout",
+    "ipv6.dhcp-timeout",
+    "ipv6.addr-gen-mode",
+    "vlan.flags",
+];
+
+/// Convert the keyfiles of a host into `.network` and `.netdev` files for systemd-networkd,
+/// returned as `(file name, contents)` pairs.
+///
+/// The keyfiles are converted together, since networkd declares VLANs and ports in the `.network` file of
+/// their parent and port respectively. As with `ifcfg` files, only the commonly used settings of Ethernet,
+/// bond, VLAN and bridge connections can be expressed, and any other settings are reported in a warning.
+pub(crate) fn to_networkd(
+    keyfiles: &[(String, Keyfile)],
+) -> Result<Vec<(String, String)>, anyhow::Error> {
+    let mut networks: BTreeMap<&str, Unit> = BTreeMap::new();
+    let mut netdevs: BTreeMap<&str, Unit> = BTreeMap::new();
+    let mut interfaces = BTreeMap::new();
+
+    for (name, keyfile) in keyfiles {
+        // Only a single configuration applies to an interface, so additional profiles can't be expressed.
+        if interface_of(name) != name {
+            warn!(file = name.as_str(); "Skipping additional profile '{name}', systemd-networkd supports a single one per interface");
+            continue;
+        }
+
+        let connection_type = keyfile.get("connection", "type").unwrap_or_default();
+        if connection_type == "loopback" {
+            info!(
+                "Skipping loopback connection '{name}', systemd-networkd brings it up on its own"
+            );
+            continue;
+        }
+
+        let interface = keyfile
+            .get("connection", "interface-name")
+            .ok_or_else(|| anyhow!("Connection '{name}' has no interface name"))?;
+        if let Some(uuid) = keyfile.get("connection", "uuid") {
+            interfaces.insert(uuid, interface);
+        }
+
+        let (network, netdev) = convert(name, interface, connection_type, keyfile)?;
+        networks.insert(interface, network);
+        if let Some(netdev) = netdev {
+            netdevs.insert(interface, netdev);
+        }
+    }
+
+    // Controllers and parents may be referred to by UUID.
+    let resolve = |reference: &str| -> String {
+        interfaces
+            .get(reference)
+            .map_or(reference, |interface| *interface)
+            .to_string()
+    };
+
+    for (name, keyfile) in keyfiles {
+        let Some(interface) = keyfile.get("connection", "interface-name") else {
+            continue;
+        };
+        if interface_of(name) != name || !networks.contains_key(interface) {
+            continue;
+        }
+
+        let controller = keyfile
+            .get("connection", "controller")
+            .or_else(|| keyfile.get("connection", "master"));
+        let port_type = keyfile
+            .get("connection", "port-type")
+            .or_else(|| keyfile.get("connection", "slave-type"));
+        match (port_type, controller) {
+            (Some("bond"), Some(controller)) => {
+                push(&mut networks, interface, "Bond", resolve(controller))
+            }
+            (Some("bridge"), Some(controller)) => {
+                push(&mut networks, interface, "Bridge", resolve(controller))
+            }
+            (None, None) => {}
+            _ => {
+                warn!(file = name.as_str(); "Settings of '{name}' not supported by systemd-networkd are dropped: connection.controller")
+            }
+        }
+
+        if let Some(parent) = keyfile.get("vlan", "parent") {
+            let parent = resolve(parent);
+            if !networks.contains_key(parent.as_str()) {
+                return Err(anyhow!(
+                    "Parent '{parent}' of VLAN '{name}' has no connection"
+                ));
+            }
+            push(&mut networks, &parent, "VLAN", interface.to_string());
+        }
+    }
+
+    let mut files: Vec<(String, String)> = netdevs
+        .iter()
+        .map(|(interface, unit)| (format!("{FILE_PREFIX}{interface}.netdev"), unit.to_string()))
+        .collect();
+    files.extend(networks.iter().map(|(interface, unit)| {
+        (
+            format!("{FILE_PREFIX}{interface}.network"),
+            unit.to_string(),
+        )
+    }));
+
+    Ok(files)
+}
+
+fn push(networks: &mut BTreeMap<&str, Unit>, interface: &str, key: &str, value: String) {
+    if let Some(network) = networks.get_mut(interface) {
+        network.push("Network", key, &value);
+    }
+}
+
+/// Convert a single keyfile into its `.network` file and, for virtual interfaces, `.netdev` file.
+fn convert(
+    name: &str,
+    interface: &str,
+    connection_type: &str,
+    keyfile: &Keyfile,
+) -> Result<(Unit, Option<Unit>), anyhow::Error> {
+    let mut network = Unit::default();
+    let mut unsupported = Vec::new();
+
+    // NICs are matched by their permanent MAC address (which bonding does not alter) if known,
+    // since the image may not name them as the config does.
+    match keyfile
+        .get("ethernet", "mac-address")
+        .or_else(|| keyfile.get("802-3-ethernet", "mac-address"))
+    {
+        Some(mac_address) => network.push("Match", "PermanentMACAddress", mac_address),
+        None => network.push("Match", "Name", interface),
+    }
+
+    let kind = match connection_type {
+        "802-3-ethernet" | "ethernet" => None,
+        "bond" | "vlan" | "bridge" => Some(connection_type),
+        _ => {
+            return Err(anyhow!(
+            "Connection type '{connection_type}' of '{name}' is not supported by systemd-networkd"
+        ))
+        }
+    };
+
+    let mut netdev = kind.map(|kind| {
+        let mut netdev = Unit::default();
+        netdev.push("NetDev", "Name", interface);
+        netdev.push("NetDev", "Kind", kind);
+        netdev
+    });
+
+    for (key, value) in keyfile.entries("connection") {
+        match key {
+            "type" | "interface-name" | "controller" | "master" | "port-type" | "slave-type" => {}
+            "autoconnect" if yes_no(value) == "no" => {
+                network.push("Link", "ActivationPolicy", "manual")
+            }
+            "autoconnect" => {}
+            _ => unsupported.push(format!("connection.{key}")),
+        }
+    }
+
+    for section in ["ethernet", "802-3-ethernet"] {
+        for (key, value) in keyfile.entries(section) {
+            match key {
+                "mac-address" => {}
+                "cloned-mac-address" => network.push("Link", "MACAddress", value),
+                "mtu" => network.push("Link", "MTUBytes", value),
+                _ => unsupported.push(format!("{section}.{key}")),
+            }
+        }
+    }
+
+    convert_ip(keyfile, &mut network, &mut unsupported);
+
+    if let Some(netdev) = &mut netdev {
+        convert_netdev(keyfile, netdev, &mut unsupported);
+    }
+
+    for section in keyfile.sections() {
+        if ![
+            "connection",
+            "ethernet",
+            "802-3-ethernet",
+            "ipv4",
+            "ipv6",
+            "vlan",
+            "bond",
+            "bridge",
+        ]
+        .contains(&section)
+        {
+            unsupported.extend(
+                keyfile
+                    .entries(section)
+                    .map(|(key, _)| format!("{section}.{key}")),
+            );
+        }
+    }
+
+    unsupported.retain(|key| !DEFAULT_KEYS.contains(&key.as_str()));
+    if !unsupported.is_empty() {
+        warn!(
+            file = name;
+            "Settings of '{name}' not supported by systemd-networkd are dropped: {}",
+            unsupported.join(", ")
+        );
+    }
+
+    Ok((network, netdev))
+}
+
+fn convert_ip(keyfile: &Keyfile, network: &mut Unit, unsupported: &mut Vec<String>) {
+    let ipv4_method = keyfile.get("ipv4", "method").unwrap_or("disabled");
+    let ipv6_method = keyfile.get("ipv6", "method").unwrap_or("ignore");
+
+    match (ipv4_method == "auto", matches!(ipv6_method, "dhcp")) {
+        (true, true) => network.push("Network", "DHCP", "yes"),
+        (true, false) => network.push("Network", "DHCP", "ipv4"),
+        (false, true) => network.push("Network", "DHCP", "ipv6"),
+        (false, false) => {}
+    }
+
+    // NetworkManager assigns IPv6 link-local addresses unless IPv6 is disabled, networkd only by default.
+    let link_local_ipv4 = ipv4_method == "link-local";
+    let link_local_ipv6 = !matches!(ipv6_method, "disabled" | "ignore");
+    match (link_local_ipv4, link_local_ipv6) {
+        (true, true) => network.push("Network", "LinkLocalAddressing", "yes"),
+        (true, false) => network.push("Network", "LinkLocalAddressing", "ipv4"),
+        (false, true) => {}
+        (false, false) => network.push("Network", "LinkLocalAddressing", "no"),
+    }
+
+    match ipv6_method {
+        "auto" => network.push("Network", "IPv6AcceptRA", "yes"),
+        "dhcp" | "manual" | "link-local" | "disabled" | "ignore" => {
+            network.push("Network", "IPv6AcceptRA", "no")
+        }
+        _ => unsupported.push("ipv6.method".to_string()),
+    }
+
+    for (family, dhcp_section) in [("ipv4", "DHCPv4"), ("ipv6", "DHCPv6")] {
+        for (key, value) in keyfile.entries(family) {
+            match key {
+                "method" => {
+                    if family == "ipv4"
+                        && !matches!(value, "auto" | "manual" | "disabled" | "link-local")
+                    {
+                        unsupported.push(format!("{family}.{key}"));
+                    }
+                }
+                _ if is_address_key(key) => {
+                    // Addresses may carry a gateway, e.g. `192.168.1.10/24,192.168.1.1`.
+                    let (address, gateway) = value.split_once(',').unwrap_or((value, ""));
+                    network.push("Network", "Address", address);
+                    if !gateway.is_empty() {
+                        network.push("Network", "Gateway", gateway);
+                    }
+                }
+                "gateway" => network.push("Network", "Gateway", value),
+                "dns" => list_items(value)
+                    .iter()
+                    .for_each(|server| network.push("Network", "DNS", server)),
+                "dns-search" => network.push("Network", "Domains", &list_items(value).join(" ")),
+                "ignore-auto-dns" if yes_no(value) == "yes" => {
+                    network.push(dhcp_section, "UseDNS", "no");
+                    if family == "ipv6" {
+                        network.push("IPv6AcceptRA", "UseDNS", "no");
+                    }
+                }
+                "ignore-auto-dns" => {}
+                "dhcp-hostname" if family == "ipv4" => {
+                    network.push(dhcp_section, "Hostname", value)
+                }
+                "dhcp-send-hostname" if family == "ipv4" => {
+                    network.push(dhcp_section, "SendHostname", yes_no(value))
+                }
+                _ => unsupported.push(format!("{family}.{key}")),
+            }
+        }
+    }
+}
+
+fn convert_netdev(keyfile: &Keyfile, netdev: &mut Unit, unsupported: &mut Vec<String>) {
+    for (key, value) in keyfile.entries("vlan") {
+        match key {
+            "id" => netdev.push("VLAN", "Id", value),
+            "parent" => {}
+            _ => unsupported.push(format!("vlan.{key}")),
+        }
+    }
+
+    for (key, value) in keyfile.entries("bond") {
+        match key {
+            "mode" => netdev.push("Bond", "Mode", value),
+            "miimon" => netdev.push("Bond", "MIIMonitorSec", &format!("{value}ms")),
+            "lacp_rate" => netdev.push("Bond", "LACPTransmitRate", value),
+            "xmit_hash_policy" => netdev.push("Bond", "TransmitHashPolicy", value),
+            _ => unsupported.push(format!("bond.{key}")),
+        }
+    }
+
+    for (key, value) in keyfile.entries("bridge") {
+        match key {
+            "stp" => netdev.push("Bridge", "STP", yes_no(value)),
+            "priority" => netdev.push("Bridge", "Priority", value),
+            "forward-delay" => netdev.push("Bridge", "ForwardDelaySec", value),
+            _ => unsupported.push(format!("bridge.{key}")),
+        }
+    }
+}
+
+/// Contents of a systemd unit-like file, i.e. sections of possibly repeated keys in order.
+#[derive(Default)]
+struct Unit {
+    sections: Vec<(String, Vec<(String, String)>)>,
+}
+
+impl Unit {
+    fn push(&mut self, section: &str, key: &str, value: &str) {
+        let entry = (key.to_string(), value.to_string());
+
+        match self.sections.iter_mut().find(|(name, _)| name == section) {
+            Some((_, entries)) => entries.push(entry),
+            None => self.sections.push((section.to_string(), vec![entry])),
+        }
+    }
+}
+
+impl fmt::Display for Unit {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for (index, (section, entries)) in self.sections.iter().enumerate() {
+            if index > 0 {
+                writeln!(f)?;
+            }
+
+            writeln!(f, "[{section}]")?;
+            for (key, value) in entries {
+                writeln!(f, "{key}={value}")?;
+            }
+        }
+
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::keyfile::Keyfile;
+    use crate::networkd::to_networkd;
+
+    fn keyfiles(keyfiles: &[(&str, &str)]) -> Vec<(String, Keyfile)> {
+        keyfiles
+            .iter()
+            .map(|(name, contents)| (name.to_string(), Keyfile::parse(contents)))
+            .collect()
+    }
+
+    #[test]
+    fn convert_ethernet_keyfile() {
+        let keyfiles = keyfiles(&[(
+            "eth0",
+            "[connection]\n\
+             autoconnect=true\n\
+             id=eth0\n\
+             interface-name=eth0\n\
+             type=802-3-ethernet\n\
+             uuid=dfd202f5-562f-5f07-8f2a-a7717756fb70\n\
+             \n\
+             [ethernet]\n\
+             mac-address=00:11:22:33:44:55\n\
+             mtu=9000\n\
+             \n\
+             [ipv4]\n\
+             address0=192.168.75.4/24,192.168.75.1\n\
+             dns=1.1.1.1;8.8.8.8;\n\
+             dns-search=example.com;\n\
+             method=manual\n\
+             \n\
+             [ipv6]\n\
+             addr-gen-mode=0\n\
+             method=auto\n\
+             \n\
+             [ethtool]\n\
+             ring-rx=4096\n",
+        )]);
+
+        assert_eq!(
+            to_networkd(&keyfiles).unwrap(),
+            [(
+                "10-eth0.network".to_string(),
+                "[Match]\n\
+                 PermanentMACAddress=00:11:22:33:44:55\n\
+                 \n\
+                 [Link]\n\
+                 MTUBytes=9000\n\
+                 \n\
+                 [Network]\n\
+                 IPv6AcceptRA=yes\n\
+                 Address=192.168.75.4/24\n\
+                 Gateway=192.168.75.1\n\
+                 DNS=1.1.1.1\n\
+                 DNS=8.8.8.8\n\
+                 Domains=example.com\n"
+                    .to_string()
+            )]
+        );
+    }
+
+    #[test]
+    fn convert_bond_vlan_and_ports() {
+        let keyfiles = keyfiles(&[
+            (
+                "bond0",
+                "[connection]\nid=bond0\nuuid=4d7e2b5c-1a3f-4e6b-9c8d-0f1e2d3c4b5a\n\
+                 interface-name=bond0\ntype=bond\n\n\
+                 [bond]\nmiimon=140\nmode=active-backup\n\n\
+                 [ipv4]\nmethod=auto\nignore-auto-dns=true\n\n\
+                 [ipv6]\nmethod=disabled\n",
+            ),
+            (
+                "eth1",
+                "[connection]\nid=eth1\ninterface-name=eth1\ntype=ethernet\n\
+                 controller=4d7e2b5c-1a3f-4e6b-9c8d-0f1e2d3c4b5a\nport-type=bond\n",
+            ),
+            (
+                "bond0.1365",
+                "[connection]\nid=bond0.1365\ninterface-name=bond0.1365\ntype=vlan\n\n\
+                 [vlan]\nflags=0\nid=1365\nparent=bond0\n\n\
+                 [ipv4]\nmethod=disabled\n\n[ipv6]\nmethod=link-local\n",
+            ),
+            (
+                "lo",
+                "[connection]\nid=lo\ninterface-name=lo\ntype=loopback\n",
+            ),
+            (
+                "bond0@dhcp",
+                "[connection]\nid=bond0@dhcp\ninterface-name=bond0\ntype=bond\n",
+            ),
+        ]);
+
+        let files = to_networkd(&keyfiles).unwrap();
+        let names: Vec<&str> = files.iter().map(|(name, _)| name.as_str()).collect();
+        assert_eq!(
+            names,
+            [
+                "10-bond0.netdev",
+                "10-bond0.1365.netdev",
+                "10-bond0.network",
+                "10-bond0.1365.network",
+                "10-eth1.network"
+            ]
+        );
+
+        assert_eq!(
+            files[1].1,
+            "[NetDev]\nName=bond0.1365\nKind=vlan\n\n[VLAN]\nId=1365\n"
+        );
+        assert_eq!(
+            files[0].1,
+            "[NetDev]\nName=bond0\nKind=bond\n\n[Bond]\nMIIMonitorSec=140ms\nMode=active-backup\n"
+        );
+        assert_eq!(
+            files[3].1,
+            "[Match]\nName=bond0.1365\n\n[Network]\nIPv6AcceptRA=no\n"
+        );
+        assert_eq!(
+            files[2].1,
+            "[Match]\nName=bond0\n\n\
+             [Network]\nDHCP=ipv4\nLinkLocalAddressing=no\nIPv6AcceptRA=no\nVLAN=bond0.1365\n\n\
+             [DHCPv4]\nUseDNS=no\n"
+        );
+        assert_eq!(
+            files[4].1,
+            "[Match]\nName=eth1\n\n[Network]\nLinkLocalAddressing=no\nIPv6AcceptRA=no\nBond=bond0\n"
+        );
+    }
+
+    #[test]
+    fn convert_fails() {
+        let bridge = keyfiles(&[(
+            "br0",
+            "[connection]\nid=br0\ninterface-name=br0\ntype=vlan\n\n[vlan]\nid=10\nparent=eth0\n",
+        )]);
+        assert_eq!(
+            to_networkd(&bridge).unwrap_err().to_string(),
+            "Parent 'eth0' of VLAN 'br0' has no connection"
+        );
+
+        let wifi = keyfiles(&[("wlan0", "[connection]\ninterface-name=wlan0\ntype=wifi\n")]);
+        assert!(to_networkd(&wifi)
+            .unwrap_err()
+            .to_string()
+            .contains("'wifi'"));
+
+        let unnamed = keyfiles(&[("eth0", "[connection]\ntype=ethernet\n")]);
+        assert_eq!(
+            to_networkd(&unnamed).unwrap_err().to_string(),
+            "Connection 'eth0' has no interface name"
+        );
+    }
+}
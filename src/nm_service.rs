@@ -0,0 +1,138 @@
+use std::fs;
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+use std::process::Command;
+
+use anyhow::{anyhow, Context};
+use log::{info, warn};
+
+use crate::deadline;
+
+const NM_UNIT: &str = "NetworkManager.service";
+/// Present in the initrd, e.g. while combustion applies the config before switching to the real root.
+pub(crate) const INITRD_RELEASE: &str = "/etc/initrd-release";
+
+/// What is done to the running NetworkManager after the connection files were stored.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub(crate) enum ServiceAction {
+    /// Only report whether it is active.
+    #[default]
+    Check,
+    /// Reload its config and connection files, which take effect the next time the connections are activated.
+    Reload,
+    /// Restart it, activating the connections right away.
+    Restart,
+}
+
+/// Check whether NetworkManager is active and reload or restart it if asked to, so that the changed files
+/// take effect.
+///
+/// Nothing is done in the initrd, including the chroot combustion runs its script in on first boot, or if
+/// NetworkManager is not active, since it picks up the files once it starts. Failing to check its state is only
+/// reported, while failing to reload or restart it fails the run.
+///
+/// Returns whether NetworkManager was reloaded or restarted.
+pub(crate) fn activate_config(
+    action: ServiceAction,
+    changed: bool,
+    initrd_release: &str,
+) -> Result<bool, anyhow::Error> {
+    if Path::new(initrd_release).exists() || in_chroot() {
+        info!("Running in the initrd, NetworkManager picks up the config once it starts on the real root");
+        return Ok(false);
+    }
+
+    let active = match is_active() {
+        Ok(active) => active,
+        Err(err) => {
+            warn!("Checking whether NetworkManager is active: {err:#}");
+            return Ok(false);
+        }
+    };
+    if !active {
+        info!("NetworkManager is not active, it picks up the config once it starts");
+        return Ok(false);
+    }
+
+    match unit_command(action, changed) {
+        Some(command) => {
+            let status = deadline::status(Command::new("systemctl").args([command, NM_UNIT]))
+                .context("Running systemctl")?;
+            if !status.success() {
+                return Err(anyhow!(
+                    "systemctl {command} {NM_UNIT} exited with {status}"
+                ));
+            }
+            info!("Ran systemctl {command} {NM_UNIT}");
+            Ok(true)
+        }
+        None if changed => {
+            info!("NetworkManager is active, the changed files take effect once it reloads or restarts");
+            Ok(false)
+        }
+        None => {
+            info!("NetworkManager is active, no files changed");
+            Ok(false)
+        }
+    }
+}
+
+/// Returns the `systemctl` command applying the changed files to the running NetworkManager, if any.
+fn unit_command(action: ServiceAction, changed: bool) -> Option<&'static str> {
+    if !changed {
+        return None;
+    }
+
+    match action {
+        ServiceAction::Check => None,
+        ServiceAction::Reload => Some("reload"),
+        ServiceAction::Restart => Some("restart"),
+    }
+}
+
+/// Returns whether the process runs in a chroot, i.e. its root differs from the one of PID 1.
+/// Assumes it does not if the root of PID 1 can not be inspected.
+fn in_chroot() -> bool {
+    match (fs::metadata("/"), fs::metadata("/proc/1/root")) {
+        (Ok(root), Ok(init_root)) => root.dev() != init_root.dev() || root.ino() != init_root.ino(),
+        _ => false,
+    }
+}
+
+/// Returns whether the NetworkManager unit is active according to systemd.
+fn is_active() -> Result<bool, anyhow::Error> {
+    let status =
+        deadline::status(Command::new("systemctl").args(["is-active", "--quiet", NM_UNIT]))
+            .context("Running systemctl")?;
+
+    Ok(status.success())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use crate::nm_service::{activate_config, unit_command, ServiceAction};
+
+    #[test]
+    fn unit_commands() {
+        assert_eq!(unit_command(ServiceAction::Reload, true), Some("reload"));
+        assert_eq!(unit_command(ServiceAction::Restart, true), Some("restart"));
+        assert_eq!(unit_command(ServiceAction::Check, true), None);
+        // Nothing to pick up
+        assert_eq!(unit_command(ServiceAction::Restart, false), None);
+    }
+
+    #[test]
+    fn activate_config_in_initrd() {
+        let initrd_release = "_nm_service_initrd-release";
+        fs::write(initrd_release, "NAME=\"dracut\"\n").unwrap();
+
+        // systemd is never asked in the initrd
+        assert!(!activate_config(ServiceAction::Restart, true, initrd_release).unwrap());
+
+        // cleanup
+        fs::remove_file(Path::new(initrd_release)).unwrap();
+    }
+}
@@ -0,0 +1,248 @@
+use std::fmt;
+use std::process::Command;
+
+use anyhow::anyhow;
+use log::{debug, info, warn};
+
+use crate::apply_conf::ConnectionFile;
+use crate::deadline;
+use crate::keyfile::Keyfile;
+
+/// Keyfile settings along with the NetworkManager version introducing them. Older versions silently ignore
+/// unknown keys, so that e.g. a port referring to its bond via `controller` is never attached to it.
+/// Keys ending with `*` cover all keys with that prefix.
+const SETTINGS: [(&str, &str, Version); 22] = [
+    ("connection", "controller", Version(1, 46, 0)),
+    ("connection", "port-type", Version(1, 46, 0)),
+    ("connection", "autoconnect-ports", Version(1, 46, 0)),
+    ("connection", "mptcp-flags", Version(1, 40, 0)),
+    ("match", "kernel-command-line", Version(1, 26, 0)),
+    ("match", "driver", Version(1, 26, 0)),
+    ("match", "path", Version(1, 26, 0)),
+    ("veth", "peer", Version(1, 30, 0)),
+    ("ethernet", "accept-all-mac-addresses", Version(1, 32, 0)),
+    ("ethtool", "coalesce-*", Version(1, 26, 0)),
+    ("ethtool", "ring-*", Version(1, 26, 0)),
+    ("ethtool", "pause-*", Version(1, 32, 0)),
+    ("ipv4", "required-timeout", Version(1, 34, 0)),
+    ("ipv4", "link-local", Version(1, 40, 0)),
+    ("ipv4", "dhcp-iaid", Version(1, 42, 0)),
+    ("ipv4", "replace-local-rule", Version(1, 44, 0)),
+    ("ipv4", "dhcp-dscp", Version(1, 46, 0)),
+    ("ipv6", "mtu", Version(1, 40, 0)),
+    ("vlan", "protocol", Version(1, 42, 0)),
+    ("link", "*", Version(1, 44, 0)),
+    ("hsr", "*", Version(1, 46, 0)),
+    ("sriov", "total-vfs", Version(1, 14, 0)),
+];
+
+/// Name of the NetworkManager package in the rpm and dpkg databases.
+const RPM_PACKAGE: &str = "NetworkManager";
+const DPKG_PACKAGE: &str = "network-manager";
+
+/// How settings unsupported by the installed NetworkManager are handled.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub(crate) enum Compatibility {
+    /// Report them and store the connection files anyway.
+    #[default]
+    Warn,
+    /// Fail the run before storing the connection files.
+    Fail,
+    /// Do not detect the version at all.
+    Skip,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub(crate) struct Version(u32, u32, u32);
+
+impl Version {
+    /// Parses the leading `major.minor.micro` of versions such as `1.44.2-150600.1.1` or `1.42.4-1ubuntu2`,
+    /// skipping a Debian epoch.
+    pub(crate) fn parse(version: &str) -> Option<Self> {
+        let version = version.trim();
+        let version = version
+            .split_once(':')
+            .map_or(version, |(_, version)| version);
+        let mut parts = version.split(|c: char| !c.is_ascii_digit()).map(str::parse);
+
+        Some(Version(
+            parts.next()?.ok()?,
+            parts.next()?.ok()?,
+            parts.next().and_then(Result::ok).unwrap_or(0),
+        ))
+    }
+}
+
+impl fmt::Display for Version {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}.{}.{}", self.0, self.1, self.2)
+    }
+}
+
+/// Detect the version of the installed NetworkManager from the rpm or dpkg database, or by asking the running
+/// daemon over D-Bus on systems using neither.
+pub(crate) fn detect_version() -> Option<Version> {
+    let queries: [(&str, &[&str]); 3] = [
+        (
+            "rpm",
+            &["--query", "--queryformat", "%{VERSION}", RPM_PACKAGE],
+        ),
+        (
+            "dpkg-query",
+            &["--show", "--showformat", "${Version}", DPKG_PACKAGE],
+        ),
+        (
+            "busctl",
+            &[
+                "get-property",
+                "org.freedesktop.NetworkManager",
+                "/org/freedesktop/NetworkManager",
+                "org.freedesktop.NetworkManager",
+                "Version",
+            ],
+        ),
+    ];
+
+    for (program, args) in queries {
+        let output = match deadline::output(Command::new(program).args(args)) {
+            Ok(output) if output.status.success() => output,
+            Ok(output) => {
+                debug!("{program} exited with {}", output.status);
+                continue;
+            }
+            Err(err) => {
+                debug!("Running {program}: {err:#}");
+                continue;
+            }
+        };
+
+        // busctl prints the type along with the value, e.g. `s "1.44.2"`.
+        let stdout = String::from_utf8_lossy(&output.stdout);
+        let value = stdout.trim().trim_start_matches("s ").trim_matches('"');
+        if let Some(version) = Version::parse(value) {
+            debug!("Detected NetworkManager {version} via {program}");
+            return Some(version);
+        }
+    }
+
+    None
+}
+
+/// Returns the settings of the connection files unsupported by the given NetworkManager version,
+/// e.g. `eth0: connection.controller (1.46.0)`.
+fn unsupported_settings(connection_files: &[ConnectionFile], version: Version) -> Vec<String> {
+    let mut unsupported = Vec::new();
+
+    for file in connection_files {
+        let keyfile = Keyfile::parse(&file.contents);
+        for (section, key, introduced) in SETTINGS {
+            if introduced <= version {
+                continue;
+            }
+
+            let prefix = key.strip_suffix('*');
+            for (name, _) in keyfile.entries(section) {
+                if prefix.map_or(name == key, |prefix| name.starts_with(prefix)) {
+                    unsupported.push(format!("{}: {section}.{name} ({introduced})", file.name));
+                }
+            }
+        }
+    }
+
+    unsupported
+}
+
+/// Check the connection files for settings the installed NetworkManager does not support yet, which it would
+/// silently ignore. Nothing is checked if the version can not be detected.
+pub(crate) fn check_compatibility(
+    connection_files: &[ConnectionFile],
+    version: Option<Version>,
+    compatibility: Compatibility,
+) -> Result<(), anyhow::Error> {
+    let Some(version) = version else {
+        info!("NetworkManager version unknown, skipping the compatibility check");
+        return Ok(());
+    };
+
+    let unsupported = unsupported_settings(connection_files, version);
+    if unsupported.is_empty() {
+        return Ok(());
+    }
+
+    match compatibility {
+        Compatibility::Fail => Err(anyhow!(
+            "Settings unsupported by NetworkManager {version}: {}",
+            unsupported.join(", ")
+        )),
+        _ => {
+            for setting in unsupported {
+                warn!("Setting unsupported by NetworkManager {version} will be ignored: {setting}");
+            }
+            Ok(())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::apply_conf::ConnectionFile;
+    use crate::nm_version::{check_compatibility, unsupported_settings, Compatibility, Version};
+
+    #[test]
+    fn parse_versions() {
+        assert_eq!(Version::parse("1.44.2"), Some(Version(1, 44, 2)));
+        assert_eq!(
+            Version::parse("1.44.2-150600.1.1\n"),
+            Some(Version(1, 44, 2))
+        );
+        assert_eq!(Version::parse("1.42.4-1ubuntu2"), Some(Version(1, 42, 4)));
+        assert_eq!(Version::parse("1:1.36.6-0ubuntu2"), Some(Version(1, 36, 6)));
+        assert_eq!(Version::parse("1.46"), Some(Version(1, 46, 0)));
+        assert_eq!(
+            Version::parse("package NetworkManager is not installed"),
+            None
+        );
+        assert_eq!(Version(1, 44, 2).to_string(), "1.44.2");
+        assert!(Version(1, 9, 0) < Version(1, 44, 0));
+    }
+
+    #[test]
+    fn check_unsupported_settings() {
+        let files = vec![
+            ConnectionFile {
+                name: "eth0".to_string(),
+                contents: "[connection]\nid=eth0\ncontroller=bond0\nport-type=bond\n\n\
+                           [ethtool]\nring-rx=1024\nfeature-tso=true\npause-rx=true\n"
+                    .to_string(),
+            },
+            ConnectionFile {
+                name: "bond0".to_string(),
+                contents: "[connection]\nid=bond0\n\n[link]\ngso-max-size=65536\n".to_string(),
+            },
+        ];
+
+        assert_eq!(
+            unsupported_settings(&files, Version(1, 46, 0)),
+            Vec::<String>::new()
+        );
+        assert_eq!(
+            unsupported_settings(&files, Version(1, 42, 0)),
+            vec![
+                "eth0: connection.controller (1.46.0)",
+                "eth0: connection.port-type (1.46.0)",
+                "bond0: link.gso-max-size (1.44.0)",
+            ]
+        );
+        assert_eq!(unsupported_settings(&files, Version(1, 30, 0)).len(), 4);
+
+        check_compatibility(&files, Some(Version(1, 42, 0)), Compatibility::Warn).unwrap();
+        check_compatibility(&files, None, Compatibility::Fail).unwrap();
+        assert_eq!(
+            check_compatibility(&files, Some(Version(1, 44, 0)), Compatibility::Fail)
+                .unwrap_err()
+                .to_string(),
+            "Settings unsupported by NetworkManager 1.44.0: eth0: connection.controller (1.46.0), \
+             eth0: connection.port-type (1.46.0)"
+        );
+    }
+}
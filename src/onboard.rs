@@ -0,0 +1,222 @@
+use std::collections::BTreeMap;
+use std::fs;
+use std::io::{self, IsTerminal, Write};
+use std::path::Path;
+use std::process::Command;
+
+use anyhow::{anyhow, Context};
+use log::info;
+use network_interface::NetworkInterface;
+
+use crate::apply_conf::local_nics;
+use crate::expand::{expand_vars, referenced_vars};
+use crate::yaml;
+
+const HOSTNAME_VAR: &str = "NMC_HOSTNAME";
+const ROLE_VAR: &str = "NMC_ROLE";
+const SITE_VAR: &str = "NMC_SITE";
+
+pub(crate) struct OnboardOptions {
+    /// Desired state template referencing the onboarding variables.
+    pub(crate) template: String,
+    pub(crate) hostname: Option<String>,
+    pub(crate) role: Option<String>,
+    pub(crate) site: Option<String>,
+    /// Commits the desired state to the git repository containing the config dir and pushes it.
+    pub(crate) submit: bool,
+}
+
+/// Render the desired state of the local machine from a template and store it in the config dir,
+/// so that it is picked up by the next `generate` run.
+///
+/// The template can reference the hostname, role and site of the machine as well as the name and MAC address
+/// of each local NIC (e.g. `${NMC_NIC0_MAC}`). Values which are not passed as options are asked for
+/// if the template references them. All other references are kept for `generate` to expand.
+pub(crate) fn onboard(config_dir: &str, options: &OnboardOptions) -> Result<(), anyhow::Error> {
+    let template = fs::read_to_string(&options.template).context("Reading template")?;
+    let referenced = referenced_vars(&template)?;
+
+    let nics = local_nics()?;
+    for nic in &nics {
+        info!("Detected NIC '{}' ({:?})", nic.name, nic.mac_addr);
+    }
+
+    let hostname = answer(options.hostname.as_ref(), "Hostname", "--hostname")?;
+    let mut vars = nic_vars(&nics);
+    vars.insert(HOSTNAME_VAR.to_string(), hostname.clone());
+
+    for (name, value, question, flag) in [
+        (ROLE_VAR, &options.role, "Role", "--role"),
+        (SITE_VAR, &options.site, "Site", "--site"),
+    ] {
+        if referenced.iter().any(|r| r == name) {
+            vars.insert(name.to_string(), answer(value.as_ref(), question, flag)?);
+        }
+    }
+
+    let desired_state = render_template(&template, &vars)?;
+    yaml::from_reader::<serde_yaml::Value>(desired_state.as_bytes())
+        .context("Parsing rendered desired state")?;
+
+    let path = Path::new(config_dir).join(format!("{hostname}.yaml"));
+    if path.exists() {
+        return Err(anyhow!(
+            "Host '{hostname}' is already onboarded in {path:?}"
+        ));
+    }
+
+    fs::write(&path, desired_state).context("Writing desired state")?;
+    info!("Stored desired state of '{hostname}' in {path:?}");
+
+    if options.submit {
+        submit(config_dir, &path, &hostname).context("Submitting desired state")?;
+        info!("Submitted desired state of '{hostname}'");
+    }
+
+    Ok(())
+}
+
+/// Variables describing the NICs, numbered in the order of their names.
+fn nic_vars(nics: &[NetworkInterface]) -> BTreeMap<String, String> {
+    let mut nics: Vec<&NetworkInterface> =
+        nics.iter().filter(|nic| nic.mac_addr.is_some()).collect();
+    nics.sort_by(|a, b| a.name.cmp(&b.name));
+
+    let mut vars = BTreeMap::new();
+    for (index, nic) in nics.into_iter().enumerate() {
+        vars.insert(format!("NMC_NIC{index}_NAME"), nic.name.clone());
+        vars.insert(
+            format!("NMC_NIC{index}_MAC"),
+            nic.mac_addr.clone().unwrap_or_default(),
+        );
+    }
+
+    vars
+}
+
+/// Expand the onboarding variables in the template, keeping all other references as they are.
+fn render_template(
+    template: &str,
+    vars: &BTreeMap<String, String>,
+) -> Result<String, anyhow::Error> {
+    expand_vars(template, |name| {
+        Some(
+            vars.get(name)
+                .cloned()
+                .unwrap_or_else(|| format!("${{{name}}}")),
+        )
+    })
+}
+
+/// Returns the given value or asks for it if running in a terminal.
+fn answer(value: Option<&String>, question: &str, flag: &str) -> Result<String, anyhow::Error> {
+    if let Some(value) = value {
+        return Ok(value.clone());
+    }
+
+    let stdin = io::stdin();
+    if !stdin.is_terminal() {
+        return Err(anyhow!("{flag} is required when not running interactively"));
+    }
+
+    eprint!("{question}: ");
+    io::stderr().flush()?;
+
+    let mut line = String::new();
+    stdin.read_line(&mut line).context("Reading answer")?;
+
+    let line = line.trim();
+    if line.is_empty() {
+        return Err(anyhow!("{question} must not be empty"));
+    }
+
+    Ok(line.to_string())
+}
+
+fn submit(config_dir: &str, path: &Path, hostname: &str) -> Result<(), anyhow::Error> {
+    let file = path.file_name().unwrap_or_default();
+
+    run(git(config_dir).args(["add", "--"]).arg(file)).context("Staging desired state")?;
+    run(git(config_dir)
+        .args(["commit", "-m", &format!("Onboard host {hostname}"), "--"])
+        .arg(file))
+    .context("Committing desired state")?;
+    run(git(config_dir).arg("push")).context("Pushing desired state")
+}
+
+fn git(dir: &str) -> Command {
+    let mut command = Command::new("git");
+    command.arg("-C").arg(dir);
+    command
+}
+
+fn run(command: &mut Command) -> Result<(), anyhow::Error> {
+    let status = command.status().context("Running git")?;
+    if !status.success() {
+        return Err(anyhow!("git exited with {status}"));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+
+    use network_interface::NetworkInterface;
+
+    use crate::onboard::{answer, nic_vars, render_template};
+
+    fn nic(name: &str, mac: Option<&str>) -> NetworkInterface {
+        NetworkInterface {
+            name: name.to_string(),
+            addr: vec![],
+            mac_addr: mac.map(str::to_string),
+            index: 0,
+        }
+    }
+
+    #[test]
+    fn describe_nics() {
+        let nics = [
+            nic("eth1", Some("00:11:22:33:44:56")),
+            nic("eth0", Some("00:11:22:33:44:55")),
+            nic("eth2", None),
+        ];
+
+        assert_eq!(
+            nic_vars(&nics),
+            BTreeMap::from([
+                ("NMC_NIC0_NAME".to_string(), "eth0".to_string()),
+                ("NMC_NIC0_MAC".to_string(), "00:11:22:33:44:55".to_string()),
+                ("NMC_NIC1_NAME".to_string(), "eth1".to_string()),
+                ("NMC_NIC1_MAC".to_string(), "00:11:22:33:44:56".to_string()),
+            ])
+        );
+    }
+
+    #[test]
+    fn render_template_successfully() {
+        let vars = BTreeMap::from([
+            ("NMC_HOSTNAME".to_string(), "node1".to_string()),
+            ("NMC_NIC0_MAC".to_string(), "00:11:22:33:44:55".to_string()),
+        ]);
+
+        let template = "# ${NMC_HOSTNAME}\ninterfaces:\n- name: eth0\n  mac-address: ${NMC_NIC0_MAC}\n  vlan: ${VLAN_ID}\n  note: $$${literal}\n";
+
+        assert_eq!(
+            render_template(template, &vars).unwrap(),
+            "# node1\ninterfaces:\n- name: eth0\n  mac-address: 00:11:22:33:44:55\n  vlan: ${VLAN_ID}\n  note: $${literal}\n"
+        );
+
+        assert!(render_template("${NMC_HOSTNAME", &vars).is_err());
+    }
+
+    #[test]
+    fn answer_from_options() {
+        assert_eq!(
+            answer(Some(&"edge".to_string()), "Role", "--role").unwrap(),
+            "edge"
+        );
+    }
+}
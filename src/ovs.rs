@@ -0,0 +1,115 @@
+use std::fs;
+
+use anyhow::anyhow;
+use log::info;
+
+use crate::apply_conf::ConnectionFile;
+use crate::keyfile::Keyfile;
+
+/// Connection types handled by the openvswitch plugin of NetworkManager.
+const OVS_CONNECTION_TYPES: [&str; 3] = ["ovs-bridge", "ovs-port", "ovs-interface"];
+/// Dirs NetworkManager loads its device plugins from, each in a subdir named after its version.
+pub(crate) const NM_PLUGIN_DIRS: [&str; 4] = [
+    "/usr/lib64/NetworkManager",
+    "/usr/lib/NetworkManager",
+    "/usr/lib/x86_64-linux-gnu/NetworkManager",
+    "/usr/lib/aarch64-linux-gnu/NetworkManager",
+];
+const OVS_PLUGIN: &str = "libnm-device-plugin-ovs.so";
+
+/// Returns the names of the OVS bridge, port and interface connections among the connection files.
+fn ovs_connections(connection_files: &[ConnectionFile]) -> Vec<&str> {
+    connection_files
+        .iter()
+        .filter(|file| {
+            Keyfile::parse(&file.contents)
+                .get("connection", "type")
+                .is_some_and(|connection_type| OVS_CONNECTION_TYPES.contains(&connection_type))
+        })
+        .map(|file| file.name.as_str())
+        .collect()
+}
+
+/// Returns whether the openvswitch plugin of NetworkManager is installed in any of the plugin dirs.
+fn has_ovs_plugin(plugin_dirs: &[&str]) -> bool {
+    plugin_dirs.iter().any(|dir| {
+        fs::read_dir(dir).is_ok_and(|entries| {
+            entries
+                .flatten()
+                .any(|entry| entry.path().join(OVS_PLUGIN).exists())
+        })
+    })
+}
+
+/// Fail if some of the connections are OVS ones but the openvswitch plugin of NetworkManager is missing,
+/// in which case NetworkManager would ignore them and leave the bridges unconfigured after boot.
+pub(crate) fn check_ovs_plugin(
+    connection_files: &[ConnectionFile],
+    plugin_dirs: &[&str],
+) -> Result<(), anyhow::Error> {
+    let connections = ovs_connections(connection_files);
+    if connections.is_empty() {
+        return Ok(());
+    }
+
+    if !has_ovs_plugin(plugin_dirs) {
+        return Err(anyhow!(
+            "The openvswitch plugin of NetworkManager required by {} is not installed",
+            connections.join(", ")
+        ));
+    }
+
+    info!(
+        "Found the openvswitch plugin required by {}",
+        connections.join(", ")
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use crate::apply_conf::ConnectionFile;
+    use crate::ovs::check_ovs_plugin;
+
+    #[test]
+    fn check_ovs_plugin_of_connections() {
+        let plugin_dir = "_ovs_plugins";
+        fs::create_dir_all(Path::new(plugin_dir).join("1.44.2")).unwrap();
+
+        let file = |name: &str, connection_type: &str| ConnectionFile {
+            name: name.to_string(),
+            contents: format!("[connection]\nid={name}\ntype={connection_type}\n"),
+        };
+        let mut files = vec![file("eth0", "ethernet"), file("eth1", "ethernet")];
+
+        // Connections without OVS ones need no plugin
+        check_ovs_plugin(&files, &[plugin_dir]).unwrap();
+
+        files.extend([
+            file("br0-br", "ovs-bridge"),
+            file("eth1-port", "ovs-port"),
+            file("br0-if", "ovs-interface"),
+        ]);
+        assert_eq!(
+            check_ovs_plugin(&files, &[plugin_dir])
+                .unwrap_err()
+                .to_string(),
+            "The openvswitch plugin of NetworkManager required by br0-br, eth1-port, br0-if is not installed"
+        );
+
+        fs::write(
+            Path::new(plugin_dir)
+                .join("1.44.2")
+                .join("libnm-device-plugin-ovs.so"),
+            "",
+        )
+        .unwrap();
+        check_ovs_plugin(&files, &["_ovs_missing", plugin_dir]).unwrap();
+
+        // cleanup
+        fs::remove_dir_all(plugin_dir).unwrap();
+    }
+}
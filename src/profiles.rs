@@ -0,0 +1,192 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use anyhow::Context;
+
+use crate::filesystem::Disk;
+use crate::keyfile::{is_keyfile, Keyfile};
+use crate::state::State;
+
+const COLUMNS: [&str; 6] = ["NAME", "UUID", "TYPE", "DEVICE", "FILE", "MANAGED-BY-NMC"];
+const MISSING_VALUE: &str = "--";
+
+#[derive(Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+struct Profile {
+    name: String,
+    uuid: String,
+    connection_type: String,
+    device: String,
+    file: PathBuf,
+    managed: bool,
+}
+
+/// Print the connection profiles stored in `connections_dir` in an nmcli-like table.
+///
+/// Reads the files directly, so it works regardless of whether NetworkManager is running.
+pub(crate) fn print_profiles(connections_dir: &str, state_file: &str) -> Result<(), anyhow::Error> {
+    let state = State::load(&Disk, state_file)?.unwrap_or_default();
+    let profiles = read_profiles(connections_dir, &state)?;
+
+    print!("{}", format_table(&profiles));
+
+    Ok(())
+}
+
+fn read_profiles(connections_dir: &str, state: &State) -> Result<Vec<Profile>, anyhow::Error> {
+    let dir = Path::new(connections_dir);
+    if !dir.exists() {
+        return Ok(Vec::new());
+    }
+
+    let mut profiles = Vec::new();
+
+    for entry in fs::read_dir(dir).context("Reading connections dir")? {
+        let path = entry?.path();
+        if !is_keyfile(&path) {
+            continue;
+        }
+
+        let contents = fs::read_to_string(&path).context("Reading connection file")?;
+        let keyfile = Keyfile::parse(&contents);
+        let value = |key: &str| {
+            keyfile
+                .get("connection", key)
+                .unwrap_or(MISSING_VALUE)
+                .to_string()
+        };
+
+        profiles.push(Profile {
+            name: value("id"),
+            uuid: value("uuid"),
+            connection_type: value("type"),
+            device: value("interface-name"),
+            managed: state.manages(&path),
+            file: path,
+        });
+    }
+
+    profiles.sort_by(|a, b| a.name.cmp(&b.name).then_with(|| a.file.cmp(&b.file)));
+
+    Ok(profiles)
+}
+
+fn format_table(profiles: &[Profile]) -> String {
+    let rows: Vec<[String; 6]> = profiles
+        .iter()
+        .map(|p| {
+            [
+                p.name.clone(),
+                p.uuid.clone(),
+                p.connection_type.clone(),
+                p.device.clone(),
+                p.file.display().to_string(),
+                if p.managed { "yes" } else { "no" }.to_string(),
+            ]
+        })
+        .collect();
+
+    let mut widths = COLUMNS.map(str::len);
+    for row in &rows {
+        for (width, value) in widths.iter_mut().zip(row) {
+            *width = (*width).max(value.len());
+        }
+    }
+
+    let format_row = |values: &[&str]| {
+        let line = values
+            .iter()
+            .zip(widths)
+            .map(|(value, width)| format!("{value:width$}"))
+            .collect::<Vec<_>>()
+            .join("  ");
+
+        format!("{}\n", line.trim_end())
+    };
+
+    let mut table = format_row(&COLUMNS);
+    for row in &rows {
+        let values: Vec<&str> = row.iter().map(String::as_str).collect();
+        table.push_str(&format_row(&values));
+    }
+
+    table
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::path::PathBuf;
+
+    use crate::profiles::{format_table, read_profiles, Profile};
+    use crate::state::State;
+
+    #[test]
+    fn read_profiles_successfully() {
+        let state = State {
+            hostname: "node1".to_string(),
+            connection_files: vec![PathBuf::from("testdata/apply/node1/eth0.nmconnection")],
+            checksums: BTreeMap::new(),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        };
+
+        let profiles = read_profiles("testdata/apply/node1", &state).unwrap();
+
+        assert_eq!(profiles.len(), 5);
+        assert_eq!(
+            profiles[0],
+            Profile {
+                name: "bond0".to_string(),
+                uuid: "925b4a95-2de0-5b2d-bcf5-8b684a7e9cb4".to_string(),
+                connection_type: "bond".to_string(),
+                device: "bond0".to_string(),
+                file: PathBuf::from("testdata/apply/node1/bond0.nmconnection"),
+                managed: false,
+            }
+        );
+        assert_eq!(
+            profiles[1],
+            Profile {
+                name: "eth0".to_string(),
+                uuid: "4fd00f34-9191-481c-b931-caa24dae871a".to_string(),
+                connection_type: "ethernet".to_string(),
+                device: "eth0".to_string(),
+                file: PathBuf::from("testdata/apply/node1/eth0.nmconnection"),
+                managed: true,
+            }
+        );
+
+        assert!(read_profiles("<missing>", &state).unwrap().is_empty());
+    }
+
+    #[test]
+    fn format_profiles_table() {
+        let profiles = vec![
+            Profile {
+                name: "eth0".to_string(),
+                uuid: "4fd00f34-9191-481c-b931-caa24dae871a".to_string(),
+                connection_type: "ethernet".to_string(),
+                device: "eth0".to_string(),
+                file: PathBuf::from("/etc/eth0.nmconnection"),
+                managed: true,
+            },
+            Profile {
+                name: "manual".to_string(),
+                uuid: "--".to_string(),
+                connection_type: "vlan".to_string(),
+                device: "eth0.1365".to_string(),
+                file: PathBuf::from("/etc/manual.nmconnection"),
+                managed: false,
+            },
+        ];
+
+        assert_eq!(
+            format_table(&profiles),
+            r#"NAME    UUID                                  TYPE      DEVICE     FILE                      MANAGED-BY-NMC
+eth0    4fd00f34-9191-481c-b931-caa24dae871a  ethernet  eth0       /etc/eth0.nmconnection    yes
+manual  --                                    vlan      eth0.1365  /etc/manual.nmconnection  no
+"#
+        );
+    }
+}
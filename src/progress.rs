@@ -0,0 +1,122 @@
+use std::fs;
+use std::io::{self, Write};
+use std::os::fd::{FromRawFd, RawFd};
+use std::os::unix::net::UnixStream;
+use std::path::Path;
+use std::sync::{Mutex, OnceLock};
+
+use log::debug;
+use serde::Serialize;
+
+/// Destination of the progress events, e.g. the pipe or socket of an installer rendering its own UI.
+static SINK: OnceLock<Mutex<Box<dyn Write + Send>>> = OnceLock::new();
+
+/// Progress of a run, emitted as a single line JSON object.
+#[derive(Serialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct Event<'a> {
+    pub(crate) phase: &'a str,
+    pub(crate) percent: u8,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) file: Option<&'a Path>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) error: Option<String>,
+}
+
+impl<'a> Event<'a> {
+    pub(crate) fn new(phase: &'a str, percent: u8) -> Self {
+        Event {
+            phase,
+            percent,
+            file: None,
+            error: None,
+        }
+    }
+}
+
+/// Emit the progress events to the already open file descriptor (e.g. passed by the parent process).
+pub(crate) fn to_fd(fd: RawFd) -> io::Result<()> {
+    // Fail early for descriptors which were not passed, rather than on the first event.
+    if unsafe { libc::fcntl(fd, libc::F_GETFD) } == -1 {
+        return Err(io::Error::last_os_error());
+    }
+
+    let file = unsafe { fs::File::from_raw_fd(fd) };
+    set_sink(Box::new(file));
+
+    Ok(())
+}
+
+/// Emit the progress events to the stream socket listening at the given path.
+pub(crate) fn to_socket(path: &str) -> io::Result<()> {
+    let stream = UnixStream::connect(path)?;
+    set_sink(Box::new(stream));
+
+    Ok(())
+}
+
+fn set_sink(sink: Box<dyn Write + Send>) {
+    let _ = SINK.set(Mutex::new(sink));
+}
+
+/// Emit the event if a destination is set up. Failures are only logged, so that a closed
+/// consumer never fails the run.
+pub(crate) fn emit(event: Event) {
+    let Some(sink) = SINK.get() else {
+        return;
+    };
+
+    let mut sink = match sink.lock() {
+        Ok(sink) => sink,
+        Err(poisoned) => poisoned.into_inner(),
+    };
+
+    if let Err(err) = write_event(&mut *sink, &event) {
+        debug!("Failed to emit progress event: {err}");
+    }
+}
+
+fn write_event(writer: &mut dyn Write, event: &Event) -> io::Result<()> {
+    let mut line = serde_json::to_vec(event)?;
+    line.push(b'\n');
+
+    writer.write_all(&line)?;
+    writer.flush()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::Path;
+
+    use crate::progress::{write_event, Event};
+
+    #[test]
+    fn write_events_as_ndjson() {
+        let mut output = Vec::new();
+
+        write_event(&mut output, &Event::new("identify", 10)).unwrap();
+        write_event(
+            &mut output,
+            &Event {
+                file: Some(Path::new("/etc/eth0.nmconnection")),
+                ..Event::new("store", 75)
+            },
+        )
+        .unwrap();
+        write_event(
+            &mut output,
+            &Event {
+                error: Some("Parsing config: missing field".to_string()),
+                ..Event::new("failed", 100)
+            },
+        )
+        .unwrap();
+
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "{\"phase\":\"identify\",\"percent\":10}\n\
+             {\"phase\":\"store\",\"percent\":75,\"file\":\"/etc/eth0.nmconnection\"}\n\
+             {\"phase\":\"failed\",\"percent\":100,\"error\":\"Parsing config: missing field\"}\n"
+        );
+    }
+}
@@ -0,0 +1,344 @@
+use std::env;
+use std::fs;
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+use anyhow::{anyhow, Context};
+use log::{error, info};
+use network_interface::NetworkInterface;
+use serde::Deserialize;
+
+use crate::apply_conf::{find_host, parse_config, MatchOptions};
+use crate::bundle::Compression;
+use crate::infiniband::{is_infiniband_address, normalize_address};
+use crate::serve::host_archive;
+use crate::workspace::Workspace;
+use crate::yaml;
+
+/// Dir within the temporary dir holding the workspace of the push.
+const WORKSPACES_DIR: &str = "nmc-push";
+/// Seconds to wait for a machine to accept the connection.
+const CONNECT_TIMEOUT: u64 = 30;
+/// Seconds of silence after which an established connection is probed. It is dropped after three unanswered probes,
+/// so that an unreachable machine never hangs the push.
+const SERVER_ALIVE_INTERVAL: u64 = 15;
+
+/// Options of applying the config to the machines of an inventory over SSH.
+pub(crate) struct PushOptions {
+    /// YAML file listing the machines.
+    pub(crate) inventory: String,
+    /// Path of the `nmc` binary on the machines.
+    pub(crate) remote_nmc: String,
+    /// Reload NetworkManager on the machines once the config is applied.
+    pub(crate) reload: bool,
+    /// Compression of the archives uploaded to the machines.
+    pub(crate) compression: Compression,
+    /// How the hosts are identified by the NICs of the machines.
+    pub(crate) matching: MatchOptions,
+}
+
+/// Machine of the inventory, e.g.
+///
+/// ```yaml
+/// - address: root@192.168.1.10
+///   port: 2222
+///   identity_file: ~/.ssh/lab
+/// ```
+#[derive(Deserialize, Debug, PartialEq)]
+#[serde(deny_unknown_fields)]
+struct Machine {
+    /// SSH destination, `[user@]host`.
+    address: String,
+    #[serde(default)]
+    port: Option<u16>,
+    #[serde(default)]
+    identity_file: Option<String>,
+}
+
+/// Interface of a machine as listed by `nmc inspect --output json` on it.
+#[derive(Deserialize, Debug)]
+struct RemoteInterface {
+    name: String,
+    mac_address: Option<String>,
+    permanent_address: Option<String>,
+    considered: bool,
+}
+
+/// Apply the config to each machine of the inventory over SSH.
+///
+/// The host of each machine is identified by the MAC addresses of its interfaces, and only the files of that host
+/// are uploaded and applied by the `nmc` binary of the machine. Machines failing to apply the config are reported
+/// once all others were handled.
+pub(crate) fn push(config_dir: &str, options: &PushOptions) -> Result<(), anyhow::Error> {
+    let machines = load_inventory(&options.inventory)?;
+    if machines.is_empty() {
+        return Err(anyhow!("Inventory does not list any machines"));
+    }
+
+    let workspace = Workspace::create(&env::temp_dir().join(WORKSPACES_DIR))?;
+    let mut failed = Vec::new();
+
+    for machine in &machines {
+        match push_machine(config_dir, machine, options, &workspace) {
+            Ok(hostname) => info!("Applied config of host '{hostname}' to {}", machine.address),
+            Err(err) => {
+                error!("Pushing config to {} failed: {err:#}", machine.address);
+                failed.push(machine.address.as_str());
+            }
+        }
+    }
+
+    if !failed.is_empty() {
+        return Err(anyhow!(
+            "Pushing config failed for {} of {} machine(s): {}",
+            failed.len(),
+            machines.len(),
+            failed.join(", ")
+        ));
+    }
+
+    Ok(())
+}
+
+fn load_inventory(path: &str) -> Result<Vec<Machine>, anyhow::Error> {
+    let file = fs::File::open(path).context("Opening inventory")?;
+    yaml::from_reader(file).context("Parsing inventory")
+}
+
+/// Apply the config to the machine, returning the hostname it was identified as.
+fn push_machine(
+    config_dir: &str,
+    machine: &Machine,
+    options: &PushOptions,
+    workspace: &Workspace,
+) -> Result<String, anyhow::Error> {
+    info!("Identifying {}...", machine.address);
+    let output = ssh(machine)
+        .arg(format!(
+            "{} inspect --output json",
+            shell_quote(&options.remote_nmc)
+        ))
+        .output()
+        .context("Running ssh")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "Listing interfaces failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    let nics = remote_nics(&output.stdout)?;
+
+    let hosts =
+        parse_config(config_dir, options.matching.allow_shared_macs).context("Parsing config")?;
+    let host = find_host(hosts, &nics, None, &options.matching)?;
+    info!("Identified {} as host '{}'", machine.address, host.hostname);
+
+    let archive = host_archive(config_dir, &host, options.compression, workspace)?;
+
+    let mut child = ssh(machine)
+        .arg(apply_script(
+            &options.remote_nmc,
+            options.reload,
+            options.compression,
+        ))
+        .stdin(Stdio::piped())
+        .spawn()
+        .context("Running ssh")?;
+    child
+        .stdin
+        .take()
+        .ok_or_else(|| anyhow!("Opening ssh input"))?
+        .write_all(&archive)
+        .context("Uploading config")?;
+
+    let status = child.wait().context("Running ssh")?;
+    if !status.success() {
+        return Err(anyhow!("Applying config exited with {status}"));
+    }
+
+    Ok(host.hostname)
+}
+
+fn ssh(machine: &Machine) -> Command {
+    let mut command = Command::new("ssh");
+    // Never prompt, the machines are handled one after the other without anyone watching.
+    command.args(["-o", "BatchMode=yes"]);
+    command
+        .arg("-o")
+        .arg(format!("ConnectTimeout={CONNECT_TIMEOUT}"));
+    command
+        .arg("-o")
+        .arg(format!("ServerAliveInterval={SERVER_ALIVE_INTERVAL}"));
+    if let Some(port) = machine.port {
+        command.arg("-p").arg(port.to_string());
+    }
+    if let Some(identity_file) = &machine.identity_file {
+        command.arg("-i").arg(identity_file);
+    }
+    command.arg(&machine.address);
+    command
+}
+
+/// Returns the NICs of the machine considered for identifying it, along with the addresses `apply` identifies it by,
+/// i.e. the permanent MAC addresses where available and the GUIDs of InfiniBand NICs.
+fn remote_nics(output: &[u8]) -> Result<Vec<NetworkInterface>, anyhow::Error> {
+    let interfaces: Vec<RemoteInterface> =
+        serde_json::from_slice(output).context("Parsing interfaces")?;
+
+    Ok(interfaces
+        .into_iter()
+        .filter(|interface| interface.considered)
+        .map(|interface| {
+            let address = match interface.mac_address {
+                Some(address) if is_infiniband_address(&address) => Some(address),
+                address => interface.permanent_address.or(address),
+            };
+
+            NetworkInterface {
+                name: interface.name,
+                mac_addr: address.map(|address| normalize_address(&address)),
+                addr: vec![],
+                index: 0,
+            }
+        })
+        .collect())
+}
+
+/// Returns the script extracting the uploaded archive read from stdin and applying it on the remote machine.
+fn apply_script(remote_nmc: &str, reload: bool, compression: Compression) -> String {
+    let network_manager = if reload { "reload" } else { "check" };
+    format!(
+        "set -e\n\
+         dir=$(mktemp -d)\n\
+         trap 'rm -rf \"$dir\"' EXIT\n\
+         tar --extract {} -C \"$dir\"\n\
+         {} apply --config-dir \"$dir\" --network-manager {network_manager}\n",
+        compression.tar_flag(),
+        shell_quote(remote_nmc)
+    )
+}
+
+fn shell_quote(value: &str) -> String {
+    format!("'{}'", value.replace('\'', "'\\''"))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+
+    use crate::bundle::Compression;
+    use crate::push::{apply_script, load_inventory, remote_nics, shell_quote, ssh, Machine};
+
+    #[test]
+    fn load_machines_of_inventory() {
+        let path = "_inventory.yaml";
+        // JSON is valid YAML
+        fs::write(
+            path,
+            r#"[{"address": "root@192.168.1.10"}, {"address": "lab2", "port": 2222, "identity_file": "lab.key"}]"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            load_inventory(path).unwrap(),
+            vec![
+                Machine {
+                    address: "root@192.168.1.10".to_string(),
+                    port: None,
+                    identity_file: None,
+                },
+                Machine {
+                    address: "lab2".to_string(),
+                    port: Some(2222),
+                    identity_file: Some("lab.key".to_string()),
+                },
+            ]
+        );
+
+        fs::write(path, r#"[{"address": "lab2", "user": "root"}]"#).unwrap();
+        assert!(load_inventory(path).is_err());
+
+        // cleanup
+        fs::remove_file(path).unwrap();
+    }
+
+    #[test]
+    fn build_ssh_command() {
+        let machine = Machine {
+            address: "root@lab2".to_string(),
+            port: Some(2222),
+            identity_file: Some("lab.key".to_string()),
+        };
+
+        let command = ssh(&machine);
+        let args: Vec<&str> = command
+            .get_args()
+            .map(|arg| arg.to_str().unwrap())
+            .collect();
+        assert_eq!(
+            args,
+            vec![
+                "-o",
+                "BatchMode=yes",
+                "-o",
+                "ConnectTimeout=30",
+                "-o",
+                "ServerAliveInterval=15",
+                "-p",
+                "2222",
+                "-i",
+                "lab.key",
+                "root@lab2"
+            ]
+        );
+    }
+
+    #[test]
+    fn parse_remote_nics() {
+        // JSON of `nmc inspect --output json`
+        let output = r#"[
+            {"name": "bond0", "mac_address": "00:11:22:33:44:55", "permanent_address": null, "driver": null, "state": "up", "considered": false},
+            {"name": "eth0", "mac_address": "00:11:22:33:44:55", "permanent_address": "00:11:22:33:44:55", "driver": "ixgbe", "state": "up", "considered": true},
+            {"name": "eth1", "mac_address": "00:11:22:33:44:55", "permanent_address": "00:11:22:33:44:AA", "driver": "ixgbe", "state": "up", "considered": true},
+            {"name": "ibp59s0", "mac_address": "80:00:02:08:fe:80:00:00:00:00:00:00:00:02:c9:03:00:0a:1b:2c", "permanent_address": null, "driver": "mlx5_core", "state": "up", "considered": true},
+            {"name": "lo", "mac_address": "00:00:00:00:00:00", "permanent_address": null, "driver": null, "state": "unknown", "considered": false}
+        ]"#;
+
+        let nics: Vec<(String, Option<String>)> = remote_nics(output.as_bytes())
+            .unwrap()
+            .into_iter()
+            .map(|nic| (nic.name, nic.mac_addr))
+            .collect();
+        assert_eq!(
+            nics,
+            vec![
+                ("eth0".to_string(), Some("00:11:22:33:44:55".to_string())),
+                // Inherited from the bond
+                ("eth1".to_string(), Some("00:11:22:33:44:aa".to_string())),
+                (
+                    "ibp59s0".to_string(),
+                    Some("00:02:c9:03:00:0a:1b:2c".to_string())
+                ),
+            ]
+        );
+
+        assert!(remote_nics(b"error: unrecognized subcommand").is_err());
+    }
+
+    #[test]
+    fn render_apply_script() {
+        assert_eq!(
+            apply_script("/usr/local/bin/nmc", true, Compression::Gzip),
+            "set -e\n\
+             dir=$(mktemp -d)\n\
+             trap 'rm -rf \"$dir\"' EXIT\n\
+             tar --extract --gzip -C \"$dir\"\n\
+             '/usr/local/bin/nmc' apply --config-dir \"$dir\" --network-manager reload\n"
+        );
+        assert!(
+            apply_script("nmc", false, Compression::Gzip).ends_with("--network-manager check\n")
+        );
+        assert!(apply_script("nmc", true, Compression::Zstd).contains("tar --extract --zstd -C"));
+        assert_eq!(shell_quote("it's"), "'it'\\''s'");
+    }
+}
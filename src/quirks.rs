@@ -0,0 +1,362 @@
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::fs;
+use std::path::Path;
+
+use anyhow::Context;
+use log::{debug, info};
+use network_interface::NetworkInterface;
+use nmstate::InterfaceType;
+use serde::Deserialize;
+
+use crate::apply_conf::ConnectionFile;
+use crate::keyfile::Keyfile;
+use crate::types::{interface_of, Host};
+use crate::yaml;
+
+/// File in the config dir declaring the workarounds required by specific NIC models.
+const QUIRKS_FILE: &str = "quirks.yaml";
+
+const SYSFS_DIR: &str = "/sys";
+
+/// Keyfile settings injected into the profiles of all NICs matching the given criteria.
+#[derive(Deserialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct Quirk {
+    name: String,
+    #[serde(rename = "match")]
+    matcher: QuirkMatch,
+    /// Values per section and key e.g. `ethtool: { feature-tso: false }`.
+    settings: BTreeMap<String, BTreeMap<String, SettingValue>>,
+}
+
+/// Criteria identifying a NIC model. All of the specified ones must match.
+#[derive(Deserialize, Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+#[serde(deny_unknown_fields)]
+struct QuirkMatch {
+    /// Organizationally unique identifier i.e. the first three octets of the MAC address.
+    oui: Option<String>,
+    /// PCI vendor ID e.g. `0x8086`.
+    vendor: Option<String>,
+    /// Kernel driver e.g. `ixgbe`.
+    driver: Option<String>,
+}
+
+#[derive(Deserialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+#[serde(untagged)]
+enum SettingValue {
+    Bool(bool),
+    Integer(i64),
+    String(String),
+}
+
+impl fmt::Display for SettingValue {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            SettingValue::Bool(value) => write!(f, "{value}"),
+            SettingValue::Integer(value) => write!(f, "{value}"),
+            SettingValue::String(value) => write!(f, "{value}"),
+        }
+    }
+}
+
+/// Properties of a local NIC used for matching quirks.
+#[derive(Debug, Default)]
+struct NicInfo {
+    mac_address: String,
+    vendor: Option<String>,
+    driver: Option<String>,
+}
+
+impl QuirkMatch {
+    fn matches(&self, nic: &NicInfo) -> bool {
+        let matches = |expected: &Option<String>, actual: Option<&str>| match expected {
+            None => true,
+            Some(expected) => actual.is_some_and(|actual| actual.eq_ignore_ascii_case(expected)),
+        };
+
+        let oui = self.oui.as_ref().map(|oui| oui.replace('-', ":"));
+        let nic_oui = nic.mac_address.get(..8);
+
+        matches(&oui, nic_oui)
+            && matches(&self.vendor, nic.vendor.as_deref())
+            && matches(&self.driver, nic.driver.as_deref())
+    }
+}
+
+/// Load the quirks from the config dir. Returns an empty list if no quirks are declared.
+pub(crate) fn load_quirks(config_dir: &str) -> Result<Vec<Quirk>, anyhow::Error> {
+    let path = Path::new(config_dir).join(QUIRKS_FILE);
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+
+    let file = fs::File::open(path).context("Opening quirks file")?;
+    let quirks = yaml::from_reader(file).context("Parsing quirks file")?;
+
+    Ok(quirks)
+}
+
+/// Inject the settings of the matching quirks into the profiles of the host's Ethernet NICs.
+///
+/// Settings already present in the profiles take precedence over the ones declared by quirks.
+pub(crate) fn apply_quirks(
+    quirks: &[Quirk],
+    host: &Host,
+    local_interfaces: &HashMap<String, String>,
+    network_interfaces: &[NetworkInterface],
+    connection_files: &mut [ConnectionFile],
+) {
+    apply_quirks_from(
+        Path::new(SYSFS_DIR),
+        quirks,
+        host,
+        local_interfaces,
+        network_interfaces,
+        connection_files,
+    )
+}
+
+fn apply_quirks_from(
+    sysfs_dir: &Path,
+    quirks: &[Quirk],
+    host: &Host,
+    local_interfaces: &HashMap<String, String>,
+    network_interfaces: &[NetworkInterface],
+    connection_files: &mut [ConnectionFile],
+) {
+    if quirks.is_empty() {
+        return;
+    }
+
+    for interface in host
+        .interfaces
+        .iter()
+        .filter(|interface| interface.interface_type == InterfaceType::Ethernet.to_string())
+    {
+        let Some(nic) = network_interfaces
+            .iter()
+            .find(|nic| nic.mac_addr.is_some() && nic.mac_addr == interface.mac_address)
+        else {
+            continue;
+        };
+
+        let name = local_interfaces
+            .get(&interface.logical_name)
+            .unwrap_or(&interface.logical_name);
+        // The quirks concern the NIC, so they apply to all profiles of the interface.
+        let mut files: Vec<&mut ConnectionFile> = connection_files
+            .iter_mut()
+            .filter(|file| interface_of(&file.name) == name)
+            .collect();
+        if files.is_empty() {
+            continue;
+        }
+
+        let info = read_nic_info(sysfs_dir, nic);
+        debug!("Detected NIC properties of '{}': {info:?}", nic.name);
+
+        let matching: Vec<&Quirk> = quirks.iter().filter(|q| q.matcher.matches(&info)).collect();
+        if matching.is_empty() {
+            continue;
+        }
+
+        for file in &mut files {
+            let mut keyfile = Keyfile::parse(&file.contents);
+            for quirk in &matching {
+                info!(file = file.name.as_str(); "Applying quirk '{}' to '{}'", quirk.name, file.name);
+
+                for (section, entries) in &quirk.settings {
+                    for (key, value) in entries {
+                        if keyfile.get(section, key).is_none() {
+                            keyfile.set(section, key, &value.to_string());
+                        }
+                    }
+                }
+            }
+
+            file.contents = keyfile.to_string();
+        }
+    }
+}
+
+fn read_nic_info(sysfs_dir: &Path, nic: &NetworkInterface) -> NicInfo {
+    let device_dir = sysfs_dir.join("class/net").join(&nic.name).join("device");
+
+    let vendor = fs::read_to_string(device_dir.join("vendor"))
+        .ok()
+        .map(|vendor| vendor.trim().to_string());
+    let driver = fs::read_link(device_dir.join("driver"))
+        .ok()
+        .and_then(|path| {
+            path.file_name()
+                .map(|name| name.to_string_lossy().to_string())
+        });
+
+    NicInfo {
+        mac_address: nic.mac_addr.clone().unwrap_or_default().to_lowercase(),
+        vendor,
+        driver,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::{BTreeMap, HashMap};
+    use std::fs;
+    use std::os::unix::fs::symlink;
+    use std::path::Path;
+
+    use network_interface::NetworkInterface;
+
+    use crate::apply_conf::ConnectionFile;
+    use crate::keyfile::Keyfile;
+    use crate::quirks::{
+        apply_quirks_from, load_quirks, read_nic_info, NicInfo, Quirk, QuirkMatch, SettingValue,
+    };
+    use crate::types::{Host, Interface};
+
+    fn quirk(matcher: QuirkMatch) -> Quirk {
+        Quirk {
+            name: "intel-tso".to_string(),
+            matcher,
+            settings: BTreeMap::from([(
+                "ethtool".to_string(),
+                BTreeMap::from([
+                    ("feature-tso".to_string(), SettingValue::Bool(false)),
+                    ("ring-rx".to_string(), SettingValue::Integer(4096)),
+                ]),
+            )]),
+        }
+    }
+
+    fn nic(name: &str, mac_address: &str) -> NetworkInterface {
+        NetworkInterface {
+            name: name.to_string(),
+            mac_addr: Some(mac_address.to_string()),
+            addr: vec![],
+            index: 0,
+        }
+    }
+
+    #[test]
+    fn match_nic_properties() {
+        let info = NicInfo {
+            mac_address: "00:1b:21:33:44:55".to_string(),
+            vendor: Some("0x8086".to_string()),
+            driver: Some("ixgbe".to_string()),
+        };
+
+        assert!(QuirkMatch::default().matches(&info));
+        assert!(QuirkMatch {
+            oui: Some("00-1B-21".to_string()),
+            vendor: Some("0x8086".to_string()),
+            driver: Some("ixgbe".to_string()),
+        }
+        .matches(&info));
+        assert!(!QuirkMatch {
+            oui: Some("00:1b:21".to_string()),
+            driver: Some("mlx5_core".to_string()),
+            ..Default::default()
+        }
+        .matches(&info));
+        assert!(!QuirkMatch {
+            vendor: Some("0x8086".to_string()),
+            ..Default::default()
+        }
+        .matches(&NicInfo::default()));
+    }
+
+    #[test]
+    fn read_nic_info_from_sysfs() {
+        let sysfs_dir = Path::new("_sysfs");
+        let device_dir = sysfs_dir.join("class/net/eth0/device");
+        fs::create_dir_all(&device_dir).unwrap();
+        fs::write(device_dir.join("vendor"), "0x8086\n").unwrap();
+        symlink("../../../bus/pci/drivers/ixgbe", device_dir.join("driver")).unwrap();
+
+        let info = read_nic_info(sysfs_dir, &nic("eth0", "00:1B:21:33:44:55"));
+        assert_eq!(info.mac_address, "00:1b:21:33:44:55");
+        assert_eq!(info.vendor.as_deref(), Some("0x8086"));
+        assert_eq!(info.driver.as_deref(), Some("ixgbe"));
+
+        let info = read_nic_info(sysfs_dir, &nic("eth1", "00:1B:21:33:44:56"));
+        assert!(info.vendor.is_none());
+        assert!(info.driver.is_none());
+
+        // cleanup
+        fs::remove_dir_all(sysfs_dir).unwrap();
+    }
+
+    #[test]
+    fn apply_matching_quirks() {
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                Interface {
+                    logical_name: "eth0".to_string(),
+                    mac_address: Option::from("00:1b:21:33:44:55".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth1".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:56".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+            ],
+            ..Default::default()
+        };
+        let local_interfaces = HashMap::from([("eth0".to_string(), "ens1f0".to_string())]);
+        let network_interfaces = vec![
+            nic("ens1f0", "00:1b:21:33:44:55"),
+            nic("eth1", "00:11:22:33:44:56"),
+        ];
+        let mut connection_files = vec![
+            ConnectionFile {
+                name: "ens1f0".to_string(),
+                contents: "[connection]\nid=eth0\n\n[ethtool]\nring-rx=1024\n".to_string(),
+            },
+            ConnectionFile {
+                name: "eth1".to_string(),
+                contents: "[connection]\nid=eth1\n".to_string(),
+            },
+        ];
+        let quirks = vec![quirk(QuirkMatch {
+            oui: Some("00:1b:21".to_string()),
+            ..Default::default()
+        })];
+
+        apply_quirks_from(
+            Path::new("<missing>"),
+            &quirks,
+            &host,
+            &local_interfaces,
+            &network_interfaces,
+            &mut connection_files,
+        );
+
+        let keyfile = Keyfile::parse(&connection_files[0].contents);
+        assert_eq!(keyfile.get("ethtool", "feature-tso"), Some("false"));
+        assert_eq!(keyfile.get("ethtool", "ring-rx"), Some("1024"));
+        assert_eq!(connection_files[1].contents, "[connection]\nid=eth1\n");
+    }
+
+    #[test]
+    fn load_quirks_successfully() {
+        let quirks = load_quirks("testdata/quirks").unwrap();
+        assert_eq!(
+            quirks,
+            vec![quirk(QuirkMatch {
+                vendor: Some("0x8086".to_string()),
+                driver: Some("ixgbe".to_string()),
+                ..Default::default()
+            })]
+        );
+
+        assert!(load_quirks("<missing>").unwrap().is_empty());
+    }
+}
@@ -0,0 +1,565 @@
+use std::collections::HashMap;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use anyhow::{anyhow, Context};
+use log::{info, warn};
+use network_interface::NetworkInterface;
+use nmstate::InterfaceType;
+
+use crate::apply_conf::write_if_changed;
+use crate::filesystem::FileSystem;
+use crate::netlink::{is_link_up, set_link_name};
+use crate::report::FileAction;
+use crate::types::Host;
+
+pub(crate) const GENERATED_HEADER: &str = "# Generated by nm-configurator. Do not edit.";
+/// Prefix of the systemd.link files, sorting ahead of the default 99-default.link shipped by systemd.
+pub(crate) const LINK_FILE_PREFIX: &str = "10-nm-configurator-";
+
+/// Preconfigured NIC which is named differently on the local system.
+#[derive(Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct Rename {
+    pub(crate) mac_address: String,
+    pub(crate) local_name: String,
+    pub(crate) logical_name: String,
+}
+
+/// Returns the Ethernet interfaces of the host whose local names differ from the preconfigured ones.
+pub(crate) fn detect_renames(
+    host: &Host,
+    local_interfaces: &HashMap<String, String>,
+) -> Vec<Rename> {
+    host.interfaces
+        .iter()
+        .filter(|interface| interface.interface_type == InterfaceType::Ethernet.to_string())
+        .filter_map(|interface| {
+            let local_name = local_interfaces.get(&interface.logical_name)?;
+            let mac_address = interface.mac_address.as_ref()?;
+
+            Some(Rename {
+                mac_address: mac_address.to_lowercase(),
+                local_name: local_name.clone(),
+                logical_name: interface.logical_name.clone(),
+            })
+        })
+        .collect()
+}
+
+/// Write udev rules renaming the NICs matched by MAC address to their preconfigured names.
+///
+/// The rules take effect the next time the devices are added (e.g. on reboot).
+/// Returns the stored file, so that it gets tracked once there is nothing left to rename.
+pub(crate) fn write_udev_rules(
+    filesystem: &dyn FileSystem,
+    renames: &[Rename],
+    path: &str,
+) -> Result<Vec<(PathBuf, FileAction)>, anyhow::Error> {
+    if renames.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    let path = Path::new(path);
+    if let Some(dir) = path.parent() {
+        filesystem
+            .create_dir_all(dir)
+            .context("Creating udev rules dir")?;
+    }
+
+    let action = write_if_changed(filesystem, path, udev_rules(renames).as_bytes(), 0o644)
+        .context("Writing udev rules file")?;
+
+    renames.iter().for_each(|rename| {
+        info!(
+            interface = rename.local_name.as_str();
+            "Interface '{}' will be renamed to '{}' via udev",
+            rename.local_name, rename.logical_name
+        )
+    });
+
+    Ok(vec![(path.to_path_buf(), action)])
+}
+
+/// Write systemd.link files renaming the NICs matched by MAC address to their preconfigured names.
+///
+/// Only physical Ethernet devices are matched, since virtual ones (e.g. bonds) may clone the same address.
+/// Returns the stored files, so that those of NICs no longer renamed are tracked as stale.
+pub(crate) fn write_link_files(
+    filesystem: &dyn FileSystem,
+    renames: &[Rename],
+    dir: &str,
+) -> Result<Vec<(PathBuf, FileAction)>, anyhow::Error> {
+    let mut stored = Vec::new();
+    if renames.is_empty() {
+        return Ok(stored);
+    }
+
+    filesystem
+        .create_dir_all(Path::new(dir))
+        .context("Creating systemd network dir")?;
+
+    for rename in renames {
+        let path = Path::new(dir).join(link_filename(rename));
+
+        let action = write_if_changed(filesystem, &path, link_file(rename).as_bytes(), 0o644)
+            .context("Writing link file")?;
+
+        info!(
+            interface = rename.local_name.as_str();
+            "Interface '{}' will be renamed to '{}' via {path:?}",
+            rename.local_name, rename.logical_name
+        );
+        stored.push((path, action));
+    }
+
+    Ok(stored)
+}
+
+/// Rename the NICs to their preconfigured names via netlink.
+///
+/// The kernel refuses to rename links which are up, so all of them are verified before renaming any.
+/// If renaming any of them fails, the ones already renamed get their local names back.
+pub(crate) fn rename_links(
+    renames: &[Rename],
+    network_interfaces: &[NetworkInterface],
+) -> Result<(), anyhow::Error> {
+    let links = link_indexes(renames, network_interfaces)?;
+
+    for (_, rename) in &links {
+        if is_link_up(&rename.local_name).context("Reading link state")? {
+            return Err(anyhow!(
+                "Interface '{}' is up and can not be renamed to '{}'",
+                rename.local_name,
+                rename.logical_name
+            ));
+        }
+    }
+
+    let intermediate = requires_intermediate_names(renames, network_interfaces);
+    set_link_names(&links, intermediate, &mut set_link_name)
+}
+
+fn set_link_names(
+    links: &[(u32, &Rename)],
+    intermediate: bool,
+    set_name: &mut impl FnMut(u32, &str) -> io::Result<()>,
+) -> Result<(), anyhow::Error> {
+    let mut renamed = Vec::new();
+
+    let result = (|| {
+        // Names may be swapped between the NICs, so free them up first.
+        if intermediate {
+            for (index, rename) in links {
+                set_name(*index, &intermediate_name(*index)).with_context(|| {
+                    format!("Renaming interface '{}' temporarily", rename.local_name)
+                })?;
+                renamed.push((*index, *rename));
+            }
+        }
+
+        for (index, rename) in links {
+            set_name(*index, &rename.logical_name).with_context(|| {
+                format!(
+                    "Renaming interface '{}' to '{}'",
+                    rename.local_name, rename.logical_name
+                )
+            })?;
+            if !intermediate {
+                renamed.push((*index, *rename));
+            }
+
+            info!(
+                interface = rename.logical_name.as_str();
+                "Renamed interface '{}' to '{}'",
+                rename.local_name, rename.logical_name
+            );
+        }
+
+        Ok(())
+    })();
+
+    if result.is_err() {
+        restore_link_names(&renamed, set_name);
+    }
+
+    result
+}
+
+/// Rename the links back to their local names, freeing up the names via intermediate ones first, since some of them
+/// may already carry the local name of another one. Failures are only reported, the run fails anyway.
+fn restore_link_names(
+    links: &[(u32, &Rename)],
+    set_name: &mut impl FnMut(u32, &str) -> io::Result<()>,
+) {
+    for (index, rename) in links {
+        if let Err(err) = set_name(*index, &intermediate_name(*index)) {
+            warn!(
+                "Failed to rename interface '{}' back temporarily: {err}",
+                rename.local_name
+            );
+        }
+    }
+
+    for (index, rename) in links {
+        match set_name(*index, &rename.local_name) {
+            Ok(()) => info!(
+                interface = rename.local_name.as_str();
+                "Renamed interface back to '{}'",
+                rename.local_name
+            ),
+            Err(err) => warn!(
+                "Failed to rename interface back to '{}': {err}",
+                rename.local_name
+            ),
+        }
+    }
+}
+
+/// Returns the interfaces as they are named once `rename_links` renamed them, so that the connection files
+/// can be checked against them before anything is renamed.
+pub(crate) fn renamed_interfaces(
+    renames: &[Rename],
+    network_interfaces: &[NetworkInterface],
+) -> Vec<NetworkInterface> {
+    network_interfaces
+        .iter()
+        .map(|nic| {
+            let mut nic = nic.clone();
+            if let Some(rename) = renames.iter().find(|rename| rename.local_name == nic.name) {
+                nic.name = rename.logical_name.clone();
+            }
+            nic
+        })
+        .collect()
+}
+
+fn link_indexes<'a>(
+    renames: &'a [Rename],
+    network_interfaces: &[NetworkInterface],
+) -> Result<Vec<(u32, &'a Rename)>, anyhow::Error> {
+    renames
+        .iter()
+        .map(|rename| {
+            network_interfaces
+                .iter()
+                .find(|nic| nic.name == rename.local_name)
+                .map(|nic| (nic.index, rename))
+                .ok_or_else(|| anyhow!("Interface '{}' not found", rename.local_name))
+        })
+        .collect()
+}
+
+fn requires_intermediate_names(
+    renames: &[Rename],
+    network_interfaces: &[NetworkInterface],
+) -> bool {
+    renames.iter().any(|rename| {
+        network_interfaces
+            .iter()
+            .any(|nic| nic.name == rename.logical_name)
+    })
+}
+
+fn intermediate_name(index: u32) -> String {
+    format!("nmc{index}")
+}
+
+fn link_filename(rename: &Rename) -> String {
+    format!("{LINK_FILE_PREFIX}{}.link", rename.logical_name)
+}
+
+fn link_file(rename: &Rename) -> String {
+    format!(
+        "{GENERATED_HEADER}\n[Match]\nMACAddress={}\nType=ether\n\n[Link]\nName={}\n",
+        rename.mac_address, rename.logical_name
+    )
+}
+
+fn udev_rules(renames: &[Rename]) -> String {
+    let mut rules = format!("{GENERATED_HEADER}\n");
+
+    for rename in renames {
+        rules.push_str(&format!(
+            "SUBSYSTEM==\"net\", ACTION==\"add\", ATTR{{address}}==\"{}\", NAME=\"{}\"\n",
+            rename.mac_address, rename.logical_name
+        ));
+    }
+
+    rules
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::{BTreeMap, HashMap};
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::{Path, PathBuf};
+
+    use network_interface::NetworkInterface;
+
+    use crate::filesystem::Disk;
+    use crate::rename::{
+        detect_renames, link_file, link_indexes, renamed_interfaces, requires_intermediate_names,
+        set_link_names, udev_rules, write_link_files, write_udev_rules, Rename,
+    };
+    use crate::report::FileAction;
+    use crate::types::{Host, Interface};
+
+    fn renames() -> Vec<Rename> {
+        vec![
+            Rename {
+                mac_address: "00:11:22:33:44:55".to_string(),
+                local_name: "ens1f0".to_string(),
+                logical_name: "eth0".to_string(),
+            },
+            Rename {
+                mac_address: "00:11:22:33:44:56".to_string(),
+                local_name: "ens1f1".to_string(),
+                logical_name: "eth1".to_string(),
+            },
+        ]
+    }
+
+    #[test]
+    fn detect_ethernet_renames() {
+        let host = Host {
+            hostname: "node1".to_string(),
+            interfaces: vec![
+                Interface {
+                    logical_name: "eth0".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:55".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth0.1365".to_string(),
+                    interface_type: "vlan".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth1".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:56".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+                Interface {
+                    logical_name: "eth2".to_string(),
+                    mac_address: Option::from("00:11:22:33:44:57".to_string()),
+                    interface_type: "ethernet".to_string(),
+                    ..Default::default()
+                },
+            ],
+            ..Default::default()
+        };
+        let local_interfaces = HashMap::from([
+            ("eth0".to_string(), "ens1f0".to_string()),
+            ("eth0.1365".to_string(), "ens1f0.1365".to_string()),
+            ("eth1".to_string(), "ens1f1".to_string()),
+        ]);
+
+        assert_eq!(detect_renames(&host, &local_interfaces), renames());
+    }
+
+    #[test]
+    fn generate_udev_rules() {
+        assert_eq!(
+            udev_rules(&renames()),
+            r#"# Generated by nm-configurator. Do not edit.
+SUBSYSTEM=="net", ACTION=="add", ATTR{address}=="00:11:22:33:44:55", NAME="eth0"
+SUBSYSTEM=="net", ACTION=="add", ATTR{address}=="00:11:22:33:44:56", NAME="eth1"
+"#
+        );
+    }
+
+    #[test]
+    fn write_udev_rules_successfully() {
+        let path = "_udev/rules.d/70-nm-configurator.rules";
+
+        assert!(write_udev_rules(&Disk, &[], path).unwrap().is_empty());
+        assert!(fs::metadata(path).is_err());
+
+        assert_eq!(
+            write_udev_rules(&Disk, &renames(), path).unwrap(),
+            vec![(PathBuf::from(path), FileAction::Created)]
+        );
+        assert_eq!(fs::read_to_string(path).unwrap(), udev_rules(&renames()));
+        assert_eq!(
+            write_udev_rules(&Disk, &renames(), path).unwrap(),
+            vec![(PathBuf::from(path), FileAction::Skipped)]
+        );
+        assert_eq!(
+            fs::metadata(path).unwrap().permissions().mode() & 0o777,
+            0o644
+        );
+
+        // cleanup
+        fs::remove_dir_all("_udev").unwrap();
+    }
+
+    #[test]
+    fn generate_link_file() {
+        assert_eq!(
+            link_file(&renames()[0]),
+            r#"# Generated by nm-configurator. Do not edit.
+[Match]
+MACAddress=00:11:22:33:44:55
+Type=ether
+
+[Link]
+Name=eth0
+"#
+        );
+    }
+
+    #[test]
+    fn write_link_files_successfully() {
+        let dir = "_systemd/network";
+
+        assert!(write_link_files(&Disk, &[], dir).unwrap().is_empty());
+        assert!(fs::metadata(dir).is_err());
+
+        assert_eq!(
+            write_link_files(&Disk, &renames(), dir).unwrap(),
+            vec![
+                (
+                    Path::new(dir).join("10-nm-configurator-eth0.link"),
+                    FileAction::Created
+                ),
+                (
+                    Path::new(dir).join("10-nm-configurator-eth1.link"),
+                    FileAction::Created
+                ),
+            ]
+        );
+        for (filename, rename) in [
+            ("10-nm-configurator-eth0.link", &renames()[0]),
+            ("10-nm-configurator-eth1.link", &renames()[1]),
+        ] {
+            let path = format!("{dir}/{filename}");
+            assert_eq!(fs::read_to_string(path).unwrap(), link_file(rename));
+        }
+
+        // cleanup
+        fs::remove_dir_all("_systemd").unwrap();
+    }
+
+    fn nic(name: &str, index: u32) -> NetworkInterface {
+        NetworkInterface {
+            name: name.to_string(),
+            mac_addr: None,
+            addr: vec![],
+            index,
+        }
+    }
+
+    #[test]
+    fn resolve_link_indexes() {
+        let renames = renames();
+        let nics = vec![nic("ens1f0", 2), nic("ens1f1", 3)];
+
+        let links = link_indexes(&renames, &nics).unwrap();
+        assert_eq!(links, vec![(2, &renames[0]), (3, &renames[1])]);
+
+        let error = link_indexes(&renames, &nics[..1]).unwrap_err();
+        assert_eq!(error.to_string(), "Interface 'ens1f1' not found");
+    }
+
+    #[test]
+    fn rename_interfaces() {
+        let renamed = renamed_interfaces(
+            &renames(),
+            &[nic("ens1f0", 2), nic("ens1f1", 3), nic("ens2", 4)],
+        );
+
+        let names: Vec<(&str, u32)> = renamed
+            .iter()
+            .map(|nic| (nic.name.as_str(), nic.index))
+            .collect();
+        assert_eq!(names, vec![("eth0", 2), ("eth1", 3), ("ens2", 4)]);
+    }
+
+    /// Links by their indexes as named by the kernel, refusing names taken by other links and the `failing` one.
+    fn set_name_of<'a>(
+        links: &'a mut BTreeMap<u32, String>,
+        failing: &'static str,
+    ) -> impl FnMut(u32, &str) -> std::io::Result<()> + 'a {
+        move |index, name| {
+            if name == failing || links.iter().any(|(i, n)| *i != index && n == name) {
+                return Err(std::io::Error::from_raw_os_error(libc::EEXIST));
+            }
+            links.insert(index, name.to_string());
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn set_link_names_successfully() {
+        let renames = renames();
+        let links = vec![(2, &renames[0]), (3, &renames[1])];
+
+        let mut names = BTreeMap::from([(2, "ens1f0".to_string()), (3, "ens1f1".to_string())]);
+        set_link_names(&links, false, &mut set_name_of(&mut names, "")).unwrap();
+        assert_eq!(
+            names,
+            BTreeMap::from([(2, "eth0".to_string()), (3, "eth1".to_string())])
+        );
+
+        // Swapped names
+        let swapped = [
+            Rename {
+                mac_address: "00:11:22:33:44:55".to_string(),
+                local_name: "eth1".to_string(),
+                logical_name: "eth0".to_string(),
+            },
+            Rename {
+                mac_address: "00:11:22:33:44:56".to_string(),
+                local_name: "eth0".to_string(),
+                logical_name: "eth1".to_string(),
+            },
+        ];
+        let links = vec![(2, &swapped[0]), (3, &swapped[1])];
+        let mut names = BTreeMap::from([(2, "eth1".to_string()), (3, "eth0".to_string())]);
+        set_link_names(&links, true, &mut set_name_of(&mut names, "")).unwrap();
+        assert_eq!(
+            names,
+            BTreeMap::from([(2, "eth0".to_string()), (3, "eth1".to_string())])
+        );
+    }
+
+    #[test]
+    fn restore_link_names_on_failure() {
+        let renames = renames();
+        let links = vec![(2, &renames[0]), (3, &renames[1])];
+        let local_names = BTreeMap::from([(2, "ens1f0".to_string()), (3, "ens1f1".to_string())]);
+
+        // Fails renaming the second link, after the first one was renamed
+        for intermediate in [false, true] {
+            let mut names = local_names.clone();
+            let error = set_link_names(&links, intermediate, &mut set_name_of(&mut names, "eth1"))
+                .unwrap_err();
+            assert_eq!(error.to_string(), "Renaming interface 'ens1f1' to 'eth1'");
+            assert_eq!(names, local_names, "intermediate: {intermediate}");
+        }
+
+        // Fails freeing up the name of the second link
+        let mut names = local_names.clone();
+        let error = set_link_names(&links, true, &mut set_name_of(&mut names, "nmc3")).unwrap_err();
+        assert_eq!(error.to_string(), "Renaming interface 'ens1f1' temporarily");
+        assert_eq!(names, local_names);
+    }
+
+    #[test]
+    fn detect_intermediate_names_requirement() {
+        let renames = renames();
+
+        assert!(!requires_intermediate_names(
+            &renames,
+            &[nic("ens1f0", 2), nic("ens1f1", 3)]
+        ));
+        assert!(requires_intermediate_names(
+            &renames,
+            &[nic("ens1f0", 2), nic("eth1", 3)]
+        ));
+    }
+}
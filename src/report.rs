@@ -0,0 +1,563 @@
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use anyhow::Context;
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+
+use crate::filesystem::FileSystem;
+
+/// Number of hosts listed in the largest hosts of a generation report.
+const LARGEST_HOSTS: usize = 5;
+
+const BOLD: &str = "\x1b[1m";
+const RED: &str = "\x1b[31m";
+const GREEN: &str = "\x1b[32m";
+const YELLOW: &str = "\x1b[33m";
+const RESET: &str = "\x1b[0m";
+
+/// Change made to a connection file when storing it.
+#[derive(Serialize, Clone, Copy, Debug, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum FileAction {
+    Created,
+    Updated,
+    /// The file already had the desired contents and was left untouched.
+    Skipped,
+    /// The file was stored by a previous run but is no longer part of the config.
+    Removed,
+}
+
+/// Summary of an apply run, allowing fleet tooling to record what was applied on each node.
+#[derive(Serialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct ApplyReport {
+    pub(crate) hostname: String,
+    /// Preconfigured interface names replaced by the local ones in the connection files.
+    pub(crate) interface_names: BTreeMap<String, String>,
+    pub(crate) files: Vec<FileReport>,
+    /// Names of the providers which resolved each secret referenced by the connection files.
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub(crate) secrets: BTreeMap<String, String>,
+    /// Statically assigned addresses which could not be probed for duplicates, e.g. `192.168.1.10 on 'bond0'`.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub(crate) unchecked_addresses: Vec<String>,
+}
+
+#[derive(Serialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct FileReport {
+    pub(crate) path: PathBuf,
+    pub(crate) action: FileAction,
+    /// Preconfigured name of the connection if the file is stored under the local interface name.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) renamed_from: Option<String>,
+    /// SHA-256 digest of the stored contents. Empty for removed files.
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub(crate) checksum: String,
+}
+
+impl ApplyReport {
+    pub(crate) fn write(
+        &self,
+        filesystem: &dyn FileSystem,
+        path: &str,
+    ) -> Result<(), anyhow::Error> {
+        write_json(filesystem, path, self)
+    }
+
+    /// Returns a human-readable table of the matched host, the changed files and the renamed interfaces,
+    /// colored with ANSI escape codes if requested.
+    pub(crate) fn summary(&self, color: bool) -> String {
+        let paint = |code: &str, text: &str| {
+            if color {
+                format!("{code}{text}{RESET}")
+            } else {
+                text.to_string()
+            }
+        };
+        let row = |label: &str, value: String| paint(BOLD, &format!("{label:<10}")) + &value + "\n";
+
+        let mut summary = row("Host", self.hostname.clone());
+        for file in &self.files {
+            let (label, code) = match file.action {
+                FileAction::Created => ("Created", GREEN),
+                FileAction::Updated => ("Updated", YELLOW),
+                FileAction::Removed => ("Removed", RED),
+                FileAction::Skipped => continue,
+            };
+            summary += &row(label, paint(code, &file.path.display().to_string()));
+        }
+        for (preconfigured, local) in &self.interface_names {
+            summary += &row("Renamed", format!("{preconfigured} -> {local}"));
+        }
+        for address in &self.unchecked_addresses {
+            summary += &row("Unchecked", paint(YELLOW, address));
+        }
+
+        let count = |action: FileAction| {
+            self.files
+                .iter()
+                .filter(|file| file.action == action)
+                .count()
+        };
+        summary += &row(
+            "Files",
+            format!(
+                "{} created, {} updated, {} unchanged, {} removed",
+                count(FileAction::Created),
+                count(FileAction::Updated),
+                count(FileAction::Skipped),
+                count(FileAction::Removed),
+            ),
+        );
+
+        summary
+    }
+}
+
+/// Aggregate summary of a generate run across all hosts, giving release engineering visibility
+/// into how the config of the fleet evolves over time.
+#[derive(Serialize, Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct GenerationReport {
+    /// Number of hosts whose config was generated.
+    pub(crate) hosts: usize,
+    pub(crate) failures: Vec<HostFailure>,
+    /// Number of files stored for all hosts.
+    pub(crate) files: usize,
+    /// Number of generated connections by type, e.g. `ethernet` or `bond`.
+    pub(crate) connection_types: BTreeMap<String, usize>,
+    /// Hosts with the most files, largest first.
+    pub(crate) largest_hosts: Vec<HostSize>,
+    pub(crate) duration_ms: DurationStats,
+}
+
+#[derive(Serialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct HostFailure {
+    pub(crate) host: String,
+    pub(crate) error: String,
+}
+
+#[derive(Serialize, Debug)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct HostSize {
+    pub(crate) host: String,
+    pub(crate) files: usize,
+}
+
+/// Total duration of the run and percentiles of the durations of the single hosts in milliseconds.
+#[derive(Serialize, Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct DurationStats {
+    pub(crate) total: u128,
+    pub(crate) p50: u128,
+    pub(crate) p90: u128,
+    pub(crate) p99: u128,
+    pub(crate) max: u128,
+}
+
+/// Outcome of generating the config of a single host.
+pub(crate) struct HostStats {
+    pub(crate) hostname: String,
+    pub(crate) files: usize,
+    /// Types of the generated connections.
+    pub(crate) connection_types: Vec<String>,
+    pub(crate) duration: Duration,
+}
+
+impl GenerationReport {
+    pub(crate) fn new(hosts: &[HostStats], failures: Vec<HostFailure>, total: Duration) -> Self {
+        let mut connection_types = BTreeMap::new();
+        for connection_type in hosts.iter().flat_map(|host| &host.connection_types) {
+            *connection_types.entry(connection_type.clone()).or_default() += 1;
+        }
+
+        let mut largest_hosts: Vec<HostSize> = hosts
+            .iter()
+            .map(|host| HostSize {
+                host: host.hostname.clone(),
+                files: host.files,
+            })
+            .collect();
+        // Stable sort keeps the hosts of the same size in name order.
+        largest_hosts.sort_by(|a, b| b.files.cmp(&a.files));
+        largest_hosts.truncate(LARGEST_HOSTS);
+
+        let mut durations: Vec<u128> = hosts.iter().map(|host| host.duration.as_millis()).collect();
+        durations.sort_unstable();
+
+        GenerationReport {
+            hosts: hosts.len(),
+            failures,
+            files: hosts.iter().map(|host| host.files).sum(),
+            connection_types,
+            largest_hosts,
+            duration_ms: DurationStats {
+                total: total.as_millis(),
+                p50: percentile(&durations, 50),
+                p90: percentile(&durations, 90),
+                p99: percentile(&durations, 99),
+                max: durations.last().copied().unwrap_or_default(),
+            },
+        }
+    }
+
+    pub(crate) fn write(
+        &self,
+        filesystem: &dyn FileSystem,
+        path: &str,
+    ) -> Result<(), anyhow::Error> {
+        write_json(filesystem, path, self)
+    }
+
+    /// Returns a human-readable summary of the report.
+    pub(crate) fn summary(&self) -> String {
+        let types: Vec<String> = self
+            .connection_types
+            .iter()
+            .map(|(connection_type, count)| format!("{count} {connection_type}"))
+            .collect();
+        let largest: Vec<String> = self
+            .largest_hosts
+            .iter()
+            .map(|host| format!("{} ({})", host.host, host.files))
+            .collect();
+
+        format!(
+            "{} host(s) generated, {} failed, {} file(s) stored\n\
+             Connections: {}\n\
+             Largest hosts: {}\n\
+             Duration: {} ms total, per host p50 {} ms, p90 {} ms, p99 {} ms, max {} ms",
+            self.hosts,
+            self.failures.len(),
+            self.files,
+            if types.is_empty() {
+                "none".to_string()
+            } else {
+                types.join(", ")
+            },
+            if largest.is_empty() {
+                "none".to_string()
+            } else {
+                largest.join(", ")
+            },
+            self.duration_ms.total,
+            self.duration_ms.p50,
+            self.duration_ms.p90,
+            self.duration_ms.p99,
+            self.duration_ms.max,
+        )
+    }
+}
+
+/// Returns the given percentile of the sorted values using the nearest-rank method.
+fn percentile(sorted: &[u128], percentile: usize) -> u128 {
+    if sorted.is_empty() {
+        return 0;
+    }
+
+    let rank = (percentile * sorted.len()).div_ceil(100);
+    sorted[rank.max(1) - 1]
+}
+
+fn write_json(
+    filesystem: &dyn FileSystem,
+    path: &str,
+    value: &impl Serialize,
+) -> Result<(), anyhow::Error> {
+    if let Some(dir) = Path::new(path).parent() {
+        filesystem
+            .create_dir_all(dir)
+            .context("Creating report dir")?;
+    }
+
+    let contents = serde_json::to_vec_pretty(value).context("Serializing report")?;
+    filesystem
+        .write(Path::new(path), &contents, 0o666)
+        .context("Writing report file")
+}
+
+/// Format the results of an apply run in Prometheus text format. A missing report denotes a failed run.
+///
+/// The matched host is exported as a hash, allowing to detect a node matching a different host
+/// than expected without exposing the hostnames to the monitoring system.
+pub(crate) fn format_metrics(report: Option<&ApplyReport>, timestamp: u64) -> String {
+    let mut metrics = String::new();
+    metrics.push_str("# HELP nmc_apply_success Whether the last apply run passed.\n");
+    metrics.push_str("# TYPE nmc_apply_success gauge\n");
+    metrics.push_str(&format!(
+        "nmc_apply_success {}\n",
+        u8::from(report.is_some())
+    ));
+
+    if let Some(report) = report {
+        metrics
+            .push_str("# HELP nmc_apply_files Connection files handled by the last apply run.\n");
+        metrics.push_str("# TYPE nmc_apply_files gauge\n");
+        for (label, action) in [
+            ("created", FileAction::Created),
+            ("updated", FileAction::Updated),
+            ("skipped", FileAction::Skipped),
+            ("removed", FileAction::Removed),
+        ] {
+            let count = report
+                .files
+                .iter()
+                .filter(|file| file.action == action)
+                .count();
+            metrics.push_str(&format!("nmc_apply_files{{action=\"{label}\"}} {count}\n"));
+        }
+
+        let host_hash: String = Sha256::digest(report.hostname.as_bytes())
+            .iter()
+            .map(|byte| format!("{byte:02x}"))
+            .collect();
+        metrics.push_str(
+            "# HELP nmc_apply_host_info SHA-256 hash of the host matched by the last apply run.\n",
+        );
+        metrics.push_str("# TYPE nmc_apply_host_info gauge\n");
+        metrics.push_str(&format!(
+            "nmc_apply_host_info{{host_hash=\"{host_hash}\"}} 1\n"
+        ));
+    }
+
+    metrics.push_str("# HELP nmc_apply_last_run_timestamp_seconds Time of the last apply run.\n");
+    metrics.push_str("# TYPE nmc_apply_last_run_timestamp_seconds gauge\n");
+    metrics.push_str(&format!(
+        "nmc_apply_last_run_timestamp_seconds {timestamp}\n"
+    ));
+
+    metrics
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::path::PathBuf;
+    use std::time::Duration;
+
+    use crate::filesystem::Disk;
+    use crate::report::{
+        format_metrics, percentile, ApplyReport, DurationStats, FileAction, FileReport,
+        GenerationReport, HostFailure, HostSize, HostStats,
+    };
+
+    #[test]
+    fn write_report_successfully() {
+        let path = "_report/report.json";
+        let report = ApplyReport {
+            hostname: "node1".to_string(),
+            interface_names: BTreeMap::from([("eth0".to_string(), "ens1f0".to_string())]),
+            files: vec![
+                FileReport {
+                    path: PathBuf::from("/etc/ens1f0.nmconnection"),
+                    action: FileAction::Created,
+                    renamed_from: Some("eth0".to_string()),
+                    checksum: "abc123".to_string(),
+                },
+                FileReport {
+                    path: PathBuf::from("/etc/bond0.nmconnection"),
+                    action: FileAction::Skipped,
+                    renamed_from: None,
+                    checksum: "def456".to_string(),
+                },
+            ],
+            secrets: BTreeMap::from([("WIFI_PSK".to_string(), "file".to_string())]),
+            unchecked_addresses: vec!["192.168.1.10 on 'bond0'".to_string()],
+        };
+
+        report.write(&Disk, path).unwrap();
+
+        assert_eq!(
+            fs::read_to_string(path).unwrap(),
+            r#"{
+  "hostname": "node1",
+  "interface_names": {
+    "eth0": "ens1f0"
+  },
+  "files": [
+    {
+      "path": "/etc/ens1f0.nmconnection",
+      "action": "created",
+      "renamed_from": "eth0",
+      "checksum": "abc123"
+    },
+    {
+      "path": "/etc/bond0.nmconnection",
+      "action": "skipped",
+      "checksum": "def456"
+    }
+  ],
+  "secrets": {
+    "WIFI_PSK": "file"
+  },
+  "unchecked_addresses": [
+    "192.168.1.10 on 'bond0'"
+  ]
+}"#
+        );
+
+        // cleanup
+        fs::remove_dir_all("_report").unwrap();
+    }
+
+    #[test]
+    fn summarize_apply_report() {
+        let file = |path: &str, action| FileReport {
+            path: PathBuf::from(path),
+            action,
+            renamed_from: None,
+            checksum: String::new(),
+        };
+        let report = ApplyReport {
+            hostname: "node1".to_string(),
+            interface_names: BTreeMap::from([("eth0".to_string(), "ens1f0".to_string())]),
+            files: vec![
+                file("/etc/ens1f0.nmconnection", FileAction::Created),
+                file("/etc/bond0.nmconnection", FileAction::Skipped),
+                file("/etc/eth1.nmconnection", FileAction::Removed),
+            ],
+            secrets: BTreeMap::new(),
+            unchecked_addresses: vec!["192.168.1.10 on 'bond0'".to_string()],
+        };
+
+        assert_eq!(
+            report.summary(false),
+            "Host      node1\n\
+             Created   /etc/ens1f0.nmconnection\n\
+             Removed   /etc/eth1.nmconnection\n\
+             Renamed   eth0 -> ens1f0\n\
+             Unchecked 192.168.1.10 on 'bond0'\n\
+             Files     1 created, 0 updated, 1 unchanged, 1 removed\n"
+        );
+        assert!(report.summary(true).starts_with(
+            "\x1b[1mHost      \x1b[0mnode1\n\x1b[1mCreated   \x1b[0m\x1b[32m/etc/ens1f0"
+        ));
+    }
+
+    #[test]
+    fn build_generation_report() {
+        let host = |hostname: &str, files, connection_types: &[&str], millis| HostStats {
+            hostname: hostname.to_string(),
+            files,
+            connection_types: connection_types.iter().map(|t| t.to_string()).collect(),
+            duration: Duration::from_millis(millis),
+        };
+        let hosts = [
+            host("node1", 2, &["ethernet", "ethernet"], 10),
+            host("node2", 4, &["ethernet", "ethernet", "bond"], 30),
+            host("node3", 2, &["ethernet"], 20),
+        ];
+        let failures = vec![HostFailure {
+            host: "node4".to_string(),
+            error: "Invalid data".to_string(),
+        }];
+
+        let report = GenerationReport::new(&hosts, failures, Duration::from_millis(75));
+        assert_eq!(
+            report,
+            GenerationReport {
+                hosts: 3,
+                failures: vec![HostFailure {
+                    host: "node4".to_string(),
+                    error: "Invalid data".to_string(),
+                }],
+                files: 8,
+                connection_types: BTreeMap::from([
+                    ("bond".to_string(), 1),
+                    ("ethernet".to_string(), 5)
+                ]),
+                largest_hosts: vec![
+                    HostSize {
+                        host: "node2".to_string(),
+                        files: 4
+                    },
+                    HostSize {
+                        host: "node1".to_string(),
+                        files: 2
+                    },
+                    HostSize {
+                        host: "node3".to_string(),
+                        files: 2
+                    },
+                ],
+                duration_ms: DurationStats {
+                    total: 75,
+                    p50: 20,
+                    p90: 30,
+                    p99: 30,
+                    max: 30,
+                },
+            }
+        );
+        assert_eq!(
+            report.summary(),
+            "3 host(s) generated, 1 failed, 8 file(s) stored\n\
+             Connections: 1 bond, 5 ethernet\n\
+             Largest hosts: node2 (4), node1 (2), node3 (2)\n\
+             Duration: 75 ms total, per host p50 20 ms, p90 30 ms, p99 30 ms, max 30 ms"
+        );
+
+        let empty = GenerationReport::new(&[], Vec::new(), Duration::ZERO);
+        assert!(empty.summary().contains("Connections: none"));
+    }
+
+    #[test]
+    fn nearest_rank_percentile() {
+        let values: Vec<u128> = (1..=10).collect();
+        assert_eq!(percentile(&values, 50), 5);
+        assert_eq!(percentile(&values, 90), 9);
+        assert_eq!(percentile(&values, 99), 10);
+        assert_eq!(percentile(&[7], 50), 7);
+        assert_eq!(percentile(&[], 50), 0);
+    }
+
+    #[test]
+    fn format_metrics_successfully() {
+        let file = |action| FileReport {
+            path: PathBuf::from("/etc/eth0.nmconnection"),
+            action,
+            renamed_from: None,
+            checksum: "abc123".to_string(),
+        };
+        let report = ApplyReport {
+            hostname: "node1".to_string(),
+            interface_names: BTreeMap::new(),
+            files: vec![
+                file(FileAction::Created),
+                file(FileAction::Skipped),
+                file(FileAction::Skipped),
+            ],
+            secrets: BTreeMap::new(),
+            unchecked_addresses: Vec::new(),
+        };
+
+        assert_eq!(
+            format_metrics(Some(&report), 1700000000),
+            "# HELP nmc_apply_success Whether the last apply run passed.\n\
+             # TYPE nmc_apply_success gauge\n\
+             nmc_apply_success 1\n\
+             # HELP nmc_apply_files Connection files handled by the last apply run.\n\
+             # TYPE nmc_apply_files gauge\n\
+             nmc_apply_files{action=\"created\"} 1\n\
+             nmc_apply_files{action=\"updated\"} 0\n\
+             nmc_apply_files{action=\"skipped\"} 2\n\
+             nmc_apply_files{action=\"removed\"} 0\n\
+             # HELP nmc_apply_host_info SHA-256 hash of the host matched by the last apply run.\n\
+             # TYPE nmc_apply_host_info gauge\n\
+             nmc_apply_host_info{host_hash=\"ca12f31b8cbf5f29e268ea64c20a37f3d50b539d891db0c3ebc7c0f66b1fb98a\"} 1\n\
+             # HELP nmc_apply_last_run_timestamp_seconds Time of the last apply run.\n\
+             # TYPE nmc_apply_last_run_timestamp_seconds gauge\n\
+             nmc_apply_last_run_timestamp_seconds 1700000000\n"
+        );
+
+        let metrics = format_metrics(None, 1700000000);
+        assert!(metrics.contains("nmc_apply_success 0\n"));
+        assert!(!metrics.contains("nmc_apply_files"));
+        assert!(!metrics.contains("nmc_apply_host_info"));
+    }
+}
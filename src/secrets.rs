@@ -0,0 +1,519 @@
+use std::cell::RefCell;
+use std::collections::BTreeMap;
+use std::env;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use anyhow::{anyhow, Context};
+use log::{debug, warn};
+use serde::Deserialize;
+
+use crate::expand::{expand_placeholders, expand_vars};
+use crate::filesystem::FileSystem;
+use crate::keyfile::Keyfile;
+use crate::yaml;
+
+/// File in the config dir declaring the providers resolving the `${VAR}` references and `@@NAME@@` placeholders
+/// in the connection files.
+const SECRETS_FILE: &str = "secrets.yaml";
+
+/// Prefix of the variables referencing the secrets extracted from the generated keyfiles.
+const SECRET_VARIABLE_PREFIX: &str = "NMC_SECRET_";
+
+/// Value of the `<key>-flags` setting telling NetworkManager to ask a secret agent for the secret.
+const AGENT_OWNED: &str = "1";
+
+/// Keys holding secrets by the keyfile sections they are stored in (including the aliases of the sections).
+const SECRET_KEYS: [(&[&str], &[&str]); 7] = [
+    (
+        &["wifi-security", "802-11-wireless-security"],
+        &[
+            "psk",
+            "leap-password",
+            "wep-key0",
+            "wep-key1",
+            "wep-key2",
+            "wep-key3",
+        ],
+    ),
+    (
+        &["802-1x"],
+        &[
+            "password",
+            "password-raw",
+            "private-key-password",
+            "phase2-private-key-password",
+            "pin",
+        ],
+    ),
+    (&["gsm"], &["password", "pin"]),
+    (&["cdma"], &["password"]),
+    (&["pppoe"], &["password"]),
+    (&["macsec"], &["mka-cak"]),
+    (&["wireguard"], &["private-key"]),
+];
+
+/// How the secrets found in the generated keyfiles are handled.
+#[derive(Debug, Default, Clone, PartialEq)]
+pub(crate) enum SecretHandling {
+    /// Keep the secrets in the keyfiles.
+    #[default]
+    Inline,
+    /// Remove the secrets and flag them as owned by a secret agent, which NetworkManager asks for them.
+    Agent,
+    /// Replace the secrets by `${VAR}` references and store them apart in a file per secret
+    /// in the given dir, so that a secret provider injects them at apply time.
+    Extract { dir: String },
+}
+
+/// Separate the secrets from the keyfile as asked for by `handling`.
+///
+/// Returns the extracted secrets by the names of the variables referencing them.
+/// Secrets which are already references (e.g. `${WIFI_PSK}`) are left untouched.
+pub(crate) fn separate_secrets(
+    name: &str,
+    keyfile: &mut Keyfile,
+    handling: &SecretHandling,
+) -> BTreeMap<String, String> {
+    let mut extracted = BTreeMap::new();
+
+    let secrets: Vec<(String, String, String)> = SECRET_KEYS
+        .iter()
+        .flat_map(|(sections, keys)| {
+            sections
+                .iter()
+                .flat_map(move |section| keys.iter().map(move |key| (*section, *key)))
+        })
+        // WireGuard stores the preshared keys in a section per peer.
+        .chain(
+            keyfile
+                .sections()
+                .filter(|section| section.starts_with("wireguard-peer."))
+                .map(|section| (section, "preshared-key"))
+                .collect::<Vec<_>>(),
+        )
+        .filter_map(|(section, key)| {
+            let value = keyfile.get(section, key)?;
+            (!value.starts_with("${"))
+                .then(|| (section.to_string(), key.to_string(), value.to_string()))
+        })
+        .collect();
+
+    if secrets.is_empty() {
+        return extracted;
+    }
+
+    match handling {
+        SecretHandling::Inline => {
+            let keys: Vec<String> = secrets
+                .iter()
+                .map(|(section, key, _)| format!("{section}.{key}"))
+                .collect();
+            warn!(
+                file = name;
+                "Connection '{name}' stores secrets in plain text: {}",
+                keys.join(", ")
+            );
+        }
+        SecretHandling::Agent => {
+            for (section, key, _) in secrets {
+                keyfile.remove(&section, &key);
+                keyfile.set(&section, &format!("{key}-flags"), AGENT_OWNED);
+            }
+        }
+        SecretHandling::Extract { .. } => {
+            for (section, key, value) in secrets {
+                let variable = secret_variable(name, &section, &key);
+                keyfile.set(&section, &key, &format!("${{{variable}}}"));
+                extracted.insert(variable, value);
+            }
+        }
+    }
+
+    extracted
+}
+
+/// Returns the name of the variable referencing the secret, e.g. `NMC_SECRET_WLAN0_WIFI_SECURITY_PSK`.
+fn secret_variable(name: &str, section: &str, key: &str) -> String {
+    let variable: String = format!("{name}_{section}_{key}")
+        .chars()
+        .map(|c| match c {
+            'a'..='z' | 'A'..='Z' | '0'..='9' => c.to_ascii_uppercase(),
+            _ => '_',
+        })
+        .collect();
+
+    format!("{SECRET_VARIABLE_PREFIX}{variable}")
+}
+
+/// Store the secrets in a file per secret named after its variable, as read by the `file` provider.
+pub(crate) fn write_secret_files(
+    filesystem: &dyn FileSystem,
+    dir: &Path,
+    secrets: &BTreeMap<String, String>,
+) -> Result<(), anyhow::Error> {
+    filesystem
+        .create_dir_all(dir)
+        .context("Creating secrets dir")?;
+
+    for (variable, value) in secrets {
+        filesystem
+            .write(&dir.join(variable), value.as_bytes(), 0o600)
+            .with_context(|| format!("Writing secret file '{variable}'"))?;
+    }
+
+    Ok(())
+}
+
+/// Ordered chain of providers consulted for the `${VAR}` references in the connection files, e.g.
+///
+/// ```yaml
+/// providers:
+///   - type: file
+///     path: /run/credentials/nmc.service
+///   - type: env
+/// overrides:
+///   WIFI_PSK: [file]
+/// ```
+///
+/// The first provider defining a secret wins, so that nodes lacking e.g. TPM sealed credentials
+/// fall back to the next provider in the chain.
+#[derive(Deserialize, Debug)]
+#[serde(deny_unknown_fields)]
+pub(crate) struct Secrets {
+    providers: Vec<Provider>,
+    /// Providers consulted for specific secrets instead of the whole chain.
+    #[serde(default)]
+    overrides: BTreeMap<String, Vec<String>>,
+    /// Name of the provider which resolved each secret.
+    #[serde(skip)]
+    resolved: RefCell<BTreeMap<String, String>>,
+}
+
+#[derive(Deserialize, Debug)]
+#[serde(tag = "type", rename_all = "lowercase", deny_unknown_fields)]
+enum Provider {
+    /// Environment of the process.
+    Env,
+    /// Directory containing a file per secret named after it, e.g. systemd credentials
+    /// decrypted from the TPM (`$CREDENTIALS_DIRECTORY`) or files rendered by the Vault agent.
+    File { path: PathBuf },
+}
+
+impl Provider {
+    fn name(&self) -> &'static str {
+        match self {
+            Provider::Env => "env",
+            Provider::File { .. } => "file",
+        }
+    }
+
+    fn lookup(&self, name: &str) -> Option<String> {
+        match self {
+            Provider::Env => env::var(name).ok(),
+            Provider::File { path } => read_secret_file(&path.join(name)),
+        }
+    }
+}
+
+impl Default for Secrets {
+    /// Resolve the secrets from the environment only.
+    fn default() -> Self {
+        Secrets {
+            providers: vec![Provider::Env],
+            overrides: BTreeMap::new(),
+            resolved: RefCell::new(BTreeMap::new()),
+        }
+    }
+}
+
+impl Secrets {
+    /// Load the providers from the config dir. Returns `None` if none are declared.
+    pub(crate) fn load(config_dir: &str) -> Result<Option<Self>, anyhow::Error> {
+        let path = Path::new(config_dir).join(SECRETS_FILE);
+        if !path.exists() {
+            return Ok(None);
+        }
+
+        let file = fs::File::open(path).context("Opening secrets file")?;
+        let secrets: Secrets = yaml::from_reader(file).context("Parsing secrets file")?;
+        secrets.validate()?;
+
+        Ok(Some(secrets))
+    }
+
+    fn validate(&self) -> Result<(), anyhow::Error> {
+        if self.providers.is_empty() {
+            return Err(anyhow!("No secret providers declared"));
+        }
+
+        for (index, provider) in self.providers.iter().enumerate() {
+            if self.providers[..index]
+                .iter()
+                .any(|p| p.name() == provider.name())
+            {
+                return Err(anyhow!(
+                    "Secret provider '{}' is declared more than once",
+                    provider.name()
+                ));
+            }
+        }
+
+        for (secret, names) in &self.overrides {
+            if let Some(name) = names
+                .iter()
+                .find(|name| !self.providers.iter().any(|p| p.name() == *name))
+            {
+                return Err(anyhow!(
+                    "Override of '{secret}' references undeclared secret provider '{name}'"
+                ));
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Expand the `@@NAME@@` placeholders and `${VAR}` references in the given input
+    /// and record the providers resolving them.
+    pub(crate) fn expand(&self, input: &str) -> Result<String, anyhow::Error> {
+        let resolve = |name: &str| {
+            let (value, provider) = self.lookup(name)?;
+            self.resolved
+                .borrow_mut()
+                .insert(name.to_string(), provider.to_string());
+            Some(value)
+        };
+
+        // Escape the resolved secrets so that a `${` in their values is not expanded in turn.
+        let input = expand_placeholders(input, |name| {
+            resolve(name).map(|value| value.replace("${", "$${"))
+        })?;
+        expand_vars(&input, resolve)
+    }
+
+    fn lookup(&self, name: &str) -> Option<(String, &'static str)> {
+        let providers: Vec<&Provider> = match self.overrides.get(name) {
+            Some(names) => names
+                .iter()
+                .filter_map(|n| self.providers.iter().find(|p| p.name() == n))
+                .collect(),
+            None => self.providers.iter().collect(),
+        };
+
+        providers.into_iter().find_map(|provider| {
+            let value = provider.lookup(name)?;
+            debug!(
+                "Resolved secret '{name}' from provider '{}'",
+                provider.name()
+            );
+            Some((value, provider.name()))
+        })
+    }
+
+    /// Names of the providers which resolved each secret. Never includes the values.
+    pub(crate) fn resolved(&self) -> BTreeMap<String, String> {
+        self.resolved.borrow().clone()
+    }
+}
+
+/// Read the secret from the file, dropping the trailing newline added by most editors and `echo`.
+fn read_secret_file(path: &Path) -> Option<String> {
+    match fs::read_to_string(path) {
+        Ok(value) => Some(value.strip_suffix('\n').unwrap_or(&value).to_string()),
+        Err(err) if err.kind() == io::ErrorKind::NotFound => None,
+        Err(err) => {
+            warn!("Failed to read secret file {path:?}: {err}");
+            None
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::cell::RefCell;
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::path::{Path, PathBuf};
+
+    use crate::filesystem::Disk;
+    use crate::keyfile::Keyfile;
+    use crate::secrets::{separate_secrets, write_secret_files, Provider, SecretHandling, Secrets};
+
+    const WIFI_KEYFILE: &str = "[connection]\nid=wlan0\ntype=wifi\n\n\
+                                [wifi-security]\nkey-mgmt=wpa-eap\npsk=secret\n\n\
+                                [802-1x]\neap=tls;\nidentity=user\nprivate-key-password=${KEY_PASSWORD}\n\n\
+                                [wireguard-peer.abc]\npreshared-key=peer-secret\n";
+
+    fn chain(dir: &str, overrides: &[(&str, &[&str])]) -> Secrets {
+        Secrets {
+            providers: vec![
+                Provider::File {
+                    path: PathBuf::from(dir),
+                },
+                Provider::Env,
+            ],
+            overrides: overrides
+                .iter()
+                .map(|(secret, names)| {
+                    (
+                        secret.to_string(),
+                        names.iter().map(|name| name.to_string()).collect(),
+                    )
+                })
+                .collect(),
+            resolved: RefCell::new(BTreeMap::new()),
+        }
+    }
+
+    #[test]
+    fn expand_secrets_from_chain() {
+        let dir = "_secrets";
+        fs::create_dir_all(dir).unwrap();
+        fs::write("_secrets/NMC_TEST_PSK", "file-psk\n").unwrap();
+        fs::write("_secrets/NMC_TEST_TOKEN", "file-token").unwrap();
+        std::env::set_var("NMC_TEST_TOKEN", "env-token");
+        std::env::set_var("NMC_TEST_USER", "env-user");
+
+        let secrets = chain(dir, &[("NMC_TEST_TOKEN", &["env"])]);
+        let output = secrets
+            .expand("psk=${NMC_TEST_PSK}\ntoken=${NMC_TEST_TOKEN}\nuser=${NMC_TEST_USER}\n")
+            .unwrap();
+
+        assert_eq!(output, "psk=file-psk\ntoken=env-token\nuser=env-user\n");
+        assert_eq!(
+            secrets.resolved(),
+            BTreeMap::from([
+                ("NMC_TEST_PSK".to_string(), "file".to_string()),
+                ("NMC_TEST_TOKEN".to_string(), "env".to_string()),
+                ("NMC_TEST_USER".to_string(), "env".to_string()),
+            ])
+        );
+
+        // Placeholders are resolved through the same chain, their values are never expanded in turn
+        fs::write("_secrets/NMC_TEST_KEY", "a${b}").unwrap();
+        let output = secrets
+            .expand("psk=@@NMC_TEST_PSK@@\nkey=@@NMC_TEST_KEY@@\nuser=${NMC_TEST_USER}\n")
+            .unwrap();
+        assert_eq!(output, "psk=file-psk\nkey=a${b}\nuser=env-user\n");
+
+        // An override restricting the providers makes the secret undefined if none of them defines it
+        let secrets = chain(dir, &[("NMC_TEST_USER", &["file"])]);
+        assert!(secrets.expand("user=${NMC_TEST_USER}").is_err());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn validate_secrets_config() {
+        assert!(chain("_secrets", &[("A", &["env", "file"])])
+            .validate()
+            .is_ok());
+        assert!(Secrets::default().validate().is_ok());
+
+        let error = chain("_secrets", &[("A", &["vault"])])
+            .validate()
+            .unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Override of 'A' references undeclared secret provider 'vault'"
+        );
+
+        let mut duplicate = Secrets::default();
+        duplicate.providers.push(Provider::Env);
+        assert!(duplicate.validate().is_err());
+
+        let mut empty = Secrets::default();
+        empty.providers.clear();
+        assert!(empty.validate().is_err());
+    }
+
+    #[test]
+    fn separate_secrets_inline() {
+        let mut keyfile = Keyfile::parse(WIFI_KEYFILE);
+
+        let secrets = separate_secrets("wlan0", &mut keyfile, &SecretHandling::Inline);
+
+        assert!(secrets.is_empty());
+        assert_eq!(keyfile, Keyfile::parse(WIFI_KEYFILE));
+    }
+
+    #[test]
+    fn separate_secrets_for_agent() {
+        let mut keyfile = Keyfile::parse(WIFI_KEYFILE);
+
+        let secrets = separate_secrets("wlan0", &mut keyfile, &SecretHandling::Agent);
+
+        assert!(secrets.is_empty());
+        assert_eq!(keyfile.get("wifi-security", "psk"), None);
+        assert_eq!(keyfile.get("wifi-security", "psk-flags"), Some("1"));
+        assert_eq!(keyfile.get("wireguard-peer.abc", "preshared-key"), None);
+        assert_eq!(
+            keyfile.get("wireguard-peer.abc", "preshared-key-flags"),
+            Some("1")
+        );
+        // References are resolved at apply time
+        assert_eq!(
+            keyfile.get("802-1x", "private-key-password"),
+            Some("${KEY_PASSWORD}")
+        );
+        assert_eq!(keyfile.get("802-1x", "private-key-password-flags"), None);
+    }
+
+    #[test]
+    fn separate_secrets_by_extracting() {
+        let mut keyfile = Keyfile::parse(WIFI_KEYFILE);
+        let handling = SecretHandling::Extract {
+            dir: "_secrets".to_string(),
+        };
+
+        let secrets = separate_secrets("wlan0", &mut keyfile, &handling);
+
+        assert_eq!(
+            secrets,
+            BTreeMap::from([
+                (
+                    "NMC_SECRET_WLAN0_WIFI_SECURITY_PSK".to_string(),
+                    "secret".to_string()
+                ),
+                (
+                    "NMC_SECRET_WLAN0_WIREGUARD_PEER_ABC_PRESHARED_KEY".to_string(),
+                    "peer-secret".to_string()
+                ),
+            ])
+        );
+        assert_eq!(
+            keyfile.get("wifi-security", "psk"),
+            Some("${NMC_SECRET_WLAN0_WIFI_SECURITY_PSK}")
+        );
+        assert_eq!(
+            keyfile.get("wireguard-peer.abc", "preshared-key"),
+            Some("${NMC_SECRET_WLAN0_WIREGUARD_PEER_ABC_PRESHARED_KEY}")
+        );
+    }
+
+    #[test]
+    fn write_secrets_to_files() {
+        let dir = Path::new("_secret_files").join("node1");
+        let secrets = BTreeMap::from([("NMC_SECRET_A".to_string(), "secret".to_string())]);
+
+        write_secret_files(&Disk, &dir, &secrets).unwrap();
+
+        let path = dir.join("NMC_SECRET_A");
+        assert_eq!(fs::read_to_string(&path).unwrap(), "secret");
+        assert_eq!(
+            fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o600
+        );
+
+        // cleanup
+        fs::remove_dir_all("_secret_files").unwrap();
+    }
+
+    #[test]
+    fn load_secrets_config() {
+        assert!(Secrets::load("testdata/apply").unwrap().is_none());
+    }
+}
@@ -0,0 +1,201 @@
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+
+use anyhow::{anyhow, Context};
+
+use crate::variables::Scalar;
+use crate::yaml;
+
+/// Labels of the hosts by their hostnames, e.g.
+///
+/// ```yaml
+/// node1:
+///   site: berlin
+///   role: gateway
+/// ```
+pub(crate) type Labels = BTreeMap<String, BTreeMap<String, String>>;
+
+/// Expression selecting hosts by their labels, e.g. `site=berlin,role!=edge,gpu,!legacy`.
+///
+/// A host is selected if its labels satisfy all requirements of the expression.
+#[derive(Clone, Debug, PartialEq)]
+pub(crate) struct Selector {
+    expression: String,
+    requirements: Vec<Requirement>,
+}
+
+#[derive(Clone, Debug, PartialEq)]
+enum Requirement {
+    Equals(String, String),
+    NotEquals(String, String),
+    Exists(String),
+    NotExists(String),
+}
+
+impl Selector {
+    pub(crate) fn parse(expression: &str) -> Result<Self, anyhow::Error> {
+        let requirements = expression
+            .split(',')
+            .map(|term| parse_requirement(term.trim()))
+            .collect::<Result<_, _>>()?;
+
+        Ok(Selector {
+            expression: expression.to_string(),
+            requirements,
+        })
+    }
+
+    pub(crate) fn matches(&self, labels: &BTreeMap<String, String>) -> bool {
+        self.requirements
+            .iter()
+            .all(|requirement| match requirement {
+                Requirement::Equals(key, value) => labels.get(key) == Some(value),
+                Requirement::NotEquals(key, value) => labels.get(key) != Some(value),
+                Requirement::Exists(key) => labels.contains_key(key),
+                Requirement::NotExists(key) => !labels.contains_key(key),
+            })
+    }
+}
+
+impl fmt::Display for Selector {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.expression)
+    }
+}
+
+fn parse_requirement(term: &str) -> Result<Requirement, anyhow::Error> {
+    let requirement = if let Some(key) = term.strip_prefix('!') {
+        Requirement::NotExists(key.trim().to_string())
+    } else if let Some((key, value)) = term.split_once("!=") {
+        Requirement::NotEquals(key.trim().to_string(), value.trim().to_string())
+    } else if let Some((key, value)) = term.split_once('=') {
+        Requirement::Equals(key.trim().to_string(), value.trim().to_string())
+    } else {
+        Requirement::Exists(term.to_string())
+    };
+
+    let (key, value) = match &requirement {
+        Requirement::Equals(key, value) | Requirement::NotEquals(key, value) => (key, Some(value)),
+        Requirement::Exists(key) | Requirement::NotExists(key) => (key, None),
+    };
+
+    if !is_valid_label(key) || value.is_some_and(|value| !is_valid_label(value)) {
+        return Err(anyhow!("Invalid selector requirement '{term}'"));
+    }
+
+    Ok(requirement)
+}
+
+/// Label keys and values consist of alphanumerics, `-`, `_`, `.` and `/` (e.g. `example.com/site`).
+pub(crate) fn is_valid_label(label: &str) -> bool {
+    !label.is_empty()
+        && label
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.' | '/'))
+}
+
+/// Load the labels of the hosts. Values other than strings (e.g. `rack: 12`) are taken as they are written.
+pub(crate) fn load_labels(path: &str) -> Result<Labels, anyhow::Error> {
+    let file = fs::File::open(path).context("Opening labels file")?;
+    let labels: BTreeMap<String, BTreeMap<String, Scalar>> =
+        yaml::from_reader(file).context("Parsing labels file")?;
+
+    labels
+        .into_iter()
+        .map(|(hostname, labels)| {
+            let labels: BTreeMap<String, String> = labels
+                .into_iter()
+                .map(|(key, value)| (key, value.to_string()))
+                .collect();
+
+            if let Some((key, value)) = labels
+                .iter()
+                .find(|(key, value)| !is_valid_label(key) || !is_valid_label(value))
+            {
+                return Err(anyhow!(
+                    "Invalid label '{key}: {value}' of host '{hostname}'"
+                ));
+            }
+
+            Ok((hostname, labels))
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+
+    use crate::selector::{load_labels, Requirement, Selector};
+
+    fn labels(pairs: &[(&str, &str)]) -> BTreeMap<String, String> {
+        pairs
+            .iter()
+            .map(|(key, value)| (key.to_string(), value.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn parse_selector() {
+        let selector = Selector::parse("site=berlin, role!=edge,gpu,!legacy").unwrap();
+
+        assert_eq!(
+            selector.requirements,
+            vec![
+                Requirement::Equals("site".to_string(), "berlin".to_string()),
+                Requirement::NotEquals("role".to_string(), "edge".to_string()),
+                Requirement::Exists("gpu".to_string()),
+                Requirement::NotExists("legacy".to_string()),
+            ]
+        );
+        assert_eq!(selector.to_string(), "site=berlin, role!=edge,gpu,!legacy");
+
+        for expression in ["", "site=", "=berlin", "site=berlin,", "site=ber lin", "!"] {
+            assert!(Selector::parse(expression).is_err(), "{expression}");
+        }
+    }
+
+    #[test]
+    fn load_labels_of_hosts() {
+        let path = "_labels.yaml";
+        fs::write(
+            path,
+            "node1:\n  site: berlin\n  rack: 12\nnode2:\n  site: paris\n",
+        )
+        .unwrap();
+
+        let loaded = load_labels(path).unwrap();
+        assert_eq!(
+            loaded["node1"],
+            labels(&[("site", "berlin"), ("rack", "12")])
+        );
+        assert_eq!(loaded["node2"], labels(&[("site", "paris")]));
+
+        fs::write(path, "node1:\n  site: new york\n").unwrap();
+        assert_eq!(
+            load_labels(path).unwrap_err().to_string(),
+            "Invalid label 'site: new york' of host 'node1'"
+        );
+
+        // cleanup
+        fs::remove_file(path).unwrap();
+    }
+
+    #[test]
+    fn match_labels() {
+        let selector = Selector::parse("site=berlin,role!=edge,!legacy").unwrap();
+
+        assert!(selector.matches(&labels(&[("site", "berlin"), ("role", "gateway")])));
+        assert!(selector.matches(&labels(&[("site", "berlin")])));
+        assert!(!selector.matches(&labels(&[("site", "berlin"), ("role", "edge")])));
+        assert!(!selector.matches(&labels(&[("site", "berlin"), ("legacy", "true")])));
+        assert!(!selector.matches(&labels(&[("site", "paris")])));
+        assert!(!selector.matches(&BTreeMap::new()));
+
+        let selector = Selector::parse("example.com/gpu").unwrap();
+        assert!(selector.matches(&labels(&[("example.com/gpu", "a100")])));
+        assert!(!selector.matches(&labels(&[("gpu", "a100")])));
+    }
+}
@@ -0,0 +1,798 @@
+use std::env;
+use std::fs;
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::path::Path;
+use std::process::Command;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Context};
+use log::{error, info, warn};
+use network_interface::NetworkInterface;
+use rustls::pki_types::pem::PemObject;
+use rustls::pki_types::{CertificateDer, PrivateKeyDer};
+use rustls::{ServerConfig, ServerConnection, StreamOwned};
+
+use crate::apply_conf::{find_host, parse_config, MatchOptions, NoHostMatched, COMMON_CONFIG_DIR};
+use crate::bundle::Compression;
+use crate::filenames::validate_hostname;
+use crate::infiniband::normalize_address;
+use crate::types::Host;
+use crate::workspace::Workspace;
+use crate::HOST_MAPPING_FILE;
+
+/// Path of the endpoint serving the config of a host, e.g. `GET /config?mac=00:11:22:33:44:55`.
+pub(crate) const CONFIG_PATH: &str = "/config";
+/// Query parameter carrying a MAC address of the requesting machine, repeated for each of its NICs.
+pub(crate) const MAC_PARAM: &str = "mac";
+
+/// Dir within the temporary dir holding the workspace of the server.
+const WORKSPACES_DIR: &str = "nmc-serve";
+/// Bounds of the request head, the server never reads a body.
+const MAX_HEADER_LINES: usize = 64;
+const MAX_HEADER_LINE: u64 = 8192;
+/// Requests taking longer than this are dropped, however steadily the client sends or receives data.
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(10);
+/// Connections accepted while this many requests are being served are dropped.
+const MAX_CONNECTIONS: usize = 64;
+
+/// Distinguishes the host mappings of the archives of concurrent requests in the workspace.
+static ARCHIVES: AtomicUsize = AtomicUsize::new(0);
+
+/// Options of serving the configs of the hosts.
+pub(crate) struct ServeOptions {
+    /// Address to listen on, e.g. `0.0.0.0:8080`.
+    pub(crate) listen: String,
+    /// PEM encoded certificate chain and private key serving HTTPS instead of plain HTTP.
+    pub(crate) tls: Option<(String, String)>,
+    /// File containing the bearer token clients are required to present.
+    pub(crate) token_file: Option<String>,
+    /// Serve the configs without a token to anyone able to connect.
+    pub(crate) insecure: bool,
+    /// Compression of the served archives.
+    pub(crate) compression: Compression,
+    /// How the hosts are identified by the MAC addresses of the requesting machines.
+    pub(crate) matching: MatchOptions,
+}
+
+#[cfg_attr(test, derive(Debug, PartialEq))]
+struct Request {
+    method: String,
+    path: String,
+    query: Vec<(String, String)>,
+    authorization: Option<String>,
+}
+
+#[cfg_attr(test, derive(Debug))]
+struct Response {
+    status: u16,
+    reason: &'static str,
+    headers: Vec<(&'static str, String)>,
+    body: Vec<u8>,
+}
+
+impl Response {
+    fn text(status: u16, reason: &'static str, message: &str) -> Self {
+        Response {
+            status,
+            reason,
+            headers: vec![("Content-Type", "text/plain".to_string())],
+            body: format!("{message}\n").into_bytes(),
+        }
+    }
+}
+
+/// Serve the config of each host in `config_dir` to the machines presenting its MAC addresses.
+///
+/// `GET /config?mac=<address>&mac=<address>...` returns a compressed tar archive of a config dir only
+/// containing the host identified by the addresses the same way `nmc apply` identifies it, ready to be applied.
+/// The config dir is read for each request, so changes (e.g. by `nmc controller`) are picked up without restarting
+/// the server. Each connection is handled by its own thread.
+pub(crate) fn serve(config_dir: &str, options: &ServeOptions) -> Result<(), anyhow::Error> {
+    let token = match &options.token_file {
+        Some(path) => Some(
+            fs::read_to_string(path)
+                .context("Reading token file")?
+                .trim()
+                .to_string(),
+        ),
+        None => None,
+    };
+    if token.as_ref().is_some_and(String::is_empty) {
+        return Err(anyhow!("Token file is empty"));
+    }
+    if token.is_none() && !options.insecure {
+        return Err(anyhow!(
+            "A token file is required, pass --insecure to serve the configs to anyone able to connect"
+        ));
+    }
+
+    let tls = match &options.tls {
+        Some((cert, key)) => Some(Arc::new(tls_config(cert, key)?)),
+        None => None,
+    };
+
+    let workspace = Workspace::create(&env::temp_dir().join(WORKSPACES_DIR))?;
+    let listener = TcpListener::bind(&options.listen)
+        .with_context(|| format!("Listening on {}", options.listen))?;
+
+    info!(
+        "Serving configs of {config_dir:?} via {} on {}",
+        if tls.is_some() { "HTTPS" } else { "HTTP" },
+        options.listen
+    );
+    if token.is_none() {
+        warn!("No token required, the configs are served to anyone able to connect");
+    }
+
+    let server = Server {
+        config_dir,
+        token: token.as_deref(),
+        workspace: &workspace,
+        compression: options.compression,
+        matching: &options.matching,
+    };
+    let active = AtomicUsize::new(0);
+
+    thread::scope(|scope| {
+        for stream in listener.incoming() {
+            let stream = match stream {
+                Ok(stream) => stream,
+                Err(err) => {
+                    warn!("Failed to accept connection: {err}");
+                    continue;
+                }
+            };
+
+            if active.fetch_add(1, Ordering::SeqCst) >= MAX_CONNECTIONS {
+                active.fetch_sub(1, Ordering::SeqCst);
+                warn!("Dropping connection, {MAX_CONNECTIONS} requests are already being served");
+                continue;
+            }
+
+            let (server, active, tls) = (&server, &active, tls.as_ref());
+            let spawned = thread::Builder::new().spawn_scoped(scope, move || {
+                if let Err(err) = handle_connection(stream, tls, server) {
+                    warn!("Failed to handle request: {err:#}");
+                }
+                active.fetch_sub(1, Ordering::SeqCst);
+            });
+            if let Err(err) = spawned {
+                active.fetch_sub(1, Ordering::SeqCst);
+                warn!("Failed to handle request: {err}");
+            }
+        }
+    });
+
+    Ok(())
+}
+
+struct Server<'a> {
+    config_dir: &'a str,
+    token: Option<&'a str>,
+    workspace: &'a Workspace,
+    compression: Compression,
+    matching: &'a MatchOptions,
+}
+
+/// Connection failing reads and writes once the deadline of the request passed, since the timeouts of the socket
+/// would restart with every byte a client trickles in or out.
+struct DeadlineStream {
+    stream: TcpStream,
+    deadline: Instant,
+}
+
+impl DeadlineStream {
+    fn remaining(&self) -> io::Result<Duration> {
+        self.deadline
+            .checked_duration_since(Instant::now())
+            .filter(|remaining| !remaining.is_zero())
+            .ok_or_else(|| io::Error::new(io::ErrorKind::TimedOut, "Request timed out"))
+    }
+}
+
+impl Read for DeadlineStream {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        self.stream.set_read_timeout(Some(self.remaining()?))?;
+        self.stream.read(buf)
+    }
+}
+
+impl Write for DeadlineStream {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.stream.set_write_timeout(Some(self.remaining()?))?;
+        self.stream.write(buf)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.stream.flush()
+    }
+}
+
+fn tls_config(cert: &str, key: &str) -> Result<ServerConfig, anyhow::Error> {
+    let certs = CertificateDer::pem_file_iter(cert)
+        .and_then(|certs| certs.collect::<Result<Vec<_>, _>>())
+        .map_err(|err| anyhow!("Reading TLS certificate: {err}"))?;
+    let key = PrivateKeyDer::from_pem_file(key).map_err(|err| anyhow!("Reading TLS key: {err}"))?;
+
+    ServerConfig::builder_with_provider(Arc::new(rustls::crypto::ring::default_provider()))
+        .with_safe_default_protocol_versions()
+        .and_then(|builder| builder.with_no_client_auth().with_single_cert(certs, key))
+        .context("Setting up TLS")
+}
+
+fn handle_connection(
+    stream: TcpStream,
+    tls: Option<&Arc<ServerConfig>>,
+    server: &Server,
+) -> Result<(), anyhow::Error> {
+    let peer = stream
+        .peer_addr()
+        .map_or("unknown peer".to_string(), |addr| addr.to_string());
+    let stream = DeadlineStream {
+        stream,
+        deadline: Instant::now() + REQUEST_TIMEOUT,
+    };
+
+    match tls {
+        Some(config) => {
+            let connection = ServerConnection::new(config.clone()).context("Setting up TLS")?;
+            handle_stream(StreamOwned::new(connection, stream), &peer, server)
+        }
+        None => handle_stream(stream, &peer, server),
+    }
+}
+
+fn handle_stream<S: Read + Write>(
+    mut stream: S,
+    peer: &str,
+    server: &Server,
+) -> Result<(), anyhow::Error> {
+    let response = match read_request(&mut BufReader::new(&mut stream)) {
+        Ok(request) => route(&request, server),
+        Err(err) => {
+            warn!("Invalid request from {peer}: {err:#}");
+            Response::text(400, "Bad Request", "Invalid request")
+        }
+    };
+    info!("{peer}: {} {}", response.status, response.reason);
+
+    write_response(&mut stream, &response).context("Writing response")
+}
+
+fn read_request(reader: &mut impl BufRead) -> Result<Request, anyhow::Error> {
+    let mut lines = Vec::new();
+
+    loop {
+        let mut line = String::new();
+        reader
+            .take(MAX_HEADER_LINE)
+            .read_line(&mut line)
+            .context("Reading request")?;
+        if !line.ends_with('\n') {
+            return Err(anyhow!("Incomplete request"));
+        }
+
+        let line = line.trim_end().to_string();
+        if line.is_empty() {
+            break;
+        }
+        if lines.len() == MAX_HEADER_LINES {
+            return Err(anyhow!("Too many headers"));
+        }
+        lines.push(line);
+    }
+
+    let request_line = lines.first().ok_or_else(|| anyhow!("Empty request"))?;
+    let mut parts = request_line.split(' ');
+    let (Some(method), Some(target), Some(_version), None) =
+        (parts.next(), parts.next(), parts.next(), parts.next())
+    else {
+        return Err(anyhow!("Invalid request line '{request_line}'"));
+    };
+
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+    let query = query
+        .split('&')
+        .filter(|pair| !pair.is_empty())
+        .map(|pair| {
+            let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+            Ok((percent_decode(key)?, percent_decode(value)?))
+        })
+        .collect::<Result<_, anyhow::Error>>()?;
+
+    let authorization = lines[1..].iter().find_map(|line| {
+        let (name, value) = line.split_once(':')?;
+        name.trim()
+            .eq_ignore_ascii_case("authorization")
+            .then(|| value.trim().to_string())
+    });
+
+    Ok(Request {
+        method: method.to_string(),
+        path: path.to_string(),
+        query,
+        authorization,
+    })
+}
+
+fn percent_decode(value: &str) -> Result<String, anyhow::Error> {
+    let bytes = value.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+
+    let mut i = 0;
+    while i < bytes.len() {
+        match bytes[i] {
+            b'%' => {
+                let hex = bytes
+                    .get(i + 1..i + 3)
+                    .and_then(|hex| std::str::from_utf8(hex).ok())
+                    .and_then(|hex| u8::from_str_radix(hex, 16).ok())
+                    .ok_or_else(|| anyhow!("Invalid percent encoding in '{value}'"))?;
+                decoded.push(hex);
+                i += 3;
+            }
+            b'+' => {
+                decoded.push(b' ');
+                i += 1;
+            }
+            byte => {
+                decoded.push(byte);
+                i += 1;
+            }
+        }
+    }
+
+    String::from_utf8(decoded).map_err(|_| anyhow!("Invalid UTF-8 in '{value}'"))
+}
+
+fn route(request: &Request, server: &Server) -> Response {
+    if request.path != CONFIG_PATH {
+        return Response::text(404, "Not Found", "Not found");
+    }
+    if request.method != "GET" {
+        let mut response = Response::text(405, "Method Not Allowed", "Method not allowed");
+        response.headers.push(("Allow", "GET".to_string()));
+        return response;
+    }
+
+    if let Some(token) = server.token {
+        let presented = request
+            .authorization
+            .as_deref()
+            .and_then(|value| value.strip_prefix("Bearer "));
+        if !presented.is_some_and(|presented| constant_time_eq(presented, token)) {
+            let mut response = Response::text(401, "Unauthorized", "Invalid or missing token");
+            response
+                .headers
+                .push(("WWW-Authenticate", "Bearer".to_string()));
+            return response;
+        }
+    }
+
+    let macs: Vec<String> = request
+        .query
+        .iter()
+        .filter(|(key, _)| key == MAC_PARAM)
+        .map(|(_, value)| value.to_lowercase())
+        .collect();
+    if macs.is_empty() {
+        return Response::text(400, "Bad Request", "Missing 'mac' parameter");
+    }
+
+    match config_response(&macs, server) {
+        Ok(response) => response,
+        Err(err) => {
+            error!("Serving config failed: {err:#}");
+            Response::text(500, "Internal Server Error", "Internal server error")
+        }
+    }
+}
+
+fn config_response(macs: &[String], server: &Server) -> Result<Response, anyhow::Error> {
+    let hosts = parse_config(server.config_dir, server.matching.allow_shared_macs)
+        .context("Parsing config")?;
+    let nics: Vec<NetworkInterface> = macs
+        .iter()
+        .map(|mac| NetworkInterface {
+            name: String::new(),
+            mac_addr: Some(normalize_address(mac)),
+            addr: vec![],
+            index: 0,
+        })
+        .collect();
+
+    let host = match find_host(hosts, &nics, None, server.matching) {
+        Ok(host) => host,
+        Err(err) if err.root_cause().is::<NoHostMatched>() => {
+            info!("MAC addresses {macs:?} do not identify a host: {err:#}");
+            return Ok(Response::text(
+                404,
+                "Not Found",
+                "No host matches the MAC addresses",
+            ));
+        }
+        Err(err) => {
+            warn!("MAC addresses {macs:?} do not identify a single host: {err:#}");
+            return Ok(Response::text(
+                409,
+                "Conflict",
+                "The MAC addresses match multiple hosts",
+            ));
+        }
+    };
+
+    let body = host_archive(
+        server.config_dir,
+        &host,
+        server.compression,
+        server.workspace,
+    )?;
+    info!("Serving config of host '{}'", host.hostname);
+
+    Ok(Response {
+        status: 200,
+        reason: "OK",
+        headers: vec![
+            ("Content-Type", server.compression.media_type().to_string()),
+            (
+                "Content-Disposition",
+                format!(
+                    "attachment; filename=\"{}.{}\"",
+                    host.hostname,
+                    server.compression.extension()
+                ),
+            ),
+        ],
+        body,
+    })
+}
+
+/// Returns a compressed tar archive of a config dir only containing the host, i.e. its entry of the host mapping,
+/// its dir and the `common` dir. Anything else in the config dir (e.g. hooks, secret providers or other hosts)
+/// is never included.
+pub(crate) fn host_archive(
+    config_dir: &str,
+    host: &Host,
+    compression: Compression,
+    workspace: &Workspace,
+) -> Result<Vec<u8>, anyhow::Error> {
+    // The hostname becomes a path of the archive and an argument of tar.
+    validate_hostname(&host.hostname)?;
+
+    let entries: Vec<&str> = [host.hostname.as_str(), COMMON_CONFIG_DIR]
+        .into_iter()
+        .filter(|name| Path::new(config_dir).join(name).is_dir())
+        .collect();
+
+    let mapping_dir = workspace.dir(&format!(
+        "mapping-{}",
+        ARCHIVES.fetch_add(1, Ordering::SeqCst)
+    ))?;
+    let result = (|| {
+        let mapping = serde_yaml::to_string(&[host]).context("Serializing host mapping")?;
+        fs::write(mapping_dir.join(HOST_MAPPING_FILE), mapping).context("Writing host mapping")?;
+
+        let output = Command::new("tar")
+            .arg("--create")
+            .arg(compression.tar_flag())
+            .args(["--file", "-", "--directory"])
+            .arg(&mapping_dir)
+            .arg(HOST_MAPPING_FILE)
+            .arg("--directory")
+            .arg(
+                Path::new(config_dir)
+                    .canonicalize()
+                    .context("Resolving config dir")?,
+            )
+            .arg("--")
+            .args(&entries)
+            .output()
+            .context("Running tar")?;
+        if !output.status.success() {
+            return Err(anyhow!(
+                "tar exited with {}: {}",
+                output.status,
+                String::from_utf8_lossy(&output.stderr).trim()
+            ));
+        }
+
+        Ok(output.stdout)
+    })();
+    fs::remove_dir_all(&mapping_dir).context("Removing host mapping")?;
+
+    result
+}
+
+fn constant_time_eq(a: &str, b: &str) -> bool {
+    a.len() == b.len()
+        && a.bytes()
+            .zip(b.bytes())
+            .fold(0, |diff, (a, b)| diff | (a ^ b))
+            == 0
+}
+
+fn write_response(writer: &mut impl Write, response: &Response) -> Result<(), anyhow::Error> {
+    let mut head = format!("HTTP/1.1 {} {}\r\n", response.status, response.reason);
+    for (name, value) in &response.headers {
+        head.push_str(&format!("{name}: {value}\r\n"));
+    }
+    head.push_str(&format!(
+        "Content-Length: {}\r\nConnection: close\r\n\r\n",
+        response.body.len()
+    ));
+
+    writer.write_all(head.as_bytes())?;
+    writer.write_all(&response.body)?;
+    writer.flush()?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::io::{Cursor, ErrorKind, Read};
+    use std::net::{TcpListener, TcpStream};
+    use std::path::Path;
+    use std::process::Command;
+    use std::time::{Duration, Instant};
+
+    use crate::apply_conf::MatchOptions;
+    use crate::bundle::Compression;
+    use crate::filenames::validate_hostname;
+    use crate::serve::{
+        host_archive, read_request, route, serve, write_response, DeadlineStream, Request,
+        Response, ServeOptions, Server,
+    };
+    use crate::types::Host;
+    use crate::workspace::Workspace;
+
+    fn request(target: &str, authorization: Option<&str>) -> Request {
+        let mut head = format!("GET {target} HTTP/1.1\r\nHost: localhost\r\n");
+        if let Some(value) = authorization {
+            head.push_str(&format!("Authorization: {value}\r\n"));
+        }
+        head.push_str("\r\n");
+
+        read_request(&mut Cursor::new(head)).unwrap()
+    }
+
+    #[test]
+    fn read_requests() {
+        let request = request(
+            "/config?mac=00%3A11:22:33:44:55&mac=AA:BB:CC:DD:EE:FF",
+            Some("Bearer s3cret"),
+        );
+        assert_eq!(
+            request,
+            Request {
+                method: "GET".to_string(),
+                path: "/config".to_string(),
+                query: vec![
+                    ("mac".to_string(), "00:11:22:33:44:55".to_string()),
+                    ("mac".to_string(), "AA:BB:CC:DD:EE:FF".to_string()),
+                ],
+                authorization: Some("Bearer s3cret".to_string()),
+            }
+        );
+
+        for head in [
+            "",
+            "GET /config\r\n\r\n",
+            "GET /config HTTP/1.1\r\n",
+            "GET /config?mac=%zz HTTP/1.1\r\n\r\n",
+        ] {
+            assert!(read_request(&mut Cursor::new(head)).is_err(), "{head:?}");
+        }
+    }
+
+    #[test]
+    fn write_responses() {
+        let mut output = Vec::new();
+        write_response(&mut output, &Response::text(404, "Not Found", "Not found")).unwrap();
+
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 10\r\nConnection: close\r\n\r\nNot found\n"
+        );
+    }
+
+    #[test]
+    fn require_token() {
+        let options = ServeOptions {
+            listen: "127.0.0.1:0".to_string(),
+            tls: None,
+            token_file: None,
+            insecure: false,
+            compression: Compression::default(),
+            matching: MatchOptions::default(),
+        };
+
+        assert_eq!(
+            serve("_serve_token", &options).unwrap_err().to_string(),
+            "A token file is required, pass --insecure to serve the configs to anyone able to connect"
+        );
+    }
+
+    #[test]
+    fn serve_config_of_matched_host() {
+        let dir = Path::new("_serve");
+        let config_dir = dir.join("config");
+        for name in ["node1", "node2", "node3", "common"] {
+            fs::create_dir_all(config_dir.join(name)).unwrap();
+            fs::write(config_dir.join(name).join("eth0.nmconnection"), "").unwrap();
+        }
+        // Only shared by the operator of the config dir
+        fs::create_dir_all(config_dir.join("hooks")).unwrap();
+        fs::create_dir_all(config_dir.join(".git")).unwrap();
+        fs::write(config_dir.join("hooks.yaml"), "").unwrap();
+        fs::write(config_dir.join("secrets.yaml"), "").unwrap();
+        // JSON is valid YAML
+        fs::write(
+            config_dir.join("host_config.yaml"),
+            r#"[
+                {"hostname": "node1", "interfaces": [{"logical_name": "eth0", "mac_address": "00:11:22:33:44:55", "interface_type": "ethernet"}]},
+                {"hostname": "node2", "interfaces": [{"logical_name": "eth0", "mac_address": "00:11:22:33:44:66", "interface_type": "ethernet"}]},
+                {"hostname": "node3", "interfaces": [{"logical_name": "eth0", "mac_address": "00:11:22:33:44:88", "interface_type": "ethernet"}]}
+            ]"#,
+        )
+        .unwrap();
+
+        let workspace = Workspace::create(&dir.join("work")).unwrap();
+        let server = Server {
+            config_dir: config_dir.to_str().unwrap(),
+            token: Some("s3cret"),
+            workspace: &workspace,
+            compression: Compression::Gzip,
+            matching: &MatchOptions::default(),
+        };
+
+        let response = route(
+            &request("/config?mac=00:11:22:33:44:55", Some("Bearer s3cret")),
+            &server,
+        );
+        assert_eq!(response.status, 200);
+
+        let archive = dir.join("node1.tar.gz");
+        fs::write(&archive, &response.body).unwrap();
+        let listing = Command::new("tar")
+            .arg("--list")
+            .arg("--file")
+            .arg(&archive)
+            .output()
+            .unwrap();
+        let mut entries: Vec<String> = String::from_utf8(listing.stdout)
+            .unwrap()
+            .lines()
+            .map(|line| line.trim_end_matches('/').to_string())
+            .collect();
+        entries.sort();
+        assert_eq!(
+            entries,
+            vec![
+                "common",
+                "common/eth0.nmconnection",
+                "host_config.yaml",
+                "node1",
+                "node1/eth0.nmconnection"
+            ]
+        );
+
+        for (target, authorization, status) in [
+            ("/config?mac=00:11:22:33:44:55", None, 401),
+            ("/config?mac=00:11:22:33:44:55", Some("Bearer wrong"), 401),
+            ("/config", Some("Bearer s3cret"), 400),
+            ("/config?mac=00:11:22:33:44:77", Some("Bearer s3cret"), 404),
+            // The first of the hosts matching equally well, like apply picks it
+            (
+                "/config?mac=00:11:22:33:44:66&mac=00:11:22:33:44:88",
+                Some("Bearer s3cret"),
+                200,
+            ),
+            ("/other", Some("Bearer s3cret"), 404),
+        ] {
+            let response = route(&request(target, authorization), &server);
+            assert_eq!(response.status, status, "{target} {authorization:?}");
+        }
+
+        let fail_on_ambiguous = MatchOptions {
+            fail_on_ambiguous: true,
+            ..MatchOptions::default()
+        };
+        let strict_server = Server {
+            matching: &fail_on_ambiguous,
+            ..server
+        };
+        let response = route(
+            &request(
+                "/config?mac=00:11:22:33:44:66&mac=00:11:22:33:44:88",
+                Some("Bearer s3cret"),
+            ),
+            &strict_server,
+        );
+        assert_eq!(response.status, 409);
+
+        let zstd_server = Server {
+            compression: Compression::Zstd,
+            ..strict_server
+        };
+        let response = route(
+            &request("/config?mac=00:11:22:33:44:55", Some("Bearer s3cret")),
+            &zstd_server,
+        );
+        assert_eq!(response.status, 200);
+        assert!(response.body.starts_with(&[0x28, 0xb5, 0x2f, 0xfd]));
+        assert!(response
+            .headers
+            .contains(&("Content-Type", "application/zstd".to_string())));
+
+        // cleanup
+        drop(workspace);
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn archive_invalid_hostnames() {
+        let dir = Path::new("_serve_archive");
+        let config_dir = dir.join("config");
+        fs::create_dir_all(config_dir.join("-node1")).unwrap();
+        fs::create_dir_all(config_dir.join("--checkpoint-action=exec=false")).unwrap();
+        fs::create_dir_all(config_dir.join(".git")).unwrap();
+        let workspace = Workspace::create(&dir.join("work")).unwrap();
+
+        for hostname in [
+            "-node1",
+            "--checkpoint-action=exec=false",
+            "..",
+            ".git",
+            "../config",
+            "node1/../../etc",
+        ] {
+            let host = Host {
+                hostname: hostname.to_string(),
+                ..Default::default()
+            };
+            assert_eq!(
+                host_archive(
+                    config_dir.to_str().unwrap(),
+                    &host,
+                    Compression::Gzip,
+                    &workspace
+                )
+                .unwrap_err()
+                .to_string(),
+                format!("Invalid hostname '{hostname}'")
+            );
+        }
+
+        // cleanup
+        drop(workspace);
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn drop_requests_past_deadline() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let _client = TcpStream::connect(listener.local_addr().unwrap()).unwrap();
+        let (stream, _) = listener.accept().unwrap();
+
+        let mut stream = DeadlineStream {
+            stream,
+            deadline: Instant::now() + Duration::from_millis(100),
+        };
+        let started = Instant::now();
+        let error = stream.read(&mut [0; 16]).unwrap_err();
+        assert!(
+            matches!(error.kind(), ErrorKind::WouldBlock | ErrorKind::TimedOut),
+            "{error:?}"
+        );
+        assert!(started.elapsed() < Duration::from_secs(5));
+
+        let error = stream.read(&mut [0; 16]).unwrap_err();
+        assert_eq!(error.kind(), ErrorKind::TimedOut);
+    }
+}
@@ -0,0 +1,258 @@
+use std::net::{SocketAddr, ToSocketAddrs, UdpSocket};
+use std::process::Command;
+use std::sync::mpsc;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::{anyhow, Context};
+
+use crate::types::{Probe, ProbeType};
+
+const NTP_PORT: u16 = 123;
+const NTP_PACKET_LEN: usize = 48;
+/// First byte of an NTP client request: no leap second warning, version 3 and client mode.
+const NTP_CLIENT_REQUEST: u8 = 0x1b;
+const NTP_SERVER_MODE: u8 = 4;
+
+/// Returns a description of the probe for log messages, e.g. `DNS probe of registry.example.com`.
+pub(crate) fn describe(probe: &Probe) -> String {
+    let kind = match probe.probe_type {
+        ProbeType::Http => "HTTP",
+        ProbeType::Dns => "DNS",
+        ProbeType::Ntp => "NTP",
+    };
+
+    format!("{kind} probe of {}", probe.target)
+}
+
+/// Probe the target of the probe within its timeout.
+pub(crate) fn run(probe: &Probe) -> Result<(), anyhow::Error> {
+    let timeout = Duration::from_secs(probe.timeout);
+
+    match probe.probe_type {
+        ProbeType::Http => probe_http(&probe.target, timeout),
+        ProbeType::Dns => resolve(&probe.target, 0, timeout).map(|_| ()),
+        ProbeType::Ntp => probe_ntp(&probe.target, timeout),
+    }
+}
+
+fn probe_http(url: &str, timeout: Duration) -> Result<(), anyhow::Error> {
+    let output = Command::new("curl")
+        .args([
+            "--silent",
+            "--show-error",
+            "--fail",
+            "--output",
+            "/dev/null",
+        ])
+        .arg("--max-time")
+        .arg(timeout.as_secs().max(1).to_string())
+        .arg(url)
+        .output()
+        .context("Running curl")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "{}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+
+    Ok(())
+}
+
+/// Resolve the name, giving up once the timeout passed, since the resolver of the system may retry for much longer.
+fn resolve(name: &str, port: u16, timeout: Duration) -> Result<Vec<SocketAddr>, anyhow::Error> {
+    let (sender, receiver) = mpsc::channel();
+    let host = name.to_string();
+    // Left behind if it does not finish in time, exiting once the resolver gives up.
+    thread::spawn(move || {
+        let _ = sender.send(
+            (host.as_str(), port)
+                .to_socket_addrs()
+                .map(|addresses| addresses.collect::<Vec<_>>()),
+        );
+    });
+
+    match receiver.recv_timeout(timeout) {
+        Ok(Ok(addresses)) if addresses.is_empty() => {
+            Err(anyhow!("'{name}' did not resolve to any address"))
+        }
+        Ok(Ok(addresses)) => Ok(addresses),
+        Ok(Err(err)) => Err(anyhow!("Resolving '{name}' failed: {err}")),
+        Err(..) => Err(anyhow!(
+            "Resolving '{name}' did not finish within {}s",
+            timeout.as_secs()
+        )),
+    }
+}
+
+/// Send a client request to the time server and expect a server response, e.g. to catch a firewall
+/// dropping NTP which would leave the clock of the machine drifting.
+fn probe_ntp(server: &str, timeout: Duration) -> Result<(), anyhow::Error> {
+    let deadline = Instant::now() + timeout;
+    let (host, port) = split_port(server)?;
+    let address = resolve(host, port, timeout)?[0];
+
+    let socket = UdpSocket::bind(match address {
+        SocketAddr::V4(..) => "0.0.0.0:0",
+        SocketAddr::V6(..) => "[::]:0",
+    })
+    .context("Opening socket")?;
+    socket.connect(address).context("Connecting socket")?;
+    // Zero would disable the timeout.
+    let remaining = deadline.saturating_duration_since(Instant::now());
+    socket
+        .set_read_timeout(Some(remaining.max(Duration::from_millis(1))))
+        .context("Setting timeout")?;
+
+    let mut request = [0; NTP_PACKET_LEN];
+    request[0] = NTP_CLIENT_REQUEST;
+    socket.send(&request).context("Sending request")?;
+
+    let mut response = [0; NTP_PACKET_LEN];
+    let len = socket
+        .recv(&mut response)
+        .with_context(|| format!("No answer from {address}"))?;
+    if !is_ntp_response(&response[..len]) {
+        return Err(anyhow!("Invalid answer from {address}"));
+    }
+
+    Ok(())
+}
+
+/// Returns whether the packet is the response of a synchronized server, i.e. neither a kiss-o'-death packet
+/// (stratum 0) nor one of a server without a time source (stratum 16).
+fn is_ntp_response(packet: &[u8]) -> bool {
+    packet.len() >= NTP_PACKET_LEN
+        && packet[0] & 0x07 == NTP_SERVER_MODE
+        && (1..16).contains(&packet[1])
+}
+
+/// Split the port off the server, e.g. `ntp.example.com:1123`. Bare IPv6 addresses use the NTP port.
+fn split_port(server: &str) -> Result<(&str, u16), anyhow::Error> {
+    let host_port = match server.strip_prefix('[') {
+        Some(bracketed) => bracketed
+            .split_once("]:")
+            .or_else(|| bracketed.strip_suffix(']').map(|host| (host, ""))),
+        None if server.matches(':').count() == 1 => server.split_once(':'),
+        None => Some((server, "")),
+    };
+
+    match host_port {
+        Some((host, "")) => Ok((host, NTP_PORT)),
+        Some((host, port)) => Ok((
+            host,
+            port.parse()
+                .map_err(|_| anyhow!("Invalid port in NTP server '{server}'"))?,
+        )),
+        None => Err(anyhow!("Invalid NTP server '{server}'")),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::UdpSocket;
+    use std::thread;
+
+    use crate::service_probe::{describe, is_ntp_response, run, split_port, NTP_PACKET_LEN};
+    use crate::types::{Probe, ProbeType, Severity};
+
+    fn probe(probe_type: ProbeType, target: &str) -> Probe {
+        Probe {
+            probe_type,
+            target: target.to_string(),
+            timeout: 2,
+            severity: Severity::Critical,
+        }
+    }
+
+    #[test]
+    fn parse_probes() {
+        let probes: Vec<Probe> = serde_yaml::from_str(
+            "- type: http\n  target: https://mgmt.example.com/healthz\n  timeout: 10\n  severity: warn\n\
+             - type: dns\n  target: registry.example.com\n",
+        )
+        .unwrap();
+
+        assert_eq!(
+            probes,
+            vec![
+                Probe {
+                    probe_type: ProbeType::Http,
+                    target: "https://mgmt.example.com/healthz".to_string(),
+                    timeout: 10,
+                    severity: Severity::Warn,
+                },
+                Probe {
+                    probe_type: ProbeType::Dns,
+                    target: "registry.example.com".to_string(),
+                    timeout: 5,
+                    severity: Severity::Critical,
+                },
+            ]
+        );
+        assert!(serde_yaml::from_str::<Vec<Probe>>("- type: icmp\n  target: gw\n").is_err());
+        assert_eq!(describe(&probes[1]), "DNS probe of registry.example.com");
+    }
+
+    #[test]
+    fn split_ntp_ports() {
+        assert_eq!(
+            split_port("ntp.example.com").unwrap(),
+            ("ntp.example.com", 123)
+        );
+        assert_eq!(
+            split_port("ntp.example.com:1123").unwrap(),
+            ("ntp.example.com", 1123)
+        );
+        assert_eq!(split_port("2001:db8::1").unwrap(), ("2001:db8::1", 123));
+        assert_eq!(split_port("[2001:db8::1]").unwrap(), ("2001:db8::1", 123));
+        assert_eq!(
+            split_port("[2001:db8::1]:1123").unwrap(),
+            ("2001:db8::1", 1123)
+        );
+        assert!(split_port("ntp.example.com:ntp").is_err());
+        assert!(split_port("[2001:db8::1").is_err());
+    }
+
+    #[test]
+    fn validate_ntp_responses() {
+        let mut response = [0; NTP_PACKET_LEN];
+        response[0] = 0x1c; // version 3, server mode
+        response[1] = 2;
+        assert!(is_ntp_response(&response));
+        assert!(!is_ntp_response(&response[..NTP_PACKET_LEN - 1]));
+
+        // Kiss-o'-death
+        response[1] = 0;
+        assert!(!is_ntp_response(&response));
+
+        // Echoed client request
+        response[0] = 0x1b;
+        response[1] = 2;
+        assert!(!is_ntp_response(&response));
+    }
+
+    #[test]
+    fn probe_local_services() {
+        assert!(run(&probe(ProbeType::Dns, "localhost")).is_ok());
+        assert!(run(&probe(ProbeType::Dns, "nmc.invalid")).is_err());
+
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let address = server.local_addr().unwrap();
+        let handle = thread::spawn(move || {
+            let mut request = [0; NTP_PACKET_LEN];
+            let (_, client) = server.recv_from(&mut request).unwrap();
+            let mut response = [0; NTP_PACKET_LEN];
+            response[0] = 0x1c;
+            response[1] = 2;
+            server.send_to(&response, client).unwrap();
+        });
+
+        run(&probe(ProbeType::Ntp, &address.to_string())).unwrap();
+        handle.join().unwrap();
+
+        // Nothing answers on the port anymore
+        assert!(run(&probe(ProbeType::Ntp, &address.to_string())).is_err());
+    }
+}
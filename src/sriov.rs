@@ -0,0 +1,184 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::Path;
+
+use log::{info, warn};
+use network_interface::NetworkInterface;
+
+use crate::apply_conf::ConnectionFile;
+use crate::keyfile::Keyfile;
+use crate::types::Host;
+
+/// Returns the PCI address of the local NIC, i.e. the name of the device it is backed by in sysfs.
+fn pci_address(sysfs_net_dir: &str, name: &str) -> Option<String> {
+    let device = fs::read_link(Path::new(sysfs_net_dir).join(name).join("device")).ok()?;
+    Some(device.file_name()?.to_string_lossy().to_string())
+}
+
+/// Point the interfaces of the identified host declaring a PCI address instead of a MAC address to the local NIC
+/// at that address, so that they are renamed and checked like those matched by MAC address.
+///
+/// This only happens after identifying the host, since machines of the same model share their PCI addresses.
+pub(crate) fn map_pci_addresses(
+    host: &mut Host,
+    network_interfaces: &[NetworkInterface],
+    sysfs_net_dir: &str,
+) {
+    for interface in &mut host.interfaces {
+        let Some(address) = &interface.pci_address else {
+            continue;
+        };
+        if interface.mac_address.is_some() {
+            continue;
+        }
+
+        let nic = network_interfaces.iter().find(|nic| {
+            pci_address(sysfs_net_dir, &nic.name).is_some_and(|nic_address| nic_address == *address)
+        });
+        match nic {
+            Some(nic) if nic.mac_addr.is_some() => {
+                info!(
+                    "Located interface '{}' at PCI address {address} as '{}'",
+                    interface.logical_name, nic.name
+                );
+                interface.mac_address = nic.mac_addr.clone();
+            }
+            _ => warn!(
+                "No NIC found at PCI address {address} of interface '{}'",
+                interface.logical_name
+            ),
+        }
+    }
+}
+
+/// Set the number of virtual functions of the host's SR-IOV physical functions in their connection files,
+/// so that NetworkManager creates them when activating the connection.
+pub(crate) fn configure_vfs(
+    host: &Host,
+    local_interfaces: &HashMap<String, String>,
+    connection_files: &mut [ConnectionFile],
+) {
+    for interface in &host.interfaces {
+        let Some(sriov) = interface.sriov else {
+            continue;
+        };
+
+        let name = local_interfaces
+            .get(&interface.logical_name)
+            .unwrap_or(&interface.logical_name);
+        let Some(file) = connection_files.iter_mut().find(|file| file.name == *name) else {
+            warn!(
+                "No connection file for SR-IOV interface '{}', skipping its virtual functions",
+                interface.logical_name
+            );
+            continue;
+        };
+
+        let mut keyfile = Keyfile::parse(&file.contents);
+        let total_vfs = sriov.total_vfs.to_string();
+        if keyfile.get("sriov", "total-vfs") == Some(total_vfs.as_str()) {
+            continue;
+        }
+
+        info!("Configuring {total_vfs} virtual functions of '{name}'");
+        keyfile.set("sriov", "total-vfs", &total_vfs);
+        file.contents = keyfile.to_string();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+    use std::fs;
+    use std::os::unix::fs::symlink;
+    use std::path::Path;
+
+    use network_interface::NetworkInterface;
+
+    use crate::apply_conf::ConnectionFile;
+    use crate::sriov::{configure_vfs, map_pci_addresses};
+    use crate::types::{Host, Interface, Sriov};
+
+    fn interface(
+        logical_name: &str,
+        pci_address: Option<&str>,
+        total_vfs: Option<u32>,
+    ) -> Interface {
+        Interface {
+            logical_name: logical_name.to_string(),
+            interface_type: "ethernet".to_string(),
+            pci_address: pci_address.map(str::to_string),
+            sriov: total_vfs.map(|total_vfs| Sriov { total_vfs }),
+            ..Default::default()
+        }
+    }
+
+    fn host(interfaces: Vec<Interface>) -> Host {
+        Host {
+            hostname: "node1".to_string(),
+            interfaces,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn map_pci_addresses_of_interfaces() {
+        let sysfs = Path::new("_sriov_sysfs");
+        let devices = Path::new("_sriov_devices");
+        fs::create_dir_all(sysfs.join("ens1f0")).unwrap();
+        fs::create_dir_all(devices.join("0000:3b:00.0")).unwrap();
+        symlink(
+            fs::canonicalize(devices.join("0000:3b:00.0")).unwrap(),
+            sysfs.join("ens1f0").join("device"),
+        )
+        .unwrap();
+
+        let mut host = host(vec![
+            interface("eth0", Some("0000:3b:00.0"), None),
+            interface("eth1", Some("0000:3b:00.1"), None),
+        ]);
+        let network_interfaces = [NetworkInterface {
+            name: "ens1f0".to_string(),
+            mac_addr: Some("00:11:22:33:44:55".to_string()),
+            addr: vec![],
+            index: 0,
+        }];
+
+        map_pci_addresses(&mut host, &network_interfaces, sysfs.to_str().unwrap());
+        assert_eq!(
+            host.interfaces[0].mac_address.as_deref(),
+            Some("00:11:22:33:44:55")
+        );
+        assert_eq!(host.interfaces[1].mac_address, None);
+
+        // cleanup
+        fs::remove_dir_all(sysfs).unwrap();
+        fs::remove_dir_all(devices).unwrap();
+    }
+
+    #[test]
+    fn configure_virtual_functions() {
+        let host = host(vec![
+            interface("eth0", None, Some(8)),
+            interface("eth1", None, None),
+        ]);
+        let local_interfaces = HashMap::from([("eth0".to_string(), "ens1f0".to_string())]);
+        let mut files = vec![
+            ConnectionFile {
+                name: "ens1f0".to_string(),
+                contents: "[connection]\nid=ens1f0\n\n[sriov]\ntotal-vfs=2\n".to_string(),
+            },
+            ConnectionFile {
+                name: "eth1".to_string(),
+                contents: "[connection]\nid=eth1\n".to_string(),
+            },
+        ];
+
+        configure_vfs(&host, &local_interfaces, &mut files);
+        assert_eq!(
+            files[0].contents,
+            "[connection]\nid=ens1f0\n\n[sriov]\ntotal-vfs=8\n"
+        );
+        assert_eq!(files[1].contents, "[connection]\nid=eth1\n");
+    }
+}
@@ -0,0 +1,180 @@
+use std::collections::BTreeMap;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use anyhow::Context;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::filesystem::FileSystem;
+use crate::types::{Probe, Verification};
+
+/// File recording what NMC stored on the local system during the last apply.
+pub(crate) const STATE_FILE: &str = "/var/lib/nm-configurator/state.yaml";
+
+#[derive(Serialize, Deserialize, Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+pub(crate) struct State {
+    pub(crate) hostname: String,
+    pub(crate) connection_files: Vec<PathBuf>,
+    /// SHA-256 digests of the stored connection files used for detecting modifications.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub(crate) checksums: BTreeMap<PathBuf, String>,
+    /// Verification policies of the interfaces by their local names.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub(crate) verification: BTreeMap<String, Verification>,
+    /// Probes of the services the host has to reach.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub(crate) probes: Vec<Probe>,
+}
+
+impl State {
+    /// Load the state from the given path. Returns `None` if NMC has not stored any state yet.
+    pub(crate) fn load(
+        filesystem: &dyn FileSystem,
+        path: &str,
+    ) -> Result<Option<State>, anyhow::Error> {
+        let Some(contents) = filesystem
+            .read(Path::new(path))
+            .context("Reading state file")?
+        else {
+            return Ok(None);
+        };
+
+        let state = serde_yaml::from_slice(&contents).context("Parsing state file")?;
+
+        Ok(Some(state))
+    }
+
+    pub(crate) fn save(
+        &self,
+        filesystem: &dyn FileSystem,
+        path: &str,
+    ) -> Result<(), anyhow::Error> {
+        if let Some(dir) = Path::new(path).parent() {
+            filesystem
+                .create_dir_all(dir)
+                .context("Creating state dir")?;
+        }
+
+        let contents = serde_yaml::to_string(self).context("Serializing state")?;
+        filesystem
+            .write(Path::new(path), contents.as_bytes(), 0o666)
+            .context("Writing state file")
+    }
+
+    pub(crate) fn manages(&self, path: &Path) -> bool {
+        self.connection_files.iter().any(|file| file == path)
+    }
+}
+
+/// Returns the hex encoded SHA-256 digest of the file contents.
+pub(crate) fn checksum(filesystem: &dyn FileSystem, path: &Path) -> io::Result<String> {
+    let contents = filesystem
+        .read(path)?
+        .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, format!("{path:?}")))?;
+    Ok(digest(&contents))
+}
+
+/// Returns the hex encoded SHA-256 digest of the contents.
+pub(crate) fn digest(contents: &[u8]) -> String {
+    Sha256::digest(contents)
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::path::{Path, PathBuf};
+
+    use crate::filesystem::{Disk, Memory};
+    use crate::state::{checksum, State};
+    use crate::types::{Probe, ProbeType, Severity, Verification};
+
+    #[test]
+    fn save_and_load_state() {
+        let path = "_state/state.yaml";
+        let state = State {
+            hostname: "node1".to_string(),
+            connection_files: vec![PathBuf::from("/etc/eth0.nmconnection")],
+            checksums: BTreeMap::from([(
+                PathBuf::from("/etc/eth0.nmconnection"),
+                "abc123".to_string(),
+            )]),
+            verification: BTreeMap::from([(
+                "wwan0".to_string(),
+                Verification {
+                    timeout: 120,
+                    severity: Severity::Warn,
+                },
+            )]),
+            probes: vec![Probe {
+                probe_type: ProbeType::Dns,
+                target: "registry.example.com".to_string(),
+                timeout: 5,
+                severity: Severity::Critical,
+            }],
+        };
+
+        assert!(State::load(&Disk, path).unwrap().is_none());
+
+        state.save(&Disk, path).unwrap();
+        assert_eq!(State::load(&Disk, path).unwrap(), Some(state));
+
+        // Only the given filesystem is written
+        let memory = Memory::default();
+        let state = State::load(&Disk, path).unwrap().unwrap();
+        state.save(&memory, "_state_memory/state.yaml").unwrap();
+        assert_eq!(
+            State::load(&memory, "_state_memory/state.yaml").unwrap(),
+            Some(state)
+        );
+        assert!(!Path::new("_state_memory").exists());
+
+        // cleanup
+        fs::remove_dir_all("_state").unwrap();
+    }
+
+    #[test]
+    fn state_manages_files() {
+        let state = State {
+            hostname: "node1".to_string(),
+            connection_files: vec![PathBuf::from("/etc/eth0.nmconnection")],
+            checksums: BTreeMap::new(),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        };
+
+        assert!(state.manages(Path::new("/etc/eth0.nmconnection")));
+        assert!(!state.manages(Path::new("/etc/eth1.nmconnection")));
+    }
+
+    #[test]
+    fn load_state_without_checksums() {
+        let path = "_state_legacy/state.yaml";
+        fs::create_dir_all("_state_legacy").unwrap();
+        fs::write(
+            path,
+            "hostname: node1\nconnection_files:\n- /etc/eth0.nmconnection\n",
+        )
+        .unwrap();
+
+        let state = State::load(&Disk, path).unwrap().unwrap();
+        assert!(state.checksums.is_empty());
+
+        // cleanup
+        fs::remove_dir_all("_state_legacy").unwrap();
+    }
+
+    #[test]
+    fn checksum_file_contents() {
+        assert_eq!(
+            checksum(&Disk, Path::new("testdata/apply/node1/eth0.nmconnection")).unwrap(),
+            "fbadf742abf8ae1cc838f58f10ebf2f4a44fefecc1a16d873646b3b2ef03437b"
+        );
+        assert!(checksum(&Disk, Path::new("<missing>")).is_err());
+    }
+}
@@ -0,0 +1,263 @@
+use std::env;
+use std::ffi::OsStr;
+use std::fs;
+use std::io;
+use std::os::linux::net::SocketAddrExt;
+use std::os::unix::net::{SocketAddr, UnixDatagram};
+use std::path::Path;
+
+use anyhow::Context;
+use log::{debug, info};
+
+use crate::filesystem::WriteFailed;
+
+/// Environment variable holding the socket of the service manager if the process runs as a `Type=notify` service.
+const NOTIFY_SOCKET_ENV: &str = "NOTIFY_SOCKET";
+
+const SERVICE_UNIT: &str = "nm-configurator.service";
+const PATH_UNIT: &str = "nm-configurator.path";
+
+/// Options of the generated systemd units.
+pub(crate) struct UnitOptions {
+    /// Path of the nmc binary executed by the service.
+    pub(crate) exec_path: String,
+    /// Config dir watched by the service, usually delivered by e.g. combustion or ignition.
+    pub(crate) config_dir: String,
+    /// Seconds between checking the config dir for changes.
+    pub(crate) interval: u64,
+}
+
+/// Tell the service manager that the service finished starting up along with its current status.
+pub(crate) fn notify_ready(status: &str) {
+    notify(&format!("READY=1\nSTATUS={}", single_line(status)));
+}
+
+pub(crate) fn notify_status(status: &str) {
+    notify(&format!("STATUS={}", single_line(status)));
+}
+
+/// Tell the service manager why the service failed, including the OS error code if the failure was caused by one.
+pub(crate) fn notify_failed(err: &anyhow::Error) {
+    notify(&failure_state(err));
+}
+
+fn failure_state(err: &anyhow::Error) -> String {
+    let mut state = format!("STATUS=Failed: {}", single_line(&format!("{err:#}")));
+
+    if let Some(errno) = err
+        .chain()
+        .filter_map(|cause| cause.downcast_ref::<io::Error>())
+        .map(|err| WriteFailed::unwrap(err).unwrap_or(err))
+        .find_map(io::Error::raw_os_error)
+    {
+        state.push_str(&format!("\nERRNO={errno}"));
+    }
+
+    state
+}
+
+fn single_line(status: &str) -> String {
+    status.replace('\n', " ")
+}
+
+/// Send the state to the service manager. Does nothing if the process was not started by it.
+fn notify(state: &str) {
+    let Some(socket) = env::var_os(NOTIFY_SOCKET_ENV) else {
+        return;
+    };
+
+    if let Err(err) = send(&socket, state) {
+        debug!("Failed to notify the service manager via {socket:?}: {err}");
+    }
+}
+
+/// Send the state as a single datagram to the socket, which is located in the abstract namespace
+/// if its name starts with `@`.
+fn send(socket: &OsStr, state: &str) -> io::Result<()> {
+    let datagram = UnixDatagram::unbound()?;
+
+    match socket.as_encoded_bytes().strip_prefix(b"@") {
+        Some(name) => {
+            let address = SocketAddr::from_abstract_name(name)?;
+            datagram.send_to_addr(state.as_bytes(), &address)?;
+        }
+        None => {
+            datagram.send_to(state.as_bytes(), socket)?;
+        }
+    }
+
+    Ok(())
+}
+
+/// Print the recommended systemd units to stdout (`output` is `-`) or install them in the `output` dir
+/// (e.g. `/etc/systemd/system`).
+pub(crate) fn print_units(options: &UnitOptions, output: &str) -> Result<(), anyhow::Error> {
+    let units = units(options);
+
+    if output == "-" {
+        let units: Vec<String> = units
+            .iter()
+            .map(|(name, content)| format!("# {name}\n{content}"))
+            .collect();
+        print!("{}", units.join("\n"));
+        return Ok(());
+    }
+
+    fs::create_dir_all(output).context("Creating unit dir")?;
+
+    units.iter().try_for_each(|(name, content)| {
+        let path = Path::new(output).join(name);
+        fs::write(&path, content).with_context(|| format!("Writing unit file {path:?}"))?;
+        info!("Installed {path:?}");
+        Ok(())
+    })
+}
+
+/// The service applies the config once it is present and keeps watching it for changes.
+/// It is started by the path unit, so that nodes receiving the config late in the boot process are covered as well.
+fn units(options: &UnitOptions) -> [(&'static str, String); 2] {
+    let UnitOptions {
+        exec_path,
+        config_dir,
+        interval,
+    } = options;
+
+    let service = format!(
+        "[Unit]
+Description=Apply the static network configuration of the host
+Documentation=https://github.com/suse-edge/nm-configurator
+Wants=network-pre.target
+Before=network-pre.target NetworkManager.service
+ConditionPathExists={config_dir}/host_config.yaml
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={exec_path} apply --config-dir {config_dir} --watch {interval} --log-target journal
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+"
+    );
+
+    let path = format!(
+        "[Unit]
+Description=Start nm-configurator once the static network configuration of the host is delivered
+
+[Path]
+PathExists={config_dir}/host_config.yaml
+Unit={SERVICE_UNIT}
+
+[Install]
+WantedBy=paths.target
+"
+    );
+
+    [(SERVICE_UNIT, service), (PATH_UNIT, path)]
+}
+
+#[cfg(test)]
+mod tests {
+    use std::ffi::OsStr;
+    use std::fs;
+    use std::io;
+    use std::os::linux::net::SocketAddrExt;
+    use std::os::unix::net::{SocketAddr, UnixDatagram};
+    use std::path::Path;
+
+    use anyhow::Context;
+
+    use crate::filesystem::{Disk, FileSystem};
+    use crate::systemd::{failure_state, print_units, send, units, UnitOptions};
+
+    fn options() -> UnitOptions {
+        UnitOptions {
+            exec_path: "/usr/bin/nmc".to_string(),
+            config_dir: "/var/lib/nm-configurator/config".to_string(),
+            interval: 30,
+        }
+    }
+
+    #[test]
+    fn send_notifications() {
+        let dir = Path::new("_systemd_notify");
+        fs::create_dir_all(dir).unwrap();
+        let path = dir.join("notify.sock");
+        let _ = fs::remove_file(&path);
+
+        let receiver = UnixDatagram::bind(&path).unwrap();
+        send(path.as_os_str(), "READY=1\nSTATUS=Applied config").unwrap();
+
+        let mut buf = [0; 64];
+        let len = receiver.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..len], b"READY=1\nSTATUS=Applied config");
+
+        let address = SocketAddr::from_abstract_name(b"nmc-test-notify").unwrap();
+        let receiver = UnixDatagram::bind_addr(&address).unwrap();
+        send(OsStr::new("@nmc-test-notify"), "STATUS=Applied config").unwrap();
+
+        let len = receiver.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..len], b"STATUS=Applied config");
+
+        assert!(send(OsStr::new("<missing>"), "READY=1").is_err());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn format_failure_state() {
+        let err = anyhow::anyhow!("No host matched");
+        assert_eq!(failure_state(&err), "STATUS=Failed: No host matched");
+
+        let err = Err::<(), _>(io::Error::from_raw_os_error(libc::EACCES))
+            .context("Writing config file")
+            .unwrap_err();
+        let state = failure_state(&err);
+        assert!(state.starts_with("STATUS=Failed: Writing config file: "));
+        assert!(state.ends_with(&format!("\nERRNO={}", libc::EACCES)));
+
+        let err = Disk
+            .write(Path::new("_systemd_missing/file"), b"contents", 0o600)
+            .context("Storing connection files")
+            .unwrap_err();
+        assert!(failure_state(&err).ends_with(&format!("\nERRNO={}", libc::ENOENT)));
+    }
+
+    #[test]
+    fn generate_units() {
+        let [(service_name, service), (path_name, path)] = units(&options());
+
+        assert_eq!(service_name, "nm-configurator.service");
+        assert!(service.contains("Type=notify\n"));
+        assert!(service.contains(
+            "ExecStart=/usr/bin/nmc apply --config-dir /var/lib/nm-configurator/config --watch 30"
+        ));
+
+        assert_eq!(path_name, "nm-configurator.path");
+        assert!(path.contains("PathExists=/var/lib/nm-configurator/config/host_config.yaml\n"));
+        assert!(path.contains("Unit=nm-configurator.service\n"));
+    }
+
+    #[test]
+    fn install_units() {
+        let dir = "_systemd_units";
+
+        print_units(&options(), dir).unwrap();
+
+        let [(service_name, service), (path_name, path)] = units(&options());
+        assert_eq!(
+            fs::read_to_string(Path::new(dir).join(service_name)).unwrap(),
+            service
+        );
+        assert_eq!(
+            fs::read_to_string(Path::new(dir).join(path_name)).unwrap(),
+            path
+        );
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
@@ -1,13 +1,52 @@
+use std::collections::BTreeMap;
+
+use nmstate::InterfaceType;
 use serde::{Deserialize, Serialize};
 
-#[derive(Serialize, Deserialize, Debug)]
+/// Separates the interface name from the profile name in the names of additional profiles, e.g. `eth0@dhcp`.
+pub(crate) const PROFILE_SEPARATOR: char = '@';
+/// Suffixes nmstate appends to the connection names of OVS bridges, interfaces and ports, since a bridge
+/// usually shares its name with its internal interface and a port with the interface attached to it.
+const OVS_BRIDGE_SUFFIX: &str = "-br";
+const OVS_INTERFACE_SUFFIX: &str = "-if";
+const OVS_PORT_SUFFIX: &str = "-port";
+
+/// Host of `host_config.yaml` along with the interfaces identifying it.
+#[derive(Serialize, Deserialize, Debug, Default)]
 #[cfg_attr(test, derive(PartialEq))]
 pub struct Host {
     pub(crate) hostname: String,
+    /// Whether local NICs not covered by the host's profiles get a DHCP fallback profile,
+    /// overriding the `--dhcp-fallback` flag of `apply`.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) dhcp_fallback: Option<bool>,
+    /// How many of the host's NICs have to be present locally for it to match,
+    /// overriding the `--match` flag of `apply` and `identify`.
+    #[serde(rename = "match", skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) match_mode: Option<MatchMode>,
+    /// Labels selecting the host along with others, e.g. `site: berlin`.
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    #[serde(default)]
+    pub(crate) labels: BTreeMap<String, String>,
+    /// Name servers added to the host's connections which don't declare their own.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) dns: Option<Dns>,
+    /// Time servers stored as a drop-in of the host's NTP client.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) ntp: Option<Ntp>,
+    /// Services the host has to reach once its config is active, probed by `verify`.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    #[serde(default)]
+    pub(crate) probes: Vec<Probe>,
     pub(crate) interfaces: Vec<Interface>,
 }
 
-#[derive(Serialize, Deserialize, Debug)]
+/// Preconfigured interface of a host.
+#[derive(Serialize, Deserialize, Debug, Default)]
 #[cfg_attr(test, derive(PartialEq))]
 pub struct Interface {
     pub(crate) logical_name: String,
@@ -15,4 +54,195 @@ pub struct Interface {
     #[serde(default)]
     pub(crate) mac_address: Option<String>,
     pub(crate) interface_type: String,
+    /// Marks the interface providing remote access to the host.
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    #[serde(default)]
+    pub(crate) management: bool,
+    /// Free-form description of the interface (ifalias) e.g. "uplink to sw-03 port 12".
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) description: Option<String>,
+    /// Alternative names of the interface.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    #[serde(default)]
+    pub(crate) altnames: Vec<String>,
+    /// How the interface is checked by `verify`.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) verification: Option<Verification>,
+    /// Additional connection profiles of the interface (e.g. a DHCP fallback),
+    /// stored next to the primary one as `<logical_name>@<profile>`.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    #[serde(default)]
+    pub(crate) profiles: Vec<String>,
+    /// PCI address of the NIC, e.g. `0000:3b:00.0`, locating it after the host was identified
+    /// if the interface has no MAC address.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) pci_address: Option<String>,
+    /// Virtual functions of an SR-IOV physical function.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) sriov: Option<Sriov>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct Sriov {
+    /// Number of virtual functions created on the physical function.
+    pub(crate) total_vfs: u32,
+}
+
+impl Interface {
+    /// Returns the names of the connections of the interface, the primary one (named after the interface) first.
+    pub(crate) fn connection_names(&self) -> Vec<String> {
+        let mut names = vec![self.connection_name()];
+        names.extend(
+            self.profiles
+                .iter()
+                .map(|profile| profile_name(&self.logical_name, profile)),
+        );
+        names
+    }
+
+    /// Returns the name of the primary connection of the interface, which is the interface name
+    /// except for OVS bridges and interfaces, e.g. `br0-br` and `br0-if`.
+    pub(crate) fn connection_name(&self) -> String {
+        let suffix = if self.interface_type == InterfaceType::OvsBridge.to_string() {
+            OVS_BRIDGE_SUFFIX
+        } else if self.interface_type == InterfaceType::OvsInterface.to_string() {
+            OVS_INTERFACE_SUFFIX
+        } else {
+            ""
+        };
+
+        format!("{}{suffix}", self.logical_name)
+    }
+
+    /// Returns the name of the connection of the OVS port the interface may be attached to, e.g. `eth0-port`,
+    /// which only exists if the interface is part of an OVS bridge. Bridges themselves are never attached to one.
+    pub(crate) fn ovs_port_name(&self) -> Option<String> {
+        (self.interface_type != InterfaceType::OvsBridge.to_string())
+            .then(|| format!("{}{OVS_PORT_SUFFIX}", self.logical_name))
+    }
+
+    /// Returns whether the interface is a NIC identified by its hardware address, i.e. an Ethernet or InfiniBand one.
+    pub(crate) fn is_nic(&self) -> bool {
+        self.interface_type == InterfaceType::Ethernet.to_string()
+            || self.interface_type == InterfaceType::InfiniBand.to_string()
+    }
+}
+
+/// Returns the name of an additional profile of the interface.
+pub(crate) fn profile_name(interface: &str, profile: &str) -> String {
+    format!("{interface}{PROFILE_SEPARATOR}{profile}")
+}
+
+/// Returns the name of the interface a connection belongs to, e.g. `eth0` for both `eth0` and `eth0@dhcp`.
+pub(crate) fn interface_of(connection_name: &str) -> &str {
+    connection_name
+        .split_once(PROFILE_SEPARATOR)
+        .map_or(connection_name, |(interface, _)| interface)
+}
+
+/// Returns the name of the connection after renaming the interface it belongs to, keeping the profile name.
+pub(crate) fn rename_connection(connection_name: &str, interface: &str) -> String {
+    match connection_name.split_once(PROFILE_SEPARATOR) {
+        Some((_, profile)) => profile_name(interface, profile),
+        None => interface.to_string(),
+    }
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct Verification {
+    /// Seconds to wait for the link to come up, e.g. for LTE modems or bridges waiting for STP to converge.
+    #[serde(default)]
+    pub(crate) timeout: u64,
+    #[serde(default)]
+    pub(crate) severity: Severity,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct Probe {
+    #[serde(rename = "type")]
+    pub(crate) probe_type: ProbeType,
+    /// URL, name or time server probed, depending on the type.
+    pub(crate) target: String,
+    /// Seconds to wait for the answer.
+    #[serde(default = "default_probe_timeout")]
+    pub(crate) timeout: u64,
+    #[serde(default)]
+    pub(crate) severity: Severity,
+}
+
+fn default_probe_timeout() -> u64 {
+    5
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum ProbeType {
+    /// GET request of a URL expecting a successful status, e.g. of the management endpoint.
+    Http,
+    /// Resolution of a name to at least one address.
+    Dns,
+    /// Time request to an NTP server, `host` or `host:port`.
+    Ntp,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Default, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct Dns {
+    /// IPv4 and IPv6 addresses of the name servers, each added to the settings of its address family.
+    #[serde(default)]
+    pub(crate) servers: Vec<String>,
+    /// Search domains, e.g. `example.com`.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    #[serde(default)]
+    pub(crate) search: Vec<String>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Default, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct Ntp {
+    /// Host names or addresses of the time servers.
+    #[serde(default)]
+    pub(crate) servers: Vec<String>,
+    /// Client the drop-in is written for, detected on the machine if not set.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    #[serde(default)]
+    pub(crate) client: Option<NtpClient>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum NtpClient {
+    Chrony,
+    Timesyncd,
+}
+
+/// How many of a host's NICs have to be present locally for the host to match.
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, Default, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum MatchMode {
+    /// Any of the MAC addresses of the host.
+    #[default]
+    Any,
+    /// All MAC addresses of the host's Ethernet interfaces, so that an address copied into the wrong host
+    /// does not select it.
+    All,
+}
+
+/// Whether failed checks of an interface or probes fail the verification.
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, Default, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    #[default]
+    Critical,
+    /// Failed checks are only logged.
+    Warn,
+    /// Failed checks are not even logged.
+    Ignore,
 }
@@ -0,0 +1,342 @@
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use anyhow::{anyhow, Context};
+use log::{info, warn};
+
+use crate::apply_conf::{
+    CONFIG_DIR, NO_AUTO_DEFAULT_FILE, RUNTIME_CONFIG_DIR, SYSTEMD_NETWORK_DIR, UDEV_RULES_FILE,
+};
+use crate::deadline;
+use crate::filesystem::Disk;
+use crate::lock::{RunLock, LOCK_FILE};
+use crate::rename::{GENERATED_HEADER, LINK_FILE_PREFIX};
+use crate::state::{checksum, State, STATE_FILE};
+
+/// Options of removing what NMC stored on this machine.
+pub(crate) struct UninstallOptions {
+    /// Remove the tracked files even if they were modified since NMC stored them.
+    pub(crate) force: bool,
+    /// Reload NetworkManager once the files are removed.
+    pub(crate) reload: bool,
+    /// Wait for a concurrent run to finish instead of failing.
+    pub(crate) wait_for_lock: bool,
+}
+
+/// Remove everything NMC stored on this machine, e.g. for decommissioning a node or reverting to manual management.
+///
+/// This covers the connection files, NetworkManager.conf drop-ins and dispatcher scripts tracked in the state,
+/// the drop-ins disabling the default wired connections (in /etc and, of transient runs, in /run), the generated
+/// udev rules and systemd.link files and finally the state dir itself. NMC keeps no backups of the files it replaced,
+/// so there is nothing to restore.
+///
+/// Tracked files kept because they were modified stay tracked, so that a later run with `force` still removes them.
+/// The state dir is then only rewritten to track them instead of being removed.
+pub(crate) fn uninstall(options: &UninstallOptions) -> Result<(), anyhow::Error> {
+    let _lock = RunLock::acquire(LOCK_FILE, options.wait_for_lock)?;
+
+    let state = State::load(&Disk, STATE_FILE).context("Loading state")?;
+    let (mut removed, kept) = match &state {
+        Some(state) => remove_tracked_files(state, options.force)?,
+        None => {
+            info!("No state found, NMC has not stored any files on this machine");
+            (Vec::new(), Vec::new())
+        }
+    };
+
+    removed.extend(
+        remove_generated_files(
+            &[CONFIG_DIR, RUNTIME_CONFIG_DIR].map(|dir| Path::new(dir).join(NO_AUTO_DEFAULT_FILE)),
+            Path::new(UDEV_RULES_FILE),
+            Path::new(SYSTEMD_NETWORK_DIR),
+            state
+                .as_ref()
+                .map(|state| state.connection_files.as_slice())
+                .unwrap_or_default(),
+        )
+        .context("Removing generated files")?,
+    );
+
+    if options.reload {
+        if let Err(err) = reload_network_manager() {
+            warn!("Failed to reload NetworkManager, restart it to drop the removed connections: {err:#}");
+        }
+    }
+
+    if let Some(state) = state.filter(|_| !kept.is_empty()) {
+        tracking_only(state, &kept)
+            .save(&Disk, STATE_FILE)
+            .context("Saving state")?;
+        info!(
+            "Keeping state dir tracking {} modified file(s), pass --force to remove them",
+            kept.len()
+        );
+    } else if let Some(dir) = Path::new(STATE_FILE).parent() {
+        match fs::remove_dir_all(dir) {
+            Ok(..) => info!("Removed state dir {dir:?}"),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => {}
+            Err(err) => return Err(err).context("Removing state dir"),
+        }
+    }
+
+    info!("Removed {} file(s)", removed.len());
+
+    Ok(())
+}
+
+/// Remove the files tracked in the state and return the removed and the kept ones.
+/// Files modified since NMC stored them are kept unless `force` is set.
+fn remove_tracked_files(
+    state: &State,
+    force: bool,
+) -> Result<(Vec<PathBuf>, Vec<PathBuf>), anyhow::Error> {
+    let mut removed = Vec::new();
+    let mut kept = Vec::new();
+
+    for path in &state.connection_files {
+        if !path.exists() {
+            continue;
+        }
+
+        if let Some(expected) = state.checksums.get(path) {
+            let actual =
+                checksum(&Disk, path).with_context(|| format!("Computing checksum of {path:?}"))?;
+            if actual != *expected && !force {
+                warn!("Keeping {path:?} which was modified since NMC stored it, pass --force to remove it");
+                kept.push(path.clone());
+                continue;
+            }
+        }
+
+        fs::remove_file(path).with_context(|| format!("Removing {path:?}"))?;
+        info!("Removed {path:?}");
+        removed.push(path.clone());
+    }
+
+    Ok((removed, kept))
+}
+
+/// Returns the state tracking only the kept files.
+fn tracking_only(state: State, kept: &[PathBuf]) -> State {
+    State {
+        connection_files: kept.to_vec(),
+        checksums: state
+            .checksums
+            .into_iter()
+            .filter(|(path, _)| kept.contains(path))
+            .collect(),
+        ..state
+    }
+}
+
+/// Remove the files which NMC writes itself rather than taking them from the config.
+///
+/// The udev rules and systemd.link files are only removed if they still carry the header NMC generates them with.
+/// Those tracked in the state were already removed or kept along with the other tracked files.
+fn remove_generated_files(
+    no_auto_default_files: &[PathBuf],
+    udev_rules_file: &Path,
+    network_dir: &Path,
+    tracked_files: &[PathBuf],
+) -> Result<Vec<PathBuf>, anyhow::Error> {
+    let mut candidates = vec![udev_rules_file.to_path_buf()];
+
+    match fs::read_dir(network_dir) {
+        Ok(entries) => {
+            for entry in entries {
+                let path = entry.context("Reading systemd network dir")?.path();
+                if path
+                    .file_name()
+                    .and_then(|name| name.to_str())
+                    .is_some_and(|name| name.starts_with(LINK_FILE_PREFIX))
+                {
+                    candidates.push(path);
+                }
+            }
+        }
+        Err(err) if err.kind() == io::ErrorKind::NotFound => {}
+        Err(err) => return Err(err).context("Reading systemd network dir"),
+    }
+
+    let mut removed = Vec::new();
+
+    // The name of the drop-in is reserved by NMC, so it never belongs to anyone else.
+    for path in no_auto_default_files {
+        if path.exists() {
+            fs::remove_file(path).with_context(|| format!("Removing {path:?}"))?;
+            info!("Removed {path:?}");
+            removed.push(path.clone());
+        }
+    }
+
+    for path in candidates {
+        if tracked_files.contains(&path) {
+            continue;
+        }
+
+        match fs::read_to_string(&path) {
+            Ok(contents) if contents.starts_with(GENERATED_HEADER) => {
+                fs::remove_file(&path).with_context(|| format!("Removing {path:?}"))?;
+                info!("Removed {path:?}");
+                removed.push(path);
+            }
+            Ok(..) => warn!("Keeping {path:?} which was not generated by NMC"),
+            Err(err) if err.kind() == io::ErrorKind::NotFound => {}
+            Err(err) => return Err(err).with_context(|| format!("Reading {path:?}")),
+        }
+    }
+
+    Ok(removed)
+}
+
+/// Make NetworkManager drop the removed connections and pick up the drop-ins that are left.
+fn reload_network_manager() -> Result<(), anyhow::Error> {
+    for args in [["connection", "reload"], ["general", "reload"]] {
+        let status = deadline::status(Command::new("nmcli").args(args)).context("Running nmcli")?;
+        if !status.success() {
+            return Err(anyhow!("nmcli {} exited with {status}", args.join(" ")));
+        }
+    }
+
+    info!("Reloaded NetworkManager");
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::path::{Path, PathBuf};
+    use std::slice;
+
+    use crate::filesystem::Disk;
+    use crate::state::{checksum, State};
+    use crate::uninstall::{remove_generated_files, remove_tracked_files, tracking_only};
+
+    #[test]
+    fn remove_unmodified_tracked_files() {
+        let dir = Path::new("_uninstall_tracked");
+        fs::create_dir_all(dir).unwrap();
+
+        let eth0 = dir.join("eth0.nmconnection");
+        let eth1 = dir.join("eth1.nmconnection");
+        let missing = dir.join("eth2.nmconnection");
+        fs::write(&eth0, "[connection]\nid=eth0\n").unwrap();
+        fs::write(&eth1, "[connection]\nid=eth1\n").unwrap();
+
+        let state = State {
+            hostname: "node1".to_string(),
+            connection_files: vec![eth0.clone(), eth1.clone(), missing],
+            checksums: BTreeMap::from([
+                (eth0.clone(), checksum(&Disk, &eth0).unwrap()),
+                (eth1.clone(), checksum(&Disk, &eth1).unwrap()),
+            ]),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        };
+
+        // Modified by the operator after NMC stored it
+        fs::write(&eth1, "[connection]\nid=eth1\nautoconnect=false\n").unwrap();
+
+        assert_eq!(
+            remove_tracked_files(&state, false).unwrap(),
+            (vec![eth0.clone()], vec![eth1.clone()])
+        );
+        assert!(!eth0.exists());
+        assert!(eth1.exists());
+
+        // The kept file stays tracked along with its checksum
+        let state = tracking_only(state, slice::from_ref(&eth1));
+        assert_eq!(state.hostname, "node1");
+        assert_eq!(state.connection_files, vec![eth1.clone()]);
+        assert_eq!(state.checksums.keys().collect::<Vec<_>>(), vec![&eth1]);
+
+        // A later run with --force removes it
+        assert_eq!(
+            remove_tracked_files(&state, true).unwrap(),
+            (vec![eth1.clone()], Vec::new())
+        );
+        assert!(!eth1.exists());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn remove_files_generated_by_nmc() {
+        let dir = Path::new("_uninstall_generated");
+        let network_dir = dir.join("network");
+        fs::create_dir_all(&network_dir).unwrap();
+
+        let no_auto_default = dir.join("no-auto-default.conf");
+        let runtime_no_auto_default = dir.join("run").join("no-auto-default.conf");
+        let udev_rules = dir.join("70-nm-configurator.rules");
+        let link_file = network_dir.join("10-nm-configurator-eth0.link");
+        let edited_link_file = network_dir.join("10-nm-configurator-eth1.link");
+        let other_link_file = network_dir.join("50-other.link");
+
+        fs::write(&no_auto_default, "[main]\nno-auto-default=*\n").unwrap();
+        fs::create_dir_all(dir.join("run")).unwrap();
+        fs::write(&runtime_no_auto_default, "[main]\nno-auto-default=*\n").unwrap();
+        fs::write(
+            &udev_rules,
+            "# Generated by nm-configurator. Do not edit.\n",
+        )
+        .unwrap();
+        fs::write(&link_file, "# Generated by nm-configurator. Do not edit.\n").unwrap();
+        fs::write(&edited_link_file, "[Match]\n").unwrap();
+        fs::write(
+            &other_link_file,
+            "# Generated by nm-configurator. Do not edit.\n",
+        )
+        .unwrap();
+
+        let tracked_link_file = network_dir.join("10-nm-configurator-eth2.link");
+        fs::write(
+            &tracked_link_file,
+            "# Generated by nm-configurator. Do not edit.\n",
+        )
+        .unwrap();
+
+        let removed = remove_generated_files(
+            &[no_auto_default.clone(), runtime_no_auto_default.clone()],
+            &udev_rules,
+            &network_dir,
+            slice::from_ref(&tracked_link_file),
+        )
+        .unwrap();
+
+        assert_eq!(
+            removed,
+            vec![
+                no_auto_default,
+                runtime_no_auto_default,
+                udev_rules,
+                link_file.clone()
+            ]
+        );
+        assert!(!link_file.exists());
+        assert!(edited_link_file.exists());
+        assert!(other_link_file.exists());
+        // Kept as a modified tracked file, e.g. without --force
+        assert!(tracked_link_file.exists());
+
+        // Nothing left to remove
+        assert_eq!(
+            remove_generated_files(
+                &[dir.join("missing.conf")],
+                &dir.join("missing.rules"),
+                &PathBuf::from("_uninstall_missing"),
+                &[]
+            )
+            .unwrap(),
+            Vec::<PathBuf>::new()
+        );
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
@@ -0,0 +1,429 @@
+use std::collections::BTreeMap;
+use std::env;
+use std::fmt;
+use std::fs;
+
+use anyhow::{anyhow, Context};
+use log::warn;
+use serde::Deserialize;
+
+use crate::expand::{expand_vars, referenced_vars};
+use crate::file_filter::FileFilter;
+use crate::generate_conf::{read_desired_states, DesiredState};
+use crate::yaml;
+
+/// Variables available to the desired states of the hosts, e.g.
+///
+/// ```yaml
+/// common:
+///   DNS_SERVER: 10.0.0.53
+/// hosts:
+///   node1:
+///     VLAN_ID: 1365
+/// ```
+#[derive(Deserialize, Debug, Default)]
+#[serde(deny_unknown_fields)]
+pub(crate) struct Catalog {
+    /// Variables shared by all hosts.
+    #[serde(default)]
+    common: BTreeMap<String, Scalar>,
+    /// Variables per hostname, taking precedence over the common ones.
+    #[serde(default)]
+    hosts: BTreeMap<String, BTreeMap<String, Scalar>>,
+}
+
+#[derive(Deserialize, Debug)]
+#[serde(untagged)]
+pub(crate) enum Scalar {
+    Bool(bool),
+    Integer(i64),
+    Float(f64),
+    String(String),
+}
+
+impl fmt::Display for Scalar {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Scalar::Bool(value) => write!(f, "{value}"),
+            Scalar::Integer(value) => write!(f, "{value}"),
+            Scalar::Float(value) => write!(f, "{value}"),
+            Scalar::String(value) => write!(f, "{value}"),
+        }
+    }
+}
+
+/// Where the value of a variable referenced by a host comes from.
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Source {
+    Host,
+    Common,
+    Env,
+}
+
+impl Catalog {
+    pub(crate) fn load(path: &str) -> Result<Self, anyhow::Error> {
+        let file = fs::File::open(path).context("Opening variables file")?;
+        yaml::from_reader(file).context("Parsing variables file")
+    }
+
+    /// Expand the `${VAR}` references in the desired state of the given host.
+    pub(crate) fn expand(&self, hostname: &str, input: &str) -> Result<String, anyhow::Error> {
+        expand_vars(input, |name| {
+            self.lookup(hostname, name).map(|(value, _)| value)
+        })
+    }
+
+    /// Look up the variable in the host's variables, the common ones and the environment, in that order.
+    fn lookup(&self, hostname: &str, name: &str) -> Option<(String, Source)> {
+        if let Some(value) = self.hosts.get(hostname).and_then(|vars| vars.get(name)) {
+            return Some((value.to_string(), Source::Host));
+        }
+
+        if let Some(value) = self.common.get(name) {
+            return Some((value.to_string(), Source::Common));
+        }
+
+        env::var(name).ok().map(|value| (value, Source::Env))
+    }
+
+    fn defines(&self, hostname: &str, name: &str) -> bool {
+        self.common.contains_key(name)
+            || self
+                .hosts
+                .get(hostname)
+                .is_some_and(|vars| vars.contains_key(name))
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Usage {
+    /// Referenced by the host and defined in the given source.
+    Defined(Source),
+    /// Referenced by the host but not defined anywhere.
+    Missing,
+    /// Defined for the host in the catalog but not referenced by it.
+    Unused,
+    /// Neither referenced by nor defined for the host.
+    Irrelevant,
+}
+
+impl fmt::Display for Usage {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let value = match self {
+            Usage::Defined(Source::Host) => "host",
+            Usage::Defined(Source::Common) => "common",
+            Usage::Defined(Source::Env) => "env",
+            Usage::Missing => "MISSING",
+            Usage::Unused => "unused",
+            Usage::Irrelevant => "--",
+        };
+
+        f.pad(value)
+    }
+}
+
+/// Usage of every variable (rows) by every host (columns).
+struct Matrix {
+    hosts: Vec<String>,
+    variables: BTreeMap<String, Vec<Usage>>,
+}
+
+impl Matrix {
+    fn build(catalog: &Catalog, states: &[DesiredState]) -> Result<Self, anyhow::Error> {
+        let mut references = Vec::new();
+        for state in states {
+            let names = referenced_vars(&state.data)
+                .with_context(|| format!("Parsing variable references of '{}'", state.name()))?;
+            references.push(names);
+        }
+
+        let names = catalog
+            .common
+            .keys()
+            .chain(catalog.hosts.values().flat_map(BTreeMap::keys))
+            .chain(references.iter().flatten());
+
+        let mut variables = BTreeMap::new();
+        for name in names {
+            if variables.contains_key(name) {
+                continue;
+            }
+
+            let usages = states
+                .iter()
+                .zip(&references)
+                .map(|(state, referenced)| {
+                    if referenced.contains(name) {
+                        catalog
+                            .lookup(&state.hostname, name)
+                            .map_or(Usage::Missing, |(_, source)| Usage::Defined(source))
+                    } else if catalog.defines(&state.hostname, name) {
+                        Usage::Unused
+                    } else {
+                        Usage::Irrelevant
+                    }
+                })
+                .collect();
+
+            variables.insert(name.clone(), usages);
+        }
+
+        Ok(Matrix {
+            hosts: states.iter().map(DesiredState::name).collect(),
+            variables,
+        })
+    }
+
+    /// Hosts referencing undefined variables along with the names of the latter.
+    fn missing(&self) -> Vec<(&str, Vec<&str>)> {
+        self.hosts
+            .iter()
+            .enumerate()
+            .filter_map(|(index, host)| {
+                let names: Vec<&str> = self
+                    .variables
+                    .iter()
+                    .filter(|(_, usages)| usages[index] == Usage::Missing)
+                    .map(|(name, _)| name.as_str())
+                    .collect();
+
+                (!names.is_empty()).then_some((host.as_str(), names))
+            })
+            .collect()
+    }
+
+    /// Variables defined in the catalog which are not referenced by any host.
+    fn unused(&self) -> Vec<&str> {
+        self.variables
+            .iter()
+            .filter(|(_, usages)| {
+                usages
+                    .iter()
+                    .all(|usage| matches!(usage, Usage::Unused | Usage::Irrelevant))
+            })
+            .map(|(name, _)| name.as_str())
+            .collect()
+    }
+}
+
+impl fmt::Display for Matrix {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let name_width = self
+            .variables
+            .keys()
+            .map(String::len)
+            .chain(["VARIABLE".len()])
+            .max()
+            .unwrap_or_default();
+        let widths: Vec<usize> = self
+            .hosts
+            .iter()
+            .map(|host| host.len().max("MISSING".len()))
+            .collect();
+
+        let mut header = format!("{:name_width$}", "VARIABLE");
+        for (host, width) in self.hosts.iter().zip(&widths) {
+            header.push_str(&format!("  {host:width$}"));
+        }
+        writeln!(f, "{}", header.trim_end())?;
+
+        for (name, usages) in &self.variables {
+            let mut row = format!("{name:name_width$}");
+            for (usage, width) in usages.iter().zip(&widths) {
+                row.push_str(&format!("  {usage:width$}"));
+            }
+            writeln!(f, "{}", row.trim_end())?;
+        }
+
+        Ok(())
+    }
+}
+
+/// Ensure that every variable referenced by a host is defined for it,
+/// so that the generation does not fail midway. Unused variables are reported as warnings.
+pub(crate) fn check_variables(
+    catalog: &Catalog,
+    states: &[DesiredState],
+) -> Result<(), anyhow::Error> {
+    let matrix = Matrix::build(catalog, states)?;
+
+    for name in matrix.unused() {
+        warn!("Variable '{name}' is not referenced by any host");
+    }
+
+    let missing = matrix.missing();
+    if missing.is_empty() {
+        return Ok(());
+    }
+
+    let hosts: Vec<String> = missing
+        .iter()
+        .map(|(host, names)| format!("{host} ({})", names.join(", ")))
+        .collect();
+
+    Err(anyhow!("Undefined variables: {}", hosts.join(", ")))
+}
+
+/// Print which variables are referenced by and defined for which hosts in the `config_dir`.
+pub(crate) fn print_variables(
+    config_dir: &str,
+    vars_file: Option<&str>,
+    file_filter: &FileFilter,
+) -> Result<(), anyhow::Error> {
+    let catalog = match vars_file {
+        Some(path) => Catalog::load(path)?,
+        None => Catalog::default(),
+    };
+    let states = read_desired_states(config_dir, file_filter).context("Reading desired states")?;
+
+    print!("{}", Matrix::build(&catalog, &states)?);
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::path::PathBuf;
+
+    use crate::generate_conf::DesiredState;
+    use crate::variables::{check_variables, Catalog, Matrix, Scalar, Source, Usage};
+
+    fn catalog() -> Catalog {
+        Catalog {
+            common: BTreeMap::from([
+                (
+                    "DNS_SERVER".to_string(),
+                    Scalar::String("10.0.0.53".to_string()),
+                ),
+                (
+                    "NTP_SERVER".to_string(),
+                    Scalar::String("10.0.0.123".to_string()),
+                ),
+            ]),
+            hosts: BTreeMap::from([
+                (
+                    "node1".to_string(),
+                    BTreeMap::from([("VLAN_ID".to_string(), Scalar::Integer(1365))]),
+                ),
+                (
+                    "node2".to_string(),
+                    BTreeMap::from([
+                        ("VLAN_ID".to_string(), Scalar::Integer(1366)),
+                        (
+                            "DNS_SERVER".to_string(),
+                            Scalar::String("10.0.1.53".to_string()),
+                        ),
+                    ]),
+                ),
+            ]),
+        }
+    }
+
+    fn state(hostname: &str, data: &str) -> DesiredState {
+        DesiredState {
+            hostname: hostname.to_string(),
+            profile: None,
+            path: PathBuf::from(format!("{hostname}.yaml")),
+            data: data.to_string(),
+        }
+    }
+
+    #[test]
+    fn expand_host_variables() {
+        let catalog = catalog();
+        let input = "id: ${VLAN_ID}\ndns: ${DNS_SERVER}\n";
+
+        assert_eq!(
+            catalog.expand("node1", input).unwrap(),
+            "id: 1365\ndns: 10.0.0.53\n"
+        );
+        assert_eq!(
+            catalog.expand("node2", input).unwrap(),
+            "id: 1366\ndns: 10.0.1.53\n"
+        );
+        assert!(catalog.expand("node3", input).is_err());
+    }
+
+    #[test]
+    fn build_variable_matrix() {
+        let states = vec![
+            state("node1", "id: ${VLAN_ID}\ndns: ${DNS_SERVER}\n"),
+            state(
+                "node2",
+                "id: ${VLAN_ID}\ndns: ${DNS_SERVER}\nmtu: ${NMC_TEST_MTU}\n",
+            ),
+            state("node3", "id: ${VLAN_ID}\n"),
+        ];
+
+        let matrix = Matrix::build(&catalog(), &states).unwrap();
+
+        assert_eq!(matrix.hosts, vec!["node1", "node2", "node3"]);
+        assert_eq!(
+            matrix.variables,
+            BTreeMap::from([
+                (
+                    "DNS_SERVER".to_string(),
+                    vec![
+                        Usage::Defined(Source::Common),
+                        Usage::Defined(Source::Host),
+                        Usage::Unused
+                    ]
+                ),
+                (
+                    "NMC_TEST_MTU".to_string(),
+                    vec![Usage::Irrelevant, Usage::Missing, Usage::Irrelevant]
+                ),
+                (
+                    "NTP_SERVER".to_string(),
+                    vec![Usage::Unused, Usage::Unused, Usage::Unused]
+                ),
+                (
+                    "VLAN_ID".to_string(),
+                    vec![
+                        Usage::Defined(Source::Host),
+                        Usage::Defined(Source::Host),
+                        Usage::Missing
+                    ]
+                ),
+            ])
+        );
+
+        assert_eq!(
+            matrix.missing(),
+            vec![("node2", vec!["NMC_TEST_MTU"]), ("node3", vec!["VLAN_ID"])]
+        );
+        assert_eq!(matrix.unused(), vec!["NTP_SERVER"]);
+
+        assert_eq!(
+            matrix.to_string(),
+            "VARIABLE      node1    node2    node3\n\
+             DNS_SERVER    common   host     unused\n\
+             NMC_TEST_MTU  --       MISSING  --\n\
+             NTP_SERVER    unused   unused   unused\n\
+             VLAN_ID       host     host     MISSING\n"
+        );
+    }
+
+    #[test]
+    fn check_variables_of_all_hosts() {
+        let states = vec![
+            state("node1", "id: ${VLAN_ID}\n"),
+            state("node2", "id: ${VLAN_ID}\n"),
+        ];
+        assert!(check_variables(&catalog(), &states).is_ok());
+
+        let states = vec![
+            state("node1", "id: ${VLAN_ID}\nmtu: ${NMC_TEST_MTU}\n"),
+            state("node3", "id: ${VLAN_ID}\n"),
+        ];
+        let error = check_variables(&catalog(), &states).unwrap_err();
+        assert_eq!(
+            error.to_string(),
+            "Undefined variables: node1 (NMC_TEST_MTU), node3 (VLAN_ID)"
+        );
+
+        let states = vec![state("node1", "id: ${VLAN-ID}\n")];
+        assert!(check_variables(&catalog(), &states).is_err());
+    }
+}
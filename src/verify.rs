@@ -0,0 +1,748 @@
+use std::cmp::Reverse;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use anyhow::Context;
+use log::{debug, error, info, warn};
+
+use crate::ethtool::{verify_settings, ETHTOOL_SECTION};
+use crate::fallback::{restore_last_known_good, save_last_known_good};
+use crate::filesystem::Disk;
+use crate::keyfile::{is_keyfile, Keyfile};
+use crate::lock::{RunLock, LOCK_FILE};
+use crate::metrics::{unix_timestamp, write_metrics_file};
+use crate::nm_service::{activate_config, ServiceAction, INITRD_RELEASE};
+use crate::service_probe;
+use crate::state::{checksum, State};
+use crate::systemd::{notify_ready, notify_status};
+use crate::types::{Probe, Severity, Verification};
+
+const SYSFS_NET_DIR: &str = "/sys/class/net";
+
+/// Interval of checking whether a link came up.
+const LINK_POLL_INTERVAL: Duration = Duration::from_secs(1);
+
+#[derive(Default)]
+pub(crate) struct VerifyOptions {
+    /// Re-runs the verification periodically instead of only once.
+    pub(crate) interval: Option<Duration>,
+    /// File in Prometheus text format updated after each verification run.
+    pub(crate) metrics_file: Option<String>,
+    /// Restores the last successfully verified config if the verification fails.
+    pub(crate) fallback: bool,
+    /// Wait for a concurrent run to finish instead of failing when falling back is enabled.
+    pub(crate) wait_for_lock: bool,
+}
+
+/// Error returned when the stored config is not intact or its settings are not in effect.
+#[derive(Debug)]
+pub(crate) struct VerificationFailed(pub(crate) String);
+
+impl fmt::Display for VerificationFailed {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.0)
+    }
+}
+
+impl std::error::Error for VerificationFailed {}
+
+/// Results of a single verification run.
+#[derive(Debug, Default)]
+#[cfg_attr(test, derive(PartialEq))]
+struct Report {
+    /// Connection files stored during the last apply which no longer exist.
+    missing_profiles: usize,
+    /// Connection files stored during the last apply which were modified since.
+    modified_profiles: usize,
+    /// Interfaces whose ethtool settings are not in effect.
+    ethtool_mismatches: usize,
+    /// Interfaces whose link did not come up within their verification timeout.
+    link_failures: usize,
+    /// Probes of the services the host has to reach which failed.
+    probe_failures: usize,
+}
+
+impl Report {
+    fn failures(&self) -> usize {
+        self.missing_profiles
+            + self.modified_profiles
+            + self.ethtool_mismatches
+            + self.link_failures
+            + self.probe_failures
+    }
+}
+
+/// Verify that the connection profiles stored during the last apply are intact and
+/// that their settings are in effect on the local system (e.g. after NetworkManager activated them).
+///
+/// Runs indefinitely if an interval is configured, catching manual changes or disk corruption
+/// between applies. Failed runs are logged and reported via the metrics file in that case.
+///
+/// The stored files are kept as last-known-good config after each successful run.
+/// The service manager is notified once the initial run completed and about the result of each run.
+pub(crate) fn verify(
+    connections_dir: &str,
+    state_file: &str,
+    options: &VerifyOptions,
+) -> Result<(), anyhow::Error> {
+    let Some(interval) = options.interval else {
+        return verify_once(connections_dir, state_file, options);
+    };
+
+    info!("Verifying config every {}s", interval.as_secs());
+
+    notify_ready(&verify_logged(connections_dir, state_file, options));
+
+    loop {
+        thread::sleep(interval);
+        notify_status(&verify_logged(connections_dir, state_file, options));
+    }
+}
+
+/// Verify the config and return the logged result as status.
+fn verify_logged(connections_dir: &str, state_file: &str, options: &VerifyOptions) -> String {
+    match verify_once(connections_dir, state_file, options) {
+        Ok(..) => {
+            info!("Successfully verified config");
+            "Successfully verified config".to_string()
+        }
+        Err(err) => {
+            error!("Verifying config failed: {err:#}");
+            format!("Verifying config failed: {err:#}")
+        }
+    }
+}
+
+fn verify_once(
+    connections_dir: &str,
+    state_file: &str,
+    options: &VerifyOptions,
+) -> Result<(), anyhow::Error> {
+    // Restoring the last-known-good config writes the connections dir, racing with apply otherwise.
+    let _lock = options
+        .fallback
+        .then(|| RunLock::acquire(LOCK_FILE, options.wait_for_lock))
+        .transpose()?;
+
+    let result = run_checks(connections_dir, state_file);
+
+    if let Some(path) = &options.metrics_file {
+        write_metrics(path, result.as_ref().ok()).context("Writing metrics file")?;
+    }
+
+    conclude(result?, state_file, options.fallback)
+}
+
+/// Verify the config `apply` just activated, falling back to the last-known-good config if the verification fails.
+///
+/// Unlike `verify`, the run lock is not taken, since `apply` holds it already.
+pub(crate) fn verify_applied(connections_dir: &str, state_file: &str) -> Result<(), anyhow::Error> {
+    conclude(run_checks(connections_dir, state_file)?, state_file, true)
+}
+
+/// Keep the config as last-known-good if the verification succeeded, otherwise fail with its failures,
+/// restoring the last-known-good config first if falling back is enabled.
+fn conclude(report: Report, state_file: &str, fallback: bool) -> Result<(), anyhow::Error> {
+    let mut failures = Vec::new();
+    if report.missing_profiles > 0 {
+        failures.push(format!(
+            "{} stored profiles are missing",
+            report.missing_profiles
+        ));
+    }
+    if report.modified_profiles > 0 {
+        failures.push(format!(
+            "{} stored profiles were modified",
+            report.modified_profiles
+        ));
+    }
+    if report.ethtool_mismatches > 0 {
+        failures.push(format!(
+            "Ethtool settings are not in effect for {} interfaces",
+            report.ethtool_mismatches
+        ));
+    }
+    if report.link_failures > 0 {
+        failures.push(format!(
+            "Links of {} interfaces are not up",
+            report.link_failures
+        ));
+    }
+    if report.probe_failures > 0 {
+        failures.push(format!("{} probes failed", report.probe_failures));
+    }
+
+    if failures.is_empty() {
+        return save_last_known_good(&Disk, state_file).context("Keeping last-known-good config");
+    }
+
+    let mut message = failures.join(", ");
+    if fallback
+        && restore_last_known_good(&Disk, state_file).context("Restoring last-known-good config")?
+    {
+        warn!("Fell back to the last-known-good config");
+        message.push_str("; fell back to the last-known-good config");
+
+        // The restored files only take effect once NetworkManager activates them again.
+        activate_config(ServiceAction::Restart, true, INITRD_RELEASE)
+            .context("Activating the last-known-good config")?;
+    }
+
+    Err(VerificationFailed(message).into())
+}
+
+fn run_checks(connections_dir: &str, state_file: &str) -> Result<Report, anyhow::Error> {
+    let mut report = Report::default();
+
+    let policies = match State::load(&Disk, state_file).context("Loading state")? {
+        Some(state) => {
+            check_stored_files(&state, &mut report);
+            check_links(&state.verification, SYSFS_NET_DIR, &mut report);
+            check_probes(&state.probes, &mut report);
+            state.verification
+        }
+        None => {
+            info!("Skipping integrity verification: no state found");
+            BTreeMap::new()
+        }
+    };
+
+    check_ethtool_settings(connections_dir, &policies, &mut report)?;
+
+    Ok(report)
+}
+
+fn check_stored_files(state: &State, report: &mut Report) {
+    for path in &state.connection_files {
+        if !path.exists() {
+            warn!(file = &*path.to_string_lossy(); "Stored profile {path:?} is missing");
+            report.missing_profiles += 1;
+            continue;
+        }
+
+        let Some(expected) = state.checksums.get(path) else {
+            continue;
+        };
+
+        match checksum(&Disk, path) {
+            Ok(actual) if &actual == expected => {}
+            Ok(..) => {
+                warn!(
+                    file = &*path.to_string_lossy();
+                    "Stored profile {path:?} was modified since the last apply"
+                );
+                report.modified_profiles += 1;
+            }
+            Err(err) => {
+                warn!(
+                    file = &*path.to_string_lossy();
+                    "Failed to read stored profile {path:?}: {err}"
+                );
+                report.modified_profiles += 1;
+            }
+        }
+    }
+}
+
+/// Wait for the links of the interfaces declaring a verification policy to come up within their timeouts.
+fn check_links(
+    policies: &BTreeMap<String, Verification>,
+    sysfs_net_dir: &str,
+    report: &mut Report,
+) {
+    for (interface, policy) in policies {
+        if policy.severity == Severity::Ignore {
+            debug!("Skipping link verification of '{interface}': ignored");
+            continue;
+        }
+
+        let timeout = Duration::from_secs(policy.timeout);
+        if wait_for_link(sysfs_net_dir, interface, timeout) {
+            info!(interface = interface.as_str(); "Link of '{interface}' is up");
+            continue;
+        }
+
+        record_failure(
+            interface,
+            policy.severity,
+            &format!("Link of '{interface}' is not up after {}s", policy.timeout),
+            &mut report.link_failures,
+        );
+    }
+}
+
+fn wait_for_link(sysfs_net_dir: &str, interface: &str, timeout: Duration) -> bool {
+    let path = Path::new(sysfs_net_dir).join(interface).join("operstate");
+    let deadline = Instant::now() + timeout;
+
+    loop {
+        if fs::read_to_string(&path).is_ok_and(|state| state.trim() == "up") {
+            return true;
+        }
+
+        let now = Instant::now();
+        if now >= deadline {
+            return false;
+        }
+
+        thread::sleep(LINK_POLL_INTERVAL.min(deadline - now));
+    }
+}
+
+/// Probe the services the host has to reach once the links are up, e.g. its management endpoint.
+fn check_probes(probes: &[Probe], report: &mut Report) {
+    for probe in probes {
+        let description = service_probe::describe(probe);
+        if probe.severity == Severity::Ignore {
+            debug!("Skipping {description}: ignored");
+            continue;
+        }
+
+        let Err(err) = service_probe::run(probe) else {
+            info!("{description} succeeded");
+            continue;
+        };
+
+        let message = format!("{description} failed: {err:#}");
+        match probe.severity {
+            Severity::Critical => {
+                warn!("{message}");
+                report.probe_failures += 1;
+            }
+            _ => warn!("{message} (not failing the verification due to its severity)"),
+        }
+    }
+}
+
+/// Count the failed check of the interface unless its severity says otherwise.
+fn record_failure(interface: &str, severity: Severity, message: &str, failures: &mut usize) {
+    match severity {
+        Severity::Critical => {
+            warn!(interface = interface; "{message}");
+            *failures += 1;
+        }
+        Severity::Warn => {
+            warn!(interface = interface; "{message} (not failing the verification due to its severity)")
+        }
+        Severity::Ignore => debug!(interface = interface; "{message} (ignored)"),
+    }
+}
+
+/// Verify the ethtool settings of each interface.
+///
+/// Only one of the profiles of an interface is active at a time, so the settings are in effect
+/// if those of any of its profiles are. Otherwise, the mismatches of the preferred profile are reported.
+fn check_ethtool_settings(
+    connections_dir: &str,
+    policies: &BTreeMap<String, Verification>,
+    report: &mut Report,
+) -> Result<(), anyhow::Error> {
+    for (interface, keyfiles) in ethtool_profiles(connections_dir)? {
+        let interface = interface.as_str();
+
+        if !Path::new(SYSFS_NET_DIR).join(interface).exists() {
+            info!("Skipping ethtool verification of '{interface}': interface not present");
+            continue;
+        }
+
+        let mut mismatches = Vec::new();
+        for (index, keyfile) in keyfiles.iter().enumerate() {
+            let profile_mismatches = verify_settings(interface, keyfile)
+                .with_context(|| format!("Verifying ethtool settings of '{interface}'"))?;
+
+            if profile_mismatches.is_empty() {
+                mismatches.clear();
+                break;
+            }
+            if index == 0 {
+                mismatches = profile_mismatches;
+            }
+        }
+
+        if mismatches.is_empty() {
+            info!(interface = interface; "Ethtool settings of '{interface}' are in effect");
+            continue;
+        }
+
+        let mismatches: Vec<String> = mismatches.iter().map(ToString::to_string).collect();
+        record_failure(
+            interface,
+            policies
+                .get(interface)
+                .map_or(Severity::Critical, |policy| policy.severity),
+            &format!(
+                "Ethtool settings of '{interface}' differ: {}",
+                mismatches.join(", ")
+            ),
+            &mut report.ethtool_mismatches,
+        );
+    }
+
+    Ok(())
+}
+
+/// Returns the profiles with ethtool settings by interface, the preferred ones
+/// (i.e. with the highest autoconnect priority) first.
+fn ethtool_profiles(
+    connections_dir: &str,
+) -> Result<BTreeMap<String, Vec<Keyfile>>, anyhow::Error> {
+    let mut profiles: BTreeMap<String, Vec<Keyfile>> = BTreeMap::new();
+
+    for path in keyfile_paths(connections_dir)? {
+        let contents = fs::read_to_string(&path).context("Reading connection file")?;
+        let keyfile = Keyfile::parse(&contents);
+
+        if keyfile.entries(ETHTOOL_SECTION).next().is_none() {
+            continue;
+        }
+
+        let Some(interface) = keyfile.get("connection", "interface-name") else {
+            warn!("Skipping ethtool verification of {path:?}: no interface name");
+            continue;
+        };
+
+        profiles
+            .entry(interface.to_string())
+            .or_default()
+            .push(keyfile);
+    }
+
+    let priority = |keyfile: &Keyfile| {
+        keyfile
+            .get("connection", "autoconnect-priority")
+            .and_then(|priority| priority.parse::<i32>().ok())
+            .unwrap_or_default()
+    };
+    for keyfiles in profiles.values_mut() {
+        keyfiles.sort_by_key(|keyfile| Reverse(priority(keyfile)));
+    }
+
+    Ok(profiles)
+}
+
+fn keyfile_paths(dir: &str) -> Result<Vec<PathBuf>, anyhow::Error> {
+    let mut paths = Vec::new();
+
+    for entry in fs::read_dir(dir).context("Reading connections dir")? {
+        let path = entry?.path();
+        if is_keyfile(&path) {
+            paths.push(path);
+        }
+    }
+
+    paths.sort();
+
+    Ok(paths)
+}
+
+fn write_metrics(path: &str, report: Option<&Report>) -> Result<(), anyhow::Error> {
+    write_metrics_file(&Disk, path, &format_metrics(report, unix_timestamp()))
+}
+
+/// Format the results in Prometheus text format. A missing report denotes a run
+/// which could not be completed at all.
+fn format_metrics(report: Option<&Report>, timestamp: u64) -> String {
+    let success = report.is_some_and(|report| report.failures() == 0);
+
+    let mut metrics = String::new();
+    metrics.push_str("# HELP nmc_verify_success Whether the last verification run passed.\n");
+    metrics.push_str("# TYPE nmc_verify_success gauge\n");
+    metrics.push_str(&format!("nmc_verify_success {}\n", u8::from(success)));
+
+    if let Some(report) = report {
+        metrics
+            .push_str("# HELP nmc_verify_failures Failed checks of the last verification run.\n");
+        metrics.push_str("# TYPE nmc_verify_failures gauge\n");
+        for (check, failures) in [
+            ("missing_profile", report.missing_profiles),
+            ("modified_profile", report.modified_profiles),
+            ("ethtool", report.ethtool_mismatches),
+            ("link", report.link_failures),
+            ("probe", report.probe_failures),
+        ] {
+            metrics.push_str(&format!(
+                "nmc_verify_failures{{check=\"{check}\"}} {failures}\n"
+            ));
+        }
+    }
+
+    metrics.push_str(
+        "# HELP nmc_verify_last_run_timestamp_seconds Time of the last verification run.\n",
+    );
+    metrics.push_str("# TYPE nmc_verify_last_run_timestamp_seconds gauge\n");
+    metrics.push_str(&format!(
+        "nmc_verify_last_run_timestamp_seconds {timestamp}\n"
+    ));
+
+    metrics
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+    use std::fs;
+    use std::path::{Path, PathBuf};
+
+    use crate::filesystem::Disk;
+    use crate::state::{checksum, State};
+    use crate::types::{Probe, ProbeType, Severity, Verification};
+    use crate::verify::{
+        check_links, check_probes, check_stored_files, conclude, ethtool_profiles, format_metrics,
+        keyfile_paths, verify, write_metrics, Report, VerifyOptions,
+    };
+
+    #[test]
+    fn list_keyfile_paths() {
+        let paths = keyfile_paths("testdata/apply/node1").unwrap();
+
+        assert_eq!(paths.len(), 5);
+        assert_eq!(
+            paths[0],
+            PathBuf::from("testdata/apply/node1/bond0.nmconnection")
+        );
+        assert!(keyfile_paths("<missing>").is_err());
+    }
+
+    #[test]
+    fn group_ethtool_profiles_by_interface() {
+        let dir = Path::new("_ethtool_profiles");
+        fs::create_dir_all(dir).unwrap();
+        for (name, contents) in [
+            ("eth0", "[connection]\ninterface-name=eth0\n\n[ethtool]\nfeature-rx=true\n"),
+            (
+                "eth0@dhcp",
+                "[connection]\ninterface-name=eth0\nautoconnect-priority=-10\n\n[ethtool]\nfeature-rx=false\n",
+            ),
+            (
+                "eth0@backup",
+                "[connection]\ninterface-name=eth0\nautoconnect-priority=5\n\n[ethtool]\nfeature-tx=true\n",
+            ),
+            ("eth1", "[connection]\ninterface-name=eth1\n"),
+            ("bond0", "[ethtool]\nfeature-rx=true\n"),
+        ] {
+            fs::write(dir.join(format!("{name}.nmconnection")), contents).unwrap();
+        }
+
+        let profiles = ethtool_profiles(dir.to_str().unwrap()).unwrap();
+        assert_eq!(profiles.keys().collect::<Vec<_>>(), ["eth0"]);
+
+        let settings: Vec<Option<&str>> = profiles["eth0"]
+            .iter()
+            .map(|keyfile| keyfile.entries("ethtool").next().map(|(key, _)| key))
+            .collect();
+        assert_eq!(
+            settings,
+            [Some("feature-tx"), Some("feature-rx"), Some("feature-rx")]
+        );
+        assert_eq!(
+            profiles["eth0"][2].get("ethtool", "feature-rx"),
+            Some("false")
+        );
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn verify_profiles_without_ethtool_settings() {
+        assert!(verify(
+            "testdata/apply/node1",
+            "<missing>",
+            &VerifyOptions::default()
+        )
+        .is_ok());
+        assert!(verify("<missing>", "<missing>", &VerifyOptions::default()).is_err());
+    }
+
+    #[test]
+    fn check_stored_files_integrity() {
+        let dir = Path::new("_verify");
+        fs::create_dir_all(dir).unwrap();
+
+        let intact = dir.join("eth0.nmconnection");
+        let modified = dir.join("eth1.nmconnection");
+        let legacy = dir.join("eth2.nmconnection");
+        let missing = dir.join("eth3.nmconnection");
+
+        fs::write(&intact, "[connection]\nid=eth0\n").unwrap();
+        fs::write(&modified, "[connection]\nid=eth1\n").unwrap();
+        fs::write(&legacy, "[connection]\nid=eth2\n").unwrap();
+
+        let state = State {
+            hostname: "node1".to_string(),
+            connection_files: vec![
+                intact.clone(),
+                modified.clone(),
+                legacy.clone(),
+                missing.clone(),
+            ],
+            checksums: BTreeMap::from([
+                (intact.clone(), checksum(&Disk, &intact).unwrap()),
+                (modified.clone(), checksum(&Disk, &modified).unwrap()),
+                (missing.clone(), "abc123".to_string()),
+            ]),
+            verification: BTreeMap::new(),
+            probes: Vec::new(),
+        };
+
+        fs::write(&modified, "[connection]\nid=eth1\nautoconnect=false\n").unwrap();
+
+        let mut report = Report::default();
+        check_stored_files(&state, &mut report);
+
+        assert_eq!(
+            report,
+            Report {
+                missing_profiles: 1,
+                modified_profiles: 1,
+                ethtool_mismatches: 0,
+                link_failures: 0,
+                probe_failures: 0,
+            }
+        );
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn conclude_verification() {
+        let dir = Path::new("_verify_conclude");
+        fs::create_dir_all(dir).unwrap();
+        let state_file = dir.join("state.yaml");
+        let state_file = state_file.to_str().unwrap();
+
+        let profile = dir.join("eth0.nmconnection");
+        fs::write(&profile, "[connection]\nid=eth0\n").unwrap();
+        State {
+            hostname: "node1".to_string(),
+            connection_files: vec![profile.clone()],
+            checksums: BTreeMap::from([(profile.clone(), checksum(&Disk, &profile).unwrap())]),
+            ..State::default()
+        }
+        .save(&Disk, state_file)
+        .unwrap();
+
+        // Nothing to fall back to yet
+        let failed = Report {
+            modified_profiles: 1,
+            ..Report::default()
+        };
+        assert_eq!(
+            conclude(failed, state_file, true).unwrap_err().to_string(),
+            "1 stored profiles were modified"
+        );
+        assert!(!dir.join("last-known-good").exists());
+
+        conclude(Report::default(), state_file, false).unwrap();
+        assert!(dir.join("last-known-good").join("state.yaml").exists());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn check_links_by_severity() {
+        let dir = Path::new("_verify_links");
+        for (interface, operstate) in [("eth0", "up"), ("eth1", "down"), ("wwan0", "down")] {
+            fs::create_dir_all(dir.join(interface)).unwrap();
+            fs::write(
+                dir.join(interface).join("operstate"),
+                format!("{operstate}\n"),
+            )
+            .unwrap();
+        }
+
+        let policy = |timeout, severity| Verification { timeout, severity };
+        let policies = BTreeMap::from([
+            ("eth0".to_string(), policy(0, Severity::Critical)),
+            ("eth1".to_string(), policy(0, Severity::Critical)),
+            ("eth2".to_string(), policy(0, Severity::Ignore)),
+            ("wwan0".to_string(), policy(1, Severity::Warn)),
+        ]);
+
+        let mut report = Report::default();
+        check_links(&policies, dir.to_str().unwrap(), &mut report);
+
+        assert_eq!(report.link_failures, 1);
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn check_probes_by_severity() {
+        let probe = |target: &str, severity| Probe {
+            probe_type: ProbeType::Dns,
+            target: target.to_string(),
+            timeout: 2,
+            severity,
+        };
+        let probes = [
+            probe("localhost", Severity::Critical),
+            probe("nmc.invalid", Severity::Critical),
+            probe("nmc.invalid", Severity::Warn),
+            probe("nmc.invalid", Severity::Ignore),
+        ];
+
+        let mut report = Report::default();
+        check_probes(&probes, &mut report);
+
+        assert_eq!(report.probe_failures, 1);
+    }
+
+    #[test]
+    fn format_metrics_successfully() {
+        let report = Report {
+            missing_profiles: 0,
+            modified_profiles: 2,
+            ethtool_mismatches: 0,
+            link_failures: 1,
+            probe_failures: 0,
+        };
+
+        assert_eq!(
+            format_metrics(Some(&report), 1700000000),
+            "# HELP nmc_verify_success Whether the last verification run passed.\n\
+             # TYPE nmc_verify_success gauge\n\
+             nmc_verify_success 0\n\
+             # HELP nmc_verify_failures Failed checks of the last verification run.\n\
+             # TYPE nmc_verify_failures gauge\n\
+             nmc_verify_failures{check=\"missing_profile\"} 0\n\
+             nmc_verify_failures{check=\"modified_profile\"} 2\n\
+             nmc_verify_failures{check=\"ethtool\"} 0\n\
+             nmc_verify_failures{check=\"link\"} 1\n\
+             nmc_verify_failures{check=\"probe\"} 0\n\
+             # HELP nmc_verify_last_run_timestamp_seconds Time of the last verification run.\n\
+             # TYPE nmc_verify_last_run_timestamp_seconds gauge\n\
+             nmc_verify_last_run_timestamp_seconds 1700000000\n"
+        );
+
+        let metrics = format_metrics(Some(&Report::default()), 1700000000);
+        assert!(metrics.contains("nmc_verify_success 1\n"));
+
+        let metrics = format_metrics(None, 1700000000);
+        assert!(metrics.contains("nmc_verify_success 0\n"));
+        assert!(!metrics.contains("nmc_verify_failures"));
+    }
+
+    #[test]
+    fn write_metrics_file() {
+        let dir = Path::new("_metrics");
+        fs::create_dir_all(dir).unwrap();
+        let path = dir.join("nmc.prom");
+
+        write_metrics(path.to_str().unwrap(), None).unwrap();
+
+        let metrics = fs::read_to_string(&path).unwrap();
+        assert!(metrics.starts_with("# HELP nmc_verify_success"));
+        assert_eq!(fs::read_dir(dir).unwrap().count(), 1);
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
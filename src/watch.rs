@@ -0,0 +1,160 @@
+use std::fs;
+use std::path::Path;
+use std::thread;
+use std::time::Duration;
+
+use anyhow::{anyhow, Context};
+use log::{error, info, warn};
+use sha2::{Digest, Sha256};
+
+use crate::apply_conf::{apply, ApplyOptions};
+use crate::bundle::Encryption;
+use crate::filesystem::Disk;
+use crate::systemd::{notify_ready, notify_status};
+
+/// Apply the config and keep re-applying it whenever the contents of the config dir change.
+///
+/// The config dir is polled in the given interval. A change is only applied once the contents
+/// remained the same for a whole interval, so that a partially copied config is never applied.
+/// Failed runs are logged and retried with the next change, leaving the previously stored files in place.
+///
+/// The service manager is notified once the initial run completed and about the result of each run.
+pub(crate) fn watch(
+    source_dir: &str,
+    options: &ApplyOptions,
+    interval: Duration,
+) -> Result<(), anyhow::Error> {
+    if Encryption::detect(source_dir).is_some() {
+        return Err(anyhow!(
+            "Watching encrypted config bundles is not supported"
+        ));
+    }
+
+    info!(
+        "Watching {source_dir:?} for changes every {}s",
+        interval.as_secs()
+    );
+
+    let mut applied = dir_digest(Path::new(source_dir)).context("Reading config dir")?;
+    notify_ready(&apply_logged(source_dir, options));
+
+    let mut pending: Option<String> = None;
+
+    loop {
+        thread::sleep(interval);
+
+        let digest = match dir_digest(Path::new(source_dir)) {
+            Ok(digest) => digest,
+            Err(err) => {
+                warn!("Failed to read config dir: {err}");
+                continue;
+            }
+        };
+
+        if digest == applied {
+            pending = None;
+            continue;
+        }
+
+        if pending.as_ref() != Some(&digest) {
+            info!("Detected config change, waiting for it to settle");
+            pending = Some(digest);
+            continue;
+        }
+
+        applied = digest;
+        pending = None;
+        notify_status(&apply_logged(source_dir, options));
+    }
+}
+
+/// Apply the config and return the logged result as status.
+fn apply_logged(source_dir: &str, options: &ApplyOptions) -> String {
+    match apply(source_dir, options, &Disk) {
+        Ok(..) => {
+            info!("Successfully applied config");
+            "Successfully applied config".to_string()
+        }
+        Err(err) => {
+            error!("Applying config failed: {err:#}");
+            format!("Applying config failed: {err:#}")
+        }
+    }
+}
+
+/// Returns a hex encoded SHA-256 digest over the relative paths and contents of all files in the dir.
+fn dir_digest(dir: &Path) -> Result<String, anyhow::Error> {
+    let mut hasher = Sha256::new();
+    hash_dir(dir, dir, &mut hasher)?;
+
+    Ok(hasher
+        .finalize()
+        .iter()
+        .map(|byte| format!("{byte:02x}"))
+        .collect())
+}
+
+fn hash_dir(root: &Path, dir: &Path, hasher: &mut Sha256) -> Result<(), anyhow::Error> {
+    let mut paths = fs::read_dir(dir)?
+        .map(|entry| entry.map(|entry| entry.path()))
+        .collect::<Result<Vec<_>, _>>()?;
+    paths.sort();
+
+    for path in paths {
+        if path.is_dir() {
+            hash_dir(root, &path, hasher)?;
+            continue;
+        }
+
+        let relative = path.strip_prefix(root).unwrap_or(&path);
+        let contents = fs::read(&path).with_context(|| format!("Reading {path:?}"))?;
+
+        // Length prefixes keep the boundaries between the paths and contents unambiguous.
+        for data in [relative.as_os_str().as_encoded_bytes(), &contents] {
+            hasher.update((data.len() as u64).to_le_bytes());
+            hasher.update(data);
+        }
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+
+    use crate::watch::dir_digest;
+
+    #[test]
+    fn dir_digest_detects_changes() {
+        let dir = Path::new("_watch");
+        fs::create_dir_all(dir.join("node1")).unwrap();
+        fs::write(dir.join("host_config.yaml"), "- hostname: node1\n").unwrap();
+        fs::write(dir.join("node1/eth0.nmconnection"), "[connection]\n").unwrap();
+
+        let digest = dir_digest(dir).unwrap();
+        assert_eq!(digest.len(), 64);
+        assert_eq!(dir_digest(dir).unwrap(), digest);
+
+        fs::write(
+            dir.join("node1/eth0.nmconnection"),
+            "[connection]\nid=eth0\n",
+        )
+        .unwrap();
+        let modified = dir_digest(dir).unwrap();
+        assert_ne!(modified, digest);
+
+        fs::rename(
+            dir.join("node1/eth0.nmconnection"),
+            dir.join("node1/eth1.nmconnection"),
+        )
+        .unwrap();
+        assert_ne!(dir_digest(dir).unwrap(), modified);
+
+        assert!(dir_digest(Path::new("<missing>")).is_err());
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
@@ -0,0 +1,151 @@
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::process;
+
+use anyhow::Context;
+use log::{debug, warn};
+
+/// Directory next to the state file holding the workspaces of the runs.
+const WORKSPACES_DIR: &str = "work";
+const WORKSPACE_PREFIX: &str = "run-";
+
+/// Returns the directory holding the workspaces, next to the state file so that files staged there
+/// can be moved in place atomically.
+pub(crate) fn workspaces_dir(state_file: &str) -> PathBuf {
+    Path::new(state_file)
+        .parent()
+        .unwrap_or(Path::new(""))
+        .join(WORKSPACES_DIR)
+}
+
+/// Directory holding the temporary files of a run, removed along with its contents when dropped.
+///
+/// Runs which were interrupted (e.g. by a power loss or SIGKILL) never get to drop theirs,
+/// so the workspaces left behind are removed by the next run. Workspaces are named after the PID
+/// of their run, telling the stale ones apart from the ones of concurrent runs.
+pub(crate) struct Workspace {
+    path: PathBuf,
+}
+
+impl Workspace {
+    /// Create the workspace of this run in `dir`, recovering the stale ones first.
+    pub(crate) fn create(dir: &Path) -> Result<Self, anyhow::Error> {
+        recover(dir)?;
+
+        let path = dir.join(format!("{WORKSPACE_PREFIX}{}", process::id()));
+        fs::create_dir_all(&path).context("Creating workspace")?;
+        debug!("Created workspace {path:?}");
+
+        Ok(Workspace { path })
+    }
+
+    /// Returns the path of a new, empty directory within the workspace.
+    pub(crate) fn dir(&self, name: &str) -> Result<PathBuf, anyhow::Error> {
+        let path = self.path.join(name);
+        fs::create_dir(&path).with_context(|| format!("Creating {path:?}"))?;
+
+        Ok(path)
+    }
+}
+
+impl Drop for Workspace {
+    fn drop(&mut self) {
+        match fs::remove_dir_all(&self.path) {
+            Ok(..) => debug!("Removed workspace {:?}", self.path),
+            Err(err) => warn!("Failed to remove workspace {:?}: {err}", self.path),
+        }
+    }
+}
+
+/// Remove the workspaces left behind by interrupted runs, i.e. those of processes which no longer exist,
+/// along with any other entries not belonging to a run. Returns how many were removed.
+pub(crate) fn recover(dir: &Path) -> Result<usize, anyhow::Error> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(0),
+        Err(err) => return Err(err).context("Reading workspaces dir"),
+    };
+
+    let mut removed = 0;
+
+    for entry in entries {
+        let path = entry.context("Reading workspaces dir")?.path();
+
+        let owner = path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .and_then(|name| name.strip_prefix(WORKSPACE_PREFIX))
+            .and_then(|pid| pid.parse::<libc::pid_t>().ok());
+        if owner.is_some_and(is_running) {
+            debug!("Keeping workspace {path:?} of a running process");
+            continue;
+        }
+
+        warn!("Removing stale workspace {path:?} of an interrupted run");
+        if path.is_dir() {
+            fs::remove_dir_all(&path)
+        } else {
+            fs::remove_file(&path)
+        }
+        .with_context(|| format!("Removing stale workspace {path:?}"))?;
+
+        removed += 1;
+    }
+
+    Ok(removed)
+}
+
+fn is_running(pid: libc::pid_t) -> bool {
+    // Signal 0 only checks whether the process exists. EPERM means it does, but belongs to another user.
+    let result = unsafe { libc::kill(pid, 0) };
+
+    result == 0 || io::Error::last_os_error().raw_os_error() == Some(libc::EPERM)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::Path;
+    use std::process;
+
+    use crate::workspace::{recover, workspaces_dir, Workspace};
+
+    #[test]
+    fn workspaces_dir_next_to_state_file() {
+        assert_eq!(
+            workspaces_dir("/var/lib/nm-configurator/state.yaml"),
+            Path::new("/var/lib/nm-configurator/work")
+        );
+    }
+
+    #[test]
+    fn recover_stale_workspaces() {
+        let dir = Path::new("_workspaces");
+        assert_eq!(recover(dir).unwrap(), 0);
+
+        // Left behind by interrupted runs, PIDs are capped well below i32::MAX
+        let stale = dir.join(format!("run-{}", i32::MAX));
+        fs::create_dir_all(stale.join("last-known-good")).unwrap();
+        fs::write(stale.join("last-known-good/eth0.nmconnection"), "").unwrap();
+        fs::write(dir.join("stray"), "").unwrap();
+        // Owned by a running process
+        fs::create_dir_all(dir.join("run-1")).unwrap();
+
+        let workspace = Workspace::create(dir).unwrap();
+        assert!(!stale.exists());
+        assert!(!dir.join("stray").exists());
+        assert!(dir.join("run-1").exists());
+        assert!(dir.join(format!("run-{}", process::id())).exists());
+
+        let staging = workspace.dir("staging").unwrap();
+        fs::write(staging.join("eth0.nmconnection"), "").unwrap();
+        assert!(workspace.dir("staging").is_err());
+
+        drop(workspace);
+        assert_eq!(fs::read_dir(dir).unwrap().count(), 1);
+
+        // cleanup
+        fs::remove_dir_all(dir).unwrap();
+    }
+}
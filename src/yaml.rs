@@ -0,0 +1,226 @@
+use std::io::Read;
+
+use anyhow::{anyhow, Context};
+use serde::de::DeserializeOwned;
+use serde_yaml::Value;
+
+/// Key merging the entries of the referenced mapping(s) into the surrounding one, e.g.
+/// `<<: *defaults` or `<<: [*defaults, *uplink]`.
+const MERGE_KEY: &str = "<<";
+
+/// Deserialize YAML after resolving its merge keys, which serde_yaml does not apply on its own.
+pub(crate) fn from_reader<T: DeserializeOwned>(reader: impl Read) -> Result<T, anyhow::Error> {
+    let mut value: Value = serde_yaml::from_reader(reader)?;
+    resolve_merge_keys(&mut value)?;
+
+    Ok(serde_yaml::from_value(value)?)
+}
+
+/// Resolve the merge keys of a YAML document which is parsed by another library (e.g. nmstate).
+///
+/// Documents without merge keys are returned unchanged to keep their formatting intact.
+pub(crate) fn merge_keys(data: &str) -> Result<String, anyhow::Error> {
+    if !data.contains(MERGE_KEY) {
+        return Ok(data.to_string());
+    }
+
+    let mut value: Value = serde_yaml::from_str(data).context("Parsing YAML")?;
+    resolve_merge_keys(&mut value)?;
+
+    serde_yaml::to_string(&value).context("Serializing YAML")
+}
+
+/// Recursively replace the merge keys with the entries of the mappings they reference.
+///
+/// Keys present in the surrounding mapping take precedence over the merged ones and,
+/// when merging a list of mappings, earlier mappings take precedence over later ones.
+/// Merge keys of the referenced mappings are resolved first, so chained merges keep all of their entries.
+fn resolve_merge_keys(value: &mut Value) -> Result<(), anyhow::Error> {
+    match value {
+        Value::Mapping(mapping) => {
+            if let Some(merge) = mapping.remove(MERGE_KEY) {
+                let sources = match merge {
+                    Value::Sequence(sources) => sources,
+                    source => vec![source],
+                };
+
+                for mut source in sources {
+                    resolve_merge_keys(&mut source)?;
+
+                    let Value::Mapping(source) = source else {
+                        return Err(anyhow!(
+                            "Merge key must reference a mapping or a list of mappings"
+                        ));
+                    };
+
+                    for (key, value) in source {
+                        mapping.entry(key).or_insert(value);
+                    }
+                }
+            }
+
+            for value in mapping.values_mut() {
+                resolve_merge_keys(value)?;
+            }
+        }
+        Value::Sequence(sequence) => {
+            for value in sequence {
+                resolve_merge_keys(value)?;
+            }
+        }
+        Value::Tagged(tagged) => resolve_merge_keys(&mut tagged.value)?,
+        _ => {}
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_yaml::Value;
+
+    use crate::types::{Host, Interface};
+    use crate::yaml::{from_reader, merge_keys, resolve_merge_keys};
+
+    fn resolve(data: &str) -> Value {
+        let mut value: Value = serde_yaml::from_str(data).unwrap();
+        resolve_merge_keys(&mut value).unwrap();
+        value
+    }
+
+    #[test]
+    fn resolve_merge_key() {
+        let value = resolve(
+            r#"
+defaults: &defaults
+  interface_type: ethernet
+  management: true
+eth0:
+  <<: *defaults
+  management: false
+"#,
+        );
+
+        assert_eq!(value["eth0"]["interface_type"], "ethernet");
+        assert_eq!(value["eth0"]["management"], false);
+    }
+
+    #[test]
+    fn resolve_list_of_merge_keys() {
+        let value = resolve(
+            r#"
+ethernet: &ethernet
+  interface_type: ethernet
+  description: ethernet
+uplink: &uplink
+  description: uplink
+  management: true
+eth0:
+  <<: [*uplink, *ethernet]
+"#,
+        );
+
+        assert_eq!(value["eth0"]["interface_type"], "ethernet");
+        assert_eq!(value["eth0"]["description"], "uplink");
+        assert_eq!(value["eth0"]["management"], true);
+    }
+
+    #[test]
+    fn resolve_chained_merge_keys() {
+        let value = resolve(
+            r#"
+base: &base
+  interface_type: ethernet
+uplink: &uplink
+  <<: *base
+  management: true
+eth0:
+  <<: *uplink
+  logical_name: eth0
+nested:
+  - interfaces:
+      - <<: *uplink
+"#,
+        );
+
+        assert_eq!(value["eth0"]["interface_type"], "ethernet");
+        assert_eq!(value["eth0"]["management"], true);
+        assert_eq!(value["eth0"]["logical_name"], "eth0");
+        assert!(value["eth0"].get("<<").is_none());
+        assert_eq!(
+            value["nested"][0]["interfaces"][0]["interface_type"],
+            "ethernet"
+        );
+    }
+
+    #[test]
+    fn resolve_invalid_merge_keys() {
+        for data in ["eth0:\n  <<: ethernet\n", "eth0:\n  <<: [[a, b]]\n"] {
+            let mut value: Value = serde_yaml::from_str(data).unwrap();
+            assert!(resolve_merge_keys(&mut value).is_err());
+        }
+    }
+
+    #[test]
+    fn load_hosts_with_anchors_and_merge_keys() {
+        let data = r#"
+- hostname: node1
+  interfaces:
+    - &eth0
+      logical_name: eth0
+      mac_address: "00:11:22:33:44:55"
+      <<: &ethernet
+        interface_type: ethernet
+    - <<: [*eth0, *ethernet]
+      logical_name: eth1
+      mac_address: "00:11:22:33:44:56"
+- hostname: node2
+  interfaces:
+    - <<: *eth0
+      mac_address: "00:11:22:33:44:57"
+      management: true
+"#;
+
+        let hosts: Vec<Host> = from_reader(data.as_bytes()).unwrap();
+
+        let interface = |logical_name: &str, mac_address: &str, management: bool| Interface {
+            logical_name: logical_name.to_string(),
+            mac_address: Option::from(mac_address.to_string()),
+            interface_type: "ethernet".to_string(),
+            management,
+            ..Default::default()
+        };
+        assert_eq!(
+            hosts,
+            vec![
+                Host {
+                    hostname: "node1".to_string(),
+                    interfaces: vec![
+                        interface("eth0", "00:11:22:33:44:55", false),
+                        interface("eth1", "00:11:22:33:44:56", false),
+                    ],
+                    ..Default::default()
+                },
+                Host {
+                    hostname: "node2".to_string(),
+                    interfaces: vec![interface("eth0", "00:11:22:33:44:57", true)],
+                    ..Default::default()
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn merge_keys_of_document() {
+        let data = "interfaces:\n- name: eth0\n  type: ethernet\n";
+        assert_eq!(merge_keys(data).unwrap(), data);
+
+        let merged = merge_keys(
+            "defaults: &defaults\n  type: ethernet\ninterfaces:\n- name: eth0\n  <<: *defaults\n",
+        )
+        .unwrap();
+        let value: Value = serde_yaml::from_str(&merged).unwrap();
+        assert_eq!(value["interfaces"][0]["type"], "ethernet");
+        assert!(!merged.contains("<<"));
+    }
+}